@@ -0,0 +1,238 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	benchWell = `bench`
+)
+
+// benchPhase summarizes the push or pull phase of a benchmark
+type benchPhase struct {
+	Phase       string
+	Shards      int
+	OK          int
+	Elapsed     time.Duration
+	MBPerSecond float64
+	Latency     *benchLatency `json:",omitempty"`
+	Codes       map[int]int   //HTTP status to count, zero means no response
+	Errors      []string      `json:",omitempty"`
+}
+
+type benchLatency struct {
+	Min time.Duration
+	Avg time.Duration
+	P50 time.Duration
+	P95 time.Duration
+	Max time.Duration
+}
+
+// benchResult is the outcome of a single shard transfer
+type benchResult struct {
+	latency time.Duration
+	code    int //HTTP status, zero if the request never got a response
+	err     error
+}
+
+// Bench pushes and then pulls a set of synthetic shards, reporting throughput,
+// latency, and the server response codes for each phase
+func Bench(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	if *fBenchMB <= 0 || *fBenchShards <= 0 || *fBenchWorkers <= 0 {
+		return errors.New("bench size, shard count, and worker count must be positive")
+	}
+	var tps []tags.TagPair
+	if tps, err = tm.TagSet(); err != nil {
+		return
+	}
+	var dir string
+	if dir, err = ioutil.TempDir(``, `cloudarchive-bench`); err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	size := int64(*fBenchMB) << 20
+	lgr.Infof("generating %d synthetic shards of %d MB", *fBenchShards, *fBenchMB)
+	var shards []string
+	if shards, err = makeBenchShards(filepath.Join(dir, `push`), *fBenchShards, size); err != nil {
+		return
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+
+	lgr.Infof("pushing to indexer %v with %d workers", guid, *fBenchWorkers)
+	res, elapsed := runBench(shards, func(shard string) error {
+		sid := client.ShardID{Indexer: guid, Well: benchWell, Shard: shard}
+		return cli.PushShard(sid, filepath.Join(dir, `push`, shard), tps, nil, ctx)
+	})
+	phases := []benchPhase{summarizeBench(`push`, res, elapsed, size)}
+
+	pullDir := filepath.Join(dir, `pull`)
+	lgr.Infof("pulling with %d workers", *fBenchWorkers)
+	res, elapsed = runBench(shards, func(shard string) error {
+		sid := client.ShardID{Indexer: guid, Well: benchWell, Shard: shard}
+		return cli.PullShard(sid, filepath.Join(pullDir, shard), ctx)
+	})
+	phases = append(phases, summarizeBench(`pull`, res, elapsed, size))
+	err = emit(phases, func() {
+		for _, bp := range phases {
+			printBenchPhase(lgr, bp)
+		}
+	})
+	return
+}
+
+// makeBenchShards creates count shards under dir, each with a store file of random data
+// shard IDs count backwards from the current shard so they never land in the future
+func makeBenchShards(dir string, count int, size int64) (shards []string, err error) {
+	data := make([]byte, size)
+	if _, err = rand.Read(data); err != nil {
+		return
+	}
+	curr := int64(util.GetShardId(time.Now())) >> 17
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("%x", curr-int64(i))
+		p := filepath.Join(dir, id)
+		if err = os.MkdirAll(p, 0770); err != nil {
+			return
+		}
+		if err = ioutil.WriteFile(filepath.Join(p, id+`.store`), data, 0660); err != nil {
+			return
+		} else if err = ioutil.WriteFile(filepath.Join(p, id+`.index`), data[:size/16], 0660); err != nil {
+			return
+		} else if err = ioutil.WriteFile(filepath.Join(p, id+`.verify`), data[:64], 0660); err != nil {
+			return
+		}
+		shards = append(shards, id)
+	}
+	return
+}
+
+// runBench executes op for every shard using the configured number of workers
+func runBench(shards []string, op func(string) error) (res []benchResult, elapsed time.Duration) {
+	ch := make(chan string, len(shards))
+	for _, s := range shards {
+		ch <- s
+	}
+	close(ch)
+
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *fBenchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range ch {
+				ts := time.Now()
+				err := op(s)
+				r := benchResult{latency: time.Since(ts), err: err}
+				var se *client.StatusError
+				if err == nil {
+					r.code = http.StatusOK
+				} else if errors.As(err, &se) {
+					r.code = se.Code
+				}
+				mtx.Lock()
+				res = append(res, r)
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed = time.Since(start)
+	return
+}
+
+func summarizeBench(phase string, res []benchResult, elapsed time.Duration, size int64) (bp benchPhase) {
+	bp = benchPhase{
+		Phase:   phase,
+		Shards:  len(res),
+		Elapsed: elapsed,
+		Codes:   map[int]int{},
+	}
+	lats := make([]time.Duration, 0, len(res))
+	for _, r := range res {
+		bp.Codes[r.code]++
+		if r.err != nil {
+			bp.Errors = append(bp.Errors, r.err.Error())
+			continue
+		}
+		bp.OK++
+		lats = append(lats, r.latency)
+	}
+	bp.MBPerSecond = float64(int64(bp.OK)*size) / float64(1<<20) / elapsed.Seconds()
+	if len(lats) > 0 {
+		sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+		var total time.Duration
+		for _, l := range lats {
+			total += l
+		}
+		bp.Latency = &benchLatency{
+			Min: lats[0],
+			Avg: total / time.Duration(len(lats)),
+			P50: percentile(lats, 50),
+			P95: percentile(lats, 95),
+			Max: lats[len(lats)-1],
+		}
+	}
+	return
+}
+
+func printBenchPhase(lgr *log.Logger, bp benchPhase) {
+	for _, e := range bp.Errors {
+		lgr.Warnf("%s failed: %v", bp.Phase, e)
+	}
+	lgr.Infof("%s: %d/%d shards in %v, %.2f MB/s", bp.Phase, bp.OK, bp.Shards, bp.Elapsed.Round(time.Millisecond), bp.MBPerSecond)
+	if l := bp.Latency; l != nil {
+		lgr.Infof("%s latency: min %v avg %v p50 %v p95 %v max %v", bp.Phase,
+			l.Min.Round(time.Millisecond), l.Avg.Round(time.Millisecond), l.P50.Round(time.Millisecond),
+			l.P95.Round(time.Millisecond), l.Max.Round(time.Millisecond))
+	}
+	keys := make([]int, 0, len(bp.Codes))
+	for k := range bp.Codes {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		if k == 0 {
+			lgr.Infof("%s responses: %d with no response", bp.Phase, bp.Codes[k])
+		} else {
+			lgr.Infof("%s responses: %d x %d %s", bp.Phase, bp.Codes[k], k, http.StatusText(k))
+		}
+	}
+}
+
+// percentile returns the p'th percentile of a sorted list
+func percentile(lats []time.Duration, p int) time.Duration {
+	idx := (len(lats)*p + 99) / 100
+	if idx > 0 {
+		idx--
+	}
+	return lats[idx]
+}
@@ -0,0 +1,169 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var (
+	fStart        *string
+	fEnd          *string
+	fYes          *bool
+	fBenchMB      *int
+	fBenchShards  *int
+	fBenchWorkers *int
+)
+
+// addCommands attaches every subcommand to the root command
+func addCommands(root *cobra.Command) {
+	root.AddCommand(&cobra.Command{
+		Use:   `push <shard path>`,
+		Short: `Push a shard to the server`,
+		Long: `Push a single shard directory to the server.  The well and shard ID are taken from the
+last two components of the path, which must be laid out as <well>/<shard> just as an
+indexer stores it.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeDirs(1),
+		RunE:              session(PushShard),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `pushall <indexer storage path>`,
+		Short: `Push every shard under an indexer storage directory`,
+		Long: `Walk every well under an indexer storage directory and push each shard which is not
+already on the server.  Use --parallel to run several pushes at once.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeDirs(1),
+		RunE:              session(PushAllShards),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:               `pull --uuid <indexer> --well <well> --shard <shard> <store path>`,
+		Short:             `Pull a shard from the server`,
+		Long:              `Pull a single shard into <store path>/<shard>.  The indexer, well, and shard are selected with --uuid, --well, and --shard.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeDirs(1),
+		RunE:              session(PullShard, `uuid`, `well`, `shard`),
+	})
+	pullWell := &cobra.Command{
+		Use:   `pullwell --uuid <indexer> --well <well> <indexer storage path>`,
+		Short: `Pull every shard of a well`,
+		Long: `Pull every shard of a well within a time range into a storage directory, laid out as
+<storage path>/<well>/<shard> just as an indexer expects.  Shards already present are
+skipped, so an interrupted pull can simply be rerun.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeDirs(1),
+		RunE:              session(PullWell, `uuid`, `well`),
+	}
+	fStart = pullWell.Flags().String("start", "", "Start of the time range, RFC3339.  Defaults to the start of the well")
+	fEnd = pullWell.Flags().String("end", "", "End of the time range, RFC3339.  Defaults to the end of the well")
+	root.AddCommand(pullWell)
+
+	root.AddCommand(&cobra.Command{
+		Use:   `tags`,
+		Short: `Pull the server's tags into the local tags file`,
+		Args:  cobra.NoArgs,
+		RunE:  session(PullTags),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `synctags`,
+		Short: `Merge the local tags with the server's`,
+		Args:  cobra.NoArgs,
+		RunE:  session(SyncTags),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `indexes`,
+		Short: `List the indexers known to the server`,
+		Args:  cobra.NoArgs,
+		RunE:  session(ListKnownIndexers),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `wells --uuid <indexer>`,
+		Short: `List the wells of an indexer`,
+		Args:  cobra.NoArgs,
+		RunE:  session(ListIndexerWells, `uuid`),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `shards --uuid <indexer> --well <well>`,
+		Short: `List the shards of a well`,
+		Args:  cobra.NoArgs,
+		RunE:  session(GetWellShards, `uuid`, `well`),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `welltime --uuid <indexer> --well <well>`,
+		Short: `Show the time range held by a well`,
+		Args:  cobra.NoArgs,
+		RunE:  session(GetWellTimeframe, `uuid`, `well`),
+	})
+
+	bench := &cobra.Command{
+		Use:   `bench`,
+		Short: `Benchmark pushes and pulls against the server`,
+		Long: `Push and then pull a set of synthetic shards, reporting throughput, latency, and the
+server's response codes for each phase.  The shards are pushed as the indexer given
+by --uuid, or a random one.`,
+		Args: cobra.NoArgs,
+		RunE: session(Bench),
+	}
+	fBenchMB = bench.Flags().Int("size-mb", 8, "Size in megabytes of each synthetic shard")
+	fBenchShards = bench.Flags().Int("shards", 16, "Number of synthetic shards")
+	fBenchWorkers = bench.Flags().Int("workers", 4, "Number of concurrent transfers")
+	root.AddCommand(bench)
+
+	root.AddCommand(&cobra.Command{
+		Use:               `verify <indexer storage path>`,
+		Short:             `Compare local shards with the server's copies`,
+		Long:              `Compare the shards under a local indexer storage directory with those held on the server, checking existence, file sizes, and checksums.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeDirs(1),
+		RunE:              session(Verify),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `diff --uuid <indexer> --well <well> <indexer storage path>`,
+		Short: `List the shards of a well missing locally or on the server`,
+		Long: `List the shards of a well which exist locally but not on the server, and vice versa.
+Only shard names are compared, use verify to check shard contents.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeDirs(1),
+		RunE:              session(DiffShards, `uuid`, `well`),
+	})
+
+	del := &cobra.Command{
+		Use:   `delete <indexer> <well> <shard>`,
+		Short: `Delete a shard from the server`,
+		Long: `Delete a shard from the server after asking for confirmation.  The shard is moved to
+the server's trash and may be restored until it expires.`,
+		Args: cobra.ExactArgs(3),
+		RunE: session(DeleteShard),
+	}
+	fYes = del.Flags().BoolP("yes", "y", false, "Do not ask for confirmation")
+	root.AddCommand(del)
+
+	root.AddCommand(&cobra.Command{
+		Use:   `trash`,
+		Short: `List the deleted shards the server can restore`,
+		Args:  cobra.NoArgs,
+		RunE:  session(ListTrash),
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   `restore <trash id>`,
+		Short: `Restore a deleted shard, the trash command lists the IDs`,
+		Args:  cobra.ExactArgs(1),
+		RunE:  session(RestoreShard),
+	})
+}
+
+// completeDirs completes up to n positional arguments as directories
+func completeDirs(n int) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, a []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(a) >= n {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	}
+}
@@ -0,0 +1,49 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"github.com/gravwell/gcfg"
+	"github.com/spf13/pflag"
+)
+
+// cfgType holds the connection settings which may be read from a config file,
+// any flag given on the command line overrides the matching config value
+type cfgType struct {
+	Global struct {
+		Server      string
+		Customer_ID string
+		Password    string
+		UUID        string
+		Tags_File   string
+		No_SSL      bool
+	}
+}
+
+// loadConfig reads the config file and applies its values to any flags not set on the command line
+func loadConfig(p string, fs *pflag.FlagSet) error {
+	var c cfgType
+	if err := gcfg.ReadFileInto(&c, p); err != nil {
+		return err
+	}
+	apply := func(name string, dst *string, v string) {
+		if !fs.Changed(name) && v != `` {
+			*dst = v
+		}
+	}
+	apply(`server`, fServer, c.Global.Server)
+	apply(`id`, fCustID, c.Global.Customer_ID)
+	apply(`password`, fPassword, c.Global.Password)
+	apply(`uuid`, fUUID, c.Global.UUID)
+	apply(`tags`, fTags, c.Global.Tags_File)
+	if !fs.Changed(`nossl`) && c.Global.No_SSL {
+		*fNossl = true
+	}
+	return nil
+}
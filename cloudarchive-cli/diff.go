@@ -0,0 +1,97 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	errShardsDiffer = errors.New("local and server shard sets differ")
+)
+
+// diffReport lists the shards of a well which exist on only one side
+type diffReport struct {
+	Indexer    string
+	Well       string
+	Common     int
+	LocalOnly  []string
+	RemoteOnly []string
+}
+
+// DiffShards compares the set of shards in a local well directory with the shards the
+// server holds for that indexer and well.  Only shard names are compared, use verify to
+// check shard contents.
+func DiffShards(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer, well := *fUUID, *fWell
+	var storePath string
+	if storePath, err = getStorePath(); err != nil {
+		return
+	}
+
+	local := map[string]bool{}
+	var shards []os.FileInfo
+	if shards, err = ioutil.ReadDir(filepath.Join(storePath, well)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	for _, shard := range shards {
+		if _, _, err := getPathParts(filepath.Join(storePath, well, shard.Name())); err == nil {
+			local[shard.Name()] = true
+		}
+	}
+
+	//the server cannot report on a well it has never seen
+	remote := map[string]bool{}
+	var wells []string
+	if wells, err = cli.ListIndexerWells(indexer); err != nil {
+		return
+	}
+	for _, w := range wells {
+		if w == well {
+			if remote, err = listRemoteShards(cli, indexer, well); err != nil {
+				return
+			}
+			break
+		}
+	}
+
+	dr := diffReport{Indexer: indexer, Well: well}
+	for s := range local {
+		if remote[s] {
+			dr.Common++
+			delete(remote, s)
+		} else {
+			dr.LocalOnly = append(dr.LocalOnly, s)
+		}
+	}
+	sort.Strings(dr.LocalOnly)
+	dr.RemoteOnly = sortedSet(remote)
+	if err = emit(dr, func() {
+		for _, s := range dr.LocalOnly {
+			fmt.Printf("%s/%s: %s\n", well, s, verifyMissing)
+		}
+		for _, s := range dr.RemoteOnly {
+			fmt.Printf("%s/%s: %s\n", well, s, verifyRemoteOnly)
+		}
+		lgr.Infof("%d shards on both, %d missing on server, %d only on server", dr.Common, len(dr.LocalOnly), len(dr.RemoteOnly))
+	}); err == nil && (len(dr.LocalOnly) > 0 || len(dr.RemoteOnly) > 0) {
+		err = errShardsDiffer
+	}
+	return
+}
@@ -0,0 +1,169 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	fConfig     *string
+	fCustID     *string
+	fPassword   *string
+	fTOTP       *string
+	fServer     *string
+	fTags       *string
+	fUUID       *string
+	fWell       *string
+	fShard      *string
+	fNossl      *bool
+	fOutput     *string
+	fParallel   *int
+	fNoProgress *bool
+
+	guid = uuid.New()
+	args []string //positional arguments of the running command
+
+	rootCmd = &cobra.Command{
+		Use:   `cloudarchive-cli`,
+		Short: `Push, pull, and inspect shards on a Cloud Archive server`,
+		Long: `cloudarchive-cli talks to a Cloud Archive server as an indexer would, pushing and
+pulling shards and tags and inspecting what the server holds.
+
+Connection settings are given with the global flags or read from a config file with
+--config, flags given on the command line override the values in the file.  Nothing
+is asked for interactively, a command missing a value it needs, such as the well to
+operate on, fails with its usage.`,
+		SilenceErrors: true,
+	}
+)
+
+// opFunc is a command run against a logged in client
+type opFunc func(cli *client.Client, tm tags.TagManager, lgr *log.Logger) error
+
+func init() {
+	pf := rootCmd.PersistentFlags()
+	fConfig = pf.StringP("config", "c", "", "Path to a config file holding the server, credentials, UUID, and tags path")
+	fCustID = pf.String("id", "17", "Customer ID")
+	fPassword = pf.String("password", "foo", "Password")
+	fTOTP = pf.String("totp", "", "TOTP code, required if the account has TOTP enabled")
+	fServer = pf.StringP("server", "s", "localhost:8888", "Server address")
+	fTags = pf.String("tags", "", "Path to tags.dat")
+	fUUID = pf.String("uuid", "", "Indexer UUID, used as the pushing indexer and to select the indexer to read from")
+	fWell = pf.String("well", "", "Well to operate on")
+	fShard = pf.String("shard", "", "Shard to operate on")
+	fNossl = pf.Bool("nossl", false, "Use an insecure HTTP connection")
+	fOutput = pf.StringP("output", "o", outputText, "Output format, text or json")
+	fParallel = pf.IntP("parallel", "p", 1, "Number of concurrent shard transfers for commands which move multiple shards")
+	fNoProgress = pf.Bool("noprogress", false, "Do not report progress during shard transfers")
+
+	rootCmd.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{outputText, outputJSON}, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.MarkPersistentFlagFilename("config")
+	rootCmd.MarkPersistentFlagFilename("tags", "dat")
+
+	addCommands(rootCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fatalf(log.New(os.Stderr), "%v", err)
+	}
+}
+
+// session wraps an operation as a cobra command, connecting and logging in before running it.
+// The required flags must be given on the command line or in the config file.
+func session(op opFunc, required ...string) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, a []string) (err error) {
+		//the command line parsed, any failure from here on is not a usage problem
+		cmd.SilenceUsage = true
+		args = a
+		if err = setup(cmd.Flags()); err != nil {
+			return
+		}
+		for _, name := range required {
+			if f := cmd.Flags().Lookup(name); f != nil && f.Value.String() == `` {
+				//except a value which was never given
+				cmd.SilenceUsage = false
+				return fmt.Errorf("--%s is required", name)
+			}
+		}
+		lgr := log.New(os.Stderr)
+		var cli *client.Client
+		if cli, err = connect(); err != nil {
+			return
+		}
+		tm, err := tags.New(*fTags)
+		if err != nil {
+			return
+		}
+		if err = op(cli, tm, lgr); err != nil {
+			tm.Close()
+			err = fmt.Errorf("session failure: %w", err)
+		} else if err = tm.Close(); err != nil {
+			err = fmt.Errorf("Failed to close tag manager: %w", err)
+		}
+		return
+	}
+}
+
+// setup applies the config file and validates the global flags
+func setup(fs *pflag.FlagSet) (err error) {
+	if *fConfig != `` {
+		if err = loadConfig(*fConfig, fs); err != nil {
+			err = fmt.Errorf("Failed to load config %s: %w", *fConfig, err)
+			return
+		}
+	}
+	if *fCustID == `` || *fPassword == `` || *fServer == `` || *fTags == `` {
+		err = errors.New("The customer ID, password, server, and tags path are required")
+	} else if *fOutput != outputText && *fOutput != outputJSON {
+		err = fmt.Errorf("Invalid output format %q", *fOutput)
+	} else if *fParallel < 1 {
+		err = fmt.Errorf("Invalid parallelism %d", *fParallel)
+	} else if *fUUID != `` {
+		if guid, err = uuid.Parse(*fUUID); err != nil {
+			err = fmt.Errorf("Invalid UUID override: %w", err)
+		}
+	}
+	return
+}
+
+// connect logs in to the server
+func connect() (cli *client.Client, err error) {
+	if cli, err = client.NewClient(*fServer, false, !*fNossl); err != nil {
+		return
+	}
+	//keep a connection for each concurrent transfer rather than redialing
+	conns := *fParallel
+	if *fBenchWorkers > conns {
+		conns = *fBenchWorkers
+	}
+	if err = cli.SetPoolOptions(client.PoolOptions{MaxIdleConnsPerHost: conns, IdleConnTimeout: 90 * time.Second}); err != nil {
+		return
+	}
+	if err = cli.Test(); err != nil {
+		return
+	}
+	if err = cli.LoginTOTP(*fCustID, *fPassword, *fTOTP); err != nil {
+		return
+	}
+	err = cli.TestLogin()
+	return
+}
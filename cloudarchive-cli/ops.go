@@ -0,0 +1,525 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func PullTags(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var tset []tags.TagPair
+	if tset, err = cli.PullTags(guid.String()); err != nil {
+		return
+	}
+	if _, err = tm.Merge(tset); err != nil {
+		return
+	}
+	err = emit(tset, nil)
+	return
+}
+
+func SyncTags(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var tset []tags.TagPair
+	if tset, err = tm.TagSet(); err != nil {
+		return
+	}
+	if tset, err = cli.SyncTags(guid.String(), tset); err != nil {
+		return
+	}
+	err = emit(tset, nil)
+	return
+}
+
+func ListKnownIndexers(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var idx []string
+	if idx, err = cli.ListIndexers(); err != nil {
+		return
+	}
+	err = emit(idx, func() {
+		lgr.Info("Indexers:")
+		for i := range idx {
+			lgr.Info(idx[i])
+		}
+	})
+	return
+}
+
+func ListIndexerWells(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer := *fUUID
+	var wells []string
+	if wells, err = cli.ListIndexerWells(indexer); err != nil {
+		return
+	}
+	r := struct {
+		Indexer string
+		Wells   []string
+	}{Indexer: indexer, Wells: wells}
+	err = emit(r, func() {
+		lgr.Infof("Wells on indexer %v:", indexer)
+		for i := range wells {
+			lgr.Info(wells[i])
+		}
+	})
+	return
+}
+
+func GetWellTimeframe(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer, well := *fUUID, *fWell
+	var tf util.Timeframe
+	if tf, err = cli.GetWellTimeframe(indexer, well); err != nil {
+		return
+	}
+
+	r := struct {
+		Indexer string
+		Well    string
+		util.Timeframe
+	}{Indexer: indexer, Well: well, Timeframe: tf}
+	err = emit(r, func() {
+		lgr.Infof("Well data starts at %v and ends at %v", tf.Start, tf.End)
+	})
+	return
+}
+
+func GetWellShards(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer, well := *fUUID, *fWell
+
+	var tf util.Timeframe
+	if tf, err = cli.GetWellTimeframe(indexer, well); err != nil {
+		return
+	}
+
+	var shards []string
+	if shards, err = cli.GetWellShardsInTimeframe(indexer, well, tf); err != nil {
+		return
+	}
+	r := struct {
+		Indexer string
+		Well    string
+		Shards  []string
+	}{Indexer: indexer, Well: well, Shards: shards}
+	err = emit(r, func() {
+		lgr.Infof("Shards: %v", shards)
+	})
+	return
+}
+
+func PullShard(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer, well, shard := *fUUID, *fWell, *fShard
+
+	var storePath string
+	var shardPath string
+	if storePath, err = getStorePath(); err != nil {
+		return
+	}
+	shardPath = filepath.Join(storePath, shard)
+	if err = os.MkdirAll(shardPath, 0770); err != nil {
+		return
+	}
+	var guid uuid.UUID
+	if guid, err = uuid.Parse(indexer); err != nil {
+		return
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+
+	sid := client.ShardID{
+		Indexer: guid,
+		Well:    well,
+		Shard:   shard,
+	}
+
+	pg := newProgress(fmt.Sprintf("pull %s/%s", well, shard), lgr)
+	err = cli.PullShardWithProgress(sid, shardPath, ctx, pg.callback())
+	pg.finish()
+	if err != nil {
+		return
+	}
+	err = emit(shardResult{Indexer: indexer, Well: well, Shard: shard, Path: shardPath}, nil)
+	return
+}
+
+// PullWell pulls every shard of a well within the requested time range into a destination
+// storage directory, laid out as <destination>/<well>/<shard> just as an indexer expects.
+// Shards already present in the destination are skipped, so an interrupted pull can be resumed.
+func PullWell(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer, well := *fUUID, *fWell
+	var storePath string
+	if storePath, err = getStorePath(); err != nil {
+		return
+	}
+	var guid uuid.UUID
+	if guid, err = uuid.Parse(indexer); err != nil {
+		return
+	}
+	var tf util.Timeframe
+	if tf, err = getTimeframe(cli, indexer, well); err != nil {
+		return
+	}
+	var shards []string
+	if shards, err = cli.GetWellShardsInTimeframe(indexer, well, tf); err != nil {
+		return
+	}
+
+	//re-uploaded shards carry a .N suffix on the server, take the newest copy of each
+	latest := map[string]string{}
+	for _, s := range shards {
+		id := strings.TrimSuffix(s, filepath.Ext(s))
+		if curr, ok := latest[id]; !ok || shardVersion(s) > shardVersion(curr) {
+			latest[id] = s
+		}
+	}
+	wellPath := filepath.Join(storePath, well)
+	var pending []shardResult
+	var skipped int
+	ids := make([]string, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p := filepath.Join(wellPath, id)
+		if _, err = os.Stat(p); err == nil {
+			skipped++
+			continue
+		} else if !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		pending = append(pending, shardResult{Indexer: indexer, Well: well, Shard: latest[id], Path: p})
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	err = forEachParallel(*fParallel, len(pending), func(i int) error {
+		sr := pending[i]
+		lgr.Infof("pulling shard %s/%s", sr.Well, sr.Shard)
+		sid := client.ShardID{
+			Indexer: guid,
+			Well:    sr.Well,
+			Shard:   sr.Shard,
+		}
+		//pull into a partial directory so an interrupted pull is not mistaken for a complete shard
+		partial := sr.Path + `.partial`
+		os.RemoveAll(partial)
+		pg := newProgress(fmt.Sprintf("pull %s/%s", sr.Well, sr.Shard), lgr)
+		err := cli.PullShardWithProgress(sid, partial, ctx, pg.callback())
+		pg.finish()
+		if err != nil {
+			cf() //abort any other transfers
+			os.RemoveAll(partial)
+			return fmt.Errorf("%s/%s: %w", sr.Well, sr.Shard, err)
+		}
+		return os.Rename(partial, sr.Path)
+	})
+	if err != nil {
+		return
+	}
+	r := struct {
+		Pulled  []shardResult
+		Skipped int
+	}{Pulled: pending, Skipped: skipped}
+	err = emit(r, func() {
+		lgr.Infof("pulled %d shards, skipped %d already present", len(pending), skipped)
+	})
+	return
+}
+
+// getTimeframe returns the time range given by --start and --end, missing bounds are taken from the well
+func getTimeframe(cli *client.Client, indexer, well string) (tf util.Timeframe, err error) {
+	if *fStart == `` || *fEnd == `` {
+		if tf, err = cli.GetWellTimeframe(indexer, well); err != nil {
+			return
+		}
+	}
+	if *fStart != `` {
+		if tf.Start, err = time.Parse(time.RFC3339, *fStart); err != nil {
+			return
+		}
+	}
+	if *fEnd != `` {
+		if tf.End, err = time.Parse(time.RFC3339, *fEnd); err != nil {
+			return
+		}
+	}
+	if tf.End.Before(tf.Start) {
+		err = fmt.Errorf("start time %v is after end time %v", tf.Start, tf.End)
+	}
+	return
+}
+
+// shardVersion returns the re-upload version of a shard name, zero for the original upload
+func shardVersion(s string) (v uint64) {
+	_, v, _ = util.ParseShardName(s)
+	return
+}
+
+// DeleteShard removes a shard from the server, the deletion must be confirmed unless --yes is set
+func DeleteShard(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	indexer, well, shard := args[0], args[1], args[2]
+	var guid uuid.UUID
+	if guid, err = uuid.Parse(indexer); err != nil {
+		return
+	}
+	if !*fYes && !confirm(fmt.Sprintf("Delete shard %s/%s from indexer %s", well, shard, indexer)) {
+		err = errors.New("Delete not confirmed")
+		return
+	}
+
+	sid := client.ShardID{
+		Indexer: guid,
+		Well:    well,
+		Shard:   shard,
+	}
+	if err = cli.DeleteShard(sid); err != nil {
+		return
+	}
+	err = emit(shardResult{Indexer: indexer, Well: well, Shard: shard}, func() {
+		lgr.Infof("deleted shard %s/%s from indexer %s", well, shard, indexer)
+	})
+	return
+}
+
+// ListTrash lists the deleted shards the server can still restore
+func ListTrash(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var ents []util.TrashEntry
+	if ents, err = cli.ListTrash(); err != nil {
+		return
+	}
+	err = emit(ents, func() {
+		for _, te := range ents {
+			fmt.Printf("%s %s/%s/%s deleted %s, expires %s\n", te.ID, te.IdxUUID, te.Well, te.Shard,
+				te.Deleted.Format(time.RFC3339), te.Expires.Format(time.RFC3339))
+		}
+	})
+	return
+}
+
+// RestoreShard moves a deleted shard out of the server's trash
+func RestoreShard(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	id := args[0]
+	var te util.TrashEntry
+	if te, err = cli.RestoreShard(id); err != nil {
+		return
+	}
+	err = emit(shardResult{Indexer: te.IdxUUID.String(), Well: te.Well, Shard: te.Shard}, func() {
+		lgr.Infof("restored shard %s/%s to indexer %s", te.Well, te.Shard, te.IdxUUID)
+	})
+	return
+}
+
+func PushShard(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var tps []tags.TagPair
+	var shardPath string
+	var wellName string
+	var shardId string
+	if tps, err = tm.TagSet(); err != nil {
+		return
+	}
+	tgs := []string{`test`, `test2`}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	if shardPath, wellName, shardId, err = getShardPath(); err != nil {
+		return
+	}
+	lgr.Info("pushing shard")
+	sid := client.ShardID{
+		Indexer: guid,
+		Well:    wellName,
+		Shard:   shardId,
+	}
+	pg := newProgress(fmt.Sprintf("push %s/%s", wellName, shardId), lgr)
+	err = cli.PushShardWithProgress(sid, shardPath, tps, tgs, ctx, pg.callback())
+	pg.finish()
+	if err != nil {
+		return
+	}
+	err = emit(shardResult{Indexer: guid.String(), Well: wellName, Shard: shardId, Path: shardPath}, nil)
+	return
+}
+
+// PushAllShards walks every well under an indexer storage directory and pushes each
+// shard that is not already on the server
+func PushAllShards(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var tps []tags.TagPair
+	var storePath string
+	if tps, err = tm.TagSet(); err != nil {
+		return
+	}
+	if storePath, err = getStorePath(); err != nil {
+		return
+	}
+	var wells []os.FileInfo
+	if wells, err = ioutil.ReadDir(storePath); err != nil {
+		return
+	}
+
+	//gather everything that needs pushing
+	var pending []shardResult
+	var skipped int
+	for _, well := range wells {
+		if !well.IsDir() {
+			continue
+		}
+		wellPath := filepath.Join(storePath, well.Name())
+		var shards []os.FileInfo
+		if shards, err = ioutil.ReadDir(wellPath); err != nil {
+			return
+		}
+		existing := remoteShards(cli, well.Name())
+		for _, shard := range shards {
+			shardPath := filepath.Join(wellPath, shard.Name())
+			if _, _, err := getPathParts(shardPath); err != nil {
+				continue //not a shard
+			}
+			if existing[shard.Name()] {
+				skipped++
+				continue
+			}
+			pending = append(pending, shardResult{Indexer: guid.String(), Well: well.Name(), Shard: shard.Name(), Path: shardPath})
+		}
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	err = forEachParallel(*fParallel, len(pending), func(i int) error {
+		sr := pending[i]
+		lgr.Infof("pushing shard %s/%s", sr.Well, sr.Shard)
+		sid := client.ShardID{
+			Indexer: guid,
+			Well:    sr.Well,
+			Shard:   sr.Shard,
+		}
+		pg := newProgress(fmt.Sprintf("push %s/%s", sr.Well, sr.Shard), lgr)
+		err := cli.PushShardWithProgress(sid, sr.Path, tps, shardWellTags(sr.Path), ctx, pg.callback())
+		pg.finish()
+		if err != nil {
+			cf() //abort any other transfers
+			return fmt.Errorf("%s/%s: %w", sr.Well, sr.Shard, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	r := struct {
+		Pushed  []shardResult
+		Skipped int
+	}{Pushed: pending, Skipped: skipped}
+	err = emit(r, func() {
+		lgr.Infof("pushed %d shards, skipped %d already on the server", len(pending), skipped)
+	})
+	return
+}
+
+// remoteShards returns the set of shards the server holds for a well on this indexer
+// a well the server has never seen has no shards
+func remoteShards(cli *client.Client, well string) (r map[string]bool) {
+	r, _ = listRemoteShards(cli, guid.String(), well)
+	return
+}
+
+// listRemoteShards returns the set of shards the server holds for a well on an indexer
+func listRemoteShards(cli *client.Client, indexer, well string) (r map[string]bool, err error) {
+	r = map[string]bool{}
+	var tf util.Timeframe
+	if tf, err = cli.GetWellTimeframe(indexer, well); err != nil || tf.Start.IsZero() {
+		return
+	}
+	var shards []string
+	if shards, err = cli.GetWellShardsInTimeframe(indexer, well, tf); err != nil {
+		return
+	}
+	for _, s := range shards {
+		//re-uploads are stored with a .N suffix
+		r[strings.TrimSuffix(s, filepath.Ext(s))] = true
+	}
+	return
+}
+
+// shardWellTags reads the well tags file stored alongside a shard, if there is one
+func shardWellTags(shardPath string) (tgs []string) {
+	bts, err := ioutil.ReadFile(filepath.Join(shardPath, `tags`))
+	if err != nil {
+		return
+	}
+	for _, t := range strings.Split(string(bts), "\n") {
+		if t = strings.TrimSpace(t); t != `` {
+			tgs = append(tgs, t)
+		}
+	}
+	return
+}
+
+func getStorePath() (storePath string, err error) {
+	storePath = args[0]
+	err = isDir(storePath)
+	return
+}
+
+func getShardPath() (shardPath, wellName, shardId string, err error) {
+	shardPath = args[0]
+	wellName, shardId, err = getPathParts(shardPath)
+	return
+}
+
+// confirm asks on stderr for a yes or no answer on stdin, anything but yes is no
+func confirm(label string) bool {
+	fmt.Fprintf(os.Stderr, "%s? [y/N] ", label)
+	resp, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(resp)) {
+	case `y`, `yes`:
+		return true
+	}
+	return false
+}
+
+func getPathParts(v string) (wellName, shardId string, err error) {
+	v = filepath.Clean(v)
+	if err = isDir(v); err == nil {
+		//grab the base component
+		shardId = filepath.Base(v)
+		if wellName = filepath.Base(filepath.Dir(v)); wellName == `` || wellName == `.` {
+			err = errors.New("Invalid well in path")
+		} else {
+			_, err = strconv.ParseUint(shardId, 16, 22) //up to 22 bits for a shardID
+		}
+	}
+	return
+}
+
+func isDir(v string) (err error) {
+	//check that path is a directory
+	var fi os.FileInfo
+	if fi, err = os.Stat(v); err == nil {
+		if !fi.IsDir() {
+			err = errors.New("Path is not a directory")
+		}
+	}
+	return
+}
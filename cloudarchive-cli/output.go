@@ -0,0 +1,64 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	outputText = `text`
+	outputJSON = `json`
+)
+
+// shardResult is the structured result of a single shard operation
+type shardResult struct {
+	Indexer string
+	Well    string
+	Shard   string
+	Path    string `json:",omitempty"`
+}
+
+type errorResult struct {
+	Error string
+}
+
+var emitted bool
+
+func jsonOutput() bool {
+	return *fOutput == outputJSON
+}
+
+// emit reports the result of a command, JSON encoded on STDOUT when -o json is set,
+// otherwise the text function is called to print it
+func emit(v interface{}, text func()) error {
+	if jsonOutput() {
+		emitted = true
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent(``, `  `)
+		return enc.Encode(v)
+	}
+	if text != nil {
+		text()
+	}
+	return nil
+}
+
+// fatalf logs the error and exits, in JSON mode the error is also emitted on STDOUT
+// unless the command already emitted its result
+func fatalf(lgr *log.Logger, format string, args ...interface{}) {
+	if jsonOutput() && !emitted {
+		emit(errorResult{Error: fmt.Sprintf(format, args...)}, nil)
+	}
+	lgr.Fatalf(format, args...)
+}
@@ -0,0 +1,51 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+)
+
+// forEachParallel calls fn for each index in [0, count) using up to n concurrent workers.
+// The first error is returned and no new calls are started once an error has occurred.
+func forEachParallel(n, count int, fn func(i int) error) (err error) {
+	if n < 1 {
+		n = 1
+	}
+	idx := make(chan int)
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				if lerr := fn(i); lerr != nil {
+					mtx.Lock()
+					if err == nil {
+						err = lerr
+					}
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		mtx.Lock()
+		failed := err != nil
+		mtx.Unlock()
+		if failed {
+			break
+		}
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	return
+}
@@ -0,0 +1,149 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	barWidth       = 40
+	barInterval    = 200 * time.Millisecond
+	reportInterval = 5 * time.Second
+	reportStep     = 10 //percent
+)
+
+// progress reports the byte level progress of a single shard transfer.  When stderr is a
+// terminal and only one transfer runs at a time a progress bar is drawn, otherwise periodic
+// percentage lines are logged so concurrent transfers and redirected output stay readable.
+type progress struct {
+	sync.Mutex
+	label   string
+	lgr     *log.Logger
+	bar     bool
+	last    time.Time
+	lastPct int64
+	done    int64
+	total   int64
+}
+
+func newProgress(label string, lgr *log.Logger) *progress {
+	return &progress{
+		label:   label,
+		lgr:     lgr,
+		bar:     *fParallel == 1 && isTerminal(os.Stderr),
+		last:    time.Now(),
+		lastPct: -1,
+	}
+}
+
+// callback returns the function handed to the client, nil if progress reporting is disabled
+func (p *progress) callback() client.ProgressFunc {
+	if *fNoProgress {
+		return nil
+	}
+	return p.update
+}
+
+func (p *progress) update(done, total int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.done, p.total = done, total
+	now := time.Now()
+	if p.bar {
+		if now.Sub(p.last) >= barInterval {
+			p.last = now
+			p.draw()
+		}
+		return
+	}
+	pct := p.percent()
+	if now.Sub(p.last) >= reportInterval || (pct >= 0 && pct/reportStep > p.lastPct/reportStep) {
+		p.last = now
+		p.lastPct = pct
+		p.report()
+	}
+}
+
+// finish completes the output for the transfer, it must be called once the transfer ends
+func (p *progress) finish() {
+	if *fNoProgress {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.bar {
+		if p.done > 0 {
+			p.draw()
+			fmt.Fprintln(os.Stderr)
+		}
+	} else if p.done > 0 && p.lastPct != 100 {
+		p.report()
+	}
+}
+
+// percent returns the completed percentage, -1 if the total size is unknown
+func (p *progress) percent() int64 {
+	if p.total <= 0 {
+		return -1
+	}
+	if p.done >= p.total {
+		return 100
+	}
+	return p.done * 100 / p.total
+}
+
+func (p *progress) draw() {
+	pct := p.percent()
+	if pct < 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %s", p.label, byteSize(p.done))
+		return
+	}
+	n := int(pct) * barWidth / 100
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %3d%% %s/%s", p.label,
+		strings.Repeat(`=`, n), strings.Repeat(` `, barWidth-n),
+		pct, byteSize(p.done), byteSize(p.total))
+}
+
+func (p *progress) report() {
+	if pct := p.percent(); pct < 0 {
+		p.lgr.Infof("%s %s", p.label, byteSize(p.done))
+	} else {
+		p.lgr.Infof("%s %d%% %s/%s", p.label, pct, byteSize(p.done), byteSize(p.total))
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// byteSize renders a byte count in human readable form
+func byteSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,170 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	errVerifyFailed = errors.New("local shards do not match the server")
+)
+
+const (
+	verifyMissing    = `missing on server`
+	verifyRemoteOnly = `only on server`
+	verifyDiffers    = `differs`
+)
+
+// verifyReport is the result of comparing a local indexer storage directory with the server
+type verifyReport struct {
+	Match      int
+	Differ     int
+	Missing    int
+	RemoteOnly int
+	Shards     []shardDiff `json:",omitempty"` //shards which do not match
+}
+
+type shardDiff struct {
+	Well   string
+	Shard  string
+	Status string
+	Diffs  []string `json:",omitempty"`
+}
+
+// Verify compares the shards under a local indexer storage directory with those held
+// on the server, checking existence, file sizes, and checksums, and prints a diff report
+func Verify(cli *client.Client, tm tags.TagManager, lgr *log.Logger) (err error) {
+	var storePath string
+	if storePath, err = getStorePath(); err != nil {
+		return
+	}
+	var wells []os.FileInfo
+	if wells, err = ioutil.ReadDir(storePath); err != nil {
+		return
+	}
+
+	var vr verifyReport
+	for _, well := range wells {
+		if !well.IsDir() {
+			continue
+		}
+		wellPath := filepath.Join(storePath, well.Name())
+		var shards []os.FileInfo
+		if shards, err = ioutil.ReadDir(wellPath); err != nil {
+			return
+		}
+		existing := remoteShards(cli, well.Name())
+		for _, shard := range shards {
+			shardPath := filepath.Join(wellPath, shard.Name())
+			if _, _, err := getPathParts(shardPath); err != nil {
+				continue //not a shard
+			}
+			delete(existing, shard.Name())
+
+			sid := client.ShardID{
+				Indexer: guid,
+				Well:    well.Name(),
+				Shard:   shard.Name(),
+			}
+			si, err := cli.GetShardInfo(sid)
+			if err != nil {
+				var se *client.StatusError
+				if errors.As(err, &se) && se.Code == http.StatusNotFound {
+					vr.Shards = append(vr.Shards, shardDiff{Well: well.Name(), Shard: shard.Name(), Status: verifyMissing})
+					vr.Missing++
+					continue
+				}
+				return err
+			}
+			local, err := util.ShardFiles(shardPath)
+			if err != nil {
+				return err
+			}
+			if diffs := diffShardFiles(local, si.Files); len(diffs) > 0 {
+				vr.Shards = append(vr.Shards, shardDiff{Well: well.Name(), Shard: shard.Name(), Status: verifyDiffers, Diffs: diffs})
+				vr.Differ++
+			} else {
+				vr.Match++
+			}
+		}
+		for _, s := range sortedSet(existing) {
+			vr.Shards = append(vr.Shards, shardDiff{Well: well.Name(), Shard: s, Status: verifyRemoteOnly})
+			vr.RemoteOnly++
+		}
+	}
+	if err = emit(vr, func() {
+		for _, sd := range vr.Shards {
+			if len(sd.Diffs) == 0 {
+				fmt.Printf("%s/%s: %s\n", sd.Well, sd.Shard, sd.Status)
+			}
+			for _, d := range sd.Diffs {
+				fmt.Printf("%s/%s: %s\n", sd.Well, sd.Shard, d)
+			}
+		}
+		lgr.Infof("%d shards match, %d differ, %d missing on server, %d only on server", vr.Match, vr.Differ, vr.Missing, vr.RemoteOnly)
+	}); err == nil && len(vr.Shards) > 0 {
+		err = errVerifyFailed
+	}
+	return
+}
+
+// diffShardFiles describes the differences between local and remote copies of a shard
+// the well tags file is written by the server alongside each shard, so is ignored
+func diffShardFiles(local, remote []util.ShardFile) (diffs []string) {
+	rm := make(map[string]util.ShardFile, len(remote))
+	for _, f := range remote {
+		rm[f.Name] = f
+	}
+	for _, lf := range local {
+		rf, ok := rm[lf.Name]
+		delete(rm, lf.Name)
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s missing on server", lf.Name))
+		} else if lf.Size != rf.Size {
+			diffs = append(diffs, fmt.Sprintf("%s size differs, local %d server %d", lf.Name, lf.Size, rf.Size))
+		} else if lf.SHA256 != rf.SHA256 {
+			diffs = append(diffs, fmt.Sprintf("%s checksum differs, local %s server %s", lf.Name, lf.SHA256, rf.SHA256))
+		}
+	}
+	delete(rm, shardpacker.WellTags.Filename(``))
+	for _, name := range sortedKeys(rm) {
+		diffs = append(diffs, fmt.Sprintf("%s only on server", name))
+	}
+	return
+}
+
+func sortedSet(m map[string]bool) (r []string) {
+	for k := range m {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return
+}
+
+func sortedKeys(m map[string]util.ShardFile) (r []string) {
+	for k := range m {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return
+}
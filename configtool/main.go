@@ -10,47 +10,156 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/gravwell/cloudarchive/pkg/configbuilder"
 )
 
 var (
-	fStub = flag.String("stub", "", "Path to config file stub")
-	fDir  = flag.String("dir", "", "Base directory for new config, should be the top-level dir of an indexer (final component is a UUID, e.g. /var/archives/<custid>/<indexeruuid>")
-	fOut  = flag.String("o", "", "Output file for configuration.  STDOUT if empty")
+	fStub    = flag.String("stub", "", "Path to config file stub")
+	fDir     = flag.String("dir", "", "Base directory for new config, should be the top-level dir of an indexer (final component is a UUID, e.g. /var/archives/<custid>/<indexeruuid>.  Multiple comma separated directories may be given, additional directories may also be passed as arguments")
+	fOut     = flag.String("o", "", "Output file for configuration.  STDOUT if empty.  When multiple directories are given this is a directory which receives a <indexeruuid>.conf file per indexer")
+	fCheck   = flag.String("check", "", "Path to an existing config, report drift between it and the directory instead of generating a config.  When multiple directories are given this is a directory containing a <indexeruuid>.conf file per indexer")
+	fArchive = flag.String("archive-server", "", "If set, append a Cloud-Archive block pointing at this archive server so the restored indexer can re-attach")
+	fServer  = flag.String("server", "", "Build configs from the wells held on this archive server instead of a local directory.  Directories are replaced by indexer UUIDs, all of the customer's indexers are used if none are given")
+	fCustID  = flag.String("id", "", "Customer number used to log in to the archive server")
+	fPass    = flag.String("password", "", "Password used to log in to the archive server")
+	fTOTP    = flag.String("totp", "", "TOTP code for the archive server, required if the account has TOTP enabled")
+	fNossl   = flag.Bool("nossl", false, "Use an insecure HTTP connection to the archive server")
+	fInv     = flag.Bool("inventory", false, "Emit a JSON inventory of the wells, shard counts, tags, and time ranges in each directory instead of a config")
+
+	dirs []string
+	vars = varFlags{}
 )
 
+// varFlags collects repeated -var NAME=VALUE flags
+type varFlags map[string]string
+
+func (vf varFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(vf))
+}
+
+func (vf varFlags) Set(v string) error {
+	k, val, ok := strings.Cut(v, `=`)
+	if !ok || k == `` {
+		return fmt.Errorf("%q is not of the form NAME=VALUE", v)
+	}
+	vf[k] = val
+	return nil
+}
+
 func init() {
+	flag.Var(vars, "var", "Template variable of the form NAME=VALUE substituted for ${NAME} in the stub, may be repeated")
 	flag.Parse()
-	if *fStub == `` {
-		log.Fatal("config stub required")
-	} else if *fDir == `` {
+	for _, d := range strings.Split(*fDir, ",") {
+		if d = strings.TrimSpace(d); d != `` {
+			dirs = append(dirs, d)
+		}
+	}
+	dirs = append(dirs, flag.Args()...)
+	if *fServer != `` {
+		if *fCustID == `` || *fPass == `` {
+			log.Fatal("customer number and password are required with -server")
+		} else if *fStub == `` {
+			log.Fatal("config stub required")
+		} else if *fCheck != `` || *fInv {
+			log.Fatal("-check and -inventory require local directories")
+		}
+	} else if len(dirs) == 0 {
 		log.Fatal("directory is required")
+	} else if *fStub == `` && *fCheck == `` && !*fInv {
+		log.Fatal("config stub required")
 	}
 }
 
 func main() {
+	if *fCheck != `` {
+		checkConfigs()
+		return
+	} else if *fInv {
+		writeInventory()
+		return
+	}
 	// Read the file
 	stubContents, err := ioutil.ReadFile(*fStub)
 	if err != nil {
 		log.Fatalf("Couldn't read config file stub: %v", err)
 	}
 
-	result, err := configbuilder.BuildConfig(stubContents, *fDir)
-	if err != nil {
-		log.Fatalf("Couldn't build config: %v", err)
+	if *fServer != `` {
+		buildRemoteConfigs(stubContents)
+		return
 	}
 
-	var out io.Writer
+	if len(dirs) == 1 {
+		result, err := buildConfig(stubContents, dirs[0])
+		if err != nil {
+			log.Fatalf("Couldn't build config: %v", err)
+		}
+		writeConfig(*fOut, result)
+		return
+	}
+
+	makeOutDir()
+	for _, d := range dirs {
+		result, err := buildConfig(stubContents, d)
+		if err != nil {
+			log.Fatalf("Couldn't build config for %s: %v", d, err)
+		}
+		writeIndexerConfig(d, result)
+	}
+}
+
+// makeOutDir creates the output directory used when generating configs for multiple indexers
+func makeOutDir() {
 	if *fOut != `` {
-		fout, err := os.Create(*fOut)
+		if err := os.MkdirAll(*fOut, 0750); err != nil {
+			log.Fatalf("Failed to create output directory %s: %v\n", *fOut, err)
+		}
+	}
+}
+
+// writeIndexerConfig writes one of several configs, either into the output directory
+// or to STDOUT with a header naming the indexer
+func writeIndexerConfig(d string, result []byte) {
+	if *fOut == `` {
+		//no output directory, emit one combined stream with a header per indexer
+		fmt.Printf("# ===== Indexer %s =====\n", filepath.Base(d))
+		writeConfig(``, result)
+		fmt.Println()
+		return
+	}
+	p := filepath.Join(*fOut, configName(d))
+	writeConfig(p, result)
+	fmt.Printf("Wrote %s\n", p)
+}
+
+// buildConfig generates the config for one indexer directory, adding the Cloud-Archive block if requested
+func buildConfig(stub []byte, dir string) (result []byte, err error) {
+	if result, err = configbuilder.BuildConfigWithVars(stub, dir, vars); err != nil {
+		return
+	}
+	if *fArchive != `` {
+		result = append(result, configbuilder.ArchiveStanza(*fArchive, dir)...)
+	}
+	return
+}
+
+// writeConfig writes the config to the given path, or STDOUT if the path is empty
+func writeConfig(p string, result []byte) {
+	var out io.Writer
+	if p != `` {
+		fout, err := os.Create(p)
 		if err != nil {
-			log.Fatalf("Failed to create output file %s: %v\n", *fOut, err)
+			log.Fatalf("Failed to create output file %s: %v\n", p, err)
 		}
 		out = fout
 		defer fout.Close()
@@ -63,3 +172,58 @@ func main() {
 		log.Fatal("Failed to write entire config file")
 	}
 }
+
+// configName returns the per-indexer config file name for an indexer directory
+func configName(dir string) string {
+	return filepath.Base(filepath.Clean(dir)) + `.conf`
+}
+
+// writeInventory emits a JSON array with the inventory of every directory
+func writeInventory() {
+	invs := make([]configbuilder.Inventory, 0, len(dirs))
+	for _, d := range dirs {
+		inv, err := configbuilder.BuildInventory(d)
+		if err != nil {
+			log.Fatalf("Couldn't build inventory for %s: %v", d, err)
+		}
+		invs = append(invs, inv)
+	}
+	b, err := json.MarshalIndent(invs, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeConfig(*fOut, append(b, '\n'))
+}
+
+// checkConfigs reports drift between existing configs and the archive directories
+// the process exits with a non-zero status if any drift is found
+func checkConfigs() {
+	var drifted bool
+	if len(dirs) == 1 {
+		drifted = checkConfig(*fCheck, dirs[0])
+	} else {
+		for _, d := range dirs {
+			fmt.Printf("# ===== Indexer %s =====\n", filepath.Base(d))
+			if checkConfig(filepath.Join(*fCheck, configName(d)), d) {
+				drifted = true
+			}
+		}
+	}
+	if drifted {
+		os.Exit(1)
+	}
+}
+
+// checkConfig prints the drift between a config and a single indexer directory, returning true if there is any
+func checkConfig(p, dir string) bool {
+	conf, err := ioutil.ReadFile(p)
+	if err != nil {
+		log.Fatalf("Couldn't read config file: %v", err)
+	}
+	drift, err := configbuilder.CheckDrift(conf, dir)
+	if err != nil {
+		log.Fatalf("Couldn't check config: %v", err)
+	}
+	fmt.Print(drift)
+	return !drift.Empty()
+}
@@ -0,0 +1,70 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/configbuilder"
+
+	"github.com/google/uuid"
+)
+
+// buildRemoteConfigs generates configs from the wells held on the archive server,
+// the dirs list holds indexer UUIDs rather than local paths in this mode
+func buildRemoteConfigs(stub []byte) {
+	cid, err := strconv.ParseUint(*fCustID, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid customer number %q: %v", *fCustID, err)
+	}
+	cli, err := client.NewClient(*fServer, false, !*fNossl)
+	if err != nil {
+		log.Fatalf("Couldn't create client: %v", err)
+	}
+	if err = cli.Test(); err != nil {
+		log.Fatalf("Couldn't reach archive server: %v", err)
+	}
+	if err = cli.LoginTOTP(*fCustID, *fPass, *fTOTP); err != nil {
+		log.Fatalf("Couldn't log in to archive server: %v", err)
+	}
+
+	ids := dirs
+	if len(ids) == 0 {
+		if ids, err = cli.ListIndexers(); err != nil {
+			log.Fatalf("Couldn't list indexers: %v", err)
+		} else if len(ids) == 0 {
+			log.Fatal("No indexers found on the archive server")
+		}
+	}
+
+	single := len(ids) == 1
+	if !single {
+		makeOutDir()
+	}
+	for _, id := range ids {
+		guid, err := uuid.Parse(id)
+		if err != nil {
+			log.Fatalf("Invalid indexer UUID %q: %v", id, err)
+		}
+		result, err := configbuilder.BuildRemoteConfig(stub, cli, cid, guid, vars)
+		if err != nil {
+			log.Fatalf("Couldn't build config for %s: %v", id, err)
+		}
+		if *fArchive != `` {
+			result = append(result, configbuilder.CustomerArchiveStanza(*fArchive, cid)...)
+		}
+		if single {
+			writeConfig(*fOut, result)
+		} else {
+			writeIndexerConfig(guid.String(), result)
+		}
+	}
+}
@@ -3,39 +3,46 @@ module github.com/gravwell/cloudarchive
 go 1.19
 
 require (
+	github.com/crewjam/rfc5424 v0.1.0
 	github.com/dolmen-go/contextio v0.0.0-20220904134943-e50796217f5f
+	github.com/go-sql-driver/mysql v1.7.1
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.7.3
 	github.com/gravwell/gcfg v1.2.9-0.20221122204101-04b4a74a3018
 	github.com/gravwell/gravwell/v3 v3.8.17
 	github.com/howeyc/gopass v0.0.0-20210920133722-c8aef6fb66ef
-	github.com/manifoldco/promptui v0.9.0
-	golang.org/x/crypto v0.7.0
-	golang.org/x/sys v0.6.0
+	github.com/jlaffaye/ftp v0.1.0
+	github.com/lib/pq v1.10.9
+	github.com/minio/minio-go/v6 v6.0.46
+	github.com/spf13/cobra v1.7.0
+	github.com/spf13/pflag v1.0.5
+	goftp.io/server v0.4.1
+	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
-	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
-	github.com/crewjam/rfc5424 v0.1.0 // indirect
 	github.com/go-ole/go-ole v1.2.4 // indirect
 	github.com/gofrs/flock v0.8.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/go-write v0.0.0-20181107114627-56629a6b2542 // indirect
 	github.com/google/renameio v0.1.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
-	github.com/jlaffaye/ftp v0.1.0 // indirect
-	github.com/minio/minio-go/v6 v6.0.46 // indirect
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/minio/sha256-simd v0.1.1 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/shirou/gopsutil v2.20.9+incompatible // indirect
-	goftp.io/server v0.4.1 // indirect
-	golang.org/x/net v0.8.0 // indirect
-	golang.org/x/term v0.6.0 // indirect
-	golang.org/x/text v0.8.0 // indirect
-	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/term v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 	gopkg.in/ini.v1 v1.42.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
@@ -0,0 +1,516 @@
+// Copyright 2023 Gravwell, Inc. All rights reserved.
+// Contact: <legal@gravwell.io>
+//
+// This software may be modified and distributed under the terms of the
+// BSD 2-clause license. See the LICENSE file for details.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: archive.proto
+
+package archivepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Archive_Login_FullMethodName            = "/cloudarchive.Archive/Login"
+	Archive_LoginTOTP_FullMethodName        = "/cloudarchive.Archive/LoginTOTP"
+	Archive_ListIndexers_FullMethodName     = "/cloudarchive.Archive/ListIndexers"
+	Archive_ListWells_FullMethodName        = "/cloudarchive.Archive/ListWells"
+	Archive_GetWellTimeframe_FullMethodName = "/cloudarchive.Archive/GetWellTimeframe"
+	Archive_ListShards_FullMethodName       = "/cloudarchive.Archive/ListShards"
+	Archive_GetTags_FullMethodName          = "/cloudarchive.Archive/GetTags"
+	Archive_SyncTags_FullMethodName         = "/cloudarchive.Archive/SyncTags"
+	Archive_PushShard_FullMethodName        = "/cloudarchive.Archive/PushShard"
+	Archive_PullShard_FullMethodName        = "/cloudarchive.Archive/PullShard"
+)
+
+// ArchiveClient is the client API for Archive service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ArchiveClient interface {
+	Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	LoginTOTP(ctx context.Context, in *LoginTOTPRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	ListIndexers(ctx context.Context, in *ListIndexersRequest, opts ...grpc.CallOption) (*ListIndexersResponse, error)
+	ListWells(ctx context.Context, in *ListWellsRequest, opts ...grpc.CallOption) (*ListWellsResponse, error)
+	GetWellTimeframe(ctx context.Context, in *WellRequest, opts ...grpc.CallOption) (*Timeframe, error)
+	ListShards(ctx context.Context, in *ListShardsRequest, opts ...grpc.CallOption) (*ListShardsResponse, error)
+	GetTags(ctx context.Context, in *GetTagsRequest, opts ...grpc.CallOption) (*TagsResponse, error)
+	SyncTags(ctx context.Context, in *SyncTagsRequest, opts ...grpc.CallOption) (*TagsResponse, error)
+	// PushShard uploads a packed shard, the first message must name the shard
+	// and every message may carry a chunk of the packed stream
+	PushShard(ctx context.Context, opts ...grpc.CallOption) (Archive_PushShardClient, error)
+	// PullShard downloads a packed shard as a series of chunks
+	PullShard(ctx context.Context, in *ShardRequest, opts ...grpc.CallOption) (Archive_PullShardClient, error)
+}
+
+type archiveClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewArchiveClient(cc grpc.ClientConnInterface) ArchiveClient {
+	return &archiveClient{cc}
+}
+
+func (c *archiveClient) Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Archive_Login_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) LoginTOTP(ctx context.Context, in *LoginTOTPRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Archive_LoginTOTP_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) ListIndexers(ctx context.Context, in *ListIndexersRequest, opts ...grpc.CallOption) (*ListIndexersResponse, error) {
+	out := new(ListIndexersResponse)
+	err := c.cc.Invoke(ctx, Archive_ListIndexers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) ListWells(ctx context.Context, in *ListWellsRequest, opts ...grpc.CallOption) (*ListWellsResponse, error) {
+	out := new(ListWellsResponse)
+	err := c.cc.Invoke(ctx, Archive_ListWells_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) GetWellTimeframe(ctx context.Context, in *WellRequest, opts ...grpc.CallOption) (*Timeframe, error) {
+	out := new(Timeframe)
+	err := c.cc.Invoke(ctx, Archive_GetWellTimeframe_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) ListShards(ctx context.Context, in *ListShardsRequest, opts ...grpc.CallOption) (*ListShardsResponse, error) {
+	out := new(ListShardsResponse)
+	err := c.cc.Invoke(ctx, Archive_ListShards_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) GetTags(ctx context.Context, in *GetTagsRequest, opts ...grpc.CallOption) (*TagsResponse, error) {
+	out := new(TagsResponse)
+	err := c.cc.Invoke(ctx, Archive_GetTags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) SyncTags(ctx context.Context, in *SyncTagsRequest, opts ...grpc.CallOption) (*TagsResponse, error) {
+	out := new(TagsResponse)
+	err := c.cc.Invoke(ctx, Archive_SyncTags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveClient) PushShard(ctx context.Context, opts ...grpc.CallOption) (Archive_PushShardClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Archive_ServiceDesc.Streams[0], Archive_PushShard_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &archivePushShardClient{stream}
+	return x, nil
+}
+
+type Archive_PushShardClient interface {
+	Send(*PushShardRequest) error
+	CloseAndRecv() (*PushShardResponse, error)
+	grpc.ClientStream
+}
+
+type archivePushShardClient struct {
+	grpc.ClientStream
+}
+
+func (x *archivePushShardClient) Send(m *PushShardRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *archivePushShardClient) CloseAndRecv() (*PushShardResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PushShardResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *archiveClient) PullShard(ctx context.Context, in *ShardRequest, opts ...grpc.CallOption) (Archive_PullShardClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Archive_ServiceDesc.Streams[1], Archive_PullShard_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &archivePullShardClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Archive_PullShardClient interface {
+	Recv() (*ShardChunk, error)
+	grpc.ClientStream
+}
+
+type archivePullShardClient struct {
+	grpc.ClientStream
+}
+
+func (x *archivePullShardClient) Recv() (*ShardChunk, error) {
+	m := new(ShardChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ArchiveServer is the server API for Archive service.
+// All implementations must embed UnimplementedArchiveServer
+// for forward compatibility
+type ArchiveServer interface {
+	Login(context.Context, *LoginRequest) (*LoginResponse, error)
+	LoginTOTP(context.Context, *LoginTOTPRequest) (*LoginResponse, error)
+	ListIndexers(context.Context, *ListIndexersRequest) (*ListIndexersResponse, error)
+	ListWells(context.Context, *ListWellsRequest) (*ListWellsResponse, error)
+	GetWellTimeframe(context.Context, *WellRequest) (*Timeframe, error)
+	ListShards(context.Context, *ListShardsRequest) (*ListShardsResponse, error)
+	GetTags(context.Context, *GetTagsRequest) (*TagsResponse, error)
+	SyncTags(context.Context, *SyncTagsRequest) (*TagsResponse, error)
+	// PushShard uploads a packed shard, the first message must name the shard
+	// and every message may carry a chunk of the packed stream
+	PushShard(Archive_PushShardServer) error
+	// PullShard downloads a packed shard as a series of chunks
+	PullShard(*ShardRequest, Archive_PullShardServer) error
+	mustEmbedUnimplementedArchiveServer()
+}
+
+// UnimplementedArchiveServer must be embedded to have forward compatible implementations.
+type UnimplementedArchiveServer struct {
+}
+
+func (UnimplementedArchiveServer) Login(context.Context, *LoginRequest) (*LoginResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Login not implemented")
+}
+func (UnimplementedArchiveServer) LoginTOTP(context.Context, *LoginTOTPRequest) (*LoginResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LoginTOTP not implemented")
+}
+func (UnimplementedArchiveServer) ListIndexers(context.Context, *ListIndexersRequest) (*ListIndexersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIndexers not implemented")
+}
+func (UnimplementedArchiveServer) ListWells(context.Context, *ListWellsRequest) (*ListWellsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListWells not implemented")
+}
+func (UnimplementedArchiveServer) GetWellTimeframe(context.Context, *WellRequest) (*Timeframe, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWellTimeframe not implemented")
+}
+func (UnimplementedArchiveServer) ListShards(context.Context, *ListShardsRequest) (*ListShardsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListShards not implemented")
+}
+func (UnimplementedArchiveServer) GetTags(context.Context, *GetTagsRequest) (*TagsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTags not implemented")
+}
+func (UnimplementedArchiveServer) SyncTags(context.Context, *SyncTagsRequest) (*TagsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SyncTags not implemented")
+}
+func (UnimplementedArchiveServer) PushShard(Archive_PushShardServer) error {
+	return status.Errorf(codes.Unimplemented, "method PushShard not implemented")
+}
+func (UnimplementedArchiveServer) PullShard(*ShardRequest, Archive_PullShardServer) error {
+	return status.Errorf(codes.Unimplemented, "method PullShard not implemented")
+}
+func (UnimplementedArchiveServer) mustEmbedUnimplementedArchiveServer() {}
+
+// UnsafeArchiveServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ArchiveServer will
+// result in compilation errors.
+type UnsafeArchiveServer interface {
+	mustEmbedUnimplementedArchiveServer()
+}
+
+func RegisterArchiveServer(s grpc.ServiceRegistrar, srv ArchiveServer) {
+	s.RegisterService(&Archive_ServiceDesc, srv)
+}
+
+func _Archive_Login_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).Login(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_Login_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).Login(ctx, req.(*LoginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_LoginTOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoginTOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).LoginTOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_LoginTOTP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).LoginTOTP(ctx, req.(*LoginTOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_ListIndexers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListIndexersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).ListIndexers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_ListIndexers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).ListIndexers(ctx, req.(*ListIndexersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_ListWells_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListWellsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).ListWells(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_ListWells_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).ListWells(ctx, req.(*ListWellsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_GetWellTimeframe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WellRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).GetWellTimeframe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_GetWellTimeframe_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).GetWellTimeframe(ctx, req.(*WellRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_ListShards_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListShardsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).ListShards(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_ListShards_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).ListShards(ctx, req.(*ListShardsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_GetTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTagsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).GetTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_GetTags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).GetTags(ctx, req.(*GetTagsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_SyncTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncTagsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServer).SyncTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Archive_SyncTags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServer).SyncTags(ctx, req.(*SyncTagsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Archive_PushShard_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ArchiveServer).PushShard(&archivePushShardServer{stream})
+}
+
+type Archive_PushShardServer interface {
+	SendAndClose(*PushShardResponse) error
+	Recv() (*PushShardRequest, error)
+	grpc.ServerStream
+}
+
+type archivePushShardServer struct {
+	grpc.ServerStream
+}
+
+func (x *archivePushShardServer) SendAndClose(m *PushShardResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *archivePushShardServer) Recv() (*PushShardRequest, error) {
+	m := new(PushShardRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Archive_PullShard_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ShardRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ArchiveServer).PullShard(m, &archivePullShardServer{stream})
+}
+
+type Archive_PullShardServer interface {
+	Send(*ShardChunk) error
+	grpc.ServerStream
+}
+
+type archivePullShardServer struct {
+	grpc.ServerStream
+}
+
+func (x *archivePullShardServer) Send(m *ShardChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Archive_ServiceDesc is the grpc.ServiceDesc for Archive service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Archive_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cloudarchive.Archive",
+	HandlerType: (*ArchiveServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Login",
+			Handler:    _Archive_Login_Handler,
+		},
+		{
+			MethodName: "LoginTOTP",
+			Handler:    _Archive_LoginTOTP_Handler,
+		},
+		{
+			MethodName: "ListIndexers",
+			Handler:    _Archive_ListIndexers_Handler,
+		},
+		{
+			MethodName: "ListWells",
+			Handler:    _Archive_ListWells_Handler,
+		},
+		{
+			MethodName: "GetWellTimeframe",
+			Handler:    _Archive_GetWellTimeframe_Handler,
+		},
+		{
+			MethodName: "ListShards",
+			Handler:    _Archive_ListShards_Handler,
+		},
+		{
+			MethodName: "GetTags",
+			Handler:    _Archive_GetTags_Handler,
+		},
+		{
+			MethodName: "SyncTags",
+			Handler:    _Archive_SyncTags_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PushShard",
+			Handler:       _Archive_PushShard_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PullShard",
+			Handler:       _Archive_PullShard_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "archive.proto",
+}
@@ -10,22 +10,52 @@ package auth
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gravwell/cloudarchive/pkg/flock"
 
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	defaultCost   int    = 12 //bcrypt cost
-	minCost       int    = 8  //not passwords may be below this cost
-	lineSplitChar string = `:`
+	defaultCost    int    = 12 //bcrypt cost
+	minCost        int    = 8  //not passwords may be below this cost
+	lineSplitChar  string = `:`
+	fieldSplitChar string = `=`
+
+	//optional metadata field keys
+	fieldDescription string = `desc`
+	fieldEmail       string = `email`
+	fieldCreated     string = `created`
+	fieldDisabled    string = `disabled`
+	fieldTOTP        string = `totp`
+	fieldIndexers    string = `indexers`
+	fieldRole        string = `role`
+	fieldQuota       string = `quota`
+
+	indexerSplitChar string = `,`
+
+	//generated passwords are drawn uniformly from this alphabet
+	passwordAlphabet      string = `ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789`
+	DefaultPasswordLength int    = 24
+
+	//credential roles, users without a role have full access
+	RoleFull     string = `full`
+	RoleReadOnly string = `readonly`
+	RoleAdmin    string = `admin` //full access, and may manage other users over the HTTP API
+
+	//how long to wait on another process holding the password file lock
+	lockTimeout = 2 * time.Second
 )
 
 var (
@@ -36,16 +66,88 @@ var (
 	ErrCorruptLine     = errors.New("passwd line is corrupt")
 	ErrInvalidUser     = errors.New("Invalid user")
 	ErrCustnumExists   = errors.New("userid already exists")
+	ErrUserDisabled    = errors.New("user is disabled")
+	ErrInvalidRole     = errors.New("invalid role")
 )
 
 type userHash struct {
-	custnum uint64
-	hash    []byte
+	custnum  uint64
+	hash     []byte
+	meta     Metadata
+	disabled bool
+	totp     string      //base32 encoded TOTP secret, empty if not enabled
+	indexers []uuid.UUID //indexers the user may push and pull for, empty allows any
+	role     string      //RoleFull, RoleReadOnly, or RoleAdmin
+	quota    uint64      //storage quota in bytes, zero is unlimited
+	extra    []string    //unknown fields, preserved so that newer files survive a rewrite
+}
+
+// Metadata holds optional, informational fields attached to a user record
+type Metadata struct {
+	Description string    `json:",omitempty"`
+	Email       string    `json:",omitempty"`
+	Created     time.Time `json:",omitempty"`
+}
+
+// UserInfo is an exportable summary of a user record, it never contains secrets
+type UserInfo struct {
+	ID            uint64
+	HashAlgorithm string
+	HashCost      int
+	Role          string
+	Disabled      bool        `json:",omitempty"`
+	TOTP          bool        `json:",omitempty"`
+	Indexers      []uuid.UUID `json:",omitempty"`
+	Quota         uint64      `json:",omitempty"`
+	Metadata
+}
+
+// GeneratePassword returns a random password of the given length, visually ambiguous characters are excluded
+func GeneratePassword(length int) (string, error) {
+	if length <= 0 {
+		length = DefaultPasswordLength
+	}
+	//reject bytes beyond the largest multiple of the alphabet size so every character is equally likely
+	limit := byte(256 - (256 % len(passwordAlphabet)))
+	out := make([]byte, 0, length)
+	buff := make([]byte, length)
+	for len(out) < length {
+		if _, err := rand.Read(buff); err != nil {
+			return ``, err
+		}
+		for _, b := range buff {
+			if b < limit && len(out) < length {
+				out = append(out, passwordAlphabet[int(b)%len(passwordAlphabet)])
+			}
+		}
+	}
+	return string(out), nil
+}
+
+// ImportUser describes a user to be created by ImportUsers, exactly one of
+// Password or Hash must be provided, Hash must be a bcrypt hash
+type ImportUser struct {
+	ID       uint64
+	Password string `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+	Metadata
 }
 
 type Auth struct {
 	sync.Mutex
 	fpath string
+	cost  int
+	cache authCache
+
+	totpLock  sync.Mutex
+	totpSteps map[uint64]uint64 //last TOTP time step accepted for each user
+}
+
+// authCache holds the most recently parsed contents of the passwd file
+// along with the file attributes observed when it was parsed
+type authCache struct {
+	fi  os.FileInfo
+	uhs []userHash
 }
 
 func NewAuthModule(fpath string) (*Auth, error) {
@@ -56,7 +158,7 @@ func NewAuthModule(fpath string) (*Auth, error) {
 				return nil, err
 			}
 			//we were able to create the file
-			return &Auth{fpath: fpath}, nil
+			return &Auth{fpath: fpath, cost: defaultCost}, nil
 		}
 		//some other error
 		return nil, err
@@ -69,7 +171,20 @@ func NewAuthModule(fpath string) (*Auth, error) {
 		return nil, err
 	}
 	//file exists and we can read and write from it
-	return &Auth{fpath: fpath}, nil
+	return &Auth{fpath: fpath, cost: defaultCost}, nil
+}
+
+// SetCost sets the target bcrypt cost, users that successfully authenticate
+// with a hash below this cost are transparently rehashed at the new cost
+func (a *Auth) SetCost(cost int) {
+	if cost > bcrypt.MaxCost {
+		cost = bcrypt.MaxCost
+	} else if cost < minCost {
+		cost = minCost
+	}
+	a.Lock()
+	a.cost = cost
+	a.Unlock()
 }
 
 // List returns a list of current users
@@ -80,19 +195,52 @@ func (a *Auth) List() (uhs []userHash, err error) {
 	return
 }
 
-// load opens the file, locks it, loads the contents and closes it
+// ListUsers returns a summary of every current user
+func (a *Auth) ListUsers() (uis []UserInfo, err error) {
+	var uhs []userHash
+	if uhs, err = a.List(); err != nil {
+		return
+	}
+	uis = make([]UserInfo, 0, len(uhs))
+	for _, uh := range uhs {
+		uis = append(uis, uh.Info())
+	}
+	return
+}
+
+// load returns the current set of users, if the file has not changed since the
+// last load the cached set is returned, the caller must hold the lock
 func (a *Auth) load() (uhs []userHash, err error) {
-	var fin *os.File
-	var uh userHash
+	var fi os.FileInfo
 	if a.fpath == `` {
 		err = ErrNotOpen
 		return
 	}
+	if fi, err = os.Stat(a.fpath); err != nil {
+		return
+	}
+	if a.cache.hit(fi) {
+		uhs = a.cache.get()
+		return
+	}
+	if uhs, err = a.loadFile(); err != nil {
+		a.cache.invalidate()
+		return
+	}
+	a.cache.set(fi, uhs)
+	uhs = a.cache.get()
+	return
+}
+
+// loadFile opens the file, locks it, loads the contents and closes it
+func (a *Auth) loadFile() (uhs []userHash, err error) {
+	var fin *os.File
+	var uh userHash
 	if fin, err = os.OpenFile(a.fpath, os.O_RDWR, 0660); err != nil {
 		return
 	}
 	//get an exclusive lock on the file
-	if err = flock.Flock(fin, true); err != nil {
+	if err = flock.FlockTimeout(fin, true, lockTimeout); err != nil {
 		fin.Close()
 		return
 	}
@@ -141,7 +289,16 @@ func (a *Auth) Authenticate(custnum, passwd string) (cid uint64, err error) {
 	}
 	for _, uh := range uhs {
 		if uh.custnum == cid {
-			err = bcrypt.CompareHashAndPassword(uh.hash, []byte(passwd))
+			if err = bcrypt.CompareHashAndPassword(uh.hash, []byte(passwd)); err != nil {
+				return
+			} else if uh.disabled {
+				//only report a disabled account when the password is correct
+				err = ErrUserDisabled
+				return
+			}
+			//the password is good, upgrade the hash if it is below our target cost
+			//failing to upgrade is not an authentication failure
+			a.upgradeHash(uh, passwd)
 			return
 		}
 	}
@@ -149,19 +306,71 @@ func (a *Auth) Authenticate(custnum, passwd string) (cid uint64, err error) {
 	return
 }
 
-func (a *Auth) AddUser(custnum uint64, passwd string, cost int) (err error) {
+// upgradeHash rehashes and persists a users password if the existing hash is below the target cost
+// the caller must have already validated the password against the hash
+func (a *Auth) upgradeHash(old userHash, passwd string) (err error) {
 	var uhs []userHash
-	if cost > bcrypt.MaxCost {
-		cost = bcrypt.MaxCost
-	} else if cost < minCost {
-		cost = minCost
+	var cost int
+	if cost, err = bcrypt.Cost(old.hash); err != nil {
+		return
 	}
+	a.Lock()
+	defer a.Unlock()
+	if cost >= a.cost {
+		return
+	}
+	//reload while holding the lock, the user may have changed since we validated
+	if uhs, err = a.load(); err != nil {
+		return
+	}
+	for i := range uhs {
+		if uhs[i].custnum != old.custnum {
+			continue
+		} else if !bytes.Equal(uhs[i].hash, old.hash) {
+			return //password was changed out from under us, leave it alone
+		}
+		if uhs[i].hash, err = bcrypt.GenerateFromPassword([]byte(passwd), a.cost); err != nil {
+			return
+		}
+		err = a.updateUsers(uhs)
+		return
+	}
+	return
+}
+
+// UserDisabled returns whether the given user has been disabled
+func (a *Auth) UserDisabled(custnum uint64) (disabled bool, err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err == nil {
+		disabled = uh.disabled
+	}
+	return
+}
+
+// AddUser adds a new user with an empty set of metadata
+func (a *Auth) AddUser(custnum uint64, passwd string, cost int) (err error) {
+	return a.AddUserWithMetadata(custnum, passwd, cost, Metadata{})
+}
+
+// AddUserWithMetadata adds a new user and attaches the provided metadata,
+// if the created timestamp is empty the current time is used.
+// A cost of zero hashes the password at the module's target cost.
+func (a *Auth) AddUserWithMetadata(custnum uint64, passwd string, cost int, md Metadata) (err error) {
+	var uhs []userHash
 	if custnum == 0 || len(passwd) == 0 {
 		err = errors.New("empty auth parameters")
 		return
 	}
 	a.Lock()
 	defer a.Unlock()
+	if cost == 0 {
+		cost = a.cost
+	}
+	if cost > bcrypt.MaxCost {
+		cost = bcrypt.MaxCost
+	} else if cost < minCost {
+		cost = minCost
+	}
 	if uhs, err = a.load(); err != nil {
 		return
 	}
@@ -174,7 +383,10 @@ func (a *Auth) AddUser(custnum uint64, passwd string, cost int) (err error) {
 	}
 
 	//this is a new customer, encode and append
-	uh := userHash{custnum: custnum}
+	uh := userHash{custnum: custnum, meta: md, role: RoleFull}
+	if uh.meta.Created.IsZero() {
+		uh.meta.Created = time.Now().UTC().Truncate(time.Second)
+	}
 	if uh.hash, err = bcrypt.GenerateFromPassword([]byte(passwd), cost); err != nil {
 		return
 	}
@@ -182,6 +394,84 @@ func (a *Auth) AddUser(custnum uint64, passwd string, cost int) (err error) {
 	return
 }
 
+// ImportUsers adds a batch of new users in a single update of the password file.
+// The batch is validated up front, if any user is invalid or already exists no users are added.
+// A zero cost hashes passwords at the cost given to SetCost.
+func (a *Auth) ImportUsers(ius []ImportUser, cost int) (err error) {
+	var uhs []userHash
+	if cost == 0 {
+		a.Lock()
+		cost = a.cost
+		a.Unlock()
+	}
+	if cost > bcrypt.MaxCost {
+		cost = bcrypt.MaxCost
+	} else if cost < minCost {
+		cost = minCost
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	seen := make(map[uint64]bool, len(ius))
+	nuhs := make([]userHash, 0, len(ius))
+	for _, iu := range ius {
+		if iu.ID == 0 {
+			err = errors.New("empty auth parameters")
+			return
+		} else if seen[iu.ID] {
+			err = fmt.Errorf("user %d: %w", iu.ID, ErrCustnumExists)
+			return
+		}
+		seen[iu.ID] = true
+		uh := userHash{custnum: iu.ID, meta: iu.Metadata, role: RoleFull}
+		if uh.meta.Created.IsZero() {
+			uh.meta.Created = now
+		}
+		if uh.hash, err = importHash(iu, cost); err != nil {
+			err = fmt.Errorf("user %d: %w", iu.ID, err)
+			return
+		}
+		nuhs = append(nuhs, uh)
+	}
+	if len(nuhs) == 0 {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if uhs, err = a.load(); err != nil {
+		return
+	}
+	for _, uh := range uhs {
+		if seen[uh.custnum] {
+			err = fmt.Errorf("user %d: %w", uh.custnum, ErrCustnumExists)
+			return
+		}
+	}
+	err = a.updateUsers(append(uhs, nuhs...))
+	return
+}
+
+// importHash returns the hash for an imported user, either validating the provided hash or generating one
+func importHash(iu ImportUser, cost int) (hash []byte, err error) {
+	if (iu.Password == ``) == (iu.Hash == ``) {
+		err = errors.New("exactly one of password or hash is required")
+		return
+	}
+	if iu.Password != `` {
+		hash, err = bcrypt.GenerateFromPassword([]byte(iu.Password), cost)
+		return
+	}
+	hash = []byte(iu.Hash)
+	var hc int
+	if strings.ContainsAny(iu.Hash, lineSplitChar+" \t\r\n") {
+		err = ErrCorruptLine
+	} else if hc, err = bcrypt.Cost(hash); err != nil {
+		return
+	} else if hc < minCost {
+		err = ErrInvalidHashCost
+	}
+	return
+}
+
 func (a *Auth) DeleteUser(custnum uint64) (err error) {
 	var uhs []userHash
 	if custnum == 0 {
@@ -234,7 +524,10 @@ func (a *Auth) ChangePassword(custnum uint64, passwd string) (err error) {
 	if cost, err = bcrypt.Cost(uhs[idx].hash); err != nil {
 		return
 	}
-	//check and update the cost
+	//check and update the cost, never rehash below our target cost
+	if cost < a.cost {
+		cost = a.cost
+	}
 	if cost > bcrypt.MaxCost {
 		cost = bcrypt.MaxCost
 	} else if cost < minCost {
@@ -249,6 +542,183 @@ func (a *Auth) ChangePassword(custnum uint64, passwd string) (err error) {
 	return
 }
 
+// GetUser returns a summary of a single user
+func (a *Auth) GetUser(custnum uint64) (ui UserInfo, err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err == nil {
+		ui = uh.Info()
+	}
+	return
+}
+
+// SetMetadata replaces the metadata associated with an existing user
+// if the created timestamp is empty the existing value is retained
+func (a *Auth) SetMetadata(custnum uint64, md Metadata) error {
+	return a.modifyUser(custnum, func(uh *userHash) error {
+		if md.Created.IsZero() {
+			md.Created = uh.meta.Created
+		}
+		uh.meta = md
+		return nil
+	})
+}
+
+// SetDisabled enables or disables an existing user without altering its hash
+func (a *Auth) SetDisabled(custnum uint64, disabled bool) error {
+	return a.modifyUser(custnum, func(uh *userHash) error {
+		uh.disabled = disabled
+		return nil
+	})
+}
+
+// SetTOTPSecret assigns a base32 encoded TOTP secret to a user, an empty secret disables TOTP
+func (a *Auth) SetTOTPSecret(custnum uint64, secret string) error {
+	if secret != `` {
+		if _, err := decodeTOTPSecret(secret); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTOTPSecret, err)
+		}
+	}
+	return a.modifyUser(custnum, func(uh *userHash) error {
+		uh.totp = secret
+		return nil
+	})
+}
+
+// SetIndexers restricts a user to the given set of indexer UUIDs, an empty set allows any indexer
+func (a *Auth) SetIndexers(custnum uint64, indexers []uuid.UUID) error {
+	return a.modifyUser(custnum, func(uh *userHash) error {
+		uh.indexers = append([]uuid.UUID(nil), indexers...)
+		return nil
+	})
+}
+
+// AllowedIndexers returns the indexer UUIDs the user is restricted to, an empty set allows any indexer
+func (a *Auth) AllowedIndexers(custnum uint64) (indexers []uuid.UUID, err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err == nil {
+		indexers = uh.indexers
+	}
+	return
+}
+
+// SetRole assigns a credential role to a user
+func (a *Auth) SetRole(custnum uint64, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	return a.modifyUser(custnum, func(uh *userHash) error {
+		uh.role = role
+		return nil
+	})
+}
+
+// UserRole returns the credential role assigned to a user
+func (a *Auth) UserRole(custnum uint64) (role string, err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err == nil {
+		role = uh.role
+	}
+	return
+}
+
+// SetQuota sets the storage quota for a user in bytes, zero removes the quota
+func (a *Auth) SetQuota(custnum uint64, quota uint64) error {
+	return a.modifyUser(custnum, func(uh *userHash) error {
+		uh.quota = quota
+		return nil
+	})
+}
+
+// UserQuota returns the storage quota for a user in bytes, zero means unlimited
+func (a *Auth) UserQuota(custnum uint64) (quota uint64, err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err == nil {
+		quota = uh.quota
+	}
+	return
+}
+
+// ValidRole returns true if the role is a known credential role
+func ValidRole(role string) bool {
+	return role == RoleFull || role == RoleReadOnly || role == RoleAdmin
+}
+
+// TOTPEnabled returns whether the user must provide a TOTP code to log in
+func (a *Auth) TOTPEnabled(custnum uint64) (enabled bool, err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err == nil {
+		enabled = uh.totp != ``
+	}
+	return
+}
+
+// ValidateTOTP checks a TOTP code for the given user, each code is only accepted once
+// and once a code is accepted the codes which came before it are no longer valid.
+// Accepted codes are tracked in memory, which covers the short window a code is valid for.
+func (a *Auth) ValidateTOTP(custnum uint64, code string) (err error) {
+	var uh userHash
+	if uh, err = a.getUser(custnum); err != nil {
+		return
+	} else if uh.totp == `` {
+		err = ErrTOTPNotEnabled
+		return
+	}
+	a.totpLock.Lock()
+	defer a.totpLock.Unlock()
+	var step uint64
+	if step, err = validateTOTP(uh.totp, code, time.Now(), a.totpSteps[custnum]); err != nil {
+		return
+	}
+	if a.totpSteps == nil {
+		a.totpSteps = map[uint64]uint64{}
+	}
+	a.totpSteps[custnum] = step
+	return
+}
+
+// getUser returns a copy of a single user
+func (a *Auth) getUser(custnum uint64) (uh userHash, err error) {
+	var uhs []userHash
+	a.Lock()
+	uhs, err = a.load()
+	a.Unlock()
+	if err != nil {
+		return
+	}
+	for i := range uhs {
+		if uhs[i].custnum == custnum {
+			uh = uhs[i]
+			return
+		}
+	}
+	err = ErrNotFound
+	return
+}
+
+// modifyUser loads the users, hands the requested user to fn, and writes the result back out
+func (a *Auth) modifyUser(custnum uint64, fn func(*userHash) error) (err error) {
+	var uhs []userHash
+	if custnum == 0 {
+		err = errors.New("empty auth parameters")
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if uhs, err = a.load(); err != nil {
+		return
+	}
+	for i := range uhs {
+		if uhs[i].custnum == custnum {
+			if err = fn(&uhs[i]); err == nil {
+				err = a.updateUsers(uhs)
+			}
+			return
+		}
+	}
+	err = ErrNotFound
+	return
+}
+
 // updateUsers updates the entire file, the caller must hold the lock
 func (a *Auth) updateUsers(uhs []userHash) (err error) {
 	pth := a.fpath + ".tmp"
@@ -256,20 +726,21 @@ func (a *Auth) updateUsers(uhs []userHash) (err error) {
 		err = ErrNotOpen
 		return
 	}
+	a.cache.invalidate()
 	//open our new file
 	var fn *os.File
 	if fn, err = os.OpenFile(pth, os.O_RDWR|os.O_CREATE, 0660); err != nil {
 		return
 	}
 	//get an exclusive lock on the file
-	if err = flock.Flock(fn, true); err != nil {
+	if err = flock.FlockTimeout(fn, true, lockTimeout); err != nil {
 		fn.Close()
 		return
 	}
 
 	//write out our users
 	for _, uh := range uhs {
-		if _, err = fmt.Fprintf(fn, "%d:%s\n", uh.custnum, string(uh.hash)); err != nil {
+		if _, err = fmt.Fprintln(fn, uh.line()); err != nil {
 			flock.Funlock(fn)
 			fn.Close()
 			os.Remove(pth)
@@ -286,7 +757,7 @@ func (a *Auth) updateUsers(uhs []userHash) (err error) {
 		return
 	}
 	//get an exclusive lock on the file
-	if err = flock.Flock(fio, true); err != nil {
+	if err = flock.FlockTimeout(fio, true, lockTimeout); err != nil {
 		flock.Funlock(fn)
 		fn.Close()
 		os.Remove(pth)
@@ -331,16 +802,17 @@ func (a *Auth) addUser(uh userHash) (err error) {
 		err = ErrNotOpen
 		return
 	}
+	a.cache.invalidate()
 	if fio, err = os.OpenFile(a.fpath, os.O_RDWR|os.O_APPEND, 0660); err != nil {
 		return
 	}
 	//get an exclusive lock on the file
-	if err = flock.Flock(fio, true); err != nil {
+	if err = flock.FlockTimeout(fio, true, lockTimeout); err != nil {
 		fio.Close()
 		return
 	}
 
-	if _, err = fmt.Fprintf(fio, "%d:%s\n", uh.custnum, string(uh.hash)); err != nil {
+	if _, err = fmt.Fprintln(fio, uh.line()); err != nil {
 		flock.Funlock(fio)
 		fio.Close()
 		return
@@ -365,9 +837,9 @@ func (uh *userHash) Parse(v string) error {
 		return ErrEmptyLine
 	}
 
-	//crack the line into its two components
+	//crack the line into its components, the first two are required
 	bits := strings.Split(v, lineSplitChar)
-	if len(bits) != 2 {
+	if len(bits) < 2 {
 		return ErrCorruptLine
 	}
 
@@ -383,14 +855,218 @@ func (uh *userHash) Parse(v string) error {
 	} else if cost < minCost {
 		return ErrInvalidHashCost
 	}
+	//parse any optional fields
+	uh.meta = Metadata{}
+	uh.disabled = false
+	uh.totp = ``
+	uh.indexers = nil
+	uh.role = RoleFull
+	uh.quota = 0
+	uh.extra = nil
+	for _, f := range bits[2:] {
+		if err = uh.parseField(f); err != nil {
+			return err
+		}
+	}
 	//successful parse
 	return nil
 }
 
+// parseField handles a single optional key=value field, unknown keys are retained
+func (uh *userHash) parseField(f string) error {
+	k, ev, ok := strings.Cut(f, fieldSplitChar)
+	if !ok || k == `` {
+		return ErrCorruptLine
+	}
+	v, err := url.QueryUnescape(ev)
+	if err != nil {
+		return fmt.Errorf("Invalid %s field: %v", k, err)
+	}
+	switch k {
+	case fieldDescription:
+		uh.meta.Description = v
+	case fieldEmail:
+		uh.meta.Email = v
+	case fieldCreated:
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid %s field: %v", k, err)
+		}
+		uh.meta.Created = time.Unix(ts, 0).UTC()
+	case fieldDisabled:
+		if uh.disabled, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("Invalid %s field: %v", k, err)
+		}
+	case fieldTOTP:
+		uh.totp = v
+	case fieldRole:
+		if !ValidRole(v) {
+			return fmt.Errorf("Invalid %s field: %w", k, ErrInvalidRole)
+		}
+		uh.role = v
+	case fieldQuota:
+		if uh.quota, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return fmt.Errorf("Invalid %s field: %v", k, err)
+		}
+	case fieldIndexers:
+		for _, id := range strings.Split(v, indexerSplitChar) {
+			guid, err := uuid.Parse(id)
+			if err != nil {
+				return fmt.Errorf("Invalid %s field: %v", k, err)
+			}
+			uh.indexers = append(uh.indexers, guid)
+		}
+	default:
+		uh.extra = append(uh.extra, f)
+	}
+	return nil
+}
+
+// line encodes the user into a single passwd file line, without the trailing newline
+func (uh userHash) line() string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatUint(uh.custnum, 10))
+	sb.WriteString(lineSplitChar)
+	sb.Write(uh.hash)
+	addField := func(k, v string) {
+		if v != `` {
+			sb.WriteString(lineSplitChar)
+			sb.WriteString(k)
+			sb.WriteString(fieldSplitChar)
+			sb.WriteString(url.QueryEscape(v))
+		}
+	}
+	addField(fieldDescription, uh.meta.Description)
+	addField(fieldEmail, uh.meta.Email)
+	//a creation time alone is not worth losing the two field form older servers can read
+	if !uh.meta.Created.IsZero() && uh.hasMetadata() {
+		addField(fieldCreated, strconv.FormatInt(uh.meta.Created.Unix(), 10))
+	}
+	if uh.disabled {
+		addField(fieldDisabled, `true`)
+	}
+	addField(fieldTOTP, uh.totp)
+	if uh.role != RoleFull {
+		addField(fieldRole, uh.role)
+	}
+	if uh.quota > 0 {
+		addField(fieldQuota, strconv.FormatUint(uh.quota, 10))
+	}
+	if len(uh.indexers) > 0 {
+		ids := make([]string, 0, len(uh.indexers))
+		for _, guid := range uh.indexers {
+			ids = append(ids, guid.String())
+		}
+		addField(fieldIndexers, strings.Join(ids, indexerSplitChar))
+	}
+	for _, f := range uh.extra {
+		sb.WriteString(lineSplitChar)
+		sb.WriteString(f)
+	}
+	return sb.String()
+}
+
+// hasMetadata reports whether the record carries any optional field other than its creation time
+func (uh userHash) hasMetadata() bool {
+	return uh.meta.Description != `` || uh.meta.Email != `` || uh.disabled || uh.totp != `` ||
+		uh.role != RoleFull || uh.quota > 0 || len(uh.indexers) > 0 || len(uh.extra) > 0
+}
+
 func (uh *userHash) ID() uint64 {
 	return uh.custnum
 }
 
+// Disabled returns true if the user has been disabled
+func (uh *userHash) Disabled() bool {
+	return uh.disabled
+}
+
+// TOTPEnabled returns true if the user has a TOTP secret assigned
+func (uh *userHash) TOTPEnabled() bool {
+	return uh.totp != ``
+}
+
+// Metadata returns the optional metadata associated with the user
+func (uh *userHash) Metadata() Metadata {
+	return uh.meta
+}
+
+// Info returns a summary of the user record without the hash or TOTP secret
+func (uh *userHash) Info() UserInfo {
+	return UserInfo{
+		ID:            uh.custnum,
+		HashAlgorithm: uh.hashAlgorithm(),
+		HashCost:      uh.hashCost(),
+		Role:          uh.role,
+		Disabled:      uh.disabled,
+		TOTP:          uh.totp != ``,
+		Indexers:      uh.indexers,
+		Quota:         uh.quota,
+		Metadata:      uh.meta,
+	}
+}
+
+// hashAlgorithm identifies the hash scheme from its prefix, for example bcrypt-2a
+func (uh *userHash) hashAlgorithm() string {
+	bits := strings.Split(string(uh.hash), `$`)
+	if len(bits) < 3 || bits[0] != `` {
+		return `unknown`
+	} else if strings.HasPrefix(bits[1], `2`) {
+		return `bcrypt-` + bits[1]
+	}
+	return bits[1]
+}
+
+// hashCost returns the bcrypt cost of the hash, or zero if it cannot be determined
+func (uh *userHash) hashCost() int {
+	cost, err := bcrypt.Cost(uh.hash)
+	if err != nil {
+		return 0
+	}
+	return cost
+}
+
+// Role returns the credential role assigned to the user
+func (uh *userHash) Role() string {
+	return uh.role
+}
+
+// Quota returns the storage quota for the user in bytes, zero means unlimited
+func (uh *userHash) Quota() uint64 {
+	return uh.quota
+}
+
+// Indexers returns the indexer UUIDs the user is restricted to, empty if unrestricted
+func (uh *userHash) Indexers() []uuid.UUID {
+	return uh.indexers
+}
+
+// hit returns true if the cache is populated and the file described by fi
+// is the same file, with the same size and modification time, that was cached
+func (ac *authCache) hit(fi os.FileInfo) bool {
+	return sameFileInfo(ac.fi, fi)
+}
+
+// get returns a copy of the cached users so callers can freely modify the set
+func (ac *authCache) get() (uhs []userHash) {
+	if len(ac.uhs) == 0 {
+		return
+	}
+	uhs = make([]userHash, len(ac.uhs))
+	copy(uhs, ac.uhs)
+	return
+}
+
+func (ac *authCache) set(fi os.FileInfo, uhs []userHash) {
+	ac.fi = fi
+	ac.uhs = uhs
+}
+
+func (ac *authCache) invalidate() {
+	ac.fi = nil
+	ac.uhs = nil
+}
+
 func testFile(p string) error {
 	if f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0660); err != nil {
 		return err
@@ -14,7 +14,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -242,3 +246,469 @@ func dropTestFile(p string) error {
 	}
 	return nil
 }
+
+func TestCache(t *testing.T) {
+	pth := filepath.Join(tdir, "test7")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uhs, err := a.List(); err != nil {
+		t.Fatal(err)
+	} else if len(uhs) != 2 {
+		t.Fatalf("Load count is invalid: %d != 2", len(uhs))
+	} else if a.cache.fi == nil {
+		t.Fatal("load did not populate the cache")
+	}
+	//modifying the returned set must not touch the cache
+	if uhs, err := a.List(); err != nil {
+		t.Fatal(err)
+	} else {
+		uhs[0].custnum = 0
+	}
+	if _, err := a.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+
+	//change the file out from under the auth module and make sure we pick it up
+	fout, err := os.OpenFile(pth, os.O_WRONLY|os.O_TRUNC, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(fout, testUser2+"\n"); err != nil {
+		fout.Close()
+		t.Fatal(err)
+	} else if err = fout.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(testUser1IDS, testUser1Password); err != ErrInvalidUser {
+		t.Fatal("stale cache used after file change")
+	}
+	if cid, err := a.Authenticate(testUser2IDS, testUser2Password); err != nil {
+		t.Fatal(err)
+	} else if cid != testUser2ID {
+		t.Fatal("bad userid")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	pth := filepath.Join(tdir, "test8")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := Metadata{
+		Description: `test: user=with "odd" chars`,
+		Email:       `test@example.com`,
+	}
+	if err = a.AddUserWithMetadata(10, `password`, 8, md); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetMetadata(testUser1ID, Metadata{Description: `user one`}); err != nil {
+		t.Fatal(err)
+	}
+	//reload from a fresh module so we are reading what hit the disk
+	if a, err = NewAuthModule(pth); err != nil {
+		t.Fatal(err)
+	}
+	uhs, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(uhs) != 3 {
+		t.Fatalf("Load count is invalid: %d != 3", len(uhs))
+	}
+	for _, uh := range uhs {
+		got := uh.Metadata()
+		switch uh.ID() {
+		case 10:
+			if got.Description != md.Description || got.Email != md.Email {
+				t.Fatalf("bad metadata: %+v", got)
+			} else if got.Created.IsZero() {
+				t.Fatal("created time not set")
+			}
+		case testUser1ID:
+			if got.Description != `user one` || got.Email != `` {
+				t.Fatalf("bad metadata: %+v", got)
+			}
+		case testUser2ID:
+			if got != (Metadata{}) {
+				t.Fatalf("unexpected metadata: %+v", got)
+			}
+		}
+	}
+	//legacy users and users with metadata must both still authenticate
+	if _, err := a.Authenticate(`10`, `password`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+
+	//unknown fields are preserved across a rewrite
+	var uh userHash
+	if err = uh.Parse(testUser2 + `:future=value`); err != nil {
+		t.Fatal(err)
+	} else if uh.line() != testUser2+`:future=value` {
+		t.Fatalf("unknown field not preserved: %s", uh.line())
+	}
+	if err = uh.Parse(testUser2 + `:bad`); err != ErrCorruptLine {
+		t.Fatalf("failed to catch corrupt field: %v", err)
+	}
+
+	//users without metadata keep the two field form, so older servers can still read the file
+	if err = a.AddUser(11, `password`, 8); err != nil {
+		t.Fatal(err)
+	} else if uh, err := a.getUser(11); err != nil {
+		t.Fatal(err)
+	} else if bits := strings.Split(uh.line(), lineSplitChar); len(bits) != 2 {
+		t.Fatalf("plain user written with metadata: %s", uh.line())
+	}
+}
+
+func TestIndexers(t *testing.T) {
+	pth := filepath.Join(tdir, "test11")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxs, err := a.AllowedIndexers(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 0 {
+		t.Fatalf("new user has indexer restrictions: %v", idxs)
+	}
+	set := []uuid.UUID{uuid.New(), uuid.New()}
+	if err = a.SetIndexers(testUser1ID, set); err != nil {
+		t.Fatal(err)
+	}
+	//reload from disk to make sure the field round trips
+	if a, err = NewAuthModule(pth); err != nil {
+		t.Fatal(err)
+	}
+	if idxs, err := a.AllowedIndexers(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != len(set) || idxs[0] != set[0] || idxs[1] != set[1] {
+		t.Fatalf("bad indexer set: %v != %v", idxs, set)
+	}
+	if idxs, err := a.AllowedIndexers(testUser2ID); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 0 {
+		t.Fatalf("other user picked up indexer restrictions: %v", idxs)
+	}
+	if _, err = a.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+	//clearing the set removes the restriction
+	if err = a.SetIndexers(testUser1ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if idxs, err := a.AllowedIndexers(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 0 {
+		t.Fatalf("indexer restrictions not cleared: %v", idxs)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	pth := filepath.Join(tdir, "test12")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, err := a.UserRole(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if role != RoleFull {
+		t.Fatalf("bad default role: %q", role)
+	}
+	if err = a.SetRole(testUser1ID, `superuser`); err != ErrInvalidRole {
+		t.Fatalf("failed to catch invalid role: %v", err)
+	}
+	if err = a.SetRole(testUser1ID, RoleReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	//reload from disk to make sure the field round trips
+	if a, err = NewAuthModule(pth); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := a.UserRole(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if role != RoleReadOnly {
+		t.Fatalf("bad role: %q", role)
+	}
+	if role, err := a.UserRole(testUser2ID); err != nil {
+		t.Fatal(err)
+	} else if role != RoleFull {
+		t.Fatalf("other user picked up role: %q", role)
+	}
+	if err = a.SetRole(testUser2ID, RoleAdmin); err != nil {
+		t.Fatal(err)
+	} else if uis, err := a.ListUsers(); err != nil {
+		t.Fatal(err)
+	} else if len(uis) != 2 || uis[1].ID != testUser2ID || uis[1].Role != RoleAdmin {
+		t.Fatalf("bad users %+v", uis)
+	}
+	if err = a.AddUser(1234, `password`, minCost); err != nil {
+		t.Fatal(err)
+	} else if role, err := a.UserRole(1234); err != nil {
+		t.Fatal(err)
+	} else if role != RoleFull {
+		t.Fatalf("bad role for new user: %q", role)
+	}
+	//a zero cost hashes at the module's target cost
+	a.SetCost(minCost + 1)
+	if err = a.AddUser(1235, `password`, 0); err != nil {
+		t.Fatal(err)
+	} else if ui, err := a.GetUser(1235); err != nil {
+		t.Fatal(err)
+	} else if ui.HashCost != minCost+1 {
+		t.Fatalf("bad cost for new user: %d", ui.HashCost)
+	}
+}
+
+func TestImport(t *testing.T) {
+	pth := filepath.Join(tdir, "test13")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ius := []ImportUser{
+		ImportUser{ID: 1000, Password: `password1000`},
+		ImportUser{ID: 1001, Hash: `$2a$10$rMk0Usz6tkteuRsyvRk6mej7eEhV/EKmBklxDn9YCdV4r95ByGEae`, Metadata: Metadata{Email: `x@example.org`}},
+	}
+	if err = a.ImportUsers(ius, minCost); err != nil {
+		t.Fatal(err)
+	}
+	if cid, err := a.Authenticate(`1000`, `password1000`); err != nil {
+		t.Fatal(err)
+	} else if cid != 1000 {
+		t.Fatal("bad userid")
+	}
+	//the pre-computed hash is the same as testUser2
+	if _, err := a.Authenticate(`1001`, testUser2Password); err != nil {
+		t.Fatal(err)
+	}
+	if uh, err := a.getUser(1001); err != nil {
+		t.Fatal(err)
+	} else if uh.meta.Email != `x@example.org` || uh.meta.Created.IsZero() {
+		t.Fatalf("bad metadata: %+v", uh.meta)
+	}
+
+	//a batch containing any bad entry must not add anything
+	bad := [][]ImportUser{
+		[]ImportUser{ImportUser{ID: 2000, Password: `foo`}, ImportUser{ID: testUser1ID, Password: `foo`}},
+		[]ImportUser{ImportUser{ID: 2000, Password: `foo`}, ImportUser{ID: 2000, Password: `bar`}},
+		[]ImportUser{ImportUser{ID: 2000, Password: `foo`}, ImportUser{ID: 2001}},
+		[]ImportUser{ImportUser{ID: 2000, Password: `foo`}, ImportUser{ID: 2001, Password: `foo`, Hash: `bar`}},
+		[]ImportUser{ImportUser{ID: 2000, Password: `foo`}, ImportUser{ID: 2001, Hash: `notahash`}},
+		[]ImportUser{ImportUser{ID: 2000, Password: `foo`}, ImportUser{ID: 2001, Hash: testUser1[len(testUser1IDS)+1:] + `:role=full`}},
+	}
+	for i, b := range bad {
+		if err = a.ImportUsers(b, minCost); err == nil {
+			t.Fatalf("failed to catch bad batch %d", i)
+		}
+		if _, err = a.getUser(2000); err != ErrNotFound {
+			t.Fatalf("bad batch %d partially imported: %v", i, err)
+		}
+	}
+	if uhs, err := a.List(); err != nil {
+		t.Fatal(err)
+	} else if len(uhs) != 4 {
+		t.Fatalf("bad user count: %d", len(uhs))
+	}
+}
+
+func TestQuota(t *testing.T) {
+	pth := filepath.Join(tdir, "test14")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, err := a.UserQuota(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if q != 0 {
+		t.Fatalf("new user has a quota: %d", q)
+	}
+	if err = a.SetQuota(testUser1ID, 1<<40); err != nil {
+		t.Fatal(err)
+	}
+	//reload from disk to make sure the field round trips
+	if a, err = NewAuthModule(pth); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := a.UserQuota(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if q != 1<<40 {
+		t.Fatalf("bad quota: %d", q)
+	}
+	if err = a.SetQuota(testUser1ID, 0); err != nil {
+		t.Fatal(err)
+	} else if q, err := a.UserQuota(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if q != 0 {
+		t.Fatalf("quota not removed: %d", q)
+	}
+	if err = a.SetQuota(1, 100); err != ErrNotFound {
+		t.Fatalf("failed to catch missing user: %v", err)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	pth := filepath.Join(tdir, "test15")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ui, err := a.GetUser(testUser2ID); err != nil {
+		t.Fatal(err)
+	} else if ui.ID != testUser2ID || ui.HashAlgorithm != `bcrypt-2a` || ui.HashCost != 10 || ui.Role != RoleFull {
+		t.Fatalf("bad user info: %+v", ui)
+	}
+	if _, err = a.GetUser(1); err != ErrNotFound {
+		t.Fatalf("failed to catch missing user: %v", err)
+	}
+	uh := userHash{hash: []byte(`$apr1$9Cv/OMGj$ZomWQzuQbL.3TRCS81A1g/`)}
+	if alg := uh.hashAlgorithm(); alg != `apr1` {
+		t.Fatalf("bad hash algorithm: %s", alg)
+	} else if cost := uh.hashCost(); cost != 0 {
+		t.Fatalf("bad cost for non-bcrypt hash: %d", cost)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	pth := filepath.Join(tdir, "test9")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetDisabled(testUser1ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Authenticate(testUser1IDS, testUser1Password); err != ErrUserDisabled {
+		t.Fatalf("disabled user was not locked: %v", err)
+	}
+	//a bad password should not reveal that the account is disabled
+	if _, err = a.Authenticate(testUser1IDS, `foobar`); err == nil || err == ErrUserDisabled {
+		t.Fatalf("bad password returned %v", err)
+	}
+	if disabled, err := a.UserDisabled(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if !disabled {
+		t.Fatal("user not reported as disabled")
+	}
+	if disabled, err := a.UserDisabled(testUser2ID); err != nil {
+		t.Fatal(err)
+	} else if disabled {
+		t.Fatal("user incorrectly reported as disabled")
+	}
+	//the hash must survive so that unlocking restores access
+	if err = a.SetDisabled(testUser1ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if cid, err := a.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	} else if cid != testUser1ID {
+		t.Fatal("bad userid")
+	}
+	if err = a.SetDisabled(1, true); err != ErrNotFound {
+		t.Fatalf("failed to catch missing user: %v", err)
+	}
+}
+
+func TestCostUpgrade(t *testing.T) {
+	pth := filepath.Join(tdir, "test10")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCost := func(id uint64) int {
+		uhs, err := a.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, uh := range uhs {
+			if uh.ID() == id {
+				cost, err := bcrypt.Cost(uh.hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return cost
+			}
+		}
+		t.Fatalf("user %d not found", id)
+		return 0
+	}
+	a.SetCost(11)
+	//user 2 is stored at cost 10, user 1 at cost 12
+	if _, err = a.Authenticate(testUser2IDS, `foobar`); err == nil {
+		t.Fatal("failed to catch bad password")
+	} else if c := getCost(testUser2ID); c != 10 {
+		t.Fatalf("hash upgraded on bad password: %d", c)
+	}
+	if _, err = a.Authenticate(testUser2IDS, testUser2Password); err != nil {
+		t.Fatal(err)
+	} else if c := getCost(testUser2ID); c != 11 {
+		t.Fatalf("hash not upgraded: %d != 11", c)
+	}
+	if _, err = a.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	} else if c := getCost(testUser1ID); c != 12 {
+		t.Fatalf("hash should not be downgraded: %d != 12", c)
+	}
+	//upgraded hash must still work
+	if cid, err := a.Authenticate(testUser2IDS, testUser2Password); err != nil {
+		t.Fatal(err)
+	} else if cid != testUser2ID {
+		t.Fatal("bad userid")
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		p, err := GeneratePassword(DefaultPasswordLength)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(p) != DefaultPasswordLength {
+			t.Fatalf("bad length: %d", len(p))
+		} else if seen[p] {
+			t.Fatalf("duplicate password %s", p)
+		}
+		seen[p] = true
+		for _, c := range p {
+			if !strings.ContainsRune(passwordAlphabet, c) {
+				t.Fatalf("invalid character %q in %s", c, p)
+			}
+		}
+	}
+	if p, err := GeneratePassword(0); err != nil {
+		t.Fatal(err)
+	} else if len(p) != DefaultPasswordLength {
+		t.Fatalf("bad default length: %d", len(p))
+	}
+}
@@ -0,0 +1,175 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnsupportedHash = errors.New("unsupported htpasswd hash, only bcrypt is supported")
+)
+
+// HtpasswdAuth authenticates users against a standard Apache htpasswd file.
+// Only bcrypt entries (htpasswd -B) are supported.  Because htpasswd files are
+// keyed by username, a map file is used to assign customer numbers to usernames.
+// Each line of the map file is of the form:
+//
+//	username:customer number
+//
+// Both files are reloaded whenever they change on disk.
+type HtpasswdAuth struct {
+	sync.Mutex
+	passPath string
+	mapPath  string
+	passFi   os.FileInfo
+	mapFi    os.FileInfo
+	hashes   map[string][]byte //username to hash
+	users    map[uint64]string //customer number to username
+}
+
+func NewHtpasswdAuthModule(passPath, mapPath string) (*HtpasswdAuth, error) {
+	if passPath == `` || mapPath == `` {
+		return nil, errors.New("htpasswd and map file paths are required")
+	}
+	ha := &HtpasswdAuth{
+		passPath: passPath,
+		mapPath:  mapPath,
+	}
+	if err := ha.reload(); err != nil {
+		return nil, err
+	}
+	return ha, nil
+}
+
+func (ha *HtpasswdAuth) Authenticate(custnum, passwd string) (cid uint64, err error) {
+	if len(custnum) == 0 || len(passwd) == 0 {
+		err = errors.New("empty auth parameters")
+		return
+	}
+	if cid, err = strconv.ParseUint(custnum, 10, 64); err != nil {
+		return
+	}
+	var hash []byte
+	ha.Lock()
+	if err = ha.reload(); err == nil {
+		if user, ok := ha.users[cid]; !ok {
+			err = ErrInvalidUser
+		} else if hash, ok = ha.hashes[user]; !ok {
+			err = ErrInvalidUser
+		}
+	}
+	ha.Unlock()
+	if err != nil {
+		return
+	}
+	if _, err = bcrypt.Cost(hash); err != nil {
+		err = ErrUnsupportedHash
+		return
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(passwd))
+	return
+}
+
+// reload re-reads either file if it has changed since it was last loaded, the caller must hold the lock
+func (ha *HtpasswdAuth) reload() (err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(ha.passPath); err != nil {
+		return
+	} else if !sameFileInfo(ha.passFi, fi) {
+		var hashes map[string][]byte
+		if hashes, err = loadHtpasswd(ha.passPath); err != nil {
+			return
+		}
+		ha.hashes, ha.passFi = hashes, fi
+	}
+	if fi, err = os.Stat(ha.mapPath); err != nil {
+		return
+	} else if !sameFileInfo(ha.mapFi, fi) {
+		var users map[uint64]string
+		if users, err = loadHtpasswdMap(ha.mapPath); err != nil {
+			return
+		}
+		ha.users, ha.mapFi = users, fi
+	}
+	return
+}
+
+func loadHtpasswd(p string) (hashes map[string][]byte, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	hashes = make(map[string][]byte)
+	scn := bufio.NewScanner(fin)
+	for ln := 1; scn.Scan(); ln++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, lineSplitChar)
+		if !ok || user == `` || hash == `` {
+			err = fmt.Errorf("%s line %d: %w", p, ln, ErrCorruptLine)
+			return
+		}
+		hashes[user] = []byte(hash)
+	}
+	err = scn.Err()
+	return
+}
+
+func loadHtpasswdMap(p string) (users map[uint64]string, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	users = make(map[uint64]string)
+	scn := bufio.NewScanner(fin)
+	for ln := 1; scn.Scan(); ln++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		user, cn, ok := strings.Cut(line, lineSplitChar)
+		if !ok || user == `` {
+			err = fmt.Errorf("%s line %d: %w", p, ln, ErrCorruptLine)
+			return
+		}
+		var cid uint64
+		if cid, err = strconv.ParseUint(strings.TrimSpace(cn), 10, 64); err != nil {
+			err = fmt.Errorf("%s line %d: Invalid customer number %s: %v", p, ln, cn, err)
+			return
+		} else if _, ok := users[cid]; ok {
+			err = fmt.Errorf("%s line %d: %w", p, ln, ErrCustnumExists)
+			return
+		}
+		users[cid] = strings.TrimSpace(user)
+	}
+	err = scn.Err()
+	return
+}
+
+// sameFileInfo returns true if both are populated and describe the same file
+// with the same size and modification time
+func sameFileInfo(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
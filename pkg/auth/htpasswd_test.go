@@ -0,0 +1,83 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	passPth := filepath.Join(tdir, "htpasswd")
+	mapPth := filepath.Join(tdir, "htpasswd.map")
+	hash, err := bcrypt.GenerateFromPassword([]byte(testUser1Password), minCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//htpasswd -B writes the $2y$ prefix, make sure we handle it
+	hash = []byte(strings.Replace(string(hash), `$2a$`, `$2y$`, 1))
+	htpasswd := "# managed by htpasswd\n" +
+		"alice:" + string(hash) + "\n" +
+		"bob:$apr1$9Cv/OMGj$ZomWQzuQbL.3TRCS81A1g/\n"
+	if err := os.WriteFile(passPth, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mapPth, []byte("alice:"+testUser1IDS+"\nbob:"+testUser2IDS+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ha, err := NewHtpasswdAuthModule(passPth, mapPth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid, err := ha.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	} else if cid != testUser1ID {
+		t.Fatalf("bad customer number: %d != %d", cid, testUser1ID)
+	}
+	if _, err := ha.Authenticate(testUser1IDS, `wrong`); err == nil {
+		t.Fatal("failed to reject bad password")
+	}
+	if _, err := ha.Authenticate(testUser2IDS, testUser2Password); err != ErrUnsupportedHash {
+		t.Fatalf("failed to reject non-bcrypt hash: %v", err)
+	}
+	if _, err := ha.Authenticate(`1234`, testUser1Password); err != ErrInvalidUser {
+		t.Fatalf("failed to reject unmapped user: %v", err)
+	}
+
+	//remap alice and make sure the change is picked up without a restart
+	if err := os.WriteFile(mapPth, []byte("alice:1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//make sure the modification time moves on filesystems with coarse timestamps
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(mapPth, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ha.Authenticate(testUser1IDS, testUser1Password); err != ErrInvalidUser {
+		t.Fatalf("failed to pick up map change: %v", err)
+	}
+	if cid, err := ha.Authenticate(`1234`, testUser1Password); err != nil {
+		t.Fatal(err)
+	} else if cid != 1234 {
+		t.Fatalf("bad customer number: %d", cid)
+	}
+
+	//duplicate customer numbers are rejected
+	if err := os.WriteFile(mapPth, []byte("alice:1234\nbob:1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHtpasswdAuthModule(passPth, mapPth); err == nil {
+		t.Fatal("failed to catch duplicate customer number")
+	}
+}
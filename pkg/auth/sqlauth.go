@@ -0,0 +1,204 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	DriverPostgres string = `postgres`
+	DriverMySQL    string = `mysql`
+
+	DefaultSQLTable string = `users`
+
+	StatusActive   string = `active`
+	StatusDisabled string = `disabled`
+
+	sqlTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidDriver = errors.New("unsupported SQL driver")
+	ErrInvalidTable  = errors.New("invalid SQL table name")
+
+	tableRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+)
+
+// SQLAuth authenticates users against a table in an SQL database.
+// The table must contain the following columns:
+//
+//	cid    - integer customer number, unique
+//	hash   - bcrypt hash of the users password
+//	status - "active" or "disabled"
+//
+// The driver for the database must be registered by the caller,
+// typically by importing it in the main package.
+type SQLAuth struct {
+	sync.Mutex
+	db     *sql.DB
+	driver string
+	cost   int
+
+	selectQuery string
+	updateQuery string
+}
+
+// NewSQLAuthModule opens a connection to the database and validates that the user table is reachable
+func NewSQLAuthModule(driver, dsn, table string) (*SQLAuth, error) {
+	if table == `` {
+		table = DefaultSQLTable
+	}
+	if !tableRegex.MatchString(table) {
+		return nil, ErrInvalidTable
+	}
+	sel, upd, err := buildSQLQueries(driver, table)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	sa := &SQLAuth{
+		db:          db,
+		driver:      driver,
+		cost:        defaultCost,
+		selectQuery: sel,
+		updateQuery: upd,
+	}
+	//make sure we can actually hit the table
+	if _, _, err = sa.getUser(0); err != nil && err != ErrNotFound {
+		db.Close()
+		return nil, fmt.Errorf("failed to query user table %s: %w", table, err)
+	}
+	return sa, nil
+}
+
+func buildSQLQueries(driver, table string) (sel, upd string, err error) {
+	switch driver {
+	case DriverPostgres:
+		sel = fmt.Sprintf(`SELECT hash, status FROM %s WHERE cid = $1`, table)
+		upd = fmt.Sprintf(`UPDATE %s SET hash = $1 WHERE cid = $2 AND hash = $3`, table)
+	case DriverMySQL:
+		sel = fmt.Sprintf(`SELECT hash, status FROM %s WHERE cid = ?`, table)
+		upd = fmt.Sprintf(`UPDATE %s SET hash = ? WHERE cid = ? AND hash = ?`, table)
+	default:
+		err = ErrInvalidDriver
+	}
+	return
+}
+
+// SetCost sets the target bcrypt cost, users that successfully authenticate
+// with a hash below this cost are transparently rehashed at the new cost
+func (sa *SQLAuth) SetCost(cost int) {
+	if cost > bcrypt.MaxCost {
+		cost = bcrypt.MaxCost
+	} else if cost < minCost {
+		cost = minCost
+	}
+	sa.Lock()
+	sa.cost = cost
+	sa.Unlock()
+}
+
+func (sa *SQLAuth) Close() error {
+	return sa.db.Close()
+}
+
+func (sa *SQLAuth) Authenticate(custnum, passwd string) (cid uint64, err error) {
+	var hash []byte
+	var disabled bool
+	if len(custnum) == 0 || len(passwd) == 0 {
+		err = errors.New("empty auth parameters")
+		return
+	}
+	if cid, err = strconv.ParseUint(custnum, 10, 64); err != nil {
+		return
+	}
+	if hash, disabled, err = sa.getUser(cid); err != nil {
+		if err == ErrNotFound {
+			err = ErrInvalidUser
+		}
+		return
+	}
+	if err = bcrypt.CompareHashAndPassword(hash, []byte(passwd)); err != nil {
+		return
+	} else if disabled {
+		//only report a disabled account when the password is correct
+		err = ErrUserDisabled
+		return
+	}
+	//failing to upgrade is not an authentication failure
+	sa.upgradeHash(cid, hash, passwd)
+	return
+}
+
+// UserDisabled returns whether the given user has been disabled
+func (sa *SQLAuth) UserDisabled(cid uint64) (disabled bool, err error) {
+	_, disabled, err = sa.getUser(cid)
+	return
+}
+
+func (sa *SQLAuth) getUser(cid uint64) (hash []byte, disabled bool, err error) {
+	var status string
+	ctx, cf := newSQLContext()
+	defer cf()
+	row := sa.db.QueryRowContext(ctx, sa.selectQuery, cid)
+	if err = row.Scan(&hash, &status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = ErrNotFound
+		}
+		return
+	}
+	switch status {
+	case StatusActive:
+	case StatusDisabled:
+		disabled = true
+	default:
+		err = fmt.Errorf("invalid status %q for user %d", status, cid)
+	}
+	return
+}
+
+// upgradeHash rehashes and persists a users password if the existing hash is below the target cost
+// the update only applies if the hash has not been changed since it was validated
+func (sa *SQLAuth) upgradeHash(cid uint64, old []byte, passwd string) (err error) {
+	var cost int
+	var hash []byte
+	if cost, err = bcrypt.Cost(old); err != nil {
+		return
+	}
+	sa.Lock()
+	target := sa.cost
+	sa.Unlock()
+	if cost >= target {
+		return
+	}
+	if hash, err = bcrypt.GenerateFromPassword([]byte(passwd), target); err != nil {
+		return
+	}
+	ctx, cf := newSQLContext()
+	defer cf()
+	_, err = sa.db.ExecContext(ctx, sa.updateQuery, string(hash), cid, string(old))
+	return
+}
+
+func newSQLContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), sqlTimeout)
+}
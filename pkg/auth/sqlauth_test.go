@@ -0,0 +1,308 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package auth
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	fakeSQLDriver = `fakesql`
+)
+
+func init() {
+	sql.Register(fakeSQLDriver, &fakeDriver{dbs: map[string]*fakeDB{}})
+}
+
+func TestSQLQueries(t *testing.T) {
+	if sel, upd, err := buildSQLQueries(DriverPostgres, `users`); err != nil {
+		t.Fatal(err)
+	} else if sel != `SELECT hash, status FROM users WHERE cid = $1` {
+		t.Fatalf("bad select query: %s", sel)
+	} else if upd != `UPDATE users SET hash = $1 WHERE cid = $2 AND hash = $3` {
+		t.Fatalf("bad update query: %s", upd)
+	}
+	if sel, _, err := buildSQLQueries(DriverMySQL, `archive.users`); err != nil {
+		t.Fatal(err)
+	} else if sel != `SELECT hash, status FROM archive.users WHERE cid = ?` {
+		t.Fatalf("bad select query: %s", sel)
+	}
+	if _, _, err := buildSQLQueries(`sqlite`, `users`); err != ErrInvalidDriver {
+		t.Fatalf("failed to catch bad driver: %v", err)
+	}
+	//table names are interpolated, make sure we reject anything that isn't an identifier
+	for _, tbl := range []string{`users; DROP TABLE users`, `1users`, `a.b.c`, `users--`} {
+		if _, err := NewSQLAuthModule(DriverPostgres, ``, tbl); err != ErrInvalidTable {
+			t.Fatalf("failed to catch bad table %q: %v", tbl, err)
+		}
+	}
+}
+
+func TestSQLAuthenticate(t *testing.T) {
+	sa, db := newTestSQLAuth(t)
+	db.addUser(t, testUser1ID, testUser1Password, StatusActive)
+
+	if cid, err := sa.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	} else if cid != testUser1ID {
+		t.Fatalf("bad cid: %d != %d", cid, testUser1ID)
+	}
+	if _, err := sa.Authenticate(testUser1IDS, `not the password`); err != bcrypt.ErrMismatchedHashAndPassword {
+		t.Fatalf("authenticated with a bad password: %v", err)
+	}
+	if _, err := sa.Authenticate(testUser1IDS, ``); err == nil {
+		t.Fatal("authenticated with an empty password")
+	}
+	if _, err := sa.Authenticate(`not a number`, testUser1Password); err == nil {
+		t.Fatal("authenticated with a bad customer number")
+	}
+	if disabled, err := sa.UserDisabled(testUser1ID); err != nil || disabled {
+		t.Fatalf("bad disabled state: %v %v", disabled, err)
+	}
+}
+
+func TestSQLAuthDisabled(t *testing.T) {
+	sa, db := newTestSQLAuth(t)
+	db.addUser(t, testUser1ID, testUser1Password, StatusDisabled)
+
+	if _, err := sa.Authenticate(testUser1IDS, testUser1Password); err != ErrUserDisabled {
+		t.Fatalf("disabled user was not rejected: %v", err)
+	}
+	//a bad password must not reveal that the account exists and is disabled
+	if _, err := sa.Authenticate(testUser1IDS, `not the password`); err != bcrypt.ErrMismatchedHashAndPassword {
+		t.Fatalf("bad password on a disabled user returned %v", err)
+	}
+	if disabled, err := sa.UserDisabled(testUser1ID); err != nil || !disabled {
+		t.Fatalf("bad disabled state: %v %v", disabled, err)
+	}
+}
+
+func TestSQLAuthInvalidStatus(t *testing.T) {
+	sa, db := newTestSQLAuth(t)
+	db.addUser(t, testUser1ID, testUser1Password, `suspended`)
+
+	if _, err := sa.Authenticate(testUser1IDS, testUser1Password); err == nil {
+		t.Fatal("authenticated a user with an invalid status")
+	} else if err == ErrUserDisabled || !strings.Contains(err.Error(), `suspended`) {
+		t.Fatalf("bad error for an invalid status: %v", err)
+	}
+	if _, err := sa.UserDisabled(testUser1ID); err == nil {
+		t.Fatal("missed invalid status")
+	}
+}
+
+func TestSQLAuthMissingUser(t *testing.T) {
+	sa, db := newTestSQLAuth(t)
+	db.addUser(t, testUser1ID, testUser1Password, StatusActive)
+
+	if _, err := sa.Authenticate(testUser2IDS, testUser1Password); err != ErrInvalidUser {
+		t.Fatalf("missing user returned %v", err)
+	}
+	if _, err := sa.UserDisabled(testUser2ID); err != ErrNotFound {
+		t.Fatalf("missing user returned %v", err)
+	}
+}
+
+func TestSQLAuthUpgradeHash(t *testing.T) {
+	sa, db := newTestSQLAuth(t)
+	db.addUser(t, testUser1ID, testUser1Password, StatusActive)
+	sa.SetCost(minCost + 1)
+
+	if _, err := sa.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := db.user(testUser1ID)
+	if cost, err := bcrypt.Cost(hash); err != nil {
+		t.Fatal(err)
+	} else if cost != minCost+1 {
+		t.Fatalf("hash was not upgraded, cost %d", cost)
+	}
+	//the upgraded hash must still work, and is not upgraded again
+	if _, err := sa.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+	if now, _ := db.user(testUser1ID); string(now) != string(hash) {
+		t.Fatal("hash at the target cost was rewritten")
+	}
+
+	//the password was changed after the old hash was read, the upgrade must not clobber it
+	stale, err := bcrypt.GenerateFromPassword([]byte(testUser1Password), minCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.SetCost(minCost + 2)
+	if err = sa.upgradeHash(testUser1ID, stale, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+	if now, _ := db.user(testUser1ID); string(now) != string(hash) {
+		t.Fatal("upgrade replaced a hash which changed since it was read")
+	}
+}
+
+func newTestSQLAuth(t *testing.T) (*SQLAuth, *fakeDB) {
+	sel, upd, err := buildSQLQueries(DriverMySQL, DefaultSQLTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(fakeSQLDriver, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sa := &SQLAuth{
+		db:          db,
+		driver:      DriverMySQL,
+		cost:        minCost,
+		selectQuery: sel,
+		updateQuery: upd,
+	}
+	return sa, db.Driver().(*fakeDriver).get(t.Name())
+}
+
+// fakeDriver is a database/sql driver which serves the two SQLAuth queries from memory,
+// each data source name is its own database
+type fakeDriver struct {
+	sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+func (fd *fakeDriver) get(dsn string) *fakeDB {
+	fd.Lock()
+	defer fd.Unlock()
+	db, ok := fd.dbs[dsn]
+	if !ok {
+		db = &fakeDB{users: map[int64]fakeUser{}}
+		fd.dbs[dsn] = db
+	}
+	return db
+}
+
+func (fd *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	return &fakeConn{db: fd.get(dsn)}, nil
+}
+
+type fakeUser struct {
+	hash   string
+	status string
+}
+
+type fakeDB struct {
+	sync.Mutex
+	users map[int64]fakeUser
+}
+
+func (db *fakeDB) addUser(t *testing.T, cid uint64, passwd, status string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), minCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	db.users[int64(cid)] = fakeUser{hash: string(hash), status: status}
+	db.Unlock()
+}
+
+func (db *fakeDB) user(cid uint64) ([]byte, string) {
+	db.Lock()
+	defer db.Unlock()
+	u := db.users[int64(cid)]
+	return []byte(u.hash), u.status
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (fc *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: fc.db, query: query}, nil
+}
+
+func (fc *fakeConn) Close() error {
+	return nil
+}
+
+func (fc *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (fs *fakeStmt) Close() error {
+	return nil
+}
+
+func (fs *fakeStmt) NumInput() int {
+	return strings.Count(fs.query, `?`)
+}
+
+// Exec handles the update, which only applies while the hash is unchanged
+func (fs *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(fs.query, `UPDATE`) {
+		return nil, fmt.Errorf("unexpected exec %q", fs.query)
+	}
+	hash, _ := args[0].(string)
+	cid, _ := args[1].(int64)
+	old, _ := args[2].(string)
+	fs.db.Lock()
+	defer fs.db.Unlock()
+	u, ok := fs.db.users[cid]
+	if !ok || u.hash != old {
+		return driver.RowsAffected(0), nil
+	}
+	u.hash = hash
+	fs.db.users[cid] = u
+	return driver.RowsAffected(1), nil
+}
+
+// Query handles the select
+func (fs *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(fs.query, `SELECT`) {
+		return nil, fmt.Errorf("unexpected query %q", fs.query)
+	}
+	cid, _ := args[0].(int64)
+	fs.db.Lock()
+	defer fs.db.Unlock()
+	fr := &fakeRows{}
+	if u, ok := fs.db.users[cid]; ok {
+		fr.rows = append(fr.rows, []driver.Value{[]byte(u.hash), u.status})
+	}
+	return fr, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (fr *fakeRows) Columns() []string {
+	return []string{`hash`, `status`}
+}
+
+func (fr *fakeRows) Close() error {
+	return nil
+}
+
+func (fr *fakeRows) Next(dest []driver.Value) error {
+	if len(fr.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, fr.rows[0])
+	fr.rows = fr.rows[1:]
+	return nil
+}
@@ -0,0 +1,119 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTOTPVectors(t *testing.T) {
+	//test vectors from RFC 6238 appendix B, truncated to 6 digits
+	key := []byte(`12345678901234567890`)
+	vectors := []struct {
+		ts   int64
+		code string
+	}{
+		{59, `287082`},
+		{1111111109, `081804`},
+		{1111111111, `050471`},
+		{1234567890, `005924`},
+		{2000000000, `279037`},
+	}
+	for _, v := range vectors {
+		if c := totpCode(key, uint64(v.ts/totpPeriod)); c != v.code {
+			t.Fatalf("bad code at %d: %s != %s", v.ts, c, v.code)
+		}
+	}
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1111111109, 0)
+	step := uint64(now.Unix() / totpPeriod)
+	if s, err := validateTOTP(secret, `081804`, now, 0); err != nil {
+		t.Fatal(err)
+	} else if s != step {
+		t.Fatalf("bad step: %d != %d", s, step)
+	}
+	//one period of skew either direction is allowed
+	if _, err := validateTOTP(secret, `081804`, now.Add(totpPeriod*time.Second), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateTOTP(secret, `081804`, now.Add(3*totpPeriod*time.Second), 0); err != ErrInvalidTOTP {
+		t.Fatalf("failed to catch expired code: %v", err)
+	}
+	if _, err := validateTOTP(secret, `123`, now, 0); err != ErrInvalidTOTP {
+		t.Fatalf("failed to catch short code: %v", err)
+	}
+	//codes at or before the last accepted step are replays
+	if _, err := validateTOTP(secret, `081804`, now, step); err != ErrTOTPReplay {
+		t.Fatalf("failed to catch replayed code: %v", err)
+	}
+	if _, err := validateTOTP(secret, `081804`, now, step+1); err != ErrTOTPReplay {
+		t.Fatalf("failed to catch code older than the last accepted: %v", err)
+	}
+}
+
+func TestTOTPUser(t *testing.T) {
+	pth := filepath.Join(tdir, "totp")
+	if err := dropTestFile(pth); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthModule(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := a.TOTPEnabled(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("TOTP enabled by default")
+	}
+	if err = a.ValidateTOTP(testUser1ID, `000000`); err != ErrTOTPNotEnabled {
+		t.Fatalf("expected %v, got %v", ErrTOTPNotEnabled, err)
+	}
+	if err = a.SetTOTPSecret(testUser1ID, `not base32!`); err == nil {
+		t.Fatal("failed to catch invalid secret")
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetTOTPSecret(testUser1ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := uint64(time.Now().Unix() / totpPeriod)
+	code := totpCode(key, step)
+	if err = a.ValidateTOTP(testUser1ID, code); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ValidateTOTP(testUser1ID, code); err != ErrTOTPReplay {
+		t.Fatalf("replayed code returned %v", err)
+	}
+	//a later code is accepted, after which the earlier one is still refused
+	if err = a.ValidateTOTP(testUser1ID, totpCode(key, step+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ValidateTOTP(testUser1ID, code); err != ErrTOTPReplay {
+		t.Fatalf("replayed code returned %v", err)
+	}
+	//password authentication is unchanged
+	if _, err = a.Authenticate(testUser1IDS, testUser1Password); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetTOTPSecret(testUser1ID, ``); err != nil {
+		t.Fatal(err)
+	} else if enabled, err := a.TOTPEnabled(testUser1ID); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("TOTP still enabled after clear")
+	}
+}
@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package backend is a registry of named storage backends.  Backends register a
+// constructor, typically from an init function, and the server creates the backend
+// named in its configuration without knowing about it ahead of time.  Backends built
+// outside of this repository can be compiled into the server with a blank import or
+// loaded at startup from a Go plugin whose init function registers them.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrInvalidName       = errors.New("invalid backend name")
+	ErrNilConstructor    = errors.New("nil backend constructor")
+	ErrAlreadyRegistered = errors.New("backend is already registered")
+	ErrUnknownBackend    = errors.New("unknown backend")
+
+	regLock      sync.Mutex
+	constructors = map[string]Constructor{}
+)
+
+// Config is handed to a backend constructor
+type Config struct {
+	StorageDirectory string            // local storage, or staging space for remote backends
+	Options          map[string]string // backend specific options
+	Logger           *log.Logger
+}
+
+// Constructor creates a ShardHandler from the server's backend configuration
+type Constructor func(Config) (webserver.ShardHandler, error)
+
+// Register makes a backend available under the given name, names are case insensitive
+// and a name can only be registered once
+func Register(name string, c Constructor) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == `` {
+		return ErrInvalidName
+	} else if c == nil {
+		return ErrNilConstructor
+	}
+	regLock.Lock()
+	defer regLock.Unlock()
+	if _, ok := constructors[name]; ok {
+		return fmt.Errorf("%w: %s", ErrAlreadyRegistered, name)
+	}
+	constructors[name] = c
+	return nil
+}
+
+// Registered returns the sorted names of all registered backends
+func Registered() (r []string) {
+	regLock.Lock()
+	defer regLock.Unlock()
+	for k := range constructors {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return
+}
+
+// New creates the named backend
+func New(name string, cfg Config) (webserver.ShardHandler, error) {
+	regLock.Lock()
+	c, ok := constructors[strings.ToLower(strings.TrimSpace(name))]
+	regLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered backends are %s", ErrUnknownBackend, name, strings.Join(Registered(), `, `))
+	}
+	if cfg.Options == nil {
+		cfg.Options = map[string]string{}
+	}
+	return c(cfg)
+}
+
+// LoadPlugin opens a Go plugin, the plugin registers its backends from its init functions.
+// Plugins must be built with the same Go toolchain and module versions as the server.
+func LoadPlugin(p string) error {
+	if _, err := plugin.Open(p); err != nil {
+		return fmt.Errorf("failed to load backend plugin %s: %w", p, err)
+	}
+	return nil
+}
+
+// ParseOption splits a key=value backend option, keys are case insensitive
+func ParseOption(v string) (key, value string, err error) {
+	var ok bool
+	if key, value, ok = strings.Cut(v, `=`); !ok {
+		err = fmt.Errorf("backend option %q is not of the form key=value", v)
+		return
+	}
+	if key = strings.ToLower(strings.TrimSpace(key)); key == `` {
+		err = fmt.Errorf("backend option %q has an empty key", v)
+	}
+	value = strings.TrimSpace(value)
+	return
+}
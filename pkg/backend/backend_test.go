@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package backend
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+)
+
+// testHandler satisfies the ShardHandler interface, none of its methods are called
+type testHandler struct {
+	webserver.ShardHandler
+}
+
+func TestRegister(t *testing.T) {
+	var got Config
+	c := func(cfg Config) (webserver.ShardHandler, error) {
+		got = cfg
+		return &testHandler{}, nil
+	}
+	if err := Register(` `, c); err != ErrInvalidName {
+		t.Fatalf("empty name registered: %v", err)
+	} else if err = Register(`test`, nil); err != ErrNilConstructor {
+		t.Fatalf("nil constructor registered: %v", err)
+	} else if err = Register(`Test`, c); err != nil {
+		t.Fatal(err)
+	} else if err = Register(`test`, c); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Fatalf("duplicate registered: %v", err)
+	}
+	if r := Registered(); len(r) != 1 || r[0] != `test` {
+		t.Fatalf("bad registered list %v", r)
+	}
+
+	if _, err := New(`nope`, Config{}); !errors.Is(err, ErrUnknownBackend) {
+		t.Fatalf("unknown backend created: %v", err)
+	}
+	sh, err := New(`TEST`, Config{StorageDirectory: `/tmp/foo`})
+	if err != nil {
+		t.Fatal(err)
+	} else if sh == nil {
+		t.Fatal("nil handler")
+	} else if got.StorageDirectory != `/tmp/foo` || got.Options == nil {
+		t.Fatalf("bad config handed to constructor: %+v", got)
+	}
+}
+
+func TestParseOption(t *testing.T) {
+	k, v, err := ParseOption(` Bucket = archive=1 `)
+	if err != nil {
+		t.Fatal(err)
+	} else if k != `bucket` || v != `archive=1` {
+		t.Fatalf("bad option %q %q", k, v)
+	}
+	for _, bad := range []string{`bucket`, `=value`, ``} {
+		if _, _, err = ParseOption(bad); err == nil {
+			t.Fatalf("invalid option %q parsed", bad)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2023 Gravwell, Inc. All rights reserved.
+// Contact: <legal@gravwell.io>
+//
+// This software may be modified and distributed under the terms of the
+// BSD 2-clause license. See the LICENSE file for details.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: backend.proto
+
+package backendpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ShardStore_UnpackShard_FullMethodName          = "/cloudarchive.backend.ShardStore/UnpackShard"
+	ShardStore_PackShard_FullMethodName            = "/cloudarchive.backend.ShardStore/PackShard"
+	ShardStore_ListIndexes_FullMethodName          = "/cloudarchive.backend.ShardStore/ListIndexes"
+	ShardStore_ListIndexerWells_FullMethodName     = "/cloudarchive.backend.ShardStore/ListIndexerWells"
+	ShardStore_GetWellTimeframe_FullMethodName     = "/cloudarchive.backend.ShardStore/GetWellTimeframe"
+	ShardStore_GetShardsInTimeframe_FullMethodName = "/cloudarchive.backend.ShardStore/GetShardsInTimeframe"
+	ShardStore_GetTags_FullMethodName              = "/cloudarchive.backend.ShardStore/GetTags"
+	ShardStore_SyncTags_FullMethodName             = "/cloudarchive.backend.ShardStore/SyncTags"
+)
+
+// ShardStoreClient is the client API for ShardStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ShardStoreClient interface {
+	// UnpackShard stores a packed shard, the first message must name the shard
+	// and every message may carry a chunk of the packed stream
+	UnpackShard(ctx context.Context, opts ...grpc.CallOption) (ShardStore_UnpackShardClient, error)
+	// PackShard returns a packed shard as a series of chunks
+	PackShard(ctx context.Context, in *ShardRequest, opts ...grpc.CallOption) (ShardStore_PackShardClient, error)
+	ListIndexes(ctx context.Context, in *ListIndexesRequest, opts ...grpc.CallOption) (*ListIndexesResponse, error)
+	ListIndexerWells(ctx context.Context, in *IndexerRequest, opts ...grpc.CallOption) (*ListIndexerWellsResponse, error)
+	GetWellTimeframe(ctx context.Context, in *WellRequest, opts ...grpc.CallOption) (*Timeframe, error)
+	GetShardsInTimeframe(ctx context.Context, in *ShardsInTimeframeRequest, opts ...grpc.CallOption) (*ShardsResponse, error)
+	GetTags(ctx context.Context, in *IndexerRequest, opts ...grpc.CallOption) (*TagsResponse, error)
+	SyncTags(ctx context.Context, in *SyncTagsRequest, opts ...grpc.CallOption) (*TagsResponse, error)
+}
+
+type shardStoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewShardStoreClient(cc grpc.ClientConnInterface) ShardStoreClient {
+	return &shardStoreClient{cc}
+}
+
+func (c *shardStoreClient) UnpackShard(ctx context.Context, opts ...grpc.CallOption) (ShardStore_UnpackShardClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ShardStore_ServiceDesc.Streams[0], ShardStore_UnpackShard_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &shardStoreUnpackShardClient{stream}
+	return x, nil
+}
+
+type ShardStore_UnpackShardClient interface {
+	Send(*UnpackShardRequest) error
+	CloseAndRecv() (*UnpackShardResponse, error)
+	grpc.ClientStream
+}
+
+type shardStoreUnpackShardClient struct {
+	grpc.ClientStream
+}
+
+func (x *shardStoreUnpackShardClient) Send(m *UnpackShardRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *shardStoreUnpackShardClient) CloseAndRecv() (*UnpackShardResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UnpackShardResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *shardStoreClient) PackShard(ctx context.Context, in *ShardRequest, opts ...grpc.CallOption) (ShardStore_PackShardClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ShardStore_ServiceDesc.Streams[1], ShardStore_PackShard_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &shardStorePackShardClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ShardStore_PackShardClient interface {
+	Recv() (*ShardChunk, error)
+	grpc.ClientStream
+}
+
+type shardStorePackShardClient struct {
+	grpc.ClientStream
+}
+
+func (x *shardStorePackShardClient) Recv() (*ShardChunk, error) {
+	m := new(ShardChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *shardStoreClient) ListIndexes(ctx context.Context, in *ListIndexesRequest, opts ...grpc.CallOption) (*ListIndexesResponse, error) {
+	out := new(ListIndexesResponse)
+	err := c.cc.Invoke(ctx, ShardStore_ListIndexes_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardStoreClient) ListIndexerWells(ctx context.Context, in *IndexerRequest, opts ...grpc.CallOption) (*ListIndexerWellsResponse, error) {
+	out := new(ListIndexerWellsResponse)
+	err := c.cc.Invoke(ctx, ShardStore_ListIndexerWells_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardStoreClient) GetWellTimeframe(ctx context.Context, in *WellRequest, opts ...grpc.CallOption) (*Timeframe, error) {
+	out := new(Timeframe)
+	err := c.cc.Invoke(ctx, ShardStore_GetWellTimeframe_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardStoreClient) GetShardsInTimeframe(ctx context.Context, in *ShardsInTimeframeRequest, opts ...grpc.CallOption) (*ShardsResponse, error) {
+	out := new(ShardsResponse)
+	err := c.cc.Invoke(ctx, ShardStore_GetShardsInTimeframe_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardStoreClient) GetTags(ctx context.Context, in *IndexerRequest, opts ...grpc.CallOption) (*TagsResponse, error) {
+	out := new(TagsResponse)
+	err := c.cc.Invoke(ctx, ShardStore_GetTags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardStoreClient) SyncTags(ctx context.Context, in *SyncTagsRequest, opts ...grpc.CallOption) (*TagsResponse, error) {
+	out := new(TagsResponse)
+	err := c.cc.Invoke(ctx, ShardStore_SyncTags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ShardStoreServer is the server API for ShardStore service.
+// All implementations must embed UnimplementedShardStoreServer
+// for forward compatibility
+type ShardStoreServer interface {
+	// UnpackShard stores a packed shard, the first message must name the shard
+	// and every message may carry a chunk of the packed stream
+	UnpackShard(ShardStore_UnpackShardServer) error
+	// PackShard returns a packed shard as a series of chunks
+	PackShard(*ShardRequest, ShardStore_PackShardServer) error
+	ListIndexes(context.Context, *ListIndexesRequest) (*ListIndexesResponse, error)
+	ListIndexerWells(context.Context, *IndexerRequest) (*ListIndexerWellsResponse, error)
+	GetWellTimeframe(context.Context, *WellRequest) (*Timeframe, error)
+	GetShardsInTimeframe(context.Context, *ShardsInTimeframeRequest) (*ShardsResponse, error)
+	GetTags(context.Context, *IndexerRequest) (*TagsResponse, error)
+	SyncTags(context.Context, *SyncTagsRequest) (*TagsResponse, error)
+	mustEmbedUnimplementedShardStoreServer()
+}
+
+// UnimplementedShardStoreServer must be embedded to have forward compatible implementations.
+type UnimplementedShardStoreServer struct {
+}
+
+func (UnimplementedShardStoreServer) UnpackShard(ShardStore_UnpackShardServer) error {
+	return status.Errorf(codes.Unimplemented, "method UnpackShard not implemented")
+}
+func (UnimplementedShardStoreServer) PackShard(*ShardRequest, ShardStore_PackShardServer) error {
+	return status.Errorf(codes.Unimplemented, "method PackShard not implemented")
+}
+func (UnimplementedShardStoreServer) ListIndexes(context.Context, *ListIndexesRequest) (*ListIndexesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIndexes not implemented")
+}
+func (UnimplementedShardStoreServer) ListIndexerWells(context.Context, *IndexerRequest) (*ListIndexerWellsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIndexerWells not implemented")
+}
+func (UnimplementedShardStoreServer) GetWellTimeframe(context.Context, *WellRequest) (*Timeframe, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWellTimeframe not implemented")
+}
+func (UnimplementedShardStoreServer) GetShardsInTimeframe(context.Context, *ShardsInTimeframeRequest) (*ShardsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetShardsInTimeframe not implemented")
+}
+func (UnimplementedShardStoreServer) GetTags(context.Context, *IndexerRequest) (*TagsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTags not implemented")
+}
+func (UnimplementedShardStoreServer) SyncTags(context.Context, *SyncTagsRequest) (*TagsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SyncTags not implemented")
+}
+func (UnimplementedShardStoreServer) mustEmbedUnimplementedShardStoreServer() {}
+
+// UnsafeShardStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ShardStoreServer will
+// result in compilation errors.
+type UnsafeShardStoreServer interface {
+	mustEmbedUnimplementedShardStoreServer()
+}
+
+func RegisterShardStoreServer(s grpc.ServiceRegistrar, srv ShardStoreServer) {
+	s.RegisterService(&ShardStore_ServiceDesc, srv)
+}
+
+func _ShardStore_UnpackShard_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ShardStoreServer).UnpackShard(&shardStoreUnpackShardServer{stream})
+}
+
+type ShardStore_UnpackShardServer interface {
+	SendAndClose(*UnpackShardResponse) error
+	Recv() (*UnpackShardRequest, error)
+	grpc.ServerStream
+}
+
+type shardStoreUnpackShardServer struct {
+	grpc.ServerStream
+}
+
+func (x *shardStoreUnpackShardServer) SendAndClose(m *UnpackShardResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *shardStoreUnpackShardServer) Recv() (*UnpackShardRequest, error) {
+	m := new(UnpackShardRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ShardStore_PackShard_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ShardRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ShardStoreServer).PackShard(m, &shardStorePackShardServer{stream})
+}
+
+type ShardStore_PackShardServer interface {
+	Send(*ShardChunk) error
+	grpc.ServerStream
+}
+
+type shardStorePackShardServer struct {
+	grpc.ServerStream
+}
+
+func (x *shardStorePackShardServer) Send(m *ShardChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ShardStore_ListIndexes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListIndexesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardStoreServer).ListIndexes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardStore_ListIndexes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardStoreServer).ListIndexes(ctx, req.(*ListIndexesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardStore_ListIndexerWells_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IndexerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardStoreServer).ListIndexerWells(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardStore_ListIndexerWells_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardStoreServer).ListIndexerWells(ctx, req.(*IndexerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardStore_GetWellTimeframe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WellRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardStoreServer).GetWellTimeframe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardStore_GetWellTimeframe_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardStoreServer).GetWellTimeframe(ctx, req.(*WellRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardStore_GetShardsInTimeframe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShardsInTimeframeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardStoreServer).GetShardsInTimeframe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardStore_GetShardsInTimeframe_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardStoreServer).GetShardsInTimeframe(ctx, req.(*ShardsInTimeframeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardStore_GetTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IndexerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardStoreServer).GetTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardStore_GetTags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardStoreServer).GetTags(ctx, req.(*IndexerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardStore_SyncTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncTagsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardStoreServer).SyncTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardStore_SyncTags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardStoreServer).SyncTags(ctx, req.(*SyncTagsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ShardStore_ServiceDesc is the grpc.ServiceDesc for ShardStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ShardStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cloudarchive.backend.ShardStore",
+	HandlerType: (*ShardStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListIndexes",
+			Handler:    _ShardStore_ListIndexes_Handler,
+		},
+		{
+			MethodName: "ListIndexerWells",
+			Handler:    _ShardStore_ListIndexerWells_Handler,
+		},
+		{
+			MethodName: "GetWellTimeframe",
+			Handler:    _ShardStore_GetWellTimeframe_Handler,
+		},
+		{
+			MethodName: "GetShardsInTimeframe",
+			Handler:    _ShardStore_GetShardsInTimeframe_Handler,
+		},
+		{
+			MethodName: "GetTags",
+			Handler:    _ShardStore_GetTags_Handler,
+		},
+		{
+			MethodName: "SyncTags",
+			Handler:    _ShardStore_SyncTags_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "UnpackShard",
+			Handler:       _ShardStore_UnpackShard_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PackShard",
+			Handler:       _ShardStore_PackShard_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "backend.proto",
+}
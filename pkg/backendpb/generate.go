@@ -0,0 +1,15 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package backendpb holds the protobuf messages and gRPC service definition spoken
+// between the server and storage backends running in their own process.  The generated
+// files are checked in, regenerate them after editing backend.proto with protoc-gen-go
+// v1.31.0 and protoc-gen-go-grpc v1.3.0.
+package backendpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative backend.proto
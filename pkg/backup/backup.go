@@ -0,0 +1,148 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package backup takes timestamped snapshots of the server state which is not part of
+// any shard, the password database and every tags.dat, so that a corrupted file can be
+// restored rather than reconstructed by hand.
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/flock"
+)
+
+const (
+	stampFormat = `20060102T150405Z` //UTC, sorts by time
+	tempPrefix  = `.partial-`        //snapshots being written, never mistaken for a complete one
+	tagsDir     = `tags`
+
+	lockTimeout = 10 * time.Second
+)
+
+var (
+	ErrMissingDir = errors.New("backup directory not specified")
+)
+
+// TagSource is implemented by storage backends which keep tags.dat files, they are
+// copied into dir laid out as <customer>/<indexer>/tags.dat
+type TagSource interface {
+	BackupTags(ctx context.Context, dir string) error
+}
+
+type Config struct {
+	Dir       string        // snapshots are written to timestamped directories here
+	Retention time.Duration // snapshots older than this are removed, the newest is always kept
+	Files     []string      // files copied into each snapshot, such as the password file
+	Tags      TagSource     // optional
+}
+
+// Backup writes and prunes snapshots
+type Backup struct {
+	cfg Config
+}
+
+func New(cfg Config) (*Backup, error) {
+	if cfg.Dir == `` {
+		return nil, ErrMissingDir
+	} else if err := os.MkdirAll(cfg.Dir, 0770); err != nil {
+		return nil, err
+	}
+	return &Backup{cfg: cfg}, nil
+}
+
+// Snapshot writes a new snapshot and returns its directory, a snapshot which fails
+// part way through is removed rather than left looking complete
+func (b *Backup) Snapshot(ctx context.Context, now time.Time) (dir string, err error) {
+	stamp := now.UTC().Format(stampFormat)
+	tmp := filepath.Join(b.cfg.Dir, tempPrefix+stamp)
+	if err = os.MkdirAll(tmp, 0770); err != nil {
+		return
+	}
+	for _, f := range b.cfg.Files {
+		if err = copyFile(f, filepath.Join(tmp, filepath.Base(f))); err != nil {
+			os.RemoveAll(tmp)
+			return
+		}
+	}
+	if b.cfg.Tags != nil {
+		if err = b.cfg.Tags.BackupTags(ctx, filepath.Join(tmp, tagsDir)); err != nil {
+			os.RemoveAll(tmp)
+			return
+		}
+	}
+	dir = filepath.Join(b.cfg.Dir, stamp)
+	if err = os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		dir = ``
+	}
+	return
+}
+
+// Prune removes snapshots older than the retention period along with any left
+// incomplete by a crash, the newest snapshot is kept however old it is
+func (b *Backup) Prune(now time.Time) (removed []string, err error) {
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(b.cfg.Dir); err != nil {
+		return
+	}
+	var snaps []string
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		} else if strings.HasPrefix(ent.Name(), tempPrefix) {
+			if err = os.RemoveAll(filepath.Join(b.cfg.Dir, ent.Name())); err != nil {
+				return
+			}
+		} else if _, perr := time.Parse(stampFormat, ent.Name()); perr == nil {
+			snaps = append(snaps, ent.Name())
+		}
+	}
+	sort.Strings(snaps)
+	cutoff := now.Add(-b.cfg.Retention)
+	for i, s := range snaps {
+		ts, _ := time.Parse(stampFormat, s)
+		if i == len(snaps)-1 || !ts.Before(cutoff) {
+			break
+		}
+		if err = os.RemoveAll(filepath.Join(b.cfg.Dir, s)); err != nil {
+			return
+		}
+		removed = append(removed, s)
+	}
+	return
+}
+
+// copyFile copies a file while holding a shared lock, so writers which lock it are not caught mid update
+func copyFile(src, dst string) (err error) {
+	var fin, fout *os.File
+	if fin, err = os.Open(src); err != nil {
+		return
+	}
+	defer fin.Close()
+	if err = flock.FlockTimeout(fin, false, lockTimeout); err != nil {
+		return
+	}
+	defer flock.Funlock(fin)
+	if fout, err = os.Create(dst); err != nil {
+		return
+	}
+	if _, err = io.Copy(fout, fin); err != nil {
+		fout.Close()
+		return
+	}
+	err = fout.Close()
+	return
+}
@@ -0,0 +1,105 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tagWriter struct {
+	err error
+}
+
+func (tw tagWriter) BackupTags(ctx context.Context, dir string) error {
+	if tw.err != nil {
+		return tw.err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, `1`), 0770); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, `1`, `tags.dat`), []byte("default=0\n"), 0660)
+}
+
+func TestSnapshot(t *testing.T) {
+	pw := filepath.Join(t.TempDir(), `passwd`)
+	if err := ioutil.WriteFile(pw, []byte(`1337:hash`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(Config{
+		Dir:       t.TempDir(),
+		Retention: 48 * time.Hour,
+		Files:     []string{pw},
+		Tags:      tagWriter{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 6, 1, 3, 0, 0, 0, time.UTC)
+	dir, err := b.Snapshot(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	} else if filepath.Base(dir) != `20230601T030000Z` {
+		t.Fatalf("bad snapshot name %s", dir)
+	}
+	if bts, err := ioutil.ReadFile(filepath.Join(dir, `passwd`)); err != nil || string(bts) != `1337:hash` {
+		t.Fatalf("bad password file copy %q: %v", bts, err)
+	} else if _, err = os.Stat(filepath.Join(dir, tagsDir, `1`, `tags.dat`)); err != nil {
+		t.Fatalf("tags missing from snapshot: %v", err)
+	}
+
+	//a failed snapshot leaves nothing behind
+	b.cfg.Tags = tagWriter{err: errors.New(`failed`)}
+	if _, err = b.Snapshot(context.Background(), now.Add(time.Hour)); err == nil {
+		t.Fatal("failed snapshot succeeded")
+	}
+	if ents, err := os.ReadDir(b.cfg.Dir); err != nil || len(ents) != 1 {
+		t.Fatalf("failed snapshot left files behind: %v %v", ents, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	b, err := New(Config{
+		Dir:       t.TempDir(),
+		Retention: 48 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 6, 10, 3, 0, 0, 0, time.UTC)
+	for _, d := range []int{5, 4, 1, 0} {
+		if _, err = b.Snapshot(context.Background(), now.AddDate(0, 0, -d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Mkdir(filepath.Join(b.cfg.Dir, tempPrefix+`20230609T030000Z`), 0770); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := b.Prune(now)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 2 || removed[0] != `20230605T030000Z` || removed[1] != `20230606T030000Z` {
+		t.Fatalf("bad prune: %v", removed)
+	}
+	if ents, err := os.ReadDir(b.cfg.Dir); err != nil || len(ents) != 2 {
+		t.Fatalf("bad snapshots left after prune: %v %v", ents, err)
+	}
+
+	//the newest snapshot is never removed
+	if removed, err = b.Prune(now.AddDate(1, 0, 0)); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 1 {
+		t.Fatalf("bad prune: %v", removed)
+	}
+}
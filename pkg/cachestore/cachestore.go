@@ -0,0 +1,214 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package cachestore is a storage backend wrapper which keeps recently pulled shards on
+// local disk, so pulling the same shard again does not go back to a remote backend such
+// as FTP or S3.  The least recently used shards are evicted to keep the cache under a
+// size cap, and pushes or deletes of a shard drop it from the cache.
+package cachestore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gravwell/cloudarchive/pkg/backup"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrMissingBackend = errors.New("Missing storage backend to cache")
+	ErrMissingDir     = errors.New("Missing cache directory")
+	ErrBadMaxSize     = errors.New("Cache size must be positive")
+	ErrNoUsage        = errors.New("Storage backend does not report customer usage")
+	ErrNoDelete       = errors.New("Storage backend does not support deleting shards")
+	ErrNoTagBackup    = errors.New("Storage backend does not support tag backups")
+)
+
+type CacheStoreConfig struct {
+	Backend webserver.ShardHandler
+	Dir     string // where cached shards are kept, anything else in it is left alone
+	MaxSize int64  // total bytes of cached shards, a shard larger than this is never cached
+	Lgr     *log.Logger
+}
+
+type cachestore struct {
+	cfg   CacheStoreConfig
+	cache *lru
+	seq   uint64 //names temporary fill files
+}
+
+// NewCacheStoreHandler wraps a backend with a cache, shards already in the cache directory
+// from an earlier run are served until they are evicted or the shard is pushed again
+func NewCacheStoreHandler(cfg CacheStoreConfig) (*cachestore, error) {
+	if cfg.Backend == nil {
+		return nil, ErrMissingBackend
+	} else if cfg.Dir == `` {
+		return nil, ErrMissingDir
+	} else if cfg.MaxSize <= 0 {
+		return nil, ErrBadMaxSize
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	l, err := openLRU(cfg.Dir, cfg.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &cachestore{
+		cfg:   cfg,
+		cache: l,
+	}, nil
+}
+
+// Close closes the backend if it can be closed, the cache is kept for the next run
+func (cs *cachestore) Close() error {
+	if c, ok := cs.cfg.Backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (cs *cachestore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
+	return cs.cfg.Backend.ListIndexes(ctx, cid)
+}
+
+func (cs *cachestore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
+	return cs.cfg.Backend.ListIndexerWells(ctx, cid, guid)
+}
+
+func (cs *cachestore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (util.Timeframe, error) {
+	return cs.cfg.Backend.GetWellTimeframe(ctx, cid, guid, well)
+}
+
+func (cs *cachestore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	return cs.cfg.Backend.GetShardsInTimeframe(ctx, cid, guid, well, tf)
+}
+
+func (cs *cachestore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) ([]tags.TagPair, error) {
+	return cs.cfg.Backend.GetTags(ctx, cid, guid)
+}
+
+func (cs *cachestore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) ([]tags.TagPair, error) {
+	return cs.cfg.Backend.SyncTags(ctx, cid, guid, idxTags)
+}
+
+// UnpackShard stores the shard in the backend, dropping any cached copy of it
+func (cs *cachestore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	key := cacheKey(cid, guid, well, shard)
+	cs.cache.invalidate(key)
+	err := cs.cfg.Backend.UnpackShard(ctx, cid, guid, well, shard, rdr)
+	//a pull during the push may have cached the old copy
+	cs.cache.invalidate(key)
+	return err
+}
+
+// PackShard serves the shard from the cache, pulling it from the backend and caching it on a miss
+func (cs *cachestore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	key := cacheKey(cid, guid, well, shard)
+	if fin, ok := cs.cache.get(key); ok {
+		defer fin.Close()
+		_, err = io.Copy(wtr, fin)
+		return
+	}
+	f := cs.cache.startFill(key)
+	tmp := cs.cache.path(key) + `.` + strconv.FormatUint(atomic.AddUint64(&cs.seq, 1), 10) + tmpExt
+	fout, lerr := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if lerr != nil {
+		//the pull still goes ahead, it just is not cached
+		cs.cfg.Lgr.Warn("Failed to create cache file", log.KV("path", tmp), log.KVErr(lerr))
+		cs.cache.finishFill(key, f, tmp, 0, false)
+		return cs.cfg.Backend.PackShard(ctx, cid, guid, well, shard, wtr)
+	}
+	tw := &teeWriter{w: wtr, f: fout, max: cs.cfg.MaxSize}
+	err = cs.cfg.Backend.PackShard(ctx, cid, guid, well, shard, tw)
+	ok := err == nil && tw.ferr == nil
+	if lerr = fout.Close(); lerr != nil {
+		ok = false
+	}
+	if tw.ferr != nil && !errors.Is(tw.ferr, errTooLarge) {
+		cs.cfg.Lgr.Warn("Failed to write cache file", log.KV("path", tmp), log.KVErr(tw.ferr))
+	}
+	if lerr = cs.cache.finishFill(key, f, tmp, tw.n, ok); lerr != nil {
+		cs.cfg.Lgr.Warn("Failed to add shard to cache", log.KV("cid", cid), log.KV("indexeruuid", guid),
+			log.KV("well", well), log.KV("shard", shard), log.KVErr(lerr))
+	}
+	return
+}
+
+// DeleteShard deletes the shard from the backend and drops any cached copy of it
+func (cs *cachestore) DeleteShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) error {
+	sd, ok := cs.cfg.Backend.(webserver.ShardDeleter)
+	if !ok {
+		return ErrNoDelete
+	}
+	key := cacheKey(cid, guid, well, shard)
+	cs.cache.invalidate(key)
+	err := sd.DeleteShard(ctx, cid, guid, well, shard)
+	cs.cache.invalidate(key)
+	return err
+}
+
+func (cs *cachestore) CustomerUsage(ctx context.Context, cid uint64) (uint64, error) {
+	if ur, ok := cs.cfg.Backend.(webserver.UsageReporter); ok {
+		return ur.CustomerUsage(ctx, cid)
+	}
+	return 0, ErrNoUsage
+}
+
+func (cs *cachestore) SetLegalHolds(lh util.LegalHolds) {
+	if lhe, ok := cs.cfg.Backend.(webserver.LegalHoldEnforcer); ok {
+		lhe.SetLegalHolds(lh)
+	}
+}
+
+// Preflight checks the backend, a backend which cannot be checked is assumed to be available
+func (cs *cachestore) Preflight(ctx context.Context) error {
+	if pf, ok := cs.cfg.Backend.(webserver.Preflighter); ok {
+		return pf.Preflight(ctx)
+	}
+	return nil
+}
+
+func (cs *cachestore) BackupTags(ctx context.Context, dir string) error {
+	if ts, ok := cs.cfg.Backend.(backup.TagSource); ok {
+		return ts.BackupTags(ctx, dir)
+	}
+	return ErrNoTagBackup
+}
+
+var errTooLarge = errors.New("shard is larger than the cache")
+
+// teeWriter copies a pull to the cache file as it is written to the client, a failure
+// writing the cache file stops caching but never fails the pull
+type teeWriter struct {
+	w    io.Writer
+	f    *os.File
+	max  int64
+	n    int64
+	ferr error
+}
+
+func (tw *teeWriter) Write(b []byte) (n int, err error) {
+	if n, err = tw.w.Write(b); n > 0 && tw.ferr == nil {
+		if tw.n+int64(n) > tw.max {
+			tw.ferr = errTooLarge
+		} else if _, tw.ferr = tw.f.Write(b[:n]); tw.ferr == nil {
+			tw.n += int64(n)
+		}
+	}
+	return
+}
@@ -0,0 +1,141 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cachestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// counting is a backend which counts the pulls that reach it
+type counting struct {
+	webserver.ShardHandler
+	pulls int
+}
+
+func (c *counting) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) error {
+	c.pulls++
+	return c.ShardHandler.PackShard(ctx, cid, guid, well, shard, wtr)
+}
+
+func newTestStore(t *testing.T, dir string, max int64) (cs *cachestore, be *counting) {
+	fs, _ := storetest.NewFileStore(t)
+	be = &counting{ShardHandler: fs}
+	cs, err := NewCacheStoreHandler(CacheStoreConfig{
+		Backend: be,
+		Dir:     dir,
+		MaxSize: max,
+		Lgr:     log.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func push(t *testing.T, h webserver.ShardHandler, guid uuid.UUID, shard string, data []byte) {
+	t.Helper()
+	files := map[string][]byte{`.index`: data, `.verify`: data, `.store`: data}
+	if err := h.UnpackShard(context.Background(), 1, guid, `default`, shard, storetest.NewShard(t, shard, files)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pull(t *testing.T, h webserver.ShardHandler, guid uuid.UUID, shard string, want []byte) {
+	t.Helper()
+	storetest.CheckPull(t, h, guid, shard, map[string][]byte{`.store`: want})
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	cs, be := newTestStore(t, dir, 1<<20)
+	guid := uuid.New()
+	v1 := bytes.Repeat([]byte(`first `), 1000)
+	push(t, cs, guid, `76a00`, v1)
+
+	//the second pull is served from the cache
+	pull(t, cs, guid, `76a00`, v1)
+	pull(t, cs, guid, `76a00`, v1)
+	if be.pulls != 1 {
+		t.Fatalf("backend pulled %d times", be.pulls)
+	}
+
+	//pushing the shard again drops the cached copy
+	push(t, cs, guid, `76a00`, bytes.Repeat([]byte(`second `), 1000))
+	if n := len(cs.cache.entries); n != 0 {
+		t.Fatalf("%d cached shards after a push", n)
+	}
+	pull(t, cs, guid, `76a00`, v1) //the file backend keeps the first copy under the shard's name
+	if be.pulls != 2 {
+		t.Fatalf("backend pulled %d times", be.pulls)
+	}
+
+	//the cache survives a restart
+	cs2, be2 := newTestStore(t, dir, 1<<20)
+	if n := len(cs2.cache.entries); n != 1 {
+		t.Fatalf("reloaded %d cached shards", n)
+	}
+	bb := bytes.NewBuffer(nil)
+	if err := cs2.PackShard(context.Background(), 1, guid, `default`, `76a00`, bb); err != nil {
+		t.Fatal(err)
+	} else if be2.pulls != 0 {
+		t.Fatal("reloaded cache missed")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := t.TempDir()
+	cs, be := newTestStore(t, dir, 24*1024)
+	guid := uuid.New()
+	data := make([]byte, 16*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	shards := []string{`76a00`, `76a01`, `76a02`}
+	for _, s := range shards {
+		push(t, cs, guid, s, data)
+	}
+	//each packed shard is over 16KB, so only one fits
+	for _, s := range shards {
+		pull(t, cs, guid, s, data)
+	}
+	if n := len(cs.cache.entries); n != 1 || cs.cache.size > cs.cfg.MaxSize {
+		t.Fatalf("cache holds %d shards, %d bytes", n, cs.cache.size)
+	}
+	pull(t, cs, guid, shards[2], data)
+	pull(t, cs, guid, shards[0], data)
+	if be.pulls != 4 {
+		t.Fatalf("backend pulled %d times", be.pulls)
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(des) != 1 {
+		t.Fatalf("%d files left in the cache directory", len(des))
+	}
+
+	//shards larger than the whole cache are never cached
+	small, be := newTestStore(t, t.TempDir(), 1024)
+	push(t, small, guid, `76a00`, data)
+	pull(t, small, guid, `76a00`, data)
+	pull(t, small, guid, `76a00`, data)
+	if be.pulls != 2 || len(small.cache.entries) != 0 {
+		t.Fatalf("oversized shard was cached")
+	}
+}
@@ -0,0 +1,206 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cachestore
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	cacheExt = `.pack`
+	tmpExt   = `.tmp`
+)
+
+// entry is one packed shard held in the cache
+type entry struct {
+	key  string
+	size int64
+}
+
+// lru tracks the cached shards in order of use and evicts the least recently used
+// to keep the total size under the cap
+type lru struct {
+	dir string
+	max int64
+
+	mtx     sync.Mutex
+	size    int64
+	order   *list.List                // front is the most recently used
+	entries map[string]*list.Element  // by cache key
+	fills   map[string]map[*fill]bool // pulls currently filling the cache, by cache key
+}
+
+// fill is a pull which is writing a shard into the cache, a push or delete of the
+// shard while it runs makes the copy stale so it is never added
+type fill struct {
+	stale bool
+}
+
+// cacheKey names the cache file for a shard, shard and well names are hashed so they
+// never have to be safe as paths
+func cacheKey(cid uint64, guid uuid.UUID, well, shard string) string {
+	sum := sha256.Sum256([]byte(strconv.FormatUint(cid, 10) + `/` + guid.String() + `/` + well + `/` + shard))
+	return hex.EncodeToString(sum[:])
+}
+
+// openLRU loads the shards already in the cache directory, oldest first, and evicts
+// any over the cap.  Partial files left by an interrupted fill are removed.
+func openLRU(dir string, max int64) (l *lru, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	l = &lru{
+		dir:     dir,
+		max:     max,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		fills:   map[string]map[*fill]bool{},
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		key  string
+		size int64
+		used int64
+	}
+	var fs []found
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		} else if !strings.HasSuffix(name, cacheExt) || !de.Type().IsRegular() {
+			continue
+		}
+		fi, lerr := de.Info()
+		if lerr != nil {
+			continue
+		}
+		fs = append(fs, found{key: strings.TrimSuffix(name, cacheExt), size: fi.Size(), used: fi.ModTime().UnixNano()})
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].used < fs[j].used })
+	for _, f := range fs {
+		l.entries[f.key] = l.order.PushFront(&entry{key: f.key, size: f.size})
+		l.size += f.size
+	}
+	l.mtx.Lock()
+	l.evict()
+	l.mtx.Unlock()
+	return
+}
+
+func (l *lru) path(key string) string {
+	return filepath.Join(l.dir, key+cacheExt)
+}
+
+// get opens a cached shard and marks it as recently used
+func (l *lru) get(key string) (*os.File, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	fin, err := os.Open(l.path(key))
+	if err != nil {
+		//removed from under us, forget it
+		l.remove(el)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	//the modification time orders the cache when it is reloaded
+	now := time.Now()
+	os.Chtimes(l.path(key), now, now)
+	return fin, true
+}
+
+// startFill registers a pull which is about to write a shard into the cache
+func (l *lru) startFill(key string) *fill {
+	f := &fill{}
+	l.mtx.Lock()
+	if l.fills[key] == nil {
+		l.fills[key] = map[*fill]bool{}
+	}
+	l.fills[key][f] = true
+	l.mtx.Unlock()
+	return f
+}
+
+// finishFill adds a completed fill to the cache unless the shard changed while it ran,
+// the temporary file is always consumed
+func (l *lru) finishFill(key string, f *fill, tmp string, size int64, ok bool) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	delete(l.fills[key], f)
+	if len(l.fills[key]) == 0 {
+		delete(l.fills, key)
+	}
+	if !ok || f.stale || size > l.max {
+		return os.Remove(tmp)
+	}
+	if err := os.Rename(tmp, l.path(key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if el, ok := l.entries[key]; ok {
+		//another pull filled it first, the file was replaced
+		l.size -= el.Value.(*entry).size
+		l.order.Remove(el)
+	}
+	l.entries[key] = l.order.PushFront(&entry{key: key, size: size})
+	l.size += size
+	l.evict()
+	return nil
+}
+
+// invalidate drops a shard from the cache and marks any fill of it as stale
+func (l *lru) invalidate(key string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for f := range l.fills[key] {
+		f.stale = true
+	}
+	if el, ok := l.entries[key]; ok {
+		l.remove(el)
+	}
+}
+
+// evict removes the least recently used shards until the cache fits, the caller holds the lock
+func (l *lru) evict() {
+	for l.size > l.max {
+		el := l.order.Back()
+		if el == nil {
+			return
+		}
+		l.remove(el)
+	}
+}
+
+// remove deletes a shard from the cache, the caller holds the lock.  Pulls already
+// reading the file keep their open handle.
+func (l *lru) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	l.order.Remove(el)
+	delete(l.entries, e.key)
+	l.size -= e.size
+	os.Remove(l.path(e.key))
+}
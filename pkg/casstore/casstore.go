@@ -0,0 +1,721 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package casstore is a storage backend which keeps each shard file once, named by the SHA-256
+// digest of its contents, and records every shard as a manifest listing the digests of its files.
+// Shards which are pushed again, or which share files with other shards, do not store those files
+// a second time.  Objects no manifest refers to are removed by a periodic sweep.
+package casstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/safepath"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/dolmen-go/contextio"
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	objectDir   = `objects` //not a valid customer number, so never treated as a customer
+	tempDir     = `tmp`
+	manifestExt = `.json`
+
+	DefaultSweepInterval = time.Hour
+)
+
+var (
+	ErrMissingBaseDir = errors.New("Empty base directory for content addressed store")
+	ErrInvalidWell    = errors.New("Invalid well name")
+	ErrBadDigest      = errors.New("Invalid object digest")
+)
+
+// packOrder is the order shard files are sent in on a pull, artifacts follow sorted by name
+var packOrder = []shardpacker.Ftype{
+	shardpacker.Verify,
+	shardpacker.Index,
+	shardpacker.Store,
+	shardpacker.AccelFile,
+	shardpacker.IndexAccelKeyFile,
+	shardpacker.IndexAccelDataFile,
+}
+
+type CASStoreConfig struct {
+	Dir string // objects, manifests, and each indexer's tags.dat are kept here
+	// How often objects no longer referenced by a manifest are removed, zero selects
+	// DefaultSweepInterval and a negative interval disables sweeping
+	SweepInterval time.Duration
+	Lgr           *log.Logger
+}
+
+type casstore struct {
+	util.UploadTracker
+	cfg CASStoreConfig
+
+	mtx     sync.Mutex
+	holds   util.LegalHolds
+	pinned  map[string]int      // objects being written or read, by digest
+	protect map[string]struct{} // objects pinned or unpinned during a sweep, nil outside of one
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// NewCASStoreHandler opens the store in the configured directory, creating it if needed,
+// and starts sweeping unreferenced objects
+func NewCASStoreHandler(cfg CASStoreConfig) (*casstore, error) {
+	if cfg.Dir == `` {
+		return nil, ErrMissingBaseDir
+	}
+	if cfg.SweepInterval == 0 {
+		cfg.SweepInterval = DefaultSweepInterval
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	//anything left in the temporary directory was abandoned by a previous run
+	if err := os.RemoveAll(filepath.Join(cfg.Dir, tempDir)); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{objectDir, tempDir} {
+		if err := os.MkdirAll(filepath.Join(cfg.Dir, d), 0770); err != nil {
+			return nil, err
+		}
+	}
+	c := &casstore{
+		UploadTracker: util.NewUploadTracker(),
+		cfg:           cfg,
+		pinned:        map[string]int{},
+		done:          make(chan struct{}),
+	}
+	if cfg.SweepInterval > 0 {
+		c.wg.Add(1)
+		go c.sweepRoutine()
+	}
+	return c, nil
+}
+
+// Close stops sweeping
+func (c *casstore) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+	})
+	return nil
+}
+
+func (c *casstore) indexerDir(cid uint64, guid uuid.UUID) string {
+	return filepath.Join(c.cfg.Dir, strconv.FormatUint(cid, 10), guid.String())
+}
+
+func (c *casstore) manifestPath(cid uint64, guid uuid.UUID, well, shard string) string {
+	return filepath.Join(c.indexerDir(cid, guid), well, shard+manifestExt)
+}
+
+func (c *casstore) objectPath(digest string) string {
+	return filepath.Join(c.cfg.Dir, objectDir, digest[:2], digest)
+}
+
+// Preflight ensures a file can still be written to the store
+func (c *casstore) Preflight(ctx context.Context) error {
+	fout, err := ioutil.TempFile(filepath.Join(c.cfg.Dir, tempDir), `preflight`)
+	if err != nil {
+		return err
+	}
+	fout.Close()
+	return os.Remove(fout.Name())
+}
+
+func (c *casstore) ListIndexes(ctx context.Context, cid uint64) (idx []string, err error) {
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(filepath.Join(c.cfg.Dir, strconv.FormatUint(cid, 10))); err != nil {
+		return
+	}
+	for _, ent := range ents {
+		if _, perr := uuid.Parse(ent.Name()); perr == nil && ent.IsDir() {
+			idx = append(idx, ent.Name())
+		}
+	}
+	return
+}
+
+func (c *casstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) (wells []string, err error) {
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(c.indexerDir(cid, guid)); err != nil {
+		return
+	}
+	for _, ent := range ents {
+		if ent.IsDir() {
+			wells = append(wells, ent.Name())
+		}
+	}
+	return
+}
+
+// listShards returns the name of every shard with a manifest in the well
+func (c *casstore) listShards(cid uint64, guid uuid.UUID, well string) (shards []string, err error) {
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(filepath.Join(c.indexerDir(cid, guid), well)); err != nil {
+		return
+	}
+	for _, ent := range ents {
+		if name := ent.Name(); ent.Type().IsRegular() && strings.HasSuffix(name, manifestExt) {
+			shards = append(shards, strings.TrimSuffix(name, manifestExt))
+		}
+	}
+	return
+}
+
+func (c *casstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	var shards []string
+	if shards, err = c.listShards(cid, guid, well); err != nil {
+		return
+	}
+	for _, name := range shards {
+		s, e, err := util.ShardNameToDateRange(name)
+		if err != nil {
+			continue
+		}
+		if t.Start.IsZero() || s.Before(t.Start) {
+			t.Start = s
+		}
+		if t.End.IsZero() || e.After(t.End) {
+			t.End = e
+		}
+	}
+	return
+}
+
+func (c *casstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+	var all []string
+	if all, err = c.listShards(cid, guid, well); err != nil {
+		return
+	}
+	for _, name := range all {
+		if ok, err := tf.ShardOverlaps(name); err == nil && ok {
+			shards = append(shards, name)
+		}
+	}
+	return
+}
+
+// GetShardInfo returns the manifest recorded when the shard was pushed
+func (c *casstore) GetShardInfo(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (si util.ShardInfo, err error) {
+	if err = validate(well, shard); err != nil {
+		return
+	}
+	return readManifest(c.manifestPath(cid, guid, well, shard))
+}
+
+// CustomerUsage returns the number of bytes of objects referenced by a customer's shards,
+// a file shared by several of the customer's shards is only counted once
+func (c *casstore) CustomerUsage(ctx context.Context, cid uint64) (usage uint64, err error) {
+	seen := map[string]bool{}
+	err = c.walkManifests(cid, func(si util.ShardInfo) {
+		for _, f := range si.Files {
+			if !seen[f.SHA256] {
+				seen[f.SHA256] = true
+				usage += uint64(f.Size)
+			}
+		}
+	})
+	if os.IsNotExist(err) {
+		//nothing has been stored yet
+		err = nil
+	}
+	return
+}
+
+// SetLegalHolds sets the customers and wells whose shards may not be deleted or replaced
+func (c *casstore) SetLegalHolds(lh util.LegalHolds) {
+	c.mtx.Lock()
+	c.holds = lh
+	c.mtx.Unlock()
+}
+
+func (c *casstore) held(cid uint64, well string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.holds.Held(cid, well)
+}
+
+// DeleteShard removes a shard's manifest, its objects are removed by the next sweep unless
+// another shard refers to them
+func (c *casstore) DeleteShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (err error) {
+	if err = validate(well, shard); err != nil {
+		return
+	} else if c.held(cid, well) {
+		return util.ErrLegalHold
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: guid,
+		Well:    well,
+		Shard:   shard,
+	}
+	if err = c.EnterUpload(uid); err != nil {
+		return
+	}
+	if err = os.Remove(c.manifestPath(cid, guid, well, shard)); err != nil {
+		c.ExitUpload(uid)
+		return
+	}
+	err = c.ExitUpload(uid)
+	return
+}
+
+// UnpackShard stores a pushed shard, a shard which is already stored is replaced unless its
+// well is held.  The shard is only replaced once the entire push is received.
+func (c *casstore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	return c.unpackShard(ctx, cid, guid, well, shard, rdr, c.EnterUpload, false)
+}
+
+// UnpackShardWait is UnpackShard, but an upload of the same shard which is already in
+// progress is waited on for up to wait rather than immediately failing
+func (c *casstore) UnpackShardWait(ctx context.Context, wait time.Duration, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	return c.unpackShard(ctx, cid, guid, well, shard, rdr, func(uid util.UploadID) error {
+		return c.EnterUploadWait(ctx, uid, wait)
+	}, false)
+}
+
+// UnpackNewShard is UnpackShardWait, but fails with util.ErrShardExists if the shard is already stored
+func (c *casstore) UnpackNewShard(ctx context.Context, wait time.Duration, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	return c.unpackShard(ctx, cid, guid, well, shard, rdr, func(uid util.UploadID) error {
+		return c.EnterUploadWait(ctx, uid, wait)
+	}, true)
+}
+
+// unpackShard writes each file of the shard as an object and then records the shard's manifest,
+// any provenance attached to the context is recorded in the manifest
+func (c *casstore) unpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader, enter func(util.UploadID) error, exclusive bool) (err error) {
+	if err = validate(well, shard); err != nil {
+		return
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: guid,
+		Well:    well,
+		Shard:   shard,
+	}
+	if err = enter(uid); err != nil {
+		return
+	}
+	defer func() {
+		if xerr := c.ExitUpload(uid); err == nil {
+			err = xerr
+		}
+	}()
+	rdr = contextio.NewReader(ctx, c.CountReader(uid, rdr))
+
+	mpath := c.manifestPath(cid, guid, well, shard)
+	if _, err = os.Stat(mpath); err == nil && (exclusive || c.held(cid, well)) {
+		return util.ErrShardExists
+	}
+	indexerDir := c.indexerDir(cid, guid)
+	if err = os.MkdirAll(filepath.Dir(mpath), 0770); err != nil {
+		return
+	}
+
+	h := &handler{
+		c:    c,
+		cid:  cid,
+		guid: guid,
+		bdir: indexerDir,
+		si:   util.ShardInfo{Shard: shard},
+	}
+	//the objects stay pinned until the manifest refers to them, so a sweep cannot remove them first
+	defer func() {
+		c.unpin(h.digests()...)
+	}()
+	var up *shardpacker.Unpacker
+	if up, err = shardpacker.NewUnpacker(shard, rdr); err != nil {
+		return
+	} else if err = up.Unpack(h); err != nil {
+		return
+	}
+	if p, ok := util.ProvenanceFromContext(ctx); ok {
+		h.si.Provenance = &p
+	}
+	err = c.writeManifest(mpath, h.si)
+	return
+}
+
+func (c *casstore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	if err = validate(well, shard); err != nil {
+		return
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: guid,
+		Well:    well,
+		Shard:   shard,
+	}
+	if err = c.EnterUpload(uid); err != nil {
+		return
+	}
+	defer func() {
+		if xerr := c.ExitUpload(uid); err == nil {
+			err = xerr
+		}
+	}()
+	var si util.ShardInfo
+	if si, err = readManifest(c.manifestPath(cid, guid, well, shard)); err != nil {
+		return
+	}
+	//the manifest cannot be removed while we hold the shard, so its objects are still referenced
+	files := map[string]util.ShardFile{}
+	var digests []string
+	for _, f := range si.Files {
+		files[f.Name] = f
+		digests = append(digests, f.SHA256)
+	}
+	c.pin(digests...)
+	defer c.unpin(digests...)
+
+	p := shardpacker.NewPacker(shard)
+	wtr = contextio.NewWriter(ctx, c.CountWriter(uid, wtr))
+
+	//fire up the routine that will relay from the packer to the writer
+	copyErrChan := make(chan error, 1)
+	go func(ch chan error) {
+		_, err := io.Copy(wtr, p)
+		ch <- err
+	}(copyErrChan)
+
+	addFilesErrChan := make(chan error, 1)
+	go func(ch chan error) {
+		err := c.addFiles(shard, files, p)
+		if err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Flush(); err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Close(); err != nil {
+			p.CloseWithError(err)
+		}
+		ch <- err
+	}(addFilesErrChan)
+
+	select {
+	case err = <-copyErrChan:
+		if err != nil {
+			//cancel first, the adder may hold the packer lock while blocked flushing to us
+			p.Cancel()
+			p.CloseWithError(err)
+			<-addFilesErrChan
+		} else {
+			err = <-addFilesErrChan
+		}
+	case err = <-addFilesErrChan:
+		if err != nil {
+			p.CloseWithError(err)
+			<-copyErrChan
+		} else {
+			err = <-copyErrChan
+		}
+	}
+	return
+}
+
+// addFiles adds the files a pull sends to the packer, files which are only kept alongside
+// the shard such as well tags are left out as the file backend does
+func (c *casstore) addFiles(id string, files map[string]util.ShardFile, p *shardpacker.Packer) (err error) {
+	for _, ft := range packOrder {
+		if f, ok := files[filepath.ToSlash(ft.Filepath(id))]; ok {
+			if err = c.addObject(f, func(rdr io.Reader) error { return p.AddFile(ft, f.Size, rdr) }); err != nil {
+				return
+			}
+		}
+	}
+	var arts []string
+	for name := range files {
+		if shardpacker.IsArtifact(name) {
+			arts = append(arts, name)
+		}
+	}
+	sort.Strings(arts)
+	for _, name := range arts {
+		f := files[name]
+		if err = c.addObject(f, func(rdr io.Reader) error { return p.AddArtifact(name, f.Size, rdr) }); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *casstore) addObject(f util.ShardFile, add func(io.Reader) error) (err error) {
+	if !validDigest(f.SHA256) {
+		return ErrBadDigest
+	}
+	var fin *os.File
+	if fin, err = os.Open(c.objectPath(f.SHA256)); err != nil {
+		return
+	}
+	err = add(fin)
+	fin.Close()
+	return
+}
+
+func (c *casstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, c.indexerDir(cid, guid)); err != nil {
+		return
+	}
+	tgs, err = tm.TagSet()
+	if err == nil {
+		err = tags.ReleaseTagMan(cid, guid) //set the error on release
+	} else {
+		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
+	}
+	return
+}
+
+func (c *casstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	var tm tags.TagManager
+	indexerDir := c.indexerDir(cid, guid)
+	// This is likely to happen before the shard is synced, so make sure the directory exists
+	if err = os.MkdirAll(indexerDir, 0770); err != nil {
+		return
+	}
+	if tm, err = tags.GetTagMan(cid, guid, indexerDir); err != nil {
+		return
+	}
+	if _, err = tm.Merge(idxTags); err != nil {
+		tags.ReleaseTagMan(cid, guid)
+		return
+	}
+	tgs, err = tm.TagSet()
+	if err == nil {
+		err = tags.ReleaseTagMan(cid, guid) //set the error on release
+	} else {
+		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
+	}
+	return
+}
+
+// putObject stores the contents of the reader as an object and pins it, the caller unpins it
+// once a manifest refers to it or the object is no longer wanted
+func (c *casstore) putObject(rdr io.Reader) (f util.ShardFile, err error) {
+	var fout *os.File
+	if fout, err = ioutil.TempFile(filepath.Join(c.cfg.Dir, tempDir), `object`); err != nil {
+		return
+	}
+	tmp := fout.Name()
+	h := sha256.New()
+	if f.Size, err = io.Copy(io.MultiWriter(fout, h), rdr); err == nil {
+		err = fout.Sync()
+	}
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	opath := c.objectPath(f.SHA256)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, err = os.Stat(opath); err == nil {
+		//already stored, objects are never modified so the new copy is dropped
+		os.Remove(tmp)
+	} else if err = os.MkdirAll(filepath.Dir(opath), 0770); err == nil {
+		err = os.Rename(tmp, opath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	c.pinLocked(f.SHA256)
+	return
+}
+
+func (c *casstore) pin(digests ...string) {
+	c.mtx.Lock()
+	for _, d := range digests {
+		c.pinLocked(d)
+	}
+	c.mtx.Unlock()
+}
+
+func (c *casstore) pinLocked(d string) {
+	c.pinned[d]++
+	if c.protect != nil {
+		c.protect[d] = struct{}{}
+	}
+}
+
+func (c *casstore) unpin(digests ...string) {
+	c.mtx.Lock()
+	for _, d := range digests {
+		if c.pinned[d]--; c.pinned[d] <= 0 {
+			delete(c.pinned, d)
+		}
+		//a running sweep may have read the manifests before the one referring to this was written
+		if c.protect != nil {
+			c.protect[d] = struct{}{}
+		}
+	}
+	c.mtx.Unlock()
+}
+
+// writeManifest replaces the manifest at pth, readers see either the old or new manifest
+func (c *casstore) writeManifest(pth string, si util.ShardInfo) (err error) {
+	var bts []byte
+	if bts, err = json.Marshal(si); err != nil {
+		return
+	}
+	var fout *os.File
+	if fout, err = ioutil.TempFile(filepath.Join(c.cfg.Dir, tempDir), `manifest`); err != nil {
+		return
+	}
+	tmp := fout.Name()
+	if _, err = fout.Write(bts); err == nil {
+		err = fout.Sync()
+	}
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, pth)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+func readManifest(pth string) (si util.ShardInfo, err error) {
+	var bts []byte
+	if bts, err = os.ReadFile(pth); err == nil {
+		err = json.Unmarshal(bts, &si)
+	}
+	return
+}
+
+// walkManifests calls fn with every manifest stored for the customer
+func (c *casstore) walkManifests(cid uint64, fn func(util.ShardInfo)) error {
+	custDir := filepath.Join(c.cfg.Dir, strconv.FormatUint(cid, 10))
+	return filepath.WalkDir(custDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !d.Type().IsRegular() || !strings.HasSuffix(d.Name(), manifestExt) {
+			return nil
+		}
+		//manifests are only found at <indexer>/<well>/<shard>.json
+		if rel, err := filepath.Rel(custDir, p); err != nil || len(strings.Split(filepath.ToSlash(rel), `/`)) != 3 {
+			return nil
+		}
+		si, err := readManifest(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil //deleted since the directory was read
+			}
+			return err
+		}
+		fn(si)
+		return nil
+	})
+}
+
+// listCustomers returns every customer with a directory in the store
+func (c *casstore) listCustomers() (cids []uint64, err error) {
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(c.cfg.Dir); err != nil {
+		return
+	}
+	for _, ent := range ents {
+		if cid, perr := strconv.ParseUint(ent.Name(), 10, 64); perr == nil && ent.IsDir() {
+			cids = append(cids, cid)
+		}
+	}
+	return
+}
+
+func validate(well, shard string) error {
+	if well == `` || well == `.` || well == `..` || path.Base(well) != well || strings.Contains(well, `\`) {
+		return ErrInvalidWell
+	}
+	return util.ValidateShardName(shard)
+}
+
+func validDigest(d string) bool {
+	if len(d) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(d)
+	return err == nil
+}
+
+// handler stores the files of a pushed shard as objects and builds its manifest
+type handler struct {
+	c    *casstore
+	cid  uint64
+	guid uuid.UUID
+	bdir string //indexer directory
+	si   util.ShardInfo
+}
+
+func (h *handler) HandleFile(pth string, rdr io.Reader) (err error) {
+	//the path comes off the wire, make sure it stays inside the shard
+	if pth, err = safepath.Sanitize(pth); err != nil {
+		return
+	}
+	var f util.ShardFile
+	if f, err = h.c.putObject(rdr); err != nil {
+		return
+	}
+	f.Name = filepath.ToSlash(pth)
+	h.si.Files = append(h.si.Files, f)
+	return
+}
+
+func (h *handler) HandleTagUpdate(tgs []tags.TagPair) error {
+	tm, err := tags.GetTagMan(h.cid, h.guid, h.bdir)
+	if err != nil {
+		return err
+	}
+	if _, err = tm.Merge(tgs); err != nil {
+		tags.ReleaseTagMan(h.cid, h.guid)
+		return err
+	}
+	return tags.ReleaseTagMan(h.cid, h.guid)
+}
+
+// HandleMetadata records the shard metadata in the manifest
+func (h *handler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	h.si.Metadata = &md
+	return nil
+}
+
+// digests returns the digest of every object written so far
+func (h *handler) digests() (r []string) {
+	for _, f := range h.si.Files {
+		r = append(r, f.SHA256)
+	}
+	return
+}
@@ -0,0 +1,243 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package casstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+)
+
+var _ webserver.ShardHandler = &casstore{}
+
+func newStore(t *testing.T) *casstore {
+	t.Helper()
+	c, err := NewCASStoreHandler(CASStoreConfig{Dir: t.TempDir(), SweepInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func pack(t *testing.T, shard string, files map[shardpacker.Ftype][]byte, tps []tags.TagPair) io.Reader {
+	t.Helper()
+	pkr := shardpacker.NewPacker(shard)
+	go func() {
+		var err error
+		if len(tps) > 0 {
+			err = pkr.AddTags(tps)
+		}
+		for ft, bts := range files {
+			if err == nil {
+				err = pkr.AddFile(ft, int64(len(bts)), bytes.NewReader(bts))
+			}
+		}
+		if err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	return pkr
+}
+
+// countObjects returns how many objects are stored
+func countObjects(t *testing.T, c *casstore) (n int) {
+	t.Helper()
+	err := filepath.Walk(filepath.Join(c.cfg.Dir, objectDir), func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestPushPull(t *testing.T) {
+	ctx := context.Background()
+	c := newStore(t)
+	guid := uuid.New()
+	files := map[shardpacker.Ftype][]byte{
+		shardpacker.Store:              []byte(`store stuff`),
+		shardpacker.Index:              []byte(`index stuff`),
+		shardpacker.Verify:             []byte(`verify stuff`),
+		shardpacker.IndexAccelKeyFile:  []byte(`accel keys`),
+		shardpacker.IndexAccelDataFile: []byte(`accel data`),
+	}
+	tps := []tags.TagPair{{Name: `testing`, Value: 1}}
+	if err := c.UnpackShard(ctx, 1, guid, `foo`, `76a00`, pack(t, `76a00`, files, tps)); err != nil {
+		t.Fatal(err)
+	} else if n := countObjects(t, c); n != len(files) {
+		t.Fatalf("stored %d objects", n)
+	}
+
+	//pushing the shard again replaces it without storing anything new
+	if err := c.UnpackShard(ctx, 1, guid, `foo`, `76a00`, pack(t, `76a00`, files, tps)); err != nil {
+		t.Fatal(err)
+	} else if n := countObjects(t, c); n != len(files) {
+		t.Fatalf("re-push stored %d objects", n)
+	} else if shards, err := c.GetShardsInTimeframe(ctx, 1, guid, `foo`, util.Timeframe{End: time.Now()}); err != nil || len(shards) != 1 || shards[0] != `76a00` {
+		t.Fatalf("bad shards %v %v", shards, err)
+	}
+
+	//a shard which shares a file only adds the files which differ
+	files[shardpacker.Index] = []byte(`other index stuff`)
+	if err := c.UnpackShard(ctx, 1, guid, `foo`, `76a01`, pack(t, `76a01`, files, nil)); err != nil {
+		t.Fatal(err)
+	} else if n := countObjects(t, c); n != len(files)+1 {
+		t.Fatalf("stored %d objects", n)
+	}
+
+	if idx, err := c.ListIndexes(ctx, 1); err != nil || len(idx) != 1 || idx[0] != guid.String() {
+		t.Fatalf("bad indexers %v %v", idx, err)
+	} else if wells, err := c.ListIndexerWells(ctx, 1, guid); err != nil || len(wells) != 1 || wells[0] != `foo` {
+		t.Fatalf("bad wells %v %v", wells, err)
+	}
+	tf, err := c.GetWellTimeframe(ctx, 1, guid, `foo`)
+	if err != nil {
+		t.Fatal(err)
+	} else if s, _, _ := util.ShardNameToDateRange(`76a00`); !tf.Start.Equal(s) {
+		t.Fatalf("bad timeframe start %v", tf.Start)
+	} else if _, e, _ := util.ShardNameToDateRange(`76a01`); !tf.End.Equal(e) {
+		t.Fatalf("bad timeframe end %v", tf.End)
+	}
+
+	bb := bytes.NewBuffer(nil)
+	if err = c.PackShard(ctx, 1, guid, `foo`, `76a01`, bb); err != nil {
+		t.Fatal(err)
+	}
+	up, err := shardpacker.NewUnpacker(`76a01`, bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := storetest.FileSet{}
+	if err = up.Unpack(got); err != nil {
+		t.Fatal(err)
+	}
+	for ft, want := range files {
+		if !bytes.Equal(got[ft.Filepath(`76a01`)], want) {
+			t.Fatalf("pulled %s does not match", ft.Filepath(`76a01`))
+		}
+	}
+
+	if tgs, err := c.GetTags(ctx, 1, guid); err != nil || len(tgs) != 3 {
+		t.Fatalf("bad tags %+v %v", tgs, err)
+	}
+	if si, err := c.GetShardInfo(ctx, 1, guid, `foo`, `76a01`); err != nil || si.Shard != `76a01` || len(si.Files) != len(files) {
+		t.Fatalf("bad shard info %+v %v", si, err)
+	}
+	//the shared files are only counted once
+	var want uint64
+	for _, s := range []string{`store stuff`, `index stuff`, `other index stuff`, `verify stuff`, `accel keys`, `accel data`} {
+		want += uint64(len(s))
+	}
+	if usage, err := c.CustomerUsage(ctx, 1); err != nil || usage != want {
+		t.Fatalf("bad usage %d %v", usage, err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	c := newStore(t)
+	guid := uuid.New()
+	a := map[shardpacker.Ftype][]byte{
+		shardpacker.Store: []byte(`shared store`),
+		shardpacker.Index: []byte(`index a`),
+	}
+	b := map[shardpacker.Ftype][]byte{
+		shardpacker.Store: []byte(`shared store`),
+		shardpacker.Index: []byte(`index b`),
+	}
+	if err := c.UnpackShard(ctx, 1, guid, `foo`, `76a00`, pack(t, `76a00`, a, nil)); err != nil {
+		t.Fatal(err)
+	} else if err = c.UnpackShard(ctx, 1, guid, `foo`, `76a01`, pack(t, `76a01`, b, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := c.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("swept %d referenced objects %v", n, err)
+	}
+
+	//only the file no other shard refers to is removed
+	if err := c.DeleteShard(ctx, 1, guid, `foo`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if n, freed, err := c.Sweep(ctx); err != nil || n != 1 || freed != uint64(len(`index a`)) {
+		t.Fatalf("bad sweep %d %d %v", n, freed, err)
+	} else if err = c.PackShard(ctx, 1, guid, `foo`, `76a01`, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	//objects in use are left alone even when nothing refers to them yet
+	f, err := c.putObject(bytes.NewReader([]byte(`pending`)))
+	if err != nil {
+		t.Fatal(err)
+	} else if n, _, err := c.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("swept %d pinned objects %v", n, err)
+	}
+	c.unpin(f.SHA256)
+	if n, _, err := c.Sweep(ctx); err != nil || n != 1 {
+		t.Fatalf("swept %d unpinned objects %v", n, err)
+	} else if _, err = os.Stat(c.objectPath(f.SHA256)); !os.IsNotExist(err) {
+		t.Fatalf("unreferenced object left behind: %v", err)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	ctx := context.Background()
+	c := newStore(t)
+	guid := uuid.New()
+	if _, err := c.ListIndexes(ctx, 1); !os.IsNotExist(err) {
+		t.Fatalf("listed a missing customer: %v", err)
+	} else if err = c.PackShard(ctx, 1, guid, `foo`, `76a00`, ioutil.Discard); !os.IsNotExist(err) {
+		t.Fatalf("pulled a missing shard: %v", err)
+	}
+	files := map[shardpacker.Ftype][]byte{shardpacker.Store: []byte(`store stuff`)}
+	if err := c.UnpackNewShard(ctx, 0, 1, guid, `foo`, `76a00`, pack(t, `76a00`, files, nil)); err != nil {
+		t.Fatal(err)
+	} else if err = c.UnpackNewShard(ctx, 0, 1, guid, `foo`, `76a00`, pack(t, `76a00`, files, nil)); !errors.Is(err, util.ErrShardExists) {
+		t.Fatalf("duplicate push was not refused: %v", err)
+	}
+
+	//a truncated push stores no manifest
+	pr, pw := io.Pipe()
+	pw.CloseWithError(errors.New("dropped"))
+	if err := c.UnpackShard(ctx, 1, guid, `foo`, `76a01`, pr); err == nil {
+		t.Fatal("truncated push succeeded")
+	} else if err = c.PackShard(ctx, 1, guid, `foo`, `76a01`, ioutil.Discard); !os.IsNotExist(err) {
+		t.Fatalf("truncated push was stored: %v", err)
+	}
+
+	c.SetLegalHolds(util.LegalHolds{1: {Wells: []string{`foo`}}})
+	if err := c.DeleteShard(ctx, 1, guid, `foo`, `76a00`); err != util.ErrLegalHold {
+		t.Fatalf("deleted a held shard: %v", err)
+	}
+	c.SetLegalHolds(nil)
+	if err := c.DeleteShard(ctx, 1, guid, `foo`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if err = c.DeleteShard(ctx, 1, guid, `foo`, `76a00`); !os.IsNotExist(err) {
+		t.Fatalf("deleted a missing shard: %v", err)
+	}
+}
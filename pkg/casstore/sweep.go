@@ -0,0 +1,127 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package casstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func (c *casstore) sweepRoutine() {
+	defer c.wg.Done()
+	ctx, cf := context.WithCancel(context.Background())
+	go func() {
+		<-c.done
+		cf()
+	}()
+	tckr := time.NewTicker(c.cfg.SweepInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tckr.C:
+		}
+		if n, freed, err := c.Sweep(ctx); err != nil && ctx.Err() == nil {
+			c.cfg.Lgr.Warn("Failed to sweep unreferenced objects", log.KV("removed", n), log.KVErr(err))
+		} else if n > 0 {
+			c.cfg.Lgr.Info("Removed unreferenced objects", log.KV("removed", n), log.KV("bytes", freed))
+		}
+	}
+}
+
+// Sweep removes every object which no manifest refers to, returning how many were removed
+// and their total size.  Objects being written or read, or whose use changed while the
+// manifests were being read, are left for the next sweep.
+func (c *casstore) Sweep(ctx context.Context) (removed int, freed uint64, err error) {
+	c.mtx.Lock()
+	if c.protect != nil {
+		c.mtx.Unlock()
+		return //another sweep is running
+	}
+	c.protect = map[string]struct{}{}
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		c.protect = nil
+		c.mtx.Unlock()
+	}()
+
+	refs := map[string]struct{}{}
+	var cids []uint64
+	if cids, err = c.listCustomers(); err != nil {
+		return
+	}
+	for _, cid := range cids {
+		if err = c.walkManifests(cid, func(si util.ShardInfo) {
+			for _, f := range si.Files {
+				refs[f.SHA256] = struct{}{}
+			}
+		}); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+
+	var prefixes []os.DirEntry
+	if prefixes, err = os.ReadDir(filepath.Join(c.cfg.Dir, objectDir)); err != nil {
+		return
+	}
+	for _, pfx := range prefixes {
+		if !pfx.IsDir() {
+			continue
+		}
+		var objs []os.DirEntry
+		if objs, err = os.ReadDir(filepath.Join(c.cfg.Dir, objectDir, pfx.Name())); err != nil {
+			return
+		}
+		for _, obj := range objs {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			d := obj.Name()
+			if _, ok := refs[d]; ok || !validDigest(d) {
+				continue
+			}
+			var fi os.FileInfo
+			if fi, err = obj.Info(); err != nil {
+				if os.IsNotExist(err) {
+					err = nil
+					continue
+				}
+				return
+			}
+			//holding the lock keeps a push from adopting the object as we remove it
+			c.mtx.Lock()
+			_, prot := c.protect[d]
+			if c.pinned[d] > 0 || prot {
+				c.mtx.Unlock()
+				continue
+			}
+			err = os.Remove(c.objectPath(d))
+			c.mtx.Unlock()
+			if err != nil {
+				if os.IsNotExist(err) {
+					err = nil
+					continue
+				}
+				return
+			}
+			removed++
+			freed += uint64(fi.Size())
+		}
+	}
+	return
+}
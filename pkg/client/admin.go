@@ -0,0 +1,88 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+)
+
+// The Admin calls manage the server's customers and require a login holding the admin role,
+// other logins get a StatusError with code 403.
+
+// AdminListUsers returns every customer on the server
+func (c *Client) AdminListUsers() (uis []auth.UserInfo, err error) {
+	err = c.getStaticURL(webserver.ADMIN_USERS_PATH, &uis)
+	return
+}
+
+// AdminGetUser returns the account details of a customer
+func (c *Client) AdminGetUser(id uint64) (ui auth.UserInfo, err error) {
+	err = c.getStaticURL(fmt.Sprintf("%s/%d", webserver.ADMIN_USERS_PATH, id), &ui)
+	return
+}
+
+// AdminAddUser creates a customer, if passwd is empty the server generates a password
+// and it is returned here.  It is never shown again.
+func (c *Client) AdminAddUser(id uint64, passwd string, md auth.Metadata) (generated string, err error) {
+	var resp webserver.AdminUserResponse
+	aur := webserver.AdminUserRequest{ID: id, Password: passwd, Metadata: md}
+	if err = c.postStaticURL(webserver.ADMIN_USERS_PATH, aur, &resp); err == nil {
+		generated = resp.Password
+	}
+	return
+}
+
+// AdminDeleteUser deletes a customer, administrators may not delete themselves
+func (c *Client) AdminDeleteUser(id uint64) error {
+	return c.deleteStaticURL(fmt.Sprintf("%s/%d", webserver.ADMIN_USERS_PATH, id), nil)
+}
+
+// AdminResetPassword sets a customer's password, if passwd is empty the server generates
+// a password and it is returned here.  It is never shown again.
+func (c *Client) AdminResetPassword(id uint64, passwd string) (generated string, err error) {
+	var resp webserver.AdminUserResponse
+	url := fmt.Sprintf("%s/%d/password", webserver.ADMIN_USERS_PATH, id)
+	if err = c.methodStaticPushURL(http.MethodPut, url, webserver.AdminUserRequest{Password: passwd}, &resp); err == nil {
+		generated = resp.Password
+	}
+	return
+}
+
+// AdminUpdateUser changes the fields of a customer's account which are set in upd and returns the updated account
+func (c *Client) AdminUpdateUser(id uint64, upd webserver.AdminUserUpdate) (ui auth.UserInfo, err error) {
+	err = c.methodStaticPushURL(http.MethodPatch, fmt.Sprintf("%s/%d", webserver.ADMIN_USERS_PATH, id), upd, &ui)
+	return
+}
+
+// AdminImportUsers creates every customer given or none of them, each is given either a password or a bcrypt hash
+func (c *Client) AdminImportUsers(ius []auth.ImportUser) error {
+	return c.postStaticURL(webserver.ADMIN_IMPORT_PATH, ius, nil)
+}
+
+// AdminVerifyShard has the server check its stored copy of a customer's shard for corruption,
+// the shard is not downloaded.  A shard with problems is not an error, check the report's Passed field.
+func (c *Client) AdminVerifyShard(cid uint64, sid ShardID) (sv util.ShardVerification, err error) {
+	url := fmt.Sprintf("/api/verify/%d/%s/%s/%s", cid, sid.Indexer, sid.Well, sid.Shard)
+	err = c.postStaticURL(url, nil, &sv)
+	return
+}
+
+// AdminReencrypt runs a pass which re-encrypts the server's stored shards under the current
+// keys and returns its outcome once it finishes, a dry run only counts what would be rewritten.
+// Servers which do not encrypt shards answer with a StatusError with code 501, and one with 409
+// if a pass is already running.
+func (c *Client) AdminReencrypt(dryRun bool) (res util.ReencryptResult, err error) {
+	err = c.postStaticURL(webserver.ADMIN_REKEY_PATH, webserver.AdminReencryptRequest{DryRun: dryRun}, &res)
+	return
+}
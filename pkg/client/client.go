@@ -9,6 +9,7 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -25,10 +26,14 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gravwell/cloudarchive/pkg/safepath"
 	"github.com/gravwell/cloudarchive/pkg/shardpacker"
 	"github.com/gravwell/cloudarchive/pkg/tags"
 	"github.com/gravwell/cloudarchive/pkg/util"
 	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gravwell/gravwell/v3/ingest/log"
 )
 
 const (
@@ -39,6 +44,9 @@ const (
 	defaultUserAgent = `GravwellCloudArchiveClient`
 	authHeaderName   = `Authorization`
 	cntType          = `GravwellShard`
+
+	pullSpaceMargin  = 20               //pulls require an extra 1/20th of the shard size free
+	pullSpaceReserve = 64 * 1024 * 1024 //plus this many bytes
 )
 
 var (
@@ -47,8 +55,18 @@ var (
 	ErrInvalidTestStatus error = errors.New("Invalid status on webserver test")
 	ErrAccountLocked     error = errors.New(`Account is Locked`)
 	ErrLoginFail         error = errors.New(`Username and Password are incorrect`)
+	ErrTOTPRequired      error = errors.New(`TOTP code required`)
+	ErrTOTPFail          error = errors.New(`TOTP code is incorrect`)
+	ErrLoginBackoff      error = errors.New(`Too many failed logins`)
 	ErrNotSynced         error = errors.New(`Client has not been synced`)
 	ErrNoLogin           error = errors.New("Not logged in")
+	ErrInsufficientSpace error = errors.New("Insufficient disk space to pull shard")
+	ErrNoFreeSpaceCheck  error = errors.New("Free space checks are not supported on this platform")
+	ErrPushVerifyFailed  error = errors.New("Stored shard does not match the local copy")
+	ErrInvalidPoolSize   error = errors.New("Connection pool options must not be negative")
+	ErrInvalidToken      error = errors.New("Token does not name a customer")
+
+	errPushUnverified = errors.New("push was not verified by the server")
 
 	tickChunkSize = 128 * 1024      //tick every 32KB
 	tickTimeout   = 8 * time.Second //basically we have to maintain 32KB/s
@@ -70,6 +88,19 @@ type Client struct {
 	tlsConfig   *tls.Config
 	transport   *http.Transport
 	custID      uint64
+	verifyPush  bool
+	noMetadata  bool
+	reserve     bool
+	log         *clientLog
+}
+
+// PoolOptions sizes the pool of HTTP connections a client keeps to its server, zero values
+// keep the net/http defaults
+type PoolOptions struct {
+	MaxConnsPerHost     int           // connections open to the server at once, zero is unlimited
+	MaxIdleConns        int           // idle connections kept in total, zero is unlimited
+	MaxIdleConnsPerHost int           // idle connections kept to the server, 2 if zero
+	IdleConnTimeout     time.Duration // how long an idle connection is kept, zero is forever
 }
 
 type ActiveSession struct {
@@ -100,19 +131,17 @@ func NewClient(server string, enforceCertificate, useHttps bool) (*Client, error
 	}
 
 	//setup a transport that allows a bad client if the user asks for it
-	tr := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
+	tr := newTransport(tlsConfig, PoolOptions{})
+	cl := &clientLog{}
 	clnt := http.Client{
-		Transport:     tr,
-		CheckRedirect: redirectPolicy, //use default redirect policy
+		Transport: &loggingTransport{rt: tr, log: cl},
 	}
 	//create the header map and stuff our user-agent in there
 	hdrMap := make(map[string]string, 1)
 	hdrMap[`User-Agent`] = defaultUserAgent
 
 	//actually build and return the client
-	return &Client{
+	c := &Client{
 		server:      server,
 		serverURL:   serverURL,
 		clnt:        &clnt,
@@ -124,7 +153,10 @@ func NewClient(server string, enforceCertificate, useHttps bool) (*Client, error
 		httpScheme:  httpScheme,
 		tlsConfig:   tlsConfig,
 		transport:   tr,
-	}, nil
+		log:         cl,
+	}
+	clnt.CheckRedirect = c.checkRedirect //use default redirect policy, logging what it does
+	return c, nil
 }
 
 // we allow a single redirect to allow for the muxer to clean up requests
@@ -167,6 +199,28 @@ func (c *Client) Test() error {
 	return nil
 }
 
+// Capabilities asks the server which API versions and optional features it supports, no
+// login is required.  Servers which predate the capabilities endpoint are reported as
+// serving only the v1 API without any optional features.
+func (c *Client) Capabilities() (cp webserver.Capabilities, err error) {
+	var resp *http.Response
+	if resp, err = c.methodRequestURL(http.MethodGet, webserver.CAPABILITIES_PATH, ``, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&cp)
+	case http.StatusNotFound:
+		cp.APIVersions = []string{webserver.APIv1}
+		cp.Compression = []string{webserver.CompressionZlib}
+		cp.DuplicatePolicy = webserver.DuplicateVersion
+	default:
+		err = statusError(resp)
+	}
+	return
+}
+
 func (c *Client) SetUserAgent(val string) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -177,6 +231,76 @@ func (c *Client) SetUserAgent(val string) {
 	return
 }
 
+// SetVerifyPushes controls whether a pushed shard which the server could not check against
+// its streamed checksum, such as when a proxy strips the checksum trailer or the server
+// predates checksums, is verified afterwards by comparing the stored copy with the local one
+func (c *Client) SetVerifyPushes(v bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.verifyPush = v
+}
+
+// SetPushMetadata controls whether pushed shards carry a metadata entry describing their
+// provenance, it is enabled by default and must be disabled for servers which predate it
+func (c *Client) SetPushMetadata(v bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.noMetadata = !v
+}
+
+// SetReservePushes controls whether each push first reserves capacity for the shard, so that
+// a server which lacks the space or quota refuses it before any data is sent.  Servers which
+// predate reservations are pushed to without one.
+func (c *Client) SetReservePushes(v bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.reserve = v
+}
+
+// SetPoolOptions replaces the client's connection pool with one sized by po, connections
+// idle in the old pool are closed.  Clients pushing or pulling several shards at once need
+// a larger pool.  It must be called before the client is shared between goroutines.
+func (c *Client) SetPoolOptions(po PoolOptions) error {
+	if po.MaxConnsPerHost < 0 || po.MaxIdleConns < 0 || po.MaxIdleConnsPerHost < 0 || po.IdleConnTimeout < 0 {
+		return ErrInvalidPoolSize
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	old := c.transport
+	c.transport = newTransport(c.tlsConfig, po)
+	c.clnt.Transport = &loggingTransport{rt: c.transport, log: c.log}
+	old.CloseIdleConnections()
+	return nil
+}
+
+func newTransport(tlsConfig *tls.Config, po PoolOptions) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxConnsPerHost:     po.MaxConnsPerHost,
+		MaxIdleConns:        po.MaxIdleConns,
+		MaxIdleConnsPerHost: po.MaxIdleConnsPerHost,
+		IdleConnTimeout:     po.IdleConnTimeout,
+	}
+}
+
+// shardMetadata builds the metadata entry sent with a shard push, nil if it is disabled
+func (c *Client) shardMetadata(sid ShardID) *shardpacker.ShardMetadata {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.noMetadata {
+		return nil
+	}
+	md := &shardpacker.ShardMetadata{
+		Shard:         sid.Shard,
+		Well:          sid.Well,
+		Indexer:       sid.Indexer,
+		ClientVersion: c.headerMap[`User-Agent`],
+	}
+	//the server rejects shards with bad names, so an unparseable name just leaves the range empty
+	md.Start, md.End, _ = util.ShardNameToDateRange(sid.Shard)
+	return md
+}
+
 // TestLogin checks if we're logged in to the webserver
 func (c *Client) TestLogin() error {
 	c.mtx.Lock()
@@ -187,7 +311,14 @@ func (c *Client) TestLogin() error {
 }
 
 // Login logs into the URL and grabs the jwt
+// if the account requires a TOTP code ErrTOTPRequired is returned, use LoginTOTP
 func (c *Client) Login(user, pass string) error {
+	return c.LoginTOTP(user, pass, ``)
+}
+
+// LoginTOTP logs into the URL using a TOTP code as a second factor and grabs the jwt
+// the code is only sent if the server requests it
+func (c *Client) LoginTOTP(user, pass, code string) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
@@ -237,6 +368,8 @@ func (c *Client) Login(user, pass string) error {
 		return ErrAccountLocked
 	case http.StatusUnprocessableEntity:
 		return ErrLoginFail
+	case http.StatusTooManyRequests:
+		return loginBackoffError(resp)
 	case http.StatusOK:
 	default:
 		return fmt.Errorf("Invalid response: %d", resp.StatusCode)
@@ -246,6 +379,14 @@ func (c *Client) Login(user, pass string) error {
 	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
 		return err
 	}
+	if loginResp.TOTPRequired {
+		if code == `` {
+			return ErrTOTPRequired
+		}
+		if loginResp, err = c.loginTOTP(loginResp.Challenge, code); err != nil {
+			return err
+		}
+	}
 	err = c.processLoginResponse(loginResp)
 	if err == nil {
 		c.custID = cid
@@ -253,6 +394,89 @@ func (c *Client) Login(user, pass string) error {
 	return err
 }
 
+// LoginToken uses a token from an earlier login in place of logging in, the token is
+// checked with the server before it is used
+func (c *Client) LoginToken(tok string) (err error) {
+	var claims jwt.MapClaims
+	if _, _, err = new(jwt.Parser).ParseUnverified(tok, &claims); err != nil {
+		return
+	}
+	cn, ok := claims[`CustomerNumber`].(float64)
+	if !ok {
+		return ErrInvalidToken
+	}
+	c.mtx.Lock()
+	if c.state != STATE_NEW && c.state != STATE_LOGGED_OFF {
+		c.mtx.Unlock()
+		return errors.New("Client not ready for login")
+	}
+	c.headerMap[authHeaderName] = fmt.Sprintf("Bearer %s", tok)
+	c.sessionData = ActiveSession{
+		JWT: tok,
+	}
+	c.custID = uint64(cn)
+	c.state = STATE_AUTHED
+	c.mtx.Unlock()
+
+	if err = c.TestLogin(); err != nil {
+		c.mtx.Lock()
+		delete(c.headerMap, authHeaderName)
+		c.sessionData = ActiveSession{}
+		c.state = STATE_LOGGED_OFF
+		c.mtx.Unlock()
+	}
+	return
+}
+
+// loginTOTP performs the second step of a login, handing back the challenge and a TOTP code
+func (c *Client) loginTOTP(challenge, code string) (loginResp webserver.LoginResponse, err error) {
+	uri := fmt.Sprintf("%s://%s%s", c.httpScheme, c.server, LOGIN_TOTP_URL)
+	vals := url.Values{}
+	vals.Add(CHALLENGE_FIELD, challenge)
+	vals.Add(CODE_FIELD, code)
+
+	var req *http.Request
+	if req, err = http.NewRequest(`POST`, uri, strings.NewReader(vals.Encode())); err != nil {
+		return
+	}
+	for k, v := range c.headerMap {
+		req.Header.Add(k, v)
+	}
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+
+	var resp *http.Response
+	if resp, err = c.clnt.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusLocked:
+		err = ErrAccountLocked
+		return
+	case http.StatusUnprocessableEntity:
+		err = ErrTOTPFail
+		return
+	case http.StatusTooManyRequests:
+		err = loginBackoffError(resp)
+		return
+	case http.StatusOK:
+	default:
+		err = fmt.Errorf("Invalid response: %d", resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	return
+}
+
+// loginBackoffError wraps ErrLoginBackoff with how long the server asked us to wait
+func loginBackoffError(resp *http.Response) error {
+	if secs, err := strconv.ParseUint(resp.Header.Get(`Retry-After`), 10, 32); err == nil {
+		return fmt.Errorf("%w, retry in %v", ErrLoginBackoff, time.Duration(secs)*time.Second)
+	}
+	return ErrLoginBackoff
+}
+
 func (c *Client) processLoginResponse(loginResp webserver.LoginResponse) error {
 	//check that we had a good login
 	if !loginResp.LoginStatus {
@@ -285,6 +509,19 @@ func (c *Client) SyncTags(guid string, idxTags []tags.TagPair) (tset []tags.TagP
 	return
 }
 
+// PullAllTags returns the tags stored for every indexer the client may access, keyed by indexer UUID
+func (c *Client) PullAllTags() (it webserver.IndexerTags, err error) {
+	err = c.getStaticURL(fmt.Sprintf("/api/tags/%d", c.custID), &it)
+	return
+}
+
+// SyncAllTags merges the tag sets of several indexers in a single request and returns the
+// merged sets, if any indexer may not be accessed no tags are merged
+func (c *Client) SyncAllTags(idxTags webserver.IndexerTags) (it webserver.IndexerTags, err error) {
+	err = c.postStaticURL(fmt.Sprintf("/api/tags/%d", c.custID), idxTags, &it)
+	return
+}
+
 func (c *Client) ListIndexers() ([]string, error) {
 	var r []string
 	err := c.getStaticURL(fmt.Sprintf("/api/shard/%d", c.custID), &r)
@@ -298,6 +535,20 @@ func (c *Client) ListIndexerWells(guid string) ([]string, error) {
 	return r, err
 }
 
+// ListIndexersPage returns a page of the customer's indexers, sorted and filtered by the options
+func (c *Client) ListIndexersPage(lo webserver.ListOptions) (lp webserver.ListPage, err error) {
+	url := fmt.Sprintf("/api/shard/%d", c.custID) + lo.Query()
+	err = c.getStaticURL(url, &lp)
+	return
+}
+
+// ListIndexerWellsPage returns a page of an indexer's wells, sorted and filtered by the options
+func (c *Client) ListIndexerWellsPage(guid string, lo webserver.ListOptions) (lp webserver.ListPage, err error) {
+	url := fmt.Sprintf("/api/shard/%d/%s", c.custID, guid) + lo.Query()
+	err = c.getStaticURL(url, &lp)
+	return
+}
+
 func (c *Client) GetWellTimeframe(guid, well string) (util.Timeframe, error) {
 	var r util.Timeframe
 	url := fmt.Sprintf("/api/shard/%d/%s/%s", c.custID, guid, well)
@@ -312,8 +563,200 @@ func (c *Client) GetWellShardsInTimeframe(guid, well string, tf util.Timeframe)
 	return r, err
 }
 
+// GetWellShardsInTimeframePage returns a page of the shards in a well which fall within
+// a timeframe, sorted and filtered by the options
+func (c *Client) GetWellShardsInTimeframePage(guid, well string, tf util.Timeframe, lo webserver.ListOptions) (lp webserver.ListPage, err error) {
+	url := fmt.Sprintf("/api/shard/%d/%s/%s", c.custID, guid, well) + lo.Query()
+	err = c.postStaticURL(url, tf, &lp)
+	return
+}
+
+// GetWellTags returns the tags assigned to a well, as pushed with its most recent shard
+func (c *Client) GetWellTags(guid, well string) ([]string, error) {
+	var r []string
+	url := fmt.Sprintf("/api/welltags/%d/%s/%s", c.custID, guid, well)
+	err := c.getStaticURL(url, &r)
+	return r, err
+}
+
+// GetWellStats returns the number of shards stored in a well, their total size, and the time span they cover
+func (c *Client) GetWellStats(guid, well string) (ws util.WellStats, err error) {
+	url := fmt.Sprintf("/api/stats/%d/%s/%s", c.custID, guid, well)
+	err = c.getStaticURL(url, &ws)
+	return
+}
+
+// GetShardInfo returns the files the server holds for a shard along with their sizes and checksums
+func (c *Client) GetShardInfo(sid ShardID) (si util.ShardInfo, err error) {
+	url := fmt.Sprintf("/api/shardinfo/%d/%s/%s/%s", c.custID, sid.Indexer, sid.Well, sid.Shard)
+	err = c.getStaticURL(url, &si)
+	return
+}
+
+// ShardStat describes a shard stored on the server, as reported by StatShard
+type ShardStat struct {
+	Size     util.ShardSize // zero if the server cannot size the shard
+	Checksum string         // checksum of the stored files as reported in ShardInfo, empty if the server cannot report it
+}
+
+// StatShard checks whether the server already holds a shard without transferring it, so a
+// shard which is archived need not be packed and pushed again.  A shard the server does not
+// hold is reported as not found rather than as an error.
+func (c *Client) StatShard(sid ShardID) (st ShardStat, found bool, err error) {
+	if c.state != STATE_AUTHED {
+		err = ErrNoLogin
+		return
+	}
+	var resp *http.Response
+	if resp, err = c.methodRequestURL(http.MethodHead, sid.PushShardUrl(c.custID), ``, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		found = true
+		st.Size, _ = sizeHint(resp.Header)
+		st.Checksum = resp.Header.Get(webserver.ShardStoredChecksumHeader)
+	case http.StatusNotFound:
+	case http.StatusUnauthorized:
+		c.state = STATE_LOGGED_OFF
+		err = ErrNotAuthed
+	default:
+		err = statusError(resp)
+	}
+	return
+}
+
+// GetStatus returns the shard transfers the server is currently performing for this customer
+func (c *Client) GetStatus() (st webserver.Status, err error) {
+	url := fmt.Sprintf("/api/status/%d", c.custID)
+	err = c.getStaticURL(url, &st)
+	return
+}
+
+// DeleteShard removes a shard from the server, servers with a trash retention period
+// hold it in the customer's trash where it can be restored with RestoreShard
+func (c *Client) DeleteShard(sid ShardID) error {
+	return c.deleteStaticURL(sid.PushShardUrl(c.custID), nil)
+}
+
+// ListTrash returns the deleted shards the server is still holding for this customer
+func (c *Client) ListTrash() (ents []util.TrashEntry, err error) {
+	url := fmt.Sprintf("/api/trash/%d", c.custID)
+	err = c.getStaticURL(url, &ents)
+	return
+}
+
+// GetAccessHistory returns the customer's shard pushes, pulls, and deletes selected by the query, most recent first
+func (c *Client) GetAccessHistory(q util.AccessQuery) (evs []util.AccessEvent, err error) {
+	url := fmt.Sprintf("/api/history/%d", c.custID)
+	err = c.postStaticURL(url, q, &evs)
+	return
+}
+
+// SignShardURL mints a URL path which pulls the shard without a session token until it
+// expires, a zero expiry selects an hour.  Anyone holding the URL may pull the shard.
+func (c *Client) SignShardURL(sid ShardID, expires time.Time) (su webserver.SignedURL, err error) {
+	url := fmt.Sprintf("/api/sign/%d/%s/%s/%s", c.custID, sid.Indexer, sid.Well, sid.Shard)
+	err = c.postStaticURL(url, webserver.SignURLRequest{Expires: expires}, &su)
+	return
+}
+
+// RestoreShard moves a deleted shard out of the trash and back into its well
+func (c *Client) RestoreShard(id string) (te util.TrashEntry, err error) {
+	url := fmt.Sprintf("/api/trash/%d/%s", c.custID, id)
+	err = c.postStaticURL(url, nil, &te)
+	return
+}
+
+// ReserveShard asks the server to hold capacity for a shard of the given size which is about
+// to be pushed, the reservation is released when the push finishes or after a few minutes.
+// A StatusError with code 507 means the server cannot take the shard.
+// A shard the server already holds and refuses to store again is returned as a DuplicateShardError.
+func (c *Client) ReserveShard(sid ShardID, size uint64) (r webserver.Reservation, err error) {
+	url := fmt.Sprintf("/api/reserve/%d/%s/%s/%s", c.custID, sid.Indexer, sid.Well, sid.Shard)
+	var bts []byte
+	if bts, err = json.Marshal(webserver.ReserveRequest{Size: size}); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = c.methodRequestURL(http.MethodPost, url, `application/json`, bytes.NewReader(bts)); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&r)
+	case http.StatusConflict:
+		dse := &DuplicateShardError{}
+		if err = json.NewDecoder(resp.Body).Decode(&dse.DuplicateShard); err == nil {
+			err = dse
+		}
+	default:
+		err = statusError(resp)
+	}
+	return
+}
+
+// reservePush reserves capacity for a push when reservations are enabled
+func (c *Client) reservePush(sid ShardID, spath string) error {
+	c.mtx.Lock()
+	reserve := c.reserve
+	c.mtx.Unlock()
+	if !reserve {
+		return nil
+	}
+	size, err := dirSize(spath, shardpacker.WellTags.Filename(sid.Shard))
+	if err != nil {
+		return err
+	} else if size == 0 {
+		return nil //nothing to reserve, let the push report what is wrong with the shard
+	}
+	if _, err = c.ReserveShard(sid, uint64(size)); err != nil {
+		var se *StatusError
+		if errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed) {
+			c.log.info("server does not support reservations, pushing without one", log.KV("shard", sid.Shard))
+			return nil
+		}
+		var dse *DuplicateShardError
+		if errors.As(err, &dse) {
+			return checkDuplicate(spath, dse)
+		}
+		return err
+	}
+	return nil
+}
+
+// ProgressFunc is called as a shard transfer proceeds with the number of uncompressed shard
+// bytes moved so far and the expected total, total is zero when it is not known
+type ProgressFunc func(done, total int64)
+
 func (c *Client) PushShard(sid ShardID, spath string, tps []tags.TagPair, tags []string, ctx context.Context) error {
+	return c.PushShardWithProgress(sid, spath, tps, tags, ctx, nil)
+}
+
+// PushShardWithProgress pushes a shard, calling pf as the shard files are sent
+func (c *Client) PushShardWithProgress(sid ShardID, spath string, tps []tags.TagPair, tags []string, ctx context.Context, pf ProgressFunc) error {
+	if err := c.reservePush(sid, spath); err != nil {
+		return err
+	}
+	return c.pushShard(sid, spath, sid.PushShardUrl(c.custID), nil, nil, tps, tags, pf)
+}
+
+// pushShard packs and sends a shard to url, only the listed files are sent if files is not nil
+func (c *Client) pushShard(sid ShardID, spath, url string, hdr http.Header, files []string, tps []tags.TagPair, tags []string, pf ProgressFunc) error {
 	pkr := shardpacker.NewPacker(sid.Shard)
+	if pf != nil {
+		total, err := packSize(spath, sid.Shard, files)
+		if err != nil {
+			return err
+		}
+		var done int64
+		pkr.SetProgress(func(n int64) {
+			done += n
+			pf(done, total)
+		})
+	}
 	trdr, err := newReadTicker(pkr, tickChunkSize)
 	if err != nil {
 		return err
@@ -322,9 +765,9 @@ func (c *Client) PushShard(sid ShardID, spath string, tps []tags.TagPair, tags [
 	ctx, cf := context.WithCancel(context.Background())
 	defer cf()
 	reqRespChan := make(chan error, 1)
-	go c.asyncPushShard(sid, trdr, ctx, reqRespChan)
+	go c.asyncPushShard(url, hdr, trdr, ctx, reqRespChan)
 	packChan := make(chan error, 1)
-	go c.asyncPackShard(spath, tps, tags, pkr, packChan)
+	go c.asyncPackShard(spath, files, tps, tags, c.shardMetadata(sid), pkr, packChan)
 
 	tckr := trdr.ticker()
 	tmr := time.NewTimer(tickTimeout)
@@ -354,6 +797,7 @@ tickLoop:
 			tmr.Reset(tickTimeout) //and continue
 		case _ = <-tmr.C:
 			err = errors.New("upload timeout")
+			c.log.error("shard push stalled, aborting", log.KV("indexer", sid.Indexer), log.KV("well", sid.Well), log.KV("shard", sid.Shard), log.KV("timeout", tickTimeout))
 			//cancel both contexts
 			pkr.Cancel()
 			cf()
@@ -371,23 +815,87 @@ tickLoop:
 	}
 	close(reqRespChan)
 	close(packChan)
+	var dse *DuplicateShardError
+	if errors.As(err, &dse) {
+		err = checkDuplicate(spath, dse)
+	} else if err == errPushUnverified {
+		c.log.warn("server did not verify shard push, checking the stored copy", log.KV("indexer", sid.Indexer), log.KV("well", sid.Well), log.KV("shard", sid.Shard))
+		err = c.verifyStoredShard(sid, spath)
+	}
 	return err
 }
 
+// verifyStoredShard compares the server's copy of a shard with the local one
+func (c *Client) verifyStoredShard(sid ShardID, spath string) error {
+	si, err := c.GetShardInfo(sid)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPushVerifyFailed, err)
+	}
+	files, err := util.ShardFiles(spath)
+	if err != nil {
+		return err
+	}
+	if local := (util.ShardInfo{Files: files}).Checksum(); local != si.Checksum() {
+		return fmt.Errorf("%w: stored checksum %s, local checksum %s", ErrPushVerifyFailed, si.Checksum(), local)
+	}
+	return nil
+}
+
+// DuplicateShardError is returned when a push is refused because the server
+// already holds a copy of the shard which differs from the local copy
+type DuplicateShardError struct {
+	webserver.DuplicateShard
+	Local string // checksum of the local copy, see util.ShardInfo.Checksum
+}
+
+func (dse *DuplicateShardError) Error() string {
+	return fmt.Sprintf("Shard %s is already stored with checksum %s, the local copy has checksum %s", dse.Shard.Shard, dse.Checksum, dse.Local)
+}
+
+// checkDuplicate treats a refused push as a success if the stored shard matches the local copy
+func checkDuplicate(spath string, dse *DuplicateShardError) error {
+	files, err := util.ShardFiles(spath)
+	if err != nil {
+		return err
+	}
+	if dse.Local = (util.ShardInfo{Files: files}).Checksum(); dse.Local == dse.Checksum {
+		return nil //the push was redundant
+	}
+	return dse
+}
+
 // asyncPushShard is a background method that actually performs the HTTP request
 // it will execute the request and copy from the rdr to the http request
 // results are returned via the rchan parameter
-func (c *Client) asyncPushShard(sid ShardID, rdr io.Reader, ctx context.Context, rchan chan error) {
-	resp, err := c.methodRequestURLWithContext(http.MethodPost, sid.PushShardUrl(c.custID), cntType, rdr, ctx)
-	if err == nil && resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Bad Status %s(%d): %s", resp.Status, resp.StatusCode, getBodyErr(resp.Body))
+func (c *Client) asyncPushShard(url string, hdr http.Header, rdr io.Reader, ctx context.Context, rchan chan error) {
+	//the server verifies the packed stream against its checksum before accepting the shard
+	trailer := http.Header{webserver.ShardChecksumHeader: nil}
+	rdr = newChecksumTrailer(rdr, trailer)
+	resp, err := c.methodRequestURLWithHeaders(http.MethodPost, url, cntType, rdr, hdr, trailer, ctx)
+	if err == nil && resp.StatusCode == http.StatusConflict {
+		//the server rejects duplicates and already holds this shard
+		dse := &DuplicateShardError{}
+		if err = json.NewDecoder(resp.Body).Decode(&dse.DuplicateShard); err == nil {
+			err = dse
+		}
+		resp.Body.Close()
+	} else if err == nil && resp.StatusCode != http.StatusOK {
+		err = statusError(resp)
+	} else if err == nil {
+		resp.Body.Close()
+		c.mtx.Lock()
+		verify := c.verifyPush
+		c.mtx.Unlock()
+		if verify && resp.Header.Get(webserver.ShardVerifiedHeader) != `true` {
+			err = errPushUnverified
+		}
 	}
 	rchan <- err
 }
 
 // packShard processes a complete shard, pushsing each component into the
 // shardpacker.Packer object (a compressed tarball)
-func (c *Client) asyncPackShard(spath string, tps []tags.TagPair, tgs []string, pkr *shardpacker.Packer, rchan chan error) {
+func (c *Client) asyncPackShard(spath string, files []string, tps []tags.TagPair, tgs []string, md *shardpacker.ShardMetadata, pkr *shardpacker.Packer, rchan chan error) {
 	id := filepath.Base(spath)
 
 	if err := pkr.AddTags(tps); err != nil {
@@ -400,7 +908,20 @@ func (c *Client) asyncPackShard(spath string, tps []tags.TagPair, tgs []string,
 		pkr.CloseWithError(err)
 		return
 	}
-	if err := util.AddShardFilesToPacker(spath, id, pkr); err != nil {
+	if md != nil {
+		if err := pkr.AddMetadata(*md); err != nil {
+			rchan <- err
+			pkr.CloseWithError(err)
+			return
+		}
+	}
+	var err error
+	if files == nil {
+		err = util.AddShardFilesToPacker(spath, id, pkr)
+	} else {
+		err = util.AddShardFileListToPacker(spath, id, files, pkr)
+	}
+	if err != nil {
 		rchan <- err
 		pkr.CloseWithError(err)
 	} else {
@@ -410,18 +931,48 @@ func (c *Client) asyncPackShard(spath string, tps []tags.TagPair, tgs []string,
 }
 
 func (c *Client) PullShard(sid ShardID, spath string, cancel context.Context) error {
+	return c.PullShardWithProgress(sid, spath, cancel, nil)
+}
+
+// PullShardWithProgress pulls a shard, calling pf as the shard files are written.
+// The expected total is taken from the shard metadata on the server, if the server
+// cannot provide it the total is reported as zero.
+func (c *Client) PullShardWithProgress(sid ShardID, spath string, cancel context.Context, pf ProgressFunc) error {
+	return c.pullShard(sid, sid.PushShardUrl(c.custID), spath, cancel, pf)
+}
+
+// PullSignedShard pulls a shard through a signed URL minted with SignShardURL, no login is needed.
+// The shard ID must name the shard the URL was signed for.
+func (c *Client) PullSignedShard(signedPath string, sid ShardID, spath string, cancel context.Context) error {
+	return c.pullShard(sid, signedPath, spath, cancel, nil)
+}
+
+func (c *Client) pullShard(sid ShardID, url, spath string, cancel context.Context, pf ProgressFunc) error {
 	//make the request and get the body
 	ctx, cf := context.WithCancel(context.Background())
 	defer cf()
 	c.clnt.Timeout = 0
-	resp, err := c.methodRequestURLWithContext(http.MethodGet, sid.PushShardUrl(c.custID), ``, nil, ctx)
+	resp, err := c.methodRequestURLWithContext(http.MethodGet, url, ``, nil, ctx)
 	if err != nil {
 		return err
-	} else if err == nil && resp.StatusCode != http.StatusOK {
+	}
+	hdr := resp.Header
+	if resp.StatusCode == http.StatusFound && hdr.Get(webserver.PullRedirectHeader) != `` {
+		//the shard is served straight from the backend's object store
+		resp.Body.Close()
+		if resp, err = c.followPullRedirect(hdr.Get(`Location`), ctx); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return fmt.Errorf("Bad Status %s(%d): %s", resp.Status, resp.StatusCode, getBodyErr(resp.Body))
+		return statusError(resp)
 	}
 	defer resp.Body.Close()
+	sz, _ := sizeHint(hdr) //the total is zero if the server can't size the shard
+	if err = checkFreeSpace(spath, sz.Uncompressed); err != nil {
+		return err
+	}
 
 	trdr, err := newReadTicker(resp.Body, tickChunkSize)
 	if err != nil {
@@ -434,6 +985,13 @@ func (c *Client) PullShard(sid ShardID, spath string, cancel context.Context) er
 	if err != nil {
 		return err
 	}
+	if pf != nil {
+		var done int64
+		upkr.SetProgress(func(n int64) {
+			done += n
+			pf(done, sz.Uncompressed)
+		})
+	}
 	reqRespChan := make(chan error, 1)
 	go c.asyncUnpackShard(spath, upkr, reqRespChan)
 
@@ -455,6 +1013,7 @@ tickLoop:
 			tmr.Reset(tickTimeout) //and continue
 		case _ = <-tmr.C:
 			err = errors.New("download timeout")
+			c.log.error("shard pull stalled, aborting", log.KV("indexer", sid.Indexer), log.KV("well", sid.Well), log.KV("shard", sid.Shard), log.KV("timeout", tickTimeout))
 			//cancel both contexts
 			cf()
 			upkr.Cancel()
@@ -473,6 +1032,74 @@ tickLoop:
 	return err
 }
 
+// checkFreeSpace fails if the filesystem spath will be created on lacks room for a
+// pull of the given uncompressed size plus a margin, an unknown size is not checked
+func checkFreeSpace(spath string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	//the shard directory may not exist yet, check the nearest directory that does
+	dir := filepath.Clean(spath)
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	avail, err := freeSpace(dir)
+	if err != nil {
+		if err == ErrNoFreeSpaceCheck {
+			return nil
+		}
+		return err
+	}
+	need := uint64(size) + uint64(size)/pullSpaceMargin + pullSpaceReserve
+	if avail < need {
+		return fmt.Errorf("%w: %s needs %d bytes but only %d are available", ErrInsufficientSpace, dir, need, avail)
+	}
+	return nil
+}
+
+// sizeHint extracts the size hints a server sends with a shard pull
+func sizeHint(h http.Header) (sz util.ShardSize, ok bool) {
+	var err error
+	if sz.Uncompressed, err = strconv.ParseInt(h.Get(webserver.ShardUncompressedSizeHeader), 10, 64); err != nil {
+		return
+	} else if sz.Packed, err = strconv.ParseInt(h.Get(webserver.ShardPackedSizeHeader), 10, 64); err != nil {
+		sz.Packed = 0 //the estimate is optional
+	}
+	ok = true
+	return
+}
+
+// dirSize returns the total size of the regular files under a directory, skipping
+// any files named in ignore at the top of the directory
+func dirSize(p string, ignore ...string) (sz int64, err error) {
+	p = filepath.Clean(p)
+	err = filepath.Walk(p, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if fi.Mode().IsRegular() && !ignored(p, fp, ignore) {
+			sz += fi.Size()
+		}
+		return nil
+	})
+	return
+}
+
+func ignored(base, fp string, ignore []string) bool {
+	for _, n := range ignore {
+		if fp == filepath.Join(base, n) {
+			return true
+		}
+	}
+	return false
+}
+
 type unpackHandler struct {
 	base string
 }
@@ -490,21 +1117,23 @@ func (uh unpackHandler) HandleTagUpdate([]tags.TagPair) error {
 }
 
 func (uh unpackHandler) HandleFile(p string, rdr io.Reader) error {
-	if p = filepath.Clean(p); p == `` || p == `.` {
-		return errors.New("Invalid filename")
+	//the path comes from the server, make sure it stays inside the shard directory
+	p, err := safepath.Sanitize(p)
+	if err != nil {
+		return err
 	}
 	//check if we need to make a directory
-	if d, _ := filepath.Split(p); d != `` {
+	if d := filepath.Dir(p); d != `.` {
 		if err := os.MkdirAll(filepath.Join(uh.base, d), 0770); err != nil {
 			return err
 		}
 	}
-	fout, err := os.OpenFile(filepath.Clean(filepath.Join(uh.base, p)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	fout, err := os.OpenFile(filepath.Join(uh.base, p), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
 	if err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(fout, rdr); err != nil {
+	if _, err := shardpacker.Copy(fout, rdr); err != nil {
 		fout.Close()
 		return err
 	}
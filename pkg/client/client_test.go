@@ -9,28 +9,40 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gravwell/cloudarchive/pkg/auth"
 	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/memstore"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
 	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
 	"github.com/gravwell/cloudarchive/pkg/webserver"
 	"goftp.io/server"
 	"goftp.io/server/core"
@@ -232,20 +244,27 @@ func TestMain(m *testing.M) {
 }
 
 func launchWebserver() error {
-	var err error
-	lgr := gravlog.New(discarder{})
+	return launchWebserverDuplicates(webserver.DuplicateVersion)
+}
 
+func launchWebserverDuplicates(policy webserver.DuplicatePolicy) error {
 	handler, err := filestore.NewFilestoreHandler(serverDir)
 	if err != nil {
 		return err
 	}
+	return runWebserver(handler, policy)
+}
 
+func runWebserver(handler webserver.ShardHandler, policy webserver.DuplicatePolicy) (err error) {
+	lgr := gravlog.New(discarder{})
 	conf := webserver.WebserverConfig{
 		ListenString: listenAddr,
 		CertFile:     certFile,
 		KeyFile:      keyFile,
 		Logger:       lgr,
 		ShardHandler: handler,
+
+		DuplicatePolicy: policy,
 	}
 	if conf.Auth, err = auth.NewAuthModule(passwordFile); err != nil {
 		return err
@@ -361,6 +380,19 @@ func TestClientShardPush(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	//the server keeps the metadata sent with the shard
+	var md shardpacker.ShardMetadata
+	mdpath := filepath.Join(serverDir, fmt.Sprintf("%d", custNum), idxUUID.String(), `foo`, shardid, shardpacker.Metadata.Filename(shardid))
+	if bts, err := ioutil.ReadFile(mdpath); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(bts, &md); err != nil {
+		t.Fatal(err)
+	} else if md.Shard != shardid || md.Well != `foo` || md.Indexer != idxUUID || md.ClientVersion != defaultUserAgent {
+		t.Fatalf("bad shard metadata %+v", md)
+	} else if s, e, _ := util.ShardNameToDateRange(shardid); !md.Start.Equal(s) || !md.End.Equal(e) {
+		t.Fatalf("bad shard time range %v - %v", md.Start, md.End)
+	}
+
 	if err = ws.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -406,6 +438,63 @@ func TestClientShardPull(t *testing.T) {
 	}
 }
 
+func TestClientMemstore(t *testing.T) {
+	// Start a webserver which keeps everything in memory
+	if err := runWebserver(memstore.NewMemStoreHandler(), webserver.DuplicateVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `769f2`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	tps := []tags.TagPair{
+		tags.TagPair{Name: `testing`, Value: 1},
+	}
+	sdir := filepath.Join(baseDir, `memstore`, shardid)
+	if err = os.MkdirAll(filepath.Dir(sdir), 0700); err != nil {
+		t.Fatal(err)
+	} else if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if indexers, err := cli.ListIndexers(); err != nil {
+		t.Fatal(err)
+	} else if len(indexers) != 1 {
+		t.Fatalf("Invalid number of indexers: got %v expected %v", len(indexers), 1)
+	}
+	if tgs, err := cli.PullTags(idxUUID.String()); err != nil {
+		t.Fatal(err)
+	} else if len(tgs) != 3 {
+		t.Fatalf("Invalid number of tags: got %v expected %v", len(tgs), 3)
+	}
+
+	pdir := filepath.Join(baseDir, `memstore`, `pull`, shardid)
+	if err = cli.PullShard(sid, pdir, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateShardExists(pdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func validateShardExists(shardDir, shardID string) (err error) {
 	// Now look to see if it showed up
 	if !fileExists(shardDir) {
@@ -553,12 +642,32 @@ func TestClientGetTimeframe(t *testing.T) {
 		t.Fatalf("Expected 2 shards, got %d", len(shards))
 	}
 
+	// and page through them one at a time
+	var paged []string
+	for lo := (webserver.ListOptions{Limit: 1}); ; {
+		lp, err := cli.GetWellShardsInTimeframePage(idxUUID.String(), "foo", tf, lo)
+		if err != nil {
+			t.Fatal(err)
+		} else if lp.Total != 2 || len(lp.Items) != 1 {
+			t.Fatalf("bad page %+v", lp)
+		}
+		paged = append(paged, lp.Items...)
+		if !lp.More {
+			break
+		}
+		lo.Offset += len(lp.Items)
+	}
+	sort.Strings(shards)
+	if !reflect.DeepEqual(paged, shards) {
+		t.Fatalf("paged shards %v != %v", paged, shards)
+	}
+
 	if err = ws.Close(); err != nil {
 		t.Fatal(err)
 	}
 }
 
-func TestClientPullTags(t *testing.T) {
+func TestClientGetWellTags(t *testing.T) {
 	// Start a webserver
 	if err := launchWebserver(); err != nil {
 		t.Fatal(err)
@@ -576,19 +685,23 @@ func TestClientPullTags(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tagset, err := cli.PullTags(idxUUID.String())
+	tgs, err := cli.GetWellTags(idxUUID.String(), "foo")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(tagset) != 3 {
-		t.Fatalf("Invalid tagset, expected 3 tags got: %+v\n", tagset)
+	if len(tgs) != 1 || tgs[0] != `testing` {
+		t.Fatalf("Invalid well tags: %v", tgs)
+	}
+	if _, err = cli.GetWellTags(idxUUID.String(), "nope"); err == nil {
+		t.Fatal("Failed to catch missing well")
 	}
+
 	if err = ws.Close(); err != nil {
 		t.Fatal(err)
 	}
 }
 
-func TestClientSyncTags(t *testing.T) {
+func TestClientGetShardInfo(t *testing.T) {
 	// Start a webserver
 	if err := launchWebserver(); err != nil {
 		t.Fatal(err)
@@ -606,39 +719,1763 @@ func TestClientSyncTags(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Pull the tags
-	tagset, err := cli.PullTags(idxUUID.String())
+	shardid := `769f2`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	si, err := cli.GetShardInfo(sid)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(tagset) != 3 {
-		t.Fatalf("Invalid tagset, expected 3 tags got: %+v\n", tagset)
+	remote := map[string]util.ShardFile{}
+	for _, f := range si.Files {
+		remote[f.Name] = f
 	}
-
-	// Now add a new tag
-	tagset = append(tagset, tags.TagPair{Name: "xyzzy", Value: entry.EntryTag(100)})
-	if newset, err := cli.SyncTags(idxUUID.String(), tagset); err != nil {
+	local, err := util.ShardFiles(filepath.Join(baseDir, shardid))
+	if err != nil {
 		t.Fatal(err)
-	} else {
-		if len(newset) != 4 {
-			t.Fatalf("Expected 4 tags in new tag set, got %v", len(newset))
-		}
-		var ok bool
-		for _, t := range newset {
-			if t.Name == "xyzzy" {
-				ok = true
-				break
-			}
+	}
+	for _, lf := range local {
+		if rf, ok := remote[lf.Name]; !ok {
+			t.Fatalf("%s missing from server: %+v", lf.Name, si)
+		} else if rf != lf {
+			t.Fatalf("%s mismatch: %+v != %+v", lf.Name, rf, lf)
 		}
-		if !ok {
-			t.Fatalf("Did not find newly-added tag in tag set %v", newset)
+	}
+	// the server recorded who pushed the shard and kept the metadata it was sent with
+	if p := si.Provenance; p == nil {
+		t.Fatal("no provenance recorded")
+	} else if p.CID != custNum || p.IdxUUID != idxUUID || p.RemoteAddr != `127.0.0.1` || p.UserAgent != defaultUserAgent || p.Uploaded.IsZero() {
+		t.Fatalf("bad provenance %+v", p)
+	} else if si.Metadata == nil || si.Metadata.Shard != shardid {
+		t.Fatalf("bad metadata %+v", si.Metadata)
+	}
+
+	// a shard which does not exist is reported as not found
+	sid.Shard = `769f0`
+	var se *StatusError
+	if _, err = cli.GetShardInfo(sid); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("bad error on missing shard: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientStatShard(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect to it
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log in
+	err = cli.Login(fmt.Sprintf("%d", custNum), custPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   `769f2`,
+	}
+	si, err := cli.GetShardInfo(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, found, err := cli.StatShard(sid)
+	if err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Fatal("stored shard not found")
+	} else if st.Checksum != si.Checksum() {
+		t.Fatalf("bad checksum %q != %q", st.Checksum, si.Checksum())
+	} else if st.Size.Uncompressed <= 0 {
+		t.Fatalf("bad size %+v", st.Size)
+	}
+
+	sid.Shard = `769f0`
+	if _, found, err = cli.StatShard(sid); err != nil || found {
+		t.Fatalf("missing shard reported found %v: %v", found, err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect to it, capabilities are available before logging in
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := cli.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.APIVersions) != 2 || cp.APIVersions[1] != webserver.APIv2 {
+		t.Fatalf("bad API versions %v", cp.APIVersions)
+	} else if !cp.Delete || !cp.ShardInfo {
+		t.Fatalf("filestore features not advertised %+v", cp)
+	} else if cp.DuplicatePolicy != webserver.DuplicateVersion || cp.ReadOnly {
+		t.Fatalf("bad server configuration advertised %+v", cp)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientAdmin(t *testing.T) {
+	const adminNum, adminPass = 1338, `adminpass`
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(adminNum, adminPass, 8); err != nil {
+		t.Fatal(err)
+	} else if err = am.SetRole(adminNum, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(adminNum)
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ordinary customers may not manage users
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+	var se *StatusError
+	if _, err = cli.AdminListUsers(); !errors.As(err, &se) || se.Code != http.StatusForbidden {
+		t.Fatalf("customer listed users: %v", err)
+	}
+
+	adm, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = adm.Login(fmt.Sprintf("%d", adminNum), adminPass); err != nil {
+		t.Fatal(err)
+	}
+	pass, err := adm.AdminAddUser(5000, ``, auth.Metadata{Description: `added over the API`})
+	if err != nil {
+		t.Fatal(err)
+	} else if pass == `` {
+		t.Fatal("no generated password")
+	}
+	if ui, err := adm.AdminGetUser(5000); err != nil {
+		t.Fatal(err)
+	} else if ui.Description != `added over the API` {
+		t.Fatalf("bad user %+v", ui)
+	}
+	if pass, err = adm.AdminResetPassword(5000, `newpass`); err != nil || pass != `` {
+		t.Fatalf("bad reset %q %v", pass, err)
+	}
+	if _, err = am.Authenticate(`5000`, `newpass`); err != nil {
+		t.Fatal(err)
+	}
+	quota, role := uint64(4096), auth.RoleReadOnly
+	if ui, err := adm.AdminUpdateUser(5000, webserver.AdminUserUpdate{Quota: &quota, Role: &role}); err != nil {
+		t.Fatal(err)
+	} else if ui.Quota != quota || ui.Role != role || ui.Description != `added over the API` {
+		t.Fatalf("bad update %+v", ui)
+	}
+	if err = adm.AdminImportUsers([]auth.ImportUser{{ID: 5001, Password: `pass5001`}}); err != nil {
+		t.Fatal(err)
+	} else if _, err = am.Authenticate(`5001`, `pass5001`); err != nil {
+		t.Fatal(err)
+	}
+
+	//a token from an earlier login can be used in place of logging in
+	tok, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tok.LoginToken(`not a token`); err == nil {
+		t.Fatal("bad token accepted")
+	} else if err = tok.LoginToken(adm.sessionData.JWT); err != nil {
+		t.Fatal(err)
+	} else if err = tok.AdminDeleteUser(5001); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = adm.AdminDeleteUser(5000); err != nil {
+		t.Fatal(err)
+	}
+	uis, err := adm.AdminListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ui := range uis {
+		if ui.ID == 5000 || ui.ID == 5001 {
+			t.Fatal("deleted user still listed")
 		}
 	}
+	//the test server does not encrypt shards
+	if _, err = adm.AdminReencrypt(true); !errors.As(err, &se) || se.Code != http.StatusNotImplemented {
+		t.Fatalf("re-encryption without encryption: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientGetWellStats(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pushed shards are in the foo well
+	st, err := cli.GetWellStats(idxUUID.String(), `foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end, _ := util.ShardNameToDateRange(`769f2`)
+	if st.Well != `foo` || st.Shards == 0 || st.Bytes == 0 {
+		t.Fatalf("bad well stats: %+v", st)
+	} else if st.Oldest.After(start) || st.Newest.Before(end) {
+		t.Fatalf("well time span %v - %v does not cover pushed shard", st.Oldest, st.Newest)
+	}
+
+	var se *StatusError
+	if _, err = cli.GetWellStats(idxUUID.String(), `nothere`); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("bad error on missing well: %v", err)
+	}
+
 	if err = ws.Close(); err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestClientVerifyShard(t *testing.T) {
+	const adminNum, adminPass = 1339, `adminpass`
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(adminNum, adminPass, 8); err != nil {
+		t.Fatal(err)
+	} else if err = am.SetRole(adminNum, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(adminNum)
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   `769f2`,
+	}
+	// verifying reads the whole shard, so customers may not start it
+	var se *StatusError
+	if _, err = cli.AdminVerifyShard(custNum, sid); !errors.As(err, &se) || se.Code != http.StatusForbidden {
+		t.Fatalf("customer verified a shard: %v", err)
+	}
+
+	adm, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = adm.Login(fmt.Sprintf("%d", adminNum), adminPass); err != nil {
+		t.Fatal(err)
+	}
+	sv, err := adm.AdminVerifyShard(custNum, sid)
+	if err != nil {
+		t.Fatal(err)
+	} else if !sv.Passed || !sv.Manifest || sv.Shard != sid.Shard || len(sv.Files) == 0 {
+		t.Fatalf("stored shard failed verification: %+v", sv)
+	}
+
+	// a shard which does not exist is reported as not found
+	sid.Shard = `769f0`
+	if _, err = adm.AdminVerifyShard(custNum, sid); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("bad error on missing shard: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPullTags(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect to it
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log in
+	err = cli.Login(fmt.Sprintf("%d", custNum), custPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagset, err := cli.PullTags(idxUUID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagset) != 3 {
+		t.Fatalf("Invalid tagset, expected 3 tags got: %+v\n", tagset)
+	}
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSyncTags(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect to it
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log in
+	err = cli.Login(fmt.Sprintf("%d", custNum), custPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pull the tags
+	tagset, err := cli.PullTags(idxUUID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagset) != 3 {
+		t.Fatalf("Invalid tagset, expected 3 tags got: %+v\n", tagset)
+	}
+
+	// Now add a new tag
+	tagset = append(tagset, tags.TagPair{Name: "xyzzy", Value: entry.EntryTag(100), Description: "adventure logs", Origin: "colossal-cave"})
+	if newset, err := cli.SyncTags(idxUUID.String(), tagset); err != nil {
+		t.Fatal(err)
+	} else {
+		if len(newset) != 4 {
+			t.Fatalf("Expected 4 tags in new tag set, got %v", len(newset))
+		}
+		var ok bool
+		for _, t := range newset {
+			if t.Name == "xyzzy" {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			t.Fatalf("Did not find newly-added tag in tag set %v", newset)
+		}
+	}
+
+	// The tag's description and origin are kept
+	if tagset, err = cli.PullTags(idxUUID.String()); err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range tagset {
+		if tp.Name == "xyzzy" && (tp.Description != "adventure logs" || tp.Origin != "colossal-cave") {
+			t.Fatalf("tag metadata was not stored: %+v", tp)
+		}
+	}
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientBulkTags(t *testing.T) {
+	const bulkNum uint64 = 4141
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(bulkNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(bulkNum)
+	idxA, idxB, forbidden := uuid.New(), uuid.New(), uuid.New()
+	if err = am.SetIndexers(bulkNum, []uuid.UUID{idxA, idxB}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", bulkNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := cli.SyncAllTags(webserver.IndexerTags{
+		idxA: []tags.TagPair{tags.TagPair{Name: `alpha`, Value: 1}},
+		idxB: []tags.TagPair{tags.TagPair{Name: `beta`, Value: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(it) != 2 {
+		t.Fatalf("expected tags for 2 indexers, got %+v", it)
+	}
+	hasTag := func(tps []tags.TagPair, name string) bool {
+		for _, tp := range tps {
+			if tp.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasTag(it[idxA], `alpha`) || hasTag(it[idxA], `beta`) || !hasTag(it[idxB], `beta`) {
+		t.Fatalf("bad merged tags: %+v", it)
+	}
+
+	if it, err = cli.PullAllTags(); err != nil {
+		t.Fatal(err)
+	} else if len(it) != 2 || !hasTag(it[idxA], `alpha`) || !hasTag(it[idxB], `beta`) {
+		t.Fatalf("bad pulled tags: %+v", it)
+	}
+
+	// a single forbidden indexer fails the whole request
+	if _, err = cli.SyncAllTags(webserver.IndexerTags{
+		idxA:      []tags.TagPair{tags.TagPair{Name: `gamma`, Value: 2}},
+		forbidden: []tags.TagPair{tags.TagPair{Name: `gamma`, Value: 2}},
+	}); err == nil {
+		t.Fatal("sync including a forbidden indexer succeeded")
+	}
+	if tps, err := cli.PullTags(idxA.String()); err != nil {
+		t.Fatal(err)
+	} else if hasTag(tps, `gamma`) {
+		t.Fatalf("tags merged despite forbidden indexer: %+v", tps)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientLockedLogin(t *testing.T) {
+	const lockedNum uint64 = 4242
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(lockedNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(lockedNum)
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log in while the account is active
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", lockedNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock the account, the existing session and new logins must both be rejected
+	if err = am.SetDisabled(lockedNum, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.TestLogin(); err == nil {
+		t.Fatal("session for locked account still valid")
+	}
+	if cli, err = NewClient(listenAddr, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", lockedNum), custPass); err != ErrAccountLocked {
+		t.Fatalf("expected %v, got %v", ErrAccountLocked, err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientLoginBackoff(t *testing.T) {
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the first few failures are refused on their merits
+	for i := 0; i < 5; i++ {
+		if err = cli.Login(fmt.Sprintf("%d", custNum), `bad`); err != ErrLoginFail {
+			t.Fatalf("expected %v, got %v", ErrLoginFail, err)
+		}
+	}
+	//after which our address has to wait, even with the right password
+	if err = cli.Login(fmt.Sprintf("%d", custNum), `bad`); err != ErrLoginFail {
+		t.Fatalf("expected %v, got %v", ErrLoginFail, err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); !errors.Is(err, ErrLoginBackoff) {
+		t.Fatalf("expected %v, got %v", ErrLoginBackoff, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPoolOptions(t *testing.T) {
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.SetPoolOptions(PoolOptions{MaxConnsPerHost: -1}); err != ErrInvalidPoolSize {
+		t.Fatalf("expected %v, got %v", ErrInvalidPoolSize, err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+	//swapping the pool keeps the session
+	po := PoolOptions{MaxConnsPerHost: 8, MaxIdleConns: 16, MaxIdleConnsPerHost: 8, IdleConnTimeout: time.Minute}
+	if err = cli.SetPoolOptions(po); err != nil {
+		t.Fatal(err)
+	}
+	if tr := cli.transport; tr.MaxConnsPerHost != 8 || tr.MaxIdleConns != 16 || tr.MaxIdleConnsPerHost != 8 || tr.IdleConnTimeout != time.Minute {
+		t.Fatalf("pool options not applied: %+v", tr)
+	}
+	if err = cli.TestLogin(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTOTPLogin(t *testing.T) {
+	const totpNum uint64 = 4343
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(totpNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(totpNum)
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = am.SetTOTPSecret(totpNum, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	user := fmt.Sprintf("%d", totpNum)
+
+	// a password alone is not enough
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(user, custPass); err != ErrTOTPRequired {
+		t.Fatalf("expected %v, got %v", ErrTOTPRequired, err)
+	}
+	if err = cli.LoginTOTP(user, custPass, `abcdef`); err != ErrTOTPFail {
+		t.Fatalf("expected %v, got %v", ErrTOTPFail, err)
+	}
+
+	// password and code gets us in
+	code, err := auth.GenerateTOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.LoginTOTP(user, custPass, code); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.TestLogin(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientIndexerAllowlist(t *testing.T) {
+	const restrictedNum uint64 = 4444
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(restrictedNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(restrictedNum)
+	if err = am.SetIndexers(restrictedNum, []uuid.UUID{uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", restrictedNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	// The indexer is not in the allowlist, so requests for it must be rejected
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if _, err = cli.SyncTags(idxUUID.String(), tps); err == nil {
+		t.Fatal("request for unauthorized indexer succeeded")
+	}
+
+	// Add the indexer, the change applies to the existing session
+	if err = am.SetIndexers(restrictedNum, []uuid.UUID{idxUUID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.SyncTags(idxUUID.String(), tps); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReadOnly(t *testing.T) {
+	const readOnlyNum uint64 = 4545
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(readOnlyNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(readOnlyNum)
+	if err = am.SetRole(readOnlyNum, auth.RoleReadOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", readOnlyNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session itself is valid
+	if err = cli.TestLogin(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modifying tags and pushing shards are not
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if _, err = cli.SyncTags(idxUUID.String(), tps); err == nil {
+		t.Fatal("read-only credentials modified tags")
+	}
+	shardid := `769f3`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err == nil {
+		t.Fatal("read-only credentials pushed a shard")
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientDemoted(t *testing.T) {
+	const demotedNum uint64 = 4747
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(demotedNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(demotedNum)
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", demotedNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	push := func(shardid string) error {
+		sid := ShardID{
+			Indexer: idxUUID,
+			Well:    `foo`,
+			Shard:   shardid,
+		}
+		sdir := filepath.Join(baseDir, shardid)
+		if err := makeShardDir(sdir, shardid); err != nil {
+			t.Fatal(err)
+		}
+		return cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background())
+	}
+	if err = push(`76d00`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Demoting the credentials applies to the session already logged in
+	if err = am.SetRole(demotedNum, auth.RoleReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	var se *StatusError
+	if err = push(`76d01`); !errors.As(err, &se) || se.Code != http.StatusForbidden {
+		t.Fatalf("demoted credentials pushed a shard: %v", err)
+	}
+	if err = cli.TestLogin(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientQuota(t *testing.T) {
+	const quotaNum uint64 = 4646
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(quotaNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(quotaNum)
+	if err = am.SetQuota(quotaNum, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", quotaNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	push := func(shardid string) error {
+		sid := ShardID{
+			Indexer: idxUUID,
+			Well:    `foo`,
+			Shard:   shardid,
+		}
+		sdir := filepath.Join(baseDir, shardid)
+		if err := makeShardDir(sdir, shardid); err != nil {
+			t.Fatal(err)
+		}
+		return cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background())
+	}
+
+	// Nothing is stored yet so the first push is under quota
+	if err = push(`76a00`); err != nil {
+		t.Fatal(err)
+	}
+	// Now the customer is over quota
+	if err = push(`76a01`); err == nil {
+		t.Fatal("push allowed while over quota")
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReserveShard(t *testing.T) {
+	const reserveNum uint64 = 4747
+	am, err := auth.NewAuthModule(passwordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = am.AddUser(reserveNum, custPass, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer am.DeleteUser(reserveNum)
+	if err = am.SetQuota(reserveNum, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a webserver
+	if err := launchWebserverDuplicates(webserver.DuplicateReject); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", reserveNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	// A shard larger than the quota is refused up front
+	var se *StatusError
+	big := ShardID{Indexer: idxUUID, Well: `foo`, Shard: `76b00`}
+	if _, err = cli.ReserveShard(big, 2*1024*1024); !errors.As(err, &se) || se.Code != http.StatusInsufficientStorage {
+		t.Fatalf("oversized reservation not refused: %v", err)
+	}
+	// Reservations count against the quota until they are used
+	if _, err = cli.ReserveShard(big, 768*1024); err != nil {
+		t.Fatal(err)
+	}
+	other := ShardID{Indexer: idxUUID, Well: `foo`, Shard: `76b01`}
+	if _, err = cli.ReserveShard(other, 512*1024); !errors.As(err, &se) || se.Code != http.StatusInsufficientStorage {
+		t.Fatalf("reservation beyond quota not refused: %v", err)
+	}
+	// Reserving the same shard again replaces its reservation
+	if r, err := cli.ReserveShard(big, 1024); err != nil {
+		t.Fatal(err)
+	} else if r.Shard != big.Shard || r.Size != 1024 || !r.Expires.After(time.Now()) {
+		t.Fatalf("bad reservation: %+v", r)
+	}
+
+	// Pushes reserve before sending and the push releases the reservation
+	cli.SetReservePushes(true)
+	sdir := filepath.Join(baseDir, other.Shard)
+	if err = makeShardDir(sdir, other.Shard); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShard(other, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored shards cannot be reserved again when duplicates are rejected
+	var dse *DuplicateShardError
+	if _, err = cli.ReserveShard(other, 1024); !errors.As(err, &dse) || dse.Shard.Shard != other.Shard {
+		t.Fatalf("reservation of a stored shard not reported as a duplicate: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPushShardDelta(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76c10`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	// A shard the server does not hold is pushed whole
+	sd, err := cli.PushShardDelta(sid, sdir, tps, []string{`testing`}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if !sd.Full {
+		t.Fatalf("new shard not pushed whole: %+v", sd)
+	}
+	// Nothing has changed, so nothing is sent
+	if sd, err = cli.PushShardDelta(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	} else if sd.Full || len(sd.Sent) != 0 || len(sd.Removed) != 0 {
+		t.Fatalf("unchanged shard re-sent: %+v", sd)
+	}
+
+	// Rebuild the accelerator as a single file, only it is sent and the old one removed
+	if err = os.RemoveAll(filepath.Join(sdir, shardid+`.accel`)); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(sdir, shardid+`.accel`), []byte(`bloom`), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if sd, err = cli.PushShardDelta(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	} else if sd.Full || len(sd.Sent) != 1 || sd.Sent[0] != shardid+`.accel` || len(sd.Removed) != 2 {
+		t.Fatalf("bad delta: %+v", sd)
+	}
+	si, err := cli.GetShardInfo(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := util.ShardFiles(sdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.Checksum() != (util.ShardInfo{Files: local}).Checksum() {
+		t.Fatalf("stored shard does not match the local copy: %+v", si.Files)
+	}
+	// The shard was updated in place rather than stored again
+	if _, err = cli.GetShardInfo(ShardID{Indexer: idxUUID, Well: `foo`, Shard: shardid + `.1`}); err == nil {
+		t.Fatal("delta push stored a second copy")
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientAccessHistory(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76c20`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	start := time.Now()
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.PullShard(sid, filepath.Join(baseDir, shardid+`.pulled`), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	evs, err := cli.GetAccessHistory(util.AccessQuery{Start: start, Indexer: idxUUID, Shard: shardid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{util.AccessDelete, util.AccessPull, util.AccessPush}
+	if len(evs) != len(want) {
+		t.Fatalf("bad history %+v", evs)
+	}
+	for i, op := range want {
+		if evs[i].Operation != op || evs[i].Error != `` || evs[i].Well != `foo` || evs[i].RemoteAddr == `` {
+			t.Fatalf("bad history event %d %+v", i, evs[i])
+		}
+	}
+	if evs, err = cli.GetAccessHistory(util.AccessQuery{Start: start, Shard: shardid, Operation: util.AccessPull}); err != nil {
+		t.Fatal(err)
+	} else if len(evs) != 1 || evs[0].Operation != util.AccessPull {
+		t.Fatalf("bad filtered history %+v", evs)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSignedURL(t *testing.T) {
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76c30`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var se *StatusError
+	if _, err = cli.SignShardURL(sid, time.Now().Add(-time.Minute)); !errors.As(err, &se) || se.Code != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for a past expiry, got %v", err)
+	}
+	su, err := cli.SignShardURL(sid, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	} else if d := time.Until(su.Expires); d <= 0 || d > time.Hour {
+		t.Fatalf("bad expiry %v", su.Expires)
+	}
+
+	//redeem it with a client that never logged in
+	anon, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdir := filepath.Join(baseDir, shardid+`.signed`)
+	if err = anon.PullSignedShard(su.Path, sid, pdir, context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err = validateShardExists(pdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+
+	//a tampered token is refused, and the token cannot stand in for a session
+	bad := su.Path[:len(su.Path)-2] + `xx`
+	if err = anon.PullSignedShard(bad, sid, pdir, context.Background()); !errors.As(err, &se) || se.Code != http.StatusForbidden {
+		t.Fatalf("expected forbidden for a tampered token, got %v", err)
+	}
+	anon.headerMap[authHeaderName] = `Bearer ` + su.Path[strings.LastIndex(su.Path, `/`)+1:]
+	if _, err = anon.ListIndexers(); err == nil {
+		t.Fatal("signed URL token was accepted as a session")
+	}
+}
+
+func TestClientDeleteShard(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `769f9`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shard is gone and deleting it again reports not found
+	var se *StatusError
+	if _, err = cli.GetShardInfo(sid); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("shard still present after delete: %v", err)
+	}
+	if err = cli.DeleteShard(sid); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("bad error deleting missing shard: %v", err)
+	}
+
+	// relative path elements never remove anything outside the shard
+	sid.Shard = `..`
+	cli.DeleteShard(sid)
+	sid.Shard = `769f2`
+	if _, err = cli.GetShardInfo(sid); err != nil {
+		t.Fatalf("well damaged by relative delete: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTrash(t *testing.T) {
+	// Start a webserver which keeps deleted shards
+	handler, err := filestore.NewFilestoreHandler(serverDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetTrashRetention(time.Hour)
+	if err = runWebserver(handler, webserver.DuplicateVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76a02`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+	var se *StatusError
+	if _, err = cli.GetShardInfo(sid); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("shard still present after delete: %v", err)
+	}
+
+	ents, err := cli.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, te := range ents {
+		if te.IdxUUID == idxUUID && te.Well == sid.Well && te.Shard == shardid {
+			id = te.ID
+		}
+	}
+	if id == `` {
+		t.Fatalf("deleted shard not in trash: %+v", ents)
+	}
+
+	// restoring a shard which has been pushed again is refused
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.RestoreShard(id); !errors.As(err, &se) || se.Code != http.StatusConflict {
+		t.Fatalf("bad error restoring over a stored shard: %v", err)
+	}
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	te, err := cli.RestoreShard(id)
+	if err != nil {
+		t.Fatal(err)
+	} else if te.Shard != shardid {
+		t.Fatalf("restored the wrong shard: %+v", te)
+	}
+	if _, err = cli.GetShardInfo(sid); err != nil {
+		t.Fatalf("shard missing after restore: %v", err)
+	}
+	if _, err = cli.RestoreShard(id); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("bad error restoring twice: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// redirectingHandler hands out the URL of an object server for every shard pull
+type redirectingHandler struct {
+	webserver.ShardHandler
+	url string
+}
+
+func (rh *redirectingHandler) RedirectPull(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (string, error) {
+	if rh.url == `` {
+		return ``, webserver.ErrNoRedirect
+	}
+	return rh.url + `/` + shard, nil
+}
+
+func TestClientPullRedirect(t *testing.T) {
+	fs, err := filestore.NewFilestoreHandler(serverDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &redirectingHandler{ShardHandler: fs}
+
+	//stands in for an object store, serving packed shards to unauthenticated requests
+	var objPulls, authed int32
+	obj := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&objPulls, 1)
+		if req.Header.Get(`Authorization`) != `` {
+			atomic.AddInt32(&authed, 1)
+		}
+		if err := fs.PackShard(req.Context(), custNum, idxUUID, `foo`, filepath.Base(req.URL.Path), res); err != nil {
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer obj.Close()
+
+	if err = runWebserver(handler, webserver.DuplicateVersion); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76c40`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	//without a URL the server streams the shard itself
+	pdir := filepath.Join(baseDir, shardid+`.streamed`)
+	if err = cli.PullShard(sid, pdir, context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err = validateShardExists(pdir, shardid); err != nil {
+		t.Fatal(err)
+	} else if atomic.LoadInt32(&objPulls) != 0 {
+		t.Fatal("pull was redirected")
+	}
+
+	handler.url = obj.URL
+	pdir = filepath.Join(baseDir, shardid+`.redirected`)
+	if err = cli.PullShard(sid, pdir, context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err = validateShardExists(pdir, shardid); err != nil {
+		t.Fatal(err)
+	} else if n := atomic.LoadInt32(&objPulls); n != 1 {
+		t.Fatalf("pull was not redirected, %d object pulls", n)
+	} else if atomic.LoadInt32(&authed) != 0 {
+		t.Fatal("session token was sent to the object store")
+	}
+
+	//a missing object is reported like any failed pull
+	sid.Shard = `76c41`
+	var se *StatusError
+	if err = cli.PullShard(sid, filepath.Join(baseDir, `76c41`), context.Background()); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestClientLegalHold(t *testing.T) {
+	// Start a webserver with the customer under legal hold
+	handler, err := filestore.NewFilestoreHandler(serverDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetLegalHolds(util.LegalHolds{custNum: {All: true}})
+	if err = runWebserver(handler, webserver.DuplicateVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76a03`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	// new shards are stored, and pushing an identical copy again is redundant rather than an error
+	for i := 0; i < 2; i++ {
+		if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var se *StatusError
+	if err = cli.DeleteShard(sid); !errors.As(err, &se) || se.Code != http.StatusLocked {
+		t.Fatalf("bad error deleting held shard: %v", err)
+	}
+	if _, err = cli.GetShardInfo(ShardID{Indexer: idxUUID, Well: `foo`, Shard: shardid + `.1`}); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("held shard gained a duplicate copy: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientDuplicatePush(t *testing.T) {
+	// Start a webserver which rejects duplicate pushes
+	if err := launchWebserverDuplicates(webserver.DuplicateReject); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76b00`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// pushing the same shard again is refused, but the checksums match so it is not an error
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); err != nil {
+		t.Fatalf("redundant push failed: %v", err)
+	}
+
+	// a different copy of the shard is reported
+	if err = ioutil.WriteFile(filepath.Join(sdir, shardid+`.store`), []byte(`other store stuff`), 0660); err != nil {
+		t.Fatal(err)
+	}
+	var dse *DuplicateShardError
+	if err = cli.PushShard(sid, sdir, tps, []string{`testing`}, context.Background()); !errors.As(err, &dse) {
+		t.Fatalf("conflicting push not reported: %v", err)
+	} else if dse.Checksum == dse.Local || dse.Shard.Shard != shardid {
+		t.Fatalf("bad duplicate error %+v", dse)
+	}
+
+	// no suffixed copies were stored
+	wellDir := filepath.Join(serverDir, fmt.Sprintf("%d", custNum), idxUUID.String(), `foo`)
+	if _, err = os.Stat(filepath.Join(wellDir, shardid+`.1`)); !os.IsNotExist(err) {
+		t.Fatalf("duplicate copy stored: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPushChecksum(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `76c00`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	pkr := shardpacker.NewPacker(shardid)
+	go func() {
+		if err := util.AddShardFilesToPacker(sdir, shardid, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	packed, err := ioutil.ReadAll(pkr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stream which does not match the checksum trailer is refused and not stored
+	trailer := http.Header{webserver.ShardChecksumHeader: []string{strings.Repeat(`0`, 64)}}
+	resp, err := cli.methodRequestURLWithTrailer(http.MethodPost, sid.PushShardUrl(custNum), cntType, io.MultiReader(bytes.NewReader(packed)), trailer, context.Background()) //unknown length, so the trailer is sent
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("corrupt push answered with %s", resp.Status)
+	}
+	var se *StatusError
+	if _, err = cli.GetShardInfo(sid); !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("corrupt push stored: %v", err)
+	}
+
+	// a trailer which never arrives leaves the push unverified rather than failing it
+	trailer = http.Header{webserver.ShardChecksumHeader: nil}
+	resp, err = cli.methodRequestURLWithTrailer(http.MethodPost, sid.PushShardUrl(custNum), cntType, io.MultiReader(bytes.NewReader(packed)), trailer, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(webserver.ShardVerifiedHeader) != `false` {
+		t.Fatalf("unverified push answered with %s, verified %q", resp.Status, resp.Header.Get(webserver.ShardVerifiedHeader))
+	}
+	// the stored copy can be checked afterwards instead
+	if err = cli.verifyStoredShard(sid, sdir); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client sends the correct checksum
+	cli.SetVerifyPushes(true)
+	if err = cli.PushShard(sid, sdir, nil, nil, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.GetShardInfo(sid); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(sdir, shardid+`.store`), []byte(`changed`), 0660); err != nil {
+		t.Fatal(err)
+	} else if err = cli.verifyStoredShard(sid, sdir); !errors.Is(err, ErrPushVerifyFailed) {
+		t.Fatalf("changed shard verified: %v", err)
+	}
+
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	// the destination does not need to exist yet
+	spath := filepath.Join(baseDir, `nonexistent`, `76d00`)
+	if err := checkFreeSpace(spath, 1024); err != nil {
+		t.Fatal(err)
+	} else if err = checkFreeSpace(spath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFreeSpace(spath, 1<<60); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("huge pull allowed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(spath)); !os.IsNotExist(err) {
+		t.Fatalf("destination created: %v", err)
+	}
+}
+
+func TestClientProgress(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+
+	shardid := `769fa`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	var done, total int64
+	pf := func(d, t int64) {
+		done, total = d, t
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShardWithProgress(sid, sdir, tps, []string{`testing`}, context.Background(), pf); err != nil {
+		t.Fatal(err)
+	}
+	if done == 0 || done != total {
+		t.Fatalf("bad push progress: %d/%d", done, total)
+	}
+
+	done, total = 0, 0
+	pdir := filepath.Join(baseDir, shardid+`.pulled`)
+	if err = cli.PullShardWithProgress(sid, pdir, context.Background(), pf); err != nil {
+		t.Fatal(err)
+	}
+	if done == 0 || done != total {
+		t.Fatalf("bad pull progress: %d/%d", done, total)
+	}
+
+	// the packed size estimate covers the whole pull stream
+	resp, err := cli.methodRequestURL(http.MethodGet, sid.PushShardUrl(custNum), ``, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if sz, ok := sizeHint(resp.Header); !ok || sz.Uncompressed != total || sz.Packed < int64(len(packed)) {
+		t.Fatalf("bad size hints %+v for %d packed bytes", sz, len(packed))
+	}
+
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientGetStatus(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+	st, err := cli.GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(st.Transfers) != 0 {
+		t.Fatalf("unexpected transfers: %+v", st.Transfers)
+	}
+
+	shardid := `769fb`
+	sid := ShardID{
+		Indexer: idxUUID,
+		Well:    `foo`,
+		Shard:   shardid,
+	}
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	// hold the push open until the server reports it
+	var seen bool
+	var statusErr error
+	pf := func(done, total int64) {
+		for i := 0; !seen && statusErr == nil && i < 100; i++ {
+			var st webserver.Status
+			if st, statusErr = cli.GetStatus(); statusErr != nil {
+				return
+			}
+			for _, tr := range st.Transfers {
+				if tr.CID == custNum && tr.IdxUUID == idxUUID && tr.Shard == shardid {
+					seen = true
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	tps := []tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}
+	if err = cli.PushShardWithProgress(sid, sdir, tps, []string{`testing`}, context.Background(), pf); err != nil {
+		t.Fatal(err)
+	}
+	if statusErr != nil {
+		t.Fatal(statusErr)
+	} else if !seen {
+		t.Fatal("push not reported in status")
+	}
+	if st, err = cli.GetStatus(); err != nil {
+		t.Fatal(err)
+	} else if len(st.Transfers) != 0 {
+		t.Fatalf("transfers remain after push: %+v", st.Transfers)
+	}
+
+	if err = cli.DeleteShard(sid); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientLogger(t *testing.T) {
+	// Start a webserver
+	if err := launchWebserver(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	var mtx sync.Mutex
+	lf := LogFunc(func(lvl, msg string, args ...interface{}) {
+		mtx.Lock()
+		lines = append(lines, strings.TrimSpace(fmt.Sprintln(append([]interface{}{lvl, msg}, args...)...)))
+		mtx.Unlock()
+	})
+	cli, err := NewClient(listenAddr, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.WithLogger(lf)
+	if err = cli.Login(fmt.Sprintf("%d", custNum), custPass); err != nil {
+		t.Fatal(err)
+	}
+	//the server cleans up the doubled slash with a redirect
+	if err = cli.getStaticURL(`/api//testauth`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.getStaticURL(`/api/nothere`, nil); err == nil {
+		t.Fatal("request for a missing path succeeded")
+	}
+
+	logged := func() []string {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]string(nil), lines...)
+	}
+	for _, want := range []string{LOGIN_URL, `following redirect`, TEST_AUTH_URL, `/api/nothere`, `status 404`} {
+		var found bool
+		for _, ln := range logged() {
+			if strings.Contains(ln, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%q not logged: %q", want, logged())
+		}
+	}
+	for _, ln := range logged() {
+		if strings.Contains(ln, cli.sessionData.JWT) {
+			t.Fatalf("session token logged: %q", ln)
+		}
+	}
+
+	//a nil logger turns logging back off
+	cli.WithLogger(nil)
+	n := len(logged())
+	if err = cli.TestLogin(); err != nil {
+		t.Fatal(err)
+	} else if l := logged(); len(l) != n {
+		t.Fatalf("logged after logger removed: %q", l[n:])
+	}
+
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func makeShardDir(p, id string) error {
 	if err := os.Mkdir(p, 0700); err != nil {
 		return err
@@ -0,0 +1,133 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// ShardDelta describes a delta push, the files sent and the stored files removed.
+// Full is set when the whole shard was pushed instead.
+type ShardDelta struct {
+	Sent    []string
+	Removed []string
+	Full    bool
+}
+
+// PushShardDelta re-pushes a shard the server already holds, such as after its accelerator
+// was rebuilt.  The server's file checksums are fetched and only the files which differ from
+// the local copy are sent, stored data files the local copy no longer has are removed.  A shard
+// the server does not hold, or a server which cannot take deltas, gets a normal push.
+func (c *Client) PushShardDelta(sid ShardID, spath string, tps []tags.TagPair, tgs []string, ctx context.Context) (sd ShardDelta, err error) {
+	return c.PushShardDeltaWithProgress(sid, spath, tps, tgs, ctx, nil)
+}
+
+// PushShardDeltaWithProgress is PushShardDelta, calling pf as the shard files are sent
+func (c *Client) PushShardDeltaWithProgress(sid ShardID, spath string, tps []tags.TagPair, tgs []string, ctx context.Context, pf ProgressFunc) (sd ShardDelta, err error) {
+	var si util.ShardInfo
+	if si, err = c.GetShardInfo(sid); err != nil {
+		if isStatus(err, http.StatusNotFound, http.StatusNotImplemented) {
+			sd.Full = true
+			err = c.PushShardWithProgress(sid, spath, tps, tgs, ctx, pf)
+		}
+		return
+	}
+	if sd.Sent, sd.Removed, err = shardDelta(spath, sid.Shard, si.Files); err != nil {
+		return
+	} else if len(sd.Sent) == 0 && len(sd.Removed) == 0 {
+		return //the stored copy is already up to date
+	}
+	hdr := http.Header{}
+	hdr.Set(webserver.ShardDeltaBaseHeader, si.Checksum())
+	if len(sd.Removed) > 0 {
+		hdr.Set(webserver.ShardDeltaRemoveHeader, strings.Join(sd.Removed, `,`))
+	}
+	err = c.pushShard(sid, spath, sid.PushDeltaUrl(c.custID), hdr, sd.Sent, tps, tgs, pf)
+	if isStatus(err, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented) {
+		//the shard went away, or the server cannot take deltas
+		c.log.info("delta push refused, pushing the whole shard", log.KV("indexer", sid.Indexer), log.KV("well", sid.Well), log.KV("shard", sid.Shard), log.KVErr(err))
+		sd = ShardDelta{Full: true}
+		err = c.PushShardWithProgress(sid, spath, tps, tgs, ctx, pf)
+	}
+	return
+}
+
+// shardDelta compares the local files a push would send with the stored files, returning the
+// local files which are new or changed and the stored data files which are no longer present
+func shardDelta(spath, id string, stored []util.ShardFile) (send, remove []string, err error) {
+	var names []string
+	var files []util.ShardFile
+	if names, err = util.PackedFiles(spath, id); err != nil {
+		return
+	} else if files, err = util.ShardFiles(spath); err != nil {
+		return
+	}
+	sums := make(map[string]string, len(files))
+	for _, sf := range files {
+		sums[sf.Name] = sf.SHA256
+	}
+	have := make(map[string]string, len(stored))
+	for _, sf := range stored {
+		have[sf.Name] = sf.SHA256
+	}
+	local := make(map[string]bool, len(names))
+	for _, name := range names {
+		local[name] = true
+		if sum, ok := have[name]; !ok || sum != sums[name] {
+			send = append(send, name)
+		}
+	}
+	for _, sf := range stored {
+		if local[sf.Name] {
+			continue
+		} else if _, terr := util.PackedFileType(id, sf.Name); terr == nil || shardpacker.IsArtifact(sf.Name) {
+			remove = append(remove, sf.Name)
+		}
+	}
+	return
+}
+
+// packSize returns the bytes a push of the listed files sends, or of the whole shard if files is nil
+func packSize(spath, id string, files []string) (sz int64, err error) {
+	if files == nil {
+		return dirSize(spath, shardpacker.WellTags.Filename(id))
+	}
+	for _, name := range files {
+		var fi os.FileInfo
+		if fi, err = os.Stat(filepath.Join(spath, filepath.FromSlash(name))); err != nil {
+			return
+		}
+		sz += fi.Size()
+	}
+	return
+}
+
+func isStatus(err error, codes ...int) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		for _, code := range codes {
+			if se.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
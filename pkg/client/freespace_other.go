@@ -0,0 +1,17 @@
+//go:build plan9 || solaris
+// +build plan9 solaris
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+// freeSpace is not implemented on this platform, pulls are not checked for space
+func freeSpace(p string) (uint64, error) {
+	return 0, ErrNoFreeSpaceCheck
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !plan9 && !solaris
+// +build !windows,!plan9,!solaris
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the bytes available to this user on the filesystem holding p
+func freeSpace(p string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// freeSpace returns the bytes available to this user on the volume holding p
+func freeSpace(p string) (avail uint64, err error) {
+	var pth *uint16
+	if pth, err = windows.UTF16PtrFromString(p); err != nil {
+		return
+	}
+	err = windows.GetDiskFreeSpaceEx(pth, &avail, nil, nil)
+	return
+}
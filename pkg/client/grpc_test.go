@@ -0,0 +1,226 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/archivepb"
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	gravlog "github.com/gravwell/gravwell/v3/ingest/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	grpcHTTPAddr string = "localhost:12347"
+	grpcAddr     string = "localhost:12348"
+)
+
+func launchWebserverGRPC() error {
+	lgr := gravlog.New(discarder{})
+
+	handler, err := filestore.NewFilestoreHandler(serverDir)
+	if err != nil {
+		return err
+	}
+
+	conf := webserver.WebserverConfig{
+		ListenString:     grpcHTTPAddr,
+		GRPCListenString: grpcAddr,
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		Logger:           lgr,
+		ShardHandler:     handler,
+	}
+	if conf.Auth, err = auth.NewAuthModule(passwordFile); err != nil {
+		return err
+	}
+
+	if ws, err = webserver.NewWebserver(conf); err != nil {
+		return err
+	} else if err = ws.Init(); err != nil {
+		return err
+	}
+	return ws.Run()
+}
+
+func TestGRPCShardPushPull(t *testing.T) {
+	if err := launchWebserverGRPC(); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	conn, err := grpc.Dial(grpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cli := archivepb.NewArchiveClient(conn)
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+
+	// calls without a token are rejected
+	if _, err = cli.ListIndexers(ctx, &archivepb.ListIndexersRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("unauthenticated call was not rejected: %v", err)
+	}
+	if _, err = cli.Login(ctx, &archivepb.LoginRequest{User: fmt.Sprintf("%d", custNum), Pass: `bad`}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("bad password was not rejected: %v", err)
+	}
+	lr, err := cli.Login(ctx, &archivepb.LoginRequest{User: fmt.Sprintf("%d", custNum), Pass: custPass})
+	if err != nil {
+		t.Fatal(err)
+	} else if lr.Jwt == `` {
+		t.Fatal("empty token")
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, `authorization`, `Bearer `+lr.Jwt)
+
+	// push a shard
+	shardid := `769fd`
+	well := `grpc`
+	sdir := filepath.Join(baseDir, shardid)
+	if err = makeShardDir(sdir, shardid); err != nil {
+		t.Fatal(err)
+	}
+	pkr := shardpacker.NewPacker(shardid)
+	go func() {
+		if err := pkr.AddTags([]tags.TagPair{tags.TagPair{Name: `testing`, Value: 1}}); err != nil {
+			pkr.CloseWithError(err)
+		} else if err = util.AddShardFilesToPacker(sdir, shardid, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	push, err := cli.PushShard(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := &archivepb.ShardRequest{Indexer: idxUUID.String(), Well: well, Shard: shardid}
+	buf := make([]byte, 1024)
+	for first := true; ; first = false {
+		n, rerr := pkr.Read(buf)
+		req := &archivepb.PushShardRequest{Data: buf[:n]}
+		if first {
+			req.Shard = ref
+		}
+		if err = push.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			t.Fatal(rerr)
+		}
+	}
+	if _, err = push.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+
+	// listings
+	ilr, err := cli.ListIndexers(ctx, &archivepb.ListIndexersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasString(ilr.Indexers, idxUUID.String()) {
+		t.Fatalf("indexer missing from %v", ilr.Indexers)
+	}
+	wlr, err := cli.ListWells(ctx, &archivepb.ListWellsRequest{Indexer: idxUUID.String()})
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasString(wlr.Wells, well) {
+		t.Fatalf("well missing from %v", wlr.Wells)
+	}
+	s, e, err := util.ShardNameToDateRange(shardid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slr, err := cli.ListShards(ctx, &archivepb.ListShardsRequest{
+		Indexer:   idxUUID.String(),
+		Well:      well,
+		Timeframe: &archivepb.Timeframe{Start: timestamppb.New(s), End: timestamppb.New(e)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasString(slr.Shards, shardid) {
+		t.Fatalf("shard missing from %v", slr.Shards)
+	}
+
+	// pull it back and compare
+	pull, err := cli.PullShard(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packed bytes.Buffer
+	for {
+		chunk, err := pull.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		packed.Write(chunk.Data)
+	}
+	rdir := filepath.Join(baseDir, `grpcpull`)
+	if err = os.MkdirAll(rdir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	upkr, err := shardpacker.NewUnpacker(shardid, &packed)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = upkr.Unpack(unpackHandler{base: rdir}); err != nil {
+		t.Fatal(err)
+	}
+	for _, nm := range []string{shardid + `.index`, shardid + `.store`, shardid + `.verify`, filepath.Join(shardid+`.accel`, `keys`)} {
+		orig, err := ioutil.ReadFile(filepath.Join(sdir, nm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(rdir, nm)); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(orig, got) {
+			t.Fatalf("%s differs after pull", nm)
+		}
+	}
+
+	// bad requests are rejected
+	if _, err = cli.GetWellTimeframe(ctx, &archivepb.WellRequest{Indexer: idxUUID.String(), Well: `nope`}); err == nil {
+		t.Fatal("got timeframe for missing well")
+	}
+	if _, err = cli.ListWells(ctx, &archivepb.ListWellsRequest{Indexer: `bad`}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("bad indexer was not rejected: %v", err)
+	}
+}
+
+func hasString(set []string, v string) bool {
+	for _, s := range set {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package client
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/crewjam/rfc5424"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	LevelInfo  = `INFO`
+	LevelWarn  = `WARN`
+	LevelError = `ERROR`
+)
+
+// Logger receives the client's request, redirect, and stall timeout logs.
+// The gravwell ingest *log.Logger satisfies it directly, other structured
+// loggers such as slog can be adapted with LogFunc.
+type Logger interface {
+	Info(msg string, sds ...rfc5424.SDParam) error
+	Warn(msg string, sds ...rfc5424.SDParam) error
+	Error(msg string, sds ...rfc5424.SDParam) error
+}
+
+// LogFunc adapts a function to the Logger interface, the structured values are handed
+// over as alternating keys and values so a slog.Logger can be wrapped with:
+//
+//	client.LogFunc(func(lvl, msg string, args ...interface{}) { slgr.Info(msg, args...) })
+type LogFunc func(level, msg string, args ...interface{})
+
+func (lf LogFunc) Info(msg string, sds ...rfc5424.SDParam) error {
+	lf(LevelInfo, msg, sdArgs(sds)...)
+	return nil
+}
+
+func (lf LogFunc) Warn(msg string, sds ...rfc5424.SDParam) error {
+	lf(LevelWarn, msg, sdArgs(sds)...)
+	return nil
+}
+
+func (lf LogFunc) Error(msg string, sds ...rfc5424.SDParam) error {
+	lf(LevelError, msg, sdArgs(sds)...)
+	return nil
+}
+
+func sdArgs(sds []rfc5424.SDParam) (args []interface{}) {
+	args = make([]interface{}, 0, 2*len(sds))
+	for _, sd := range sds {
+		args = append(args, sd.Name, sd.Value)
+	}
+	return
+}
+
+// WithLogger sends every request the client makes, every redirect it follows, and every
+// transfer it aborts for stalling to lgr.  Requests are logged with their method, path,
+// status, and duration, headers are never logged so session tokens stay out of the logs.
+// A nil Logger disables logging, which is the default.
+func (c *Client) WithLogger(lgr Logger) *Client {
+	c.log.set(lgr)
+	return c
+}
+
+// clientLog holds the client's logger apart from the client mutex, which is
+// often held while requests are in flight
+type clientLog struct {
+	sync.Mutex
+	lgr Logger
+}
+
+func (cl *clientLog) set(lgr Logger) {
+	cl.Lock()
+	cl.lgr = lgr
+	cl.Unlock()
+}
+
+func (cl *clientLog) get() (lgr Logger) {
+	cl.Lock()
+	lgr = cl.lgr
+	cl.Unlock()
+	return
+}
+
+func (cl *clientLog) info(msg string, sds ...rfc5424.SDParam) {
+	if lgr := cl.get(); lgr != nil {
+		lgr.Info(msg, sds...)
+	}
+}
+
+func (cl *clientLog) warn(msg string, sds ...rfc5424.SDParam) {
+	if lgr := cl.get(); lgr != nil {
+		lgr.Warn(msg, sds...)
+	}
+}
+
+func (cl *clientLog) error(msg string, sds ...rfc5424.SDParam) {
+	if lgr := cl.get(); lgr != nil {
+		lgr.Error(msg, sds...)
+	}
+}
+
+// loggingTransport logs each round trip the http client makes, redirected requests included
+type loggingTransport struct {
+	rt  http.RoundTripper
+	log *clientLog
+}
+
+func (lt *loggingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	lgr := lt.log.get()
+	if lgr == nil {
+		return lt.rt.RoundTrip(req)
+	}
+	ts := time.Now()
+	resp, err = lt.rt.RoundTrip(req)
+	sds := []rfc5424.SDParam{
+		log.KV("method", req.Method),
+		log.KV("path", req.URL.Path),
+		log.KV("duration", time.Since(ts).Round(time.Millisecond)),
+	}
+	if err != nil {
+		lgr.Warn("request failed", append(sds, log.KVErr(err))...)
+	} else if resp.StatusCode >= http.StatusInternalServerError {
+		lgr.Warn("request complete", append(sds, log.KV("status", resp.StatusCode))...)
+	} else {
+		lgr.Info("request complete", append(sds, log.KV("status", resp.StatusCode))...)
+	}
+	return
+}
+
+// checkRedirect applies the redirect policy and logs the redirects that are followed
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) (err error) {
+	if req.Response != nil && req.Response.Header.Get(webserver.PullRedirectHeader) != `` {
+		//pulls follow these themselves, without the session token
+		return http.ErrUseLastResponse
+	}
+	if err = redirectPolicy(req, via); err != nil {
+		c.log.warn("refusing redirect", log.KV("method", req.Method), log.KV("path", req.URL.Path), log.KV("redirects", len(via)), log.KVErr(err))
+	} else {
+		c.log.info("following redirect", log.KV("method", req.Method), log.KV("from", via[len(via)-1].URL.Path), log.KV("path", req.URL.Path))
+	}
+	return
+}
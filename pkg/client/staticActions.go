@@ -18,6 +18,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
 )
 
 const (
@@ -91,7 +93,7 @@ func (c *Client) staticRequest(req *http.Request, obj interface{}, okResponses [
 	}
 	//either its in the list, or the list is empty and StatusOK is implied
 	if !(statOk || (resp.StatusCode == http.StatusOK && len(okResponses) == 0)) {
-		return fmt.Errorf("Bad Status %s(%d): %s", resp.Status, resp.StatusCode, getBodyErr(resp.Body))
+		return statusError(resp)
 	}
 
 	if obj != nil {
@@ -128,7 +130,7 @@ func (c *Client) methodStaticPushRawURL(method, url string, data []byte, recvObj
 		return ErrNotAuthed
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Bad Status %s(%d): %s", resp.Status, resp.StatusCode, getBodyErr(resp.Body))
+		return statusError(resp)
 	}
 
 	if recvObj != nil {
@@ -172,7 +174,7 @@ func (c *Client) methodStaticPushURL(method, url string, sendObj, recvObj interf
 		return ErrNotAuthed
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Bad Status %s(%d): %s", resp.Status, resp.StatusCode, getBodyErr(resp.Body))
+		return statusError(resp)
 	}
 
 	if recvObj != nil {
@@ -200,12 +202,46 @@ func (c *Client) methodRequestURL(method, url, contentType string, body io.Reade
 }
 
 func (c *Client) methodRequestURLWithContext(method, url, contentType string, body io.Reader, ctx context.Context) (resp *http.Response, err error) {
+	return c.methodRequestURLWithTrailer(method, url, contentType, body, nil, ctx)
+}
+
+// methodRequestURLWithTrailer sends trailer after the body, its values may be filled in as the body is read
+func (c *Client) methodRequestURLWithTrailer(method, url, contentType string, body io.Reader, trailer http.Header, ctx context.Context) (resp *http.Response, err error) {
+	return c.methodRequestURLWithHeaders(method, url, contentType, body, nil, trailer, ctx)
+}
+
+// followPullRedirect fetches the presigned object URL a pull was redirected to, the session
+// token and other client headers are not sent to the object store
+func (c *Client) followPullRedirect(loc string, ctx context.Context) (resp *http.Response, err error) {
+	var req *http.Request
+	if loc == `` {
+		err = errors.New("Pull redirect has no location")
+		return
+	} else if req, err = http.NewRequestWithContext(ctx, http.MethodGet, loc, nil); err != nil {
+		return
+	}
+	c.mtx.Lock()
+	req.Header.Set(`User-Agent`, c.headerMap[`User-Agent`])
+	c.mtx.Unlock()
+	c.log.info("following pull redirect", log.KV("host", req.URL.Host))
+	resp, err = c.clnt.Do(req)
+	return
+}
+
+// methodRequestURLWithHeaders is methodRequestURLWithTrailer, also sending the headers in hdr
+func (c *Client) methodRequestURLWithHeaders(method, url, contentType string, body io.Reader, hdr, trailer http.Header, ctx context.Context) (resp *http.Response, err error) {
 	var req *http.Request
 	uri := fmt.Sprintf("%s://%s%s", c.httpScheme, c.server, url)
 	if req, err = http.NewRequest(method, uri, body); err != nil {
 		return
 	}
 	req = req.WithContext(ctx)
+	req.Trailer = trailer
+	for k, vs := range hdr {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
 	for k, v := range c.headerMap {
 		req.Header.Add(k, v)
 	}
@@ -245,6 +281,25 @@ func (c *Client) nolockTestGet(path string) error {
 	return nil
 }
 
+// StatusError is returned when the server responds with an unexpected HTTP status
+type StatusError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("Bad Status %s(%d): %s", se.Status, se.Code, se.Message)
+}
+
+func statusError(resp *http.Response) error {
+	return &StatusError{
+		Code:    resp.StatusCode,
+		Status:  resp.Status,
+		Message: getBodyErr(resp.Body),
+	}
+}
+
 // getBodyErr pulls a possible error message out of the response body
 // and returns it as a string.  We will yank a maximum of 256 bytes
 func getBodyErr(rc io.Reader) string {
@@ -9,23 +9,33 @@
 package client
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
+
+	"github.com/gravwell/cloudarchive/pkg/webserver"
 
 	"github.com/google/uuid"
 )
 
 const (
 	//login field names
-	USER_FIELD string = "User"
-	PASS_FIELD string = "Pass"
+	USER_FIELD      string = "User"
+	PASS_FIELD      string = "Pass"
+	CHALLENGE_FIELD string = "Challenge"
+	CODE_FIELD      string = "Code"
 
 	//path to login url
 	LOGIN_URL      = `/api/login`
+	LOGIN_TOTP_URL = `/api/login/totp`
 	TEST_URL       = `/api/test`
 	TEST_AUTH_URL  = `/api/testauth`
 	PUSH_SHARD_URL = `/api/shard/%v/%v/%v/%v`
+	PUSH_DELTA_URL = `/api/delta/%v/%v/%v/%v`
 )
 
 type ClientSource interface {
@@ -49,6 +59,10 @@ func (sid ShardID) PushShardUrl(custID uint64) string {
 	return fmt.Sprintf(PUSH_SHARD_URL, custID, sid.Indexer, sid.Well, sid.Shard)
 }
 
+func (sid ShardID) PushDeltaUrl(custID uint64) string {
+	return fmt.Sprintf(PUSH_DELTA_URL, custID, sid.Indexer, sid.Well, sid.Shard)
+}
+
 func newReadTicker(rdr io.Reader, maxChunk int) (*readTicker, error) {
 	if maxChunk <= 0 {
 		return nil, errors.New("Invalid chunk size")
@@ -80,3 +94,27 @@ func (rt *readTicker) Read(b []byte) (n int, err error) {
 	}
 	return
 }
+
+// checksumTrailer hashes a push body as it is sent and sets the checksum trailer once it is exhausted
+type checksumTrailer struct {
+	rdr     io.Reader
+	h       hash.Hash
+	trailer http.Header
+}
+
+func newChecksumTrailer(rdr io.Reader, trailer http.Header) *checksumTrailer {
+	return &checksumTrailer{
+		rdr:     rdr,
+		h:       sha256.New(),
+		trailer: trailer,
+	}
+}
+
+func (ct *checksumTrailer) Read(b []byte) (n int, err error) {
+	n, err = ct.rdr.Read(b)
+	ct.h.Write(b[:n])
+	if err == io.EOF {
+		ct.trailer.Set(webserver.ShardChecksumHeader, hex.EncodeToString(ct.h.Sum(nil)))
+	}
+	return
+}
@@ -22,12 +22,64 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	defaultWellName = `default`
+
+	// Template variables which are always available to a stub, they may be overridden
+	VarIndexerUUID = `INDEXER_UUID` // UUID of the indexer directory
+	VarCustomerID  = `CUSTOMER_ID`  // customer number, taken from the parent of the indexer directory
+	VarWellRoot    = `WELL_ROOT`    // root directory for well locations, defaults to the indexer directory
+)
+
+var (
+	templateVarRe = regexp.MustCompile(`\$\{([A-Za-z0-9_-]+)\}`)
+)
+
+// Well describes a well found in an archive directory or a config file
+type Well struct {
+	Name string
+	Tags []string // empty for the default well
+}
+
 func BuildConfig(stub []byte, baseDir string) (conf []byte, err error) {
+	return BuildConfigWithVars(stub, baseDir, nil)
+}
+
+// BuildConfigWithVars builds a config, substituting ${NAME} placeholders in the stub with values from vars.
+// The INDEXER_UUID, CUSTOMER_ID, and WELL_ROOT variables are populated automatically unless provided,
+// WELL_ROOT also sets the root of the generated well locations.
+// Any placeholder without a value is an error.
+func BuildConfigWithVars(stub []byte, baseDir string, vars map[string]string) (conf []byte, err error) {
 	// Extract the UUID from the basedir, better be the last component
 	indexerUUID, err := uuid.Parse(filepath.Base(baseDir))
 	if err != nil {
 		return
 	}
+	vals := map[string]string{
+		VarWellRoot: baseDir,
+	}
+	if cust := filepath.Base(filepath.Dir(filepath.Clean(baseDir))); isCustomerNumber(cust) {
+		vals[VarCustomerID] = cust
+	}
+	for k, v := range vars {
+		vals[k] = v
+	}
+	var wells []Well
+	if wells, err = ScanWells(baseDir); err != nil {
+		return
+	}
+	return buildConfig(stub, indexerUUID, wells, vals)
+}
+
+// buildConfig expands the stub, sets the indexer UUID, and appends an entry for each well
+func buildConfig(stub []byte, indexerUUID uuid.UUID, wells []Well, vals map[string]string) (conf []byte, err error) {
+	if _, ok := vals[VarIndexerUUID]; !ok {
+		vals[VarIndexerUUID] = indexerUUID.String()
+	}
+	if stub, err = expandVars(stub, vals); err != nil {
+		return
+	}
+	wellRoot := vals[VarWellRoot]
 
 	// Attempt to find and replace the Indexer-UUID field
 	re := regexp.MustCompile(`(Indexer-UUID=).+`)
@@ -38,6 +90,67 @@ func BuildConfig(stub []byte, baseDir string) (conf []byte, err error) {
 	}
 	conf = re.ReplaceAll(stub, []byte(fmt.Sprintf("${1}%v", indexerUUID)))
 
+	for _, well := range wells {
+		// Construct a Well entry based on that, assuming baseDir will map to /opt/gravwell/storage
+		var wellEntry string
+		if well.Name == defaultWellName {
+			wellEntry = "[Default-Well]\n"
+		} else {
+			wellEntry = fmt.Sprintf("[Storage-Well \"%v\"]\n", well.Name)
+		}
+		wellEntry = fmt.Sprintf("%s	Location=%s/%s\n", wellEntry, wellRoot, well.Name)
+		for _, t := range well.Tags {
+			wellEntry = fmt.Sprintf("%s	Tags=%s\n", wellEntry, t)
+		}
+
+		// Append the well to the config
+		conf = bytes.Join([][]byte{conf, []byte(wellEntry)}, []byte{})
+	}
+	return
+}
+
+// expandVars replaces ${NAME} placeholders, returning an error listing any that have no value
+func expandVars(stub []byte, vals map[string]string) ([]byte, error) {
+	var missing []string
+	out := templateVarRe.ReplaceAllFunc(stub, func(m []byte) []byte {
+		name := string(templateVarRe.FindSubmatch(m)[1])
+		if v, ok := vals[name]; ok {
+			return []byte(v)
+		}
+		missing = append(missing, name)
+		return m
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("No value for template variables: %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+func isCustomerNumber(v string) bool {
+	_, err := strconv.ParseUint(v, 10, 64)
+	return err == nil
+}
+
+// ScanWells walks an indexer directory and returns each well containing shards,
+// along with the tags listed in the most recent shard of the well
+func ScanWells(baseDir string) (r []Well, err error) {
+	var scans []wellScan
+	if scans, err = scanWells(baseDir); err != nil {
+		return
+	}
+	for _, ws := range scans {
+		r = append(r, ws.Well)
+	}
+	return
+}
+
+// wellScan is a well found on disk along with the IDs of its shards
+type wellScan struct {
+	Well
+	shards []uint64
+}
+
+func scanWells(baseDir string) (r []wellScan, err error) {
 	// Now, walk the basedir
 	var wells []os.FileInfo
 	wells, err = ioutil.ReadDir(baseDir)
@@ -63,6 +176,7 @@ func BuildConfig(stub []byte, baseDir string) (conf []byte, err error) {
 		// Find the most recent shard
 		var newest uint64
 		var newestName string
+		var ids []uint64
 		for _, shard := range shards {
 			if !shard.IsDir() {
 				continue
@@ -72,6 +186,7 @@ func BuildConfig(stub []byte, baseDir string) (conf []byte, err error) {
 			if err != nil {
 				continue
 			}
+			ids = append(ids, u)
 			if u > newest {
 				newest = u
 				newestName = shard.Name()
@@ -87,7 +202,7 @@ func BuildConfig(stub []byte, baseDir string) (conf []byte, err error) {
 
 		// Read its 'tags' file (unless default well)
 		var tagList []string
-		if well.Name() != `default` {
+		if well.Name() != defaultWellName {
 			var tagContents []byte
 			tagContents, err = ioutil.ReadFile(filepath.Join(newestPath, "tags"))
 			if err != nil {
@@ -106,21 +221,33 @@ func BuildConfig(stub []byte, baseDir string) (conf []byte, err error) {
 				}
 			}
 		}
-
-		// Construct a Well entry based on that, assuming baseDir will map to /opt/gravwell/storage
-		var wellEntry string
-		if well.Name() == `default` {
-			wellEntry = "[Default-Well]\n"
-		} else {
-			wellEntry = fmt.Sprintf("[Storage-Well \"%v\"]\n", well.Name())
-		}
-		wellEntry = fmt.Sprintf("%s	Location=%s/%s\n", wellEntry, baseDir, well.Name())
-		for _, t := range tagList {
-			wellEntry = fmt.Sprintf("%s	Tags=%s\n", wellEntry, t)
-		}
-
-		// Append the well to the config
-		conf = bytes.Join([][]byte{conf, []byte(wellEntry)}, []byte{})
+		r = append(r, wellScan{
+			Well:   Well{Name: well.Name(), Tags: tagList},
+			shards: ids,
+		})
 	}
 	return
 }
+
+// ArchiveStanza builds a Cloud-Archive block so a restored indexer can re-attach to the archive server.
+// The customer number is taken from the parent of the indexer directory when it is numeric, otherwise
+// a placeholder is emitted.  The shared secret is always a placeholder to be filled in by hand.
+func ArchiveStanza(server, baseDir string) []byte {
+	cust := filepath.Base(filepath.Dir(filepath.Clean(baseDir)))
+	if !isCustomerNumber(cust) {
+		cust = `<customer number>`
+	}
+	return archiveStanza(server, cust)
+}
+
+// CustomerArchiveStanza builds a Cloud-Archive block for a known customer number
+func CustomerArchiveStanza(server string, cid uint64) []byte {
+	return archiveStanza(server, strconv.FormatUint(cid, 10))
+}
+
+func archiveStanza(server, cust string) []byte {
+	return []byte(fmt.Sprintf("[Cloud-Archive]\n"+
+		"\t# Customer number %s, the shared secret is that customer's archive password\n"+
+		"\tArchive-Server=%s\n"+
+		"\tArchive-Shared-Secret=\"<archive password>\"\n", cust, server))
+}
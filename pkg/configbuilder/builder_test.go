@@ -14,10 +14,12 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gravwell/cloudarchive/pkg/util"
 )
 
 const (
@@ -104,3 +106,213 @@ func TestBuildConfig(t *testing.T) {
 		fmt.Println(string(conf))
 	}
 }
+
+func TestCheckDrift(t *testing.T) {
+	baseDir, uuidDir, err := makeTestDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	// A freshly generated config must not drift
+	conf, err := BuildConfig(stubConfig, uuidDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := CheckDrift(conf, uuidDir); err != nil {
+		t.Fatal(err)
+	} else if !d.Empty() {
+		t.Fatalf("unexpected drift in generated config:\n%s", d)
+	}
+
+	// Drop a well and a tag from the config, add a bogus well and tag
+	wls, err := ParseWells(conf)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(wls) != len(wells) {
+		t.Fatalf("bad well count: %d != %d", len(wls), len(wells))
+	}
+	edited := []byte(`[Default-Well]
+	Location=/opt/gravwell/storage/default
+[Storage-Well "raw"]
+	Location=/opt/gravwell/storage/raw
+	Tags=pcap
+	Tags=netflow
+[Storage-Well "syslog"]
+	Location=/opt/gravwell/storage/syslog
+	Tags=syslog
+#[Storage-Well "bro"]
+[Storage-Well "windows"]
+	Location=/opt/gravwell/storage/windows
+	Tags=winlog
+`)
+	d, err := CheckDrift(edited, uuidDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.MissingWells) != 1 || d.MissingWells[0] != `bro` {
+		t.Fatalf("bad missing wells: %v", d.MissingWells)
+	}
+	if len(d.ExtraWells) != 1 || d.ExtraWells[0] != `windows` {
+		t.Fatalf("bad extra wells: %v", d.ExtraWells)
+	}
+	if len(d.MissingTags) != 1 || len(d.MissingTags[`raw`]) != 1 || d.MissingTags[`raw`][0] != `video` {
+		t.Fatalf("bad missing tags: %v", d.MissingTags)
+	}
+	if len(d.ExtraTags) != 1 || len(d.ExtraTags[`raw`]) != 1 || d.ExtraTags[`raw`][0] != `netflow` {
+		t.Fatalf("bad extra tags: %v", d.ExtraTags)
+	}
+}
+
+func TestArchiveStanza(t *testing.T) {
+	id := uuid.New().String()
+	s := string(ArchiveStanza(`archive.example.org:8886`, filepath.Join(`/opt/cloudarchive/storage/12345`, id)))
+	if !strings.HasPrefix(s, "[Cloud-Archive]\n") {
+		t.Fatalf("missing stanza header:\n%s", s)
+	} else if !strings.Contains(s, "Archive-Server=archive.example.org:8886\n") {
+		t.Fatalf("missing server:\n%s", s)
+	} else if !strings.Contains(s, "Customer number 12345,") {
+		t.Fatalf("missing customer number:\n%s", s)
+	}
+	s = string(ArchiveStanza(`archive.example.org`, filepath.Join(`/tmp/restore`, id)))
+	if !strings.Contains(s, "Customer number <customer number>,") {
+		t.Fatalf("missing customer placeholder:\n%s", s)
+	}
+}
+
+func TestBuildConfigWithVars(t *testing.T) {
+	baseDir, uuidDir, err := makeTestDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	stub := []byte(`[Global]
+Indexer-UUID=00000000-0000-0000-0000-000000000000
+Ingest-Port=${INGEST_PORT}
+Web-Port=${WEB_PORT}
+License-Location=/opt/gravwell/etc/${INDEXER_UUID}.lic
+`)
+	vars := map[string]string{
+		`INGEST_PORT`: `4023`,
+		`WEB_PORT`:    `443`,
+		VarWellRoot:   `/opt/gravwell/storage`,
+	}
+	conf, err := BuildConfigWithVars(stub, uuidDir, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(conf)
+	id := filepath.Base(uuidDir)
+	for _, want := range []string{
+		"Ingest-Port=4023\n",
+		"Web-Port=443\n",
+		"Indexer-UUID=" + id + "\n",
+		"License-Location=/opt/gravwell/etc/" + id + ".lic\n",
+		"Location=/opt/gravwell/storage/syslog\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("missing %q in config:\n%s", want, s)
+		}
+	}
+
+	// An unresolved placeholder is an error
+	delete(vars, `WEB_PORT`)
+	if _, err = BuildConfigWithVars(stub, uuidDir, vars); err == nil || !strings.Contains(err.Error(), `WEB_PORT`) {
+		t.Fatalf("failed to catch missing variable: %v", err)
+	}
+}
+
+func TestBuildInventory(t *testing.T) {
+	baseDir, uuidDir, err := makeTestDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	inv, err := BuildInventory(uuidDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Indexer.String() != filepath.Base(uuidDir) {
+		t.Fatalf("bad indexer: %v", inv.Indexer)
+	} else if inv.Customer != `` {
+		t.Fatalf("unexpected customer: %v", inv.Customer)
+	} else if len(inv.Wells) != len(wells) {
+		t.Fatalf("bad well count: %d != %d", len(inv.Wells), len(wells))
+	}
+	start, _, err := util.ShardNameToDateRange(fmt.Sprintf("%x", baseShard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wi := range inv.Wells {
+		shards, err := ioutil.ReadDir(filepath.Join(uuidDir, wi.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wi.Shards != len(shards) {
+			t.Fatalf("well %s bad shard count: %d != %d", wi.Name, wi.Shards, len(shards))
+		}
+		_, end, err := util.ShardNameToDateRange(fmt.Sprintf("%x", baseShard+len(shards)-1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !wi.Start.Equal(start) || !wi.End.Equal(end) {
+			t.Fatalf("well %s bad range: %v - %v", wi.Name, wi.Start, wi.End)
+		}
+		for _, w := range wells {
+			if w.name == wi.Name && len(w.tags) != len(wi.Tags) {
+				t.Fatalf("well %s bad tags: %v != %v", wi.Name, wi.Tags, w.tags)
+			}
+		}
+	}
+}
+
+type fakeWellSource map[string][]string
+
+func (f fakeWellSource) ListIndexerWells(guid string) (r []string, err error) {
+	for k := range f {
+		r = append(r, k)
+	}
+	return
+}
+
+func (f fakeWellSource) GetWellTags(guid, well string) ([]string, error) {
+	tgs, ok := f[well]
+	if !ok {
+		return nil, fmt.Errorf("no well %s", well)
+	}
+	return tgs, nil
+}
+
+func TestBuildRemoteConfig(t *testing.T) {
+	ws := fakeWellSource{}
+	for _, w := range wells {
+		ws[w.name] = w.tags
+	}
+	id := uuid.New()
+	conf, err := BuildRemoteConfig(stubConfig, ws, 1234, id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseWells(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var disk []Well
+	for _, w := range wells {
+		disk = append(disk, Well{Name: w.name, Tags: w.tags})
+	}
+	if d := compareWells(disk, cfg); !d.Empty() {
+		t.Fatalf("remote config does not match wells:\n%s", d)
+	}
+	s := string(conf)
+	for _, want := range []string{
+		"Indexer-UUID=" + id.String() + "\n",
+		"Location=" + DefaultRemoteWellRoot + "/syslog\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("missing %q in config:\n%s", want, s)
+		}
+	}
+}
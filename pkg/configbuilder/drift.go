@@ -0,0 +1,166 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package configbuilder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	defaultWellRe = regexp.MustCompile(`(?i)^\[\s*default-well\s*\]$`)
+	storageWellRe = regexp.MustCompile(`(?i)^\[\s*storage-well\s+"([^"]+)"\s*\]$`)
+	tagsRe        = regexp.MustCompile(`(?i)^tags\s*=\s*(.*)$`)
+)
+
+// Drift describes the differences between the wells on disk and those in a config
+type Drift struct {
+	MissingWells []string            // wells on disk that are not in the config
+	ExtraWells   []string            // wells in the config that are not on disk
+	MissingTags  map[string][]string // per well, tags on disk that are not in the config
+	ExtraTags    map[string][]string // per well, tags in the config that are not on disk
+}
+
+// Empty returns true if the config matches the archive directory
+func (d Drift) Empty() bool {
+	return len(d.MissingWells) == 0 && len(d.ExtraWells) == 0 && len(d.MissingTags) == 0 && len(d.ExtraTags) == 0
+}
+
+// String renders a human readable report of the drift
+func (d Drift) String() string {
+	if d.Empty() {
+		return "No drift detected\n"
+	}
+	var sb strings.Builder
+	for _, w := range d.MissingWells {
+		fmt.Fprintf(&sb, "well %s is on disk but missing from the config\n", w)
+	}
+	for _, w := range d.ExtraWells {
+		fmt.Fprintf(&sb, "well %s is in the config but not on disk\n", w)
+	}
+	for _, w := range sortedKeys(d.MissingTags) {
+		fmt.Fprintf(&sb, "well %s: tags on disk but missing from the config: %s\n", w, strings.Join(d.MissingTags[w], ", "))
+	}
+	for _, w := range sortedKeys(d.ExtraTags) {
+		fmt.Fprintf(&sb, "well %s: tags in the config but not on disk: %s\n", w, strings.Join(d.ExtraTags[w], ", "))
+	}
+	return sb.String()
+}
+
+// ParseWells extracts the default and storage wells, along with their tags, from a gravwell.conf
+func ParseWells(conf []byte) (wells []Well, err error) {
+	var cur *Well
+	scn := bufio.NewScanner(bytes.NewReader(conf))
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == `` || strings.HasPrefix(line, `#`) || strings.HasPrefix(line, `;`) {
+			continue
+		}
+		if strings.HasPrefix(line, `[`) {
+			cur = nil
+			if defaultWellRe.MatchString(line) {
+				wells = append(wells, Well{Name: defaultWellName})
+				cur = &wells[len(wells)-1]
+			} else if m := storageWellRe.FindStringSubmatch(line); m != nil {
+				wells = append(wells, Well{Name: m[1]})
+				cur = &wells[len(wells)-1]
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if m := tagsRe.FindStringSubmatch(line); m != nil {
+			for _, t := range strings.Split(strings.Trim(m[1], `"`), `,`) {
+				if t = strings.TrimSpace(t); t != `` {
+					cur.Tags = append(cur.Tags, t)
+				}
+			}
+		}
+	}
+	err = scn.Err()
+	return
+}
+
+// CheckDrift compares the wells in an existing config with those in an indexer archive directory
+func CheckDrift(conf []byte, baseDir string) (d Drift, err error) {
+	var disk, cfg []Well
+	if disk, err = ScanWells(baseDir); err != nil {
+		return
+	} else if cfg, err = ParseWells(conf); err != nil {
+		return
+	}
+	d = compareWells(disk, cfg)
+	return
+}
+
+func compareWells(disk, cfg []Well) (d Drift) {
+	d.MissingTags = map[string][]string{}
+	d.ExtraTags = map[string][]string{}
+	cfgWells := make(map[string]Well, len(cfg))
+	for _, w := range cfg {
+		cfgWells[w.Name] = w
+	}
+	diskWells := make(map[string]Well, len(disk))
+	for _, w := range disk {
+		diskWells[w.Name] = w
+		cw, ok := cfgWells[w.Name]
+		if !ok {
+			d.MissingWells = append(d.MissingWells, w.Name)
+			continue
+		}
+		if missing := tagDifference(w.Tags, cw.Tags); len(missing) > 0 {
+			d.MissingTags[w.Name] = missing
+		}
+		if extra := tagDifference(cw.Tags, w.Tags); len(extra) > 0 {
+			d.ExtraTags[w.Name] = extra
+		}
+	}
+	for _, w := range cfg {
+		if _, ok := diskWells[w.Name]; !ok {
+			d.ExtraWells = append(d.ExtraWells, w.Name)
+		}
+	}
+	if len(d.MissingTags) == 0 {
+		d.MissingTags = nil
+	}
+	if len(d.ExtraTags) == 0 {
+		d.ExtraTags = nil
+	}
+	sort.Strings(d.MissingWells)
+	sort.Strings(d.ExtraWells)
+	return
+}
+
+// tagDifference returns the tags in a that are not in b
+func tagDifference(a, b []string) (r []string) {
+	set := make(map[string]bool, len(b))
+	for _, t := range b {
+		set[t] = true
+	}
+	for _, t := range a {
+		if !set[t] {
+			r = append(r, t)
+		}
+	}
+	sort.Strings(r)
+	return
+}
+
+func sortedKeys(m map[string][]string) (r []string) {
+	for k := range m {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return
+}
@@ -0,0 +1,71 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package configbuilder
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/cloudarchive/pkg/util"
+)
+
+// Inventory describes the archived structure of a single indexer
+type Inventory struct {
+	Indexer  uuid.UUID
+	Customer string `json:",omitempty"`
+	Wells    []WellInventory
+}
+
+// WellInventory describes a single well within an indexer archive
+type WellInventory struct {
+	Name   string
+	Tags   []string
+	Shards int
+	Start  time.Time // start of the oldest shard
+	End    time.Time // end of the newest shard
+}
+
+// BuildInventory scans an indexer directory and reports each well along with its
+// tags, shard count, and the time range covered by its shards
+func BuildInventory(baseDir string) (inv Inventory, err error) {
+	if inv.Indexer, err = uuid.Parse(filepath.Base(baseDir)); err != nil {
+		return
+	}
+	if cust := filepath.Base(filepath.Dir(filepath.Clean(baseDir))); isCustomerNumber(cust) {
+		inv.Customer = cust
+	}
+	var scans []wellScan
+	if scans, err = scanWells(baseDir); err != nil {
+		return
+	}
+	inv.Wells = make([]WellInventory, 0, len(scans))
+	for _, ws := range scans {
+		wi := WellInventory{
+			Name:   ws.Name,
+			Tags:   ws.Tags,
+			Shards: len(ws.shards),
+		}
+		for _, id := range ws.shards {
+			var s, e time.Time
+			if s, e, err = util.ShardNameToDateRange(fmt.Sprintf("%x", id)); err != nil {
+				return
+			}
+			if wi.Start.IsZero() || s.Before(wi.Start) {
+				wi.Start = s
+			}
+			if e.After(wi.End) {
+				wi.End = e
+			}
+		}
+		inv.Wells = append(inv.Wells, wi)
+	}
+	return
+}
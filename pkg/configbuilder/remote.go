@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package configbuilder
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultRemoteWellRoot is the well location root used for remote configs when WELL_ROOT is not given
+	DefaultRemoteWellRoot = `/opt/gravwell/storage`
+)
+
+// WellSource is the subset of the cloudarchive client used to discover wells on an archive server
+type WellSource interface {
+	ListIndexerWells(guid string) ([]string, error)
+	GetWellTags(guid, well string) ([]string, error)
+}
+
+// RemoteWells queries an archive server for the wells held for an indexer,
+// along with the tags pushed with the most recent shard of each well
+func RemoteWells(ws WellSource, indexerUUID uuid.UUID) (r []Well, err error) {
+	var names []string
+	if names, err = ws.ListIndexerWells(indexerUUID.String()); err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w := Well{Name: name}
+		if name != defaultWellName {
+			if w.Tags, err = ws.GetWellTags(indexerUUID.String(), name); err != nil {
+				return
+			}
+		}
+		r = append(r, w)
+	}
+	return
+}
+
+// BuildRemoteConfig builds a config for an indexer using the wells held on an archive server,
+// no shards need to be present locally.  The CUSTOMER_ID variable is populated from cid when it
+// is non-zero and WELL_ROOT defaults to DefaultRemoteWellRoot.
+func BuildRemoteConfig(stub []byte, ws WellSource, cid uint64, indexerUUID uuid.UUID, vars map[string]string) (conf []byte, err error) {
+	vals := map[string]string{
+		VarWellRoot: DefaultRemoteWellRoot,
+	}
+	if cid != 0 {
+		vals[VarCustomerID] = strconv.FormatUint(cid, 10)
+	}
+	for k, v := range vars {
+		vals[k] = v
+	}
+	var wells []Well
+	if wells, err = RemoteWells(ws, indexerUUID); err != nil {
+		return
+	}
+	return buildConfig(stub, indexerUUID, wells, vals)
+}
@@ -0,0 +1,176 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsKMSTarget      = `TrentService.Decrypt`
+	awsKMSContentType = `application/x-amz-json-1.1`
+	awsDateFormat     = `20060102T150405Z`
+)
+
+var (
+	ErrMissingAWSRegion      = errors.New("Missing AWS region")
+	ErrMissingAWSCredentials = errors.New("Missing AWS access key")
+)
+
+// AWSKMSConfig unwraps keys with AWS KMS.  Each key is generated as a data key, such as with
+// aws kms generate-data-key --key-spec AES_256, and its CiphertextBlob is kept in a file.
+type AWSKMSConfig struct {
+	Region          string // such as us-east-1
+	Endpoint        string // defaults to https://kms.<region>.amazonaws.com
+	KeyID           string // optional, when set KMS refuses keys wrapped by another KMS key
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string       // only for temporary credentials
+	Client          *http.Client // defaults to a client with a 30 second timeout
+}
+
+type awsKMSSource struct {
+	AWSKMSConfig
+}
+
+// NewAWSKMSKeySource returns a KeySource which reads files of wrapped keys and unwraps them
+// with AWS KMS, the name of each key is the path of its file.  The credentials need the
+// kms:Decrypt permission on the KMS key.
+func NewAWSKMSKeySource(cfg AWSKMSConfig) (KeySource, error) {
+	if cfg.Region == `` {
+		return nil, ErrMissingAWSRegion
+	} else if cfg.AccessKeyID == `` || cfg.SecretAccessKey == `` {
+		return nil, ErrMissingAWSCredentials
+	}
+	if cfg.Endpoint == `` {
+		cfg.Endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", cfg.Region)
+	}
+	if u, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, err
+	} else if u.Scheme != `http` && u.Scheme != `https` {
+		return nil, fmt.Errorf("AWS KMS endpoint %q is not an http or https URL", cfg.Endpoint)
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultKMSTimeout}
+	}
+	return &awsKMSSource{AWSKMSConfig: cfg}, nil
+}
+
+// Keys unwraps every key in the file at the named path, oldest first
+func (as *awsKMSSource) Keys(ctx context.Context, name string) ([][]byte, error) {
+	return wrappedKeys(ctx, as, name)
+}
+
+type awsDecryptRequest struct {
+	CiphertextBlob []byte
+	KeyId          string `json:",omitempty"`
+}
+
+type awsDecryptResponse struct {
+	Plaintext []byte
+}
+
+func (as *awsKMSSource) unwrap(ctx context.Context, wrapped []byte) (key []byte, err error) {
+	var req *http.Request
+	var body []byte
+	if req, body, err = postJSON(ctx, as.Endpoint, awsDecryptRequest{CiphertextBlob: wrapped, KeyId: as.KeyID}); err != nil {
+		return
+	}
+	req.Header.Set(`Content-Type`, awsKMSContentType)
+	req.Header.Set(`X-Amz-Target`, awsKMSTarget)
+	if as.SessionToken != `` {
+		req.Header.Set(`X-Amz-Security-Token`, as.SessionToken)
+	}
+	signV4(req, body, as.AccessKeyID, as.SecretAccessKey, as.Region, `kms`, time.Now())
+	var resp awsDecryptResponse
+	if err = doJSON(as.Client, req, `AWS KMS`, &resp); err == nil {
+		key = resp.Plaintext
+	}
+	return
+}
+
+// signV4 signs a request with AWS signature version 4, every header already set on the
+// request is signed along with the host
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	stamp := t.Format(awsDateFormat)
+	date := stamp[:8]
+	req.Header.Set(`X-Amz-Date`, stamp)
+
+	hdrs := map[string]string{`host`: req.URL.Host}
+	for k, v := range req.Header {
+		hdrs[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, `,`))
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHdrs strings.Builder
+	for _, k := range names {
+		canonHdrs.WriteString(k + `:` + hdrs[k] + "\n")
+	}
+	signed := strings.Join(names, `;`)
+
+	pth := req.URL.EscapedPath()
+	if pth == `` {
+		pth = `/`
+	}
+	payload := sha256.Sum256(body)
+	canon := strings.Join([]string{
+		req.Method,
+		pth,
+		canonicalQuery(req.URL.Query()),
+		canonHdrs.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	canonSum := sha256.Sum256([]byte(canon))
+	scope := date + `/` + region + `/` + service + `/aws4_request`
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonSum[:])
+
+	key := hmacSHA256([]byte(`AWS4`+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, `aws4_request`)
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set(`Authorization`, fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signed, sig))
+}
+
+func canonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vs := range q {
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k)+`=`+awsEscape(v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, `&`)
+}
+
+// awsEscape escapes a query component as AWS expects, spaces as %20 and ~ left alone
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), `+`, `%20`)
+}
+
+func hmacSHA256(key []byte, v string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(v))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,468 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package cryptstore wraps a storage backend so that everything it stores is encrypted.
+// Shard files are encrypted with AES-256-GCM as they are pushed and decrypted as they
+// are pulled, and tag names are encrypted before they are written to tags.dat.  Each
+// customer's data is encrypted with its own key, the backend only ever sees ciphertext.
+//
+// Files stored before encryption was enabled are still read, they are recognized by the
+// lack of an encryption header and handed back as is.
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gravwell/cloudarchive/pkg/backup"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+)
+
+const (
+	labelName   = `name`
+	labelDesc   = `description`
+	labelOrigin = `origin`
+)
+
+var (
+	ErrMissingStore = errors.New("Missing storage backend")
+	ErrUnsized      = errors.New("Shard file size is unknown")
+	ErrNoUsage      = errors.New("Storage backend does not report customer usage")
+	ErrNoDelete     = errors.New("Storage backend does not support deleting shards")
+	ErrNoTagBackup  = errors.New("Storage backend does not back up tags")
+	ErrNoTrash      = errors.New("Storage backend does not keep deleted shards")
+	ErrNoHistory    = errors.New("Storage backend does not keep access history")
+	ErrNoCompaction = errors.New("Storage backend does not support duplicate shard compaction")
+	ErrNoVerify     = errors.New("Storage backend does not support shard verification")
+	ErrUnencrypted  = errors.New("Stored file is not encrypted")
+
+	errStopped = errors.New("Stopped reading the shard")
+)
+
+type cryptstore struct {
+	h       webserver.ShardHandler
+	kr      *Keyring
+	require bool
+
+	reencrypting int32 //set while a Reencrypt pass runs
+}
+
+// NewCryptStoreHandler wraps the backend so that shards and tags are encrypted with the keys in the keyring
+func NewCryptStoreHandler(h webserver.ShardHandler, kr *Keyring) (*cryptstore, error) {
+	if h == nil {
+		return nil, ErrMissingStore
+	} else if kr == nil || kr.Empty() {
+		return nil, ErrNoKeys
+	}
+	return &cryptstore{h: h, kr: kr}, nil
+}
+
+// SetRequireEncryption controls whether files which are not encrypted are refused.  They are
+// served as they are by default so that shards stored before encryption was enabled can still
+// be read, but that also serves a file an attacker with write access to the backend put in
+// place of an encrypted one.  Require encryption once every stored file has been re-encrypted.
+func (cs *cryptstore) SetRequireEncryption(require bool) {
+	cs.require = require
+}
+
+// Close closes the wrapped backend if it can be closed
+func (cs *cryptstore) Close() error {
+	if c, ok := cs.h.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (cs *cryptstore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
+	return cs.h.ListIndexes(ctx, cid)
+}
+
+func (cs *cryptstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
+	return cs.h.ListIndexerWells(ctx, cid, guid)
+}
+
+func (cs *cryptstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (util.Timeframe, error) {
+	return cs.h.GetWellTimeframe(ctx, cid, guid, well)
+}
+
+func (cs *cryptstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	return cs.h.GetShardsInTimeframe(ctx, cid, guid, well, tf)
+}
+
+func (cs *cryptstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	if tgs, err = cs.h.GetTags(ctx, cid, guid); err == nil {
+		tgs, err = cs.decryptTags(cid, tgs)
+	}
+	return
+}
+
+func (cs *cryptstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	if idxTags, err = cs.encryptTags(ctx, cid, guid, idxTags); err != nil {
+		return
+	} else if tgs, err = cs.h.SyncTags(ctx, cid, guid, idxTags); err != nil {
+		return
+	}
+	tgs, err = cs.decryptTags(cid, tgs)
+	return
+}
+
+// UnpackShard encrypts each file in the shard as it is streamed to the backend
+func (cs *cryptstore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) (err error) {
+	var ck *custKey
+	var up *shardpacker.Unpacker
+	if ck, err = cs.kr.current(cid); err != nil {
+		return
+	} else if up, err = shardpacker.NewUnpacker(shard, rdr); err != nil {
+		return
+	}
+	pkr := shardpacker.NewPacker(shard)
+	done := make(chan error, 1)
+	go func() {
+		done <- cs.h.UnpackShard(ctx, cid, guid, well, shard, pkr)
+		//unblock our writes if the backend returned without reading everything
+		pkr.Cancel()
+	}()
+	err = up.Unpack(&encryptHandler{ctx: ctx, cs: cs, cid: cid, guid: guid, ck: ck, pkr: pkr})
+	return finish(err, done, func(err error) error {
+		if err != nil {
+			pkr.CloseWithError(err)
+			return err
+		}
+		return pkr.Close()
+	})
+}
+
+// PackShard decrypts each file in the shard as it is streamed from the backend
+func (cs *cryptstore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		lerr := cs.h.PackShard(ctx, cid, guid, well, shard, pw)
+		pw.CloseWithError(lerr)
+		done <- lerr
+	}()
+	out := shardpacker.NewPacker(shard)
+	copied := make(chan error, 1)
+	go func() {
+		_, lerr := io.Copy(wtr, out)
+		if lerr != nil {
+			out.Cancel()
+		}
+		copied <- lerr
+	}()
+	var up *shardpacker.Unpacker
+	if up, err = shardpacker.NewUnpacker(shard, pr); err == nil {
+		err = up.Unpack(&decryptHandler{cs: cs, cid: cid, pkr: out})
+	}
+	err = finish(err, done, func(err error) error {
+		//unblock the backend if we stopped reading early
+		pr.CloseWithError(errStopped)
+		return err
+	})
+	if err != nil {
+		out.CloseWithError(err)
+		<-copied
+		return
+	}
+	if err = out.Close(); err == nil {
+		err = <-copied
+	} else {
+		<-copied
+	}
+	return
+}
+
+// finish waits for the backend once our side of a transfer is done.  If the backend had
+// already returned its error is what stopped us, otherwise a failure on our side comes first.
+func finish(err error, done chan error, closer func(error) error) error {
+	var ierr error
+	var early bool
+	select {
+	case ierr = <-done:
+		early = true
+	default:
+	}
+	err = closer(err)
+	if !early {
+		ierr = <-done
+	}
+	if ierr != nil && (early || err == nil) {
+		return ierr
+	}
+	return err
+}
+
+// CustomerUsage reports the usage of the backend, which includes the encryption overhead
+func (cs *cryptstore) CustomerUsage(ctx context.Context, cid uint64) (uint64, error) {
+	if ur, ok := cs.h.(webserver.UsageReporter); ok {
+		return ur.CustomerUsage(ctx, cid)
+	}
+	return 0, ErrNoUsage
+}
+
+func (cs *cryptstore) SetLegalHolds(lh util.LegalHolds) {
+	if lhe, ok := cs.h.(webserver.LegalHoldEnforcer); ok {
+		lhe.SetLegalHolds(lh)
+	}
+}
+
+// Preflight checks the backend, a backend which cannot be checked is assumed to be available
+func (cs *cryptstore) Preflight(ctx context.Context) error {
+	if pf, ok := cs.h.(webserver.Preflighter); ok {
+		return pf.Preflight(ctx)
+	}
+	return nil
+}
+
+func (cs *cryptstore) DeleteShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) error {
+	if sd, ok := cs.h.(webserver.ShardDeleter); ok {
+		return sd.DeleteShard(ctx, cid, guid, well, shard)
+	}
+	return ErrNoDelete
+}
+
+// ListTrash lists the backend's deleted shards, trash entries only describe
+// where a shard was stored so they are the same with and without encryption
+func (cs *cryptstore) ListTrash(cid uint64) ([]util.TrashEntry, error) {
+	if st, ok := cs.h.(webserver.ShardTrash); ok {
+		return st.ListTrash(cid)
+	}
+	return nil, ErrNoTrash
+}
+
+// RestoreShard moves a deleted shard back into place, it is restored still encrypted
+func (cs *cryptstore) RestoreShard(cid uint64, id string) (util.TrashEntry, error) {
+	if st, ok := cs.h.(webserver.ShardTrash); ok {
+		return st.RestoreShard(cid, id)
+	}
+	return util.TrashEntry{}, ErrNoTrash
+}
+
+// PurgeTrash purges the backend's trash, a backend without one has nothing to purge
+func (cs *cryptstore) PurgeTrash(ctx context.Context) ([]util.TrashEntry, error) {
+	if st, ok := cs.h.(webserver.ShardTrash); ok {
+		return st.PurgeTrash(ctx)
+	}
+	return nil, nil
+}
+
+// RecordAccess records a shard operation if the backend keeps access history
+func (cs *cryptstore) RecordAccess(ev util.AccessEvent) error {
+	if ah, ok := cs.h.(webserver.AccessHistory); ok {
+		return ah.RecordAccess(ev)
+	}
+	return nil
+}
+
+func (cs *cryptstore) AccessHistory(ctx context.Context, cid uint64, q util.AccessQuery) ([]util.AccessEvent, error) {
+	if ah, ok := cs.h.(webserver.AccessHistory); ok {
+		return ah.AccessHistory(ctx, cid, q)
+	}
+	return nil, ErrNoHistory
+}
+
+func (cs *cryptstore) PurgeHistory(ctx context.Context) (int, error) {
+	if ah, ok := cs.h.(webserver.AccessHistory); ok {
+		return ah.PurgeHistory(ctx)
+	}
+	return 0, nil
+}
+
+// CompactDuplicates compacts the backend's duplicate shards, the kept copy is
+// chosen by which copies are complete so the contents are never looked at
+func (cs *cryptstore) CompactDuplicates(ctx context.Context, dryRun bool) ([]util.CompactionResult, error) {
+	if dc, ok := cs.h.(webserver.DuplicateCompactor); ok {
+		return dc.CompactDuplicates(ctx, dryRun)
+	}
+	return nil, ErrNoCompaction
+}
+
+// VerifyShard has the backend check its stored copy of the shard against the checksums
+// recorded when it was pushed.  Those checksums are of the encrypted files, so the sizes
+// and checksums in the report are of what the backend holds and not of the shard a pull returns.
+func (cs *cryptstore) VerifyShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (util.ShardVerification, error) {
+	if sv, ok := cs.h.(webserver.ShardVerifier); ok {
+		return sv.VerifyShard(ctx, cid, guid, well, shard)
+	}
+	return util.ShardVerification{}, ErrNoVerify
+}
+
+// BackupTags backs up the backend's tags.dat files, the tag names in them stay encrypted
+func (cs *cryptstore) BackupTags(ctx context.Context, dir string) error {
+	if ts, ok := cs.h.(backup.TagSource); ok {
+		return ts.BackupTags(ctx, dir)
+	}
+	return ErrNoTagBackup
+}
+
+// encryptTags encrypts tag names, descriptions, and origins.  Names the backend already
+// holds are sent as stored so that rotating keys, or enabling encryption on an existing
+// store, never gives a tag a second name.
+func (cs *cryptstore) encryptTags(ctx context.Context, cid uint64, guid uuid.UUID, tps []tags.TagPair) (r []tags.TagPair, err error) {
+	var ck *custKey
+	var existing []tags.TagPair
+	if ck, err = cs.kr.current(cid); err != nil {
+		return
+	} else if existing, err = cs.h.GetTags(ctx, cid, guid); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	stored := make(map[string]string, len(existing))
+	for _, tp := range existing {
+		if name, lerr := cs.kr.openString(cid, labelName, tp.Name); lerr == nil {
+			stored[name] = tp.Name
+		}
+	}
+	r = make([]tags.TagPair, 0, len(tps))
+	for _, tp := range tps {
+		if name, ok := stored[tp.Name]; ok {
+			tp.Name = name
+		} else if !static(tp.Name) {
+			tp.Name = ck.sealString(labelName, tp.Name)
+		}
+		if tp.Description != `` {
+			tp.Description = ck.sealString(labelDesc, tp.Description)
+		}
+		if tp.Origin != `` {
+			tp.Origin = ck.sealString(labelOrigin, tp.Origin)
+		}
+		r = append(r, tp)
+	}
+	return
+}
+
+func (cs *cryptstore) decryptTags(cid uint64, tps []tags.TagPair) (r []tags.TagPair, err error) {
+	r = make([]tags.TagPair, 0, len(tps))
+	for _, tp := range tps {
+		if tp.Name, err = cs.kr.openString(cid, labelName, tp.Name); err != nil {
+			return
+		} else if tp.Description, err = cs.kr.openString(cid, labelDesc, tp.Description); err != nil {
+			return
+		} else if tp.Origin, err = cs.kr.openString(cid, labelOrigin, tp.Origin); err != nil {
+			return
+		}
+		r = append(r, tp)
+	}
+	return
+}
+
+// static reports whether the tag is one every tag set starts with, these are left in the clear
+func static(name string) bool {
+	for _, tp := range tags.StaticTagPairs() {
+		if tp.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addFile adds a file to the packer under the path the unpacker handed it to us with
+func addFile(pkr *shardpacker.Packer, pth string, sz int64, rdr io.Reader) error {
+	if ft, err := shardpacker.FilenameToType(filepath.Base(pth)); err == nil {
+		return pkr.AddFile(ft, sz, rdr)
+	} else if shardpacker.IsArtifact(pth) {
+		return pkr.AddArtifact(pth, sz, rdr)
+	} else {
+		return err
+	}
+}
+
+// encryptHandler repacks a pushed shard with every file encrypted
+type encryptHandler struct {
+	ctx  context.Context
+	cs   *cryptstore
+	cid  uint64
+	guid uuid.UUID
+	ck   *custKey
+	pkr  *shardpacker.Packer
+}
+
+func (eh *encryptHandler) HandleFile(string, io.Reader) error {
+	return ErrUnsized
+}
+
+func (eh *encryptHandler) HandleSizedFile(pth string, sz int64, rdr io.Reader) error {
+	er, err := newEncryptReader(eh.ck, pth, sz, rdr)
+	if err != nil {
+		return err
+	}
+	return addFile(eh.pkr, pth, encryptedSize(sz), er)
+}
+
+func (eh *encryptHandler) HandleTagUpdate(tps []tags.TagPair) (err error) {
+	if tps, err = eh.cs.encryptTags(eh.ctx, eh.cid, eh.guid, tps); err == nil {
+		err = eh.pkr.AddTags(tps)
+	}
+	return
+}
+
+func (eh *encryptHandler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	return eh.pkr.AddMetadata(md)
+}
+
+// decryptHandler repacks a pulled shard with every file decrypted
+type decryptHandler struct {
+	cs  *cryptstore
+	cid uint64
+	pkr *shardpacker.Packer
+}
+
+func (dh *decryptHandler) HandleFile(string, io.Reader) error {
+	return ErrUnsized
+}
+
+func (dh *decryptHandler) HandleSizedFile(pth string, sz int64, rdr io.Reader) (err error) {
+	hdr := make([]byte, headerSize)
+	if sz < int64(headerSize) {
+		hdr = hdr[:sz]
+	}
+	if _, err = io.ReadFull(rdr, hdr); err != nil {
+		return
+	}
+	if !encrypted(hdr) {
+		if dh.cs.require {
+			return fmt.Errorf("%s: %w", pth, ErrUnencrypted)
+		}
+		//stored before encryption was enabled
+		return addFile(dh.pkr, pth, sz, io.MultiReader(bytes.NewReader(hdr), rdr))
+	}
+	var psz int64
+	var dr *decryptReader
+	if psz, err = decryptedSize(sz); err != nil {
+		return
+	} else if dr, err = newDecryptReader(dh.cs.kr, dh.cid, pth, sz, hdr, rdr); err != nil {
+		return
+	} else if err = addFile(dh.pkr, pth, psz, dr); err != nil {
+		return
+	}
+	//an empty file is only authenticated once its one chunk is read
+	_, err = io.Copy(ioutil.Discard, dr)
+	return
+}
+
+func (dh *decryptHandler) HandleTagUpdate(tps []tags.TagPair) (err error) {
+	if tps, err = dh.cs.decryptTags(dh.cid, tps); err == nil {
+		err = dh.pkr.AddTags(tps)
+	}
+	return
+}
+
+func (dh *decryptHandler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	return dh.pkr.AddMetadata(md)
+}
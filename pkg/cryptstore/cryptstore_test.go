@@ -0,0 +1,378 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+)
+
+const testShard = `76a00`
+
+var testFiles = map[string][]byte{
+	`.index`:  []byte(`index`),
+	`.verify`: {},
+	`.store`:  bytes.Repeat([]byte(`store data `), 20000),
+}
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newKeyring(t *testing.T, keys ...[]byte) *Keyring {
+	kr := NewKeyring()
+	for _, k := range keys {
+		if err := kr.AddKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kr
+}
+
+func storedFile(dir string, guid uuid.UUID, ext string) string {
+	return filepath.Join(storetest.ShardDir(dir, guid, testShard), testShard+ext)
+}
+
+func TestSizes(t *testing.T) {
+	for _, sz := range []int64{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 1 << 30} {
+		if psz, err := decryptedSize(encryptedSize(sz)); err != nil || psz != sz {
+			t.Fatalf("size %d became %d: %v", sz, psz, err)
+		}
+	}
+	for _, sz := range []int64{0, int64(headerSize), int64(headerSize + chunkSize + overhead + 1)} {
+		if _, err := decryptedSize(sz); err != ErrBadSize {
+			t.Fatalf("accepted encrypted size %d", sz)
+		}
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	fs, dir := storetest.NewFileStore(t)
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	if err = cs.UnpackShard(context.Background(), 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	for ext, v := range testFiles {
+		bts, err := ioutil.ReadFile(storedFile(dir, guid, ext))
+		if err != nil {
+			t.Fatal(err)
+		} else if int64(len(bts)) != encryptedSize(int64(len(v))) || !encrypted(bts[:headerSize]) {
+			t.Fatalf("%s was not encrypted", ext)
+		} else if len(v) > 0 && bytes.Contains(bts, v[:len(v)/4+1]) {
+			t.Fatalf("%s stored in the clear", ext)
+		}
+	}
+	storetest.CheckPull(t, cs, guid, testShard, testFiles)
+
+	//a modified file is refused
+	pth := storedFile(dir, guid, `.store`)
+	bts, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts[len(bts)/2] ^= 0xff
+	if err = ioutil.WriteFile(pth, bts, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storetest.Pull(cs, 1, guid, `default`, testShard); err == nil {
+		t.Fatal("pulled a modified shard")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := filestore.NewFilestoreHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTrashRetention(time.Hour)
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//contents are encrypted so checksums and delta pushes must not be forwarded
+	var h webserver.ShardHandler = cs
+	if _, ok := h.(webserver.ShardInfoReporter); ok {
+		t.Fatal("shard info forwarded")
+	} else if _, ok = h.(webserver.DeltaShardUnpacker); ok {
+		t.Fatal("delta pushes forwarded")
+	}
+	guid := uuid.New()
+	ctx := context.Background()
+	if err = cs.UnpackShard(ctx, 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	if sv, err := cs.VerifyShard(ctx, 1, guid, `default`, testShard); err != nil {
+		t.Fatal(err)
+	} else if !sv.Passed {
+		t.Fatalf("encrypted shard failed verification %+v", sv.Problems)
+	}
+	if _, err = cs.CompactDuplicates(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cs.DeleteShard(ctx, 1, guid, `default`, testShard); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := cs.ListTrash(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 1 || ents[0].Shard != testShard {
+		t.Fatalf("bad trash %+v", ents)
+	}
+	if _, err = cs.RestoreShard(1, ents[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, guid, testShard, testFiles)
+
+	ev := util.AccessEvent{Operation: util.AccessPull, CID: 1, IdxUUID: guid, Well: `default`, Shard: testShard, Time: time.Now().UTC()}
+	if err = cs.RecordAccess(ev); err != nil {
+		t.Fatal(err)
+	}
+	if evs, err := cs.AccessHistory(ctx, 1, util.AccessQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(evs) != 1 {
+		t.Fatalf("bad history %+v", evs)
+	}
+
+	//a backend without the optional features
+	cs.h = noFeatures{fs}
+	if _, err = cs.ListTrash(1); err != ErrNoTrash {
+		t.Fatalf("bad error %v", err)
+	} else if _, err = cs.CompactDuplicates(ctx, true); err != ErrNoCompaction {
+		t.Fatalf("bad error %v", err)
+	} else if _, err = cs.VerifyShard(ctx, 1, guid, `default`, testShard); err != ErrNoVerify {
+		t.Fatalf("bad error %v", err)
+	}
+	//background maintenance has nothing to do rather than failing
+	if _, err = cs.PurgeTrash(ctx); err != nil {
+		t.Fatal(err)
+	} else if err = cs.RecordAccess(ev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// noFeatures hides every optional interface of the backend
+type noFeatures struct {
+	webserver.ShardHandler
+}
+
+func TestKeys(t *testing.T) {
+	fs, _ := storetest.NewFileStore(t)
+	oldKey := newKey(t)
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	if err = cs.UnpackShard(context.Background(), 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+
+	//rotating keys leaves old data readable
+	rotated, err := NewCryptStoreHandler(fs, newKeyring(t, oldKey, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, rotated, guid, testShard, testFiles)
+
+	//without the key it was written with a shard cannot be read
+	other, err := NewCryptStoreHandler(fs, newKeyring(t, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storetest.Pull(other, 1, guid, `default`, testShard); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("pulled with the wrong key: %v", err)
+	}
+
+}
+
+func TestCustomerKey(t *testing.T) {
+	fs, dir := storetest.NewFileStore(t)
+	ctx := context.Background()
+	global, custKey := newKey(t), newKey(t)
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, global))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := uuid.New()
+	if err = cs.UnpackShard(ctx, 1, old, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+
+	//giving the customer its own key leaves the data stored under the global key readable
+	kr := newKeyring(t, global)
+	if err = kr.AddCustomerKey(1, custKey); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err = NewCryptStoreHandler(fs, kr); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, old, testShard, testFiles)
+
+	//new data is encrypted with the customer key
+	id := sha256.Sum256(custKey)
+	fresh := uuid.New()
+	if err = cs.UnpackShard(ctx, 1, fresh, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, fresh, testShard, testFiles)
+	checkKeyID := func(guid uuid.UUID) {
+		t.Helper()
+		for ext := range testFiles {
+			bts, err := ioutil.ReadFile(storedFile(dir, guid, ext))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(bts) < headerSize || !bytes.Equal(bts[len(fileMagic):len(fileMagic)+keyIDSize], id[:keyIDSize]) {
+				t.Fatalf("%s%s is not under the customer key", guid, ext)
+			}
+		}
+	}
+	checkKeyID(fresh)
+
+	//re-encrypting moves the old data to the customer key
+	res, err := cs.Reencrypt(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Checked != 2 || res.Reencrypted != 1 || res.Skipped != 0 {
+		t.Fatalf("bad pass %+v", res)
+	}
+	checkKeyID(old)
+	storetest.CheckPull(t, cs, old, testShard, testFiles)
+
+	//other customers still use the global key
+	if other, err := kr.current(2); err != nil {
+		t.Fatal(err)
+	} else if gid := sha256.Sum256(global); !bytes.Equal(other.id[:], gid[:keyIDSize]) {
+		t.Fatal("customer without its own key is not using the global key")
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	fs, _ := storetest.NewFileStore(t)
+	guid := uuid.New()
+	if err := fs.UnpackShard(context.Background(), 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, guid, testShard, testFiles)
+
+	//once encryption is required plaintext is neither served nor re-encrypted
+	cs.SetRequireEncryption(true)
+	if _, err = storetest.Pull(cs, 1, guid, `default`, testShard); !errors.Is(err, ErrUnencrypted) {
+		t.Fatalf("pulled plaintext while encryption is required: %v", err)
+	}
+	if res, err := cs.Reencrypt(context.Background(), false); err != nil {
+		t.Fatal(err)
+	} else if res.Skipped != 1 || res.Reencrypted != 0 {
+		t.Fatalf("bad pass %+v", res)
+	}
+
+	//re-encrypted shards are served
+	cs.SetRequireEncryption(false)
+	if _, err = cs.Reencrypt(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetRequireEncryption(true)
+	storetest.CheckPull(t, cs, guid, testShard, testFiles)
+}
+
+func TestTags(t *testing.T) {
+	fs, _ := storetest.NewFileStore(t)
+	oldKey := newKey(t)
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	guid := uuid.New()
+	tgs := []tags.TagPair{
+		{Name: `syslog`, Value: 1, Description: `system logs`},
+		{Name: `netflow`, Value: 2},
+	}
+	if _, err = cs.SyncTags(ctx, 1, guid, tgs); err != nil {
+		t.Fatal(err)
+	}
+	checkTags(t, cs, guid, tgs)
+
+	//the backend only sees encrypted names
+	stored, err := fs.GetTags(ctx, 1, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range stored {
+		if tp.Name == `syslog` || tp.Name == `netflow` || tp.Description == `system logs` {
+			t.Fatalf("tag stored in the clear: %+v", tp)
+		} else if !static(tp.Name) && !strings.HasPrefix(tp.Name, tagPrefix) {
+			t.Fatalf("bad stored tag %+v", tp)
+		}
+	}
+
+	//after a rotation known tags keep their names and new ones are added
+	rotated, err := NewCryptStoreHandler(fs, newKeyring(t, oldKey, newKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgs = append(tgs, tags.TagPair{Name: `winlog`, Value: 3})
+	if _, err = rotated.SyncTags(ctx, 1, guid, tgs); err != nil {
+		t.Fatal(err)
+	}
+	checkTags(t, rotated, guid, tgs)
+	if after, err := fs.GetTags(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else if len(after) != len(stored)+1 {
+		t.Fatalf("rotation changed stored tags from %v to %v", stored, after)
+	}
+}
+
+func checkTags(t *testing.T, h webserver.ShardHandler, guid uuid.UUID, want []tags.TagPair) {
+	t.Helper()
+	got, err := h.GetTags(context.Background(), 1, guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range want {
+		var found bool
+		for _, g := range got {
+			if g == w {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("missing tag %+v in %+v", w, got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGCPKMSEndpoint = `https://cloudkms.googleapis.com`
+	defaultGCEMetadata    = `metadata.google.internal`
+	gceMetadataHostEnv    = `GCE_METADATA_HOST`
+	gceTokenPath          = `/computeMetadata/v1/instance/service-accounts/default/token`
+	gceTokenMargin        = time.Minute // tokens are fetched again this long before they expire
+)
+
+var (
+	ErrMissingGCPKey = errors.New("Missing GCP KMS key name")
+
+	gcpKeyRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+)
+
+// GCPKMSConfig unwraps keys with a Google Cloud KMS symmetric key.  Each key is 32 random
+// bytes encrypted with the KMS key, such as with gcloud kms encrypt, and kept in a file
+// base64 encoded.
+type GCPKMSConfig struct {
+	Key       string // projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+	Endpoint  string // defaults to https://cloudkms.googleapis.com
+	TokenFile string // OAuth2 access token, read for each fetch, defaults to the GCE metadata server
+	Client    *http.Client
+}
+
+type gcpKMSSource struct {
+	GCPKMSConfig
+	metadata string //host of the GCE metadata server
+
+	mtx     sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewGCPKMSKeySource returns a KeySource which reads files of wrapped keys and unwraps them
+// with Google Cloud KMS, the name of each key is the path of its file.  Without a TokenFile
+// the access token of the instance's service account is used, which needs the
+// cloudkms.cryptoKeyVersions.useToDecrypt permission on the KMS key.
+func NewGCPKMSKeySource(cfg GCPKMSConfig) (KeySource, error) {
+	if cfg.Key = strings.Trim(cfg.Key, `/`); cfg.Key == `` {
+		return nil, ErrMissingGCPKey
+	} else if !gcpKeyRegex.MatchString(cfg.Key) {
+		return nil, fmt.Errorf("GCP KMS key %q is not of the form projects/*/locations/*/keyRings/*/cryptoKeys/*", cfg.Key)
+	}
+	if cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, `/`); cfg.Endpoint == `` {
+		cfg.Endpoint = defaultGCPKMSEndpoint
+	}
+	if u, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, err
+	} else if u.Scheme != `http` && u.Scheme != `https` {
+		return nil, fmt.Errorf("GCP KMS endpoint %q is not an http or https URL", cfg.Endpoint)
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultKMSTimeout}
+	}
+	gs := &gcpKMSSource{GCPKMSConfig: cfg, metadata: os.Getenv(gceMetadataHostEnv)}
+	if gs.metadata == `` {
+		gs.metadata = defaultGCEMetadata
+	}
+	return gs, nil
+}
+
+// Keys unwraps every key in the file at the named path, oldest first
+func (gs *gcpKMSSource) Keys(ctx context.Context, name string) ([][]byte, error) {
+	return wrappedKeys(ctx, gs, name)
+}
+
+type gcpDecryptRequest struct {
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type gcpDecryptResponse struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+func (gs *gcpKMSSource) unwrap(ctx context.Context, wrapped []byte) (key []byte, err error) {
+	var tok string
+	var req *http.Request
+	if tok, err = gs.accessToken(ctx); err != nil {
+		return
+	} else if req, _, err = postJSON(ctx, gs.Endpoint+`/v1/`+gs.Key+`:decrypt`, gcpDecryptRequest{Ciphertext: wrapped}); err != nil {
+		return
+	}
+	req.Header.Set(`Authorization`, `Bearer `+tok)
+	var resp gcpDecryptResponse
+	if err = doJSON(gs.Client, req, `GCP KMS`, &resp); err == nil {
+		key = resp.Plaintext
+	}
+	return
+}
+
+type gceToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// accessToken returns the token from the token file, or one for the instance's service
+// account which is kept until shortly before it expires
+func (gs *gcpKMSSource) accessToken(ctx context.Context) (tok string, err error) {
+	if gs.TokenFile != `` {
+		var bts []byte
+		if bts, err = ioutil.ReadFile(gs.TokenFile); err != nil {
+			return
+		} else if tok = strings.TrimSpace(string(bts)); tok == `` {
+			err = fmt.Errorf("GCP token file %s is empty", gs.TokenFile)
+		}
+		return
+	}
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+	if gs.token != `` && time.Now().Before(gs.expires) {
+		return gs.token, nil
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, `http://`+gs.metadata+gceTokenPath, nil); err != nil {
+		return
+	}
+	req.Header.Set(`Metadata-Flavor`, `Google`)
+	var gt gceToken
+	if err = doJSON(gs.Client, req, `GCE metadata server`, &gt); err != nil {
+		return
+	} else if gt.AccessToken == `` {
+		err = errors.New("GCE metadata server returned an empty token")
+		return
+	}
+	gs.token = gt.AccessToken
+	gs.expires = time.Now().Add(time.Duration(gt.ExpiresIn)*time.Second - gceTokenMargin)
+	tok = gs.token
+	return
+}
@@ -0,0 +1,346 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	KeySize = 32 // AES-256
+
+	keyIDSize = 8
+)
+
+var (
+	ErrBadKey      = errors.New("Encryption keys must be 32 bytes written as 64 hex characters")
+	ErrNoKeys      = errors.New("No encryption key is configured")
+	ErrUnknownKey  = errors.New("Data was encrypted with a key which is not configured")
+	ErrDupKey      = errors.New("Encryption key is listed more than once")
+	ErrBadCustomer = errors.New("Customer keys require a customer number")
+)
+
+type keyID [keyIDSize]byte
+
+// Keyring holds the keys shards are encrypted with.  Each customer's data is encrypted with
+// its own key, either one configured for the customer or one derived from the global key.
+// Keys are never replaced, adding a key rotates to it for new data and older keys are kept
+// to read data written before the rotation.  Keys fetched from a KeySource are fetched
+// again by Refresh, so versions added to the source since are picked up while in use.
+type Keyring struct {
+	mtx      sync.Mutex
+	global   []masterKey
+	customer map[uint64][]masterKey
+	sources  []sourcedKey
+	derived  map[uint64][]*custKey
+}
+
+// sourcedKey is a named key in a KeySource, for a customer or the global key if cid is zero
+type sourcedKey struct {
+	cid  uint64
+	src  KeySource
+	name string
+}
+
+type masterKey struct {
+	id     keyID
+	secret []byte
+}
+
+// custKey is the key for one customer's data along with the keys derived from it
+type custKey struct {
+	id      keyID
+	secret  []byte      // files are encrypted with keys derived from this and a random salt
+	tagAEAD cipher.AEAD // tag names and descriptions
+	ivKey   []byte      // tag values are sealed with a nonce derived from this and the value
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		customer: map[uint64][]masterKey{},
+		derived:  map[uint64][]*custKey{},
+	}
+}
+
+// ParseKey decodes a key written as 64 hex characters, such as the output of openssl rand -hex 32
+func ParseKey(v string) (key []byte, err error) {
+	if key, err = hex.DecodeString(strings.TrimSpace(v)); err != nil || len(key) != KeySize {
+		key, err = nil, ErrBadKey
+	}
+	return
+}
+
+// LoadKeyFile reads a key from a file holding it as 64 hex characters
+func LoadKeyFile(p string) (key []byte, err error) {
+	var bts []byte
+	if bts, err = ioutil.ReadFile(p); err != nil {
+		return
+	} else if key, err = ParseKey(string(bts)); err != nil {
+		err = fmt.Errorf("%s: %w", p, err)
+	}
+	return
+}
+
+func newMasterKey(key []byte) (mk masterKey, err error) {
+	if len(key) != KeySize {
+		err = ErrBadKey
+		return
+	}
+	sum := sha256.Sum256(key)
+	copy(mk.id[:], sum[:])
+	mk.secret = append([]byte(nil), key...)
+	return
+}
+
+func addKey(keys []masterKey, key []byte) ([]masterKey, error) {
+	mk, err := newMasterKey(key)
+	if err != nil {
+		return keys, err
+	}
+	for _, k := range keys {
+		if k.id == mk.id {
+			return keys, ErrDupKey
+		}
+	}
+	return append(keys, mk), nil
+}
+
+// AddKey adds a global key, customers without their own keys have their new data encrypted
+// with a key derived from the last global key added
+func (kr *Keyring) AddKey(key []byte) (err error) {
+	kr.mtx.Lock()
+	defer kr.mtx.Unlock()
+	if kr.global, err = addKey(kr.global, key); err == nil {
+		kr.derived = map[uint64][]*custKey{}
+	}
+	return
+}
+
+// AddCustomerKey adds a key used only for the customer, the last key added for the customer
+// encrypts its new data in place of the global key, which still reads its older data
+func (kr *Keyring) AddCustomerKey(cid uint64, key []byte) (err error) {
+	kr.mtx.Lock()
+	defer kr.mtx.Unlock()
+	if kr.customer[cid], err = addKey(kr.customer[cid], key); err == nil {
+		delete(kr.derived, cid)
+	}
+	return
+}
+
+// AddKeySource adds every version of a named global key held by the source, oldest first
+func (kr *Keyring) AddKeySource(ctx context.Context, src KeySource, name string) error {
+	return kr.addSource(ctx, sourcedKey{src: src, name: name})
+}
+
+// AddCustomerKeySource adds every version of a named key held by the source for the customer, oldest first
+func (kr *Keyring) AddCustomerKeySource(ctx context.Context, cid uint64, src KeySource, name string) error {
+	if cid == 0 {
+		return ErrBadCustomer
+	}
+	return kr.addSource(ctx, sourcedKey{cid: cid, src: src, name: name})
+}
+
+func (kr *Keyring) addSource(ctx context.Context, sk sourcedKey) (err error) {
+	if _, err = kr.fetch(ctx, sk, false); err == nil {
+		kr.mtx.Lock()
+		kr.sources = append(kr.sources, sk)
+		kr.mtx.Unlock()
+	}
+	return
+}
+
+// Refresh fetches the keys added from a KeySource again and adds any new versions,
+// returning how many keys were added.  Keys which are no longer in a source are kept,
+// data encrypted with them may still be stored.
+func (kr *Keyring) Refresh(ctx context.Context) (added int, err error) {
+	kr.mtx.Lock()
+	sources := append([]sourcedKey(nil), kr.sources...)
+	kr.mtx.Unlock()
+	for _, sk := range sources {
+		var n int
+		n, err = kr.fetch(ctx, sk, true)
+		added += n
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// fetch adds the source's keys, a refresh skips the keys which are already held
+func (kr *Keyring) fetch(ctx context.Context, sk sourcedKey, refresh bool) (added int, err error) {
+	var keys [][]byte
+	if keys, err = sk.src.Keys(ctx, sk.name); err != nil {
+		err = fmt.Errorf("key %s: %w", sk.name, err)
+		return
+	} else if len(keys) == 0 {
+		err = fmt.Errorf("key %s: %w", sk.name, ErrNoKeys)
+		return
+	}
+	for _, key := range keys {
+		if sk.cid == 0 {
+			err = kr.AddKey(key)
+		} else {
+			err = kr.AddCustomerKey(sk.cid, key)
+		}
+		if refresh && err == ErrDupKey {
+			err = nil
+			continue
+		} else if err != nil {
+			err = fmt.Errorf("key %s: %w", sk.name, err)
+			return
+		}
+		added++
+	}
+	return
+}
+
+// Empty reports whether the keyring has no keys at all
+func (kr *Keyring) Empty() bool {
+	kr.mtx.Lock()
+	defer kr.mtx.Unlock()
+	return len(kr.global) == 0 && len(kr.customer) == 0
+}
+
+// KeySource fetches encryption keys from outside the config file, such as a secrets manager
+type KeySource interface {
+	// Keys returns every version of the named key which is still available, oldest first
+	Keys(ctx context.Context, name string) ([][]byte, error)
+}
+
+// cachedSource keeps the keys fetched from a KeySource for a while, so that loading the
+// same keys repeatedly does not fetch them each time
+type cachedSource struct {
+	src KeySource
+	ttl time.Duration
+
+	mtx  sync.Mutex
+	ents map[string]cachedKeys
+}
+
+type cachedKeys struct {
+	keys    [][]byte
+	fetched time.Time
+}
+
+// NewCachedKeySource returns a KeySource which serves keys fetched from src for up to ttl
+func NewCachedKeySource(src KeySource, ttl time.Duration) KeySource {
+	return &cachedSource{src: src, ttl: ttl, ents: map[string]cachedKeys{}}
+}
+
+func (cs *cachedSource) Keys(ctx context.Context, name string) (keys [][]byte, err error) {
+	cs.mtx.Lock()
+	ent, ok := cs.ents[name]
+	cs.mtx.Unlock()
+	if ok && time.Since(ent.fetched) < cs.ttl {
+		return ent.keys, nil
+	}
+	if keys, err = cs.src.Keys(ctx, name); err == nil {
+		cs.mtx.Lock()
+		cs.ents[name] = cachedKeys{keys: keys, fetched: time.Now()}
+		cs.mtx.Unlock()
+	}
+	return
+}
+
+// keys returns the customer's keys, oldest first.  The keys derived from the global keys
+// come before the customer's own keys, so that once a customer is given its own key the
+// data it stored under the global key can still be read.
+func (kr *Keyring) keys(cid uint64) (cks []*custKey, err error) {
+	kr.mtx.Lock()
+	defer kr.mtx.Unlock()
+	if cks = kr.derived[cid]; cks != nil {
+		return
+	}
+	if len(kr.global) == 0 && len(kr.customer[cid]) == 0 {
+		err = ErrNoKeys
+		return
+	}
+	var ck *custKey
+	for _, mk := range kr.global {
+		secret := deriveKey(mk.secret, nil, `cloudarchive customer `+strconv.FormatUint(cid, 10))
+		if ck, err = newCustKey(mk.id, secret); err != nil {
+			return
+		}
+		cks = append(cks, ck)
+	}
+	for _, mk := range kr.customer[cid] {
+		if ck, err = newCustKey(mk.id, mk.secret); err != nil {
+			return
+		}
+		cks = append(cks, ck)
+	}
+	kr.derived[cid] = cks
+	return
+}
+
+// current returns the key new data for the customer is encrypted with
+func (kr *Keyring) current(cid uint64) (*custKey, error) {
+	cks, err := kr.keys(cid)
+	if err != nil {
+		return nil, err
+	}
+	return cks[len(cks)-1], nil
+}
+
+// lookup returns the customer's key with the given ID
+func (kr *Keyring) lookup(cid uint64, id keyID) (*custKey, error) {
+	cks, err := kr.keys(cid)
+	if err != nil {
+		return nil, err
+	}
+	for _, ck := range cks {
+		if ck.id == id {
+			return ck, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+func newCustKey(id keyID, secret []byte) (ck *custKey, err error) {
+	ck = &custKey{
+		id:     id,
+		secret: secret,
+		ivKey:  deriveKey(secret, nil, `cloudarchive tag nonce`),
+	}
+	if ck.tagAEAD, err = newAEAD(deriveKey(secret, nil, `cloudarchive tag`)); err != nil {
+		ck = nil
+	}
+	return
+}
+
+func deriveKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err) //only possible if more than 255 blocks are read
+	}
+	return key
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
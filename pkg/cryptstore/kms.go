@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultKMSTimeout = 30 * time.Second
+	maxKMSResponse    = 1024 * 1024
+	maxWrappedKeys    = 1024
+)
+
+var (
+	ErrNoWrappedKeys = errors.New("Wrapped key file holds no keys")
+)
+
+// unwrapper decrypts a key wrapped by a key management service
+type unwrapper interface {
+	unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// wrappedKeys reads a file of keys wrapped by a key management service, one base64 encoded
+// ciphertext per line with the oldest first, and unwraps each of them.  Blank lines and lines
+// starting with # are ignored, so new keys are added by appending a line.
+func wrappedKeys(ctx context.Context, uw unwrapper, p string) (keys [][]byte, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	var lines []string
+	sc := bufio.NewScanner(fin)
+	for sc.Scan() {
+		if ln := strings.TrimSpace(sc.Text()); ln != `` && !strings.HasPrefix(ln, `#`) {
+			lines = append(lines, ln)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return
+	} else if len(lines) == 0 {
+		err = ErrNoWrappedKeys
+		return
+	} else if len(lines) > maxWrappedKeys {
+		err = fmt.Errorf("%s holds more than %d keys", p, maxWrappedKeys)
+		return
+	}
+	for i, ln := range lines {
+		var wrapped, key []byte
+		if wrapped, err = base64.StdEncoding.DecodeString(ln); err != nil {
+			err = fmt.Errorf("%s key %d is not base64: %w", p, i+1, err)
+			return
+		} else if key, err = uw.unwrap(ctx, wrapped); err != nil {
+			err = fmt.Errorf("%s key %d: %w", p, i+1, err)
+			return
+		} else if len(key) != KeySize {
+			err = fmt.Errorf("%s key %d: %w", p, i+1, ErrBadKey)
+			return
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// doJSON sends a request and decodes the JSON response into obj, any status other than
+// 200 is an error which includes the start of the response body
+func doJSON(cli *http.Client, req *http.Request, svc string, obj interface{}) (err error) {
+	var resp *http.Response
+	if resp, err = cli.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	rdr := io.LimitReader(resp.Body, maxKMSResponse)
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rdr, 512))
+		io.Copy(ioutil.Discard, rdr)
+		if msg = bytes.TrimSpace(msg); len(msg) > 0 {
+			return fmt.Errorf("%s answered %s: %s", svc, resp.Status, msg)
+		}
+		return fmt.Errorf("%s answered %s", svc, resp.Status)
+	}
+	return json.NewDecoder(rdr).Decode(obj)
+}
+
+// postJSON builds a POST request with a JSON body
+func postJSON(ctx context.Context, u string, body interface{}) (req *http.Request, bts []byte, err error) {
+	if bts, err = json.Marshal(body); err != nil {
+		return
+	} else if req, err = http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(bts)); err != nil {
+		return
+	}
+	req.Header.Set(`Content-Type`, `application/json`)
+	return
+}
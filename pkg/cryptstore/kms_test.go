@@ -0,0 +1,243 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWrap stands in for a KMS key, wrapping is a reversible transform the fake servers undo
+func fakeWrap(key []byte) []byte {
+	out := append([]byte(`wrapped:`), key...)
+	for i := range out {
+		out[i] ^= 0x5a
+	}
+	return out
+}
+
+func fakeUnwrap(wrapped []byte) ([]byte, bool) {
+	out := append([]byte(nil), wrapped...)
+	for i := range out {
+		out[i] ^= 0x5a
+	}
+	return bytes.TrimPrefix(out, []byte(`wrapped:`)), bytes.HasPrefix(out, []byte(`wrapped:`))
+}
+
+func writeWrappedKeys(t *testing.T, keys ...[]byte) string {
+	lines := []string{`# wrapped archive keys, oldest first`, ``}
+	for _, k := range keys {
+		lines = append(lines, base64.StdEncoding.EncodeToString(fakeWrap(k)))
+	}
+	p := filepath.Join(t.TempDir(), `keys`)
+	if err := os.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSignV4(t *testing.T) {
+	//the example request from the AWS signature version 4 documentation
+	req, err := http.NewRequest(http.MethodGet, `https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded; charset=utf-8`)
+	signV4(req, nil, `AKIDEXAMPLE`, `wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY`, `us-east-1`, `iam`, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := `AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, ` +
+		`SignedHeaders=content-type;host;x-amz-date, ` +
+		`Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7`
+	if got := req.Header.Get(`Authorization`); got != want {
+		t.Fatalf("bad signature\n%s\n%s", got, want)
+	} else if req.Header.Get(`X-Amz-Date`) != `20150830T123600Z` {
+		t.Fatalf("bad date %s", req.Header.Get(`X-Amz-Date`))
+	}
+}
+
+func TestAWSKMSKeys(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get(`X-Amz-Target`) != awsKMSTarget || r.Header.Get(`Content-Type`) != awsKMSContentType ||
+			r.Header.Get(`X-Amz-Security-Token`) != `session` ||
+			!strings.HasPrefix(r.Header.Get(`Authorization`), `AWS4-HMAC-SHA256 Credential=AKID/`) ||
+			!strings.Contains(r.Header.Get(`Authorization`), `/us-east-2/kms/aws4_request`) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var dr awsDecryptRequest
+		if err := json.NewDecoder(r.Body).Decode(&dr); err != nil || dr.KeyId != `alias/archive` {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key, ok := fakeUnwrap(dr.CiphertextBlob)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidCiphertextException"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(awsDecryptResponse{Plaintext: key})
+	}))
+	defer srv.Close()
+
+	if _, err := NewAWSKMSKeySource(AWSKMSConfig{AccessKeyID: `AKID`, SecretAccessKey: `secret`}); err != ErrMissingAWSRegion {
+		t.Fatalf("bad error %v", err)
+	} else if _, err = NewAWSKMSKeySource(AWSKMSConfig{Region: `us-east-2`}); err != ErrMissingAWSCredentials {
+		t.Fatalf("bad error %v", err)
+	}
+	src, err := NewAWSKMSKeySource(AWSKMSConfig{
+		Region:          `us-east-2`,
+		Endpoint:        srv.URL,
+		KeyID:           `alias/archive`,
+		AccessKeyID:     `AKID`,
+		SecretAccessKey: `secret`,
+		SessionToken:    `session`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, k2 := newKey(t), newKey(t)
+	p := writeWrappedKeys(t, k1, k2)
+	kr := NewKeyring()
+	if err = kr.AddKeySource(context.Background(), src, p); err != nil {
+		t.Fatal(err)
+	} else if requests != 2 {
+		t.Fatalf("%d requests for two keys", requests)
+	}
+	if ck, err := kr.current(1); err != nil {
+		t.Fatal(err)
+	} else if want, _ := newMasterKey(k2); ck.id != want.id {
+		t.Fatal("newest wrapped key is not current")
+	}
+
+	//KMS errors are reported
+	bad := filepath.Join(t.TempDir(), `bad`)
+	if err = os.WriteFile(bad, []byte(base64.StdEncoding.EncodeToString([]byte(`garbage`))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.Keys(context.Background(), bad); err == nil || !strings.Contains(err.Error(), `InvalidCiphertextException`) {
+		t.Fatalf("bad error %v", err)
+	}
+}
+
+func TestGCPKMSKeys(t *testing.T) {
+	const key = `projects/p/locations/global/keyRings/archive/cryptoKeys/shards`
+	var mtx sync.Mutex
+	var tokens int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch r.URL.Path {
+		case gceTokenPath:
+			if r.Header.Get(`Metadata-Flavor`) != `Google` {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			tokens++
+			json.NewEncoder(w).Encode(gceToken{AccessToken: `ya29.token`, ExpiresIn: 3600})
+		case `/v1/` + key + `:decrypt`:
+			if r.Header.Get(`Authorization`) != `Bearer ya29.token` {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var dr gcpDecryptRequest
+			if err := json.NewDecoder(r.Body).Decode(&dr); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			k, ok := fakeUnwrap(dr.Ciphertext)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(gcpDecryptResponse{Plaintext: k})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := NewGCPKMSKeySource(GCPKMSConfig{}); err != ErrMissingGCPKey {
+		t.Fatalf("bad error %v", err)
+	} else if _, err = NewGCPKMSKeySource(GCPKMSConfig{Key: `projects/p/keyRings/r`}); err == nil {
+		t.Fatal("accepted a bad key name")
+	}
+	src, err := NewGCPKMSKeySource(GCPKMSConfig{Key: key, Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.(*gcpKMSSource).metadata = strings.TrimPrefix(srv.URL, `http://`)
+
+	k1, k2 := newKey(t), newKey(t)
+	p := writeWrappedKeys(t, k1)
+	keys, err := src.Keys(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 1 || !bytes.Equal(keys[0], k1) {
+		t.Fatal("bad keys")
+	}
+	//appending a key rotates to it, and the service account token is reused
+	p = writeWrappedKeys(t, k1, k2)
+	if keys, err = src.Keys(context.Background(), p); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 2 || !bytes.Equal(keys[1], k2) {
+		t.Fatal("bad keys after rotation")
+	} else if tokens != 1 {
+		t.Fatalf("fetched %d tokens", tokens)
+	}
+
+	//a token file is used instead of the metadata server
+	tf := filepath.Join(t.TempDir(), `token`)
+	if err = os.WriteFile(tf, []byte("ya29.token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if src, err = NewGCPKMSKeySource(GCPKMSConfig{Key: key, Endpoint: srv.URL, TokenFile: tf}); err != nil {
+		t.Fatal(err)
+	} else if _, err = src.Keys(context.Background(), p); err != nil {
+		t.Fatal(err)
+	} else if tokens != 1 {
+		t.Fatal("fetched a token with a token file")
+	}
+}
+
+func TestWrappedKeys(t *testing.T) {
+	uw := unwrapFunc(func(w []byte) ([]byte, error) {
+		if k, ok := fakeUnwrap(w); ok {
+			return k, nil
+		}
+		return nil, errors.New("bad ciphertext")
+	})
+	if _, err := wrappedKeys(context.Background(), uw, writeWrappedKeys(t)); err != ErrNoWrappedKeys {
+		t.Fatalf("bad error %v", err)
+	}
+	//unwrapped keys must be the right size
+	if _, err := wrappedKeys(context.Background(), uw, writeWrappedKeys(t, []byte(`short`))); !errors.Is(err, ErrBadKey) {
+		t.Fatalf("bad error %v", err)
+	}
+	if _, err := wrappedKeys(context.Background(), uw, filepath.Join(t.TempDir(), `missing`)); !os.IsNotExist(err) {
+		t.Fatalf("bad error %v", err)
+	}
+}
+
+type unwrapFunc func([]byte) ([]byte, error)
+
+func (f unwrapFunc) unwrap(_ context.Context, w []byte) ([]byte, error) {
+	return f(w)
+}
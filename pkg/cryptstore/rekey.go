@@ -0,0 +1,266 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNoReencrypt = webserver.ErrNoReencrypt
+)
+
+// customerLister is implemented by backends which can list every customer with stored data
+type customerLister interface {
+	ListCustomers() ([]uint64, error)
+}
+
+// Reencrypt rewrites every stored file which is not encrypted with its customer's current
+// key, including files stored before encryption was enabled, so that older keys can
+// eventually be removed.  Shards are handled one at a time while the store stays in use.
+// Each shard is read through the backend and only its stale files are re-encrypted, they
+// replace the stored files with an in-place delta which is refused if the shard changed
+// since it was read.  Only ciphertext is ever written out, and a pass which is interrupted
+// leaves every shard readable, so passes can be repeated until one finds nothing to do.
+// Tag names are not re-encrypted, they keep the key they were first stored with.
+// When dryRun is set the stale shards are counted but nothing is rewritten.  Only one pass
+// runs at a time, starting another while one is running fails with util.ErrReencryptRunning.
+func (cs *cryptstore) Reencrypt(ctx context.Context, dryRun bool) (res util.ReencryptResult, err error) {
+	if !atomic.CompareAndSwapInt32(&cs.reencrypting, 0, 1) {
+		err = util.ErrReencryptRunning
+		return
+	}
+	defer atomic.StoreInt32(&cs.reencrypting, 0)
+	cl, ok := cs.h.(customerLister)
+	if !ok {
+		err = ErrNoReencrypt
+		return
+	} else if _, ok = cs.h.(webserver.ShardInfoReporter); !ok {
+		err = ErrNoReencrypt
+		return
+	} else if _, ok = cs.h.(webserver.DeltaShardUnpacker); !ok {
+		err = ErrNoReencrypt
+		return
+	}
+	var cids []uint64
+	if cids, err = cl.ListCustomers(); err != nil {
+		return
+	}
+	for _, cid := range cids {
+		var idxs []string
+		if idxs, err = cs.h.ListIndexes(ctx, cid); err != nil {
+			return
+		}
+		for _, idx := range idxs {
+			guid, perr := uuid.Parse(idx)
+			if perr != nil {
+				continue
+			}
+			if err = cs.reencryptIndexer(ctx, cid, guid, dryRun, &res); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (cs *cryptstore) reencryptIndexer(ctx context.Context, cid uint64, guid uuid.UUID, dryRun bool, res *util.ReencryptResult) (err error) {
+	var wells []string
+	if wells, err = cs.h.ListIndexerWells(ctx, cid, guid); err != nil {
+		return
+	}
+	for _, well := range wells {
+		var tf util.Timeframe
+		var shards []string
+		if tf, err = cs.h.GetWellTimeframe(ctx, cid, guid, well); err != nil {
+			return
+		} else if shards, err = cs.h.GetShardsInTimeframe(ctx, cid, guid, well, tf); err != nil {
+			return
+		}
+		for _, shard := range shards {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			var n int
+			n, err = cs.reencryptShard(ctx, cid, guid, well, shard, dryRun)
+			if skippable(err) {
+				res.Skipped++
+				err = nil
+				continue
+			} else if err != nil {
+				return
+			}
+			res.Checked++
+			if n > 0 {
+				res.Reencrypted++
+				res.Files += n
+			}
+		}
+	}
+	return
+}
+
+// skippable reports whether a shard could not be re-encrypted because it is in use, under
+// a legal hold, was replaced while it was read, or holds files under a key which is not
+// configured, all of which a later pass may find resolved.  Shards with unencrypted files
+// while encryption is required are skipped too, they need to be checked by hand.
+func skippable(err error) bool {
+	return errors.Is(err, util.ErrUploadInProgress) || errors.Is(err, util.ErrLegalHold) ||
+		errors.Is(err, util.ErrShardChanged) || errors.Is(err, ErrUnknownKey) || errors.Is(err, ErrUnencrypted)
+}
+
+// reencryptShard rewrites the shard's stale files, returning how many there were.  The
+// re-encrypted files are spooled to a temporary file as the backend cannot take a delta
+// for a shard while it is reading it.
+func (cs *cryptstore) reencryptShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, dryRun bool) (n int, err error) {
+	var ck *custKey
+	var si util.ShardInfo
+	if ck, err = cs.kr.current(cid); err != nil {
+		return
+	} else if si, err = cs.h.(webserver.ShardInfoReporter).GetShardInfo(ctx, cid, guid, well, shard); err != nil {
+		return
+	}
+	base := si.Checksum()
+
+	var spool *os.File
+	if spool, err = ioutil.TempFile(``, `cloudarchive-reencrypt`); err != nil {
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	pkr := shardpacker.NewPacker(shard)
+	spooled := make(chan error, 1)
+	go func() {
+		_, lerr := io.Copy(spool, pkr)
+		if lerr != nil {
+			pkr.Cancel()
+		}
+		spooled <- lerr
+	}()
+	rh := &reencryptHandler{cs: cs, cid: cid, ck: ck, pkr: pkr, dryRun: dryRun}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		lerr := cs.h.PackShard(ctx, cid, guid, well, shard, pw)
+		pw.CloseWithError(lerr)
+		done <- lerr
+	}()
+	var up *shardpacker.Unpacker
+	if up, err = shardpacker.NewUnpacker(shard, pr); err == nil {
+		err = up.Unpack(rh)
+	}
+	err = finish(err, done, func(err error) error {
+		pr.CloseWithError(errStopped)
+		return err
+	})
+	if err != nil {
+		pkr.CloseWithError(err)
+		<-spooled
+		return
+	}
+	if err = pkr.Close(); err == nil {
+		err = <-spooled
+	} else {
+		<-spooled
+	}
+	if n = rh.stale; err != nil || n == 0 || dryRun {
+		return
+	} else if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	err = cs.h.(webserver.DeltaShardUnpacker).UnpackShardDelta(ctx, cid, guid, well, shard, base, nil, spool)
+	return
+}
+
+// reencryptHandler repacks the files of a stored shard which are not encrypted with the
+// current key, files which already are are read and dropped
+type reencryptHandler struct {
+	cs     *cryptstore
+	cid    uint64
+	ck     *custKey
+	pkr    *shardpacker.Packer
+	dryRun bool
+	stale  int
+}
+
+func (rh *reencryptHandler) HandleFile(string, io.Reader) error {
+	return ErrUnsized
+}
+
+func (rh *reencryptHandler) HandleSizedFile(pth string, sz int64, rdr io.Reader) (err error) {
+	hdr := make([]byte, headerSize)
+	if sz < int64(headerSize) {
+		hdr = hdr[:sz]
+	}
+	if _, err = io.ReadFull(rdr, hdr); err != nil {
+		return
+	}
+	if encrypted(hdr) && bytes.Equal(hdr[len(fileMagic):len(fileMagic)+keyIDSize], rh.ck.id[:]) {
+		_, err = io.Copy(ioutil.Discard, rdr)
+		return
+	}
+	rh.stale++
+	if rh.dryRun {
+		_, err = io.Copy(ioutil.Discard, rdr)
+		return
+	}
+	if !encrypted(hdr) {
+		if rh.cs.require {
+			//not sealing a file which may have replaced an encrypted one
+			return fmt.Errorf("%s: %w", pth, ErrUnencrypted)
+		}
+		//stored before encryption was enabled
+		return rh.encrypt(pth, sz, io.MultiReader(bytes.NewReader(hdr), rdr))
+	}
+	var psz int64
+	var dr *decryptReader
+	if psz, err = decryptedSize(sz); err != nil {
+		return
+	} else if dr, err = newDecryptReader(rh.cs.kr, rh.cid, pth, sz, hdr, rdr); err != nil {
+		return
+	} else if err = rh.encrypt(pth, psz, dr); err != nil {
+		return
+	}
+	//an empty file is only authenticated once its one chunk is read
+	_, err = io.Copy(ioutil.Discard, dr)
+	return
+}
+
+func (rh *reencryptHandler) encrypt(pth string, sz int64, rdr io.Reader) error {
+	er, err := newEncryptReader(rh.ck, pth, sz, rdr)
+	if err != nil {
+		return err
+	}
+	return addFile(rh.pkr, pth, encryptedSize(sz), er)
+}
+
+// tags and metadata are left as they are stored
+
+func (rh *reencryptHandler) HandleTagUpdate([]tags.TagPair) error {
+	return nil
+}
+
+func (rh *reencryptHandler) HandleMetadata(shardpacker.ShardMetadata) error {
+	return nil
+}
@@ -0,0 +1,91 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+
+	"github.com/google/uuid"
+)
+
+func TestReencrypt(t *testing.T) {
+	fs, dir := storetest.NewFileStore(t)
+	oldKey, newKey := newKey(t), newKey(t)
+	ctx := context.Background()
+	//one shard stored before encryption was enabled and one under the old key
+	plain, old := uuid.New(), uuid.New()
+	if err := fs.UnpackShard(ctx, 1, plain, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := NewCryptStoreHandler(fs, newKeyring(t, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = cs.UnpackShard(ctx, 1, old, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+
+	//rotate and count what is stale
+	if cs, err = NewCryptStoreHandler(fs, newKeyring(t, oldKey, newKey)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cs.Reencrypt(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Checked != 2 || res.Reencrypted != 2 || res.Files != 2*len(testFiles) {
+		t.Fatalf("bad dry run %+v", res)
+	}
+	if bts, err := ioutil.ReadFile(storedFile(dir, plain, `.store`)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(bts, testFiles[`.store`]) {
+		t.Fatal("dry run rewrote a file")
+	}
+
+	if res, err = cs.Reencrypt(ctx, false); err != nil {
+		t.Fatal(err)
+	} else if res.Reencrypted != 2 || res.Files != 2*len(testFiles) {
+		t.Fatalf("bad pass %+v", res)
+	}
+	id := sha256.Sum256(newKey)
+	for _, guid := range []uuid.UUID{plain, old} {
+		for ext := range testFiles {
+			bts, err := ioutil.ReadFile(storedFile(dir, guid, ext))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(bts) < headerSize || !encrypted(bts[:headerSize]) {
+				t.Fatalf("%s%s was not encrypted", guid, ext)
+			} else if !bytes.Equal(bts[len(fileMagic):len(fileMagic)+keyIDSize], id[:keyIDSize]) {
+				t.Fatalf("%s%s is not under the new key", guid, ext)
+			}
+		}
+	}
+
+	//the old key is no longer needed and a second pass has nothing to do
+	if cs, err = NewCryptStoreHandler(fs, newKeyring(t, newKey)); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, plain, testShard, testFiles)
+	storetest.CheckPull(t, cs, old, testShard, testFiles)
+	if res, err = cs.Reencrypt(ctx, false); err != nil {
+		t.Fatal(err)
+	} else if res.Checked != 2 || res.Reencrypted != 0 || res.Files != 0 {
+		t.Fatalf("bad second pass %+v", res)
+	}
+
+	//backends without in-place updates cannot be re-encrypted
+	cs.h = noFeatures{fs}
+	if _, err = cs.Reencrypt(ctx, false); err != ErrNoReencrypt {
+		t.Fatalf("bad error %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// An encrypted file is a header followed by the file in chunks, each sealed with AES-256-GCM:
+//
+//	magic (4) | key ID (8) | salt (32) | chunk | chunk | ...
+//
+// The file key is derived from the customer key and the salt, so every file has its own key
+// and chunk nonces are simply the chunk number with a flag marking the last chunk, which
+// stops a file from being truncated at a chunk boundary.  The file's path within the shard
+// is authenticated with every chunk so files cannot be swapped for one another.
+const (
+	chunkSize  = 64 * 1024
+	saltSize   = 32
+	headerSize = len(fileMagic) + keyIDSize + saltSize
+	overhead   = 16 // GCM tag on each chunk
+
+	fileMagic = `GCE1`
+	tagPrefix = `enc-` // marks an encrypted tag name, description, or origin
+)
+
+var (
+	ErrCorrupt = errors.New("Encrypted data is corrupt or was modified")
+	ErrBadSize = errors.New("Encrypted file has an invalid size")
+)
+
+// encryptedSize returns the size of a file of sz bytes once encrypted
+func encryptedSize(sz int64) int64 {
+	chunks := (sz + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1 //an empty file still has its final chunk
+	}
+	return int64(headerSize) + sz + chunks*overhead
+}
+
+// decryptedSize returns the size of an encrypted file of sz bytes once decrypted
+func decryptedSize(sz int64) (int64, error) {
+	body := sz - int64(headerSize)
+	if body < overhead {
+		return 0, ErrBadSize
+	}
+	chunks := (body + chunkSize + overhead - 1) / (chunkSize + overhead)
+	if last := body - (chunks-1)*(chunkSize+overhead); last < overhead {
+		return 0, ErrBadSize
+	}
+	return body - chunks*overhead, nil
+}
+
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader encrypts a file of a known size as it is read
+type encryptReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	aad       []byte
+	remaining int64
+	n         uint64
+	done      bool
+	plain     []byte
+	out       []byte
+}
+
+func newEncryptReader(ck *custKey, pth string, sz int64, src io.Reader) (*encryptReader, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(deriveKey(ck.secret, salt, `cloudarchive file`))
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, chunkSize+overhead)
+	hdr = append(hdr, fileMagic...)
+	hdr = append(hdr, ck.id[:]...)
+	hdr = append(hdr, salt...)
+	return &encryptReader{
+		src:       src,
+		aead:      aead,
+		aad:       []byte(pth),
+		remaining: sz,
+		plain:     make([]byte, chunkSize),
+		out:       hdr,
+	}, nil
+}
+
+func (er *encryptReader) Read(b []byte) (n int, err error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		sz := int64(chunkSize)
+		if er.remaining < sz {
+			sz = er.remaining
+		}
+		if _, err = io.ReadFull(er.src, er.plain[:sz]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		er.remaining -= sz
+		er.done = er.remaining == 0
+		er.out = er.aead.Seal(er.out[:0], chunkNonce(er.n, er.done), er.plain[:sz], er.aad)
+		er.n++
+	}
+	n = copy(b, er.out)
+	er.out = er.out[n:]
+	return
+}
+
+// decryptReader decrypts a file of a known encrypted size as it is read
+type decryptReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	aad       []byte
+	remaining int64
+	n         uint64
+	chunk     []byte
+	out       []byte
+}
+
+// newDecryptReader reads the header of an encrypted file, the returned reader yields the
+// rest of the file decrypted
+func newDecryptReader(kr *Keyring, cid uint64, pth string, sz int64, hdr []byte, src io.Reader) (*decryptReader, error) {
+	var id keyID
+	copy(id[:], hdr[len(fileMagic):])
+	ck, err := kr.lookup(cid, id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(deriveKey(ck.secret, hdr[len(fileMagic)+keyIDSize:headerSize], `cloudarchive file`))
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:       src,
+		aead:      aead,
+		aad:       []byte(pth),
+		remaining: sz - int64(headerSize),
+		chunk:     make([]byte, chunkSize+overhead),
+	}, nil
+}
+
+func (dr *decryptReader) Read(b []byte) (n int, err error) {
+	for len(dr.out) == 0 {
+		if dr.remaining == 0 {
+			return 0, io.EOF
+		}
+		sz := int64(chunkSize + overhead)
+		if dr.remaining < sz {
+			sz = dr.remaining
+		}
+		if _, err = io.ReadFull(dr.src, dr.chunk[:sz]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		dr.remaining -= sz
+		if dr.out, err = dr.aead.Open(dr.chunk[:0], chunkNonce(dr.n, dr.remaining == 0), dr.chunk[:sz], dr.aad); err != nil {
+			err = ErrCorrupt
+			return
+		}
+		dr.n++
+	}
+	n = copy(b, dr.out)
+	dr.out = dr.out[n:]
+	return
+}
+
+// encrypted reports whether a file header is that of an encrypted file
+func encrypted(hdr []byte) bool {
+	return len(hdr) == headerSize && string(hdr[:len(fileMagic)]) == fileMagic
+}
+
+// sealString encrypts a tag value deterministically, so the same name always encrypts to the
+// same string under a key and the tag manager can still match names it has seen before
+func (ck *custKey) sealString(label, v string) string {
+	mac := hmac.New(sha256.New, ck.ivKey)
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write([]byte(v))
+	nonce := mac.Sum(nil)[:ck.tagAEAD.NonceSize()]
+	buf := make([]byte, 0, keyIDSize+len(nonce)+len(v)+overhead)
+	buf = append(buf, ck.id[:]...)
+	buf = append(buf, nonce...)
+	buf = ck.tagAEAD.Seal(buf, nonce, []byte(v), []byte(label))
+	return tagPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// openString decrypts a tag value, values without the encrypted prefix are returned as is
+func (kr *Keyring) openString(cid uint64, label, v string) (string, error) {
+	if !strings.HasPrefix(v, tagPrefix) {
+		return v, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(v, tagPrefix))
+	if err != nil || len(buf) < keyIDSize+12+overhead {
+		return v, nil //a plain value which happens to have the prefix
+	}
+	var id keyID
+	copy(id[:], buf)
+	ck, err := kr.lookup(cid, id)
+	if err != nil {
+		return ``, err
+	}
+	ns := ck.tagAEAD.NonceSize()
+	pt, err := ck.tagAEAD.Open(nil, buf[keyIDSize:keyIDSize+ns], buf[keyIDSize+ns:], []byte(label))
+	if err != nil {
+		return ``, ErrCorrupt
+	}
+	return string(pt), nil
+}
@@ -0,0 +1,144 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultMount   = `secret`
+	defaultVaultField   = `key`
+	defaultVaultTimeout = 30 * time.Second
+
+	vaultTokenHeader = `X-Vault-Token`
+)
+
+var (
+	ErrMissingVaultAddress = errors.New("Missing Vault address")
+	ErrMissingVaultToken   = errors.New("Missing Vault token")
+	ErrMissingVaultField   = errors.New("Vault secret does not hold the key field")
+)
+
+// VaultConfig locates keys held in a HashiCorp Vault KV version 2 secrets engine.  Each key
+// is a secret whose field holds the key as 64 hex characters, like a key file.  Every
+// version of the secret which has not been deleted or destroyed is used, so writing a new
+// version rotates the key and the older versions still read the data written with them.
+type VaultConfig struct {
+	Address string // such as https://vault.example.org:8200
+	Token   string
+	Mount   string       // path the KV engine is mounted at, defaults to "secret"
+	Field   string       // secret field holding the key, defaults to "key"
+	Client  *http.Client // defaults to a client with a 30 second timeout
+}
+
+type vaultSource struct {
+	VaultConfig
+	base *url.URL
+}
+
+// NewVaultKeySource returns a KeySource which reads keys from Vault, the token needs read
+// access to both the data and the metadata of the secrets
+func NewVaultKeySource(cfg VaultConfig) (KeySource, error) {
+	if cfg.Address == `` {
+		return nil, ErrMissingVaultAddress
+	} else if cfg.Token == `` {
+		return nil, ErrMissingVaultToken
+	}
+	base, err := url.Parse(strings.TrimSuffix(cfg.Address, `/`))
+	if err != nil {
+		return nil, err
+	} else if base.Scheme != `http` && base.Scheme != `https` {
+		return nil, fmt.Errorf("Vault address %q is not an http or https URL", cfg.Address)
+	}
+	if cfg.Mount = strings.Trim(cfg.Mount, `/`); cfg.Mount == `` {
+		cfg.Mount = defaultVaultMount
+	}
+	if cfg.Field == `` {
+		cfg.Field = defaultVaultField
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: defaultVaultTimeout}
+	}
+	return &vaultSource{VaultConfig: cfg, base: base}, nil
+}
+
+type vaultMetadata struct {
+	Data struct {
+		Versions map[string]struct {
+			DeletionTime string `json:"deletion_time"`
+			Destroyed    bool   `json:"destroyed"`
+		} `json:"versions"`
+	} `json:"data"`
+}
+
+type vaultSecret struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+// Keys returns every live version of the secret, oldest first
+func (vs *vaultSource) Keys(ctx context.Context, name string) (keys [][]byte, err error) {
+	name = strings.Trim(name, `/`)
+	var md vaultMetadata
+	if err = vs.get(ctx, `metadata/`+name, nil, &md); err != nil {
+		return
+	}
+	var vers []int
+	for k, v := range md.Data.Versions {
+		ver, perr := strconv.Atoi(k)
+		if perr != nil || v.Destroyed || v.DeletionTime != `` {
+			continue
+		}
+		vers = append(vers, ver)
+	}
+	sort.Ints(vers)
+	for _, ver := range vers {
+		var sec vaultSecret
+		if err = vs.get(ctx, `data/`+name, url.Values{`version`: {strconv.Itoa(ver)}}, &sec); err != nil {
+			return
+		}
+		v, ok := sec.Data.Data[vs.Field].(string)
+		if !ok {
+			err = fmt.Errorf("%s version %d: %w", name, ver, ErrMissingVaultField)
+			return
+		}
+		var key []byte
+		if key, err = ParseKey(v); err != nil {
+			err = fmt.Errorf("%s version %d: %w", name, ver, err)
+			return
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func (vs *vaultSource) get(ctx context.Context, pth string, q url.Values, obj interface{}) (err error) {
+	u := *vs.base
+	u.Path += `/v1/` + vs.Mount + `/` + pth
+	u.RawQuery = q.Encode()
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	req.Header.Set(vaultTokenHeader, vs.Token)
+	if err = doJSON(vs.Client, req, `Vault`, obj); err != nil {
+		err = fmt.Errorf("%s: %w", pth, err)
+	}
+	return
+}
@@ -0,0 +1,166 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package cryptstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+
+	"github.com/google/uuid"
+)
+
+// fakeVault serves versions of a single KV version 2 secret
+type fakeVault struct {
+	sync.Mutex
+	keys      [][]byte
+	destroyed map[int]bool
+	requests  int
+}
+
+func (fv *fakeVault) add(key []byte) {
+	fv.Lock()
+	fv.keys = append(fv.keys, key)
+	fv.Unlock()
+}
+
+func (fv *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fv.Lock()
+	defer fv.Unlock()
+	fv.requests++
+	if r.Header.Get(vaultTokenHeader) != `s.token` {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case `/v1/kv/metadata/archive`:
+		vers := map[string]interface{}{}
+		for i := range fv.keys {
+			vers[strconv.Itoa(i+1)] = map[string]interface{}{`deletion_time`: ``, `destroyed`: fv.destroyed[i+1]}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{`data`: map[string]interface{}{`versions`: vers}})
+	case `/v1/kv/data/archive`:
+		ver, err := strconv.Atoi(r.URL.Query().Get(`version`))
+		if err != nil || ver < 1 || ver > len(fv.keys) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{`data`: map[string]interface{}{
+			`data`: map[string]interface{}{`key`: hex.EncodeToString(fv.keys[ver-1])},
+		}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestVaultKeys(t *testing.T) {
+	fv := &fakeVault{destroyed: map[int]bool{}}
+	k1, k2 := newKey(t), newKey(t)
+	fv.add(k1)
+	srv := httptest.NewServer(fv)
+	defer srv.Close()
+	ctx := context.Background()
+
+	if _, err := NewVaultKeySource(VaultConfig{Address: srv.URL}); err != ErrMissingVaultToken {
+		t.Fatalf("bad error %v", err)
+	}
+	bad, err := NewVaultKeySource(VaultConfig{Address: srv.URL, Token: `wrong`, Mount: `kv`})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = bad.Keys(ctx, `archive`); err == nil {
+		t.Fatal("fetched keys with a bad token")
+	}
+	vs, err := NewVaultKeySource(VaultConfig{Address: srv.URL, Token: `s.token`, Mount: `/kv/`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCachedKeySource(vs, time.Hour)
+	kr := NewKeyring()
+	if err = kr.AddKeySource(ctx, cache, `archive`); err != nil {
+		t.Fatal(err)
+	}
+	fs, _ := storetest.NewFileStore(t)
+	cs, err := NewCryptStoreHandler(fs, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := uuid.New()
+	if err = cs.UnpackShard(ctx, 1, old, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+
+	//a new version is not seen until the cache expires
+	fv.add(k2)
+	if n, err := kr.Refresh(ctx); err != nil || n != 0 {
+		t.Fatalf("refresh through the cache added %d: %v", n, err)
+	}
+	kr.sources[0].src = NewCachedKeySource(vs, 0)
+	if n, err := kr.Refresh(ctx); err != nil || n != 1 {
+		t.Fatalf("refresh added %d: %v", n, err)
+	}
+	if ck, err := kr.current(1); err != nil {
+		t.Fatal(err)
+	} else if ref, _ := newMasterKey(k2); ck.id != ref.id {
+		t.Fatal("rotated key is not current")
+	}
+	//data written under the first version is still read
+	storetest.CheckPull(t, cs, old, testShard, testFiles)
+	neu := uuid.New()
+	if err = cs.UnpackShard(ctx, 1, neu, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, neu, testShard, testFiles)
+
+	//destroyed versions are not fetched, and keys already held are kept
+	fv.Lock()
+	fv.destroyed[1] = true
+	fv.Unlock()
+	if keys, err := vs.Keys(ctx, `archive`); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 1 || !bytes.Equal(keys[0], k2) {
+		t.Fatalf("bad keys %d", len(keys))
+	}
+	if _, err = kr.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, cs, old, testShard, testFiles)
+}
+
+func TestCachedKeySource(t *testing.T) {
+	fv := &fakeVault{destroyed: map[int]bool{}}
+	fv.add(newKey(t))
+	srv := httptest.NewServer(fv)
+	defer srv.Close()
+	vs, err := NewVaultKeySource(VaultConfig{Address: srv.URL, Token: `s.token`, Mount: `kv`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCachedKeySource(vs, time.Hour)
+	for i := 0; i < 3; i++ {
+		if keys, err := cache.Keys(context.Background(), `archive`); err != nil || len(keys) != 1 {
+			t.Fatalf("bad keys %d: %v", len(keys), err)
+		}
+	}
+	if fv.requests != 2 {
+		t.Fatalf("cache made %d requests", fv.requests)
+	}
+	//failures are not cached
+	if _, err = cache.Keys(context.Background(), `missing`); err == nil {
+		t.Fatal("fetched a missing key")
+	}
+}
@@ -0,0 +1,397 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package failoverstore is a storage backend which writes to a primary backend and falls
+// back to a secondary backend while the primary is failing.  Shards and tags written to the
+// secondary are journaled and copied to the primary once it recovers, reads check both so
+// nothing is hidden while a copy is pending.
+package failoverstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	DefaultPreflightInterval = 30 * time.Second
+	DefaultReconcileInterval = 5 * time.Minute
+	DefaultRetryDown         = 30 * time.Second // how long a failed primary is passed over
+
+	preflightTimeout = 10 * time.Second
+)
+
+var (
+	ErrMissingPrimary   = errors.New("Missing primary storage backend")
+	ErrMissingSecondary = errors.New("Missing secondary storage backend")
+	ErrMissingStore     = errors.New("Missing local storage directory")
+	ErrNoUsage          = errors.New("Neither backend reports customer usage")
+	ErrCopyFinished     = errors.New("Primary stopped reading the shard")
+)
+
+type FailoverStoreConfig struct {
+	Primary   webserver.ShardHandler
+	Secondary webserver.ShardHandler
+	// How often a primary which implements webserver.Preflighter is checked before a write,
+	// zero selects DefaultPreflightInterval
+	PreflightInterval time.Duration
+	// How often writes which went to the secondary are copied to the primary, zero selects
+	// DefaultReconcileInterval and a negative interval disables background copies
+	ReconcileInterval time.Duration
+	LocalStore        string // where the journal of writes waiting to be copied is kept
+	Lgr               *log.Logger
+}
+
+type failoverstore struct {
+	cfg     FailoverStoreConfig
+	journal *syncJournal
+
+	mtx     sync.Mutex
+	down    time.Time // the primary is passed over until then
+	failing bool      // the primary's last call failed
+	checked time.Time // when the primary last passed preflight
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+func NewFailoverStoreHandler(cfg FailoverStoreConfig) (*failoverstore, error) {
+	if cfg.Primary == nil {
+		return nil, ErrMissingPrimary
+	} else if cfg.Secondary == nil {
+		return nil, ErrMissingSecondary
+	} else if cfg.LocalStore == `` {
+		return nil, ErrMissingStore
+	}
+	if cfg.PreflightInterval <= 0 {
+		cfg.PreflightInterval = DefaultPreflightInterval
+	}
+	if cfg.ReconcileInterval == 0 {
+		cfg.ReconcileInterval = DefaultReconcileInterval
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	sj, err := openSyncJournal(cfg.LocalStore)
+	if err != nil {
+		return nil, err
+	}
+	fs := &failoverstore{
+		cfg:     cfg,
+		journal: sj,
+		done:    make(chan struct{}),
+	}
+	if n := sj.Len(); n > 0 {
+		cfg.Lgr.Warn("Writes to the secondary backend waiting to be copied from a previous run", log.KV("count", n))
+	}
+	if cfg.ReconcileInterval > 0 {
+		fs.wg.Add(1)
+		go fs.reconcileRoutine()
+	}
+	return fs, nil
+}
+
+// Close stops background copies and closes both backends if they can be closed
+func (fs *failoverstore) Close() (err error) {
+	fs.once.Do(func() {
+		close(fs.done)
+		fs.wg.Wait()
+		for _, h := range []webserver.ShardHandler{fs.cfg.Primary, fs.cfg.Secondary} {
+			if c, ok := h.(io.Closer); ok {
+				if lerr := c.Close(); lerr != nil && err == nil {
+					err = lerr
+				}
+			}
+		}
+	})
+	return
+}
+
+// primaryDown reports whether the primary recently failed
+func (fs *failoverstore) primaryDown() (r bool) {
+	fs.mtx.Lock()
+	r = time.Now().Before(fs.down)
+	fs.mtx.Unlock()
+	return
+}
+
+// primaryUp reports whether writes should go to the primary, a primary which implements
+// webserver.Preflighter must have passed preflight within the preflight interval
+func (fs *failoverstore) primaryUp(ctx context.Context) bool {
+	pf, ok := fs.cfg.Primary.(webserver.Preflighter)
+	now := time.Now()
+	fs.mtx.Lock()
+	if now.Before(fs.down) {
+		fs.mtx.Unlock()
+		return false
+	} else if !ok || now.Sub(fs.checked) < fs.cfg.PreflightInterval {
+		fs.mtx.Unlock()
+		return true
+	}
+	fs.mtx.Unlock()
+	ctx, cf := context.WithTimeout(ctx, preflightTimeout)
+	defer cf()
+	err := pf.Preflight(ctx)
+	if err == nil {
+		fs.mtx.Lock()
+		fs.checked = now
+		fs.mtx.Unlock()
+	}
+	fs.result(err)
+	return err == nil
+}
+
+// result records the outcome of a call to the primary, errors which say something about
+// the request rather than the primary do not count against it
+func (fs *failoverstore) result(err error) {
+	if err != nil && isRequestError(err) {
+		return
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if err == nil {
+		if fs.failing {
+			fs.cfg.Lgr.Info("Primary backend recovered")
+			fs.failing = false
+		}
+		return
+	}
+	if !fs.failing {
+		fs.cfg.Lgr.Warn("Primary backend failed, writing to the secondary backend",
+			log.KV("retry", DefaultRetryDown), log.KVErr(err))
+		fs.failing = true
+	}
+	fs.down = time.Now().Add(DefaultRetryDown)
+	fs.checked = time.Time{}
+}
+
+func isRequestError(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, util.ErrUploadInProgress) || errors.Is(err, util.ErrShardExists) ||
+		errors.Is(err, util.ErrLegalHold) || errors.Is(err, context.Canceled)
+}
+
+// order returns the backends to read from, the primary first unless it recently failed
+func (fs *failoverstore) order() []webserver.ShardHandler {
+	if fs.primaryDown() {
+		return []webserver.ShardHandler{fs.cfg.Secondary, fs.cfg.Primary}
+	}
+	return []webserver.ShardHandler{fs.cfg.Primary, fs.cfg.Secondary}
+}
+
+// both calls fn against each backend, a backend which fails is skipped and the call
+// only fails if both do
+func (fs *failoverstore) both(fn func(webserver.ShardHandler) error) (err error) {
+	var found bool
+	for _, h := range fs.order() {
+		lerr := fn(h)
+		if h == fs.cfg.Primary {
+			fs.result(lerr)
+		}
+		if lerr == nil {
+			found = true
+		} else if err == nil || os.IsNotExist(err) {
+			err = lerr
+		}
+	}
+	if found {
+		err = nil
+	}
+	return
+}
+
+// union merges the names listed by each backend
+func (fs *failoverstore) union(fn func(webserver.ShardHandler) ([]string, error)) (r []string, err error) {
+	have := map[string]bool{}
+	err = fs.both(func(h webserver.ShardHandler) error {
+		names, lerr := fn(h)
+		for _, n := range names {
+			if !have[n] {
+				have[n] = true
+				r = append(r, n)
+			}
+		}
+		return lerr
+	})
+	return
+}
+
+func (fs *failoverstore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
+	return fs.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.ListIndexes(ctx, cid)
+	})
+}
+
+func (fs *failoverstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
+	return fs.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.ListIndexerWells(ctx, cid, guid)
+	})
+}
+
+func (fs *failoverstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	return fs.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.GetShardsInTimeframe(ctx, cid, guid, well, tf)
+	})
+}
+
+// GetWellTimeframe covers the shards held by both backends
+func (fs *failoverstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	err = fs.both(func(h webserver.ShardHandler) error {
+		tf, lerr := h.GetWellTimeframe(ctx, cid, guid, well)
+		if lerr != nil {
+			return lerr
+		}
+		if t.Start.IsZero() || tf.Start.Before(t.Start) {
+			t.Start = tf.Start
+		}
+		if tf.End.After(t.End) {
+			t.End = tf.End
+		}
+		return nil
+	})
+	return
+}
+
+// GetTags merges the tags held by both backends, the secondary may hold tags which were
+// synced while the primary was failing and have not yet been copied
+func (fs *failoverstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	have := map[string]bool{}
+	err = fs.both(func(h webserver.ShardHandler) error {
+		set, lerr := h.GetTags(ctx, cid, guid)
+		for _, tp := range set {
+			if !have[tp.Name] {
+				have[tp.Name] = true
+				tgs = append(tgs, tp)
+			}
+		}
+		return lerr
+	})
+	return
+}
+
+// SyncTags merges the tags into the primary, if the primary is failing they are merged
+// into the secondary and copied to the primary once it recovers
+func (fs *failoverstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	if fs.primaryUp(ctx) {
+		tgs, err = fs.cfg.Primary.SyncTags(ctx, cid, guid, idxTags)
+		if fs.result(err); err == nil || isRequestError(err) {
+			return
+		}
+	}
+	if tgs, err = fs.cfg.Secondary.SyncTags(ctx, cid, guid, idxTags); err != nil {
+		return
+	}
+	fs.queue(pendingSync{CID: cid, IdxUUID: guid})
+	return
+}
+
+// UnpackShard stores the shard in the primary.  If the primary is failing, or fails before
+// reading any of the shard, the shard is stored in the secondary and copied to the primary
+// once it recovers.
+func (fs *failoverstore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) (err error) {
+	if fs.primaryUp(ctx) {
+		cr := &countReader{r: rdr}
+		err = fs.cfg.Primary.UnpackShard(ctx, cid, guid, well, shard, cr)
+		if fs.result(err); err == nil || isRequestError(err) || cr.n > 0 || ctx.Err() != nil {
+			return
+		}
+	}
+	if err = fs.cfg.Secondary.UnpackShard(ctx, cid, guid, well, shard, rdr); err != nil {
+		return
+	}
+	fs.queue(pendingSync{CID: cid, IdxUUID: guid, Well: well, Shard: shard})
+	return
+}
+
+// PackShard reads the shard from the primary, falling back to the secondary if the primary
+// does not have it or fails before anything is written
+func (fs *failoverstore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	cw := &countWriter{w: wtr}
+	for _, h := range fs.order() {
+		err = h.PackShard(ctx, cid, guid, well, shard, cw)
+		if h == fs.cfg.Primary {
+			fs.result(err)
+		}
+		if err == nil || cw.n > 0 || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// CustomerUsage reports the usage of the primary, or the secondary while the primary is failing
+func (fs *failoverstore) CustomerUsage(ctx context.Context, cid uint64) (sz uint64, err error) {
+	err = ErrNoUsage
+	for _, h := range fs.order() {
+		if ur, ok := h.(webserver.UsageReporter); ok {
+			if sz, err = ur.CustomerUsage(ctx, cid); err == nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// SetLegalHolds hands the holds to both backends
+func (fs *failoverstore) SetLegalHolds(lh util.LegalHolds) {
+	for _, h := range []webserver.ShardHandler{fs.cfg.Primary, fs.cfg.Secondary} {
+		if lhe, ok := h.(webserver.LegalHoldEnforcer); ok {
+			lhe.SetLegalHolds(lh)
+		}
+	}
+}
+
+// Preflight reports whether either backend can take writes
+func (fs *failoverstore) Preflight(ctx context.Context) error {
+	if fs.primaryUp(ctx) {
+		return nil
+	} else if pf, ok := fs.cfg.Secondary.(webserver.Preflighter); ok {
+		return pf.Preflight(ctx)
+	}
+	return nil
+}
+
+func (fs *failoverstore) queue(p pendingSync) {
+	if err := fs.journal.Add(p); err != nil {
+		fs.cfg.Lgr.Error("Failed to queue copy to the primary backend", log.KV("cid", p.CID), log.KV("indexeruuid", p.IdxUUID),
+			log.KV("well", p.Well), log.KV("shard", p.Shard), log.KVErr(err))
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(b []byte) (n int, err error) {
+	n, err = cr.r.Read(b)
+	cr.n += int64(n)
+	return
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	return
+}
@@ -0,0 +1,168 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package failoverstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const testShard = `76a00`
+
+var testFiles = map[string][]byte{
+	`.index`:  []byte(`index`),
+	`.verify`: []byte(`verify`),
+	`.store`:  bytes.Repeat([]byte(`store data `), 100000),
+}
+
+var errFlaky = errors.New("primary unavailable")
+
+// flaky is a primary which can be made to fail
+type flaky struct {
+	webserver.ShardHandler
+	fail bool
+}
+
+func (f *flaky) Preflight(ctx context.Context) error {
+	if f.fail {
+		return errFlaky
+	}
+	return nil
+}
+
+func (f *flaky) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	if f.fail {
+		return errFlaky
+	}
+	return f.ShardHandler.UnpackShard(ctx, cid, guid, well, shard, rdr)
+}
+
+func (f *flaky) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) ([]tags.TagPair, error) {
+	if f.fail {
+		return nil, errFlaky
+	}
+	return f.ShardHandler.SyncTags(ctx, cid, guid, idxTags)
+}
+
+// newTestStore wraps two file stores, returning the wrapper, the primary, and the stores' directories
+func newTestStore(t *testing.T) (fs *failoverstore, primary *flaky, pdir, sdir string) {
+	ph, pdir := storetest.NewFileStore(t)
+	sh, sdir := storetest.NewFileStore(t)
+	primary = &flaky{ShardHandler: ph}
+	fs, err := NewFailoverStoreHandler(FailoverStoreConfig{
+		Primary:           primary,
+		Secondary:         sh,
+		ReconcileInterval: -1,
+		LocalStore:        t.TempDir(),
+		Lgr:               log.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return
+}
+
+func TestPrimary(t *testing.T) {
+	fs, _, pdir, sdir := newTestStore(t)
+	guid := uuid.New()
+	if err := fs.UnpackShard(context.Background(), 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	} else if !storetest.Stored(pdir, guid, testShard) || storetest.Stored(sdir, guid, testShard) {
+		t.Fatal("healthy primary did not take the push")
+	} else if fs.journal.Len() != 0 {
+		t.Fatal("push to the primary was queued")
+	}
+	storetest.CheckPull(t, fs, guid, testShard, testFiles)
+}
+
+func TestFailover(t *testing.T) {
+	fs, primary, pdir, sdir := newTestStore(t)
+	ctx := context.Background()
+	guid := uuid.New()
+
+	//writes fall back while the primary fails preflight
+	primary.fail = true
+	tgs := []tags.TagPair{{Name: `syslog`, Value: 1}}
+	if _, err := fs.SyncTags(ctx, 1, guid, tgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UnpackShard(ctx, 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	} else if storetest.Stored(pdir, guid, testShard) || !storetest.Stored(sdir, guid, testShard) {
+		t.Fatal("push did not fall back to the secondary")
+	} else if fs.journal.Len() != 2 {
+		t.Fatalf("expected tags and shard queued, have %d", fs.journal.Len())
+	}
+	storetest.CheckPull(t, fs, guid, testShard, testFiles)
+	if shards, err := fs.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: time.Unix(0, 0), End: time.Now()}); err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 1 || shards[0] != testShard {
+		t.Fatalf("bad shards %v", shards)
+	}
+
+	//nothing is copied while the primary is down
+	if n, err := fs.Reconcile(ctx); err != nil || n != 0 {
+		t.Fatalf("copied %d shards: %v", n, err)
+	}
+
+	//once the primary recovers the writes are copied to it
+	primary.fail = false
+	fs.mtx.Lock()
+	fs.down = time.Time{}
+	fs.mtx.Unlock()
+	if n, err := fs.Reconcile(ctx); err != nil || n != 1 {
+		t.Fatalf("copied %d shards: %v", n, err)
+	} else if !storetest.Stored(pdir, guid, testShard) {
+		t.Fatal("shard not copied to the primary")
+	} else if fs.journal.Len() != 0 {
+		t.Fatalf("%d copies still queued", fs.journal.Len())
+	}
+	storetest.CheckPull(t, fs, guid, testShard, testFiles)
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	sj, err := openSyncJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pendingSync{CID: 1, IdxUUID: uuid.New(), Well: `default`, Shard: testShard}
+	if err = sj.Add(p); err != nil {
+		t.Fatal(err)
+	} else if err = sj.Add(p); err != nil {
+		t.Fatal(err)
+	} else if err = sj.Failed(p, errFlaky); err != nil {
+		t.Fatal(err)
+	}
+	//the queue survives a restart
+	if sj, err = openSyncJournal(dir); err != nil {
+		t.Fatal(err)
+	} else if l := sj.List(); len(l) != 1 || l[0].Attempts != 1 || l[0].Shard != testShard {
+		t.Fatalf("bad journal %+v", l)
+	} else if err = sj.Done(p); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(dir, syncJournalFile)); !os.IsNotExist(err) {
+		t.Fatalf("empty journal left behind: %v", err)
+	}
+}
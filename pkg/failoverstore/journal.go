@@ -0,0 +1,43 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package failoverstore
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/journal"
+
+	"github.com/google/uuid"
+)
+
+const (
+	syncJournalFile = `failover-journal.json`
+)
+
+// pendingSync is a shard, or with an empty Shard an indexer's tags, written to the
+// secondary backend which has not been copied to the primary
+type pendingSync struct {
+	CID     uint64
+	IdxUUID uuid.UUID
+	Well    string `json:",omitempty"`
+	Shard   string `json:",omitempty"`
+	journal.Progress
+}
+
+func (p pendingSync) Key() string {
+	return fmt.Sprintf("%d/%s/%s/%s", p.CID, p.IdxUUID, p.Well, p.Shard)
+}
+
+// syncJournal keeps the pending copies on disk so that they survive a restart
+type syncJournal = journal.Journal[pendingSync, *pendingSync]
+
+func openSyncJournal(dir string) (*syncJournal, error) {
+	return journal.Open[pendingSync](filepath.Join(dir, syncJournalFile), `failover`)
+}
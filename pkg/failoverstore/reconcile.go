@@ -0,0 +1,147 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package failoverstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	copyTimeout = 30 * time.Minute // longest a single shard copy may take
+)
+
+func (fs *failoverstore) reconcileRoutine() {
+	defer fs.wg.Done()
+	ctx, cf := context.WithCancel(context.Background())
+	go func() {
+		<-fs.done
+		cf()
+	}()
+	tckr := time.NewTicker(fs.cfg.ReconcileInterval)
+	defer tckr.Stop()
+	for {
+		if n, err := fs.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			fs.cfg.Lgr.Warn("Failed to copy writes to the primary backend", log.KV("copied", n), log.KVErr(err))
+		} else if n > 0 {
+			fs.cfg.Lgr.Info("Copied shards to the primary backend", log.KV("copied", n))
+		}
+		select {
+		case <-fs.done:
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+type indexer struct {
+	cid  uint64
+	guid uuid.UUID
+}
+
+// Reconcile copies the shards and tags written to the secondary while the primary was
+// failing to the primary, returning how many shards were copied.  Nothing is copied while
+// the primary is failing, a copy which fails is retried on the next pass.
+func (fs *failoverstore) Reconcile(ctx context.Context) (copied int, err error) {
+	pending := fs.journal.List()
+	if len(pending) == 0 || !fs.primaryUp(ctx) {
+		return
+	}
+	//an indexer's tags must reach the primary before any of its shards
+	synced := map[indexer]error{}
+	for _, p := range pending {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		ix := indexer{cid: p.CID, guid: p.IdxUUID}
+		lerr, ok := synced[ix]
+		if !ok {
+			lerr = fs.copyTags(ctx, p.CID, p.IdxUUID)
+			synced[ix] = lerr
+		}
+		if lerr == nil && p.Shard != `` {
+			lerr = fs.copyShard(ctx, p)
+		}
+		if lerr == nil {
+			if lerr = fs.journal.Done(p); lerr != nil {
+				fs.cfg.Lgr.Error("Failed to update failover journal", log.KVErr(lerr))
+			}
+			if p.Shard != `` {
+				copied++
+			}
+			continue
+		}
+		fs.cfg.Lgr.Warn("Failed to copy to the primary backend, will retry", log.KV("cid", p.CID), log.KV("indexeruuid", p.IdxUUID),
+			log.KV("well", p.Well), log.KV("shard", p.Shard), log.KV("attempts", p.Attempts+1), log.KVErr(lerr))
+		if jerr := fs.journal.Failed(p, lerr); jerr != nil {
+			fs.cfg.Lgr.Error("Failed to update failover journal", log.KVErr(jerr))
+		}
+		if fs.primaryDown() {
+			err = lerr
+			return
+		}
+	}
+	return
+}
+
+// copyTags merges the indexer's tags held by the secondary into the primary
+func (fs *failoverstore) copyTags(ctx context.Context, cid uint64, guid uuid.UUID) error {
+	tgs, err := fs.cfg.Secondary.GetTags(ctx, cid, guid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	_, err = fs.cfg.Primary.SyncTags(ctx, cid, guid, tgs)
+	fs.result(err)
+	return err
+}
+
+// copyShard pipes a shard from the secondary into the primary, a shard which the primary
+// already has or which the secondary no longer has counts as copied
+func (fs *failoverstore) copyShard(ctx context.Context, p pendingSync) (err error) {
+	ctx, cf := context.WithTimeout(ctx, copyTimeout)
+	defer cf()
+	pr, pw := io.Pipe()
+	srcErr := make(chan error, 1)
+	go func() {
+		lerr := fs.cfg.Secondary.PackShard(ctx, p.CID, p.IdxUUID, p.Well, p.Shard, pw)
+		pw.CloseWithError(lerr)
+		srcErr <- lerr
+	}()
+	if eu, ok := fs.cfg.Primary.(webserver.ExclusiveShardUnpacker); ok {
+		err = eu.UnpackNewShard(ctx, 0, p.CID, p.IdxUUID, p.Well, p.Shard, pr)
+	} else {
+		err = fs.cfg.Primary.UnpackShard(ctx, p.CID, p.IdxUUID, p.Well, p.Shard, pr)
+	}
+	pr.CloseWithError(ErrCopyFinished)
+	if serr := <-srcErr; serr != nil && !errors.Is(serr, ErrCopyFinished) {
+		if os.IsNotExist(serr) {
+			fs.cfg.Lgr.Warn("Shard queued for copying is no longer held by the secondary backend", log.KV("cid", p.CID),
+				log.KV("indexeruuid", p.IdxUUID), log.KV("well", p.Well), log.KV("shard", p.Shard))
+			return nil
+		}
+		return serr
+	}
+	if errors.Is(err, util.ErrShardExists) {
+		err = nil
+	}
+	fs.result(err)
+	return
+}
@@ -0,0 +1,228 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+const (
+	compactTempPrefix = `.compact-` //not a valid shard name, so never listed while a copy is swapped in
+)
+
+type shardCopy struct {
+	name     string
+	version  uint64
+	complete bool
+	mod      time.Time
+}
+
+// CompactDuplicates finds shards which were pushed more than once, leaving .N suffixed copies
+// behind, and keeps only the newest complete copy under the original shard name.  Shards with
+// no complete copy are left untouched, as are shards which are being pushed or pulled
+// and wells under legal hold.
+// When dryRun is set the duplicates are reported but nothing is removed.
+func (f *filestore) CompactDuplicates(ctx context.Context, dryRun bool) (res []util.CompactionResult, err error) {
+	var cids []uint64
+	if cids, err = f.ListCustomers(); err != nil {
+		return
+	}
+	for _, cid := range cids {
+		var idxs []string
+		if idxs, err = f.ListIndexes(ctx, cid); err != nil {
+			return
+		}
+		for _, idx := range idxs {
+			guid, _ := uuid.Parse(idx) //ListIndexes only returns valid UUIDs
+			var wells []string
+			if wells, err = f.ListIndexerWells(ctx, cid, guid); err != nil {
+				return
+			}
+			for _, well := range wells {
+				if f.holds.Held(cid, well) {
+					continue
+				}
+				var wr []util.CompactionResult
+				wr, err = f.compactWell(ctx, cid, guid, well, dryRun)
+				res = append(res, wr...)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+func (f *filestore) compactWell(ctx context.Context, cid uint64, guid uuid.UUID, well string, dryRun bool) (res []util.CompactionResult, err error) {
+	wellDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String(), well)
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(wellDir); err != nil {
+		return
+	}
+	groups := map[string][]shardCopy{}
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+		_, ver, perr := util.ParseShardName(ent.Name())
+		if perr != nil {
+			continue
+		}
+		base := strings.SplitN(ent.Name(), `.`, 2)[0]
+		groups[base] = append(groups[base], shardCopy{name: ent.Name(), version: ver})
+	}
+	bases := make([]string, 0, len(groups))
+	for base, copies := range groups {
+		if len(copies) > 1 || copies[0].version != 0 {
+			bases = append(bases, base)
+		}
+	}
+	sort.Strings(bases)
+	for _, base := range bases {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var r util.CompactionResult
+		var ok bool
+		if r, ok, err = f.compactShard(wellDir, cid, guid, well, base, groups[base], dryRun); err != nil {
+			return
+		} else if ok {
+			res = append(res, r)
+		}
+	}
+	return
+}
+
+// compactShard removes the redundant copies of a single shard, ok is false if the shard is busy
+func (f *filestore) compactShard(wellDir string, cid uint64, guid uuid.UUID, well, base string, copies []shardCopy, dryRun bool) (r util.CompactionResult, ok bool, err error) {
+	//lock the shard name and every copy, pushes lock the unsuffixed name so no new copy can appear
+	uids := []util.UploadID{{CID: cid, IdxUUID: guid, Well: well, Shard: base}}
+	for _, c := range copies {
+		if c.name != base {
+			uids = append(uids, util.UploadID{CID: cid, IdxUUID: guid, Well: well, Shard: c.name})
+		}
+	}
+	for i, uid := range uids {
+		if err = f.EnterUpload(uid); err != nil {
+			for _, held := range uids[:i] {
+				f.ExitUpload(held)
+			}
+			if err == util.ErrUploadInProgress {
+				err = nil //try again on the next pass
+			}
+			return
+		}
+	}
+	defer func() {
+		for _, uid := range uids {
+			f.ExitUpload(uid)
+		}
+	}()
+
+	r = util.CompactionResult{
+		CID:     cid,
+		IdxUUID: guid,
+		Well:    well,
+		Shard:   base,
+	}
+	ok = true
+	best := -1
+	for i := range copies {
+		c := &copies[i]
+		if c.complete, c.mod, err = util.ShardComplete(filepath.Join(wellDir, c.name), base); err != nil {
+			return
+		} else if !c.complete {
+			continue
+		}
+		if best < 0 || c.mod.After(copies[best].mod) || (c.mod.Equal(copies[best].mod) && c.version > copies[best].version) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return //nothing is safe to keep, leave every copy for an operator to inspect
+	}
+	r.Kept = copies[best].name
+	var baseExists bool
+	for i, c := range copies {
+		if c.name == base {
+			baseExists = true
+		}
+		if i == best {
+			continue
+		}
+		var sz int64
+		if sz, err = dirSize(filepath.Join(wellDir, c.name)); err != nil {
+			return
+		}
+		r.Removed = append(r.Removed, c.name)
+		r.Reclaimed += sz
+	}
+	if dryRun {
+		return
+	}
+	for _, uid := range uids {
+		if err = f.checkLock(uid); err != nil {
+			return
+		}
+	}
+
+	for _, nm := range r.Removed {
+		if nm == base {
+			continue //swapped out below so the shard name never goes missing
+		}
+		if err = os.RemoveAll(filepath.Join(wellDir, nm)); err != nil {
+			return
+		}
+	}
+	if r.Kept != base {
+		keep := filepath.Join(wellDir, r.Kept)
+		baseDir := filepath.Join(wellDir, base)
+		tmp := filepath.Join(wellDir, compactTempPrefix+base)
+		if baseExists {
+			if err = os.Rename(baseDir, tmp); err != nil {
+				return
+			}
+		}
+		if err = os.Rename(keep, baseDir); err != nil {
+			if baseExists {
+				os.Rename(tmp, baseDir)
+			}
+			return
+		}
+		if baseExists {
+			if err = os.RemoveAll(tmp); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func dirSize(p string) (sz int64, err error) {
+	err = filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if fi.Mode().IsRegular() {
+			sz += fi.Size()
+		}
+		return nil
+	})
+	return
+}
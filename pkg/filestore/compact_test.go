@@ -0,0 +1,122 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+func TestCompactDuplicates(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	wellDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`)
+	now := time.Now()
+	//complete copies are stamped with their age, incomplete copies are missing their store
+	mkShard := func(dir, id string, complete bool, age time.Duration, sz int) {
+		sdir := filepath.Join(wellDir, dir)
+		if err := os.MkdirAll(sdir, 0770); err != nil {
+			t.Fatal(err)
+		}
+		files := []string{id + `.index`}
+		if complete {
+			files = append(files, id+`.store`)
+		}
+		for _, f := range files {
+			p := filepath.Join(sdir, f)
+			if err := ioutil.WriteFile(p, make([]byte, sz), 0660); err != nil {
+				t.Fatal(err)
+			} else if err = os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	//76a00 was pushed three times, the .1 copy is the newest complete one
+	mkShard(`76a00`, `76a00`, true, time.Hour, 10)
+	mkShard(`76a00.1`, `76a00`, true, time.Minute, 20)
+	mkShard(`76a00.2`, `76a00`, false, 0, 30)
+	//76a01 is not duplicated
+	mkShard(`76a01`, `76a01`, true, time.Hour, 10)
+	//76a02 only has an incomplete duplicate, the original is kept
+	mkShard(`76a02`, `76a02`, true, time.Hour, 10)
+	mkShard(`76a02.1`, `76a02`, false, 0, 5)
+	//76a03 has no complete copy at all
+	mkShard(`76a03`, `76a03`, false, 0, 5)
+	mkShard(`76a03.1`, `76a03`, false, 0, 5)
+
+	//a dry run reports without touching anything
+	res, err := fs.CompactDuplicates(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 3 {
+		t.Fatalf("bad dry run results: %+v", res)
+	} else if r := res[0]; r.Shard != `76a00` || r.Kept != `76a00.1` || len(r.Removed) != 2 || r.Reclaimed != 2*10+30 {
+		t.Fatalf("bad dry run result %+v", r)
+	} else if _, err = os.Stat(filepath.Join(wellDir, `76a00.2`)); err != nil {
+		t.Fatal("dry run removed a copy")
+	}
+
+	//an in-flight transfer on a copy holds off compaction of that shard
+	busy := util.UploadID{CID: 1, IdxUUID: guid, Well: `default`, Shard: `76a02.1`}
+	if err = fs.EnterUpload(busy); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = fs.CompactDuplicates(context.Background(), false); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 2 {
+		t.Fatalf("bad results: %+v", res)
+	} else if r := res[0]; r.Kept != `76a00.1` {
+		t.Fatalf("bad result %+v", r)
+	} else if r = res[1]; r.Shard != `76a03` || r.Kept != `` || len(r.Removed) != 0 {
+		t.Fatalf("incomplete shard compacted %+v", r)
+	}
+	if err = fs.ExitUpload(busy); err != nil {
+		t.Fatal(err)
+	}
+	//the newest complete copy now lives under the shard name
+	if fi, err := os.Stat(filepath.Join(wellDir, `76a00`, `76a00.store`)); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 20 {
+		t.Fatalf("wrong copy kept, store is %d bytes", fi.Size())
+	}
+
+	if res, err = fs.CompactDuplicates(context.Background(), false); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 2 || res[0].Shard != `76a02` || res[0].Kept != `76a02` || res[0].Reclaimed != 5 {
+		t.Fatalf("bad results: %+v", res)
+	}
+	ents, err := os.ReadDir(wellDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range ents {
+		names = append(names, ent.Name())
+	}
+	want := []string{`76a00`, `76a01`, `76a02`, `76a03`, `76a03.1`}
+	if len(names) != len(want) {
+		t.Fatalf("well holds %v", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("well holds %v", names)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/dolmen-go/contextio"
+	"github.com/google/uuid"
+)
+
+// UnpackShardDelta updates a stored shard in place from a stream which carries only the
+// files that changed.  base is the checksum of the stored shard the delta was computed
+// against, see util.ShardInfo.Checksum, if the shard no longer matches it the delta is
+// refused with util.ErrShardChanged.  The listed data files are removed from the shard.
+// The stream is unpacked into a scratch directory first, so a failed transfer leaves the
+// stored shard untouched.
+func (f *filestore) UnpackShardDelta(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard, base string, remove []string, rdr io.Reader) (err error) {
+	if well == `` || well == `.` || well == `..` || strings.ContainsAny(well, `/\`) {
+		return ErrInvalidWell
+	} else if err = util.ValidateShardName(shard); err != nil {
+		return
+	} else if f.holds.Held(cid, well) {
+		return util.ErrLegalHold
+	}
+	for _, name := range remove {
+		if !shardpacker.IsArtifact(name) {
+			if _, err = util.PackedFileType(shard, name); err != nil {
+				return
+			}
+		}
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	indexerDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String())
+	shardDir := filepath.Join(indexerDir, well, shard)
+	if err = readableDir(shardDir); err != nil {
+		return
+	}
+	if err = f.EnterUpload(uid); err != nil {
+		return
+	}
+	defer func() {
+		if xerr := f.ExitUpload(uid); err == nil {
+			err = xerr
+		}
+	}()
+
+	var stored []util.ShardFile
+	if stored, err = util.ShardFiles(shardDir); err != nil {
+		return
+	} else if (util.ShardInfo{Files: stored}).Checksum() != base {
+		err = util.ErrShardChanged
+		return
+	}
+
+	var scratch string
+	if err = os.MkdirAll(filepath.Join(f.basedir, scratchDir), 0770); err != nil {
+		return
+	} else if scratch, err = os.MkdirTemp(filepath.Join(f.basedir, scratchDir), `delta`); err != nil {
+		return
+	}
+	defer os.RemoveAll(scratch)
+
+	h := handler{
+		cid:  cid,
+		sdir: scratch,
+		bdir: indexerDir,
+		guid: idxUUID,
+		wcfg: f.wcfg,
+		mf:   &manifest{},
+	}
+	var up *shardpacker.Unpacker
+	if up, err = shardpacker.NewUnpacker(shard, contextio.NewReader(ctx, f.CountReader(uid, rdr))); err != nil {
+		return
+	}
+	up.SetPartial(true)
+	if err = up.Unpack(h); err != nil {
+		return
+	}
+
+	//the whole delta arrived, removals go first as a rebuilt accelerator may swap its directory for a file
+	if err = f.checkLock(uid); err != nil {
+		return
+	}
+	for _, name := range remove {
+		if err = os.Remove(filepath.Join(shardDir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	if err = removeEmptyDir(filepath.Join(shardDir, shardpacker.AccelFile.Filename(shard))); err != nil {
+		return
+	}
+	for _, sf := range h.mf.files {
+		dst := filepath.Join(shardDir, filepath.FromSlash(sf.Name))
+		if err = os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+			return
+		} else if err = os.Rename(filepath.Join(scratch, filepath.FromSlash(sf.Name)), dst); err != nil {
+			return
+		}
+	}
+
+	//shards stored before manifests were kept have nothing to merge into, and a manifest
+	//holding only the delta would claim the rest of the shard was never pushed
+	var mfiles []util.ShardFile
+	var ok bool
+	if mfiles, ok, err = util.ReadManifest(shardDir); err != nil {
+		return
+	} else if ok {
+		if err = util.WriteManifest(shardDir, mergeManifest(mfiles, h.mf.files, remove)); err != nil {
+			return
+		}
+	}
+	if p, ok := util.ProvenanceFromContext(ctx); ok {
+		err = util.WriteProvenance(shardDir, p)
+	}
+	return
+}
+
+// mergeManifest replaces manifest entries with those of the files received in a delta
+// and drops the entries of removed files
+func mergeManifest(files, received []util.ShardFile, remove []string) (merged []util.ShardFile) {
+	drop := make(map[string]bool, len(received)+len(remove))
+	for _, sf := range received {
+		drop[sf.Name] = true
+	}
+	for _, name := range remove {
+		drop[name] = true
+	}
+	for _, sf := range files {
+		if !drop[sf.Name] {
+			merged = append(merged, sf)
+		}
+	}
+	merged = append(merged, received...)
+	return
+}
+
+// removeEmptyDir removes a directory if it exists and is empty
+func removeEmptyDir(pth string) error {
+	ents, err := os.ReadDir(pth)
+	if err != nil {
+		if os.IsNotExist(err) || !isDir(pth) {
+			return nil
+		}
+		return err
+	} else if len(ents) == 0 {
+		return os.Remove(pth)
+	}
+	return nil
+}
+
+func isDir(pth string) bool {
+	fi, err := os.Stat(pth)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,143 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	DefaultDiskWarnPercent = 10
+)
+
+var (
+	ErrNoDiskMonitor = errors.New("Disk usage monitor is not running")
+)
+
+// DiskMonitorConfig controls periodic reporting of the archive volume's usage
+type DiskMonitorConfig struct {
+	Interval    time.Duration // how often to sample the volume
+	WarnPercent float64       // warn when free space or inodes drop below this, zero is DefaultDiskWarnPercent
+	Lgr         *log.Logger
+}
+
+// MonitorDisk starts sampling the usage of the base directory and its volume, each sample is
+// logged and served by DiskUsage.  The monitor runs until the file store is closed.
+func (f *filestore) MonitorDisk(cfg DiskMonitorConfig) error {
+	if cfg.Interval <= 0 {
+		return errors.New("Invalid disk monitor interval")
+	} else if cfg.Lgr == nil {
+		return errors.New("Disk monitor requires a logger")
+	}
+	if cfg.WarnPercent <= 0 {
+		cfg.WarnPercent = DefaultDiskWarnPercent
+	}
+	f.duMtx.Lock()
+	defer f.duMtx.Unlock()
+	if f.duStop != nil {
+		return errors.New("Disk monitor already running")
+	}
+	f.duStop = make(chan struct{})
+	go f.diskMonitor(cfg, f.duStop)
+	return nil
+}
+
+// DiskUsage returns the most recent sample taken by the disk monitor
+func (f *filestore) DiskUsage() (du util.DiskUsage, err error) {
+	f.duMtx.Lock()
+	defer f.duMtx.Unlock()
+	if f.du == nil {
+		err = ErrNoDiskMonitor
+	} else {
+		du = *f.du
+	}
+	return
+}
+
+// Close stops the disk monitor, if it is running
+func (f *filestore) Close() error {
+	f.duMtx.Lock()
+	defer f.duMtx.Unlock()
+	if f.duStop != nil {
+		close(f.duStop)
+		f.duStop = nil
+	}
+	return nil
+}
+
+func (f *filestore) diskMonitor(cfg DiskMonitorConfig, stop chan struct{}) {
+	tckr := time.NewTicker(cfg.Interval)
+	defer tckr.Stop()
+	for {
+		if du, err := f.sampleDisk(); err != nil {
+			cfg.Lgr.Error("Failed to sample disk usage", log.KV("path", f.basedir), log.KVErr(err))
+		} else {
+			f.duMtx.Lock()
+			f.du = &du
+			f.duMtx.Unlock()
+			logDiskUsage(cfg, du)
+		}
+		select {
+		case <-tckr.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func logDiskUsage(cfg DiskMonitorConfig, du util.DiskUsage) {
+	lf, msg := cfg.Lgr.Info, `Disk usage`
+	if du.FreePercent() < cfg.WarnPercent || du.FreeInodePercent() < cfg.WarnPercent {
+		lf, msg = cfg.Lgr.Warn, `Archive volume is running out of space`
+	}
+	lf(msg, log.KV("path", du.Path),
+		log.KV("stored", du.StoredBytes),
+		log.KV("free", du.FreeBytes),
+		log.KV("total", du.TotalBytes),
+		log.KV("freepercent", du.FreePercent()),
+		log.KV("freeinodes", du.FreeInodes),
+		log.KV("freeinodepercent", du.FreeInodePercent()))
+}
+
+func (f *filestore) sampleDisk() (du util.DiskUsage, err error) {
+	du.Path = f.basedir
+	du.Sampled = time.Now()
+	if err = volumeUsage(f.basedir, &du); err != nil {
+		return
+	}
+	//shards come and go while we walk, anything which vanishes is simply not counted
+	err = filepath.Walk(f.basedir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		} else if fi.Mode().IsRegular() {
+			du.StoredBytes += uint64(fi.Size())
+		}
+		return nil
+	})
+	return
+}
+
+// FreeSpace returns the bytes available on the volume holding the storage directory
+func (f *filestore) FreeSpace() (uint64, error) {
+	var du util.DiskUsage
+	if err := volumeUsage(f.basedir, &du); err != nil {
+		return 0, err
+	}
+	return du.FreeBytes, nil
+}
@@ -0,0 +1,23 @@
+//go:build windows || plan9 || solaris
+// +build windows plan9 solaris
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"errors"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+)
+
+// volumeUsage is not implemented on this platform
+func volumeUsage(p string, du *util.DiskUsage) error {
+	return errors.New("disk usage is not supported on this platform")
+}
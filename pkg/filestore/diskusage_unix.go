@@ -0,0 +1,31 @@
+//go:build !windows && !plan9 && !solaris
+// +build !windows,!plan9,!solaris
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"golang.org/x/sys/unix"
+)
+
+// volumeUsage fills in the size, free space, and inode counts of the volume holding p
+func volumeUsage(p string, du *util.DiskUsage) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return err
+	}
+	du.TotalBytes = uint64(st.Blocks) * uint64(st.Bsize)
+	du.FreeBytes = uint64(st.Bavail) * uint64(st.Bsize)
+	du.TotalInodes = uint64(st.Files)
+	du.FreeInodes = uint64(st.Ffree)
+	return nil
+}
@@ -9,6 +9,9 @@
 package filestore
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -17,7 +20,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dolmen-go/contextio"
 	"github.com/gravwell/cloudarchive/pkg/shardpacker"
 	"github.com/gravwell/cloudarchive/pkg/tags"
 	"github.com/gravwell/cloudarchive/pkg/util"
@@ -28,11 +34,23 @@ import (
 
 var (
 	ErrMissingBaseDir = errors.New("Empty base directory for file store")
+	ErrInvalidWell    = errors.New("Invalid well name")
 )
 
 type filestore struct {
 	util.UploadTracker
-	basedir string
+	basedir        string
+	trashRetention time.Duration
+	holds          util.LegalHolds
+	wcfg           WriteConfig
+	locks          *sharedLocks // nil unless shards are also locked with lockfiles
+
+	duMtx  sync.Mutex
+	du     *util.DiskUsage // latest sample from the disk monitor
+	duStop chan struct{}
+
+	histMtx          sync.Mutex // serializes appends to the access history
+	historyRetention time.Duration
 }
 
 func NewFilestoreHandler(bdir string) (*filestore, error) {
@@ -44,10 +62,14 @@ func NewFilestoreHandler(bdir string) (*filestore, error) {
 	return &filestore{
 		basedir:       bdir,
 		UploadTracker: util.NewUploadTracker(),
+		wcfg: WriteConfig{
+			Strategy:   WriteBuffered,
+			BufferSize: DefaultWriteBufferSize,
+		},
 	}, nil
 }
 
-func (f *filestore) ListIndexes(cid uint64) ([]string, error) {
+func (f *filestore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
 	var idx []string
 	custDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10))
 	files, err := ioutil.ReadDir(custDir)
@@ -66,7 +88,44 @@ func (f *filestore) ListIndexes(cid uint64) ([]string, error) {
 	return idx, err
 }
 
-func (f *filestore) ListIndexerWells(cid uint64, guid uuid.UUID) ([]string, error) {
+// Preflight ensures the storage directory is still writable
+func (f *filestore) Preflight(ctx context.Context) error {
+	return writableDir(f.basedir)
+}
+
+// ListCustomers returns the number of every customer with data in the store
+func (f *filestore) ListCustomers() (cids []uint64, err error) {
+	var custs []os.DirEntry
+	if custs, err = os.ReadDir(f.basedir); err != nil {
+		return
+	}
+	for _, cust := range custs {
+		if cid, perr := strconv.ParseUint(cust.Name(), 10, 64); perr == nil && cust.IsDir() {
+			cids = append(cids, cid)
+		}
+	}
+	return
+}
+
+// CustomerUsage returns the number of bytes stored for a customer
+func (f *filestore) CustomerUsage(ctx context.Context, cid uint64) (usage uint64, err error) {
+	custDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10))
+	err = filepath.Walk(custDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if fi.Mode().IsRegular() {
+			usage += uint64(fi.Size())
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		//nothing has been stored yet
+		err = nil
+	}
+	return
+}
+
+func (f *filestore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
 	var wells []string
 	idxDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String())
 	files, err := ioutil.ReadDir(idxDir)
@@ -82,7 +141,7 @@ func (f *filestore) ListIndexerWells(cid uint64, guid uuid.UUID) ([]string, erro
 	return wells, err
 }
 
-func (f *filestore) GetWellTimeframe(cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+func (f *filestore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
 	wellDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String(), well)
 	// we will play it safe and walk every file
 	var files []os.FileInfo
@@ -105,32 +164,218 @@ func (f *filestore) GetWellTimeframe(cid uint64, guid uuid.UUID, well string) (t
 	return
 }
 
-func (f *filestore) GetShardsInTimeframe(cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+// GetWellStats counts the shards stored in a well and their total size, shards which
+// are removed while they are being counted are left out
+func (f *filestore) GetWellStats(ctx context.Context, cid uint64, guid uuid.UUID, well string) (ws util.WellStats, err error) {
+	if well == `` || well == `.` || well == `..` || strings.ContainsAny(well, `/\`) {
+		err = ErrInvalidWell
+		return
+	}
+	wellDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String(), well)
+	var dents []os.DirEntry
+	if dents, err = os.ReadDir(wellDir); err != nil {
+		return
+	}
+	ws.Well = well
+	for _, dent := range dents {
+		if err = ctx.Err(); err != nil {
+			return
+		} else if !dent.IsDir() {
+			continue
+		}
+		s, e, perr := util.ShardNameToDateRange(dent.Name())
+		if perr != nil {
+			continue
+		}
+		sz, serr := dirSize(filepath.Join(wellDir, dent.Name()))
+		if serr != nil {
+			if os.IsNotExist(serr) {
+				continue
+			}
+			err = serr
+			return
+		}
+		ws.Shards++
+		ws.Bytes += sz
+		if filepath.Ext(dent.Name()) != `` {
+			ws.Duplicates++
+		}
+		if ws.Oldest.IsZero() || s.Before(ws.Oldest) {
+			ws.Oldest = s
+		}
+		if e.After(ws.Newest) {
+			ws.Newest = e
+		}
+	}
+	return
+}
+
+// GetWellTags returns the well tags pushed with the most recent shard in a well
+// re-uploaded copies of a shard are distinguished by modification time
+func (f *filestore) GetWellTags(ctx context.Context, cid uint64, guid uuid.UUID, well string) (tgs []string, err error) {
 	wellDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String(), well)
-	// we will play it safe and walk every file
 	var files []os.FileInfo
-	files, err = ioutil.ReadDir(wellDir)
-	if err != nil {
+	if files, err = ioutil.ReadDir(wellDir); err != nil {
 		return
 	}
+	var newest os.FileInfo
+	var newestStart time.Time
 	for _, info := range files {
-		s, e, err := util.ShardNameToDateRange(info.Name())
+		if !info.IsDir() {
+			continue
+		}
+		s, _, err := util.ShardNameToDateRange(info.Name())
 		if err != nil {
 			continue
 		}
-		// There are several ways for this to end up on the list:
-		switch {
-		// the start of the span falls within the shard
-		case s.Before(tf.Start) && e.After(tf.Start):
-			fallthrough
-		// the end of the span falls within the shard
-		case s.Before(tf.End) && e.After(tf.End):
-			fallthrough
-		// the span's start/end lands directly on the shard's start/end
-		case s.Equal(tf.End) || s.Equal(tf.Start) || e.Equal(tf.End) || e.Equal(tf.Start):
-			fallthrough
-		// the span entirely contains the shard
-		case tf.Start.Before(s) && tf.End.After(e):
+		if newest == nil || s.After(newestStart) || (s.Equal(newestStart) && info.ModTime().After(newest.ModTime())) {
+			newest = info
+			newestStart = s
+		}
+	}
+	if newest == nil {
+		err = fmt.Errorf("No shards in well %s", well)
+		return
+	}
+	var bts []byte
+	if bts, err = ioutil.ReadFile(filepath.Join(wellDir, newest.Name(), shardpacker.WellTags.Filename(newest.Name()))); err != nil {
+		if os.IsNotExist(err) {
+			//the default well does not carry tags
+			err = nil
+		}
+		return
+	}
+	for _, t := range strings.Split(string(bts), "\n") {
+		if t = strings.TrimSpace(t); t != `` {
+			tgs = append(tgs, t)
+		}
+	}
+	return
+}
+
+// GetShardInfo returns the files stored for a shard along with their sizes and checksums,
+// and the metadata and provenance recorded when it was pushed
+func (f *filestore) GetShardInfo(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string) (si util.ShardInfo, err error) {
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	shardDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String(), well, shard)
+	if err = readableDir(shardDir); err != nil {
+		return
+	}
+	if err = f.EnterUpload(uid); err != nil {
+		return
+	}
+	si.Shard = shard
+	if si.Files, err = util.ShardFiles(shardDir); err != nil {
+		f.ExitUpload(uid)
+		return
+	} else if si.Metadata, err = util.ReadShardMetadata(shardDir, shard); err != nil {
+		f.ExitUpload(uid)
+		return
+	} else if si.Provenance, err = util.ReadProvenance(shardDir); err != nil {
+		f.ExitUpload(uid)
+		return
+	}
+	err = f.ExitUpload(uid)
+	return
+}
+
+// GetShardSize returns the size of the files a pull of the shard sends
+func (f *filestore) GetShardSize(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string) (sz util.ShardSize, err error) {
+	shardDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String(), well, shard)
+	if err = readableDir(shardDir); err != nil {
+		return
+	}
+	return util.GetShardSize(shardDir, shard)
+}
+
+// SetLegalHolds sets the customers and wells whose shards may not be deleted or replaced,
+// held shards are also left out of compaction and trash purges
+func (f *filestore) SetLegalHolds(lh util.LegalHolds) {
+	f.holds = lh
+}
+
+// DeleteShard removes a single shard from a well, re-uploaded copies carry a .N suffix
+// on the shard name and must be deleted individually.  If a trash retention period is
+// set the shard is moved to the customer's trash rather than destroyed.
+func (f *filestore) DeleteShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string) (err error) {
+	if well == `` || well == `.` || well == `..` || strings.ContainsAny(well, `/\`) {
+		return ErrInvalidWell
+	} else if err = util.ValidateShardName(shard); err != nil {
+		return
+	} else if f.holds.Held(cid, well) {
+		return util.ErrLegalHold
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	shardDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String(), well, shard)
+	if err = readableDir(shardDir); err != nil {
+		return
+	}
+	if err = f.EnterUpload(uid); err != nil {
+		return
+	}
+	if f.trashRetention > 0 {
+		err = f.trashShard(ctx, cid, idxUUID, well, shard, shardDir)
+	} else {
+		err = os.RemoveAll(shardDir)
+	}
+	if err != nil {
+		f.ExitUpload(uid)
+		return
+	}
+	err = f.ExitUpload(uid)
+	return
+}
+
+// EvictShard removes a shard without passing it through the trash, it is meant for shards
+// which have been copied to another store.  Held shards are not protected, the caller is
+// expected to check the holds it has.
+func (f *filestore) EvictShard(cid uint64, idxUUID uuid.UUID, well, shard string) (err error) {
+	if well == `` || well == `.` || well == `..` || strings.ContainsAny(well, `/\`) {
+		return ErrInvalidWell
+	} else if err = util.ValidateShardName(shard); err != nil {
+		return
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	shardDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String(), well, shard)
+	if err = readableDir(shardDir); err != nil {
+		return
+	}
+	if err = f.EnterUpload(uid); err != nil {
+		return
+	}
+	if err = os.RemoveAll(shardDir); err != nil {
+		f.ExitUpload(uid)
+		return
+	}
+	err = f.ExitUpload(uid)
+	return
+}
+
+func (f *filestore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+	wellDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String(), well)
+	// we will play it safe and walk every file
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(wellDir)
+	if err != nil {
+		return
+	}
+	for _, info := range files {
+		if ok, err := tf.ShardOverlaps(info.Name()); err == nil && ok {
 			shards = append(shards, info.Name())
 		}
 	}
@@ -138,7 +383,29 @@ func (f *filestore) GetShardsInTimeframe(cid uint64, guid uuid.UUID, well string
 
 }
 
-func (f *filestore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) (err error) {
+func (f *filestore) UnpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, f.EnterUpload, false)
+}
+
+// UnpackShardWait is UnpackShard, but an upload of the same shard which is already in
+// progress is waited on for up to wait rather than immediately failing
+func (f *filestore) UnpackShardWait(ctx context.Context, wait time.Duration, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, func(uid util.UploadID) error {
+		return f.EnterUploadWait(ctx, uid, wait)
+	}, false)
+}
+
+// UnpackNewShard is UnpackShardWait, but if the shard is already stored it fails with
+// util.ErrShardExists rather than storing another copy with a .N suffix
+func (f *filestore) UnpackNewShard(ctx context.Context, wait time.Duration, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, func(uid util.UploadID) error {
+		return f.EnterUploadWait(ctx, uid, wait)
+	}, true)
+}
+
+// unpackShard stores a pushed shard, any provenance attached to the context is written alongside it
+// and the transfer is abandoned if the context is done
+func (f *filestore) unpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader, enter func(util.UploadID) error, exclusive bool) (err error) {
 	var up *shardpacker.Unpacker
 	uid := util.UploadID{
 		CID:     cid,
@@ -149,16 +416,23 @@ func (f *filestore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard strin
 
 	//create directory structure if it does not exist
 
-	if err = f.EnterUpload(uid); err != nil {
+	if err = enter(uid); err != nil {
 		return
 	}
+	rdr = contextio.NewReader(ctx, f.CountReader(uid, rdr))
 
 	//generate the complete path to the customer/indexer upload location and make it
 	//this will create all nessasary directories
 	indexerDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String())
 
-	//do the same for the shard upload location
+	//do the same for the shard upload location, held wells never gain a .N copy which could replace the shard
 	shardDir := filepath.Join(indexerDir, well, shard)
+	if _, err = os.Stat(shardDir); err == nil && (exclusive || f.holds.Held(cid, well)) {
+		f.ExitUpload(uid)
+		err = util.ErrShardExists
+		return
+	}
+	err = nil
 	base := shardDir
 	// Check if this shard already exists. If so, we'll keep adding .N suffixes until it works
 	// We'll try up to some arbitrary big number... but we won't create shards infinitely forever,
@@ -169,36 +443,67 @@ func (f *filestore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard strin
 		}
 		shardDir = fmt.Sprintf("%s.%d", base, i)
 	}
-	if err = os.MkdirAll(shardDir, 0770); err != nil {
+	//the shard is unpacked beside its final location and renamed into place once complete,
+	//the journal entry lets a restart clean up after an unpack the server died during
+	tempDir := unpackTempDir(shardDir)
+	if err = os.MkdirAll(filepath.Dir(shardDir), 0770); err != nil {
+		f.ExitUpload(uid)
+		return
+	}
+	var entry string
+	if entry, err = f.beginUnpack(uid, shardDir, tempDir); err != nil {
 		f.ExitUpload(uid)
 		return
 	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tempDir)
+		}
+		if xerr := f.endUnpack(entry); err == nil {
+			err = xerr
+		}
+		if xerr := f.ExitUpload(uid); err == nil {
+			err = xerr
+		}
+	}()
+	if err = os.Mkdir(tempDir, 0770); err != nil {
+		return
+	}
 
 	h := handler{
 		cid:  cid,
-		sdir: shardDir,
+		sdir: tempDir,
 		bdir: indexerDir,
 		guid: idxUUID,
+		wcfg: f.wcfg,
+		mf:   &manifest{},
 	}
 	//generate a new shard unpacker
 	if up, err = shardpacker.NewUnpacker(shard, rdr); err != nil {
-		os.RemoveAll(shardDir)
-		f.ExitUpload(uid)
 		return
 	}
 	//perform the actual unpack
 	if err = up.Unpack(h); err != nil {
-		os.RemoveAll(shardDir)
-		f.ExitUpload(uid)
 		return
 	}
-
-	//release the shard
-	err = f.ExitUpload(uid)
+	if err = util.WriteManifest(tempDir, h.mf.files); err != nil {
+		return
+	}
+	if p, ok := util.ProvenanceFromContext(ctx); ok {
+		if err = util.WriteProvenance(tempDir, p); err != nil {
+			return
+		}
+	}
+	if err = f.checkLock(uid); err != nil {
+		return
+	}
+	if err = os.Rename(tempDir, shardDir); err == nil {
+		err = syncDir(filepath.Dir(shardDir))
+	}
 	return
 }
 
-func (f *filestore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+func (f *filestore) PackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) (err error) {
 	uid := util.UploadID{
 		CID:     cid,
 		IdxUUID: idxUUID,
@@ -210,6 +515,7 @@ func (f *filestore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 	if err = f.EnterUpload(uid); err != nil {
 		return
 	}
+	wtr = contextio.NewWriter(ctx, f.CountWriter(uid, wtr))
 
 	//generate the complete path to the customer/indexer upload location and make it
 	//this will create all nessasary directories
@@ -248,6 +554,8 @@ func (f *filestore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 	case err = <-copyErrChan:
 		if err != nil {
 			//somehow the copy chan exited first, close down teh file adder and wait
+			//cancel first, the adder may hold the packer lock while blocked flushing to us
+			p.Cancel()
 			p.CloseWithError(err)
 			<-addFilesErrChan
 		} else {
@@ -275,7 +583,7 @@ func (f *filestore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 	return
 }
 
-func (f *filestore) GetTags(cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+func (f *filestore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
 	var tm tags.TagManager
 	indexerDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String())
 	if tm, err = tags.GetTagMan(cid, guid, indexerDir); err != nil {
@@ -290,7 +598,7 @@ func (f *filestore) GetTags(cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err
 	return
 }
 
-func (f *filestore) SyncTags(cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+func (f *filestore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
 	var tm tags.TagManager
 	indexerDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), guid.String())
 	// This is likely to happen before the shard is synced, so make sure the directory exists
@@ -318,31 +626,28 @@ func (f *filestore) SyncTags(cid uint64, guid uuid.UUID, idxTags []tags.TagPair)
 	return
 }
 
+// BackupTags copies the tags.dat of every indexer into dir
+func (f *filestore) BackupTags(ctx context.Context, dir string) (err error) {
+	_, err = tags.BackupTagDats(ctx, f.basedir, dir)
+	return
+}
+
 type handler struct {
 	cid  uint64    //customer number
 	sdir string    //shard directory
 	bdir string    //base directory
 	guid uuid.UUID //indexer GUID
+	wcfg WriteConfig
+	mf   *manifest //files written so far, nil if no manifest is kept
 }
 
 func (h handler) HandleFile(pth string, rdr io.Reader) error {
-	//clean the path to ensure there are no relative path items
-	dir, file := clean(pth)
-	if dir != `` {
-		err := os.Mkdir(filepath.Join(h.sdir, dir), 0770)
-		if err != nil && !os.IsExist(err) {
-			return err
-		}
-	}
-	fout, err := os.Create(filepath.Join(h.sdir, dir, file))
-	if err != nil {
-		return err
-	}
-	if _, err := io.Copy(fout, rdr); err != nil {
-		fout.Close()
-		return err
-	}
-	return fout.Close()
+	return h.writeFile(pth, -1, rdr)
+}
+
+// HandleSizedFile writes a file whose size is known up front, so it can be preallocated
+func (h handler) HandleSizedFile(pth string, size int64, rdr io.Reader) error {
+	return h.writeFile(pth, size, rdr)
 }
 
 func (h handler) HandleTagUpdate(tgs []tags.TagPair) error {
@@ -359,15 +664,13 @@ func (h handler) HandleTagUpdate(tgs []tags.TagPair) error {
 	return tags.ReleaseTagMan(h.cid, h.guid)
 }
 
-// clean removes any relative path elements and returns a potential single directory and file
-func clean(p string) (d, f string) {
-	p = filepath.Clean(p)
-	//remove any starting . and do it again
-	d, f = filepath.Split(filepath.Clean(strings.TrimLeft(p, "./")))
-	if d = filepath.Base(d); d == `.` {
-		d = ``
+// HandleMetadata stores the shard metadata alongside the shard files
+func (h handler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	bts, err := json.Marshal(md)
+	if err != nil {
+		return err
 	}
-	return
+	return h.HandleFile(shardpacker.Metadata.Filepath(md.Shard), bytes.NewReader(bts))
 }
 
 // writableDir ensures that the provided location exists, is a dir, and is R/W
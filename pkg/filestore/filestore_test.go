@@ -0,0 +1,635 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestUnpackNewShard(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	sdir := filepath.Join(t.TempDir(), `76a00`)
+	if err = os.Mkdir(sdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{`index`, `verify`, `store`} {
+		if err = ioutil.WriteFile(filepath.Join(sdir, `76a00.`+ext), []byte(ext), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pack := func() io.Reader {
+		pkr := shardpacker.NewPacker(`76a00`)
+		go func() {
+			if err := util.AddShardFilesToPacker(sdir, `76a00`, pkr); err != nil {
+				pkr.CloseWithError(err)
+			} else {
+				pkr.Close()
+			}
+		}()
+		return pkr
+	}
+	ctx := context.Background()
+	if err = fs.UnpackNewShard(ctx, time.Second, 1, guid, `default`, `76a00`, pack()); err != nil {
+		t.Fatal(err)
+	}
+	//a second exclusive push is refused, a regular push stores a suffixed copy
+	if err = fs.UnpackNewShard(ctx, time.Second, 1, guid, `default`, `76a00`, pack()); err != util.ErrShardExists {
+		t.Fatalf("duplicate push not refused: %v", err)
+	} else if err = fs.UnpackShardWait(ctx, time.Second, 1, guid, `default`, `76a00`, pack()); err != nil {
+		t.Fatal(err)
+	}
+	wellDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`)
+	if _, err = os.Stat(filepath.Join(wellDir, `76a00.1`)); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(wellDir, `76a00.2`)); !os.IsNotExist(err) {
+		t.Fatalf("refused push stored a copy: %v", err)
+	}
+
+	//the stored copy matches the local one
+	si, err := fs.GetShardInfo(ctx, 1, guid, `default`, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := util.ShardFiles(sdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.Checksum() != (util.ShardInfo{Files: local}).Checksum() {
+		t.Fatal("checksum mismatch")
+	}
+}
+
+func TestUnpackShardCancel(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	//a push whose request has gone away is abandoned and nothing is left behind
+	ctx, cf := context.WithCancel(context.Background())
+	cf()
+	pkr := shardpacker.NewPacker(`76a00`)
+	go func() {
+		bb := bytes.NewBufferString(`store`)
+		if err := pkr.AddFile(shardpacker.Store, int64(bb.Len()), bb); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a00`, pkr); err != context.Canceled {
+		t.Fatalf("cancelled push not abandoned: %v", err)
+	}
+	pkr.Cancel()
+	if _, err = os.Stat(filepath.Join(fs.basedir, `1`, guid.String(), `default`, `76a00`)); !os.IsNotExist(err) {
+		t.Fatalf("cancelled push left the shard behind: %v", err)
+	}
+}
+
+func TestWellStats(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	ctx := context.Background()
+	if _, err = fs.GetWellStats(ctx, 1, guid, `default`); !os.IsNotExist(err) {
+		t.Fatalf("missing well not reported: %v", err)
+	} else if _, err = fs.GetWellStats(ctx, 1, guid, `..`); err != ErrInvalidWell {
+		t.Fatalf("bad well name not refused: %v", err)
+	}
+	wellDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`)
+	for _, shard := range []string{`76a00`, `76a00.1`, `76a08`} {
+		if err = os.MkdirAll(filepath.Join(wellDir, shard), 0700); err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(filepath.Join(wellDir, shard, `76a00.store`), make([]byte, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//things which are not shards are not counted
+	if err = os.Mkdir(filepath.Join(wellDir, `notashard`), 0700); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(wellDir, `76a10`), []byte(`file`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := fs.GetWellStats(ctx, 1, guid, `default`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest, _, _ := util.ShardNameToDateRange(`76a00`)
+	_, newest, _ := util.ShardNameToDateRange(`76a08`)
+	if ws.Well != `default` || ws.Shards != 3 || ws.Duplicates != 1 || ws.Bytes != 300 {
+		t.Fatalf("bad well stats: %+v", ws)
+	} else if !ws.Oldest.Equal(oldest) || !ws.Newest.Equal(newest) {
+		t.Fatalf("bad well time span: %v - %v, expected %v - %v", ws.Oldest, ws.Newest, oldest, newest)
+	}
+}
+
+func TestVerifyShard(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	ctx := context.Background()
+	sdir := filepath.Join(t.TempDir(), `76a00`)
+	if err = os.Mkdir(sdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{`index`, `verify`, `store`} {
+		if err = ioutil.WriteFile(filepath.Join(sdir, `76a00.`+ext), []byte(ext), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkr := shardpacker.NewPacker(`76a00`)
+	go func() {
+		if err := util.AddShardFilesToPacker(sdir, `76a00`, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a00`, pkr); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.VerifyShard(ctx, 1, guid, `default`, `76a08`); !os.IsNotExist(err) {
+		t.Fatalf("missing shard not reported: %v", err)
+	} else if _, err = fs.VerifyShard(ctx, 1, guid, `default`, `../76a00`); !errors.Is(err, util.ErrInvalidShardName) {
+		t.Fatalf("bad shard name not refused: %v", err)
+	}
+	sv, err := fs.VerifyShard(ctx, 1, guid, `default`, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	} else if !sv.Passed || !sv.Manifest || len(sv.Problems) != 0 {
+		t.Fatalf("intact shard failed verification: %+v", sv)
+	}
+
+	//flip a byte in the store without changing its size
+	shardDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`, `76a00`)
+	if err = ioutil.WriteFile(filepath.Join(shardDir, `76a00.store`), []byte(`stork`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if sv, err = fs.VerifyShard(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if sv.Passed || len(sv.Problems) != 1 || !strings.Contains(sv.Problems[0], `76a00.store`) {
+		t.Fatalf("corrupt store not caught: %+v", sv)
+	}
+
+	//shards stored before manifests can still be checked for missing files
+	if err = os.Remove(filepath.Join(shardDir, util.ManifestFilename)); err != nil {
+		t.Fatal(err)
+	} else if err = os.Remove(filepath.Join(shardDir, `76a00.index`)); err != nil {
+		t.Fatal(err)
+	}
+	if sv, err = fs.VerifyShard(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if sv.Passed || sv.Manifest || len(sv.Problems) != 2 || !strings.Contains(sv.Problems[1], `76a00.index is missing`) {
+		t.Fatalf("missing index not caught: %+v", sv)
+	}
+
+	//nothing is left in the scratch area
+	if dents, err := os.ReadDir(filepath.Join(fs.basedir, scratchDir)); err != nil {
+		t.Fatal(err)
+	} else if len(dents) != 0 {
+		t.Fatalf("scratch area not cleaned up: %v", dents)
+	}
+}
+
+func TestUnpackShardDelta(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	ctx := context.Background()
+	sdir := filepath.Join(t.TempDir(), `76a00`)
+	if err = os.MkdirAll(filepath.Join(sdir, `76a00.accel`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, nm := range []string{`76a00.index`, `76a00.verify`, `76a00.store`, `76a00.accel/keys`, `76a00.accel/data`} {
+		if err = ioutil.WriteFile(filepath.Join(sdir, nm), []byte(nm), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pack := func(files []string) *shardpacker.Packer {
+		pkr := shardpacker.NewPacker(`76a00`)
+		go func() {
+			var err error
+			if files == nil {
+				err = util.AddShardFilesToPacker(sdir, `76a00`, pkr)
+			} else {
+				err = util.AddShardFileListToPacker(sdir, `76a00`, files, pkr)
+			}
+			if err != nil {
+				pkr.CloseWithError(err)
+			} else {
+				pkr.Close()
+			}
+		}()
+		return pkr
+	}
+	if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a00`, pack(nil)); err != nil {
+		t.Fatal(err)
+	}
+	si, err := fs.GetShardInfo(ctx, 1, guid, `default`, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := si.Checksum()
+
+	//rebuild the accelerator as a single file
+	for _, nm := range []string{`76a00.accel/keys`, `76a00.accel/data`, `76a00.accel`} {
+		if err = os.Remove(filepath.Join(sdir, nm)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(sdir, `76a00.accel`), []byte(`bloom`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	remove := []string{`76a00.accel/keys`, `76a00.accel/data`}
+	//refused deltas are never read
+	empty := strings.NewReader(``)
+	if err = fs.UnpackShardDelta(ctx, 1, guid, `default`, `76a00`, base, []string{`../76a00.index`}, empty); !errors.Is(err, util.ErrNotShardFile) {
+		t.Fatalf("bad removal not refused: %v", err)
+	} else if err = fs.UnpackShardDelta(ctx, 1, guid, `default`, `76a00`, `stale`, remove, empty); err != util.ErrShardChanged {
+		t.Fatalf("stale delta not refused: %v", err)
+	} else if err = fs.UnpackShardDelta(ctx, 1, guid, `default`, `76a08`, base, nil, empty); !os.IsNotExist(err) {
+		t.Fatalf("delta of a missing shard not refused: %v", err)
+	}
+	if err = fs.UnpackShardDelta(ctx, 1, guid, `default`, `76a00`, base, remove, pack([]string{`76a00.accel`})); err != nil {
+		t.Fatal(err)
+	}
+
+	//the stored shard now matches the local copy and still verifies against its manifest
+	local, err := util.ShardFiles(sdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si, err = fs.GetShardInfo(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if si.Checksum() != (util.ShardInfo{Files: local}).Checksum() {
+		t.Fatalf("stored shard does not match after delta: %+v", si.Files)
+	}
+	if sv, err := fs.VerifyShard(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if !sv.Passed || !sv.Manifest {
+		t.Fatalf("shard failed verification after delta: %+v", sv)
+	}
+	if dents, err := os.ReadDir(filepath.Join(fs.basedir, scratchDir)); err != nil {
+		t.Fatal(err)
+	} else if len(dents) != 0 {
+		t.Fatalf("scratch area not cleaned up: %v", dents)
+	}
+}
+
+func TestAccessHistory(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	guidA, guidB := uuid.New(), uuid.New()
+	now := time.Now().UTC()
+	old := now.AddDate(0, -3, 0)
+	evs := []util.AccessEvent{
+		{Time: old, Operation: util.AccessPush, CID: 1, IdxUUID: guidA, Well: `default`, Shard: `76a00`},
+		{Time: now.Add(-time.Hour), Operation: util.AccessPush, CID: 1, IdxUUID: guidB, Well: `default`, Shard: `76a01`},
+		{Time: now.Add(-time.Minute), Operation: util.AccessPull, CID: 1, IdxUUID: guidA, Well: `default`, Shard: `76a00`},
+		{Time: now, Operation: util.AccessDelete, CID: 1, IdxUUID: guidA, Well: `default`, Shard: `76a00`, Error: `not found`},
+		{Time: now, Operation: util.AccessPush, CID: 2, IdxUUID: guidA, Well: `default`, Shard: `76a00`},
+	}
+	for _, ev := range evs {
+		if err = fs.RecordAccess(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//history never counts towards a customer's usage or shows up as a customer
+	if usage, err := fs.CustomerUsage(ctx, 1); err != nil || usage != 0 {
+		t.Fatalf("history counted as usage: %d %v", usage, err)
+	}
+
+	//everything for the customer, most recent first
+	got, err := fs.AccessHistory(ctx, 1, util.AccessQuery{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != 4 || got[0].Operation != util.AccessDelete || got[3].Shard != `76a00` || !got[3].Time.Equal(old) {
+		t.Fatalf("bad history %+v", got)
+	}
+	//filters combine
+	if got, err = fs.AccessHistory(ctx, 1, util.AccessQuery{Indexer: guidA, Operation: util.AccessPush}); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 || !got[0].Time.Equal(old) {
+		t.Fatalf("bad filtered history %+v", got)
+	}
+	if got, err = fs.AccessHistory(ctx, 1, util.AccessQuery{Start: now.Add(-2 * time.Hour), End: now}); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 2 || got[0].Operation != util.AccessPull {
+		t.Fatalf("bad time range history %+v", got)
+	}
+	if got, err = fs.AccessHistory(ctx, 1, util.AccessQuery{Indexers: []uuid.UUID{guidB}}); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 || got[0].IdxUUID != guidB {
+		t.Fatalf("restricted history leaked other indexers %+v", got)
+	}
+	if got, err = fs.AccessHistory(ctx, 1, util.AccessQuery{Limit: 2}); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 2 || got[1].Operation != util.AccessPull {
+		t.Fatalf("bad limited history %+v", got)
+	}
+
+	//only months entirely past retention are purged
+	fs.SetHistoryRetention(30 * 24 * time.Hour)
+	if n, err := fs.PurgeHistory(ctx); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("purged %d months", n)
+	}
+	if got, err = fs.AccessHistory(ctx, 1, util.AccessQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 3 {
+		t.Fatalf("bad history after purge %+v", got)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTrashRetention(time.Hour)
+	ctx := context.Background()
+	guid := uuid.New()
+	sdir := filepath.Join(fs.basedir, `1`, guid.String(), `default`, `76a00`)
+	if err = os.MkdirAll(sdir, 0770); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(sdir, `store`), []byte(`store`), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.DeleteShard(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(sdir); !os.IsNotExist(err) {
+		t.Fatalf("deleted shard still in its well: %v", err)
+	}
+	ents, err := fs.ListTrash(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 1 || ents[0].Shard != `76a00` || ents[0].IdxUUID != guid || ents[0].Size != 5 {
+		t.Fatalf("bad trash listing: %+v", ents)
+	}
+	//the trash is not mistaken for an indexer
+	if idxs, err := fs.ListIndexes(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 1 || idxs[0] != guid.String() {
+		t.Fatalf("bad indexer listing: %v", idxs)
+	}
+	//nothing has expired yet
+	if purged, err := fs.PurgeTrash(context.Background()); err != nil || len(purged) != 0 {
+		t.Fatalf("purged unexpired shards: %v %v", purged, err)
+	}
+
+	if _, err = fs.RestoreShard(1, ents[0].ID); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(sdir, `store`)); err != nil {
+		t.Fatalf("restored shard missing: %v", err)
+	}
+	if _, err = fs.RestoreShard(1, ents[0].ID); !os.IsNotExist(err) {
+		t.Fatalf("bad error restoring twice: %v", err)
+	}
+
+	//expired shards are purged
+	fs.SetTrashRetention(time.Nanosecond)
+	if err = fs.DeleteShard(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if purged, err := fs.PurgeTrash(context.Background()); err != nil || len(purged) != 1 {
+		t.Fatalf("expired shard not purged: %v %v", purged, err)
+	} else if ents, err = fs.ListTrash(1); err != nil || len(ents) != 0 {
+		t.Fatalf("trash not empty after purge: %v %v", ents, err)
+	}
+}
+
+func TestEvictShard(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTrashRetention(time.Hour)
+	guid := uuid.New()
+	sdir := filepath.Join(fs.basedir, `7`, guid.String(), `default`, `76a00`)
+	if err = os.MkdirAll(sdir, 0770); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(sdir, `store`), []byte(`store`), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if cids, err := fs.ListCustomers(); err != nil {
+		t.Fatal(err)
+	} else if len(cids) != 1 || cids[0] != 7 {
+		t.Fatalf("bad customers %v", cids)
+	}
+
+	//evicted shards skip the trash
+	if err = fs.EvictShard(7, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(sdir); !os.IsNotExist(err) {
+		t.Fatalf("evicted shard still in its well: %v", err)
+	} else if ents, err := fs.ListTrash(7); err != nil || len(ents) != 0 {
+		t.Fatalf("evicted shard in the trash: %v %v", ents, err)
+	}
+	if err = fs.EvictShard(7, guid, `default`, `76a00`); !os.IsNotExist(err) {
+		t.Fatalf("bad error evicting twice: %v", err)
+	}
+}
+
+func TestLegalHold(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	sdir := filepath.Join(t.TempDir(), `76a00`)
+	if err = os.Mkdir(sdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{`index`, `verify`, `store`} {
+		if err = ioutil.WriteFile(filepath.Join(sdir, `76a00.`+ext), []byte(ext), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pack := func() io.Reader {
+		pkr := shardpacker.NewPacker(`76a00`)
+		go func() {
+			if err := util.AddShardFilesToPacker(sdir, `76a00`, pkr); err != nil {
+				pkr.CloseWithError(err)
+			} else {
+				pkr.Close()
+			}
+		}()
+		return pkr
+	}
+	ctx := context.Background()
+	//leave a duplicate behind before the hold is placed
+	for i := 0; i < 2; i++ {
+		if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a00`, pack()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.SetLegalHolds(util.LegalHolds{1: {Wells: []string{`default`}}})
+
+	if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a00`, pack()); err != util.ErrShardExists {
+		t.Fatalf("push replacing a held shard not refused: %v", err)
+	} else if err = fs.DeleteShard(ctx, 1, guid, `default`, `76a00`); err != util.ErrLegalHold {
+		t.Fatalf("delete of a held shard not refused: %v", err)
+	}
+	if res, err := fs.CompactDuplicates(ctx, false); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 0 {
+		t.Fatalf("held well compacted: %+v", res)
+	}
+	wellDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`)
+	for _, name := range []string{`76a00`, `76a00.1`} {
+		if _, err = os.Stat(filepath.Join(wellDir, name)); err != nil {
+			t.Fatalf("held shard %s missing: %v", name, err)
+		}
+	}
+	//other customers are unaffected
+	if err = fs.UnpackShard(ctx, 2, guid, `default`, `76a00`, pack()); err != nil {
+		t.Fatal(err)
+	} else if err = fs.DeleteShard(ctx, 2, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	}
+
+	//once the hold is lifted the shard can be deleted
+	fs.SetLegalHolds(nil)
+	if err = fs.DeleteShard(ctx, 1, guid, `default`, `76a00`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteStrategies(t *testing.T) {
+	data := bytes.Repeat([]byte("shard data "), 10000)
+	for _, wc := range []WriteConfig{
+		{},
+		{Strategy: WriteBuffered, BufferSize: 4096},
+		{Strategy: WriteDirect, BufferSize: 7000, Preallocate: true},
+	} {
+		fs, err := NewFilestoreHandler(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		} else if err = fs.SetWriteConfig(wc); err != nil {
+			t.Fatal(err)
+		}
+		h := handler{sdir: t.TempDir(), wcfg: fs.wcfg}
+		if err = h.HandleSizedFile(`76a00.store`, int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		//a short stream does not leave preallocated space behind
+		if err = h.HandleSizedFile(`76a00.index`, int64(len(data)), bytes.NewReader(data[:100])); err != nil {
+			t.Fatal(err)
+		}
+		if bts, err := ioutil.ReadFile(filepath.Join(h.sdir, `76a00.store`)); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(bts, data) {
+			t.Fatalf("%+v wrote a bad file", wc)
+		}
+		if fi, err := os.Stat(filepath.Join(h.sdir, `76a00.index`)); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() != 100 {
+			t.Fatalf("%+v left a %d byte file", wc, fi.Size())
+		}
+	}
+
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.SetWriteConfig(WriteConfig{Strategy: `sideways`}); !errors.Is(err, ErrInvalidWriteStrategy) {
+		t.Fatalf("bad strategy accepted: %v", err)
+	} else if err = fs.SetWriteConfig(WriteConfig{BufferSize: -1}); err == nil {
+		t.Fatal("negative buffer size accepted")
+	}
+}
+
+func TestHandleFileUnsafePath(t *testing.T) {
+	root := t.TempDir()
+	h := handler{sdir: filepath.Join(root, `well`, `76a00`), wcfg: WriteConfig{Strategy: WriteBuffered, BufferSize: DefaultWriteBufferSize}}
+	if err := os.MkdirAll(h.sdir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{`../76a01.store`, `76a00.accel/../../../escape`, `/etc/cron.d/x`, `76a00.accel\..\..\escape`, `CON`} {
+		if err := h.HandleFile(p, strings.NewReader(`data`)); err == nil {
+			t.Fatalf("unsafe path %q accepted", p)
+		}
+	}
+	if ents, err := os.ReadDir(root); err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 1 {
+		t.Fatalf("unsafe paths wrote outside the shard: %v", ents)
+	}
+	if err := h.HandleFile(`76a00.accel/keys`, strings.NewReader(`data`)); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(h.sdir, `76a00.accel`, `keys`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskMonitor(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err = fs.DiskUsage(); err != ErrNoDiskMonitor {
+		t.Fatalf("usage reported without a monitor: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(fs.basedir, `data`), make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.MonitorDisk(DiskMonitorConfig{Interval: 10 * time.Millisecond, Lgr: log.NewDiscardLogger()}); err != nil {
+		t.Fatal(err)
+	} else if err = fs.MonitorDisk(DiskMonitorConfig{Interval: time.Second, Lgr: log.NewDiscardLogger()}); err == nil {
+		t.Fatal("started a second monitor")
+	}
+	var du util.DiskUsage
+	for i := 0; i < 100; i++ {
+		if du, err = fs.DiskUsage(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	} else if du.StoredBytes != 4096 {
+		t.Fatalf("stored %d bytes, expected 4096", du.StoredBytes)
+	} else if du.TotalBytes == 0 || du.FreeBytes > du.TotalBytes {
+		t.Fatalf("bad volume usage: %+v", du)
+	}
+}
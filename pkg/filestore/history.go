@@ -0,0 +1,187 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+)
+
+const (
+	historyDir      = `.history` //not a valid customer number, so never treated as a customer
+	historyExt      = `.jsonl`
+	historyMonthFmt = `2006-01`
+
+	DefaultHistoryLimit = 1000
+	MaxHistoryLimit     = 10000
+)
+
+// SetHistoryRetention sets how long access history is kept, history is dropped a month at a
+// time once the whole month is older than the retention period.  Zero keeps history forever.
+func (f *filestore) SetHistoryRetention(d time.Duration) {
+	f.historyRetention = d
+}
+
+// RecordAccess appends an event to the customer's access history, events are stored one
+// JSON object per line in a file per customer per month
+func (f *filestore) RecordAccess(ev util.AccessEvent) (err error) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Time = ev.Time.UTC()
+	var bts []byte
+	if bts, err = json.Marshal(ev); err != nil {
+		return
+	}
+	dir := f.custHistoryDir(ev.CID)
+	f.histMtx.Lock()
+	defer f.histMtx.Unlock()
+	if err = os.MkdirAll(dir, 0770); err != nil {
+		return
+	}
+	var fout *os.File
+	if fout, err = os.OpenFile(filepath.Join(dir, ev.Time.Format(historyMonthFmt)+historyExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660); err != nil {
+		return
+	}
+	if _, err = fout.Write(append(bts, '\n')); err != nil {
+		fout.Close()
+		return
+	}
+	err = fout.Close()
+	return
+}
+
+// AccessHistory returns the customer's events selected by the query, most recent first
+func (f *filestore) AccessHistory(ctx context.Context, cid uint64, q util.AccessQuery) (evs []util.AccessEvent, err error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultHistoryLimit
+	} else if q.Limit > MaxHistoryLimit {
+		q.Limit = MaxHistoryLimit
+	}
+	var months []string
+	if months, err = f.historyMonths(cid); err != nil {
+		return
+	}
+	//walk back from the newest month, stopping once the limit is met
+	for i := len(months) - 1; i >= 0 && len(evs) < q.Limit; i-- {
+		start, _ := time.Parse(historyMonthFmt, months[i])
+		if !q.End.IsZero() && !start.Before(q.End) {
+			continue
+		} else if !q.Start.IsZero() && !start.AddDate(0, 1, 0).After(q.Start) {
+			break
+		}
+		var mevs []util.AccessEvent
+		if mevs, err = f.readHistory(ctx, filepath.Join(f.custHistoryDir(cid), months[i]+historyExt), q); err != nil {
+			return
+		}
+		sort.SliceStable(mevs, func(i, j int) bool { return mevs[i].Time.After(mevs[j].Time) })
+		evs = append(evs, mevs...)
+	}
+	if len(evs) > q.Limit {
+		evs = evs[:q.Limit]
+	}
+	return
+}
+
+// PurgeHistory drops the months of access history which fall entirely outside the retention
+// period, the number of months dropped across all customers is returned
+func (f *filestore) PurgeHistory(ctx context.Context) (purged int, err error) {
+	if f.historyRetention <= 0 {
+		return
+	}
+	var custs []os.DirEntry
+	if custs, err = os.ReadDir(filepath.Join(f.basedir, historyDir)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil //nothing has been recorded
+		}
+		return
+	}
+	cutoff := time.Now().Add(-f.historyRetention)
+	for _, cust := range custs {
+		cid, perr := strconv.ParseUint(cust.Name(), 10, 64)
+		if perr != nil || !cust.IsDir() {
+			continue
+		}
+		var months []string
+		if months, err = f.historyMonths(cid); err != nil {
+			return
+		}
+		for _, m := range months {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			start, _ := time.Parse(historyMonthFmt, m)
+			if start.AddDate(0, 1, 0).After(cutoff) {
+				break //months are in order, everything after this is newer
+			}
+			if err = os.Remove(filepath.Join(f.custHistoryDir(cid), m+historyExt)); err != nil {
+				return
+			}
+			purged++
+		}
+	}
+	return
+}
+
+// historyMonths returns the months a customer has history for, oldest first
+func (f *filestore) historyMonths(cid uint64) (months []string, err error) {
+	var dents []os.DirEntry
+	if dents, err = os.ReadDir(f.custHistoryDir(cid)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil //nothing has been recorded
+		}
+		return
+	}
+	for _, dent := range dents {
+		m := strings.TrimSuffix(dent.Name(), historyExt)
+		if !dent.Type().IsRegular() || m == dent.Name() {
+			continue
+		} else if _, perr := time.Parse(historyMonthFmt, m); perr != nil {
+			continue
+		}
+		months = append(months, m)
+	}
+	sort.Strings(months)
+	return
+}
+
+// readHistory returns the events in a history file selected by the query, a line which
+// cannot be decoded, such as one cut short by a crash, is skipped
+func (f *filestore) readHistory(ctx context.Context, p string, q util.AccessQuery) (evs []util.AccessEvent, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	scn := bufio.NewScanner(fin)
+	for scn.Scan() {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var ev util.AccessEvent
+		if json.Unmarshal(scn.Bytes(), &ev) == nil && q.Match(ev) {
+			evs = append(evs, ev)
+		}
+	}
+	err = scn.Err()
+	return
+}
+
+func (f *filestore) custHistoryDir(cid uint64) string {
+	return filepath.Join(f.basedir, historyDir, strconv.FormatUint(cid, 10))
+}
@@ -0,0 +1,208 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/safepath"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+const (
+	journalDir       = `.journal` //not a valid customer number, so never treated as a customer
+	journalExt       = `.json`
+	unpackTempPrefix = `.unpack-` //not a valid shard name, so never listed while it is unpacked
+)
+
+// unpackIntent is the journal entry for an unpack in progress.  It is written before
+// anything is unpacked and removed once the shard has been renamed into place, paths are
+// relative to the base directory.
+type unpackIntent struct {
+	Upload   util.UploadID
+	ShardDir string // where the shard is renamed to once it is complete
+	TempDir  string // where the shard is unpacked
+	Started  time.Time
+}
+
+// UnpackRecovery describes an unpack which was in flight when the store was last stopped
+type UnpackRecovery struct {
+	util.UploadID
+	ShardDir  string
+	Started   time.Time
+	Completed bool // the shard was already in place, otherwise the partial shard was removed
+}
+
+// beginUnpack durably records the intent to unpack a shard into tempDir before renaming
+// it to shardDir, the returned entry is handed to endUnpack once the unpack is resolved
+func (f *filestore) beginUnpack(uid util.UploadID, shardDir, tempDir string) (entry string, err error) {
+	ui := unpackIntent{
+		Upload:  uid,
+		Started: time.Now(),
+	}
+	if ui.ShardDir, err = filepath.Rel(f.basedir, shardDir); err != nil {
+		return
+	} else if ui.TempDir, err = filepath.Rel(f.basedir, tempDir); err != nil {
+		return
+	}
+	var bts []byte
+	if bts, err = json.Marshal(ui); err != nil {
+		return
+	}
+	jdir := filepath.Join(f.basedir, journalDir)
+	if err = os.MkdirAll(jdir, 0770); err != nil {
+		return
+	}
+	var fout *os.File
+	if fout, err = os.CreateTemp(jdir, `unpack-*`+journalExt); err != nil {
+		return
+	}
+	entry = fout.Name()
+	if _, err = fout.Write(bts); err == nil {
+		err = fout.Sync()
+	}
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(jdir)
+	}
+	if err != nil {
+		os.Remove(entry)
+		entry = ``
+	}
+	return
+}
+
+// endUnpack removes the journal entry of an unpack which completed or was cleaned up
+func (f *filestore) endUnpack(entry string) error {
+	if err := os.Remove(entry); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RecoverUnpacks resolves the unpacks which were in flight when the store was last stopped.
+// Shards which were still being unpacked are removed, so the indexer pushes them again, and
+// shards which were already renamed into place are kept.  It must be called before the store
+// accepts any uploads.  With shared locking, unpacks whose shard is locked by another server
+// are left alone.
+func (f *filestore) RecoverUnpacks() (rec []UnpackRecovery, err error) {
+	jdir := filepath.Join(f.basedir, journalDir)
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir(jdir); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, ent := range ents {
+		if !ent.Type().IsRegular() || filepath.Ext(ent.Name()) != journalExt {
+			continue
+		}
+		entry := filepath.Join(jdir, ent.Name())
+		var ui unpackIntent
+		var ok bool
+		if ok, err = f.readIntent(entry, &ui); err != nil {
+			return
+		} else if ok {
+			//with shared locking the unpack may belong to another server which is still running
+			if err = f.EnterUpload(ui.Upload); err == util.ErrUploadInProgress {
+				err = nil
+				continue
+			} else if err != nil {
+				return
+			}
+			r := UnpackRecovery{UploadID: ui.Upload, ShardDir: ui.ShardDir, Started: ui.Started}
+			r.Completed, err = f.resolveIntent(ui)
+			f.ExitUpload(ui.Upload)
+			if err != nil {
+				return
+			}
+			rec = append(rec, r)
+		}
+		if err = f.endUnpack(entry); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// readIntent loads a journal entry, ok is false if the entry was never completely written
+// in which case nothing was unpacked
+func (f *filestore) readIntent(entry string, ui *unpackIntent) (ok bool, err error) {
+	var bts []byte
+	if bts, err = os.ReadFile(entry); err != nil {
+		return
+	} else if jerr := json.Unmarshal(bts, ui); jerr != nil {
+		return
+	}
+	//the paths are removed during recovery, make sure they are where an unpack would put them
+	if ui.ShardDir, err = safepath.Sanitize(ui.ShardDir); err != nil {
+		err = fmt.Errorf("Invalid unpack journal entry %s: %w", entry, err)
+		return
+	} else if ui.TempDir, err = safepath.Sanitize(ui.TempDir); err != nil {
+		err = fmt.Errorf("Invalid unpack journal entry %s: %w", entry, err)
+		return
+	} else if !strings.HasPrefix(filepath.Base(ui.TempDir), unpackTempPrefix) || filepath.Dir(ui.TempDir) != filepath.Dir(ui.ShardDir) {
+		err = fmt.Errorf("Invalid unpack journal entry %s: temporary directory %s", entry, ui.TempDir)
+		return
+	}
+	ok = true
+	return
+}
+
+// resolveIntent rolls back an unpack which did not finish, completed is true if the
+// shard had already been renamed into place
+func (f *filestore) resolveIntent(ui unpackIntent) (completed bool, err error) {
+	tempDir := filepath.Join(f.basedir, ui.TempDir)
+	if _, err = os.Stat(tempDir); err == nil {
+		err = os.RemoveAll(tempDir)
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	//the rename is the last step, so without a temporary directory the shard is either in place or was never started
+	if _, err = os.Stat(filepath.Join(f.basedir, ui.ShardDir)); err == nil {
+		completed = true
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// unpackTempDir returns the directory a shard is unpacked into before it is renamed into
+// place, it is in the same well so the rename never crosses filesystems
+func unpackTempDir(shardDir string) string {
+	return filepath.Join(filepath.Dir(shardDir), unpackTempPrefix+filepath.Base(shardDir)+`-`+uuid.New().String())
+}
+
+// syncDir flushes a directory so entries created in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, os.ErrInvalid) {
+		err = nil //not every filesystem can sync a directory
+	}
+	return err
+}
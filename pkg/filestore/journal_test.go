@@ -0,0 +1,154 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+func TestRecoverUnpacks(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	wellDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`)
+	if err = os.MkdirAll(wellDir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	uid := func(shard string) util.UploadID {
+		return util.UploadID{CID: 1, IdxUUID: guid, Well: `default`, Shard: shard}
+	}
+
+	//the server died part way through unpacking 76a00
+	partial := filepath.Join(wellDir, `76a00`)
+	partialTemp := unpackTempDir(partial)
+	if _, err = fs.beginUnpack(uid(`76a00`), partial, partialTemp); err != nil {
+		t.Fatal(err)
+	} else if err = os.Mkdir(partialTemp, 0770); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(partialTemp, `76a00.store`), []byte(`half`), 0660); err != nil {
+		t.Fatal(err)
+	}
+	//after renaming 76a01 into place
+	done := filepath.Join(wellDir, `76a01`)
+	doneTemp := unpackTempDir(done)
+	if _, err = fs.beginUnpack(uid(`76a01`), done, doneTemp); err != nil {
+		t.Fatal(err)
+	} else if err = os.Mkdir(doneTemp, 0770); err != nil {
+		t.Fatal(err)
+	} else if err = os.Rename(doneTemp, done); err != nil {
+		t.Fatal(err)
+	}
+	//and while writing a journal entry
+	if err = ioutil.WriteFile(filepath.Join(fs.basedir, journalDir, `unpack-torn.json`), []byte(`{"Upload":{"CID"`), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := fs.RecoverUnpacks()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rec) != 2 {
+		t.Fatalf("bad recovery %+v", rec)
+	}
+	for _, r := range rec {
+		switch r.Shard {
+		case `76a00`:
+			if r.Completed {
+				t.Fatal("partial unpack reported complete")
+			}
+		case `76a01`:
+			if !r.Completed {
+				t.Fatal("completed unpack was not reported complete")
+			}
+		default:
+			t.Fatalf("unexpected recovery %+v", r)
+		}
+	}
+	if _, err = os.Stat(partialTemp); !os.IsNotExist(err) {
+		t.Fatalf("partial shard was left behind: %v", err)
+	} else if _, err = os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatalf("partial shard was put in place: %v", err)
+	} else if _, err = os.Stat(done); err != nil {
+		t.Fatal(err)
+	}
+	if ents, err := os.ReadDir(filepath.Join(fs.basedir, journalDir)); err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 0 {
+		t.Fatalf("journal entries left behind: %v", ents)
+	}
+	if rec, err = fs.RecoverUnpacks(); err != nil || len(rec) != 0 {
+		t.Fatalf("second recovery found %+v, %v", rec, err)
+	}
+
+	//an entry pointing outside the well is refused rather than acted on
+	if _, err = fs.beginUnpack(uid(`76a02`), filepath.Join(wellDir, `76a02`), filepath.Join(fs.basedir, `..`, `elsewhere`)); err != nil {
+		t.Fatal(err)
+	} else if _, err = fs.RecoverUnpacks(); err == nil {
+		t.Fatal("bad journal entry accepted")
+	}
+}
+
+func TestUnpackJournaled(t *testing.T) {
+	fs, err := NewFilestoreHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	sdir := filepath.Join(t.TempDir(), `76a00`)
+	if err = os.Mkdir(sdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{`index`, `verify`, `store`} {
+		if err = ioutil.WriteFile(filepath.Join(sdir, `76a00.`+ext), []byte(ext), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkr := shardpacker.NewPacker(`76a00`)
+	go func() {
+		if err := util.AddShardFilesToPacker(sdir, `76a00`, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	ctx := context.Background()
+	if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a00`, pkr); err != nil {
+		t.Fatal(err)
+	}
+	//a stream which fails part way leaves nothing behind either
+	if err = fs.UnpackShard(ctx, 1, guid, `default`, `76a01`, bytes.NewReader([]byte(`not a shard`))); err == nil {
+		t.Fatal("bad stream unpacked")
+	}
+
+	wellDir := filepath.Join(fs.basedir, `1`, guid.String(), `default`)
+	if ents, err := os.ReadDir(wellDir); err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 1 || ents[0].Name() != `76a00` {
+		t.Fatalf("unexpected well contents %v", ents)
+	}
+	if _, ok, err := util.ReadManifest(filepath.Join(wellDir, `76a00`)); err != nil || !ok {
+		t.Fatalf("missing manifest: %v", err)
+	}
+	if ents, err := os.ReadDir(filepath.Join(fs.basedir, journalDir)); err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 0 {
+		t.Fatalf("journal entries left behind: %v", ents)
+	}
+}
@@ -0,0 +1,348 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+const (
+	lockDir    = `.locks` //not a valid customer number, so never treated as a customer
+	lockExt    = `.lock`
+	fenceExt   = `.fence`
+	staleInfix = `.stale-`
+
+	DefaultLockLease = 2 * time.Minute
+	MinLockLease     = 5 * time.Second
+	lockPollInterval = 250 * time.Millisecond
+)
+
+var (
+	ErrLockLost         = errors.New("Shard lock was taken over by another server")
+	ErrInvalidLockLease = errors.New("Lock lease must be at least 5s")
+)
+
+// SharedLockConfig enables locking shards with lockfiles in the storage directory, so several
+// servers can share it, for example over NFS.  Each server still tracks its own uploads in memory.
+type SharedLockConfig struct {
+	Owner string        // names this server in lockfiles, the host name and process ID if empty
+	Lease time.Duration // how long a lock is honored without being renewed, zero is DefaultLockLease
+}
+
+// lockRecord is the content of a lockfile, the lockfile's modification time is renewed
+// while it is held
+type lockRecord struct {
+	Upload   util.UploadID
+	Owner    string
+	Token    uint64 // fencing token, increases every time the shard is locked
+	Acquired time.Time
+}
+
+// sharedLocks holds shards with lockfiles which are created exclusively, which is atomic on NFS.
+// Every lock of a shard is issued the next fencing token, recorded beside the lockfiles.  A holder
+// checks its token is still current before changing the shard, so a server which stalled past its
+// lease and had its lock taken over never overwrites the new holder's work.
+type sharedLocks struct {
+	dir   string
+	owner string
+	lease time.Duration
+
+	mtx  sync.Mutex
+	held map[util.UploadID]*heldLock
+}
+
+type heldLock struct {
+	key   string
+	token uint64
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// SetSharedLocking locks shards with lockfiles as well as in memory, it must be called before
+// RecoverUnpacks and before the store is used
+func (f *filestore) SetSharedLocking(slc SharedLockConfig) error {
+	if slc.Lease == 0 {
+		slc.Lease = DefaultLockLease
+	} else if slc.Lease < MinLockLease {
+		return ErrInvalidLockLease
+	}
+	if slc.Owner == `` {
+		host, err := os.Hostname()
+		if err != nil {
+			host = `unknown`
+		}
+		slc.Owner = host + `:` + strconv.Itoa(os.Getpid())
+	}
+	dir := filepath.Join(f.basedir, lockDir)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	f.locks = &sharedLocks{
+		dir:   dir,
+		owner: slc.Owner,
+		lease: slc.Lease,
+		held:  map[util.UploadID]*heldLock{},
+	}
+	return nil
+}
+
+// EnterUpload claims a shard in this process and, with shared locking, from every other server
+func (f *filestore) EnterUpload(uid util.UploadID) error {
+	if err := f.UploadTracker.EnterUpload(uid); err != nil {
+		return err
+	} else if err = f.locks.acquire(context.Background(), uid, false); err != nil {
+		f.UploadTracker.ExitUpload(uid)
+		return err
+	}
+	return nil
+}
+
+// EnterUploadWait is EnterUpload, but waits at most the given duration for the shard to be released
+func (f *filestore) EnterUploadWait(ctx context.Context, uid util.UploadID, wait time.Duration) error {
+	ctx, cf := context.WithTimeout(ctx, wait)
+	defer cf()
+	if err := f.UploadTracker.EnterUploadCtx(ctx, uid); err != nil {
+		return err
+	} else if err = f.locks.acquire(ctx, uid, true); err != nil {
+		f.UploadTracker.ExitUpload(uid)
+		return err
+	}
+	return nil
+}
+
+// ExitUpload releases a shard claimed with EnterUpload or EnterUploadWait
+func (f *filestore) ExitUpload(uid util.UploadID) error {
+	err := f.locks.release(uid)
+	if xerr := f.UploadTracker.ExitUpload(uid); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+// checkLock ensures the shard's lock has not been taken over, it is called right before
+// a claimed shard is changed on disk
+func (f *filestore) checkLock(uid util.UploadID) error {
+	return f.locks.check(uid)
+}
+
+func lockKey(uid util.UploadID) string {
+	sum := sha256.Sum256([]byte(strconv.FormatUint(uid.CID, 10) + `/` + uid.IdxUUID.String() + `/` + uid.Well + `/` + uid.Shard))
+	return hex.EncodeToString(sum[:])
+}
+
+func (l *sharedLocks) lockPath(key string) string {
+	return filepath.Join(l.dir, key+lockExt)
+}
+
+func (l *sharedLocks) fencePath(key string) string {
+	return filepath.Join(l.dir, key+fenceExt)
+}
+
+// acquire takes the shard's lockfile, waiting for it until the context is done if wait is set.
+// A nil sharedLocks means shared locking is disabled.
+func (l *sharedLocks) acquire(ctx context.Context, uid util.UploadID, wait bool) error {
+	if l == nil {
+		return nil
+	}
+	key := lockKey(uid)
+	for {
+		err := l.tryAcquire(uid, key)
+		if err != util.ErrUploadInProgress || !wait {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return util.ErrUploadInProgress
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (l *sharedLocks) tryAcquire(uid util.UploadID, key string) (err error) {
+	pth := l.lockPath(key)
+	var fout *os.File
+	if fout, err = os.OpenFile(pth, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660); os.IsExist(err) {
+		if !l.breakStale(pth) {
+			return util.ErrUploadInProgress
+		}
+		if fout, err = os.OpenFile(pth, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660); os.IsExist(err) {
+			return util.ErrUploadInProgress
+		}
+	}
+	if err != nil {
+		return
+	}
+	rec := lockRecord{
+		Upload:   uid,
+		Owner:    l.owner,
+		Acquired: time.Now(),
+	}
+	if rec.Token, err = l.nextToken(key); err == nil {
+		err = json.NewEncoder(fout).Encode(rec)
+	}
+	if err == nil {
+		err = fout.Sync()
+	}
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(pth)
+		return
+	}
+	hl := &heldLock{
+		key:   key,
+		token: rec.Token,
+		done:  make(chan struct{}),
+	}
+	l.mtx.Lock()
+	l.held[uid] = hl
+	l.mtx.Unlock()
+	hl.wg.Add(1)
+	go l.renew(hl)
+	return
+}
+
+// nextToken issues the shard's next fencing token, the caller holds the lockfile
+func (l *sharedLocks) nextToken(key string) (token uint64, err error) {
+	pth := l.fencePath(key)
+	var bts []byte
+	if bts, err = os.ReadFile(pth); err == nil {
+		if token, err = strconv.ParseUint(strings.TrimSpace(string(bts)), 10, 64); err != nil {
+			err = fmt.Errorf("Corrupt fencing token file %s: %w", pth, err)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	token++
+	//write beside the fence file and rename over it so readers never see a partial token
+	tmp := pth + `.` + uuid.New().String()
+	if err = os.WriteFile(tmp, []byte(strconv.FormatUint(token, 10)), 0660); err != nil {
+		os.Remove(tmp)
+		return
+	} else if err = os.Rename(tmp, pth); err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// breakStale removes a lockfile whose holder has not renewed it within the lease, returning
+// true if the lock is now free.  The lockfile is renamed aside first so only one server can
+// break it, if it turns out to have been replaced by a fresh lock in the meantime it is put back.
+func (l *sharedLocks) breakStale(pth string) bool {
+	fi, err := os.Stat(pth)
+	if err != nil {
+		return os.IsNotExist(err)
+	} else if time.Since(fi.ModTime()) < l.lease {
+		return false
+	}
+	aside := pth + staleInfix + uuid.New().String()
+	if err = os.Rename(pth, aside); err != nil {
+		return os.IsNotExist(err) //someone else broke it first
+	}
+	if afi, err := os.Stat(aside); err == nil && !afi.ModTime().Equal(fi.ModTime()) {
+		//we moved a lock taken after our check, its holder finds out when it checks its token
+		os.Link(aside, pth)
+		os.Remove(aside)
+		return false
+	}
+	os.Remove(aside)
+	return true
+}
+
+// renew keeps a held lockfile's lease alive until it is released or taken over
+func (l *sharedLocks) renew(hl *heldLock) {
+	defer hl.wg.Done()
+	tckr := time.NewTicker(l.lease / 4)
+	defer tckr.Stop()
+	pth := l.lockPath(hl.key)
+	for {
+		select {
+		case <-hl.done:
+			return
+		case <-tckr.C:
+		}
+		if rec, err := readLock(pth); err != nil || rec.Token != hl.token {
+			return //lost, the holder finds out when it checks its token
+		}
+		now := time.Now()
+		os.Chtimes(pth, now, now)
+	}
+}
+
+// check ensures the shard's lockfile and fencing token are still the ones this server was issued
+func (l *sharedLocks) check(uid util.UploadID) error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	hl, ok := l.held[uid]
+	l.mtx.Unlock()
+	if !ok {
+		return util.ErrUploadNotInProgress
+	}
+	if rec, err := readLock(l.lockPath(hl.key)); err != nil || rec.Token != hl.token {
+		return ErrLockLost
+	}
+	bts, err := os.ReadFile(l.fencePath(hl.key))
+	if err != nil {
+		return ErrLockLost
+	} else if token, err := strconv.ParseUint(strings.TrimSpace(string(bts)), 10, 64); err != nil || token != hl.token {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// release stops renewing the shard's lockfile and removes it, unless it was taken over
+func (l *sharedLocks) release(uid util.UploadID) error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	hl, ok := l.held[uid]
+	delete(l.held, uid)
+	l.mtx.Unlock()
+	if !ok {
+		return nil //the in-memory tracker reports releasing an unclaimed shard
+	}
+	close(hl.done)
+	hl.wg.Wait()
+	pth := l.lockPath(hl.key)
+	if rec, err := readLock(pth); err != nil || rec.Token != hl.token {
+		return nil //taken over, the lockfile belongs to the new holder
+	}
+	if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readLock(pth string) (rec lockRecord, err error) {
+	var bts []byte
+	if bts, err = os.ReadFile(pth); err == nil {
+		err = json.Unmarshal(bts, &rec)
+	}
+	return
+}
@@ -0,0 +1,117 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+func newSharedStore(t *testing.T, dir, owner string) *filestore {
+	t.Helper()
+	fs, err := NewFilestoreHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = fs.SetSharedLocking(SharedLockConfig{Owner: owner, Lease: MinLockLease}); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestSharedLocking(t *testing.T) {
+	dir := t.TempDir()
+	a := newSharedStore(t, dir, `a`)
+	b := newSharedStore(t, dir, `b`)
+	uid := util.UploadID{CID: 1, IdxUUID: uuid.New(), Well: `default`, Shard: `76a00`}
+	lockPath := a.locks.lockPath(lockKey(uid))
+
+	//a shard held by one server cannot be claimed by the other
+	if err := a.EnterUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if err = b.EnterUpload(uid); err != util.ErrUploadInProgress {
+		t.Fatalf("claimed a locked shard: %v", err)
+	} else if err = b.EnterUploadWait(context.Background(), uid, 2*lockPollInterval); err != util.ErrUploadInProgress {
+		t.Fatalf("claimed a locked shard after waiting: %v", err)
+	} else if err = a.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if err = b.EnterUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if err = b.checkLock(uid); err != nil {
+		t.Fatal(err)
+	} else if err = b.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Fatalf("lockfile left behind: %v", err)
+	}
+
+	//a lock which was not renewed within its lease is taken over, and the
+	//stalled holder is fenced off
+	if err := a.EnterUpload(uid); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	} else if err = b.EnterUpload(uid); err != nil {
+		t.Fatalf("stale lock was not taken over: %v", err)
+	} else if err = a.checkLock(uid); err != ErrLockLost {
+		t.Fatalf("stalled holder was not fenced: %v", err)
+	} else if err = a.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if err = b.checkLock(uid); err != nil {
+		t.Fatalf("stalled holder released the new lock: %v", err)
+	} else if err = b.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedRecoverUnpacks(t *testing.T) {
+	dir := t.TempDir()
+	a := newSharedStore(t, dir, `a`)
+	b := newSharedStore(t, dir, `b`)
+	uid := util.UploadID{CID: 1, IdxUUID: uuid.New(), Well: `default`, Shard: `76a00`}
+	shardDir := filepath.Join(dir, `1`, uid.IdxUUID.String(), `default`, `76a00`)
+	tempDir := unpackTempDir(shardDir)
+	if err := os.MkdirAll(tempDir, 0770); err != nil {
+		t.Fatal(err)
+	}
+
+	//b starting up while a is unpacking leaves a's unpack alone
+	if err := a.EnterUpload(uid); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := a.beginUnpack(uid, shardDir, tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := b.RecoverUnpacks(); err != nil || len(rec) != 0 {
+		t.Fatalf("recovered a running unpack %+v %v", rec, err)
+	} else if _, err = os.Stat(tempDir); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	//once a has gone it is recovered
+	if err = a.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := b.RecoverUnpacks(); err != nil || len(rec) != 1 || rec[0].Completed {
+		t.Fatalf("bad recovery %+v %v", rec, err)
+	} else if _, err = os.Stat(tempDir); !os.IsNotExist(err) {
+		t.Fatalf("partial unpack left behind: %v", err)
+	}
+}
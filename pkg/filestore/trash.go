@@ -0,0 +1,180 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+const (
+	trashDir       = `.trash` //not a valid indexer UUID, so never listed as an indexer
+	trashEntryFile = `trash.json`
+)
+
+// SetTrashRetention sets how long deleted shards are kept in the customer's trash before
+// they are destroyed, zero destroys shards as soon as they are deleted
+func (f *filestore) SetTrashRetention(d time.Duration) {
+	f.trashRetention = d
+}
+
+// trashShard moves a shard directory into the customer's trash, the shard must be held
+func (f *filestore) trashShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard, shardDir string) (err error) {
+	now := time.Now().UTC()
+	te := util.TrashEntry{
+		ID:      uuid.New().String(),
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+		Deleted: now,
+		Expires: now.Add(f.trashRetention),
+	}
+	if te.Size, err = dirSize(shardDir); err != nil {
+		return
+	}
+	entryDir := filepath.Join(f.custTrashDir(cid), te.ID)
+	if err = os.MkdirAll(entryDir, 0770); err != nil {
+		return
+	}
+	var bts []byte
+	if bts, err = json.Marshal(te); err != nil {
+		os.RemoveAll(entryDir)
+		return
+	} else if err = ioutil.WriteFile(filepath.Join(entryDir, trashEntryFile), bts, 0660); err != nil {
+		os.RemoveAll(entryDir)
+		return
+	} else if err = os.Rename(shardDir, filepath.Join(entryDir, shard)); err != nil {
+		os.RemoveAll(entryDir)
+		return
+	}
+	//this is a convenient time to get rid of anything which has expired
+	_, err = f.purgeCustomerTrash(ctx, cid, now)
+	return
+}
+
+// ListTrash returns the shards in a customer's trash, oldest deletion first
+func (f *filestore) ListTrash(cid uint64) (ents []util.TrashEntry, err error) {
+	var dents []os.DirEntry
+	if dents, err = os.ReadDir(f.custTrashDir(cid)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil //nothing has been deleted
+		}
+		return
+	}
+	for _, dent := range dents {
+		if te, terr := f.readTrashEntry(cid, dent.Name()); terr == nil {
+			ents = append(ents, te)
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Deleted.Before(ents[j].Deleted) })
+	return
+}
+
+// RestoreShard moves a shard out of the trash and back to where it was deleted from, if the
+// shard has been stored again since it was deleted util.ErrShardExists is returned
+func (f *filestore) RestoreShard(cid uint64, id string) (te util.TrashEntry, err error) {
+	if _, err = uuid.Parse(id); err != nil {
+		err = os.ErrNotExist
+		return
+	} else if te, err = f.readTrashEntry(cid, id); err != nil {
+		return
+	}
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: te.IdxUUID,
+		Well:    te.Well,
+		Shard:   te.Shard,
+	}
+	if err = f.EnterUpload(uid); err != nil {
+		return
+	}
+	defer f.ExitUpload(uid)
+	wellDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), te.IdxUUID.String(), te.Well)
+	shardDir := filepath.Join(wellDir, te.Shard)
+	if _, err = os.Stat(shardDir); err == nil {
+		err = util.ErrShardExists
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	entryDir := filepath.Join(f.custTrashDir(cid), id)
+	if err = os.MkdirAll(wellDir, 0770); err != nil {
+		return
+	} else if err = os.Rename(filepath.Join(entryDir, te.Shard), shardDir); err != nil {
+		return
+	}
+	err = os.RemoveAll(entryDir)
+	return
+}
+
+// PurgeTrash destroys every trashed shard whose retention period has passed, shards
+// from wells under legal hold are kept until the hold is lifted
+func (f *filestore) PurgeTrash(ctx context.Context) (purged []util.TrashEntry, err error) {
+	var custs []os.DirEntry
+	if custs, err = os.ReadDir(f.basedir); err != nil {
+		return
+	}
+	now := time.Now()
+	for _, cust := range custs {
+		cid, perr := strconv.ParseUint(cust.Name(), 10, 64)
+		if perr != nil || !cust.IsDir() {
+			continue
+		}
+		var p []util.TrashEntry
+		p, err = f.purgeCustomerTrash(ctx, cid, now)
+		purged = append(purged, p...)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (f *filestore) purgeCustomerTrash(ctx context.Context, cid uint64, now time.Time) (purged []util.TrashEntry, err error) {
+	var ents []util.TrashEntry
+	if ents, err = f.ListTrash(cid); err != nil {
+		return
+	}
+	for _, te := range ents {
+		if err = ctx.Err(); err != nil {
+			return
+		} else if te.Expires.After(now) || f.holds.Held(cid, te.Well) {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(f.custTrashDir(cid), te.ID)); err != nil {
+			return
+		}
+		purged = append(purged, te)
+	}
+	return
+}
+
+func (f *filestore) readTrashEntry(cid uint64, id string) (te util.TrashEntry, err error) {
+	var bts []byte
+	if bts, err = ioutil.ReadFile(filepath.Join(f.custTrashDir(cid), id, trashEntryFile)); err != nil {
+		return
+	}
+	err = json.Unmarshal(bts, &te)
+	return
+}
+
+func (f *filestore) custTrashDir(cid uint64) string {
+	return filepath.Join(f.basedir, strconv.FormatUint(cid, 10), trashDir)
+}
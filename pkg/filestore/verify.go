@@ -0,0 +1,180 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+const (
+	scratchDir = `.scratch` //not a valid customer number, so never treated as a customer
+)
+
+// VerifyShard checks a stored shard without sending it anywhere.  Every stored file is read
+// back and compared with the checksums recorded when the shard was pushed, the shard is
+// packed exactly as a pull would send it and unpacked into a scratch directory where each
+// file is compared with the stored copy, and the store and index files a shard needs must
+// be present.  Problems found with the shard are listed in the report,
+// an error is only returned if the shard could not be checked at all.
+func (f *filestore) VerifyShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string) (sv util.ShardVerification, err error) {
+	if well == `` || well == `.` || well == `..` || strings.ContainsAny(well, `/\`) {
+		err = ErrInvalidWell
+		return
+	}
+	var id util.ShardID
+	if id, _, err = util.ParseShardName(shard); err != nil {
+		return
+	}
+	shardDir := filepath.Join(f.basedir, strconv.FormatUint(cid, 10), idxUUID.String(), well, shard)
+	if err = readableDir(shardDir); err != nil {
+		return
+	}
+	sv.Shard = shard
+	sv.Checked = time.Now().UTC()
+
+	var scratch string
+	if err = os.MkdirAll(filepath.Join(f.basedir, scratchDir), 0770); err != nil {
+		return
+	} else if scratch, err = os.MkdirTemp(filepath.Join(f.basedir, scratchDir), `verify`); err != nil {
+		return
+	}
+	defer os.RemoveAll(scratch)
+
+	//run the shard through the pull path into the scratch directory
+	pr, pw := io.Pipe()
+	packErr := make(chan error, 1)
+	go func() {
+		err := f.PackShard(ctx, cid, idxUUID, well, shard, pw)
+		pw.CloseWithError(err)
+		packErr <- err
+	}()
+	var up *shardpacker.Unpacker
+	if up, err = shardpacker.NewUnpacker(shard, pr); err == nil {
+		err = up.Unpack(scratchHandler{handler{sdir: scratch, wcfg: f.wcfg}})
+	}
+	pr.CloseWithError(err)
+	packed := err == nil
+	if perr := <-packErr; perr != nil {
+		err = perr //the packing error is the interesting one
+		packed = false
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return //the request went away
+		} else if derr := readableDir(shardDir); derr != nil {
+			err = derr //the shard was deleted out from under us
+			return
+		}
+		sv.Problems = append(sv.Problems, fmt.Sprintf("failed to pack and unpack shard: %v", err))
+		err = nil
+	}
+
+	//read back every stored file, a read error here is exactly the sort of corruption we are looking for
+	if sv.Files, err = util.ShardFiles(shardDir); err != nil {
+		if derr := readableDir(shardDir); derr != nil {
+			err = derr
+			return
+		}
+		sv.Problems = append(sv.Problems, fmt.Sprintf("failed to read stored shard: %v", err))
+		err = nil
+	}
+	stored := make(map[string]util.ShardFile, len(sv.Files))
+	for _, sf := range sv.Files {
+		stored[sf.Name] = sf
+	}
+
+	//the manifest holds the checksums taken as the shard was pushed, any difference is corruption
+	if mfiles, ok, merr := util.ReadManifest(shardDir); merr != nil {
+		sv.Problems = append(sv.Problems, fmt.Sprintf("failed to read manifest: %v", merr))
+	} else if ok {
+		sv.Manifest = true
+		for _, mf := range mfiles {
+			if sf, ok := stored[mf.Name]; !ok {
+				sv.Problems = append(sv.Problems, fmt.Sprintf("%s was pushed but is missing", mf.Name))
+			} else if sf != mf {
+				sv.Problems = append(sv.Problems, fmt.Sprintf("%s was pushed with size %d and checksum %s but now has size %d and checksum %s",
+					mf.Name, mf.Size, mf.SHA256, sf.Size, sf.SHA256))
+			}
+		}
+	}
+
+	//everything a pull sends must match the stored copy, there is nothing to compare if the pull failed
+	if packed {
+		var unpacked []util.ShardFile
+		if unpacked, err = util.ShardFiles(scratch); err != nil {
+			return
+		}
+		for _, uf := range unpacked {
+			if sf, ok := stored[uf.Name]; !ok {
+				sv.Problems = append(sv.Problems, fmt.Sprintf("%s was sent but is not stored", uf.Name))
+			} else if sf != uf {
+				sv.Problems = append(sv.Problems, fmt.Sprintf("%s was sent with size %d and checksum %s but is stored with size %d and checksum %s",
+					uf.Name, uf.Size, uf.SHA256, sf.Size, sf.SHA256))
+			}
+			delete(stored, uf.Name)
+		}
+		for name := range stored {
+			if ft, terr := shardpacker.FilenameToType(path.Base(name)); terr == nil && isDataFile(ft) {
+				sv.Problems = append(sv.Problems, fmt.Sprintf("%s is stored but was not sent", name))
+			}
+		}
+	}
+
+	//the store and index files are required, like the packer we allow for shards without a verify file
+	for _, ft := range []shardpacker.Ftype{shardpacker.Store, shardpacker.Index} {
+		if name := ft.Filepath(id.Name()); !hasFile(sv.Files, name) {
+			sv.Problems = append(sv.Problems, fmt.Sprintf("%s is missing", name))
+		}
+	}
+	sv.Passed = len(sv.Problems) == 0
+	return
+}
+
+// isDataFile returns true for the file types a pull always sends
+func isDataFile(ft shardpacker.Ftype) bool {
+	switch ft {
+	case shardpacker.Store, shardpacker.Index, shardpacker.Verify, shardpacker.AccelFile,
+		shardpacker.IndexAccelKeyFile, shardpacker.IndexAccelDataFile:
+		return true
+	}
+	return false
+}
+
+func hasFile(files []util.ShardFile, name string) bool {
+	for _, sf := range files {
+		if sf.Name == filepath.ToSlash(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// scratchHandler unpacks a shard into a scratch directory, pulled shards carry no tags
+// but any that turn up must not be merged into the indexer's real tag set
+type scratchHandler struct {
+	handler
+}
+
+func (sh scratchHandler) HandleTagUpdate(tgs []tags.TagPair) error {
+	return nil
+}
@@ -0,0 +1,184 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gravwell/cloudarchive/pkg/safepath"
+	"github.com/gravwell/cloudarchive/pkg/util"
+)
+
+// WriteStrategy selects how shard files are written out as they are unpacked
+type WriteStrategy string
+
+const (
+	// WriteBuffered leaves writeback to the kernel, files land in the page cache first
+	WriteBuffered WriteStrategy = `buffered`
+	// WriteDirect flushes each buffer to disk as it is written and drops it from the page
+	// cache, huge shards then stream at disk speed without evicting everything else
+	WriteDirect WriteStrategy = `direct`
+
+	DefaultWriteBufferSize = 1024 * 1024
+	maxWriteBufferSize     = 256 * 1024 * 1024
+)
+
+var (
+	ErrInvalidWriteStrategy = errors.New("Invalid write strategy")
+
+	writeBufPool sync.Pool // *[]byte, buffers of a different size are dropped
+)
+
+// WriteConfig controls how the file store writes shard files
+type WriteConfig struct {
+	Strategy    WriteStrategy // empty is WriteBuffered
+	BufferSize  int           // bytes read from the stream per write, zero is DefaultWriteBufferSize
+	Preallocate bool          // reserve each file's full size before writing it, where supported
+}
+
+// Validate checks the strategy and buffer size
+func (wc WriteConfig) Validate() error {
+	switch wc.Strategy {
+	case ``, WriteBuffered, WriteDirect:
+	default:
+		return fmt.Errorf("%w %q", ErrInvalidWriteStrategy, wc.Strategy)
+	}
+	if wc.BufferSize < 0 || wc.BufferSize > maxWriteBufferSize {
+		return fmt.Errorf("Write buffer size %d must be between 0 and %d", wc.BufferSize, maxWriteBufferSize)
+	}
+	return nil
+}
+
+// SetWriteConfig sets how shard files are written, it applies to pushes started afterwards
+func (f *filestore) SetWriteConfig(wc WriteConfig) error {
+	if err := wc.Validate(); err != nil {
+		return err
+	}
+	if wc.Strategy == `` {
+		wc.Strategy = WriteBuffered
+	}
+	if wc.BufferSize == 0 {
+		wc.BufferSize = DefaultWriteBufferSize
+	}
+	f.wcfg = wc
+	return nil
+}
+
+// writeFile writes a shard file from the stream, size is the expected length or -1 if unknown
+func (h handler) writeFile(pth string, size int64, rdr io.Reader) (err error) {
+	//the path comes off the wire, make sure it stays inside the shard directory
+	if pth, err = safepath.Sanitize(pth); err != nil {
+		return
+	}
+	if dir := filepath.Dir(pth); dir != `.` {
+		if err = os.MkdirAll(filepath.Join(h.sdir, dir), 0770); err != nil {
+			return
+		}
+	}
+	var fout *os.File
+	if fout, err = os.Create(filepath.Join(h.sdir, pth)); err != nil {
+		return
+	}
+	var hr *hashReader
+	if h.mf != nil {
+		hr = &hashReader{rdr: rdr, h: sha256.New()}
+		rdr = hr
+	}
+	if err = h.copyFile(fout, size, rdr); err != nil {
+		fout.Close()
+		return
+	} else if err = fout.Close(); err != nil {
+		return
+	}
+	if hr != nil {
+		h.mf.files = append(h.mf.files, util.ShardFile{
+			Name:   filepath.ToSlash(pth),
+			Size:   hr.n,
+			SHA256: hex.EncodeToString(hr.h.Sum(nil)),
+		})
+	}
+	return
+}
+
+// manifest collects the sizes and checksums of the files written for a shard
+type manifest struct {
+	files []util.ShardFile
+}
+
+// hashReader hashes and counts what is read through it
+type hashReader struct {
+	rdr io.Reader
+	h   hash.Hash
+	n   int64
+}
+
+func (hr *hashReader) Read(b []byte) (n int, err error) {
+	n, err = hr.rdr.Read(b)
+	hr.n += int64(n)
+	hr.h.Write(b[:n])
+	return
+}
+
+func (h handler) copyFile(fout *os.File, size int64, rdr io.Reader) (err error) {
+	wc := h.wcfg
+	if wc.BufferSize <= 0 {
+		wc.BufferSize = DefaultWriteBufferSize
+	}
+	var prealloc bool
+	if wc.Preallocate && size > 0 {
+		//filesystems which cannot preallocate just grow the file as it is written
+		prealloc = preallocate(fout, size) == nil
+	}
+	//os.File.ReadFrom ignores our buffer size, so fill and write the buffer ourselves
+	bp := getWriteBuffer(wc.BufferSize)
+	defer writeBufPool.Put(bp)
+	buf := *bp
+	var off int64
+	for {
+		n, rerr := io.ReadFull(rdr, buf)
+		if n > 0 {
+			if _, err = fout.Write(buf[:n]); err != nil {
+				return
+			}
+			if wc.Strategy == WriteDirect {
+				if err = dropWritten(fout, off, int64(n)); err != nil {
+					return
+				}
+			}
+			off += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			err = rerr
+			return
+		}
+	}
+	if prealloc && off < size {
+		//the stream came up short, don't leave preallocated zeros on the end
+		err = fout.Truncate(off)
+	}
+	return
+}
+
+func getWriteBuffer(sz int) *[]byte {
+	if bp, ok := writeBufPool.Get().(*[]byte); ok && len(*bp) == sz {
+		return bp
+	}
+	b := make([]byte, sz)
+	return &b
+}
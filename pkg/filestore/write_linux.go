@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes of disk for the file so it is laid out contiguously
+func preallocate(fout *os.File, size int64) error {
+	return unix.Fallocate(int(fout.Fd()), 0, 0, size)
+}
+
+// dropWritten waits for a written range to reach the disk and evicts it from the page cache
+func dropWritten(fout *os.File, off, n int64) error {
+	fd := int(fout.Fd())
+	flags := unix.SYNC_FILE_RANGE_WAIT_BEFORE | unix.SYNC_FILE_RANGE_WRITE | unix.SYNC_FILE_RANGE_WAIT_AFTER
+	if err := unix.SyncFileRange(fd, off, n, flags); err != nil {
+		return err
+	}
+	return unix.Fadvise(fd, off, n, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package filestore
+
+import (
+	"errors"
+	"os"
+)
+
+// preallocate is not implemented on this platform, files grow as they are written
+func preallocate(fout *os.File, size int64) error {
+	return errors.New("preallocation is not supported")
+}
+
+// dropWritten flushes the file, this platform offers no way to evict just the written range
+func dropWritten(fout *os.File, off, n int64) error {
+	return fout.Sync()
+}
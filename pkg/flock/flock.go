@@ -1,9 +1,3 @@
-//go:build !windows && !plan9 && !solaris
-// +build !windows,!plan9,!solaris
-
-//this package is based on the flock implementation used in boltdb
-//which is MIT licensed and available at:
-//	https://github.com/boltdb/bolt/blob/master/bolt_unix.go
 /*************************************************************************
  * Copyright 2023 Gravwell, Inc. All rights reserved.
  * Contact: <legal@gravwell.io>
@@ -12,12 +6,19 @@
  * BSD 2-clause license. See the LICENSE file for details.
  **************************************************************************/
 
+// Package flock provides advisory whole file locks.  Locks are taken with fcntl
+// on unix systems and LockFileEx on windows.
 package flock
 
 import (
 	"errors"
 	"os"
-	"syscall"
+	"time"
+)
+
+const (
+	minBackoff = time.Millisecond
+	maxBackoff = 100 * time.Millisecond
 )
 
 var (
@@ -25,36 +26,26 @@ var (
 	ErrLocked  = errors.New("File is already locked")
 )
 
-// Flock locks a file for this process, this DOES NOT prevent the same process
-// from opening the
-func Flock(f *os.File, exclusive bool) error {
-	var lock syscall.Flock_t
-	lock.Start = 0
-	lock.Len = 0
-	lock.Pid = 0
-	lock.Whence = 0
-	lock.Pid = 0
-	if exclusive {
-		lock.Type = syscall.F_WRLCK
-	} else {
-		lock.Type = syscall.F_RDLCK
-	}
-	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
-	if err == nil {
-		return nil
-	} else if err == syscall.EAGAIN {
-		return ErrLocked
+// FlockTimeout locks a file like Flock, but if the file is locked elsewhere it retries
+// with an increasing backoff until the lock is acquired or the timeout expires.
+// ErrTimeout is returned if the lock could not be acquired in time.
+func FlockTimeout(f *os.File, exclusive bool, d time.Duration) error {
+	deadline := time.Now().Add(d)
+	backoff := minBackoff
+	for {
+		if err := Flock(f, exclusive); err != ErrLocked {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrTimeout
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
-	return err
-}
-
-// Funlock releases a lock held on a file descriptor
-func Funlock(f *os.File) error {
-	var lock syscall.Flock_t
-	lock.Start = 0
-	lock.Len = 0
-	lock.Type = syscall.F_UNLCK
-	lock.Whence = 0
-	return syscall.FcntlFlock(uintptr(f.Fd()), syscall.F_SETLK, &lock)
-
 }
@@ -0,0 +1,101 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package flock
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	helperEnv = `GRAVFLOCK_HELPER_PATH`
+)
+
+// TestLockHelper is not a real test, it is run in a child process to hold a lock
+// on a file until its stdin is closed
+func TestLockHelper(t *testing.T) {
+	pth := os.Getenv(helperEnv)
+	if pth == `` {
+		t.Skip("lock helper process only")
+	}
+	f, err := os.OpenFile(pth, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Flock(f, true); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString("locked\n")
+	ioutil.ReadAll(os.Stdin)
+	Funlock(f)
+	f.Close()
+}
+
+func TestFlockTimeout(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), `gravflock`)
+	if err := ioutil.WriteFile(pth, nil, 0660); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(pth, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// an uncontended lock is taken immediately
+	if err = FlockTimeout(f, true, time.Second); err != nil {
+		t.Fatal(err)
+	} else if err = Funlock(f); err != nil {
+		t.Fatal(err)
+	}
+
+	// locks are per process, so hold the lock from a child
+	cmd := exec.Command(os.Args[0], `-test.run=^TestLockHelper$`)
+	cmd.Env = append(os.Environ(), helperEnv+`=`+pth)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	if ln, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || ln != "locked\n" {
+		t.Fatalf("helper failed to lock: %q %v", ln, err)
+	}
+
+	if err = Flock(f, true); err != ErrLocked {
+		t.Fatalf("failed to catch held lock: %v", err)
+	}
+	start := time.Now()
+	if err = FlockTimeout(f, true, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("failed to time out: %v", err)
+	} else if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("returned before the timeout: %v", time.Since(start))
+	}
+
+	// release the lock while waiting on it
+	time.AfterFunc(100*time.Millisecond, func() { stdin.Close() })
+	if err = FlockTimeout(f, true, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = Funlock(f); err != nil {
+		t.Fatal(err)
+	}
+}
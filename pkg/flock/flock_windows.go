@@ -0,0 +1,48 @@
+//go:build windows
+// +build windows
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package flock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// windows locks are mandatory, so rather than locking the file contents we lock
+	// a single byte far past the end of the file.  This keeps the lock advisory like
+	// the unix implementation, other handles can still read and write the file.
+	lockOffsetHigh uint32 = 0x7fffffff
+)
+
+// Flock locks a file for this process, unlike the unix implementation a shared lock
+// held by this process cannot be upgraded to an exclusive lock
+func Flock(f *os.File, exclusive bool) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &ol)
+	if err == nil {
+		return nil
+	} else if err == windows.ERROR_LOCK_VIOLATION || err == windows.ERROR_IO_PENDING {
+		return ErrLocked
+	}
+	return err
+}
+
+// Funlock releases a lock held on a file descriptor
+func Funlock(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
@@ -0,0 +1,92 @@
+//go:build windows
+// +build windows
+
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package flock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openPair(t *testing.T) (a, b *os.File) {
+	pth := filepath.Join(t.TempDir(), `gravflock`)
+	if err := ioutil.WriteFile(pth, []byte(`testing`), 0660); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if a, err = os.OpenFile(pth, os.O_RDWR, 0660); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	if b, err = os.OpenFile(pth, os.O_RDWR, 0660); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return
+}
+
+func TestLockUnlock(t *testing.T) {
+	a, _ := openPair(t)
+	for i := 0; i < 2; i++ {
+		if err := Flock(a, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := Funlock(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLockExclusive(t *testing.T) {
+	a, b := openPair(t)
+	if err := Flock(a, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := Flock(b, false); err != ErrLocked {
+		t.Fatalf("failed to catch exclusive lock: %v", err)
+	}
+	// the lock is advisory, the contents remain readable through other handles
+	if bts, err := ioutil.ReadAll(b); err != nil {
+		t.Fatal(err)
+	} else if string(bts) != `testing` {
+		t.Fatalf("bad file contents %q", bts)
+	}
+	if err := Funlock(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := Flock(b, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := Funlock(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockShared(t *testing.T) {
+	a, b := openPair(t)
+	if err := Flock(a, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Flock(b, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Flock(b, true); err != ErrLocked {
+		t.Fatalf("failed to catch shared lock: %v", err)
+	}
+	if err := Funlock(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := Funlock(b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ftpstore
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+)
+
+// ctxConn is a connection which is closed when its context is done
+type ctxConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (cc *ctxConn) Close() error {
+	cc.once.Do(func() { close(cc.done) })
+	return cc.Conn.Close()
+}
+
+// contextDialer returns a dial function for the FTP client which ties both the control and
+// data connections to the context, closing them once it is done aborts whatever command,
+// listing, or transfer is in flight
+func contextDialer(ctx context.Context) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: dialTimeout}
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cc := &ctxConn{Conn: conn, done: make(chan struct{})}
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-cc.done:
+			}
+		}()
+		return cc, nil
+	}
+}
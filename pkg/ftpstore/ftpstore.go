@@ -9,6 +9,9 @@
 package ftpstore
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +23,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dolmen-go/contextio"
+	"github.com/gravwell/cloudarchive/pkg/safepath"
 	"github.com/gravwell/cloudarchive/pkg/shardpacker"
 	"github.com/gravwell/cloudarchive/pkg/tags"
 	"github.com/gravwell/cloudarchive/pkg/util"
@@ -30,6 +35,11 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+const (
+	DefaultPullWorkers = 4
+	DefaultPullQueue   = 32
+)
+
 var (
 	ErrMissingBaseDir = errors.New("Empty base directory for file store")
 
@@ -41,6 +51,11 @@ var (
 type ftpstore struct {
 	cfg FtpStoreConfig
 	util.UploadTracker
+	journal  *tagJournal // tags.dat pushes which have not reached the FTP server
+	pulls    *util.WorkPool
+	flushMtx sync.Mutex
+	done     chan struct{}
+	once     sync.Once
 }
 
 type FtpStoreConfig struct {
@@ -50,39 +65,103 @@ type FtpStoreConfig struct {
 	Username   string
 	Password   string
 	Lgr        *log.Logger
+
+	// Pulls fetch every shard file over FTP then repack them, at most PullWorkers run at
+	// once and PullQueue more may wait, further pulls are refused with util.ErrQueueFull.
+	// Zero selects DefaultPullWorkers and DefaultPullQueue.
+	PullWorkers int
+	PullQueue   int
 }
 
 func NewFtpStoreHandler(cfg FtpStoreConfig) (*ftpstore, error) {
 	if cfg.Lgr == nil {
 		cfg.Lgr = log.New(os.Stderr)
 	}
-	return &ftpstore{
+	if cfg.PullWorkers <= 0 {
+		cfg.PullWorkers = DefaultPullWorkers
+	}
+	if cfg.PullQueue <= 0 {
+		cfg.PullQueue = DefaultPullQueue
+	}
+	tj, err := openTagJournal(cfg.LocalStore)
+	if err != nil {
+		return nil, err
+	}
+	f := &ftpstore{
 		cfg:           cfg,
 		UploadTracker: util.NewUploadTracker(),
-	}, nil
+		journal:       tj,
+		pulls:         util.NewWorkPool(cfg.PullWorkers, cfg.PullQueue),
+		done:          make(chan struct{}),
+	}
+	if n := tj.len(); n > 0 {
+		cfg.Lgr.Warn("tags.dat pushes pending from a previous run", log.KV("count", n))
+	}
+	go f.flushRoutine()
+	return f, nil
+}
+
+// Close stops retrying pending tags.dat pushes, they remain in the journal for the next run,
+// and waits for pulls which are already running or queued
+func (f *ftpstore) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		f.pulls.Close()
+	})
+	return nil
 }
 
-func (f *ftpstore) getFtpClient() (*ftp.ServerConn, error) {
-	do := ftp.DialWithTimeout(10 * time.Second)
-	c, err := ftp.Dial(f.cfg.FtpServer, do)
+// getFtpClient connects and logs in to the FTP server, the connection is torn down when the
+// context is done so that work on behalf of a cancelled request stops.  Any pending tags.dat
+// pushes are retried before the client is returned.  Callers must Quit the client.
+func (f *ftpstore) getFtpClient(ctx context.Context) (*ftp.ServerConn, error) {
+	c, err := f.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.journal.len() > 0 {
+		f.flushTags(c)
+	}
+	return c, nil
+}
+
+// dial connects and logs in to the FTP server
+func (f *ftpstore) dial(ctx context.Context) (*ftp.ServerConn, error) {
+	c, err := ftp.Dial(f.cfg.FtpServer, ftp.DialWithDialFunc(contextDialer(ctx)))
 	if err != nil {
 		f.cfg.Lgr.Error("Failed to dial server", log.KV("address", f.cfg.FtpServer), log.KVErr(err))
 		return nil, err
 	}
 	if err = c.Login(f.cfg.Username, f.cfg.Password); err != nil {
 		f.cfg.Lgr.Error("Failed to log in", log.KV("address", f.cfg.FtpServer), log.KVErr(err))
+		c.Quit()
+		return nil, err
 	}
-	return c, err
+	return c, nil
 }
 
-func (f *ftpstore) ListIndexes(cid uint64) ([]string, error) {
+// Preflight ensures the FTP server accepts logins
+func (f *ftpstore) Preflight(ctx context.Context) error {
+	c, err := f.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Quit()
+	if err = c.NoOp(); err != nil {
+		return err
+	}
+	return writableDir(f.cfg.LocalStore)
+}
+
+func (f *ftpstore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
 	var indexes []string
 	var ents []*ftp.Entry
 	var err error
-	c, err := f.getFtpClient()
+	c, err := f.getFtpClient(ctx)
 	if err != nil {
 		return indexes, err
 	}
+	defer c.Quit()
 	custDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10))
 	if ents, err = c.List(custDir); err != nil {
 		return indexes, err
@@ -99,14 +178,15 @@ func (f *ftpstore) ListIndexes(cid uint64) ([]string, error) {
 	return indexes, err
 }
 
-func (f *ftpstore) ListIndexerWells(cid uint64, guid uuid.UUID) ([]string, error) {
+func (f *ftpstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
 	var wells []string
 	var ents []*ftp.Entry
 	var err error
-	c, err := f.getFtpClient()
+	c, err := f.getFtpClient(ctx)
 	if err != nil {
 		return wells, err
 	}
+	defer c.Quit()
 	idxDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10), guid.String())
 	if ents, err = c.List(idxDir); err != nil {
 		f.cfg.Lgr.Error("Failed to list index directory",
@@ -123,12 +203,13 @@ func (f *ftpstore) ListIndexerWells(cid uint64, guid uuid.UUID) ([]string, error
 	return wells, err
 }
 
-func (f *ftpstore) GetWellTimeframe(cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+func (f *ftpstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
 	var c *ftp.ServerConn
-	c, err = f.getFtpClient()
+	c, err = f.getFtpClient(ctx)
 	if err != nil {
 		return
 	}
+	defer c.Quit()
 	wellDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10), guid.String(), well)
 	// we will play it safe and walk every file
 	var ents []*ftp.Entry
@@ -154,12 +235,13 @@ func (f *ftpstore) GetWellTimeframe(cid uint64, guid uuid.UUID, well string) (t
 	return
 }
 
-func (f *ftpstore) GetShardsInTimeframe(cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+func (f *ftpstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
 	var c *ftp.ServerConn
-	c, err = f.getFtpClient()
+	c, err = f.getFtpClient(ctx)
 	if err != nil {
 		return
 	}
+	defer c.Quit()
 	wellDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10), guid.String(), well)
 	// we will play it safe and walk every file
 	var ents []*ftp.Entry
@@ -171,30 +253,26 @@ func (f *ftpstore) GetShardsInTimeframe(cid uint64, guid uuid.UUID, well string,
 		return
 	}
 	for _, info := range ents {
-		s, e, err := util.ShardNameToDateRange(info.Name)
-		if err != nil {
-			continue
-		}
-		// There are several ways for this to end up on the list:
-		switch {
-		// the start of the span falls within the shard
-		case s.Before(tf.Start) && e.After(tf.Start):
-			fallthrough
-		// the end of the span falls within the shard
-		case s.Before(tf.End) && e.After(tf.End):
-			fallthrough
-		// the span's start/end lands directly on the shard's start/end
-		case s.Equal(tf.End) || s.Equal(tf.Start) || e.Equal(tf.End) || e.Equal(tf.Start):
-			fallthrough
-		// the span entirely contains the shard
-		case tf.Start.Before(s) && tf.End.After(e):
+		if ok, err := tf.ShardOverlaps(info.Name); err == nil && ok {
 			shards = append(shards, info.Name)
 		}
 	}
 	return
 }
 
-func (f *ftpstore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) (err error) {
+func (f *ftpstore) UnpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, f.EnterUpload)
+}
+
+// UnpackShardWait is UnpackShard, but an upload of the same shard which is already in
+// progress is waited on for up to wait rather than immediately failing
+func (f *ftpstore) UnpackShardWait(ctx context.Context, wait time.Duration, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, func(uid util.UploadID) error {
+		return f.EnterUploadWait(ctx, uid, wait)
+	})
+}
+
+func (f *ftpstore) unpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader, enter func(util.UploadID) error) (err error) {
 	var up *shardpacker.Unpacker
 	uid := util.UploadID{
 		CID:     cid,
@@ -203,16 +281,20 @@ func (f *ftpstore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard string
 		Shard:   shard,
 	}
 
-	if err = f.EnterUpload(uid); err != nil {
+	if err = enter(uid); err != nil {
 		f.cfg.Lgr.Error("Failed to enter upload", log.KVErr(err))
 		return
 	}
+	rdr = f.CountReader(uid, rdr)
 
-	c, err := f.getFtpClient()
+	c, err := f.getFtpClient(ctx)
 	if err != nil {
 		f.ExitUpload(uid)
 		return err
 	}
+	defer c.Quit()
+	vfy := f.newVerifier(ctx)
+	defer vfy.close()
 
 	//generate the complete path to the customer/indexer upload location and make it
 	//this will create all nessasary directories
@@ -239,7 +321,9 @@ func (f *ftpstore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard string
 	}
 
 	h := handler{
+		store:      f,
 		client:     c,
+		verify:     vfy,
 		localStore: f.cfg.LocalStore,
 		cid:        cid,
 		sdir:       shardDir,
@@ -275,11 +359,20 @@ func (f *ftpstore) UnpackShard(cid uint64, idxUUID uuid.UUID, well, shard string
 	return
 }
 
-func (f *ftpstore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) (err error) {
-	c, err := f.getFtpClient()
+// PackShard fetches and repacks a shard on the pull worker pool, so that a burst of restores
+// queues for a bounded number of FTP sessions
+func (f *ftpstore) PackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) error {
+	return f.pulls.Do(ctx, func() error {
+		return f.packShard(ctx, cid, idxUUID, well, shard, wtr)
+	})
+}
+
+func (f *ftpstore) packShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	c, err := f.getFtpClient(ctx)
 	if err != nil {
 		return err
 	}
+	defer c.Quit()
 	uid := util.UploadID{
 		CID:     cid,
 		IdxUUID: idxUUID,
@@ -291,6 +384,7 @@ func (f *ftpstore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 	if err = f.EnterUpload(uid); err != nil {
 		return
 	}
+	wtr = contextio.NewWriter(ctx, f.CountWriter(uid, wtr))
 
 	// Figure out where we're pulling from
 	indexerDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10), idxUUID.String())
@@ -312,6 +406,10 @@ func (f *ftpstore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 	// Copy everything over
 	walker := c.Walk(shardDir)
 	for walker.Next() {
+		if err = ctx.Err(); err != nil {
+			f.ExitUpload(uid)
+			return
+		}
 		stat := walker.Stat()
 		if stat.Type == ftp.EntryTypeFile {
 			name := strings.TrimPrefix(walker.Path(), shardDir) // gives us e.g. "70cc2" or "70cc2.accel/data"
@@ -340,6 +438,10 @@ func (f *ftpstore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 			resp.Close()
 		}
 	}
+	if err = walker.Err(); err != nil {
+		f.ExitUpload(uid)
+		return
+	}
 
 	//fire up the routine that will relay from the packer to the writer
 	copyErrChan := make(chan error, 1)
@@ -394,14 +496,16 @@ func (f *ftpstore) PackShard(cid uint64, idxUUID uuid.UUID, well, shard string,
 	return
 }
 
-func (f *ftpstore) GetTags(cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+func (f *ftpstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
 	var c *ftp.ServerConn
-	c, err = f.getFtpClient()
+	c, err = f.getFtpClient(ctx)
 	if err != nil {
 		return
 	}
+	defer c.Quit()
 	indexerDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10), guid.String())
 	h := handler{
+		store:      f,
 		client:     c,
 		localStore: f.cfg.LocalStore,
 		cid:        cid,
@@ -424,14 +528,16 @@ func (f *ftpstore) GetTags(cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err
 	return
 }
 
-func (f *ftpstore) SyncTags(cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+func (f *ftpstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
 	var c *ftp.ServerConn
-	c, err = f.getFtpClient()
+	c, err = f.getFtpClient(ctx)
 	if err != nil {
 		return
 	}
+	defer c.Quit()
 	indexerDir := filepath.Join(f.cfg.BaseDir, strconv.FormatUint(cid, 10), guid.String())
 	h := handler{
+		store:      f,
 		client:     c,
 		localStore: f.cfg.LocalStore,
 		cid:        cid,
@@ -446,7 +552,8 @@ func (f *ftpstore) SyncTags(cid uint64, guid uuid.UUID, idxTags []tags.TagPair)
 		return
 	}
 	// Now merge
-	_, err = tm.Merge(idxTags)
+	var updated bool
+	updated, err = tm.Merge(idxTags)
 	if err != nil {
 		tags.ReleaseTagMan(cid, guid)
 		f.cfg.Lgr.Error("Failed merge tags", log.KVErr(err))
@@ -459,6 +566,10 @@ func (f *ftpstore) SyncTags(cid uint64, guid uuid.UUID, idxTags []tags.TagPair)
 	} else {
 		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
 	}
+	if err == nil && updated {
+		// Push the merged set up so the FTP copy does not lag
+		err = f.pushTags(c, cid, guid, indexerDir)
+	}
 	return
 }
 
@@ -497,8 +608,17 @@ func ftpMkdirAll(c *ftp.ServerConn, path string) error {
 	return nil
 }
 
+// BackupTags copies the local copy of every indexer's tags.dat into dir, the local
+// copies are the ones updated by tag syncs before being pushed to the FTP server
+func (f *ftpstore) BackupTags(ctx context.Context, dir string) (err error) {
+	_, err = tags.BackupTagDats(ctx, filepath.Join(f.cfg.LocalStore, f.cfg.BaseDir), dir)
+	return
+}
+
 type handler struct {
+	store      *ftpstore
 	client     *ftp.ServerConn
+	verify     *verifier // checks each stored file against what was sent
 	localStore string    // local storage directory, we keep tags.dat and such here
 	cid        uint64    //customer number
 	sdir       string    //shard directory
@@ -507,19 +627,23 @@ type handler struct {
 }
 
 func (h handler) HandleFile(pth string, rdr io.Reader) error {
-	//clean the path to ensure there are no relative path items
-	dir, file := clean(pth)
-	if dir != `` {
-		err := ftpMkdirAll(h.client, filepath.Join(h.sdir, dir))
-		if err != nil {
+	//the path comes off the wire, make sure it stays inside the shard directory
+	pth, err := safepath.Sanitize(pth)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(pth); dir != `.` {
+		if err = ftpMkdirAll(h.client, filepath.Join(h.sdir, dir)); err != nil {
 			return err
 		}
 	}
-	dest := filepath.Join(h.sdir, filepath.Join(dir, file))
-	if err := h.client.Stor(dest, rdr); err != nil {
+	dest := filepath.Join(h.sdir, pth)
+	sr := h.verify.newSentReader(rdr)
+	if err := h.client.Stor(dest, sr); err != nil {
 		return err
 	}
-	return nil
+	//the shard is only archived once we know the server has what we sent
+	return h.verify.check(h.client, dest, sr)
 }
 
 func (h handler) ensureTagsDat() error {
@@ -567,20 +691,6 @@ func (h handler) ensureTagsDat() error {
 	return nil
 }
 
-func (h handler) pushTagsDat() error {
-	// Grab the lock so we don't trounce anything
-	ftpSync.Lock()
-	defer ftpSync.Unlock()
-	remotePath := tags.GetTagDatPath(h.bdir)
-	localPath := filepath.Join(h.localStore, remotePath)
-	f, err := os.Open(localPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return h.client.Stor(remotePath, f)
-}
-
 func (h handler) HandleTagUpdate(tgs []tags.TagPair) error {
 	// Fetch tags.dat into the localstore dir if it doesn't exist
 	if err := h.ensureTagsDat(); err != nil {
@@ -601,18 +711,16 @@ func (h handler) HandleTagUpdate(tgs []tags.TagPair) error {
 		return err
 	}
 	// Push the result back up
-	return h.pushTagsDat()
+	return h.store.pushTags(h.client, h.cid, h.guid, h.bdir)
 }
 
-// clean removes any relative path elements and returns a potential single directory and file
-func clean(p string) (d, f string) {
-	p = filepath.Clean(p)
-	//remove any starting . and do it again
-	d, f = filepath.Split(filepath.Clean(strings.TrimLeft(p, "./")))
-	if d = filepath.Base(d); d == `.` {
-		d = ``
+// HandleMetadata stores the shard metadata alongside the shard files
+func (h handler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	bts, err := json.Marshal(md)
+	if err != nil {
+		return err
 	}
-	return
+	return h.HandleFile(shardpacker.Metadata.Filepath(md.Shard), bytes.NewReader(bts))
 }
 
 // writableDir ensures that the provided location exists, is a dir, and is R/W
@@ -0,0 +1,237 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ftpstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/tags"
+
+	"github.com/google/uuid"
+	gravlog "github.com/gravwell/gravwell/v3/ingest/log"
+	"goftp.io/server"
+	"goftp.io/server/core"
+	"goftp.io/server/driver/file"
+)
+
+const (
+	ftpAddr = `127.0.0.1:2021`
+	ftpUser = `gravwell`
+	ftpPass = `testpass`
+)
+
+var (
+	ftpRoot string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if ftpRoot, err = ioutil.TempDir(os.TempDir(), `gravcloud_ftpstore`); err != nil {
+		log.Fatal(err)
+	}
+	srv := server.NewServer(&server.ServerOpts{
+		Logger: &core.DiscardLogger{},
+		Auth:   &core.SimpleAuth{Name: ftpUser, Password: ftpPass},
+		Factory: &file.DriverFactory{
+			RootPath: ftpRoot,
+			Perm:     core.NewSimplePerm(ftpUser, `gravgroup`),
+		},
+		Port:     2021,
+		Hostname: `127.0.0.1`,
+	})
+	go srv.ListenAndServe()
+	//wait for the server to come up
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial(`tcp`, ftpAddr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r := m.Run()
+	srv.Shutdown()
+	os.RemoveAll(ftpRoot)
+	os.Exit(r)
+}
+
+func newTestStore(t *testing.T, local string) *ftpstore {
+	f, err := NewFtpStoreHandler(FtpStoreConfig{
+		FtpServer:  ftpAddr,
+		LocalStore: local,
+		BaseDir:    `testing`,
+		Username:   ftpUser,
+		Password:   ftpPass,
+		Lgr:        gravlog.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestTagJournal(t *testing.T) {
+	dir := t.TempDir()
+	tj, err := openTagJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	if err = tj.add(1, guid, `testing/1/tags.dat`); err != nil {
+		t.Fatal(err)
+	}
+	p := tj.list()[0]
+	//a change made while a push is in flight keeps the entry pending
+	if err = tj.add(1, guid, `testing/1/tags.dat`); err != nil {
+		t.Fatal(err)
+	} else if err = tj.done(p); err != nil {
+		t.Fatal(err)
+	} else if tj.len() != 1 {
+		t.Fatal("pending push dropped after a newer change")
+	}
+
+	//the journal survives a restart
+	if tj, err = openTagJournal(dir); err != nil {
+		t.Fatal(err)
+	} else if pts := tj.list(); len(pts) != 1 || pts[0].IdxUUID != guid || pts[0].CID != 1 {
+		t.Fatalf("bad reloaded journal: %+v", pts)
+	}
+	if err = tj.done(tj.list()[0]); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(dir, tagJournalFile)); !os.IsNotExist(err) {
+		t.Fatalf("empty journal left on disk: %v", err)
+	}
+}
+
+func TestTagsPushRetry(t *testing.T) {
+	f := newTestStore(t, t.TempDir())
+	guid := uuid.New()
+	bdir := filepath.Join(`testing`, `1`, guid.String())
+	remote := tags.GetTagDatPath(bdir)
+	if err := os.MkdirAll(filepath.Join(f.cfg.LocalStore, bdir), 0770); err != nil {
+		t.Fatal(err)
+	}
+	tm, err := tags.GetTagMan(1, guid, filepath.Join(f.cfg.LocalStore, bdir))
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = tm.Merge([]tags.TagPair{{Name: `foo`, Value: 10}}); err != nil {
+		t.Fatal(err)
+	} else if err = tags.ReleaseTagMan(1, guid); err != nil {
+		t.Fatal(err)
+	}
+
+	//the remote directory does not exist yet so the push fails and is journaled
+	c, err := f.getFtpClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+	if err = f.pushTags(c, 1, guid, bdir); err != nil {
+		t.Fatal(err)
+	} else if pts := f.journal.list(); len(pts) != 1 || pts[0].Attempts != 1 || pts[0].LastError == `` {
+		t.Fatalf("failed push not journaled: %+v", pts)
+	}
+
+	//the next operation flushes it, merging in tags which only exist remotely
+	if err = os.MkdirAll(filepath.Join(ftpRoot, bdir), 0770); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(ftpRoot, remote), []byte("default=0\ngravwell=65535\nbar=11\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := f.getFtpClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Quit()
+	if n := f.journal.len(); n != 0 {
+		t.Fatalf("%d pushes still pending", n)
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(ftpRoot, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tg := range []string{`foo=10`, `bar=11`} {
+		if !strings.Contains(string(bts), tg) {
+			t.Fatalf("pushed tags.dat is missing %s:\n%s", tg, bts)
+		}
+	}
+
+	//a remote copy which gives a tag another ID is never overwritten
+	conflict := []byte("default=0\ngravwell=65535\nfoo=12\n")
+	if err = ioutil.WriteFile(filepath.Join(ftpRoot, remote), conflict, 0660); err != nil {
+		t.Fatal(err)
+	} else if err = f.pushTags(c, 1, guid, bdir); err != nil {
+		t.Fatal(err)
+	}
+	if pts := f.journal.list(); len(pts) != 1 || !strings.Contains(pts[0].LastError, ErrTagsDiverged.Error()) {
+		t.Fatalf("divergence not recorded: %+v", pts)
+	}
+	if bts, err = ioutil.ReadFile(filepath.Join(ftpRoot, remote)); err != nil {
+		t.Fatal(err)
+	} else if string(bts) != string(conflict) {
+		t.Fatalf("diverged remote tags.dat overwritten:\n%s", bts)
+	}
+}
+
+func TestPickHashCommand(t *testing.T) {
+	tests := map[string]string{
+		"Extensions supported:\n UTF8\n SIZE\nEnd":             ``,
+		"Extensions supported:\n XCRC\n XSHA1\n MDTM\nEnd":     `XSHA1`,
+		"Extensions supported:\n xcrc \n XSHA256\n XSHA1\nEnd": `XSHA256`,
+		"Extensions supported:\n XCRC \"filename\" SP EP\nEnd": `XCRC`,
+		"Extensions supported:\n HASH SHA-256;SHA-1;MD5\nEnd":  ``,
+	}
+	for feat, want := range tests {
+		if got := pickHashCommand(feat); got != want {
+			t.Fatalf("%q picked %q, expected %q", feat, got, want)
+		}
+	}
+}
+
+func TestUploadVerify(t *testing.T) {
+	f := newTestStore(t, t.TempDir())
+	c, err := f.getFtpClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+	vfy := f.newVerifier(context.Background())
+	defer vfy.close()
+	if cmd := vfy.hashCommand(); cmd != `` {
+		t.Fatalf("test server has no hash commands, picked %q", cmd)
+	}
+
+	if err = ftpMkdirAll(c, `testing/verify`); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("some shard data\n", 1024))
+	sr := vfy.newSentReader(bytes.NewReader(data))
+	if err = c.Stor(`testing/verify/file`, sr); err != nil {
+		t.Fatal(err)
+	} else if err = vfy.check(c, `testing/verify/file`, sr); err != nil {
+		t.Fatal(err)
+	}
+
+	//a short write on the server side is caught
+	if err = ioutil.WriteFile(filepath.Join(ftpRoot, `testing/verify/file`), data[:100], 0660); err != nil {
+		t.Fatal(err)
+	} else if err = vfy.check(c, `testing/verify/file`, sr); !errors.Is(err, ErrUploadMismatch) {
+		t.Fatalf("truncated file not detected: %v", err)
+	}
+}
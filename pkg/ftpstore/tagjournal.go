@@ -0,0 +1,273 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ftpstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/jlaffaye/ftp"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tagJournalFile   = `tags-journal.json`
+	tagFlushInterval = time.Minute
+	tagFlushTimeout  = time.Minute
+)
+
+var (
+	ErrTagsDiverged = errors.New("remote tags.dat conflicts with the local copy")
+)
+
+// pendingTagPush is a tags.dat which was updated locally but has not yet reached the FTP server
+type pendingTagPush struct {
+	CID       uint64
+	IdxUUID   uuid.UUID
+	Remote    string // path of the tags.dat on the FTP server
+	Queued    time.Time
+	Seq       uint64 // bumped each time the local copy changes again
+	Attempts  int
+	LastError string `json:",omitempty"`
+}
+
+// tagJournal keeps the pending tags.dat pushes on disk so that they survive a restart
+type tagJournal struct {
+	sync.Mutex
+	path    string
+	seq     uint64
+	pending map[string]pendingTagPush // keyed by remote path
+}
+
+func openTagJournal(dir string) (tj *tagJournal, err error) {
+	tj = &tagJournal{
+		path:    filepath.Join(dir, tagJournalFile),
+		pending: map[string]pendingTagPush{},
+	}
+	var bts []byte
+	if bts, err = ioutil.ReadFile(tj.path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var pts []pendingTagPush
+	if err = json.Unmarshal(bts, &pts); err != nil {
+		err = fmt.Errorf("corrupt tags.dat journal %s: %w", tj.path, err)
+		return
+	}
+	for _, p := range pts {
+		tj.pending[p.Remote] = p
+		if p.Seq > tj.seq {
+			tj.seq = p.Seq
+		}
+	}
+	return
+}
+
+// add records that the tags.dat must be pushed, a push which is already pending keeps its place
+func (tj *tagJournal) add(cid uint64, guid uuid.UUID, remote string) error {
+	tj.Lock()
+	defer tj.Unlock()
+	tj.seq++
+	p, ok := tj.pending[remote]
+	if !ok {
+		p = pendingTagPush{
+			CID:     cid,
+			IdxUUID: guid,
+			Remote:  remote,
+			Queued:  time.Now().UTC(),
+		}
+	}
+	p.Seq = tj.seq
+	tj.pending[remote] = p
+	return tj.save()
+}
+
+// done removes a pending push, unless the local copy changed again after the push began
+func (tj *tagJournal) done(p pendingTagPush) error {
+	tj.Lock()
+	defer tj.Unlock()
+	if cur, ok := tj.pending[p.Remote]; !ok || cur.Seq != p.Seq {
+		return nil
+	}
+	delete(tj.pending, p.Remote)
+	return tj.save()
+}
+
+// failed records a failed attempt at a pending push
+func (tj *tagJournal) failed(p pendingTagPush, perr error) error {
+	tj.Lock()
+	defer tj.Unlock()
+	cur, ok := tj.pending[p.Remote]
+	if !ok {
+		return nil
+	}
+	cur.Attempts++
+	cur.LastError = perr.Error()
+	tj.pending[p.Remote] = cur
+	return tj.save()
+}
+
+// list returns the pending pushes, oldest first
+func (tj *tagJournal) list() (pts []pendingTagPush) {
+	tj.Lock()
+	for _, p := range tj.pending {
+		pts = append(pts, p)
+	}
+	tj.Unlock()
+	sort.Slice(pts, func(i, j int) bool { return pts[i].Queued.Before(pts[j].Queued) })
+	return
+}
+
+func (tj *tagJournal) len() (n int) {
+	tj.Lock()
+	n = len(tj.pending)
+	tj.Unlock()
+	return
+}
+
+// save writes the journal, the caller must hold the lock
+func (tj *tagJournal) save() (err error) {
+	if len(tj.pending) == 0 {
+		if err = os.Remove(tj.path); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	pts := make([]pendingTagPush, 0, len(tj.pending))
+	for _, p := range tj.pending {
+		pts = append(pts, p)
+	}
+	var bts []byte
+	if bts, err = json.Marshal(pts); err != nil {
+		return
+	} else if err = os.MkdirAll(filepath.Dir(tj.path), 0770); err != nil {
+		return
+	}
+	tmp := tj.path + `.tmp`
+	if err = ioutil.WriteFile(tmp, bts, 0660); err != nil {
+		return
+	} else if err = os.Rename(tmp, tj.path); err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// pushTags journals an updated tags.dat and tries to push it, a push which fails stays
+// in the journal to be retried rather than failing the caller
+func (f *ftpstore) pushTags(c *ftp.ServerConn, cid uint64, guid uuid.UUID, bdir string) error {
+	if err := f.journal.add(cid, guid, tags.GetTagDatPath(bdir)); err != nil {
+		return err
+	}
+	f.flushTags(c)
+	return nil
+}
+
+// flushTags tries each pending tags.dat push
+func (f *ftpstore) flushTags(c *ftp.ServerConn) {
+	if !f.flushMtx.TryLock() {
+		return //another flush is running, it or the next one will pick up anything new
+	}
+	defer f.flushMtx.Unlock()
+	for _, p := range f.journal.list() {
+		if err := f.pushTagsDat(c, p); err != nil {
+			if errors.Is(err, ErrTagsDiverged) {
+				f.cfg.Lgr.Error("tags.dat on the FTP server has diverged, not overwriting it",
+					log.KV("path", p.Remote), log.KV("attempts", p.Attempts+1), log.KVErr(err))
+			} else {
+				f.cfg.Lgr.Warn("failed to push tags.dat, will retry",
+					log.KV("path", p.Remote), log.KV("attempts", p.Attempts+1), log.KVErr(err))
+			}
+			if err = f.journal.failed(p, err); err != nil {
+				f.cfg.Lgr.Error("failed to update tags.dat journal", log.KVErr(err))
+			}
+		} else if err = f.journal.done(p); err != nil {
+			f.cfg.Lgr.Error("failed to update tags.dat journal", log.KVErr(err))
+		}
+	}
+}
+
+// pushTagsDat reconciles the local tags.dat with the copy on the FTP server and pushes it.
+// Tags which only exist remotely are merged in first, if the copies give a tag different
+// IDs then the remote copy is left alone and ErrTagsDiverged is returned.
+func (f *ftpstore) pushTagsDat(c *ftp.ServerConn, p pendingTagPush) (err error) {
+	ftpSync.Lock()
+	defer ftpSync.Unlock()
+	var remote []tags.TagPair
+	if remote, err = fetchRemoteTags(c, p.Remote); err != nil {
+		return
+	}
+	var tm *tags.TagMan
+	if tm, err = tags.GetTagMan(p.CID, p.IdxUUID, filepath.Join(f.cfg.LocalStore, filepath.Dir(p.Remote))); err != nil {
+		return
+	}
+	var bb bytes.Buffer
+	if _, err = tm.Merge(remote); err != nil {
+		err = fmt.Errorf("%w: %v", ErrTagsDiverged, err)
+	} else {
+		err = tm.CopyTo(&bb)
+	}
+	if rerr := tags.ReleaseTagMan(p.CID, p.IdxUUID); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return
+	}
+	return c.Stor(p.Remote, &bb)
+}
+
+// fetchRemoteTags reads a tags.dat from the FTP server, one which does not exist yet holds no tags
+func fetchRemoteTags(c *ftp.ServerConn, pth string) (tps []tags.TagPair, err error) {
+	var resp *ftp.Response
+	if resp, err = c.Retr(pth); err != nil {
+		var te *textproto.Error
+		if errors.As(err, &te) && (te.Code == ftp.StatusFileUnavailable || te.Code == 551) {
+			err = nil
+		}
+		return
+	}
+	defer resp.Close()
+	return tags.ParseTagDat(resp)
+}
+
+// flushRoutine retries pending tags.dat pushes until the store is closed
+func (f *ftpstore) flushRoutine() {
+	tkr := time.NewTicker(tagFlushInterval)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-tkr.C:
+		}
+		if f.journal.len() == 0 {
+			continue
+		}
+		ctx, cf := context.WithTimeout(context.Background(), tagFlushTimeout)
+		if c, err := f.dial(ctx); err == nil {
+			f.flushTags(c)
+			c.Quit()
+		}
+		cf()
+	}
+}
@@ -0,0 +1,219 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ftpstore
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/jlaffaye/ftp"
+)
+
+var (
+	ErrUploadMismatch = errors.New("file stored on the FTP server does not match what was sent")
+)
+
+// hash commands we know how to check, in order of preference
+var hashCommands = []string{`XSHA256`, `XSHA1`, `XCRC`}
+
+// verifier checks that files stored on the FTP server arrived intact.  The size is always
+// checked with SIZE over the client's own connection, servers advertising one of the hash
+// commands in FEAT are also asked for a checksum.  The FTP client library does not expose
+// raw commands so checksums are requested over a second control connection, it is only
+// opened once per shard and only kept when the server has a hash command.
+type verifier struct {
+	f      *ftpstore
+	ctx    context.Context
+	probed bool
+	cmd    string // hash command to use, empty if the server has none
+	conn   *textproto.Conn
+}
+
+func (f *ftpstore) newVerifier(ctx context.Context) *verifier {
+	return &verifier{f: f, ctx: ctx}
+}
+
+// close tears down the hash connection, if there is one
+func (v *verifier) close() {
+	if v.conn != nil {
+		v.conn.Cmd(`QUIT`)
+		v.conn.Close()
+		v.conn = nil
+	}
+}
+
+// hashCommand returns the hash command the server supports, empty if it has none
+// or the second connection could not be established
+func (v *verifier) hashCommand() string {
+	if !v.probed {
+		v.probed = true
+		if err := v.probe(); err != nil {
+			v.f.cfg.Lgr.Warn("Failed to probe FTP server for hash commands, only verifying file sizes",
+				log.KV("address", v.f.cfg.FtpServer), log.KVErr(err))
+			v.close()
+			v.cmd = ``
+		} else if v.cmd == `` {
+			v.close()
+		}
+	}
+	return v.cmd
+}
+
+func (v *verifier) probe() (err error) {
+	conn, err := contextDialer(v.ctx)(`tcp`, v.f.cfg.FtpServer)
+	if err != nil {
+		return
+	}
+	v.conn = textproto.NewConn(conn)
+	var code int
+	if _, _, err = v.conn.ReadResponse(ftp.StatusReady); err != nil {
+		return
+	} else if code, _, err = v.do(-1, `USER %s`, v.f.cfg.Username); err != nil {
+		return
+	} else if code == ftp.StatusUserOK {
+		if _, _, err = v.do(ftp.StatusLoggedIn, `PASS %s`, v.f.cfg.Password); err != nil {
+			return
+		}
+	} else if code != ftp.StatusLoggedIn {
+		err = fmt.Errorf("unexpected response to USER: %d", code)
+		return
+	}
+	var msg string
+	if _, msg, err = v.do(ftp.StatusSystem, `FEAT`); err != nil {
+		var te *textproto.Error
+		if errors.As(err, &te) {
+			err = nil //no FEAT, so no hash commands either
+		}
+		return
+	}
+	v.cmd = pickHashCommand(msg)
+	return
+}
+
+func (v *verifier) do(expect int, format string, args ...interface{}) (code int, msg string, err error) {
+	if _, err = v.conn.Cmd(format, args...); err != nil {
+		return
+	}
+	return v.conn.ReadResponse(expect)
+}
+
+// pickHashCommand picks our preferred hash command out of a FEAT response
+func pickHashCommand(feat string) string {
+	feats := map[string]bool{}
+	for _, ln := range strings.Split(feat, "\n") {
+		if flds := strings.Fields(ln); len(flds) > 0 {
+			feats[strings.ToUpper(flds[0])] = true
+		}
+	}
+	for _, c := range hashCommands {
+		if feats[c] {
+			return c
+		}
+	}
+	return ``
+}
+
+// newHash returns the local hash which matches a hash command
+func newHash(cmd string) hash.Hash {
+	switch cmd {
+	case `XSHA256`:
+		return sha256.New()
+	case `XSHA1`:
+		return sha1.New()
+	case `XCRC`:
+		return crc32.NewIEEE()
+	}
+	return nil
+}
+
+// remoteHash asks the server for the checksum of a stored file
+func (v *verifier) remoteHash(pth string) (sum string, err error) {
+	var code int
+	var msg string
+	if code, msg, err = v.do(-1, `%s %s`, v.cmd, pth); err != nil {
+		return
+	} else if code != ftp.StatusRequestedFileActionOK && code != ftp.StatusFile {
+		err = &textproto.Error{Code: code, Msg: msg}
+		return
+	}
+	//servers reply with the checksum alone or followed by the path, some prefix it with 0x
+	if flds := strings.Fields(msg); len(flds) > 0 {
+		sum = strings.TrimPrefix(strings.ToLower(flds[0]), `0x`)
+	}
+	return
+}
+
+// sentReader counts and optionally hashes what is handed to Stor
+type sentReader struct {
+	rdr io.Reader
+	h   hash.Hash
+	n   int64
+}
+
+func (sr *sentReader) Read(b []byte) (n int, err error) {
+	n, err = sr.rdr.Read(b)
+	sr.n += int64(n)
+	if sr.h != nil && n > 0 {
+		sr.h.Write(b[:n])
+	}
+	return
+}
+
+// newSentReader wraps a reader destined for Stor so the upload can be verified
+func (v *verifier) newSentReader(rdr io.Reader) *sentReader {
+	return &sentReader{rdr: rdr, h: newHash(v.hashCommand())}
+}
+
+// check compares the stored file against what was sent, servers which do not
+// implement SIZE are trusted to have stored the file intact
+func (v *verifier) check(c *ftp.ServerConn, pth string, sr *sentReader) error {
+	sz, err := c.FileSize(pth)
+	if err != nil {
+		var te *textproto.Error
+		if !errors.As(err, &te) || !unsupportedCommand(te.Code) {
+			return fmt.Errorf("failed to get size of stored file %s: %w", pth, err)
+		}
+		v.f.cfg.Lgr.Debug("FTP server does not support SIZE, stored file not verified", log.KV("path", pth))
+	} else if sz != sr.n {
+		v.f.cfg.Lgr.Error("Stored file size mismatch", log.KV("path", pth), log.KV("sent", sr.n), log.KV("stored", sz))
+		return fmt.Errorf("%w: %s is %d bytes, sent %d", ErrUploadMismatch, pth, sz, sr.n)
+	}
+	if sr.h == nil || v.conn == nil {
+		return nil
+	}
+	sum, err := v.remoteHash(pth)
+	if err != nil {
+		return fmt.Errorf("failed to get %s of stored file %s: %w", v.cmd, pth, err)
+	}
+	//crc32 sums are not always zero padded
+	want := hex.EncodeToString(sr.h.Sum(nil))
+	if sum != want && strings.TrimLeft(sum, `0`) != strings.TrimLeft(want, `0`) {
+		v.f.cfg.Lgr.Error("Stored file checksum mismatch", log.KV("path", pth), log.KV("command", v.cmd), log.KV("sent", want), log.KV("stored", sum))
+		return fmt.Errorf("%w: %s %s is %s, sent %s", ErrUploadMismatch, pth, v.cmd, sum, want)
+	}
+	return nil
+}
+
+func unsupportedCommand(code int) bool {
+	switch code {
+	case ftp.StatusBadCommand, ftp.StatusBadArguments, ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
+		return true
+	}
+	return false
+}
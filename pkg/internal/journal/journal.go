@@ -0,0 +1,168 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package journal keeps a set of pending work on disk so that it survives a restart,
+// such as the shards a storage wrapper still has to copy between its backends.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Progress is the bookkeeping the journal keeps for each record, records embed it
+type Progress struct {
+	Queued    time.Time
+	Attempts  int
+	LastError string `json:",omitempty"`
+}
+
+func (p *Progress) progress() *Progress {
+	return p
+}
+
+// Record is the constraint on the pointer to a record type, a record must embed Progress
+// and its Key identifies the work it describes so the same work is only queued once
+type Record[T any] interface {
+	*T
+	Key() string
+	progress() *Progress
+}
+
+// Journal holds the pending records of type T, it is safe for concurrent use
+type Journal[T any, P Record[T]] struct {
+	sync.Mutex
+	path    string
+	name    string
+	pending map[string]T
+}
+
+// Open loads the journal at path, a missing file is an empty journal.
+// The name describes the journal in errors.
+func Open[T any, P Record[T]](path, name string) (j *Journal[T, P], err error) {
+	j = &Journal[T, P]{
+		path:    path,
+		name:    name,
+		pending: map[string]T{},
+	}
+	var bts []byte
+	if bts, err = ioutil.ReadFile(j.path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var recs []T
+	if err = json.Unmarshal(bts, &recs); err != nil {
+		err = fmt.Errorf("corrupt %s journal %s: %w", j.name, j.path, err)
+		return
+	}
+	for _, r := range recs {
+		j.pending[key[T, P](r)] = r
+	}
+	return
+}
+
+func key[T any, P Record[T]](r T) string {
+	return P(&r).Key()
+}
+
+// Add records pending work, a record which is already pending keeps its place
+func (j *Journal[T, P]) Add(r T) error {
+	j.Lock()
+	defer j.Unlock()
+	k := key[T, P](r)
+	if _, ok := j.pending[k]; ok {
+		return nil
+	}
+	P(&r).progress().Queued = time.Now().UTC()
+	j.pending[k] = r
+	return j.save()
+}
+
+// Done removes a pending record
+func (j *Journal[T, P]) Done(r T) error {
+	j.Lock()
+	defer j.Unlock()
+	k := key[T, P](r)
+	if _, ok := j.pending[k]; !ok {
+		return nil
+	}
+	delete(j.pending, k)
+	return j.save()
+}
+
+// Failed records a failed attempt at a pending record
+func (j *Journal[T, P]) Failed(r T, perr error) error {
+	j.Lock()
+	defer j.Unlock()
+	k := key[T, P](r)
+	cur, ok := j.pending[k]
+	if !ok {
+		return nil
+	}
+	pg := P(&cur).progress()
+	pg.Attempts++
+	pg.LastError = perr.Error()
+	j.pending[k] = cur
+	return j.save()
+}
+
+// List returns the pending records, oldest first
+func (j *Journal[T, P]) List() (recs []T) {
+	j.Lock()
+	for _, r := range j.pending {
+		recs = append(recs, r)
+	}
+	j.Unlock()
+	sort.Slice(recs, func(a, b int) bool {
+		return P(&recs[a]).progress().Queued.Before(P(&recs[b]).progress().Queued)
+	})
+	return
+}
+
+// Len returns the number of pending records
+func (j *Journal[T, P]) Len() (n int) {
+	j.Lock()
+	n = len(j.pending)
+	j.Unlock()
+	return
+}
+
+// save writes the journal, the caller must hold the lock
+func (j *Journal[T, P]) save() (err error) {
+	if len(j.pending) == 0 {
+		if err = os.Remove(j.path); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	recs := make([]T, 0, len(j.pending))
+	for _, r := range j.pending {
+		recs = append(recs, r)
+	}
+	var bts []byte
+	if bts, err = json.Marshal(recs); err != nil {
+		return
+	} else if err = os.MkdirAll(filepath.Dir(j.path), 0770); err != nil {
+		return
+	}
+	tmp := j.path + `.tmp`
+	if err = ioutil.WriteFile(tmp, bts, 0660); err != nil {
+		return
+	} else if err = os.Rename(tmp, j.path); err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
@@ -0,0 +1,80 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package journal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testRecord struct {
+	Name string
+	Progress
+}
+
+func (r testRecord) Key() string {
+	return r.Name
+}
+
+func TestJournal(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), `journal.json`)
+	j, err := Open[testRecord](pth, `test`)
+	if err != nil {
+		t.Fatal(err)
+	} else if j.Len() != 0 {
+		t.Fatalf("new journal has %d records", j.Len())
+	}
+	for _, n := range []string{`a`, `b`, `a`} {
+		if err = j.Add(testRecord{Name: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j.Len() != 2 {
+		t.Fatalf("duplicate record was added, %d records", j.Len())
+	}
+	if err = j.Failed(testRecord{Name: `b`}, errors.New(`boom`)); err != nil {
+		t.Fatal(err)
+	}
+
+	//reopen and check the records survived
+	if j, err = Open[testRecord](pth, `test`); err != nil {
+		t.Fatal(err)
+	}
+	recs := j.List()
+	if len(recs) != 2 || recs[0].Name != `a` || recs[1].Name != `b` {
+		t.Fatalf("bad records after reopen: %+v", recs)
+	} else if recs[1].Attempts != 1 || recs[1].LastError != `boom` {
+		t.Fatalf("failure was not recorded: %+v", recs[1])
+	} else if recs[0].Queued.IsZero() {
+		t.Fatal("queue time was not set")
+	}
+
+	for _, r := range recs {
+		if err = j.Done(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j.Len() != 0 {
+		t.Fatalf("%d records left", j.Len())
+	} else if _, err = os.Stat(pth); !os.IsNotExist(err) {
+		t.Fatalf("empty journal was not removed: %v", err)
+	}
+}
+
+func TestCorruptJournal(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), `journal.json`)
+	if err := os.WriteFile(pth, []byte(`{nope`), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open[testRecord](pth, `test`); err == nil {
+		t.Fatal("opened a corrupt journal")
+	}
+}
@@ -0,0 +1,138 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package storetest holds the fixtures shared by the storage backend tests,
+// building shards to push and checking what comes back when they are pulled.
+// Shards are described by their file contents keyed by extension, such as `.store`.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// CustomerID and Well are where CheckPull and ShardDir look for shards
+	CustomerID uint64 = 1
+	Well              = `default`
+)
+
+// NewFileStore creates a file store in a temporary directory, returning the store and its directory
+func NewFileStore(t testing.TB) (fs webserver.ShardHandler, dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	fs, err := filestore.NewFilestoreHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// WriteShard writes a shard directory holding files, returning its path
+func WriteShard(t testing.TB, shard string, files map[string][]byte) (sdir string) {
+	t.Helper()
+	sdir = filepath.Join(t.TempDir(), shard)
+	if err := os.Mkdir(sdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for ext, v := range files {
+		if err := ioutil.WriteFile(filepath.Join(sdir, shard+ext), v, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+// Pack streams a shard directory the way a push does, sending tgs first if there are any
+func Pack(sdir, shard string, tgs []tags.TagPair) *shardpacker.Packer {
+	pkr := shardpacker.NewPacker(shard)
+	go func() {
+		if tgs != nil {
+			if err := pkr.AddTags(tgs); err != nil {
+				pkr.CloseWithError(err)
+				return
+			}
+		}
+		if err := util.AddShardFilesToPacker(sdir, shard, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	return pkr
+}
+
+// NewShard writes a shard holding files and returns a packer streaming it
+func NewShard(t testing.TB, shard string, files map[string][]byte) *shardpacker.Packer {
+	t.Helper()
+	return Pack(WriteShard(t, shard, files), shard, nil)
+}
+
+// FileSet collects the files of an unpacked shard keyed by name
+type FileSet map[string][]byte
+
+func (fs FileSet) HandleFile(pth string, rdr io.Reader) (err error) {
+	fs[pth], err = ioutil.ReadAll(rdr)
+	return
+}
+
+func (fs FileSet) HandleTagUpdate([]tags.TagPair) error { return nil }
+
+// Pull packs a shard out of h and unpacks it
+func Pull(h webserver.ShardHandler, cid uint64, guid uuid.UUID, well, shard string) (got FileSet, err error) {
+	bb := bytes.NewBuffer(nil)
+	if err = h.PackShard(context.Background(), cid, guid, well, shard, bb); err != nil {
+		return
+	}
+	up, err := shardpacker.NewUnpacker(shard, bb)
+	if err != nil {
+		return
+	}
+	got = FileSet{}
+	err = up.Unpack(got)
+	return
+}
+
+// CheckPull fails the test unless the shard pulls back out of h holding files
+func CheckPull(t testing.TB, h webserver.ShardHandler, guid uuid.UUID, shard string, files map[string][]byte) {
+	t.Helper()
+	got, err := Pull(h, CustomerID, guid, Well, shard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ext, v := range files {
+		if !bytes.Equal(got[shard+ext], v) {
+			t.Fatalf("pulled %s%s does not match", shard, ext)
+		}
+	}
+}
+
+// ShardDir is where a file store rooted at dir keeps the shard
+func ShardDir(dir string, guid uuid.UUID, shard string) string {
+	return filepath.Join(dir, strconv.FormatUint(CustomerID, 10), guid.String(), Well, shard)
+}
+
+// Stored reports whether a file store rooted at dir holds the shard's store file
+func Stored(dir string, guid uuid.UUID, shard string) bool {
+	_, err := os.Stat(filepath.Join(ShardDir(dir, guid, shard), shard+`.store`))
+	return err == nil
+}
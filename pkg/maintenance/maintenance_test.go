@@ -0,0 +1,150 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package maintenance
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow(`Mon-Wed,Sat 22:30-04:00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [7]bool{false, true, true, true, false, false, true}
+	if w.Days != want || w.Start != 22*60+30 || w.End != 4*60 {
+		t.Fatalf("bad window %+v", w)
+	}
+	if w, err = ParseWindow(`Fri-Mon 00:00-24:00`); err != nil {
+		t.Fatal(err)
+	} else if want = [7]bool{true, true, false, false, false, true, true}; w.Days != want {
+		t.Fatalf("bad wrapped day range %v", w.Days)
+	}
+	if w, err = ParseWindow(`01:00-05:00`); err != nil {
+		t.Fatal(err)
+	} else if w.Days != everyDay[0].Days {
+		t.Fatalf("bad default days %v", w.Days)
+	}
+	for _, bad := range []string{``, `Mon`, `Mon 01:00`, `Funday 01:00-02:00`, `01:00-01:00`, `25:00-26:00`, `01:60-02:00`, `a b c`} {
+		if _, err = ParseWindow(bad); err == nil {
+			t.Fatalf("invalid window %q parsed", bad)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	s, err := ParseSchedule([]string{`Mon-Fri 22:00-02:00`, `Sun 12:00-13:00`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(v string) time.Time {
+		tm, err := time.ParseInLocation(`2006-01-02 15:04`, v, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	//2023-06-05 is a Monday
+	tests := []struct {
+		t      string
+		active bool
+		end    string
+		next   string
+	}{
+		{`2023-06-05 21:00`, false, ``, `2023-06-05 22:00`},
+		{`2023-06-05 23:00`, true, `2023-06-06 02:00`, `2023-06-06 22:00`},
+		{`2023-06-06 01:59`, true, `2023-06-06 02:00`, `2023-06-06 22:00`},
+		{`2023-06-06 02:00`, false, ``, `2023-06-06 22:00`},
+		{`2023-06-10 01:00`, true, `2023-06-10 02:00`, `2023-06-11 12:00`}, //Friday's window runs into Saturday
+		{`2023-06-10 23:00`, false, ``, `2023-06-11 12:00`},
+		{`2023-06-11 12:30`, true, `2023-06-11 13:00`, `2023-06-12 22:00`},
+	}
+	for _, tt := range tests {
+		active, end := s.Active(at(tt.t))
+		if active != tt.active {
+			t.Fatalf("%s: active %v", tt.t, active)
+		} else if active && !end.Equal(at(tt.end)) {
+			t.Fatalf("%s: bad end %v", tt.t, end)
+		}
+		if next := s.Next(at(tt.t)); !next.Equal(at(tt.next)) {
+			t.Fatalf("%s: bad next %v", tt.t, next)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	lgr := log.New(nopCloser{ioutil.Discard})
+	//without windows tasks run once a day, starting immediately, and pushes are never held back
+	s, err := NewScheduler(SchedulerConfig{PushLimit: 1, Logger: lgr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan struct{})
+	s.Register(`test`, func(ctx context.Context) error {
+		close(ran)
+		<-ctx.Done() //block until the scheduler is closed
+		return ctx.Err()
+	})
+	if s.InWindow() {
+		t.Fatal("in window without windows configured")
+	}
+	for i := 0; i < 2; i++ {
+		if release, err := s.AcquirePush(context.Background()); err != nil {
+			t.Fatal(err)
+		} else {
+			defer release()
+		}
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	} else if err = s.Start(); err != ErrAlreadyStarted {
+		t.Fatalf("started twice: %v", err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not run")
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//an open window limits concurrent pushes
+	if s, err = NewScheduler(SchedulerConfig{Windows: []string{`00:00-24:00`}, PushLimit: 1, Logger: lgr}); err != nil {
+		t.Fatal(err)
+	} else if !s.InWindow() {
+		t.Fatal("not in an all day window")
+	}
+	release, err := s.AcquirePush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cf()
+	if _, err = s.AcquirePush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("push limit not enforced: %v", err)
+	}
+	release()
+	if release, err = s.AcquirePush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
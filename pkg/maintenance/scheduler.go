@@ -0,0 +1,186 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package maintenance runs heavy background tasks, such as scrubbing, retention,
+// and compaction, within scheduled maintenance windows so that daytime archive
+// latency stays predictable.  Pushes can optionally be held back while a window
+// is open so the tasks are not competing with a full load of uploads.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrAlreadyStarted = errors.New("maintenance scheduler already started")
+	ErrNotStarted     = errors.New("maintenance scheduler not started")
+
+	// everyDay is used when no windows are configured, tasks run once a day starting at midnight
+	everyDay = Schedule{{Days: [7]bool{true, true, true, true, true, true, true}, Start: 0, End: minutesPerDay}}
+)
+
+// Task is a background job, it must return promptly once the context is done
+// which happens when the maintenance window closes or the server exits
+type Task func(ctx context.Context) error
+
+type SchedulerConfig struct {
+	Windows   []string // see ParseWindow, tasks run once a day if empty
+	PushLimit int      // maximum concurrent shard pushes while a window is open, zero is unlimited
+	Logger    *log.Logger
+}
+
+type namedTask struct {
+	name string
+	task Task
+}
+
+// Scheduler runs its registered tasks once each time a maintenance window opens
+type Scheduler struct {
+	sync.Mutex
+	sched    Schedule
+	windowed bool // windows were configured
+	lgr      *log.Logger
+	tasks    []namedTask
+	pushes   chan struct{} //push slots while a window is open, nil if unlimited
+
+	ctx context.Context
+	cf  context.CancelFunc
+	wg  sync.WaitGroup
+}
+
+func NewScheduler(cfg SchedulerConfig) (*Scheduler, error) {
+	sched, err := ParseSchedule(cfg.Windows)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scheduler{
+		sched:    sched,
+		windowed: len(sched) > 0,
+		lgr:      cfg.Logger,
+	}
+	if !s.windowed {
+		s.sched = everyDay
+	}
+	if cfg.PushLimit > 0 && s.windowed {
+		s.pushes = make(chan struct{}, cfg.PushLimit)
+	}
+	return s, nil
+}
+
+// Register adds a task, tasks run one at a time in the order they were registered
+func (s *Scheduler) Register(name string, t Task) {
+	s.Lock()
+	defer s.Unlock()
+	s.tasks = append(s.tasks, namedTask{name: name, task: t})
+}
+
+func (s *Scheduler) Start() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.cf != nil {
+		return ErrAlreadyStarted
+	}
+	s.ctx, s.cf = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.routine()
+	return nil
+}
+
+// Close stops the scheduler, cancelling any running task and waiting for it to return
+func (s *Scheduler) Close() error {
+	s.Lock()
+	cf := s.cf
+	s.Unlock()
+	if cf == nil {
+		return ErrNotStarted
+	}
+	cf()
+	s.wg.Wait()
+	return nil
+}
+
+// InWindow reports whether a configured maintenance window is currently open
+func (s *Scheduler) InWindow() bool {
+	if !s.windowed {
+		return false
+	}
+	active, _ := s.sched.Active(time.Now())
+	return active
+}
+
+// AcquirePush holds back a shard push while a maintenance window is open and the push
+// limit has been reached, the returned function must be called when the push completes
+func (s *Scheduler) AcquirePush(ctx context.Context) (release func(), err error) {
+	release = func() {}
+	if s.pushes == nil {
+		return
+	}
+	active, end := s.sched.Active(time.Now())
+	if !active {
+		return
+	}
+	tmr := time.NewTimer(time.Until(end))
+	defer tmr.Stop()
+	select {
+	case s.pushes <- struct{}{}:
+		release = func() { <-s.pushes }
+	case <-tmr.C:
+		//the window closed while waiting, pushes are no longer limited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+func (s *Scheduler) routine() {
+	defer s.wg.Done()
+	for {
+		now := time.Now()
+		wait := s.sched.Next(now)
+		if active, end := s.sched.Active(now); active {
+			s.runTasks(end)
+			wait = end //tasks run once per window
+		}
+		tmr := time.NewTimer(time.Until(wait))
+		select {
+		case <-tmr.C:
+		case <-s.ctx.Done():
+			tmr.Stop()
+			return
+		}
+	}
+}
+
+func (s *Scheduler) runTasks(end time.Time) {
+	s.Lock()
+	tasks := append([]namedTask(nil), s.tasks...)
+	s.Unlock()
+	if len(tasks) == 0 {
+		return
+	}
+	ctx, cf := context.WithDeadline(s.ctx, end)
+	defer cf()
+	for _, t := range tasks {
+		if ctx.Err() != nil {
+			s.lgr.Warn("maintenance window closed before task could run", log.KV("task", t.name))
+			continue
+		}
+		start := time.Now()
+		s.lgr.Info("maintenance task starting", log.KV("task", t.name))
+		if err := t.task(ctx); err != nil {
+			s.lgr.Error("maintenance task failed", log.KV("task", t.name), log.KV("duration", time.Since(start)), log.KVErr(err))
+		} else {
+			s.lgr.Info("maintenance task complete", log.KV("task", t.name), log.KV("duration", time.Since(start)))
+		}
+	}
+}
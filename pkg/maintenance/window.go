@@ -0,0 +1,189 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay = 24 * 60
+)
+
+var (
+	ErrInvalidWindow = errors.New("invalid maintenance window")
+
+	dayNames = map[string]time.Weekday{
+		`sun`: time.Sunday, `mon`: time.Monday, `tue`: time.Tuesday, `wed`: time.Wednesday,
+		`thu`: time.Thursday, `fri`: time.Friday, `sat`: time.Saturday,
+	}
+)
+
+// Window is a span of time of day on selected days of the week, in the server's local time.
+// A window whose end is before its start runs past midnight into the next day.
+type Window struct {
+	Days  [7]bool // indexed by time.Weekday, the day the window opens on
+	Start int     // minutes after midnight
+	End   int     // minutes after midnight, up to 24:00
+}
+
+// Schedule is a set of windows, a time is within the schedule if any window contains it
+type Schedule []Window
+
+// ParseWindow parses a window of the form "[days] HH:MM-HH:MM", days is a comma separated
+// list of day names or ranges such as "Mon-Fri,Sun" and defaults to every day
+func ParseWindow(v string) (w Window, err error) {
+	flds := strings.Fields(v)
+	var span string
+	switch len(flds) {
+	case 1:
+		span = flds[0]
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		if w.Days, err = parseDays(flds[0]); err != nil {
+			return
+		}
+		span = flds[1]
+	default:
+		err = fmt.Errorf("%w %q", ErrInvalidWindow, v)
+		return
+	}
+	s, e, ok := strings.Cut(span, `-`)
+	if !ok {
+		err = fmt.Errorf("%w %q: missing time range", ErrInvalidWindow, v)
+		return
+	}
+	if w.Start, err = parseClock(s); err != nil {
+		err = fmt.Errorf("%w %q: %v", ErrInvalidWindow, v, err)
+		return
+	} else if w.End, err = parseClock(e); err != nil {
+		err = fmt.Errorf("%w %q: %v", ErrInvalidWindow, v, err)
+		return
+	} else if w.Start == w.End || w.Start == minutesPerDay {
+		err = fmt.Errorf("%w %q: empty time range", ErrInvalidWindow, v)
+	}
+	return
+}
+
+// ParseSchedule parses a set of windows
+func ParseSchedule(vals []string) (s Schedule, err error) {
+	for _, v := range vals {
+		var w Window
+		if w, err = ParseWindow(v); err != nil {
+			return
+		}
+		s = append(s, w)
+	}
+	return
+}
+
+func parseDays(v string) (days [7]bool, err error) {
+	if v == `*` {
+		for i := range days {
+			days[i] = true
+		}
+		return
+	}
+	for _, part := range strings.Split(v, `,`) {
+		s, e, isRange := strings.Cut(part, `-`)
+		first, ok := dayNames[strings.ToLower(s)]
+		if !ok {
+			err = fmt.Errorf("%w: unknown day %q", ErrInvalidWindow, s)
+			return
+		}
+		last := first
+		if isRange {
+			if last, ok = dayNames[strings.ToLower(e)]; !ok {
+				err = fmt.Errorf("%w: unknown day %q", ErrInvalidWindow, e)
+				return
+			}
+		}
+		//ranges may wrap around the end of the week, such as Fri-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+func parseClock(v string) (mins int, err error) {
+	h, m, ok := strings.Cut(v, `:`)
+	if !ok {
+		err = fmt.Errorf("bad time %q, expected HH:MM", v)
+		return
+	}
+	var hr, min int
+	if hr, err = strconv.Atoi(h); err != nil || hr < 0 || hr > 24 {
+		err = fmt.Errorf("bad hour in %q", v)
+		return
+	} else if min, err = strconv.Atoi(m); err != nil || min < 0 || min > 59 || (hr == 24 && min != 0) {
+		err = fmt.Errorf("bad minute in %q", v)
+		return
+	}
+	mins = hr*60 + min
+	return
+}
+
+// occurrence returns the instance of the window which opens on the given day, ok is false
+// if the window does not open on that day
+func (w Window) occurrence(day time.Time) (start, end time.Time, ok bool) {
+	if !w.Days[day.Weekday()] {
+		return
+	}
+	y, m, d := day.Date()
+	start = time.Date(y, m, d, w.Start/60, w.Start%60, 0, 0, day.Location())
+	end = time.Date(y, m, d, w.End/60, w.End%60, 0, 0, day.Location())
+	if w.End < w.Start {
+		end = time.Date(y, m, d+1, w.End/60, w.End%60, 0, 0, day.Location())
+	}
+	ok = true
+	return
+}
+
+// Active reports whether t falls within any window of the schedule, and if so the
+// latest time at which the windows containing t close
+func (s Schedule) Active(t time.Time) (active bool, end time.Time) {
+	for _, w := range s {
+		//a window that opened yesterday may still be open
+		for off := -1; off <= 0; off++ {
+			ws, we, ok := w.occurrence(t.AddDate(0, 0, off))
+			if ok && !t.Before(ws) && t.Before(we) {
+				active = true
+				if we.After(end) {
+					end = we
+				}
+			}
+		}
+	}
+	return
+}
+
+// Next returns the next time after t at which a window opens, the zero time if the schedule is empty
+func (s Schedule) Next(t time.Time) (next time.Time) {
+	for _, w := range s {
+		for off := 0; off <= 7; off++ {
+			if ws, _, ok := w.occurrence(t.AddDate(0, 0, off)); ok && ws.After(t) {
+				if next.IsZero() || ws.Before(next) {
+					next = ws
+				}
+				break
+			}
+		}
+	}
+	return
+}
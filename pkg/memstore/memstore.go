@@ -0,0 +1,403 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package memstore is a storage backend which keeps every shard and tag set in memory.
+// Nothing touches the disk, so a complete webserver can be run in tests without temporary
+// directories or an FTP server.  Everything stored is lost when the handler is dropped.
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/dolmen-go/contextio"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidWell = errors.New("Invalid well name")
+)
+
+// packOrder is the order shard files are sent in on a pull, artifacts follow sorted by name
+var packOrder = []shardpacker.Ftype{
+	shardpacker.Verify,
+	shardpacker.Index,
+	shardpacker.Store,
+	shardpacker.AccelFile,
+	shardpacker.IndexAccelKeyFile,
+	shardpacker.IndexAccelDataFile,
+}
+
+type memstore struct {
+	mtx   sync.Mutex
+	custs map[uint64]map[uuid.UUID]*indexer
+	holds util.LegalHolds
+}
+
+// indexer holds the tags and wells stored for one indexer of a customer
+type indexer struct {
+	tags  *tagSet
+	wells map[string]map[string]shardFiles // well name to shard name
+}
+
+// shardFiles maps the slash separated path of each file relative to the shard directory to its contents
+type shardFiles map[string][]byte
+
+// NewMemStoreHandler returns an empty in-memory store
+func NewMemStoreHandler() *memstore {
+	return &memstore{
+		custs: map[uint64]map[uuid.UUID]*indexer{},
+	}
+}
+
+// notExist builds the error a file backend returns for a missing path, so the webserver
+// answers with the same status codes
+func notExist(op string, elems ...string) error {
+	return &os.PathError{Op: op, Path: path.Join(elems...), Err: os.ErrNotExist}
+}
+
+// getIndexer returns the indexer, creating it if create is set, the caller holds the lock
+func (m *memstore) getIndexer(cid uint64, guid uuid.UUID, create bool) *indexer {
+	idxs, ok := m.custs[cid]
+	if !ok {
+		if !create {
+			return nil
+		}
+		idxs = map[uuid.UUID]*indexer{}
+		m.custs[cid] = idxs
+	}
+	idx, ok := idxs[guid]
+	if !ok && create {
+		idx = &indexer{
+			tags:  newTagSet(),
+			wells: map[string]map[string]shardFiles{},
+		}
+		idxs[guid] = idx
+	}
+	return idx
+}
+
+// getWell returns the shards of a well, failing as a missing directory would
+func (m *memstore) getWell(cid uint64, guid uuid.UUID, well string) (map[string]shardFiles, error) {
+	if idx := m.getIndexer(cid, guid, false); idx != nil {
+		if shards, ok := idx.wells[well]; ok {
+			return shards, nil
+		}
+	}
+	return nil, notExist(`open`, strconv.FormatUint(cid, 10), guid.String(), well)
+}
+
+// Preflight always succeeds, memory is always reachable
+func (m *memstore) Preflight(ctx context.Context) error {
+	return nil
+}
+
+func (m *memstore) ListIndexes(ctx context.Context, cid uint64) (idx []string, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	idxs, ok := m.custs[cid]
+	if !ok {
+		err = notExist(`open`, strconv.FormatUint(cid, 10))
+		return
+	}
+	for guid := range idxs {
+		idx = append(idx, guid.String())
+	}
+	sort.Strings(idx)
+	return
+}
+
+func (m *memstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) (wells []string, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	idx := m.getIndexer(cid, guid, false)
+	if idx == nil {
+		err = notExist(`open`, strconv.FormatUint(cid, 10), guid.String())
+		return
+	}
+	for well := range idx.wells {
+		wells = append(wells, well)
+	}
+	sort.Strings(wells)
+	return
+}
+
+func (m *memstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var shards map[string]shardFiles
+	if shards, err = m.getWell(cid, guid, well); err != nil {
+		return
+	}
+	for name := range shards {
+		s, e, err := util.ShardNameToDateRange(name)
+		if err != nil {
+			continue
+		}
+		if t.Start.IsZero() || s.Before(t.Start) {
+			t.Start = s
+		}
+		if t.End.IsZero() || e.After(t.End) {
+			t.End = e
+		}
+	}
+	return
+}
+
+func (m *memstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var ws map[string]shardFiles
+	if ws, err = m.getWell(cid, guid, well); err != nil {
+		return
+	}
+	for name := range ws {
+		if ok, err := tf.ShardOverlaps(name); err == nil && ok {
+			shards = append(shards, name)
+		}
+	}
+	sort.Strings(shards)
+	return
+}
+
+// CustomerUsage returns the number of bytes of shard files stored for a customer
+func (m *memstore) CustomerUsage(ctx context.Context, cid uint64) (usage uint64, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, idx := range m.custs[cid] {
+		for _, shards := range idx.wells {
+			for _, s := range shards {
+				for _, bts := range s {
+					usage += uint64(len(bts))
+				}
+			}
+		}
+	}
+	return
+}
+
+func (m *memstore) SetLegalHolds(lh util.LegalHolds) {
+	m.mtx.Lock()
+	m.holds = lh
+	m.mtx.Unlock()
+}
+
+// DeleteShard removes a shard, held wells are refused
+func (m *memstore) DeleteShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (err error) {
+	if err = util.ValidateShardName(shard); err != nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.holds.Held(cid, well) {
+		return util.ErrLegalHold
+	}
+	var shards map[string]shardFiles
+	if shards, err = m.getWell(cid, guid, well); err != nil {
+		return
+	} else if _, ok := shards[shard]; !ok {
+		return notExist(`remove`, strconv.FormatUint(cid, 10), guid.String(), well, shard)
+	}
+	delete(shards, shard)
+	return
+}
+
+// UnpackShard stores a pushed shard, replacing any stored copy of it unless its well is
+// held.  Nothing is stored unless the entire shard is received.
+func (m *memstore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	return m.unpackShard(ctx, cid, guid, well, shard, rdr, false)
+}
+
+// UnpackNewShard is UnpackShard, but fails with util.ErrShardExists if the shard is already stored.
+// Pushes never wait on each other, so wait is unused.
+func (m *memstore) UnpackNewShard(ctx context.Context, wait time.Duration, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	return m.unpackShard(ctx, cid, guid, well, shard, rdr, true)
+}
+
+func (m *memstore) unpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader, exclusive bool) (err error) {
+	if well == `` || well == `.` || well == `..` || path.Base(well) != well {
+		return ErrInvalidWell
+	} else if err = util.ValidateShardName(shard); err != nil {
+		return
+	}
+	var up *shardpacker.Unpacker
+	if up, err = shardpacker.NewUnpacker(shard, contextio.NewReader(ctx, rdr)); err != nil {
+		return
+	}
+	h := &handler{files: shardFiles{}}
+	if err = up.Unpack(h); err != nil {
+		return
+	}
+
+	//commit the shard and its tags together
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	idx := m.getIndexer(cid, guid, true)
+	shards, ok := idx.wells[well]
+	if !ok {
+		shards = map[string]shardFiles{}
+	}
+	if _, ok := shards[shard]; ok && (exclusive || m.holds.Held(cid, well)) {
+		return util.ErrShardExists
+	}
+	ts := idx.tags.clone()
+	for _, tgs := range h.tags {
+		if err = ts.merge(tgs); err != nil {
+			return
+		}
+	}
+	idx.tags = ts
+	shards[shard] = h.files
+	idx.wells[well] = shards
+	return
+}
+
+// PackShard sends a stored shard to the writer
+func (m *memstore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	m.mtx.Lock()
+	var files shardFiles
+	if shards, lerr := m.getWell(cid, guid, well); lerr != nil {
+		err = lerr
+	} else if s, ok := shards[shard]; !ok {
+		err = notExist(`open`, strconv.FormatUint(cid, 10), guid.String(), well, shard)
+	} else {
+		//stored shards are replaced rather than modified, so the files can be read unlocked
+		files = s
+	}
+	m.mtx.Unlock()
+	if err != nil {
+		return
+	}
+
+	p := shardpacker.NewPacker(shard)
+	wtr = contextio.NewWriter(ctx, wtr)
+
+	//fire up the routine that will relay from the packer to the writer
+	copyErrChan := make(chan error, 1)
+	go func(ch chan error) {
+		_, err := io.Copy(wtr, p)
+		ch <- err
+	}(copyErrChan)
+
+	addFilesErrChan := make(chan error, 1)
+	go func(ch chan error) {
+		err := addFiles(shard, files, p)
+		if err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Flush(); err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Close(); err != nil {
+			p.CloseWithError(err)
+		}
+		ch <- err
+	}(addFilesErrChan)
+
+	select {
+	case err = <-copyErrChan:
+		if err != nil {
+			//cancel first, the adder may hold the packer lock while blocked flushing to us
+			p.Cancel()
+			p.CloseWithError(err)
+			<-addFilesErrChan
+		} else {
+			err = <-addFilesErrChan
+		}
+	case err = <-addFilesErrChan:
+		if err != nil {
+			p.CloseWithError(err)
+			<-copyErrChan
+		} else {
+			err = <-copyErrChan
+		}
+	}
+	return
+}
+
+// addFiles adds the files a pull sends to the packer, files which are only kept alongside
+// the shard such as metadata and well tags are left out as the file backend does
+func addFiles(id string, files shardFiles, p *shardpacker.Packer) (err error) {
+	for _, ft := range packOrder {
+		name := filepath.ToSlash(ft.Filepath(id))
+		if bts, ok := files[name]; ok {
+			if err = p.AddFile(ft, int64(len(bts)), bytes.NewReader(bts)); err != nil {
+				return
+			}
+		}
+	}
+	var arts []string
+	for name := range files {
+		if shardpacker.IsArtifact(name) {
+			arts = append(arts, name)
+		}
+	}
+	sort.Strings(arts)
+	for _, name := range arts {
+		bts := files[name]
+		if err = p.AddArtifact(name, int64(len(bts)), bytes.NewReader(bts)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *memstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if idx := m.getIndexer(cid, guid, false); idx != nil {
+		tgs = idx.tags.pairs()
+	} else {
+		tgs = tags.StaticTagPairs()
+	}
+	return
+}
+
+func (m *memstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	//this is likely to happen before a shard is pushed, so the indexer is created
+	idx := m.getIndexer(cid, guid, true)
+	ts := idx.tags.clone()
+	if err = ts.merge(idxTags); err != nil {
+		return
+	}
+	idx.tags = ts
+	tgs = ts.pairs()
+	return
+}
+
+// handler collects the files of a pushed shard, tag updates are held until the push completes
+type handler struct {
+	files shardFiles
+	tags  [][]tags.TagPair
+}
+
+func (h *handler) HandleFile(pth string, rdr io.Reader) (err error) {
+	buf := bytes.NewBuffer(nil)
+	if _, err = io.Copy(buf, rdr); err == nil {
+		h.files[filepath.ToSlash(pth)] = buf.Bytes()
+	}
+	return
+}
+
+func (h *handler) HandleTagUpdate(tgs []tags.TagPair) error {
+	h.tags = append(h.tags, tgs)
+	return nil
+}
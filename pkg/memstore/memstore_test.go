@@ -0,0 +1,152 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+)
+
+var _ webserver.ShardHandler = &memstore{}
+
+func pack(t *testing.T, shard string, files map[shardpacker.Ftype][]byte, tps []tags.TagPair) io.Reader {
+	t.Helper()
+	pkr := shardpacker.NewPacker(shard)
+	go func() {
+		var err error
+		if len(tps) > 0 {
+			err = pkr.AddTags(tps)
+		}
+		for ft, bts := range files {
+			if err == nil {
+				err = pkr.AddFile(ft, int64(len(bts)), bytes.NewReader(bts))
+			}
+		}
+		if err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	return pkr
+}
+
+func TestPushPull(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStoreHandler()
+	guid := uuid.New()
+	files := map[shardpacker.Ftype][]byte{
+		shardpacker.Store:              []byte(`store stuff`),
+		shardpacker.Index:              []byte(`index stuff`),
+		shardpacker.Verify:             []byte(`verify stuff`),
+		shardpacker.IndexAccelKeyFile:  []byte(`accel keys`),
+		shardpacker.IndexAccelDataFile: []byte(`accel data`),
+	}
+	tps := []tags.TagPair{{Name: `testing`, Value: 1, Description: `test data`}}
+	for _, s := range []string{`76a00`, `76a01`} {
+		if err := m.UnpackShard(ctx, 1, guid, `foo`, s, pack(t, s, files, tps)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if idx, err := m.ListIndexes(ctx, 1); err != nil || len(idx) != 1 || idx[0] != guid.String() {
+		t.Fatalf("bad indexers %v %v", idx, err)
+	} else if wells, err := m.ListIndexerWells(ctx, 1, guid); err != nil || len(wells) != 1 || wells[0] != `foo` {
+		t.Fatalf("bad wells %v %v", wells, err)
+	}
+	tf, err := m.GetWellTimeframe(ctx, 1, guid, `foo`)
+	if err != nil {
+		t.Fatal(err)
+	} else if s, _, _ := util.ShardNameToDateRange(`76a00`); !tf.Start.Equal(s) {
+		t.Fatalf("bad timeframe start %v", tf.Start)
+	} else if _, e, _ := util.ShardNameToDateRange(`76a01`); !tf.End.Equal(e) {
+		t.Fatalf("bad timeframe end %v", tf.End)
+	}
+	if shards, err := m.GetShardsInTimeframe(ctx, 1, guid, `foo`, tf); err != nil || len(shards) != 2 {
+		t.Fatalf("bad shards %v %v", shards, err)
+	}
+
+	bb := bytes.NewBuffer(nil)
+	if err = m.PackShard(ctx, 1, guid, `foo`, `76a01`, bb); err != nil {
+		t.Fatal(err)
+	}
+	up, err := shardpacker.NewUnpacker(`76a01`, bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := storetest.FileSet{}
+	if err = up.Unpack(got); err != nil {
+		t.Fatal(err)
+	}
+	for ft, want := range files {
+		if !bytes.Equal(got[ft.Filepath(`76a01`)], want) {
+			t.Fatalf("pulled %s does not match", ft.Filepath(`76a01`))
+		}
+	}
+
+	//tags pushed with the shard are kept, conflicting ones are refused
+	if tgs, err := m.GetTags(ctx, 1, guid); err != nil || len(tgs) != 3 || tgs[1].Name != `testing` || tgs[1].Description != `test data` {
+		t.Fatalf("bad tags %+v %v", tgs, err)
+	}
+	if _, err = m.SyncTags(ctx, 1, guid, []tags.TagPair{{Name: `other`, Value: 1}}); err == nil {
+		t.Fatal("conflicting tag was merged")
+	}
+	if tgs, err := m.SyncTags(ctx, 1, guid, []tags.TagPair{{Name: `other`, Value: 2}}); err != nil || len(tgs) != 4 {
+		t.Fatalf("bad tags %+v %v", tgs, err)
+	}
+
+	if usage, err := m.CustomerUsage(ctx, 1); err != nil || usage != 2*54 {
+		t.Fatalf("bad usage %d %v", usage, err)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStoreHandler()
+	guid := uuid.New()
+	if _, err := m.ListIndexes(ctx, 1); !os.IsNotExist(err) {
+		t.Fatalf("listed a missing customer: %v", err)
+	} else if err = m.PackShard(ctx, 1, guid, `foo`, `76a00`, ioutil.Discard); !os.IsNotExist(err) {
+		t.Fatalf("pulled a missing shard: %v", err)
+	}
+	files := map[shardpacker.Ftype][]byte{shardpacker.Store: []byte(`store stuff`)}
+	if err := m.UnpackNewShard(ctx, 0, 1, guid, `foo`, `76a00`, pack(t, `76a00`, files, nil)); err != nil {
+		t.Fatal(err)
+	} else if err = m.UnpackNewShard(ctx, 0, 1, guid, `foo`, `76a00`, pack(t, `76a00`, files, nil)); !errors.Is(err, util.ErrShardExists) {
+		t.Fatalf("duplicate push was not refused: %v", err)
+	}
+
+	//a truncated push stores nothing
+	pr, pw := io.Pipe()
+	pw.CloseWithError(errors.New("dropped"))
+	if err := m.UnpackShard(ctx, 1, guid, `foo`, `76a01`, pr); err == nil {
+		t.Fatal("truncated push succeeded")
+	} else if err = m.PackShard(ctx, 1, guid, `foo`, `76a01`, ioutil.Discard); !os.IsNotExist(err) {
+		t.Fatalf("truncated push was stored: %v", err)
+	}
+
+	if err := m.DeleteShard(ctx, 1, guid, `foo`, `76a00`); err != nil {
+		t.Fatal(err)
+	} else if err = m.DeleteShard(ctx, 1, guid, `foo`, `76a00`); !os.IsNotExist(err) {
+		t.Fatalf("deleted a missing shard: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package memstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gravwell/cloudarchive/pkg/tags"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// tagSet is an indexer's tags, merged with the same rules as the tags.dat kept by the file backend
+type tagSet struct {
+	names map[string]entry.EntryTag
+	ids   map[entry.EntryTag]string
+	meta  map[string]tags.TagPair //descriptions and origins, only for tags which have them
+}
+
+// newTagSet returns a set holding only the default and gravwell tags
+func newTagSet() *tagSet {
+	ts := &tagSet{
+		names: map[string]entry.EntryTag{},
+		ids:   map[entry.EntryTag]string{},
+		meta:  map[string]tags.TagPair{},
+	}
+	for _, tp := range tags.StaticTagPairs() {
+		ts.names[tp.Name] = tp.Value
+		ts.ids[tp.Value] = tp.Name
+	}
+	return ts
+}
+
+func (ts *tagSet) clone() *tagSet {
+	c := &tagSet{
+		names: make(map[string]entry.EntryTag, len(ts.names)),
+		ids:   make(map[entry.EntryTag]string, len(ts.ids)),
+		meta:  make(map[string]tags.TagPair, len(ts.meta)),
+	}
+	for k, v := range ts.names {
+		c.names[k] = v
+	}
+	for k, v := range ts.ids {
+		c.ids[k] = v
+	}
+	for k, v := range ts.meta {
+		c.meta[k] = v
+	}
+	return c
+}
+
+// merge adds the tags to the set, a name or id which is already mapped differently is an error.
+// The set may be partially updated on error, so callers merge into a clone.
+func (ts *tagSet) merge(s []tags.TagPair) error {
+	if len(s) > 0xffff {
+		return errors.New("Too many tags specified")
+	}
+	for _, v := range s {
+		switch v.Name {
+		case entry.DefaultTagName:
+			if v.Value != entry.DefaultTagId {
+				return errors.New("Invalid value for default tag")
+			}
+		case entry.GravwellTagName:
+			if v.Value != entry.GravwellTagId {
+				return errors.New("Invalid value for gravwell tag")
+			}
+		}
+	}
+	for _, v := range s {
+		var hit bool
+		if cname, ok := ts.ids[v.Value]; ok {
+			if cname != v.Name {
+				return fmt.Errorf("%s tag exists in current set and does not match provided set", v.Name)
+			}
+			hit = true
+		}
+		if ctag, ok := ts.names[v.Name]; ok {
+			if ctag != v.Value {
+				return fmt.Errorf("%s tag name exists in current set and does not match", v.Name)
+			}
+			hit = true
+		}
+		if !hit {
+			if err := ingest.CheckTag(v.Name); err != nil {
+				return err
+			}
+			ts.names[v.Name] = v.Value
+			ts.ids[v.Value] = v.Name
+		}
+		//a non-empty description or origin replaces the stored one
+		md := ts.meta[v.Name]
+		if v.Description != `` {
+			md.Description = v.Description
+		}
+		if v.Origin != `` {
+			md.Origin = v.Origin
+		}
+		if md.Description != `` || md.Origin != `` {
+			ts.meta[v.Name] = md
+		}
+	}
+	return nil
+}
+
+// pairs returns every tag in the set ordered by id
+func (ts *tagSet) pairs() (tps []tags.TagPair) {
+	tps = make([]tags.TagPair, 0, len(ts.names))
+	for name, id := range ts.names {
+		md := ts.meta[name]
+		tps = append(tps, tags.TagPair{Name: name, Value: id, Description: md.Description, Origin: md.Origin})
+	}
+	sort.Slice(tps, func(i, j int) bool { return tps[i].Value < tps[j].Value })
+	return
+}
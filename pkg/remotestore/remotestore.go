@@ -0,0 +1,291 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package remotestore connects the server to a storage backend running in its own
+// process, so storage integrations can be built and shipped separately from the server.
+// The backend process implements webserver.ShardHandler and serves it with NewServer,
+// the server reaches it through the remote backend over gRPC, usually on a unix socket.
+package remotestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gravwell/cloudarchive/pkg/backendpb"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const chunkSize = 64 * 1024 //largest data chunk sent in a single message
+
+var (
+	ErrMissingAddress = errors.New("Missing remote backend address")
+)
+
+type remotestore struct {
+	cfg  RemoteStoreConfig
+	conn *grpc.ClientConn
+	clnt backendpb.ShardStoreClient
+}
+
+type RemoteStoreConfig struct {
+	// Address of the backend process, unix:///path/to/socket for a unix socket or
+	// host:port for TCP.  Connections are not encrypted so TCP should only be used
+	// over loopback.
+	Address string
+	Lgr     *log.Logger
+}
+
+// NewRemoteStoreHandler creates a ShardHandler which forwards every call to the backend
+// process at cfg.Address.  The connection is made lazily and re-established if the
+// backend process restarts.
+func NewRemoteStoreHandler(cfg RemoteStoreConfig) (*remotestore, error) {
+	if cfg.Address == `` {
+		return nil, ErrMissingAddress
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	conn, err := grpc.Dial(cfg.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &remotestore{
+		cfg:  cfg,
+		conn: conn,
+		clnt: backendpb.NewShardStoreClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the backend process
+func (r *remotestore) Close() error {
+	return r.conn.Close()
+}
+
+func (r *remotestore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
+	resp, err := r.clnt.ListIndexes(ctx, &backendpb.ListIndexesRequest{Cid: cid})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp.Indexers, nil
+}
+
+func (r *remotestore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
+	resp, err := r.clnt.ListIndexerWells(ctx, &backendpb.IndexerRequest{Cid: cid, Indexer: guid.String()})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp.Wells, nil
+}
+
+func (r *remotestore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (tf util.Timeframe, err error) {
+	var resp *backendpb.Timeframe
+	if resp, err = r.clnt.GetWellTimeframe(ctx, &backendpb.WellRequest{Cid: cid, Indexer: guid.String(), Well: well}); err != nil {
+		err = fromStatus(err)
+		return
+	}
+	tf = fromPBTimeframe(resp)
+	return
+}
+
+func (r *remotestore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	resp, err := r.clnt.GetShardsInTimeframe(ctx, &backendpb.ShardsInTimeframeRequest{
+		Cid:       cid,
+		Indexer:   guid.String(),
+		Well:      well,
+		Timeframe: toPBTimeframe(tf),
+	})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp.Shards, nil
+}
+
+func (r *remotestore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) ([]tags.TagPair, error) {
+	resp, err := r.clnt.GetTags(ctx, &backendpb.IndexerRequest{Cid: cid, Indexer: guid.String()})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return fromPBTags(resp.Tags)
+}
+
+func (r *remotestore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) ([]tags.TagPair, error) {
+	resp, err := r.clnt.SyncTags(ctx, &backendpb.SyncTagsRequest{Cid: cid, Indexer: guid.String(), Tags: toPBTags(idxTags)})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return fromPBTags(resp.Tags)
+}
+
+// UnpackShard sends the packed shard to the backend process, which does not hear about
+// the end of the stream until the whole shard has been read, so a failed read never
+// leaves a truncated shard behind
+func (r *remotestore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) (err error) {
+	ctx, cf := context.WithCancel(ctx)
+	defer cf()
+	var stream backendpb.ShardStore_UnpackShardClient
+	if stream, err = r.clnt.UnpackShard(ctx); err != nil {
+		return fromStatus(err)
+	}
+	msg := &backendpb.UnpackShardRequest{
+		Shard: &backendpb.ShardRequest{Cid: cid, Indexer: guid.String(), Well: well, Shard: shard},
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, rerr := rdr.Read(buf)
+		if n > 0 || msg.Shard != nil {
+			msg.Data = buf[:n]
+			if err = stream.Send(msg); err == io.EOF {
+				break //the backend ended the call, its status is returned by CloseAndRecv
+			} else if err != nil {
+				return fromStatus(err)
+			}
+			msg = &backendpb.UnpackShardRequest{}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return rerr //cancelling the call aborts the unpack
+		}
+	}
+	if _, err = stream.CloseAndRecv(); err != nil {
+		err = fromStatus(err)
+	}
+	return
+}
+
+func (r *remotestore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	ctx, cf := context.WithCancel(ctx)
+	defer cf()
+	var stream backendpb.ShardStore_PackShardClient
+	if stream, err = r.clnt.PackShard(ctx, &backendpb.ShardRequest{Cid: cid, Indexer: guid.String(), Well: well, Shard: shard}); err != nil {
+		return fromStatus(err)
+	}
+	for {
+		var msg *backendpb.ShardChunk
+		if msg, err = stream.Recv(); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return fromStatus(err)
+		} else if _, err = wtr.Write(msg.Data); err != nil {
+			return
+		}
+	}
+}
+
+// fromStatus translates a status from the backend process back into the errors the
+// server recognizes, the message is kept so the backend's error is still logged
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.NotFound:
+		return &os.PathError{Op: `remote`, Path: st.Message(), Err: os.ErrNotExist}
+	case codes.Aborted:
+		return wrapStatus(util.ErrUploadInProgress, st)
+	case codes.AlreadyExists:
+		return wrapStatus(util.ErrShardExists, st)
+	case codes.FailedPrecondition:
+		return wrapStatus(util.ErrLegalHold, st)
+	case codes.ResourceExhausted:
+		return wrapStatus(util.ErrQueueFull, st)
+	case codes.Canceled:
+		return wrapStatus(context.Canceled, st)
+	case codes.DeadlineExceeded:
+		return wrapStatus(context.DeadlineExceeded, st)
+	}
+	return err
+}
+
+// toStatus translates a ShardHandler error into the status sent back to the server
+func toStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err), errors.Is(err, os.ErrNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, util.ErrUploadInProgress):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, util.ErrShardExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, util.ErrLegalHold):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, util.ErrQueueFull):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// statusError keeps the backend's message while matching the server's sentinel error
+type statusError struct {
+	sentinel error
+	msg      string
+}
+
+func wrapStatus(sentinel error, st *status.Status) error {
+	return statusError{sentinel: sentinel, msg: st.Message()}
+}
+
+func (se statusError) Error() string { return se.msg }
+func (se statusError) Unwrap() error { return se.sentinel }
+
+func toPBTimeframe(tf util.Timeframe) *backendpb.Timeframe {
+	return &backendpb.Timeframe{
+		Start: timestamppb.New(tf.Start),
+		End:   timestamppb.New(tf.End),
+	}
+}
+
+func fromPBTimeframe(tf *backendpb.Timeframe) (r util.Timeframe) {
+	if tf != nil {
+		if tf.Start != nil {
+			r.Start = tf.Start.AsTime()
+		}
+		if tf.End != nil {
+			r.End = tf.End.AsTime()
+		}
+	}
+	return
+}
+
+func toPBTags(tgs []tags.TagPair) (r []*backendpb.Tag) {
+	r = make([]*backendpb.Tag, 0, len(tgs))
+	for _, t := range tgs {
+		r = append(r, &backendpb.Tag{Name: t.Name, Value: uint32(t.Value), Description: t.Description, Origin: t.Origin})
+	}
+	return
+}
+
+func fromPBTags(tgs []*backendpb.Tag) (r []tags.TagPair, err error) {
+	r = make([]tags.TagPair, 0, len(tgs))
+	for _, t := range tgs {
+		if t.Value > uint32(^entry.EntryTag(0)) {
+			err = fmt.Errorf("Tag %s value %d is out of range", t.Name, t.Value)
+			return
+		}
+		r = append(r, tags.TagPair{Name: t.Name, Value: entry.EntryTag(t.Value), Description: t.Description, Origin: t.Origin})
+	}
+	return
+}
@@ -0,0 +1,138 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package remotestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// newTestStore serves a file store from a unix socket and connects a remote store to it
+func newTestStore(t *testing.T) *remotestore {
+	fs, _ := storetest.NewFileStore(t)
+	sock := filepath.Join(t.TempDir(), `backend.sock`)
+	lst, err := net.Listen(`unix`, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(fs)
+	go srv.Serve(lst)
+	t.Cleanup(srv.Stop)
+	r, err := NewRemoteStoreHandler(RemoteStoreConfig{Address: `unix://` + sock, Lgr: log.NewDiscardLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestRemoteStore(t *testing.T) {
+	r := newTestStore(t)
+	ctx := context.Background()
+	guid := uuid.New()
+	files := map[string][]byte{
+		`.index`:  []byte(`index`),
+		`.verify`: []byte(`verify`),
+		`.store`:  bytes.Repeat([]byte(`store data `), 3*chunkSize),
+	}
+	if err := r.UnpackShard(ctx, 1, guid, `default`, `76a00`, storetest.NewShard(t, `76a00`, files)); err != nil {
+		t.Fatal(err)
+	}
+
+	if idxs, err := r.ListIndexes(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 1 || idxs[0] != guid.String() {
+		t.Fatalf("bad indexes %v", idxs)
+	}
+	if wells, err := r.ListIndexerWells(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else if len(wells) != 1 || wells[0] != `default` {
+		t.Fatalf("bad wells %v", wells)
+	}
+	s, e, _ := util.ShardNameToDateRange(`76a00`)
+	if tf, err := r.GetWellTimeframe(ctx, 1, guid, `default`); err != nil {
+		t.Fatal(err)
+	} else if !tf.Start.Equal(s) || !tf.End.Equal(e) {
+		t.Fatalf("bad timeframe %v", tf)
+	}
+	if shards, err := r.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: s, End: e}); err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 1 || shards[0] != `76a00` {
+		t.Fatalf("bad shards %v", shards)
+	}
+
+	tgs := []tags.TagPair{{Name: `syslog`, Value: 1, Description: `system logs`}}
+	if got, err := r.SyncTags(ctx, 1, guid, tgs); err != nil {
+		t.Fatal(err)
+	} else if !hasTag(got, tgs[0]) {
+		t.Fatalf("synced tags missing %v: %v", tgs[0], got)
+	}
+	if got, err := r.GetTags(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else if !hasTag(got, tgs[0]) {
+		t.Fatalf("tags missing %v: %v", tgs[0], got)
+	}
+
+	storetest.CheckPull(t, r, guid, `76a00`, files)
+
+	//errors the server acts on survive the trip
+	if err := r.PackShard(ctx, 1, guid, `default`, `76a01`, ioutil.Discard); err == nil || !os.IsNotExist(err) {
+		t.Fatalf("missing shard pulled with %v", err)
+	}
+	if err := r.UnpackShard(ctx, 1, guid, `default`, `76a02`, bytes.NewReader([]byte(`not a shard`))); err == nil {
+		t.Fatal("bad shard accepted")
+	} else if shards, err := r.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: s, End: e.Add(1 << 40)}); err != nil || len(shards) != 1 {
+		t.Fatalf("bad shard left behind %v %v", shards, err)
+	}
+	//a push which fails on the server side never completes on the backend
+	rdr := io.MultiReader(bytes.NewReader(bytes.Repeat([]byte{0}, chunkSize)), errReader{})
+	if err := r.UnpackShard(ctx, 1, guid, `default`, `76a03`, rdr); !errors.Is(err, errRead) {
+		t.Fatalf("failed read returned %v", err)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	for _, err := range []error{util.ErrUploadInProgress, util.ErrShardExists, util.ErrLegalHold, util.ErrQueueFull, context.Canceled} {
+		if r := fromStatus(toStatus(err)); !errors.Is(r, err) {
+			t.Fatalf("%v came back as %v", err, r)
+		}
+	}
+	if r := fromStatus(toStatus(os.ErrNotExist)); !os.IsNotExist(r) {
+		t.Fatalf("not exist came back as %v", r)
+	}
+}
+
+var errRead = errors.New("read failed")
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errRead }
+
+func hasTag(tgs []tags.TagPair, tp tags.TagPair) bool {
+	for _, v := range tgs {
+		if v.Name == tp.Name && v.Value == tp.Value && v.Description == tp.Description {
+			return true
+		}
+	}
+	return false
+}
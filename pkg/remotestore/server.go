@@ -0,0 +1,197 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package remotestore
+
+import (
+	"context"
+
+	"github.com/gravwell/cloudarchive/pkg/backendpb"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewServer returns a gRPC server which serves the ShardHandler to the remote backend,
+// a backend process typically listens on a unix socket and calls Serve:
+//
+//	lst, err := net.Listen(`unix`, `/run/cloudarchive/backend.sock`)
+//	...
+//	err = remotestore.NewServer(myStore).Serve(lst)
+//
+// The server does not authenticate callers, access is controlled by who may open the socket.
+func NewServer(h webserver.ShardHandler, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	backendpb.RegisterShardStoreServer(srv, &shardStoreServer{h: h})
+	return srv
+}
+
+// shardStoreServer implements the ShardStore service on top of a ShardHandler
+type shardStoreServer struct {
+	backendpb.UnimplementedShardStoreServer
+	h webserver.ShardHandler
+}
+
+func parseIndexer(v string) (guid uuid.UUID, err error) {
+	if guid, err = uuid.Parse(v); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+	}
+	return
+}
+
+func (s *shardStoreServer) ListIndexes(ctx context.Context, req *backendpb.ListIndexesRequest) (*backendpb.ListIndexesResponse, error) {
+	idx, err := s.h.ListIndexes(ctx, req.Cid)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &backendpb.ListIndexesResponse{Indexers: idx}, nil
+}
+
+func (s *shardStoreServer) ListIndexerWells(ctx context.Context, req *backendpb.IndexerRequest) (*backendpb.ListIndexerWellsResponse, error) {
+	guid, err := parseIndexer(req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	wells, err := s.h.ListIndexerWells(ctx, req.Cid, guid)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &backendpb.ListIndexerWellsResponse{Wells: wells}, nil
+}
+
+func (s *shardStoreServer) GetWellTimeframe(ctx context.Context, req *backendpb.WellRequest) (*backendpb.Timeframe, error) {
+	guid, err := parseIndexer(req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := s.h.GetWellTimeframe(ctx, req.Cid, guid, req.Well)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toPBTimeframe(tf), nil
+}
+
+func (s *shardStoreServer) GetShardsInTimeframe(ctx context.Context, req *backendpb.ShardsInTimeframeRequest) (*backendpb.ShardsResponse, error) {
+	guid, err := parseIndexer(req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := s.h.GetShardsInTimeframe(ctx, req.Cid, guid, req.Well, fromPBTimeframe(req.Timeframe))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &backendpb.ShardsResponse{Shards: shards}, nil
+}
+
+func (s *shardStoreServer) GetTags(ctx context.Context, req *backendpb.IndexerRequest) (*backendpb.TagsResponse, error) {
+	guid, err := parseIndexer(req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	tgs, err := s.h.GetTags(ctx, req.Cid, guid)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &backendpb.TagsResponse{Tags: toPBTags(tgs)}, nil
+}
+
+func (s *shardStoreServer) SyncTags(ctx context.Context, req *backendpb.SyncTagsRequest) (*backendpb.TagsResponse, error) {
+	guid, err := parseIndexer(req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	idxTags, err := fromPBTags(req.Tags)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	tgs, err := s.h.SyncTags(ctx, req.Cid, guid, idxTags)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &backendpb.TagsResponse{Tags: toPBTags(tgs)}, nil
+}
+
+func (s *shardStoreServer) UnpackShard(stream backendpb.ShardStore_UnpackShardServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	ref := first.GetShard()
+	if ref == nil {
+		return status.Error(codes.InvalidArgument, "The first message must name the shard")
+	}
+	guid, err := parseIndexer(ref.Indexer)
+	if err != nil {
+		return err
+	}
+	rdr := &unpackReader{ctx: stream.Context(), stream: stream, buf: first.Data}
+	if err = s.h.UnpackShard(stream.Context(), ref.Cid, guid, ref.Well, ref.Shard, rdr); err != nil {
+		return toStatus(err)
+	}
+	return stream.SendAndClose(&backendpb.UnpackShardResponse{})
+}
+
+func (s *shardStoreServer) PackShard(req *backendpb.ShardRequest, stream backendpb.ShardStore_PackShardServer) error {
+	guid, err := parseIndexer(req.Indexer)
+	if err != nil {
+		return err
+	}
+	if err = s.h.PackShard(stream.Context(), req.Cid, guid, req.Well, req.Shard, packWriter{ctx: stream.Context(), stream: stream}); err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// unpackReader presents the data chunks of an unpack stream as an io.Reader
+type unpackReader struct {
+	ctx    context.Context // checked between chunks, a blocked Recv only returns with the stream
+	stream backendpb.ShardStore_UnpackShardServer
+	buf    []byte
+}
+
+func (ur *unpackReader) Read(b []byte) (n int, err error) {
+	for len(ur.buf) == 0 {
+		var msg *backendpb.UnpackShardRequest
+		if err = ur.ctx.Err(); err != nil {
+			return
+		} else if msg, err = ur.stream.Recv(); err != nil {
+			return //io.EOF once the server has sent the whole shard
+		}
+		ur.buf = msg.Data
+	}
+	n = copy(b, ur.buf)
+	ur.buf = ur.buf[n:]
+	return
+}
+
+// packWriter sends everything written to it as a series of shard chunks
+type packWriter struct {
+	ctx    context.Context
+	stream backendpb.ShardStore_PackShardServer
+}
+
+func (pw packWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if err = pw.ctx.Err(); err != nil {
+			return
+		}
+		sz := len(b)
+		if sz > chunkSize {
+			sz = chunkSize
+		}
+		if err = pw.stream.Send(&backendpb.ShardChunk{Data: b[:sz]}); err != nil {
+			return
+		}
+		n += sz
+		b = b[sz:]
+	}
+	return
+}
@@ -0,0 +1,43 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package replicastore
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/journal"
+
+	"github.com/google/uuid"
+)
+
+const (
+	repairJournalFile = `replica-journal.json`
+)
+
+// pendingRepair is a shard which was pushed but did not reach one of the replicas
+type pendingRepair struct {
+	CID     uint64
+	IdxUUID uuid.UUID
+	Well    string
+	Shard   string
+	Replica string // name of the replica missing the shard
+	journal.Progress
+}
+
+func (p pendingRepair) Key() string {
+	return fmt.Sprintf("%s/%d/%s/%s/%s", p.Replica, p.CID, p.IdxUUID, p.Well, p.Shard)
+}
+
+// repairJournal keeps the pending repairs on disk so that they survive a restart
+type repairJournal = journal.Journal[pendingRepair, *pendingRepair]
+
+func openRepairJournal(dir string) (*repairJournal, error) {
+	return journal.Open[pendingRepair](filepath.Join(dir, repairJournalFile), `replica`)
+}
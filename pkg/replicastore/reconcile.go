@@ -0,0 +1,223 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package replicastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	repairTimeout = 30 * time.Minute // longest a single shard copy may take
+)
+
+func (rs *replicastore) reconcileRoutine() {
+	defer rs.wg.Done()
+	ctx, cf := context.WithCancel(context.Background())
+	go func() {
+		<-rs.done
+		cf()
+	}()
+	tckr := time.NewTicker(rs.cfg.ReconcileInterval)
+	defer tckr.Stop()
+	for {
+		rs.repairPending(ctx)
+		for _, cid := range rs.takeScans() {
+			if err := rs.Reconcile(ctx, cid); err != nil && ctx.Err() == nil {
+				rs.cfg.Lgr.Warn("Failed to reconcile replicas", log.KV("cid", cid), log.KVErr(err))
+				rs.mtx.Lock()
+				rs.seen[cid] = false //try again once the customer is next seen
+				rs.mtx.Unlock()
+			}
+		}
+		select {
+		case <-rs.done:
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (rs *replicastore) takeScans() (cids []uint64) {
+	rs.mtx.Lock()
+	for cid := range rs.scans {
+		cids = append(cids, cid)
+	}
+	rs.scans = map[uint64]struct{}{}
+	rs.mtx.Unlock()
+	return
+}
+
+// repairPending copies each shard in the journal to the replica which missed it
+func (rs *replicastore) repairPending(ctx context.Context) {
+	for _, p := range rs.journal.List() {
+		if ctx.Err() != nil {
+			return
+		}
+		err := rs.repair(ctx, p)
+		if err == nil {
+			if err = rs.journal.Done(p); err != nil {
+				rs.cfg.Lgr.Error("Failed to update replica journal", log.KVErr(err))
+			}
+			continue
+		}
+		rs.cfg.Lgr.Warn("Failed to repair shard on replica, will retry", log.KV("replica", p.Replica),
+			log.KV("cid", p.CID), log.KV("indexeruuid", p.IdxUUID), log.KV("well", p.Well), log.KV("shard", p.Shard),
+			log.KV("attempts", p.Attempts+1), log.KVErr(err))
+		if err = rs.journal.Failed(p, err); err != nil {
+			rs.cfg.Lgr.Error("Failed to update replica journal", log.KVErr(err))
+		}
+	}
+}
+
+func (rs *replicastore) repair(ctx context.Context, p pendingRepair) error {
+	dst := rs.replicaIndex(p.Replica)
+	if dst < 0 {
+		return nil //the replica was removed from the configuration, nothing to do
+	}
+	for _, i := range rs.order() {
+		if i == dst {
+			continue
+		}
+		err := rs.copyShard(ctx, i, dst, p.CID, p.IdxUUID, p.Well, p.Shard)
+		if err == nil || !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("No replica has shard %s", p.Shard)
+}
+
+func (rs *replicastore) replicaIndex(name string) int {
+	for i, r := range rs.cfg.Replicas {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyShard pipes a shard from one replica into another, a shard which the destination
+// already has counts as copied
+func (rs *replicastore) copyShard(ctx context.Context, src, dst int, cid uint64, guid uuid.UUID, well, shard string) (err error) {
+	ctx, cf := context.WithTimeout(ctx, repairTimeout)
+	defer cf()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rs.cfg.Replicas[src].Handler.PackShard(ctx, cid, guid, well, shard, pw))
+	}()
+	h := rs.cfg.Replicas[dst].Handler
+	if eu, ok := h.(webserver.ExclusiveShardUnpacker); ok {
+		err = eu.UnpackNewShard(ctx, 0, cid, guid, well, shard, pr)
+	} else {
+		err = h.UnpackShard(ctx, cid, guid, well, shard, pr)
+	}
+	pr.CloseWithError(ErrReplicaFinished)
+	if errors.Is(err, util.ErrShardExists) {
+		err = nil
+	}
+	rs.result(dst, err)
+	return
+}
+
+type shardRef struct {
+	guid  uuid.UUID
+	well  string
+	shard string
+}
+
+// Reconcile compares the shards each replica holds for a customer and copies any which are
+// missing from a replica to it.  It runs in the background for each customer the first
+// time they are seen after startup, catching shards which were pushed while a replica was
+// out of service and never journaled.
+func (rs *replicastore) Reconcile(ctx context.Context, cid uint64) (err error) {
+	have := make([]map[shardRef]bool, len(rs.cfg.Replicas))
+	all := map[shardRef]bool{}
+	for i, r := range rs.cfg.Replicas {
+		if have[i], err = listReplica(ctx, r.Handler, cid); err != nil {
+			return fmt.Errorf("listing replica %s: %w", r.Name, err)
+		}
+		for ref := range have[i] {
+			all[ref] = true
+		}
+	}
+	var copied int
+	for ref := range all {
+		for dst := range rs.cfg.Replicas {
+			if have[dst][ref] {
+				continue
+			}
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			for src := range rs.cfg.Replicas {
+				if !have[src][ref] {
+					continue
+				}
+				if lerr := rs.copyShard(ctx, src, dst, cid, ref.guid, ref.well, ref.shard); lerr != nil {
+					rs.cfg.Lgr.Warn("Failed to copy shard between replicas", log.KV("from", rs.cfg.Replicas[src].Name),
+						log.KV("to", rs.cfg.Replicas[dst].Name), log.KV("cid", cid), log.KV("indexeruuid", ref.guid),
+						log.KV("well", ref.well), log.KV("shard", ref.shard), log.KVErr(lerr))
+					continue
+				}
+				have[dst][ref] = true
+				copied++
+				break
+			}
+		}
+	}
+	if copied > 0 {
+		rs.cfg.Lgr.Info("Reconciled replicas", log.KV("cid", cid), log.KV("copied", copied))
+	}
+	return
+}
+
+// listReplica returns every shard a replica holds for the customer
+func listReplica(ctx context.Context, h webserver.ShardHandler, cid uint64) (refs map[shardRef]bool, err error) {
+	refs = map[shardRef]bool{}
+	var idxs []string
+	if idxs, err = h.ListIndexes(ctx, cid); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, idx := range idxs {
+		var guid uuid.UUID
+		if guid, err = uuid.Parse(idx); err != nil {
+			return
+		}
+		var wells []string
+		if wells, err = h.ListIndexerWells(ctx, cid, guid); err != nil {
+			return
+		}
+		for _, well := range wells {
+			var tf util.Timeframe
+			var shards []string
+			if tf, err = h.GetWellTimeframe(ctx, cid, guid, well); err != nil {
+				return
+			} else if shards, err = h.GetShardsInTimeframe(ctx, cid, guid, well, tf); err != nil {
+				return
+			}
+			for _, shard := range shards {
+				refs[shardRef{guid: guid, well: well, shard: shard}] = true
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,475 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package replicastore is a storage backend which keeps a copy of every shard on each
+// of two or more other backends, such as the local disk and an object store.  Pushes are
+// streamed to every replica at once, reads are served by the first healthy replica which
+// has the shard, and shards which did not reach a replica are copied to it in the
+// background from a replica which has them.
+package replicastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	DefaultReconcileInterval = 5 * time.Minute
+	DefaultRetryDown         = 30 * time.Second // how long a failed replica is passed over for reads
+)
+
+var (
+	ErrTooFewReplicas  = errors.New("At least two replicas are required")
+	ErrBadMinWrites    = errors.New("Minimum writes must be between 1 and the number of replicas")
+	ErrMissingStore    = errors.New("Missing local storage directory")
+	ErrReplicaFinished = errors.New("Replica stopped reading the shard")
+)
+
+// Replica is one of the backends a shard is copied to
+type Replica struct {
+	Name    string
+	Handler webserver.ShardHandler
+}
+
+type ReplicaStoreConfig struct {
+	// Replicas in order of preference for reads, the first is usually the local disk
+	Replicas []Replica
+	// A push succeeds once this many replicas have stored the shard, the others are
+	// repaired in the background.  Zero selects one.
+	MinWrites int
+	// How often shards which are missing from a replica are copied to it, zero selects
+	// DefaultReconcileInterval and a negative interval disables background repair.
+	ReconcileInterval time.Duration
+	LocalStore        string // where the journal of shards waiting to be repaired is kept
+	Lgr               *log.Logger
+}
+
+type replicastore struct {
+	cfg     ReplicaStoreConfig
+	journal *repairJournal
+
+	mtx   sync.Mutex
+	down  []time.Time         // replicas which failed are passed over for reads until then
+	seen  map[uint64]bool     // customers which have been fully reconciled since start
+	scans map[uint64]struct{} // customers waiting for a full reconcile
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+func NewReplicaStoreHandler(cfg ReplicaStoreConfig) (*replicastore, error) {
+	if len(cfg.Replicas) < 2 {
+		return nil, ErrTooFewReplicas
+	} else if cfg.LocalStore == `` {
+		return nil, ErrMissingStore
+	}
+	if cfg.MinWrites == 0 {
+		cfg.MinWrites = 1
+	} else if cfg.MinWrites < 0 || cfg.MinWrites > len(cfg.Replicas) {
+		return nil, ErrBadMinWrites
+	}
+	if cfg.ReconcileInterval == 0 {
+		cfg.ReconcileInterval = DefaultReconcileInterval
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	names := map[string]bool{}
+	for _, r := range cfg.Replicas {
+		if r.Handler == nil {
+			return nil, fmt.Errorf("Replica %q has no backend", r.Name)
+		} else if names[r.Name] {
+			return nil, fmt.Errorf("Replica %q is listed twice", r.Name)
+		}
+		names[r.Name] = true
+	}
+	rj, err := openRepairJournal(cfg.LocalStore)
+	if err != nil {
+		return nil, err
+	}
+	rs := &replicastore{
+		cfg:     cfg,
+		journal: rj,
+		down:    make([]time.Time, len(cfg.Replicas)),
+		seen:    map[uint64]bool{},
+		scans:   map[uint64]struct{}{},
+		done:    make(chan struct{}),
+	}
+	if n := rj.Len(); n > 0 {
+		cfg.Lgr.Warn("Shard replications pending from a previous run", log.KV("count", n))
+	}
+	if cfg.ReconcileInterval > 0 {
+		rs.wg.Add(1)
+		go rs.reconcileRoutine()
+	}
+	return rs, nil
+}
+
+// Close stops background repair and closes every replica which can be closed
+func (rs *replicastore) Close() (err error) {
+	rs.once.Do(func() {
+		close(rs.done)
+		rs.wg.Wait()
+		for _, r := range rs.cfg.Replicas {
+			if c, ok := r.Handler.(io.Closer); ok {
+				if lerr := c.Close(); lerr != nil && err == nil {
+					err = lerr
+				}
+			}
+		}
+	})
+	return
+}
+
+// order returns the replicas to try for a read, healthy replicas first in order of
+// preference followed by those which recently failed
+func (rs *replicastore) order() (idx []int) {
+	now := time.Now()
+	var failed []int
+	rs.mtx.Lock()
+	for i := range rs.cfg.Replicas {
+		if now.Before(rs.down[i]) {
+			failed = append(failed, i)
+		} else {
+			idx = append(idx, i)
+		}
+	}
+	rs.mtx.Unlock()
+	return append(idx, failed...)
+}
+
+// result records the outcome of a call to a replica, errors which say something about
+// the request rather than the replica do not count against it
+func (rs *replicastore) result(i int, err error) {
+	if err == nil || isRequestError(err) {
+		return
+	}
+	rs.mtx.Lock()
+	if time.Now().After(rs.down[i]) {
+		rs.cfg.Lgr.Warn("Replica failed, passing it over for reads",
+			log.KV("replica", rs.cfg.Replicas[i].Name), log.KV("retry", DefaultRetryDown), log.KVErr(err))
+	}
+	rs.down[i] = time.Now().Add(DefaultRetryDown)
+	rs.mtx.Unlock()
+}
+
+func isRequestError(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, util.ErrUploadInProgress) || errors.Is(err, util.ErrShardExists) ||
+		errors.Is(err, util.ErrLegalHold) || errors.Is(err, context.Canceled)
+}
+
+// noteCustomer queues a full reconcile the first time a customer is seen
+func (rs *replicastore) noteCustomer(cid uint64) {
+	rs.mtx.Lock()
+	if !rs.seen[cid] {
+		rs.seen[cid] = true
+		rs.scans[cid] = struct{}{}
+	}
+	rs.mtx.Unlock()
+}
+
+// union calls fn against every replica and merges the names each returns, so shards
+// which have not yet been repaired are still listed.  It only fails if every replica does.
+func (rs *replicastore) union(fn func(webserver.ShardHandler) ([]string, error)) (r []string, err error) {
+	have := map[string]bool{}
+	var ok bool
+	for _, i := range rs.order() {
+		names, lerr := fn(rs.cfg.Replicas[i].Handler)
+		rs.result(i, lerr)
+		if lerr != nil {
+			if err == nil {
+				err = lerr
+			}
+			continue
+		}
+		ok = true
+		for _, n := range names {
+			if !have[n] {
+				have[n] = true
+				r = append(r, n)
+			}
+		}
+	}
+	if ok {
+		err = nil
+	}
+	return
+}
+
+func (rs *replicastore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
+	rs.noteCustomer(cid)
+	return rs.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.ListIndexes(ctx, cid)
+	})
+}
+
+func (rs *replicastore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
+	return rs.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.ListIndexerWells(ctx, cid, guid)
+	})
+}
+
+func (rs *replicastore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	return rs.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.GetShardsInTimeframe(ctx, cid, guid, well, tf)
+	})
+}
+
+func (rs *replicastore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	var ok bool
+	for _, i := range rs.order() {
+		tf, lerr := rs.cfg.Replicas[i].Handler.GetWellTimeframe(ctx, cid, guid, well)
+		rs.result(i, lerr)
+		if lerr != nil {
+			if err == nil {
+				err = lerr
+			}
+			continue
+		}
+		ok = true
+		if tf.Start.IsZero() && tf.End.IsZero() {
+			continue
+		}
+		if t.Start.IsZero() || tf.Start.Before(t.Start) {
+			t.Start = tf.Start
+		}
+		if t.End.IsZero() || tf.End.After(t.End) {
+			t.End = tf.End
+		}
+	}
+	if ok {
+		err = nil
+	}
+	return
+}
+
+// GetTags returns the tags from the first healthy replica
+func (rs *replicastore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	for _, i := range rs.order() {
+		if tgs, err = rs.cfg.Replicas[i].Handler.GetTags(ctx, cid, guid); err == nil {
+			return
+		}
+		rs.result(i, err)
+	}
+	return
+}
+
+// SyncTags merges the tags into every replica, it fails unless at least the minimum
+// number of writes succeed
+func (rs *replicastore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	var n int
+	for i, r := range rs.cfg.Replicas {
+		rtgs, lerr := r.Handler.SyncTags(ctx, cid, guid, idxTags)
+		rs.result(i, lerr)
+		if lerr != nil {
+			rs.cfg.Lgr.Warn("Failed to sync tags to replica", log.KV("replica", r.Name), log.KV("cid", cid), log.KV("indexeruuid", guid), log.KVErr(lerr))
+			if err == nil {
+				err = lerr
+			}
+			continue
+		}
+		if n == 0 {
+			tgs = rtgs
+		}
+		n++
+	}
+	if n >= rs.cfg.MinWrites {
+		err = nil
+	} else {
+		tgs = nil
+	}
+	return
+}
+
+// UnpackShard streams the shard to every replica at once.  A replica which fails does not
+// hold up the others, the push succeeds once the minimum number of replicas have the shard
+// and any which failed are queued for repair.
+func (rs *replicastore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) (err error) {
+	rs.noteCustomer(cid)
+	fo := &fanout{
+		pws:    make([]*io.PipeWriter, len(rs.cfg.Replicas)),
+		failed: make([]bool, len(rs.cfg.Replicas)),
+	}
+	errs := make([]error, len(rs.cfg.Replicas))
+	var wg sync.WaitGroup
+	for i, r := range rs.cfg.Replicas {
+		pr, pw := io.Pipe()
+		fo.pws[i] = pw
+		wg.Add(1)
+		go func(i int, h webserver.ShardHandler, pr *io.PipeReader) {
+			defer wg.Done()
+			errs[i] = h.UnpackShard(ctx, cid, guid, well, shard, pr)
+			//unblock the fanout if the replica returned without reading everything
+			pr.CloseWithError(ErrReplicaFinished)
+		}(i, r.Handler, pr)
+	}
+	_, rerr := io.Copy(fo, rdr)
+	for _, pw := range fo.pws {
+		if rerr != nil {
+			pw.CloseWithError(rerr)
+		} else {
+			pw.Close()
+		}
+	}
+	wg.Wait()
+	if rerr != nil && !errors.Is(rerr, errAllFailed) {
+		return rerr //the push itself failed, no replica has the shard
+	}
+
+	var stored []string
+	var missing []int
+	for i, r := range rs.cfg.Replicas {
+		rs.result(i, errs[i])
+		if errs[i] == nil {
+			stored = append(stored, r.Name)
+			continue
+		}
+		if err == nil {
+			err = errs[i]
+		}
+		missing = append(missing, i)
+		rs.cfg.Lgr.Warn("Failed to push shard to replica", log.KV("replica", r.Name),
+			log.KV("cid", cid), log.KV("indexeruuid", guid), log.KV("well", well), log.KV("shard", shard), log.KVErr(errs[i]))
+	}
+	if len(stored) < rs.cfg.MinWrites {
+		return
+	}
+	err = nil
+	for _, i := range missing {
+		if !needsRepair(errs[i]) {
+			continue
+		}
+		if jerr := rs.journal.Add(pendingRepair{CID: cid, IdxUUID: guid, Well: well, Shard: shard, Replica: rs.cfg.Replicas[i].Name}); jerr != nil {
+			rs.cfg.Lgr.Error("Failed to queue shard repair", log.KV("replica", rs.cfg.Replicas[i].Name), log.KV("shard", shard), log.KVErr(jerr))
+		}
+	}
+	return
+}
+
+// needsRepair reports whether a replica which failed a push needs the shard copied to it,
+// a shard which already exists or is being pushed will be there anyway
+func needsRepair(err error) bool {
+	return !errors.Is(err, util.ErrShardExists) && !errors.Is(err, util.ErrUploadInProgress) && !errors.Is(err, context.Canceled)
+}
+
+// PackShard reads the shard from the first healthy replica which has it, another replica
+// is only tried if nothing has been written yet
+func (rs *replicastore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	cw := &countWriter{w: wtr}
+	for _, i := range rs.order() {
+		if err = rs.cfg.Replicas[i].Handler.PackShard(ctx, cid, guid, well, shard, cw); err == nil {
+			return
+		}
+		rs.result(i, err)
+		if cw.n > 0 || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// CustomerUsage reports the usage of the first healthy replica which can report it
+func (rs *replicastore) CustomerUsage(ctx context.Context, cid uint64) (sz uint64, err error) {
+	err = errors.New("No replica reports customer usage")
+	for _, i := range rs.order() {
+		if ur, ok := rs.cfg.Replicas[i].Handler.(webserver.UsageReporter); ok {
+			if sz, err = ur.CustomerUsage(ctx, cid); err == nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// SetLegalHolds hands the holds to every replica which enforces them
+func (rs *replicastore) SetLegalHolds(lh util.LegalHolds) {
+	for _, r := range rs.cfg.Replicas {
+		if lhe, ok := r.Handler.(webserver.LegalHoldEnforcer); ok {
+			lhe.SetLegalHolds(lh)
+		}
+	}
+}
+
+// Preflight checks each replica which can be checked and fails if fewer than MinWrites
+// replicas could take a push
+func (rs *replicastore) Preflight(ctx context.Context) (err error) {
+	var up int
+	for i, r := range rs.cfg.Replicas {
+		pf, ok := r.Handler.(webserver.Preflighter)
+		if !ok {
+			up++
+			continue
+		}
+		lerr := pf.Preflight(ctx)
+		rs.result(i, lerr)
+		if lerr == nil {
+			up++
+		} else {
+			err = fmt.Errorf("replica %s: %w", r.Name, lerr)
+		}
+	}
+	if up >= rs.cfg.MinWrites {
+		err = nil
+	} else {
+		err = fmt.Errorf("%d of %d replicas available, %d required, %w", up, len(rs.cfg.Replicas), rs.cfg.MinWrites, err)
+	}
+	return
+}
+
+var errAllFailed = errors.New("Every replica failed")
+
+// fanout copies writes to each replica's pipe, a replica which stops reading is dropped
+// and the write only fails once every replica has been dropped
+type fanout struct {
+	pws    []*io.PipeWriter
+	failed []bool
+}
+
+func (fo *fanout) Write(b []byte) (n int, err error) {
+	var ok bool
+	for i, pw := range fo.pws {
+		if fo.failed[i] {
+			continue
+		} else if _, werr := pw.Write(b); werr != nil {
+			fo.failed[i] = true
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		err = errAllFailed
+		return
+	}
+	n = len(b)
+	return
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	return
+}
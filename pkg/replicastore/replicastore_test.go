@@ -0,0 +1,180 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package replicastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const testShard = `76a00`
+
+var testFiles = map[string][]byte{
+	`.index`:  []byte(`index`),
+	`.verify`: []byte(`verify`),
+	`.store`:  bytes.Repeat([]byte(`store data `), 100000),
+}
+
+var errFlaky = errors.New("replica unavailable")
+
+// flaky is a replica whose pushes can be made to fail
+type flaky struct {
+	webserver.ShardHandler
+	fail bool
+}
+
+func (f *flaky) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	if f.fail {
+		return errFlaky
+	}
+	return f.ShardHandler.UnpackShard(ctx, cid, guid, well, shard, rdr)
+}
+
+// newTestStore wraps two file stores, returning the wrapper and the replicas' directories
+func newTestStore(t *testing.T, minWrites int) (rs *replicastore, dirs []string, second *flaky) {
+	var replicas []Replica
+	for _, name := range []string{`local`, `remote`} {
+		fs, dir := storetest.NewFileStore(t)
+		dirs = append(dirs, dir)
+		replicas = append(replicas, Replica{Name: name, Handler: fs})
+	}
+	second = &flaky{ShardHandler: replicas[1].Handler}
+	replicas[1].Handler = second
+	rs, err := NewReplicaStoreHandler(ReplicaStoreConfig{
+		Replicas:          replicas,
+		MinWrites:         minWrites,
+		ReconcileInterval: -1,
+		LocalStore:        t.TempDir(),
+		Lgr:               log.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rs.Close() })
+	return
+}
+
+func TestNewReplicaStoreConfig(t *testing.T) {
+	fs, _ := storetest.NewFileStore(t)
+	cfg := ReplicaStoreConfig{
+		Replicas:   []Replica{{Name: `a`, Handler: fs}},
+		LocalStore: t.TempDir(),
+	}
+	if _, err := NewReplicaStoreHandler(cfg); err != ErrTooFewReplicas {
+		t.Fatalf("single replica accepted: %v", err)
+	}
+	cfg.Replicas = append(cfg.Replicas, Replica{Name: `a`, Handler: fs})
+	if _, err := NewReplicaStoreHandler(cfg); err == nil {
+		t.Fatal("duplicate replica accepted")
+	}
+	cfg.Replicas[1].Name = `b`
+	cfg.MinWrites = 3
+	if _, err := NewReplicaStoreHandler(cfg); err != ErrBadMinWrites {
+		t.Fatalf("bad minimum writes accepted: %v", err)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	rs, dirs, _ := newTestStore(t, 2)
+	ctx := context.Background()
+	guid := uuid.New()
+	if err := rs.UnpackShard(ctx, 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(storetest.ShardDir(dir, guid, testShard), `76a00.store`)); err != nil {
+			t.Fatalf("replica missing shard: %v", err)
+		}
+	}
+	if idxs, err := rs.ListIndexes(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 1 || idxs[0] != guid.String() {
+		t.Fatalf("bad indexes %v", idxs)
+	}
+	tgs := []tags.TagPair{{Name: `syslog`, Value: 1}}
+	if _, err := rs.SyncTags(ctx, 1, guid, tgs); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, rs, guid, testShard, testFiles)
+
+	//a replica missing the shard is passed over for one which has it
+	if err := os.RemoveAll(storetest.ShardDir(dirs[0], guid, testShard)); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, rs, guid, testShard, testFiles)
+	s, e, _ := util.ShardNameToDateRange(`76a00`)
+	if shards, err := rs.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: s, End: e}); err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 1 {
+		t.Fatalf("bad shards %v", shards)
+	}
+
+	//a full reconcile puts it back
+	if err := rs.Reconcile(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(storetest.ShardDir(dirs[0], guid, testShard), `76a00.store`)); err != nil {
+		t.Fatalf("shard not reconciled: %v", err)
+	}
+}
+
+func TestRepairJournal(t *testing.T) {
+	rs, dirs, second := newTestStore(t, 1)
+	ctx := context.Background()
+	guid := uuid.New()
+	second.fail = true
+	if err := rs.UnpackShard(ctx, 1, guid, `default`, testShard, storetest.NewShard(t, testShard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	prs := rs.journal.List()
+	if len(prs) != 1 || prs[0].Replica != `remote` || prs[0].Shard != `76a00` {
+		t.Fatalf("bad journal %+v", prs)
+	}
+	//the journal survives a restart
+	if rj, err := openRepairJournal(rs.cfg.LocalStore); err != nil {
+		t.Fatal(err)
+	} else if rj.Len() != 1 {
+		t.Fatalf("journal not saved, %d entries", rj.Len())
+	}
+
+	second.fail = false
+	rs.repairPending(ctx)
+	if n := rs.journal.Len(); n != 0 {
+		t.Fatalf("%d repairs still pending", n)
+	} else if _, err := os.Stat(filepath.Join(storetest.ShardDir(dirs[1], guid, testShard), `76a00.store`)); err != nil {
+		t.Fatalf("shard not repaired: %v", err)
+	}
+	//only the local copy is pulled from, so drop it to prove the repaired copy is good
+	if err := os.RemoveAll(storetest.ShardDir(dirs[0], guid, testShard)); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckPull(t, rs, guid, testShard, testFiles)
+}
+
+func TestTooFewWrites(t *testing.T) {
+	rs, _, second := newTestStore(t, 2)
+	second.fail = true
+	if err := rs.UnpackShard(context.Background(), 1, uuid.New(), `default`, testShard, storetest.NewShard(t, testShard, testFiles)); !errors.Is(err, errFlaky) {
+		t.Fatalf("push to one of two required replicas returned %v", err)
+	} else if n := rs.journal.Len(); n != 0 {
+		t.Fatalf("failed push queued %d repairs", n)
+	}
+}
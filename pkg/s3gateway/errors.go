@@ -0,0 +1,85 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package s3gateway
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+)
+
+var (
+	errUserDisabled = errors.New("Customer is disabled")
+
+	errMethodNotAllowed = &s3Error{Code: `MethodNotAllowed`, Message: `The gateway is read-only`, Status: http.StatusMethodNotAllowed}
+	errNoSuchBucket     = &s3Error{Code: `NoSuchBucket`, Message: `The specified bucket does not exist`, Status: http.StatusNotFound}
+	errNoSuchKey        = &s3Error{Code: `NoSuchKey`, Message: `The specified key does not exist`, Status: http.StatusNotFound}
+	errAccessDenied     = &s3Error{Code: `AccessDenied`, Message: `Access Denied`, Status: http.StatusForbidden}
+	errInvalidRange     = &s3Error{Code: `InvalidRange`, Message: `The requested range is not satisfiable`, Status: http.StatusRequestedRangeNotSatisfiable}
+)
+
+// s3Error is an error response in the form S3 clients expect
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int `xml:"-"`
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + `: ` + e.Message
+}
+
+// s3Err translates an error into the closest S3 error response
+func s3Err(err error) *s3Error {
+	var se *s3Error
+	switch {
+	case errors.As(err, &se):
+		return se
+	case err == ErrUnknownKey:
+		return &s3Error{Code: `InvalidAccessKeyId`, Message: err.Error(), Status: http.StatusForbidden}
+	case err == ErrBadSignature:
+		return &s3Error{Code: `SignatureDoesNotMatch`, Message: err.Error(), Status: http.StatusForbidden}
+	case err == ErrRequestTimeSkew:
+		return &s3Error{Code: `RequestTimeTooSkewed`, Message: err.Error(), Status: http.StatusForbidden}
+	case err == ErrMissingAuth, err == ErrBadAuth, err == ErrBadRegion:
+		return &s3Error{Code: `AccessDenied`, Message: err.Error(), Status: http.StatusForbidden}
+	case err == errUserDisabled:
+		return errAccessDenied
+	case os.IsNotExist(err):
+		return errNoSuchKey
+	}
+	return &s3Error{Code: `InternalError`, Message: err.Error(), Status: http.StatusInternalServerError}
+}
+
+func sendError(res http.ResponseWriter, req *http.Request, e *s3Error) {
+	res.Header().Set("Content-Type", "application/xml")
+	res.WriteHeader(e.Status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	res.Write([]byte(xml.Header))
+	xml.NewEncoder(res).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: req.URL.Path})
+}
+
+func sendXML(res http.ResponseWriter, req *http.Request, obj interface{}) {
+	bts, err := xml.Marshal(obj)
+	if err != nil {
+		sendError(res, req, s3Err(err))
+		return
+	}
+	res.Header().Set("Content-Type", "application/xml")
+	res.Write([]byte(xml.Header))
+	res.Write(bts)
+}
@@ -0,0 +1,265 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package s3gateway exposes archived shards as read-only objects through a subset
+// of the S3 API so that existing S3 tooling can read from the archive.
+//
+// The gateway serves a single bucket using path style addressing.  Every file of
+// every shard is an object keyed as:
+//
+//	<customer>/<indexer>/<well>/<shard>/<file>
+//
+// Requests must be signed with AWS Signature Version 4 using one of the gateway's
+// access keys, each access key can only see the objects under its customer's prefix.
+package s3gateway
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	DefaultBucket = `cloudarchive`
+	DefaultRegion = `us-east-1`
+
+	s3XMLNS = `http://s3.amazonaws.com/doc/2006-03-01/`
+)
+
+var (
+	ErrNoShardInfo    = errors.New("Storage backend does not support shard metadata queries, it cannot back an S3 gateway")
+	ErrNoCredentials  = errors.New("No S3 gateway credentials configured")
+	ErrNotInitialized = errors.New("S3 gateway is not initialized")
+)
+
+type GatewayConfig struct {
+	ListenString string // addr:port
+	DisableTLS   bool
+	CertFile     string
+	KeyFile      string
+	Bucket       string // defaults to DefaultBucket
+	Region       string // defaults to DefaultRegion, must match the region clients sign with
+	Credentials  map[string]Credential
+	Logger       *log.Logger
+	ShardHandler webserver.ShardHandler // must also implement webserver.ShardInfoReporter
+	// Optional, consulted for the UserStatusChecker and IndexerAuthorizer interfaces
+	// so that gateway access follows the same restrictions as the archive API
+	Auth webserver.Authenticator
+}
+
+// Gateway is a read-only S3 API server backed by a ShardHandler
+type Gateway struct {
+	listenString string
+	tlsConfig    *tls.Config
+	bucket       string
+	region       string
+	creds        map[string]Credential
+	lgr          *log.Logger
+	sh           webserver.ShardHandler
+	sir          webserver.ShardInfoReporter
+	auth         webserver.Authenticator
+
+	lst net.Listener
+	srv *http.Server
+}
+
+func NewGateway(conf GatewayConfig) (*Gateway, error) {
+	sir, ok := conf.ShardHandler.(webserver.ShardInfoReporter)
+	if !ok {
+		return nil, ErrNoShardInfo
+	} else if len(conf.Credentials) == 0 {
+		return nil, ErrNoCredentials
+	}
+	g := &Gateway{
+		listenString: conf.ListenString,
+		bucket:       conf.Bucket,
+		region:       conf.Region,
+		creds:        conf.Credentials,
+		lgr:          conf.Logger,
+		sh:           conf.ShardHandler,
+		sir:          sir,
+		auth:         conf.Auth,
+	}
+	if g.bucket == `` {
+		g.bucket = DefaultBucket
+	}
+	if g.region == `` {
+		g.region = DefaultRegion
+	}
+	if !conf.DisableTLS {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		g.tlsConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	return g, nil
+}
+
+func (g *Gateway) Init() (err error) {
+	if g.lst != nil {
+		return errors.New("Already initialized")
+	}
+	if g.lst, err = net.Listen("tcp", g.listenString); err != nil {
+		return
+	}
+	if g.tlsConfig != nil {
+		g.lst = tls.NewListener(g.lst, g.tlsConfig)
+	}
+	return
+}
+
+func (g *Gateway) Run() error {
+	if g.lst == nil {
+		if err := g.Init(); err != nil {
+			return err
+		}
+	}
+	g.srv = &http.Server{
+		Handler:           g,
+		ReadHeaderTimeout: time.Minute,
+	}
+	go func(srv *http.Server, lst net.Listener) {
+		if err := srv.Serve(lst); err != nil && err != http.ErrServerClosed {
+			g.lgr.Error("S3 gateway exited", log.KVErr(err))
+		}
+	}(g.srv, g.lst)
+	return nil
+}
+
+func (g *Gateway) Close() error {
+	if g.srv == nil {
+		return ErrNotInitialized
+	}
+	err := g.srv.Close()
+	g.srv = nil
+	g.lst = nil
+	return err
+}
+
+// customer is the caller a request was signed by
+type customer struct {
+	cid      uint64
+	indexers []uuid.UUID // empty allows any
+}
+
+func (c customer) indexerAllowed(guid uuid.UUID) bool {
+	cd := webserver.CustomerDetails{CustomerNumber: c.cid, Indexers: c.indexers}
+	return cd.IndexerAllowed(guid)
+}
+
+func (g *Gateway) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	trw := &statusWriter{ResponseWriter: res, status: http.StatusOK}
+	defer g.logAccess(trw, req)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		sendError(trw, req, errMethodNotAllowed)
+		return
+	}
+	cust, err := g.authRequest(req)
+	if err != nil {
+		g.lgr.Info("S3 gateway unauthorized", log.KVErr(err))
+		sendError(trw, req, s3Err(err))
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, `/`), `/`)
+	switch {
+	case bucket == ``:
+		g.listBuckets(trw, req)
+	case bucket != g.bucket:
+		sendError(trw, req, errNoSuchBucket)
+	case key != ``:
+		g.getObject(trw, req, cust, key)
+	case req.Method == http.MethodHead:
+		trw.WriteHeader(http.StatusOK)
+	case req.URL.Query().Has(`location`):
+		sendXML(trw, req, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			XMLNS   string   `xml:"xmlns,attr"`
+			Region  string   `xml:",chardata"`
+		}{XMLNS: s3XMLNS, Region: g.region})
+	default:
+		g.listObjects(trw, req, cust)
+	}
+}
+
+// authRequest verifies the request signature and resolves the customer it grants access to
+func (g *Gateway) authRequest(req *http.Request) (cust customer, err error) {
+	var cred Credential
+	if cred, err = g.verifyRequest(req); err != nil {
+		return
+	}
+	cust.cid = cred.CustomerNumber
+	if usc, ok := g.auth.(webserver.UserStatusChecker); ok {
+		var disabled bool
+		if disabled, err = usc.UserDisabled(cust.cid); err != nil {
+			return
+		} else if disabled {
+			err = errUserDisabled
+			return
+		}
+	}
+	if ia, ok := g.auth.(webserver.IndexerAuthorizer); ok {
+		cust.indexers, err = ia.AllowedIndexers(cust.cid)
+	}
+	return
+}
+
+func (g *Gateway) listBuckets(res http.ResponseWriter, req *http.Request) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	sendXML(res, req, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID string
+		}
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{
+		XMLNS:   s3XMLNS,
+		Buckets: []bucket{{Name: g.bucket, CreationDate: time.Unix(0, 0).UTC().Format(s3TimeFmt)}},
+	})
+}
+
+func (g *Gateway) logAccess(res *statusWriter, req *http.Request) {
+	remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteAddr = req.RemoteAddr
+	}
+	g.lgr.Info("S3 gateway access",
+		log.KV("remote", remoteAddr),
+		log.KV("method", req.Method),
+		log.KV("url", req.URL.Path),
+		log.KV("status", res.status),
+		log.KV("useragent", req.UserAgent()))
+}
+
+// statusWriter records the status code sent on a response for logging
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,240 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package s3gateway
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	exampleSecret = `wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY`
+	exampleDate   = `20130524T000000Z`
+)
+
+// signature examples from the AWS Signature Version 4 documentation for S3
+func TestSignatureExamples(t *testing.T) {
+	tests := []struct {
+		url     string
+		headers map[string]string
+		signed  []string
+		sig     string
+	}{
+		{
+			url:     `https://examplebucket.s3.amazonaws.com/test.txt`,
+			headers: map[string]string{`Range`: `bytes=0-9`},
+			signed:  []string{`host`, `range`, `x-amz-content-sha256`, `x-amz-date`},
+			sig:     `f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41`,
+		},
+		{
+			url:    `https://examplebucket.s3.amazonaws.com/?max-keys=2&prefix=J`,
+			signed: []string{`host`, `x-amz-content-sha256`, `x-amz-date`},
+			sig:    `34b48302e7b5fa45bde8084f4b7868a86f0a534bc59db6670ed5711ef69dc6f7`,
+		},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set(`X-Amz-Content-Sha256`, emptySHA256)
+		req.Header.Set(`X-Amz-Date`, exampleDate)
+		if sig := signature(exampleSecret, `us-east-1`, exampleDate, canonicalRequest(req, tt.signed)); sig != tt.sig {
+			t.Fatalf("%s: bad signature %s != %s", tt.url, sig, tt.sig)
+		}
+	}
+}
+
+// signRequest signs a request as an S3 client would
+func signRequest(req *http.Request, cred Credential, region string) {
+	amzDate := time.Now().UTC().Format(amzDateFmt)
+	req.Header.Set(`X-Amz-Content-Sha256`, emptySHA256)
+	req.Header.Set(`X-Amz-Date`, amzDate)
+	signed := []string{`host`, `x-amz-content-sha256`, `x-amz-date`}
+	sig := signature(cred.Secret, region, amzDate, canonicalRequest(req, signed))
+	req.Header.Set(`Authorization`, sigAlgorithm+` Credential=`+cred.AccessKey+`/`+amzDate[:8]+`/`+region+
+		`/s3/aws4_request, SignedHeaders=`+strings.Join(signed, `;`)+`, Signature=`+sig)
+}
+
+func TestGateway(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, `store`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := filestore.NewFilestoreHandler(filepath.Join(dir, `store`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid := uuid.New()
+	shards := []string{`769f2`, `769f3`}
+	for _, id := range shards {
+		if err = pushShard(fs, filepath.Join(dir, id), guid, `foo`, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	creds := map[string]Credential{
+		`cust`:  Credential{AccessKey: `cust`, Secret: `custsecret`, CustomerNumber: 1337},
+		`other`: Credential{AccessKey: `other`, Secret: `othersecret`, CustomerNumber: 42},
+	}
+	g, err := NewGateway(GatewayConfig{
+		DisableTLS:   true,
+		Credentials:  creds,
+		Logger:       log.New(nopCloser{ioutil.Discard}),
+		ShardHandler: fs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+
+	do := func(method, path string, cred Credential, hdrs ...string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		signRequest(req, cred, DefaultRegion)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	type listResult struct {
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct{ Key string }
+		CommonPrefixes        []struct{ Prefix string }
+	}
+	list := func(query string, cred Credential) (lr listResult) {
+		resp, body := do(http.MethodGet, `/`+DefaultBucket+`?list-type=2&`+query, cred)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("list %s failed: %d %s", query, resp.StatusCode, body)
+		} else if err := xml.Unmarshal(body, &lr); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// delimited listings walk down one level at a time
+	root := `1337/` + guid.String() + `/foo/`
+	if lr := list(`delimiter=/`, creds[`cust`]); len(lr.CommonPrefixes) != 1 || lr.CommonPrefixes[0].Prefix != `1337/` {
+		t.Fatalf("bad root listing %+v", lr)
+	}
+	if lr := list(`delimiter=/&prefix=`+root, creds[`cust`]); len(lr.CommonPrefixes) != 2 || lr.CommonPrefixes[1].Prefix != root+`769f3/` {
+		t.Fatalf("bad well listing %+v", lr)
+	}
+
+	// a full listing pages through every file in key order
+	var keys []string
+	var tok string
+	for i := 0; ; i++ {
+		q := `max-keys=2`
+		if tok != `` {
+			q += `&continuation-token=` + tok
+		}
+		lr := list(q, creds[`cust`])
+		for _, c := range lr.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !lr.IsTruncated {
+			break
+		} else if i > 10 {
+			t.Fatal("listing did not terminate")
+		}
+		tok = lr.NextContinuationToken
+	}
+	if len(keys) != 6 {
+		t.Fatalf("bad key count %d: %v", len(keys), keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("keys out of order: %v", keys)
+		}
+	}
+
+	// other customers see nothing and cannot read
+	if lr := list(``, creds[`other`]); len(lr.Contents) != 0 || len(lr.CommonPrefixes) != 0 {
+		t.Fatalf("other customer listed %+v", lr)
+	}
+	obj := `/` + DefaultBucket + `/` + root + `769f2/769f2.store`
+	if resp, _ := do(http.MethodGet, obj, creds[`other`]); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("other customer read object: %d", resp.StatusCode)
+	}
+
+	// objects and ranges
+	if resp, body := do(http.MethodGet, obj, creds[`cust`]); resp.StatusCode != http.StatusOK || string(body) != `769f2 store` {
+		t.Fatalf("bad object: %d %q", resp.StatusCode, body)
+	}
+	if resp, body := do(http.MethodGet, obj, creds[`cust`], `Range`, `bytes=6-`); resp.StatusCode != http.StatusPartialContent || string(body) != `store` {
+		t.Fatalf("bad range: %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := do(http.MethodGet, obj+`x`, creds[`cust`]); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing object: %d", resp.StatusCode)
+	}
+
+	// the gateway is read-only and requires valid signatures
+	if resp, _ := do(http.MethodPut, obj, creds[`cust`]); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("put allowed: %d", resp.StatusCode)
+	}
+	if resp, _ := do(http.MethodGet, obj, Credential{AccessKey: `cust`, Secret: `wrong`}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad signature allowed: %d", resp.StatusCode)
+	}
+}
+
+func pushShard(fs webserver.ShardHandler, sdir string, guid uuid.UUID, well, id string) error {
+	if err := os.MkdirAll(sdir, 0700); err != nil {
+		return err
+	}
+	for _, ext := range []string{`index`, `verify`, `store`} {
+		if err := ioutil.WriteFile(filepath.Join(sdir, id+`.`+ext), []byte(id+` `+ext), 0600); err != nil {
+			return err
+		}
+	}
+	pkr := shardpacker.NewPacker(id)
+	go func() {
+		if err := util.AddShardFilesToPacker(sdir, id, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	return fs.UnpackShard(context.Background(), 1337, guid, well, id, pkr)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,333 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package s3gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+const (
+	s3TimeFmt      = `2006-01-02T15:04:05.000Z`
+	defaultMaxKeys = 1000
+)
+
+var (
+	errListFull = errors.New("listing is full")
+)
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+// lister walks the customer's shards in key order, collecting a single page of a listing
+type lister struct {
+	ctx    context.Context //the request being served
+	g      *Gateway
+	cust   customer
+	prefix string
+	delim  string
+	after  string //entries at or before this are skipped
+	max    int
+
+	contents  []listEntry
+	prefixes  []commonPrefix
+	truncated bool
+	last      string //the last key or common prefix added
+}
+
+func (g *Gateway) listObjects(res http.ResponseWriter, req *http.Request, cust customer) {
+	q := req.URL.Query()
+	l := &lister{
+		ctx:    req.Context(),
+		g:      g,
+		cust:   cust,
+		prefix: q.Get(`prefix`),
+		delim:  q.Get(`delimiter`),
+		max:    defaultMaxKeys,
+	}
+	if v := q.Get(`max-keys`); v != `` {
+		mk, err := strconv.Atoi(v)
+		if err != nil || mk < 0 {
+			sendError(res, req, &s3Error{Code: `InvalidArgument`, Message: `Invalid max-keys`, Status: http.StatusBadRequest})
+			return
+		} else if mk < l.max {
+			l.max = mk
+		}
+	}
+	v2 := q.Get(`list-type`) == `2`
+	if v2 {
+		l.after = q.Get(`start-after`)
+		if tok := q.Get(`continuation-token`); tok != `` {
+			bts, err := base64.RawURLEncoding.DecodeString(tok)
+			if err != nil {
+				sendError(res, req, &s3Error{Code: `InvalidArgument`, Message: `Invalid continuation token`, Status: http.StatusBadRequest})
+				return
+			}
+			l.after = string(bts)
+		}
+	} else {
+		l.after = q.Get(`marker`)
+	}
+	if err := l.walk(); err != nil && err != errListFull {
+		sendError(res, req, s3Err(err))
+		return
+	}
+
+	enc := func(s string) string { return s }
+	encType := q.Get(`encoding-type`)
+	if encType == `url` {
+		enc = func(s string) string { return awsEscape(s, true) }
+		for i := range l.contents {
+			l.contents[i].Key = enc(l.contents[i].Key)
+		}
+		for i := range l.prefixes {
+			l.prefixes[i].Prefix = enc(l.prefixes[i].Prefix)
+		}
+	}
+
+	if v2 {
+		r := struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			XMLNS                 string   `xml:"xmlns,attr"`
+			Name                  string
+			Prefix                string
+			Delimiter             string `xml:",omitempty"`
+			StartAfter            string `xml:",omitempty"`
+			ContinuationToken     string `xml:",omitempty"`
+			NextContinuationToken string `xml:",omitempty"`
+			EncodingType          string `xml:",omitempty"`
+			MaxKeys               int
+			KeyCount              int
+			IsTruncated           bool
+			Contents              []listEntry
+			CommonPrefixes        []commonPrefix
+		}{
+			XMLNS:             s3XMLNS,
+			Name:              l.g.bucket,
+			Prefix:            enc(l.prefix),
+			Delimiter:         enc(l.delim),
+			StartAfter:        enc(q.Get(`start-after`)),
+			ContinuationToken: q.Get(`continuation-token`),
+			EncodingType:      encType,
+			MaxKeys:           l.max,
+			KeyCount:          len(l.contents) + len(l.prefixes),
+			IsTruncated:       l.truncated,
+			Contents:          l.contents,
+			CommonPrefixes:    l.prefixes,
+		}
+		if l.truncated {
+			r.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.last))
+		}
+		sendXML(res, req, r)
+		return
+	}
+	r := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		XMLNS          string   `xml:"xmlns,attr"`
+		Name           string
+		Prefix         string
+		Marker         string
+		NextMarker     string `xml:",omitempty"`
+		Delimiter      string `xml:",omitempty"`
+		EncodingType   string `xml:",omitempty"`
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []listEntry
+		CommonPrefixes []commonPrefix
+	}{
+		XMLNS:          s3XMLNS,
+		Name:           l.g.bucket,
+		Prefix:         enc(l.prefix),
+		Marker:         enc(l.after),
+		Delimiter:      enc(l.delim),
+		EncodingType:   encType,
+		MaxKeys:        l.max,
+		IsTruncated:    l.truncated,
+		Contents:       l.contents,
+		CommonPrefixes: l.prefixes,
+	}
+	if l.truncated && l.delim != `` {
+		r.NextMarker = enc(l.last)
+	}
+	sendXML(res, req, r)
+}
+
+// walk descends the customer, indexer, well, and shard levels, skipping any
+// subtree which cannot contain an entry for the current page
+func (l *lister) walk() error {
+	root := strconv.FormatUint(l.cust.cid, 10) + `/`
+	if ok, err := l.descend(root); !ok || err != nil {
+		return err
+	}
+	idxs, err := l.g.sh.ListIndexes(l.ctx, l.cust.cid)
+	if os.IsNotExist(err) {
+		return nil //customer has not stored anything yet
+	} else if err != nil {
+		return err
+	}
+	for _, idx := range sortDirs(idxs) {
+		guid, err := uuid.Parse(idx)
+		if err != nil || !l.cust.indexerAllowed(guid) {
+			continue
+		}
+		idxPath := root + idx + `/`
+		if ok, err := l.descend(idxPath); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		wells, err := l.g.sh.ListIndexerWells(l.ctx, l.cust.cid, guid)
+		if err != nil {
+			return err
+		}
+		for _, well := range sortDirs(wells) {
+			wellPath := idxPath + well + `/`
+			if ok, err := l.descend(wellPath); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			if err := l.walkWell(guid, well, wellPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *lister) walkWell(guid uuid.UUID, well, wellPath string) error {
+	tf, err := l.g.sh.GetWellTimeframe(l.ctx, l.cust.cid, guid, well)
+	if err != nil {
+		return err
+	} else if tf.Start.IsZero() {
+		return nil //empty well
+	}
+	shards, err := l.g.sh.GetShardsInTimeframe(l.ctx, l.cust.cid, guid, well, tf)
+	if err != nil {
+		return err
+	}
+	for _, shard := range sortDirs(shards) {
+		shardPath := wellPath + shard + `/`
+		if ok, err := l.descend(shardPath); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		si, err := l.g.sir.GetShardInfo(l.ctx, l.cust.cid, guid, well, shard)
+		if errors.Is(err, util.ErrUploadInProgress) {
+			continue //skip shards which are mid transfer
+		} else if err != nil {
+			return err
+		}
+		modified := shardModified(shard)
+		sort.Slice(si.Files, func(i, j int) bool { return si.Files[i].Name < si.Files[j].Name })
+		for _, f := range si.Files {
+			err := l.add(listEntry{
+				Key:          shardPath + f.Name,
+				LastModified: modified.Format(s3TimeFmt),
+				ETag:         `"` + f.SHA256 + `"`,
+				Size:         f.Size,
+				StorageClass: `STANDARD`,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// descend reports whether the subtree of keys beginning with p should be walked,
+// a subtree which rolls up into a single common prefix is added without walking it
+func (l *lister) descend(p string) (bool, error) {
+	if !strings.HasPrefix(p, l.prefix) && !strings.HasPrefix(l.prefix, p) {
+		return false, nil
+	} else if p < l.after && !strings.HasPrefix(l.after, p) {
+		return false, nil //every key in the subtree sorts before the marker
+	}
+	if l.delim == `/` && len(p) > len(l.prefix) && strings.HasPrefix(p, l.prefix) {
+		return false, l.addPrefix(l.rollup(p))
+	}
+	return true, nil
+}
+
+// rollup returns the common prefix a key falls under, or an empty string if it is not rolled up
+func (l *lister) rollup(key string) string {
+	if l.delim == `` {
+		return ``
+	}
+	if idx := strings.Index(key[len(l.prefix):], l.delim); idx >= 0 {
+		return key[:len(l.prefix)+idx+len(l.delim)]
+	}
+	return ``
+}
+
+func (l *lister) add(e listEntry) error {
+	if !strings.HasPrefix(e.Key, l.prefix) {
+		return nil
+	} else if cp := l.rollup(e.Key); cp != `` {
+		return l.addPrefix(cp)
+	} else if e.Key <= l.after {
+		return nil
+	} else if len(l.contents)+len(l.prefixes) >= l.max {
+		l.truncated = true
+		return errListFull
+	}
+	l.contents = append(l.contents, e)
+	l.last = e.Key
+	return nil
+}
+
+func (l *lister) addPrefix(cp string) error {
+	if cp <= l.after || (len(l.prefixes) > 0 && l.prefixes[len(l.prefixes)-1].Prefix == cp) {
+		return nil
+	} else if len(l.contents)+len(l.prefixes) >= l.max {
+		l.truncated = true
+		return errListFull
+	}
+	l.prefixes = append(l.prefixes, commonPrefix{Prefix: cp})
+	l.last = cp
+	return nil
+}
+
+// sortDirs orders names as the keys beneath them sort, which differs from
+// a plain sort when one name is a prefix of another
+func sortDirs(names []string) []string {
+	sort.Slice(names, func(i, j int) bool { return names[i]+`/` < names[j]+`/` })
+	return names
+}
+
+// shardModified reports the end of a shard's timeframe as its modification time
+func shardModified(shard string) time.Time {
+	if _, e, err := util.ShardNameToDateRange(shard); err == nil {
+		return e.UTC()
+	}
+	return time.Unix(0, 0).UTC()
+}
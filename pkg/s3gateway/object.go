@@ -0,0 +1,218 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package s3gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	errFileNotInShard = errors.New("file was not found in the packed shard")
+)
+
+// objectKey is a parsed object key naming a single file within a shard
+type objectKey struct {
+	cid   uint64
+	guid  uuid.UUID
+	well  string
+	shard string
+	file  string
+}
+
+func parseObjectKey(key string) (ok objectKey, err error) {
+	flds := strings.SplitN(key, `/`, 5)
+	if len(flds) != 5 || flds[2] == `` || flds[4] == `` {
+		err = errNoSuchKey
+		return
+	}
+	if ok.cid, err = strconv.ParseUint(flds[0], 10, 64); err != nil {
+		err = errNoSuchKey
+		return
+	} else if ok.guid, err = uuid.Parse(flds[1]); err != nil {
+		err = errNoSuchKey
+		return
+	} else if err = util.ValidateShardName(flds[3]); err != nil {
+		err = errNoSuchKey
+		return
+	}
+	ok.well, ok.shard, ok.file = flds[2], flds[3], flds[4]
+	return
+}
+
+// getObject serves a single shard file, the file is cut out of the packed shard stream
+func (g *Gateway) getObject(res http.ResponseWriter, req *http.Request, cust customer, key string) {
+	ok, err := parseObjectKey(key)
+	if err != nil {
+		sendError(res, req, s3Err(err))
+		return
+	} else if ok.cid != cust.cid || !cust.indexerAllowed(ok.guid) {
+		sendError(res, req, errAccessDenied)
+		return
+	}
+	si, err := g.sir.GetShardInfo(req.Context(), ok.cid, ok.guid, ok.well, ok.shard)
+	if err != nil {
+		sendError(res, req, s3Err(err))
+		return
+	}
+	var sf *util.ShardFile
+	for i := range si.Files {
+		if si.Files[i].Name == ok.file {
+			sf = &si.Files[i]
+			break
+		}
+	}
+	if sf == nil {
+		sendError(res, req, errNoSuchKey)
+		return
+	}
+	start, length, partial, err := parseRange(req.Header.Get(`Range`), sf.Size)
+	if err != nil {
+		sendError(res, req, s3Err(err))
+		return
+	}
+
+	hdr := res.Header()
+	hdr.Set("Content-Type", "application/octet-stream")
+	hdr.Set("Content-Length", strconv.FormatInt(length, 10))
+	hdr.Set("ETag", `"`+sf.SHA256+`"`)
+	hdr.Set("Last-Modified", shardModified(ok.shard).Format(http.TimeFormat))
+	hdr.Set("Accept-Ranges", "bytes")
+	status := http.StatusOK
+	if partial {
+		hdr.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, sf.Size))
+		status = http.StatusPartialContent
+	}
+	if req.Method == http.MethodHead {
+		res.WriteHeader(status)
+		return
+	}
+
+	// once the status is sent errors can only be logged and the connection dropped
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(g.sh.PackShard(req.Context(), ok.cid, ok.guid, ok.well, ok.shard, pw))
+	}()
+	upkr, err := shardpacker.NewUnpacker(ok.shard, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		sendError(res, req, s3Err(err))
+		return
+	}
+	fh := &fileHandler{
+		name:   ok.file,
+		start:  start,
+		length: length,
+		wtr:    res,
+		status: status,
+	}
+	if err = upkr.Unpack(fh); err == nil && !fh.found {
+		err = errFileNotInShard
+	}
+	pr.CloseWithError(io.ErrClosedPipe) //release the packer if the unpacker bailed early
+	if err != nil {
+		g.lgr.Error("S3 gateway failed to send object", log.KV("cid", ok.cid), log.KV("indexeruuid", ok.guid),
+			log.KV("well", ok.well), log.KV("shard", ok.shard), log.KV("file", ok.file), log.KVErr(err))
+		if !fh.sent {
+			sendError(res, req, s3Err(err))
+		} else if hj, hok := res.(http.Hijacker); hok {
+			//the client must not mistake a truncated object for a complete one
+			if conn, _, herr := hj.Hijack(); herr == nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// fileHandler copies the requested range of a single file out of an unpacking shard
+type fileHandler struct {
+	name   string
+	start  int64
+	length int64
+	wtr    http.ResponseWriter
+	status int
+	found  bool
+	sent   bool
+}
+
+func (fh *fileHandler) HandleTagUpdate([]tags.TagPair) error {
+	return nil
+}
+
+func (fh *fileHandler) HandleFile(p string, rdr io.Reader) (err error) {
+	if p != fh.name || fh.found {
+		_, err = io.Copy(ioutil.Discard, rdr)
+		return
+	}
+	fh.found = true
+	if _, err = io.CopyN(ioutil.Discard, rdr, fh.start); err != nil {
+		return
+	}
+	fh.sent = true
+	fh.wtr.WriteHeader(fh.status)
+	_, err = io.CopyN(fh.wtr, rdr, fh.length)
+	return
+}
+
+// parseRange handles a single byte range request, multiple ranges are not supported
+func parseRange(v string, size int64) (start, length int64, partial bool, err error) {
+	if v == `` {
+		length = size
+		return
+	}
+	spec := strings.TrimPrefix(v, `bytes=`)
+	if spec == v || strings.Contains(spec, `,`) {
+		err = errInvalidRange
+		return
+	}
+	s, e, ok := strings.Cut(spec, `-`)
+	if !ok {
+		err = errInvalidRange
+		return
+	}
+	end := size - 1
+	switch {
+	case s == ``: //suffix range, the last N bytes
+		var n int64
+		if n, err = strconv.ParseInt(e, 10, 64); err != nil || n <= 0 {
+			err = errInvalidRange
+			return
+		} else if n < size {
+			start = size - n
+		}
+	default:
+		if start, err = strconv.ParseInt(s, 10, 64); err != nil || start < 0 || start >= size {
+			err = errInvalidRange
+			return
+		}
+		if e != `` {
+			if end, err = strconv.ParseInt(e, 10, 64); err != nil || end < start {
+				err = errInvalidRange
+				return
+			} else if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	length = end - start + 1
+	partial = true
+	return
+}
@@ -0,0 +1,245 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package s3gateway
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigAlgorithm = `AWS4-HMAC-SHA256`
+	sigService   = `s3`
+	sigTerm      = `aws4_request`
+	amzDateFmt   = `20060102T150405Z`
+	scopeDateFmt = `20060102`
+	emptySHA256  = `e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855`
+
+	maxClockSkew = 15 * time.Minute
+)
+
+var (
+	ErrMissingAuth     = errors.New("Request is not signed")
+	ErrBadAuth         = errors.New("Malformed authorization header")
+	ErrUnknownKey      = errors.New("Unknown access key")
+	ErrBadSignature    = errors.New("Signature does not match")
+	ErrBadRegion       = errors.New("Signature scope does not match the gateway region")
+	ErrRequestTimeSkew = errors.New("Request time is too far from the server time")
+)
+
+// Credential is an S3 access key pair that grants read access to a customer's shards
+type Credential struct {
+	AccessKey      string
+	Secret         string
+	CustomerNumber uint64
+}
+
+// LoadCredentials reads a credentials file, each line of the file is of the form:
+//
+//	access-key secret-key customer-number
+//
+// Blank lines and lines starting with # are ignored.
+func LoadCredentials(p string) (creds map[string]Credential, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	creds = map[string]Credential{}
+	scn := bufio.NewScanner(fin)
+	for ln := 1; scn.Scan(); ln++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		flds := strings.Fields(line)
+		if len(flds) != 3 {
+			err = fmt.Errorf("%s:%d: expected access key, secret, and customer number", p, ln)
+			return
+		}
+		c := Credential{AccessKey: flds[0], Secret: flds[1]}
+		if c.CustomerNumber, err = strconv.ParseUint(flds[2], 10, 64); err != nil {
+			err = fmt.Errorf("%s:%d: invalid customer number %q", p, ln, flds[2])
+			return
+		} else if _, ok := creds[c.AccessKey]; ok {
+			err = fmt.Errorf("%s:%d: duplicate access key %s", p, ln, c.AccessKey)
+			return
+		}
+		creds[c.AccessKey] = c
+	}
+	err = scn.Err()
+	return
+}
+
+type sigAuth struct {
+	accessKey     string
+	date          string //scope date, YYYYMMDD
+	region        string
+	signedHeaders []string
+	signature     string
+}
+
+// parseAuthHeader splits a SigV4 Authorization header into its components
+func parseAuthHeader(v string) (sa sigAuth, err error) {
+	if !strings.HasPrefix(v, sigAlgorithm+` `) {
+		err = ErrBadAuth
+		return
+	}
+	for _, fld := range strings.Split(strings.TrimPrefix(v, sigAlgorithm+` `), `,`) {
+		k, val, ok := strings.Cut(strings.TrimSpace(fld), `=`)
+		if !ok {
+			err = ErrBadAuth
+			return
+		}
+		switch k {
+		case `Credential`:
+			scope := strings.Split(val, `/`)
+			if len(scope) != 5 || scope[3] != sigService || scope[4] != sigTerm {
+				err = ErrBadAuth
+				return
+			}
+			sa.accessKey, sa.date, sa.region = scope[0], scope[1], scope[2]
+		case `SignedHeaders`:
+			sa.signedHeaders = strings.Split(val, `;`)
+		case `Signature`:
+			sa.signature = val
+		}
+	}
+	if sa.accessKey == `` || len(sa.signedHeaders) == 0 || sa.signature == `` {
+		err = ErrBadAuth
+	}
+	return
+}
+
+// verifyRequest checks the SigV4 signature on a request and returns the credential that signed it
+func (g *Gateway) verifyRequest(req *http.Request) (cred Credential, err error) {
+	hdr := req.Header.Get(`Authorization`)
+	if hdr == `` {
+		err = ErrMissingAuth
+		return
+	}
+	var sa sigAuth
+	if sa, err = parseAuthHeader(hdr); err != nil {
+		return
+	}
+	var ok bool
+	if cred, ok = g.creds[sa.accessKey]; !ok {
+		err = ErrUnknownKey
+		return
+	} else if sa.region != g.region {
+		err = ErrBadRegion
+		return
+	}
+	amzDate := req.Header.Get(`X-Amz-Date`)
+	ts, perr := time.Parse(amzDateFmt, amzDate)
+	if perr != nil || ts.Format(scopeDateFmt) != sa.date {
+		err = ErrBadAuth
+		return
+	} else if d := time.Since(ts); d > maxClockSkew || d < -maxClockSkew {
+		err = ErrRequestTimeSkew
+		return
+	}
+	sig := signature(cred.Secret, sa.region, amzDate, canonicalRequest(req, sa.signedHeaders))
+	if !hmac.Equal([]byte(sig), []byte(sa.signature)) {
+		err = ErrBadSignature
+	}
+	return
+}
+
+// canonicalRequest builds the SigV4 canonical form of a request
+func canonicalRequest(req *http.Request, signed []string) string {
+	var sb strings.Builder
+	sb.WriteString(req.Method + "\n")
+	sb.WriteString(awsEscape(req.URL.Path, true) + "\n")
+	sb.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, h := range signed {
+		var vals []string
+		if h == `host` {
+			vals = []string{req.Host}
+		} else {
+			vals = req.Header.Values(h)
+		}
+		for i := range vals {
+			vals[i] = strings.Join(strings.Fields(vals[i]), ` `)
+		}
+		sb.WriteString(h + ":" + strings.Join(vals, `,`) + "\n")
+	}
+	sb.WriteString("\n" + strings.Join(signed, `;`) + "\n")
+	if ph := req.Header.Get(`X-Amz-Content-Sha256`); ph != `` {
+		sb.WriteString(ph)
+	} else {
+		sb.WriteString(emptySHA256)
+	}
+	return sb.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	parts := make([]string, 0, len(q))
+	for k, vals := range q {
+		for _, v := range vals {
+			parts = append(parts, awsEscape(k, false)+`=`+awsEscape(v, false))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, `&`)
+}
+
+// signature computes the SigV4 signature over a canonical request
+func signature(secret, region, amzDate, creq string) string {
+	scopeDate := amzDate
+	if len(scopeDate) > len(scopeDateFmt) {
+		scopeDate = scopeDate[:len(scopeDateFmt)]
+	}
+	sum := sha256.Sum256([]byte(creq))
+	sts := strings.Join([]string{
+		sigAlgorithm,
+		amzDate,
+		strings.Join([]string{scopeDate, region, sigService, sigTerm}, `/`),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	key := hmacSHA256([]byte(`AWS4`+secret), scopeDate)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, sigService)
+	key = hmacSHA256(key, sigTerm)
+	return hex.EncodeToString(hmacSHA256(key, sts))
+}
+
+func hmacSHA256(key []byte, v string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(v))
+	return h.Sum(nil)
+}
+
+// awsEscape percent encodes everything but the unreserved characters, optionally leaving slashes
+func awsEscape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
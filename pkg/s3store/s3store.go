@@ -0,0 +1,583 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package s3store is a shard storage backend for S3 compatible object stores such as
+// AWS S3 and MinIO.  Every file of every shard is stored as an object keyed as:
+//
+//	<prefix>/<customer>/<indexer>/<well>/<shard>/<file>
+//
+// which is the same layout the FTP backend uses for directories.  Each indexer's tags.dat
+// is stored alongside its wells and a local copy is kept for merging tag updates.
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dolmen-go/contextio"
+	"github.com/gravwell/cloudarchive/pkg/safepath"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/minio/minio-go/v6"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultPartSize = 64 * 1024 * 1024
+	MinPartSize     = 5 * 1024 * 1024 // the smallest part S3 accepts in a multipart upload
+	MaxPartSize     = 5 * 1024 * 1024 * 1024
+
+	noSuchKey = `NoSuchKey`
+)
+
+var (
+	ErrMissingEndpoint = errors.New("Missing S3 endpoint")
+	ErrMissingBucket   = errors.New("Missing S3 bucket")
+	ErrMissingStore    = errors.New("Missing local storage directory")
+	ErrBadPartSize     = errors.New("S3 part size must be between 5MB and 5GB")
+	ErrShardNotFound   = errors.New("Shard does not exist")
+	ErrNoBucket        = errors.New("S3 bucket does not exist")
+)
+
+type s3store struct {
+	cfg S3StoreConfig
+	util.UploadTracker
+	clnt   *minio.Client
+	tagMtx sync.Mutex // held while fetching or pushing a tags.dat
+}
+
+type S3StoreConfig struct {
+	Endpoint   string // host:port of the object store
+	Bucket     string
+	Prefix     string // prepended to every object key, may be empty
+	Region     string // empty asks the object store for the bucket's region
+	AccessKey  string
+	SecretKey  string
+	Insecure   bool   // connect without TLS
+	LocalStore string // path where we keep local copies of each tags.dat
+	Lgr        *log.Logger
+
+	// Shard files larger than PartSize are sent in a multipart upload of PartSize parts,
+	// each upload buffers up to one part in memory.  Zero selects DefaultPartSize.
+	PartSize uint64
+}
+
+func NewS3StoreHandler(cfg S3StoreConfig) (*s3store, error) {
+	if cfg.Endpoint == `` {
+		return nil, ErrMissingEndpoint
+	} else if cfg.Bucket == `` {
+		return nil, ErrMissingBucket
+	} else if cfg.LocalStore == `` {
+		return nil, ErrMissingStore
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	} else if cfg.PartSize < MinPartSize || cfg.PartSize > MaxPartSize {
+		return nil, ErrBadPartSize
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, `/`)
+	clnt, err := minio.NewWithRegion(cfg.Endpoint, cfg.AccessKey, cfg.SecretKey, !cfg.Insecure, cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+	return &s3store{
+		cfg:           cfg,
+		UploadTracker: util.NewUploadTracker(),
+		clnt:          clnt,
+	}, nil
+}
+
+// Preflight ensures the object store is reachable and the bucket exists
+func (f *s3store) Preflight(ctx context.Context) error {
+	if ok, err := f.clnt.BucketExistsWithContext(ctx, f.cfg.Bucket); err != nil {
+		return err
+	} else if !ok {
+		return ErrNoBucket
+	}
+	return nil
+}
+
+// key builds an object key, or the prefix of a directory, under the configured prefix
+func (f *s3store) key(elems ...string) string {
+	return path.Join(append([]string{f.cfg.Prefix}, elems...)...)
+}
+
+func (f *s3store) indexerKey(cid uint64, guid uuid.UUID) string {
+	return f.key(strconv.FormatUint(cid, 10), guid.String())
+}
+
+// localIndexerDir is where the local copy of an indexer's tags.dat lives
+func (f *s3store) localIndexerDir(cid uint64, guid uuid.UUID) string {
+	return filepath.Join(f.cfg.LocalStore, strconv.FormatUint(cid, 10), guid.String())
+}
+
+// listDir lists the directories and objects immediately below a directory key
+func (f *s3store) listDir(ctx context.Context, dir string) (dirs []string, objs []minio.ObjectInfo, err error) {
+	done := make(chan struct{})
+	defer close(done)
+	for oi := range f.clnt.ListObjectsV2(f.cfg.Bucket, dir+`/`, false, done) {
+		if err = oi.Err; err != nil {
+			f.cfg.Lgr.Error("Failed to list objects", log.KV("prefix", dir), log.KVErr(err))
+			return
+		} else if err = ctx.Err(); err != nil {
+			return
+		}
+		if strings.HasSuffix(oi.Key, `/`) {
+			dirs = append(dirs, path.Base(oi.Key))
+		} else {
+			objs = append(objs, oi)
+		}
+	}
+	return
+}
+
+// walk calls fn with every object below a directory key
+func (f *s3store) walk(ctx context.Context, dir string, fn func(minio.ObjectInfo) error) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	for oi := range f.clnt.ListObjectsV2(f.cfg.Bucket, dir+`/`, true, done) {
+		if err = oi.Err; err != nil {
+			return
+		} else if err = ctx.Err(); err != nil {
+			return
+		} else if err = fn(oi); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// dirExists reports whether any object is stored below a directory key
+func (f *s3store) dirExists(ctx context.Context, dir string) (exists bool, err error) {
+	errFound := errors.New(`found`)
+	if err = f.walk(ctx, dir, func(minio.ObjectInfo) error { return errFound }); err == errFound {
+		exists = true
+		err = nil
+	}
+	return
+}
+
+// removeDir removes every object below a directory key
+func (f *s3store) removeDir(ctx context.Context, dir string) (err error) {
+	var keys []string
+	if err = f.walk(ctx, dir, func(oi minio.ObjectInfo) error {
+		keys = append(keys, oi.Key)
+		return nil
+	}); err != nil {
+		return
+	}
+	ch := make(chan string, len(keys))
+	for _, k := range keys {
+		ch <- k
+	}
+	close(ch)
+	for rerr := range f.clnt.RemoveObjectsWithContext(ctx, f.cfg.Bucket, ch) {
+		if err == nil {
+			err = rerr.Err
+		}
+	}
+	return
+}
+
+func (f *s3store) ListIndexes(ctx context.Context, cid uint64) (indexes []string, err error) {
+	var dirs []string
+	if dirs, _, err = f.listDir(ctx, f.key(strconv.FormatUint(cid, 10))); err != nil {
+		return
+	}
+	for _, name := range dirs {
+		if _, err := uuid.Parse(name); err == nil {
+			indexes = append(indexes, name)
+		}
+	}
+	return
+}
+
+func (f *s3store) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) (wells []string, err error) {
+	wells, _, err = f.listDir(ctx, f.indexerKey(cid, guid))
+	return
+}
+
+func (f *s3store) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	var shards []string
+	if shards, _, err = f.listDir(ctx, path.Join(f.indexerKey(cid, guid), well)); err != nil {
+		return
+	}
+	for _, name := range shards {
+		s, e, err := util.ShardNameToDateRange(name)
+		if err != nil {
+			continue
+		}
+		if t.Start.IsZero() || s.Before(t.Start) {
+			t.Start = s
+		}
+		if t.End.IsZero() || e.After(t.End) {
+			t.End = e
+		}
+	}
+	return
+}
+
+func (f *s3store) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+	var names []string
+	if names, _, err = f.listDir(ctx, path.Join(f.indexerKey(cid, guid), well)); err != nil {
+		return
+	}
+	for _, name := range names {
+		if ok, err := tf.ShardOverlaps(name); err == nil && ok {
+			shards = append(shards, name)
+		}
+	}
+	return
+}
+
+// CustomerUsage totals the size of every object stored for a customer
+func (f *s3store) CustomerUsage(ctx context.Context, cid uint64) (sz uint64, err error) {
+	err = f.walk(ctx, f.key(strconv.FormatUint(cid, 10)), func(oi minio.ObjectInfo) error {
+		sz += uint64(oi.Size)
+		return nil
+	})
+	return
+}
+
+func (f *s3store) UnpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, f.EnterUpload)
+}
+
+// UnpackShardWait is UnpackShard, but an upload of the same shard which is already in
+// progress is waited on for up to wait rather than immediately failing
+func (f *s3store) UnpackShardWait(ctx context.Context, wait time.Duration, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return f.unpackShard(ctx, cid, idxUUID, well, shard, rdr, func(uid util.UploadID) error {
+		return f.EnterUploadWait(ctx, uid, wait)
+	})
+}
+
+func (f *s3store) unpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader, enter func(util.UploadID) error) (err error) {
+	var up *shardpacker.Unpacker
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	if err = enter(uid); err != nil {
+		f.cfg.Lgr.Error("Failed to enter upload", log.KVErr(err))
+		return
+	}
+	rdr = f.CountReader(uid, rdr)
+
+	indexerKey := f.indexerKey(cid, idxUUID)
+	shardKey := path.Join(indexerKey, well, shard)
+	base := shardKey
+	// As with the FTP backend a shard which already exists gets a .N suffix, up to some
+	// arbitrary big number in case an indexer is somehow misconfigured.
+	for i := 1; i < 10000; i++ {
+		var exists bool
+		if exists, err = f.dirExists(ctx, shardKey); err != nil {
+			f.ExitUpload(uid)
+			return
+		} else if !exists {
+			break
+		}
+		shardKey = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	h := handler{
+		ctx:   ctx,
+		store: f,
+		cid:   cid,
+		guid:  idxUUID,
+		skey:  shardKey,
+	}
+	if up, err = shardpacker.NewUnpacker(shard, rdr); err != nil {
+		f.ExitUpload(uid)
+		f.cfg.Lgr.Error("Failed to create new shard unpacker",
+			log.KV("client-id", cid),
+			log.KV("uuid", idxUUID),
+			log.KV("shard", shardKey),
+			log.KVErr(err))
+		return
+	}
+	if err = up.Unpack(h); err != nil {
+		//the request context may be what failed, so clean up without it
+		if rerr := f.removeDir(context.Background(), shardKey); rerr != nil {
+			f.cfg.Lgr.Error("Failed to remove partial shard", log.KV("shard", shardKey), log.KVErr(rerr))
+		}
+		f.ExitUpload(uid)
+		f.cfg.Lgr.Error("Failed to unpack shard",
+			log.KV("client-id", cid),
+			log.KV("uuid", idxUUID),
+			log.KV("shard", shardKey),
+			log.KVErr(err))
+		return
+	}
+
+	//release the shard
+	err = f.ExitUpload(uid)
+	return
+}
+
+// PackShard streams each of a shard's objects straight into the packer, nothing is
+// staged locally
+func (f *s3store) PackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	shardKey := path.Join(f.indexerKey(cid, idxUUID), well, shard)
+	var objs []minio.ObjectInfo
+	if err = f.walk(ctx, shardKey, func(oi minio.ObjectInfo) error {
+		objs = append(objs, oi)
+		return nil
+	}); err != nil {
+		return
+	} else if len(objs) == 0 {
+		err = fmt.Errorf("%w: %s", ErrShardNotFound, shardKey)
+		return
+	}
+
+	if err = f.EnterUpload(uid); err != nil {
+		return
+	}
+	wtr = contextio.NewWriter(ctx, f.CountWriter(uid, wtr))
+	p := shardpacker.NewPacker(shard)
+
+	addErr := make(chan error, 1)
+	go func() {
+		err := f.addObjects(ctx, shardKey, shard, objs, p)
+		if err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Flush(); err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Close(); err != nil {
+			p.CloseWithError(err)
+		}
+		addErr <- err
+	}()
+	if _, err = io.Copy(wtr, p); err != nil {
+		p.CloseWithError(err) //stop the adder and wait for it
+		<-addErr
+	} else {
+		err = <-addErr
+	}
+
+	//release the shard, setting error appropriately
+	if err == nil {
+		err = f.ExitUpload(uid)
+	} else {
+		f.ExitUpload(uid)
+	}
+	return
+}
+
+// addObjects adds every shard file object to the packer, other objects such as the shard
+// metadata are not part of a pull
+func (f *s3store) addObjects(ctx context.Context, shardKey, shard string, objs []minio.ObjectInfo, p *shardpacker.Packer) (err error) {
+	for _, oi := range objs {
+		name := strings.TrimPrefix(oi.Key, shardKey+`/`)
+		add := func(rdr io.Reader) error { return p.AddArtifact(name, oi.Size, rdr) }
+		if !shardpacker.IsArtifact(name) {
+			ft, err := util.PackedFileType(shard, name)
+			if err != nil {
+				continue
+			}
+			add = func(rdr io.Reader) error { return p.AddFile(ft, oi.Size, rdr) }
+		}
+		var obj *minio.Object
+		if obj, err = f.clnt.GetObjectWithContext(ctx, f.cfg.Bucket, oi.Key, minio.GetObjectOptions{}); err != nil {
+			return
+		}
+		err = add(obj)
+		obj.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (f *s3store) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	if err = f.ensureTagsDat(ctx, cid, guid); err != nil {
+		return
+	}
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, f.localIndexerDir(cid, guid)); err != nil {
+		f.cfg.Lgr.Error("Failed enumerate tags", log.KVErr(err))
+		return
+	}
+	tgs, err = tm.TagSet()
+	if err == nil {
+		err = tags.ReleaseTagMan(cid, guid) //set the error on release
+	} else {
+		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
+	}
+	return
+}
+
+func (f *s3store) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	var updated bool
+	if updated, err = f.mergeTags(ctx, cid, guid, idxTags); err != nil {
+		return
+	}
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, f.localIndexerDir(cid, guid)); err != nil {
+		return
+	}
+	tgs, err = tm.TagSet()
+	if err == nil {
+		err = tags.ReleaseTagMan(cid, guid) //set the error on release
+	} else {
+		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
+	}
+	if err == nil && updated {
+		err = f.pushTags(ctx, cid, guid)
+	}
+	return
+}
+
+// mergeTags merges tags into the local copy of an indexer's tags.dat
+func (f *s3store) mergeTags(ctx context.Context, cid uint64, guid uuid.UUID, tgs []tags.TagPair) (updated bool, err error) {
+	if err = f.ensureTagsDat(ctx, cid, guid); err != nil {
+		return
+	}
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, f.localIndexerDir(cid, guid)); err != nil {
+		f.cfg.Lgr.Error("Failed enumerate tags", log.KVErr(err))
+		return
+	}
+	if updated, err = tm.Merge(tgs); err != nil {
+		tags.ReleaseTagMan(cid, guid)
+		f.cfg.Lgr.Error("Failed merge tags", log.KVErr(err))
+		return
+	}
+	err = tags.ReleaseTagMan(cid, guid)
+	return
+}
+
+// ensureTagsDat fetches an indexer's tags.dat from the object store if there is no local copy
+func (f *s3store) ensureTagsDat(ctx context.Context, cid uint64, guid uuid.UUID) (err error) {
+	f.tagMtx.Lock()
+	defer f.tagMtx.Unlock()
+	tagpath := tags.GetTagDatPath(f.localIndexerDir(cid, guid))
+	if _, err = os.Stat(tagpath); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(tagpath), 0770); err != nil {
+		return
+	}
+	var obj *minio.Object
+	if obj, err = f.clnt.GetObjectWithContext(ctx, f.cfg.Bucket, f.tagsKey(cid, guid), minio.GetObjectOptions{}); err != nil {
+		return
+	}
+	defer obj.Close()
+	//fetch into a temporary file so a failed fetch never leaves a partial local copy
+	var fout *os.File
+	if fout, err = os.CreateTemp(filepath.Dir(tagpath), `tags-*.tmp`); err != nil {
+		return
+	}
+	defer os.Remove(fout.Name())
+	if _, err = io.Copy(fout, obj); err != nil {
+		if minio.ToErrorResponse(err).Code == noSuchKey {
+			err = nil //no tags yet, the tag manager creates an empty tags.dat
+		}
+		fout.Close()
+		return
+	} else if err = fout.Close(); err != nil {
+		return
+	}
+	err = os.Rename(fout.Name(), tagpath)
+	return
+}
+
+// pushTags uploads the local copy of an indexer's tags.dat
+func (f *s3store) pushTags(ctx context.Context, cid uint64, guid uuid.UUID) (err error) {
+	f.tagMtx.Lock()
+	defer f.tagMtx.Unlock()
+	var bts []byte
+	if bts, err = os.ReadFile(tags.GetTagDatPath(f.localIndexerDir(cid, guid))); err != nil {
+		return
+	}
+	if _, err = f.clnt.PutObjectWithContext(ctx, f.cfg.Bucket, f.tagsKey(cid, guid), bytes.NewReader(bts), int64(len(bts)), minio.PutObjectOptions{}); err != nil {
+		f.cfg.Lgr.Error("Failed to push tags.dat", log.KV("client-id", cid), log.KV("uuid", guid), log.KVErr(err))
+	}
+	return
+}
+
+func (f *s3store) tagsKey(cid uint64, guid uuid.UUID) string {
+	return path.Join(f.indexerKey(cid, guid), tags.TAG_MANAGER_FILENAME)
+}
+
+// BackupTags copies the local copy of every indexer's tags.dat into dir, the local
+// copies are the ones updated by tag syncs before being pushed to the object store
+func (f *s3store) BackupTags(ctx context.Context, dir string) (err error) {
+	_, err = tags.BackupTagDats(ctx, f.cfg.LocalStore, dir)
+	return
+}
+
+type handler struct {
+	ctx   context.Context
+	store *s3store
+	cid   uint64    //customer number
+	guid  uuid.UUID //indexer GUID
+	skey  string    //shard directory key
+}
+
+func (h handler) HandleFile(pth string, rdr io.Reader) error {
+	return h.HandleSizedFile(pth, -1, rdr)
+}
+
+// HandleSizedFile stores a shard file, files larger than the part size are sent as a
+// multipart upload which is aborted if the stream fails part way
+func (h handler) HandleSizedFile(pth string, sz int64, rdr io.Reader) error {
+	//the path comes off the wire, make sure it stays inside the shard directory
+	pth, err := safepath.Sanitize(pth)
+	if err != nil {
+		return err
+	}
+	key := path.Join(h.skey, filepath.ToSlash(pth))
+	opts := minio.PutObjectOptions{
+		ContentType: `application/octet-stream`,
+		PartSize:    h.store.cfg.PartSize,
+	}
+	_, err = h.store.clnt.PutObjectWithContext(h.ctx, h.store.cfg.Bucket, key, rdr, sz, opts)
+	return err
+}
+
+func (h handler) HandleTagUpdate(tgs []tags.TagPair) error {
+	if _, err := h.store.mergeTags(h.ctx, h.cid, h.guid, tgs); err != nil {
+		return err
+	}
+	return h.store.pushTags(h.ctx, h.cid, h.guid)
+}
+
+// HandleMetadata stores the shard metadata alongside the shard files
+func (h handler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	bts, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return h.HandleSizedFile(shardpacker.Metadata.Filepath(md.Shard), int64(len(bts)), bytes.NewReader(bts))
+}
@@ -0,0 +1,406 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const testBucket = `archive`
+
+func newTestStore(t *testing.T) (*s3store, *fakeS3) {
+	fk := newFakeS3()
+	srv := httptest.NewTLSServer(fk)
+	t.Cleanup(srv.Close)
+	f, err := NewS3StoreHandler(S3StoreConfig{
+		Endpoint:   srv.Listener.Addr().String(),
+		Bucket:     testBucket,
+		Prefix:     `/cloudarchive/`,
+		Region:     `us-east-1`,
+		AccessKey:  `access`,
+		SecretKey:  `secret`,
+		LocalStore: t.TempDir(),
+		PartSize:   MinPartSize,
+		Lgr:        log.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.clnt.SetCustomTransport(srv.Client().Transport)
+	return f, fk
+}
+
+func TestNewS3StoreConfig(t *testing.T) {
+	bad := []S3StoreConfig{
+		{Bucket: `b`, LocalStore: `/tmp`},
+		{Endpoint: `localhost:9000`, LocalStore: `/tmp`},
+		{Endpoint: `localhost:9000`, Bucket: `b`},
+		{Endpoint: `localhost:9000`, Bucket: `b`, LocalStore: `/tmp`, PartSize: 1024},
+	}
+	for _, c := range bad {
+		if _, err := NewS3StoreHandler(c); err == nil {
+			t.Fatalf("bad config accepted %+v", c)
+		}
+	}
+	f, err := NewS3StoreHandler(S3StoreConfig{Endpoint: `localhost:9000`, Bucket: `b`, Prefix: `/a/b/`, LocalStore: `/tmp`})
+	if err != nil {
+		t.Fatal(err)
+	} else if f.cfg.PartSize != DefaultPartSize {
+		t.Fatalf("bad default part size %d", f.cfg.PartSize)
+	} else if k := f.key(`1`, `well`); k != `a/b/1/well` {
+		t.Fatalf("bad key %q", k)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	f, fk := newTestStore(t)
+	ctx := context.Background()
+	guid := uuid.New()
+	tgs := []tags.TagPair{{Name: `default`, Value: 0}, {Name: `syslog`, Value: 1}}
+
+	//the store file is larger than the part size so it goes up in parts
+	files := map[string][]byte{
+		`.index`: []byte(`index`),
+		`.store`: randBytes(MinPartSize + 1024*1024),
+	}
+	sdir := storetest.WriteShard(t, `76a00`, files)
+	if err := f.UnpackShard(ctx, 1, guid, `default`, `76a00`, storetest.Pack(sdir, `76a00`, tgs)); err != nil {
+		t.Fatal(err)
+	} else if fk.multipartUploads() == 0 {
+		t.Fatal("store file was not sent in parts")
+	}
+	//pushing the same shard again keeps both copies
+	if err := f.UnpackShard(ctx, 1, guid, `default`, `76a00`, storetest.Pack(sdir, `76a00`, tgs)); err != nil {
+		t.Fatal(err)
+	}
+
+	if idxs, err := f.ListIndexes(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 1 || idxs[0] != guid.String() {
+		t.Fatalf("bad indexes %v", idxs)
+	}
+	if wells, err := f.ListIndexerWells(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else if len(wells) != 1 || wells[0] != `default` {
+		t.Fatalf("bad wells %v", wells)
+	}
+	s, e, _ := util.ShardNameToDateRange(`76a00`)
+	if tf, err := f.GetWellTimeframe(ctx, 1, guid, `default`); err != nil {
+		t.Fatal(err)
+	} else if !tf.Start.Equal(s) || !tf.End.Equal(e) {
+		t.Fatalf("bad timeframe %v", tf)
+	}
+	if shards, err := f.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: s, End: e}); err != nil {
+		t.Fatal(err)
+	} else if sort.Strings(shards); len(shards) != 2 || shards[0] != `76a00` || shards[1] != `76a00.1` {
+		t.Fatalf("bad shards %v", shards)
+	}
+	if got, err := f.GetTags(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else {
+		have := map[string]bool{}
+		for _, tp := range got {
+			have[tp.Name] = true
+		}
+		for _, tp := range tgs {
+			if !have[tp.Name] {
+				t.Fatalf("tag %s missing from %v", tp.Name, got)
+			}
+		}
+	}
+	if _, err := fk.object(`cloudarchive/1/` + guid.String() + `/tags.dat`); err != nil {
+		t.Fatal("tags.dat was not pushed")
+	}
+	if sz, err := f.CustomerUsage(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if sz < 2*uint64(len(files[`.store`])) {
+		t.Fatalf("bad usage %d", sz)
+	}
+
+	//pull it back and make sure we get the same files
+	got, err := storetest.Pull(f, 1, guid, `default`, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(files) {
+		t.Fatalf("pulled %d files, expected %d", len(got), len(files))
+	}
+	for ext, v := range files {
+		if !bytes.Equal(got[`76a00`+ext], v) {
+			t.Fatalf("pulled %s does not match", ext)
+		}
+	}
+	if err = f.PackShard(ctx, 1, guid, `default`, `76a01`, ioutil.Discard); err == nil {
+		t.Fatal("pulled a missing shard")
+	}
+}
+
+func TestFailedPush(t *testing.T) {
+	f, fk := newTestStore(t)
+	guid := uuid.New()
+	sdir := storetest.WriteShard(t, `76a00`, map[string][]byte{
+		`.index`: []byte(`index`),
+		`.store`: randBytes(MinPartSize + 1024*1024),
+	})
+	bb := bytes.NewBuffer(nil)
+	if _, err := io.Copy(bb, storetest.Pack(sdir, `76a00`, nil)); err != nil {
+		t.Fatal(err)
+	}
+	//cut the stream off part way through the store file
+	if err := f.UnpackShard(context.Background(), 1, guid, `default`, `76a00`, bytes.NewReader(bb.Bytes()[:bb.Len()/2])); err == nil {
+		t.Fatal("truncated shard accepted")
+	}
+	if keys := fk.keys(); len(keys) != 0 {
+		t.Fatalf("partial shard left behind %v", keys)
+	} else if n := fk.pendingUploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left open", n)
+	}
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// fakeS3 is just enough of the S3 API, with path style addressing, for the store to run against
+type fakeS3 struct {
+	sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	multipart int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func (fk *fakeS3) object(key string) ([]byte, error) {
+	fk.Lock()
+	defer fk.Unlock()
+	if v, ok := fk.objects[key]; ok {
+		return v, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fk *fakeS3) keys() (keys []string) {
+	fk.Lock()
+	defer fk.Unlock()
+	for k := range fk.objects {
+		if !strings.HasSuffix(k, `/tags.dat`) {
+			keys = append(keys, k)
+		}
+	}
+	return
+}
+
+func (fk *fakeS3) multipartUploads() int {
+	fk.Lock()
+	defer fk.Unlock()
+	return fk.multipart
+}
+
+func (fk *fakeS3) pendingUploads() int {
+	fk.Lock()
+	defer fk.Unlock()
+	return len(fk.uploads)
+}
+
+func (fk *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fk.Lock()
+	defer fk.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, `/`), `/`)
+	if bucket != testBucket {
+		fakeError(w, http.StatusNotFound, `NoSuchBucket`)
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case key == `` && r.Method == http.MethodGet:
+		fk.list(w, q.Get(`prefix`), q.Get(`delimiter`))
+	case key == `` && r.Method == http.MethodPost && q.Has(`delete`):
+		var req struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			fakeError(w, http.StatusBadRequest, `MalformedXML`)
+			return
+		}
+		for _, o := range req.Object {
+			delete(fk.objects, o.Key)
+		}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+	case r.Method == http.MethodPost && q.Has(`uploads`):
+		id := uuid.New().String()
+		fk.uploads[id] = map[int][]byte{}
+		fk.multipart++
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has(`uploadId`):
+		parts, ok := fk.uploads[q.Get(`uploadId`)]
+		if !ok {
+			fakeError(w, http.StatusNotFound, `NoSuchUpload`)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get(`partNumber`))
+		bts, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		parts[n] = bts
+		w.Header().Set(`ETag`, etag(bts))
+	case r.Method == http.MethodPost && q.Has(`uploadId`):
+		parts, ok := fk.uploads[q.Get(`uploadId`)]
+		if !ok {
+			fakeError(w, http.StatusNotFound, `NoSuchUpload`)
+			return
+		}
+		var nums []int
+		for n := range parts {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		var obj []byte
+		for _, n := range nums {
+			obj = append(obj, parts[n]...)
+		}
+		fk.objects[key] = obj
+		delete(fk.uploads, q.Get(`uploadId`))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(obj)})
+	case r.Method == http.MethodDelete && q.Has(`uploadId`):
+		delete(fk.uploads, q.Get(`uploadId`))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		bts, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		fk.objects[key] = bts
+		w.Header().Set(`ETag`, etag(bts))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := fk.objects[key]
+		if !ok {
+			fakeError(w, http.StatusNotFound, `NoSuchKey`)
+			return
+		}
+		w.Header().Set(`ETag`, etag(obj))
+		w.Header().Set(`Last-Modified`, time.Now().UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(obj))
+	case r.Method == http.MethodDelete:
+		delete(fk.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, `NotImplemented`)
+	}
+}
+
+func (fk *fakeS3) list(w http.ResponseWriter, prefix, delim string) {
+	type content struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	res := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: testBucket, Prefix: prefix}
+	var keys []string
+	for k := range fk.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delim != `` {
+			if i := strings.Index(k[len(prefix):], delim); i >= 0 {
+				if p := k[:len(prefix)+i+len(delim)]; !seen[p] {
+					seen[p] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: p})
+				}
+				continue
+			}
+		}
+		res.Contents = append(res.Contents, content{
+			Key:          k,
+			Size:         int64(len(fk.objects[k])),
+			ETag:         etag(fk.objects[k]),
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	writeXML(w, res)
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/xml`)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set(`Content-Type`, `application/xml`)
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
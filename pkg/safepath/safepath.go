@@ -0,0 +1,94 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package safepath validates file names taken from untrusted sources, such as the entry
+// names in a packed shard, before they are used to build filesystem paths.  Names are
+// checked against the rules of every platform the archive runs on, so a shard which is
+// safe to unpack on one system is safe on all of them.
+package safepath
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrEmptyPath    = errors.New("Path is empty")
+	ErrAbsolutePath = errors.New("Path is absolute")
+	ErrTraversal    = errors.New("Path escapes its directory")
+	ErrDeviceName   = errors.New("Path names a device")
+	ErrInvalidChar  = errors.New("Path contains an invalid character")
+)
+
+// reserved device names on windows, which refer to the device regardless of the
+// directory they appear in or any extension
+var deviceNames = map[string]bool{
+	`CON`: true, `PRN`: true, `AUX`: true, `NUL`: true, `CONIN$`: true, `CONOUT$`: true,
+	`COM0`: true, `COM1`: true, `COM2`: true, `COM3`: true, `COM4`: true,
+	`COM5`: true, `COM6`: true, `COM7`: true, `COM8`: true, `COM9`: true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	`LPT0`: true, `LPT1`: true, `LPT2`: true, `LPT3`: true, `LPT4`: true,
+	`LPT5`: true, `LPT6`: true, `LPT7`: true, `LPT8`: true, `LPT9`: true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// Sanitize validates a relative path, separated by slashes or the local separator, and
+// returns it cleaned and converted to the local separator, ready to be joined onto a base
+// directory.  Empty and absolute paths, paths with any .. element, backslashes, colons, or
+// control characters, and paths with an element naming a device are rejected.  Redundant
+// separators and . elements are dropped.
+func Sanitize(p string) (r string, err error) {
+	if p = filepath.ToSlash(p); p == `` {
+		err = ErrEmptyPath
+		return
+	} else if strings.HasPrefix(p, `/`) {
+		err = ErrAbsolutePath
+		return
+	}
+	for _, c := range p {
+		//backslashes are separators and colons introduce volumes and streams on windows
+		if c < 0x20 || c == 0x7f || c == '\\' || c == ':' {
+			err = ErrInvalidChar
+			return
+		}
+	}
+	for _, e := range strings.Split(p, `/`) {
+		if e == `..` {
+			err = ErrTraversal
+			return
+		} else if isDevice(e) {
+			err = ErrDeviceName
+			return
+		}
+	}
+	if r = path.Clean(p); r == `.` {
+		err = ErrEmptyPath
+		return
+	}
+	r = filepath.FromSlash(r)
+	return
+}
+
+// Join sanitizes the untrusted path p and joins it onto the trusted directory base
+func Join(base, p string) (r string, err error) {
+	if p, err = Sanitize(p); err == nil {
+		r = filepath.Join(base, p)
+	}
+	return
+}
+
+// isDevice reports whether a path element names a windows device, which it does even with
+// an extension or trailing spaces and dots
+func isDevice(e string) bool {
+	if i := strings.IndexByte(e, '.'); i >= 0 {
+		e = e[:i]
+	}
+	return deviceNames[strings.ToUpper(strings.TrimRight(e, ` `))]
+}
@@ -0,0 +1,115 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package safepath
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitize(t *testing.T) {
+	good := map[string]string{
+		`76a00.store`:       `76a00.store`,
+		`76a00.accel/keys`:  filepath.Join(`76a00.accel`, `keys`),
+		`./76a00.index`:     `76a00.index`,
+		`76a00.accel//data`: filepath.Join(`76a00.accel`, `data`),
+		`76a00.accel/./`:    `76a00.accel`,
+		`console`:           `console`,
+		`COM10`:             `COM10`,
+		`...`:               `...`,
+		`a..b`:              `a..b`,
+	}
+	for in, want := range good {
+		if r, err := Sanitize(in); err != nil {
+			t.Fatalf("%q rejected: %v", in, err)
+		} else if r != want {
+			t.Fatalf("%q sanitized to %q, expected %q", in, r, want)
+		}
+	}
+
+	bad := map[string]error{
+		``:                    ErrEmptyPath,
+		`.`:                   ErrEmptyPath,
+		`./`:                  ErrEmptyPath,
+		`/etc/passwd`:         ErrAbsolutePath,
+		`//server/share`:      ErrAbsolutePath,
+		`..`:                  ErrTraversal,
+		`../76a00.store`:      ErrTraversal,
+		`76a00.accel/../../x`: ErrTraversal,
+		`a/b/..`:              ErrTraversal,
+		`..\x`:                ErrInvalidChar,
+		`C:\Windows`:          ErrInvalidChar,
+		`C:x`:                 ErrInvalidChar,
+		`76a00.store:stream`:  ErrInvalidChar,
+		"76a00\x00.store":     ErrInvalidChar,
+		"76a00\n.store":       ErrInvalidChar,
+		`NUL`:                 ErrDeviceName,
+		`con.txt`:             ErrDeviceName,
+		`dir/aux`:             ErrDeviceName,
+		`COM1.store`:          ErrDeviceName,
+		`lpt9 .index`:         ErrDeviceName,
+		"COM¹":                ErrDeviceName,
+	}
+	for in, want := range bad {
+		if r, err := Sanitize(in); err == nil {
+			t.Fatalf("%q accepted as %q", in, r)
+		} else if !errors.Is(err, want) {
+			t.Fatalf("%q rejected with %v, expected %v", in, err, want)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	base := filepath.Join(`storage`, `well`, `76a00`)
+	if r, err := Join(base, `76a00.accel/keys`); err != nil {
+		t.Fatal(err)
+	} else if r != filepath.Join(base, `76a00.accel`, `keys`) {
+		t.Fatalf("bad join %q", r)
+	}
+	if _, err := Join(base, `../76a01/76a01.store`); err != ErrTraversal {
+		t.Fatalf("traversal not rejected: %v", err)
+	}
+}
+
+func FuzzSanitize(f *testing.F) {
+	for _, s := range []string{`76a00.store`, `76a00.accel/keys`, `../x`, `/x`, `a/./b`, `C:\x`, `con`, `a//b/`, "\x00"} {
+		f.Add(s)
+	}
+	base := filepath.Join(`storage`, `shard`)
+	f.Fuzz(func(t *testing.T, p string) {
+		r, err := Sanitize(p)
+		if err != nil {
+			return
+		}
+		if r == `` || r == `.` || filepath.IsAbs(r) || filepath.VolumeName(r) != `` {
+			t.Fatalf("%q sanitized to non-relative %q", p, r)
+		}
+		if r != filepath.Clean(r) {
+			t.Fatalf("%q sanitized to unclean %q", p, r)
+		}
+		for _, e := range strings.Split(filepath.ToSlash(r), `/`) {
+			if e == `..` || e == `.` || e == `` || isDevice(e) {
+				t.Fatalf("%q sanitized to %q with bad element %q", p, r, e)
+			}
+		}
+		if j := filepath.Join(base, r); !strings.HasPrefix(j, base+string(filepath.Separator)) {
+			t.Fatalf("%q escapes the base directory as %q", p, j)
+		}
+		if utf8.ValidString(p) && strings.ContainsAny(r, "\\:\x00") {
+			t.Fatalf("%q sanitized to %q with an invalid character", p, r)
+		}
+		//sanitizing is idempotent
+		if r2, err := Sanitize(filepath.ToSlash(r)); err != nil || r2 != r {
+			t.Fatalf("%q resanitized to %q, %v", r, r2, err)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package shardpacker
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidArtifact = errors.New("invalid shard artifact pattern")
+	ErrUnknownArtifact = errors.New("file does not match a registered shard artifact")
+
+	artifactLock     sync.Mutex
+	artifactPatterns []string
+)
+
+// RegisterArtifact registers a glob pattern, as understood by filepath.Match, naming
+// additional files which live alongside the standard shard files.  Matching files are
+// carried through the packer and routed to the UnpackHandler like any other shard file.
+// Patterns must name files directly within the shard directory and cannot claim the
+// names of the standard shard files.  Both ends of a transfer must register the same
+// patterns, an unpacker rejects files which do not match a registered pattern.
+func RegisterArtifact(pattern string) error {
+	if pattern == `` || strings.ContainsAny(pattern, `/\`) {
+		return fmt.Errorf("%w %q", ErrInvalidArtifact, pattern)
+	} else if _, err := filepath.Match(pattern, ``); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidArtifact, pattern, err)
+	}
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+	for _, p := range artifactPatterns {
+		if p == pattern {
+			return nil
+		}
+	}
+	artifactPatterns = append(artifactPatterns, pattern)
+	return nil
+}
+
+// Artifacts returns the registered shard artifact patterns
+func Artifacts() []string {
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+	return append([]string(nil), artifactPatterns...)
+}
+
+// IsArtifact returns true if the name is a file directly within a shard directory
+// that matches a registered artifact pattern and is not a standard shard file
+func IsArtifact(name string) bool {
+	if name == `` || name == `.` || name == `..` || strings.ContainsAny(name, `/\`) {
+		return false
+	} else if _, err := FilenameToType(name); err == nil {
+		return false
+	}
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+	for _, p := range artifactPatterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hitArtifact marks the named artifact as added, ensuring it is not added twice
+func (p *ftracker) hitArtifact(name string) error {
+	if !IsArtifact(name) {
+		return fmt.Errorf("%w: %s", ErrUnknownArtifact, name)
+	}
+	if p.artifacts == nil {
+		p.artifacts = map[string]bool{}
+	} else if p.artifacts[name] {
+		return fmt.Errorf("Artifact %s already added", name)
+	}
+	p.artifacts[name] = true
+	return nil
+}
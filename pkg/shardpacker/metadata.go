@@ -0,0 +1,75 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package shardpacker
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxMetadataSize = 64 * 1024
+)
+
+var (
+	ErrMetadataMismatch = errors.New("shard metadata does not describe this shard")
+)
+
+// ShardMetadata describes where a shard came from, it travels inside the packed stream
+// so that storage backends do not have to infer provenance from directory names
+type ShardMetadata struct {
+	Shard         string    // the shard ID, e.g. 76dd1
+	Well          string    // the well the shard belongs to
+	Indexer       uuid.UUID // the indexer which pushed the shard
+	Start         time.Time // start of the time range the shard covers
+	End           time.Time // end of the time range the shard covers
+	Entries       int64     `json:",omitempty"` // zero if the client does not know the entry count
+	ClientVersion string    `json:",omitempty"`
+}
+
+// MetadataHandler is an optional interface for an UnpackHandler, handlers which do not
+// implement it are unpacked as normal and the metadata is discarded
+type MetadataHandler interface {
+	HandleMetadata(ShardMetadata) error
+}
+
+// AddMetadata adds the shard metadata to the stream, an empty Shard is filled in with the packer's shard ID
+func (p *Packer) AddMetadata(md ShardMetadata) (err error) {
+	if md.Shard == `` {
+		md.Shard = p.id
+	} else if trimVersion(md.Shard) != p.id {
+		err = ErrMetadataMismatch
+		return
+	}
+	var bts []byte
+	if bts, err = json.Marshal(md); err != nil {
+		return
+	}
+	return p.addByteStream(Metadata, bts)
+}
+
+func (up *Unpacker) handleMetadata(rdr io.Reader, uph UnpackHandler) (err error) {
+	var md ShardMetadata
+	if err = json.NewDecoder(io.LimitReader(rdr, maxMetadataSize)).Decode(&md); err != nil {
+		return
+	} else if trimVersion(md.Shard) != up.id {
+		err = ErrMetadataMismatch
+		return
+	} else if err = up.hitType(Metadata); err != nil {
+		return
+	}
+	if mh, ok := uph.(MetadataHandler); ok {
+		err = mh.HandleMetadata(md)
+	}
+	return
+}
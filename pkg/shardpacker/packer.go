@@ -33,9 +33,11 @@ const (
 	IndexAccelDataFile Ftype = 6
 	TagsUpdate         Ftype = 7
 	WellTags           Ftype = 8
+	Metadata           Ftype = 9
 
 	tagupdateFilename string = `tagsupdate`
 	wellTagsFilename  string = `tags`
+	metadataFilename  string = `metadata.json`
 )
 
 var (
@@ -57,6 +59,23 @@ type Packer struct {
 	zwtr *zlib.Writer
 	prdr *io.PipeReader
 	pwtr *io.PipeWriter
+	pf   ProgressFunc
+}
+
+// ProgressFunc is handed the number of uncompressed file bytes each time a chunk of a shard file is packed or unpacked
+type ProgressFunc func(n int64)
+
+// progressReader reports every read to a ProgressFunc
+type progressReader struct {
+	io.Reader
+	pf ProgressFunc
+}
+
+func (pr progressReader) Read(b []byte) (n int, err error) {
+	if n, err = pr.Reader.Read(b); n > 0 {
+		pr.pf(int64(n))
+	}
+	return
 }
 
 type ftracker struct {
@@ -68,6 +87,8 @@ type ftracker struct {
 	accelDataHit  bool
 	wellTagsHit   bool
 	tagsUpdateHit bool
+	metadataHit   bool
+	artifacts     map[string]bool //registered artifacts which have been added
 }
 
 func NewPacker(id string) (p *Packer) {
@@ -77,11 +98,18 @@ func NewPacker(id string) (p *Packer) {
 	p.ctx, p.cf = context.WithCancel(context.Background())
 	p.prdr, p.pwtr = io.Pipe() //get a pipe wired up
 	//get the compressing writer up wired to the pipe with a context wrapper
-	p.zwtr = zlib.NewWriter(contextio.NewWriter(p.ctx, p.pwtr))
+	p.zwtr = getZlibWriter(contextio.NewWriter(p.ctx, p.pwtr))
 	p.twtr = tar.NewWriter(p.zwtr) //wire the tar writer to the compressed writer
 	return
 }
 
+// SetProgress registers a function which is called as file contents are added to the packer
+func (p *Packer) SetProgress(pf ProgressFunc) {
+	p.Lock()
+	p.pf = pf
+	p.Unlock()
+}
+
 func (p *Packer) Flush() (err error) {
 	p.Lock()
 	if p.pwtr == nil || p.zwtr == nil || p.twtr == nil {
@@ -134,6 +162,9 @@ func (p *Packer) closePipeline() (err error) {
 	} else if err = p.zwtr.Close(); err != nil {
 		return
 	}
+	//everything has been flushed through the pipe, so the compressor can be recycled
+	putZlibWriter(p.zwtr)
+	p.zwtr = nil
 	err = p.pwtr.Close()
 	return
 }
@@ -206,15 +237,7 @@ func (p *Packer) addByteStream(tp Ftype, bts []byte) (err error) {
 	if err != nil {
 		return
 	}
-	//create the tar header
-	hdr := tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     pth,
-		Size:     sz,
-		Mode:     0600,
-		Format:   tar.FormatGNU,
-	}
-	if err = twtr.WriteHeader(&hdr); err != nil {
+	if err = twtr.WriteHeader(fileHeader(pth, sz)); err != nil {
 		return
 	}
 	err = writeAll(twtr, bts)
@@ -222,43 +245,63 @@ func (p *Packer) addByteStream(tp Ftype, bts []byte) (err error) {
 }
 
 func (p *Packer) AddFile(tp Ftype, sz int64, rdr io.Reader) (err error) {
-	var twtr *tar.Writer
 	pth := tp.Filename(p.id)
 	if pth == `` {
 		err = ErrInvalidFileType
 		return
 	}
+	return p.addFile(pth, sz, rdr, func() error { return p.hitType(tp) })
+}
+
+// AddArtifact adds a file matching a registered shard artifact pattern, the name
+// is the name of the file within the shard directory
+func (p *Packer) AddArtifact(name string, sz int64, rdr io.Reader) (err error) {
+	return p.addFile(name, sz, rdr, func() error { return p.hitArtifact(name) })
+}
+
+// addFile writes a file into the tar stream, hit is called with the lock held to
+// ensure the file is valid and has not already been added
+func (p *Packer) addFile(pth string, sz int64, rdr io.Reader, hit func() error) (err error) {
+	var twtr *tar.Writer
 	//lock and grab a local copy of the tar writer, if a close happens on the read
 	//side while we are writing, we won't lose access to the tar writer
 	p.Lock()
 	if p.pwtr == nil || p.zwtr == nil || p.twtr == nil {
 		err = ErrClosed
 	} else {
-		err = p.hitType(tp)
+		err = hit()
 		twtr = p.twtr
+		if p.pf != nil {
+			rdr = progressReader{Reader: rdr, pf: p.pf}
+		}
 	}
 	p.Unlock()
 	if err != nil {
 		return
 	}
-	//create the tar header
-	hdr := tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     pth,
-		Size:     sz,
-		Mode:     0600,
-		Format:   tar.FormatGNU,
-	}
-	if err = twtr.WriteHeader(&hdr); err != nil {
+	if err = twtr.WriteHeader(fileHeader(pth, sz)); err != nil {
 		return
 	}
 	var n int64
-	if n, err = io.CopyN(twtr, rdr, sz); err == nil && n != sz {
+	if n, err = CopyN(twtr, rdr, sz); err == nil && n != sz {
 		err = errors.New("Failed file write")
 	}
 	return
 }
 
+// fileHeader builds the tar header for a shard file.  Headers are written in the PAX
+// format so files of 8GiB and larger and long names are recorded exactly, unpackers
+// accept both PAX and the GNU format written by older packers.
+func fileHeader(pth string, sz int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     pth,
+		Size:     sz,
+		Mode:     0600,
+		Format:   tar.FormatPAX,
+	}
+}
+
 // hitType marks the shard file type as added in the packer
 // this ensures we can't add things twice or attempt to add two different accelerators
 func (p *ftracker) hitType(tp Ftype) (err error) {
@@ -303,6 +346,11 @@ func (p *ftracker) hitType(tp Ftype) (err error) {
 			err = errors.New("Well tags already added")
 		}
 		p.wellTagsHit = true
+	case Metadata:
+		if p.metadataHit {
+			err = errors.New("Metadata already added")
+		}
+		p.metadataHit = true
 	default:
 		err = errors.New("unknown type")
 	}
@@ -345,6 +393,8 @@ func (ft Ftype) Filename(id string) string {
 		return tagupdateFilename
 	case WellTags:
 		return wellTagsFilename
+	case Metadata:
+		return metadataFilename
 	case Store:
 		return id + ".store"
 	case Index:
@@ -367,6 +417,8 @@ func (ft Ftype) Filepath(id string) string {
 		return tagupdateFilename
 	case WellTags:
 		return wellTagsFilename
+	case Metadata:
+		return metadataFilename
 	case Store:
 		return id + ".store"
 	case Index:
@@ -396,6 +448,9 @@ func FilenameToType(name string) (ft Ftype, err error) {
 	} else if name == wellTagsFilename {
 		ft = WellTags
 		return
+	} else if name == metadataFilename {
+		ft = Metadata
+		return
 	}
 	ext := filepath.Ext(name)
 	switch ext {
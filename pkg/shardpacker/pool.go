@@ -0,0 +1,107 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package shardpacker
+
+import (
+	"bufio"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	copyBufferSize = 128 * 1024 // file contents are copied in chunks of this size
+	readBufferSize = 64 * 1024  // compressed stream reads feeding the unpacker
+)
+
+// packing a shard allocates a deflate state of several hundred KB and unpacking one a
+// large inflate window, busy servers and indexers recycle them rather than churn the GC
+var (
+	copyBufPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, copyBufferSize)
+			return &b
+		},
+	}
+	readBufPool = sync.Pool{
+		New: func() interface{} {
+			return bufio.NewReaderSize(nil, readBufferSize)
+		},
+	}
+	zwtrPool sync.Pool // *zlib.Writer
+	zrdrPool sync.Pool // io.ReadCloser returned by zlib.NewReader
+)
+
+// writerOnly and readerOnly hide ReadFrom and WriteTo so that copies always use our buffer,
+// os.File.ReadFrom for instance falls back to io.Copy and allocates its own
+type writerOnly struct{ io.Writer }
+
+type readerOnly struct{ io.Reader }
+
+// Copy is io.Copy using a pooled buffer, UnpackHandlers can use it to write out
+// shard files without allocating a copy buffer for each one
+func Copy(dst io.Writer, src io.Reader) (n int64, err error) {
+	bp := copyBufPool.Get().(*[]byte)
+	n, err = io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *bp)
+	copyBufPool.Put(bp)
+	return
+}
+
+// CopyN is io.CopyN using a pooled buffer
+func CopyN(dst io.Writer, src io.Reader, n int64) (written int64, err error) {
+	if written, err = Copy(dst, io.LimitReader(src, n)); written == n {
+		return n, nil
+	} else if written < n && err == nil {
+		err = io.EOF //src stopped early
+	}
+	return
+}
+
+func getZlibWriter(w io.Writer) *zlib.Writer {
+	if zw, ok := zwtrPool.Get().(*zlib.Writer); ok {
+		zw.Reset(w)
+		return zw
+	}
+	return zlib.NewWriter(w)
+}
+
+// putZlibWriter recycles a closed zlib writer, nothing may write to it afterwards
+func putZlibWriter(zw *zlib.Writer) {
+	zw.Reset(ioutil.Discard) //drop the reference to the old destination
+	zwtrPool.Put(zw)
+}
+
+func getZlibReader(r io.Reader) (io.ReadCloser, error) {
+	if zr, ok := zrdrPool.Get().(io.ReadCloser); ok {
+		if err := zr.(zlib.Resetter).Reset(r, nil); err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	return zlib.NewReader(r)
+}
+
+func putZlibReader(zr io.ReadCloser) {
+	zr.Close()
+	zrdrPool.Put(zr)
+}
+
+// getReadBuffer wraps the compressed stream in a pooled buffered reader, the zlib reader
+// would otherwise allocate a small one of its own and read the stream 4KB at a time
+func getReadBuffer(r io.Reader) *bufio.Reader {
+	br := readBufPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReadBuffer(br *bufio.Reader) {
+	br.Reset(nil)
+	readBufPool.Put(br)
+}
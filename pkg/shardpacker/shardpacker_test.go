@@ -9,7 +9,9 @@
 package shardpacker
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/zlib"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +20,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -232,6 +236,292 @@ func testCycle(id string, tsts []ftest) error {
 	return nil
 }
 
+func TestProgress(t *testing.T) {
+	id := `deadbeef06`
+	sdir, err := genUnpackDirs(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsts := []ftest{
+		ftest{tp: Store, v: `store`},
+		ftest{tp: Index, v: `index`},
+		ftest{tp: Verify, v: `verify`},
+	}
+	var total int64
+	for _, v := range tsts {
+		total += int64(len(v.v))
+	}
+
+	var packed, unpacked int64
+	p := NewPacker(id)
+	p.SetProgress(func(n int64) { packed += n })
+	up, err := NewUnpacker(id, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.SetProgress(func(n int64) { unpacked += n })
+	rch := make(chan error, 1)
+	go func() {
+		rch <- up.Unpack(testUnpackHandler{sdir: sdir})
+	}()
+	for _, v := range tsts {
+		bb := bytes.NewBuffer([]byte(v.v))
+		if err := p.AddFile(v.tp, int64(bb.Len()), bb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rch; err != nil {
+		t.Fatal(err)
+	}
+	if packed != total {
+		t.Fatalf("bad packed progress: %d != %d", packed, total)
+	} else if unpacked != total {
+		t.Fatalf("bad unpacked progress: %d != %d", unpacked, total)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	for _, pat := range []string{``, `sub/*.hints`, `[`} {
+		if err := RegisterArtifact(pat); !errors.Is(err, ErrInvalidArtifact) {
+			t.Fatalf("failed to catch invalid pattern %q: %v", pat, err)
+		}
+	}
+	if err := RegisterArtifact(`*.hints`); err != nil {
+		t.Fatal(err)
+	}
+	id := `deadbeef07`
+	sdir, err := genUnpackDirs(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`..`, `foo.bogus`, id + `.store`, `../` + id + `.hints`} {
+		if IsArtifact(name) {
+			t.Fatalf("%q should not be an artifact", name)
+		}
+	}
+
+	p := NewPacker(id)
+	up, err := NewUnpacker(id, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rch := make(chan error, 1)
+	go func() {
+		rch <- up.Unpack(testUnpackHandler{sdir: sdir})
+	}()
+	bb := bytes.NewBufferString(`store`)
+	if err := p.AddFile(Store, int64(bb.Len()), bb); err != nil {
+		t.Fatal(err)
+	}
+	hints := id + `.hints`
+	bb = bytes.NewBufferString(`hints`)
+	if err := p.AddArtifact(hints, int64(bb.Len()), bb); err != nil {
+		t.Fatal(err)
+	}
+	bb = bytes.NewBufferString(`hints`)
+	if err := p.AddArtifact(hints, int64(bb.Len()), bb); err == nil {
+		t.Fatal("failed to catch duplicate artifact")
+	}
+	bb = bytes.NewBufferString(`bogus`)
+	if err := p.AddArtifact(`foo.bogus`, int64(bb.Len()), bb); !errors.Is(err, ErrUnknownArtifact) {
+		t.Fatalf("failed to catch unregistered artifact: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rch; err != nil {
+		t.Fatal(err)
+	}
+	if bts, err := ioutil.ReadFile(filepath.Join(sdir, hints)); err != nil {
+		t.Fatal(err)
+	} else if string(bts) != `hints` {
+		t.Fatalf("bad artifact contents %q", bts)
+	}
+}
+
+func TestLargeFileHeader(t *testing.T) {
+	//sizes of 8GiB and up do not fit a ustar header and need a PAX record
+	sz := int64(9 << 30)
+	bb := bytes.NewBuffer(nil)
+	if err := tar.NewWriter(bb).WriteHeader(fileHeader(`deadbeef08.store`, sz)); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(bb).Next()
+	if err != nil {
+		t.Fatal(err)
+	} else if hdr.Size != sz {
+		t.Fatalf("bad size %d", hdr.Size)
+	} else if hdr.Format != tar.FormatPAX {
+		t.Fatalf("bad format %v", hdr.Format)
+	} else if hdr.PAXRecords[`size`] != strconv.FormatInt(sz, 10) {
+		t.Fatalf("missing size record: %v", hdr.PAXRecords)
+	}
+}
+
+func TestUnpackTarFormats(t *testing.T) {
+	if err := RegisterArtifact(`*.hints`); err != nil {
+		t.Fatal(err)
+	}
+	id := `deadbeef09`
+	//too long for a ustar name field
+	long := id + strings.Repeat(`x`, 150) + `.hints`
+	for _, format := range []tar.Format{tar.FormatGNU, tar.FormatPAX} {
+		sdir, err := genUnpackDirs(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bb := bytes.NewBuffer(nil)
+		zw := zlib.NewWriter(bb)
+		tw := tar.NewWriter(zw)
+		if format == tar.FormatPAX {
+			if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{`comment`: `archive`}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for name, data := range map[string]string{Store.Filename(id): `store`, long: `hints`} {
+			hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(data)), Mode: 0600, Format: format}
+			if err = tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			} else if _, err = io.WriteString(tw, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = tw.Close(); err != nil {
+			t.Fatal(err)
+		} else if err = zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		up, err := NewUnpacker(id, bb)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = up.Unpack(testUnpackHandler{sdir: sdir}); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if bts, err := ioutil.ReadFile(filepath.Join(sdir, long)); err != nil {
+			t.Fatal(err)
+		} else if string(bts) != `hints` {
+			t.Fatalf("%v: bad artifact contents %q", format, bts)
+		}
+		if err = os.RemoveAll(sdir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type metadataUnpackHandler struct {
+	testUnpackHandler
+	md *ShardMetadata
+}
+
+func (muh metadataUnpackHandler) HandleMetadata(md ShardMetadata) error {
+	*muh.md = md
+	return nil
+}
+
+func TestMetadata(t *testing.T) {
+	id := `deadbeef08`
+	sdir, err := genUnpackDirs(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := ShardMetadata{
+		Well:          defWell,
+		Indexer:       idxguid,
+		Start:         time.Unix(1000, 0).UTC(),
+		End:           time.Unix(2000, 0).UTC(),
+		Entries:       42,
+		ClientVersion: `test`,
+	}
+	pack := func(md ShardMetadata, uph UnpackHandler) error {
+		p := NewPacker(id)
+		up, err := NewUnpacker(id, p)
+		if err != nil {
+			return err
+		}
+		rch := make(chan error, 1)
+		go func() {
+			rch <- up.Unpack(uph)
+		}()
+		if err := p.AddMetadata(md); err != nil {
+			p.CloseWithError(err)
+			<-rch
+			return err
+		} else if err = p.AddMetadata(md); err == nil {
+			t.Fatal("failed to catch duplicate metadata")
+		}
+		bb := bytes.NewBufferString(`store`)
+		if err := p.AddFile(Store, int64(bb.Len()), bb); err != nil {
+			return err
+		} else if err = p.Close(); err != nil {
+			return err
+		}
+		return <-rch
+	}
+
+	var got ShardMetadata
+	if err = pack(md, metadataUnpackHandler{testUnpackHandler: testUnpackHandler{sdir: sdir}, md: &got}); err != nil {
+		t.Fatal(err)
+	}
+	md.Shard = id //filled in by the packer
+	if got != md {
+		t.Fatalf("bad metadata %+v != %+v", got, md)
+	}
+	//handlers which do not take metadata still unpack the shard
+	if err = pack(md, testUnpackHandler{sdir: sdir}); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(sdir, Metadata.Filepath(id))); !os.IsNotExist(err) {
+		t.Fatalf("metadata written as a file: %v", err)
+	}
+	md.Shard = `deadbeef09`
+	if err = pack(md, testUnpackHandler{sdir: sdir}); err != ErrMetadataMismatch {
+		t.Fatalf("failed to catch mismatched metadata: %v", err)
+	}
+}
+
+func TestPartial(t *testing.T) {
+	id := `deadbeef0a`
+	sdir, err := genUnpackDirs(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := func(partial bool) error {
+		p := NewPacker(id)
+		up, err := NewUnpacker(id, p)
+		if err != nil {
+			return err
+		}
+		up.SetPartial(partial)
+		rch := make(chan error, 1)
+		go func() {
+			rch <- up.Unpack(testUnpackHandler{sdir: sdir})
+		}()
+		bb := bytes.NewBufferString(`index`)
+		if err := p.AddFile(Index, int64(bb.Len()), bb); err != nil {
+			p.CloseWithError(err)
+			<-rch
+			return err
+		} else if err = p.Close(); err != nil {
+			return err
+		}
+		return <-rch
+	}
+	//a stream without the store file is only complete as a partial
+	if err = pack(false); err == nil {
+		t.Fatal("failed to catch missing store file")
+	}
+	if err = pack(true); err != nil {
+		t.Fatal(err)
+	}
+	if bts, err := os.ReadFile(filepath.Join(sdir, Index.Filepath(id))); err != nil {
+		t.Fatal(err)
+	} else if string(bts) != `index` {
+		t.Fatalf("bad index file %q", bts)
+	}
+}
+
 func TestAbort(t *testing.T) {
 	id := `feedfebe00`
 	sdir, err := genUnpackDirs(id)
@@ -305,3 +595,52 @@ func (tuh testUnpackHandler) HandleFile(fname string, rdr io.Reader) error {
 func (tuh testUnpackHandler) HandleTagUpdate([]tags.TagPair) error {
 	return nil
 }
+
+// packers and unpackers running side by side must not share recycled compressors
+func TestPooledCycles(t *testing.T) {
+	tsts := []ftest{
+		ftest{tp: Store, v: strings.Repeat(`store`, 100000)},
+		ftest{tp: Index, v: `index`},
+		ftest{tp: Verify, v: `verify`},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				if err := testCycle(id, tsts); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(fmt.Sprintf("deadbeef2%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	//a closed packer has handed back its compressor and refuses further use
+	p := NewPacker(`deadbeef30`)
+	go io.Copy(ioutil.Discard, p)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = p.Flush(); err == nil {
+		t.Fatal("flushed a closed packer")
+	} else if err = p.AddFile(Store, 5, strings.NewReader(`store`)); err != ErrClosed {
+		t.Fatalf("added a file to a closed packer: %v", err)
+	}
+}
+
+func TestCopyN(t *testing.T) {
+	var bb bytes.Buffer
+	if n, err := CopyN(&bb, strings.NewReader(`hello world`), 5); err != nil || n != 5 || bb.String() != `hello` {
+		t.Fatalf("bad copy: %d %v %q", n, err, bb.String())
+	}
+	if n, err := CopyN(&bb, strings.NewReader(`abc`), 5); err != io.EOF || n != 3 {
+		t.Fatalf("short source not reported: %d %v", n, err)
+	}
+}
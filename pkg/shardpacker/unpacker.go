@@ -10,11 +10,11 @@ package shardpacker
 
 import (
 	"archive/tar"
-	"compress/zlib"
 	"context"
 	"encoding/gob"
 	"errors"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -33,6 +33,12 @@ type UnpackHandler interface {
 	HandleTagUpdate([]tags.TagPair) error
 }
 
+// SizedFileHandler is an optional interface for an UnpackHandler, handlers which implement
+// it are handed each file's size from the stream up front so they can prepare storage for it
+type SizedFileHandler interface {
+	HandleSizedFile(pth string, size int64, rdr io.Reader) error
+}
+
 type Unpacker struct {
 	io.WriteCloser
 	sync.Mutex
@@ -41,6 +47,9 @@ type Unpacker struct {
 	cf  context.CancelFunc
 	rdr io.Reader
 	id  string
+	pf  ProgressFunc
+
+	partial bool
 }
 
 func NewUnpacker(id string, rdr io.Reader) (up *Unpacker, err error) {
@@ -57,6 +66,21 @@ func NewUnpacker(id string, rdr io.Reader) (up *Unpacker, err error) {
 	return
 }
 
+// SetProgress registers a function which is called as file contents are handed to the UnpackHandler
+func (up *Unpacker) SetProgress(pf ProgressFunc) {
+	up.Lock()
+	up.pf = pf
+	up.Unlock()
+}
+
+// SetPartial allows a stream that carries only some of a shard's files, such as a delta
+// against a stored copy, rather than requiring the files a complete shard needs
+func (up *Unpacker) SetPartial(v bool) {
+	up.Lock()
+	up.partial = v
+	up.Unlock()
+}
+
 func (up *Unpacker) Cancel() {
 	if up.cf != nil {
 		up.cf()
@@ -71,19 +95,27 @@ func (up *Unpacker) Unpack(uph UnpackHandler) (err error) {
 		return
 	}
 
-	rdr := contextio.NewReader(up.ctx, up.rdr)
+	rdr := getReadBuffer(contextio.NewReader(up.ctx, up.rdr))
+	defer putReadBuffer(rdr)
 	//wire up our readers
 	var zrdr io.ReadCloser
-	if zrdr, err = zlib.NewReader(rdr); err != nil {
+	if zrdr, err = getZlibReader(rdr); err != nil {
 		return
 	}
+	defer putZlibReader(zrdr)
 	trdr := tar.NewReader(zrdr)
+	up.Lock()
+	pf := up.pf
+	partial := up.partial
+	up.Unlock()
 	for {
 		if hdr, err = trdr.Next(); err == io.EOF {
 			err = nil
 			break
 		} else if err != nil {
 			break
+		} else if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue //PAX global headers carry no file, the reader applies any records
 		} else if hdr.Typeflag != tar.TypeReg {
 			err = ErrInvalidFileType
 			break
@@ -94,23 +126,53 @@ func (up *Unpacker) Unpack(uph UnpackHandler) (err error) {
 				break
 			}
 			continue
+		} else if hdr.Name == metadataFilename {
+			if err = up.handleMetadata(trdr, uph); err != nil {
+				break
+			}
+			continue
 		}
 
-		var ft Ftype
-		if ft, err = FilenameToType(hdr.Name); err != nil {
-			return
-		} else if err = up.hitType(ft); err != nil {
+		var pth string
+		if ft, ferr := FilenameToType(hdr.Name); ferr == nil {
+			if err = up.hitType(ft); err != nil {
+				return
+			}
+			pth = ft.Filepath(up.id)
+		} else if IsArtifact(hdr.Name) {
+			if err = up.hitArtifact(hdr.Name); err != nil {
+				return
+			}
+			pth = hdr.Name
+		} else {
+			err = ferr
 			return
 		}
 		//copy from the tar file to our context writer wrapped file handle
-		if err = uph.HandleFile(ft.Filepath(up.id), contextio.NewReader(up.ctx, trdr)); err != nil {
+		var frdr io.Reader = contextio.NewReader(up.ctx, trdr)
+		if pf != nil {
+			frdr = progressReader{Reader: frdr, pf: pf}
+		}
+		if sfh, ok := uph.(SizedFileHandler); ok {
+			err = sfh.HandleSizedFile(pth, hdr.Size, frdr)
+		} else {
+			err = uph.HandleFile(pth, frdr)
+		}
+		if err != nil {
 			break
 		}
 	}
+	if err == nil {
+		//consume the rest of the stream so the compression checksum and any
+		//checks performed by the underlying reader at EOF are verified
+		if _, err = io.Copy(ioutil.Discard, zrdr); err == nil {
+			_, err = io.Copy(ioutil.Discard, rdr)
+		}
+	}
 	if up.cf != nil {
 		up.cf()
 	}
-	if err == nil {
+	if err == nil && !partial {
 		err = up.allFilesHit(false) //we are NOT being strict
 	}
 	return
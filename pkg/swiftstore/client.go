@@ -0,0 +1,384 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package swiftstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	listLimit       = 10000          // the most entries Swift returns in one container listing
+	tokenMargin     = time.Minute    // tokens this close to expiring are renewed before use
+	objectStoreType = `object-store` // catalog type of the Swift endpoint
+	authTokenPath   = `/auth/tokens` // appended to the keystone v3 URL
+	errBodyLimit    = 512            // bytes of an error response kept in the error
+	tokenHeader     = `X-Auth-Token` // carries the token on Swift requests
+	subjectHeader   = `X-Subject-Token`
+)
+
+var (
+	ErrAuthFailed    = errors.New("Keystone authentication failed")
+	ErrNoEndpoint    = errors.New("Keystone catalog has no object-store endpoint")
+	ErrRequestFailed = errors.New("Swift request failed")
+)
+
+// client is just enough of a keystone v3 and Swift client for the store, the token and storage
+// URL are fetched on first use and renewed shortly before the token expires
+type client struct {
+	cfg *SwiftStoreConfig
+	hc  *http.Client
+
+	mtx        sync.Mutex
+	token      string
+	storageURL string
+	expires    time.Time
+}
+
+// listEntry is one entry of a JSON container listing, Subdir is set for the directories
+// collapsed by a delimiter
+type listEntry struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	Subdir string `json:"subdir"`
+}
+
+// sloSegment is one entry of a static large object manifest
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+func newClient(cfg *SwiftStoreConfig) *client {
+	return &client{
+		cfg: cfg,
+		hc:  &http.Client{},
+	}
+}
+
+// authenticate returns a current token and the storage URL, fetching a new token if needed
+func (c *client) authenticate(ctx context.Context) (token, storageURL string, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.token != `` && time.Until(c.expires) > tokenMargin {
+		return c.token, c.storageURL, nil
+	}
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Domain   domain `json:"domain"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string `json:"name"`
+					Domain domain `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	req.Auth.Identity.Methods = []string{`password`}
+	req.Auth.Identity.Password.User.Name = c.cfg.Username
+	req.Auth.Identity.Password.User.Domain.Name = c.cfg.UserDomain
+	req.Auth.Identity.Password.User.Password = c.cfg.Password
+	req.Auth.Scope.Project.Name = c.cfg.Project
+	req.Auth.Scope.Project.Domain.Name = c.cfg.ProjectDomain
+	var bts []byte
+	if bts, err = json.Marshal(req); err != nil {
+		return
+	}
+	var hreq *http.Request
+	if hreq, err = http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.cfg.AuthURL, `/`)+authTokenPath, bytes.NewReader(bts)); err != nil {
+		return
+	}
+	hreq.Header.Set(`Content-Type`, `application/json`)
+	var resp *http.Response
+	if resp, err = c.hc.Do(hreq); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: %s", ErrAuthFailed, resp.Status)
+		return
+	} else if token = resp.Header.Get(subjectHeader); token == `` {
+		err = fmt.Errorf("%w: no token returned", ErrAuthFailed)
+		return
+	}
+	var tr tokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		err = fmt.Errorf("%w: %v", ErrAuthFailed, err)
+		return
+	}
+	if storageURL, err = tr.storageURL(c.cfg.Region); err != nil {
+		return
+	}
+	c.token, c.storageURL, c.expires = token, strings.TrimSuffix(storageURL, `/`), tr.Token.ExpiresAt
+	return
+}
+
+// invalidate drops the token so the next request authenticates again
+func (c *client) invalidate(token string) {
+	c.mtx.Lock()
+	if c.token == token {
+		c.token = ``
+	}
+	c.mtx.Unlock()
+}
+
+type domain struct {
+	Name string `json:"name"`
+}
+
+type tokenResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				RegionID  string `json:"region_id"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// storageURL picks the public object-store endpoint, in the region if one is given
+func (tr tokenResponse) storageURL(region string) (string, error) {
+	for _, svc := range tr.Token.Catalog {
+		if svc.Type != objectStoreType {
+			continue
+		}
+		for _, ep := range svc.Endpoints {
+			if ep.Interface != `public` {
+				continue
+			} else if region == `` || ep.Region == region || ep.RegionID == region {
+				return ep.URL, nil
+			}
+		}
+	}
+	return ``, ErrNoEndpoint
+}
+
+// do sends a request for a container, an object within it, or the account if both are empty.
+// A request without a body is retried once with a new token if the token was rejected.
+// The caller closes the response body.
+func (c *client) do(ctx context.Context, method, container, object string, query url.Values, hdr http.Header, body io.Reader, size int64) (resp *http.Response, err error) {
+	for try := 0; try < 2; try++ {
+		var token, storageURL string
+		if token, storageURL, err = c.authenticate(ctx); err != nil {
+			return
+		}
+		u := storageURL
+		if container != `` {
+			u += `/` + url.PathEscape(container)
+			if object != `` {
+				u += `/` + escapeObject(object)
+			}
+		}
+		if len(query) > 0 {
+			u += `?` + query.Encode()
+		}
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, method, u, body); err != nil {
+			return
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		req.Header.Set(tokenHeader, token)
+		if body != nil {
+			req.ContentLength = size //-1 is sent chunked
+		}
+		if resp, err = c.hc.Do(req); err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			return
+		}
+		resp.Body.Close()
+		c.invalidate(token)
+		if body != nil {
+			break //the body has been consumed
+		}
+	}
+	resp = nil
+	err = fmt.Errorf("%w: %s %s: %s", ErrRequestFailed, method, path.Join(container, object), http.StatusText(http.StatusUnauthorized))
+	return
+}
+
+// check turns an unexpected response into an error, 404 is reported as a missing file so the
+// webserver treats it the same as the file backend
+func check(resp *http.Response, method, container, object string, ok ...int) error {
+	for _, s := range ok {
+		if resp.StatusCode == s {
+			return nil
+		}
+	}
+	pth := path.Join(container, object)
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: strings.ToLower(method), Path: pth, Err: os.ErrNotExist}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, errBodyLimit))
+	return fmt.Errorf("%w: %s %s: %s %s", ErrRequestFailed, method, pth, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// request sends a request and discards the response body, failing on any status not listed
+func (c *client) request(ctx context.Context, method, container, object string, query url.Values, hdr http.Header, body io.Reader, size int64, ok ...int) (h http.Header, err error) {
+	var resp *http.Response
+	if resp, err = c.do(ctx, method, container, object, query, hdr, body, size); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = check(resp, method, container, object, ok...); err == nil {
+		h = resp.Header
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return
+}
+
+// headAccount ensures the account is reachable with our credentials
+func (c *client) headAccount(ctx context.Context) (err error) {
+	_, err = c.request(ctx, http.MethodHead, ``, ``, nil, nil, nil, 0, http.StatusOK, http.StatusNoContent)
+	return
+}
+
+// putContainer creates a container, it is not an error if it already exists
+func (c *client) putContainer(ctx context.Context, container string) (err error) {
+	_, err = c.request(ctx, http.MethodPut, container, ``, nil, nil, nil, 0, http.StatusCreated, http.StatusAccepted, http.StatusNoContent)
+	return
+}
+
+// containerBytes returns the number of bytes stored in a container
+func (c *client) containerBytes(ctx context.Context, container string) (sz uint64, err error) {
+	var h http.Header
+	if h, err = c.request(ctx, http.MethodHead, container, ``, nil, nil, nil, 0, http.StatusOK, http.StatusNoContent); err != nil {
+		return
+	}
+	if v := h.Get(`X-Container-Bytes-Used`); v != `` {
+		sz, err = strconv.ParseUint(v, 10, 64)
+	}
+	return
+}
+
+// list returns the entries of a container listing below prefix, entries after the delimiter
+// are collapsed into subdirectories if one is given
+func (c *client) list(ctx context.Context, container, prefix, delim string, fn func(listEntry) error) (err error) {
+	var marker string
+	for {
+		q := url.Values{}
+		q.Set(`format`, `json`)
+		q.Set(`limit`, strconv.Itoa(listLimit))
+		q.Set(`prefix`, prefix)
+		if delim != `` {
+			q.Set(`delimiter`, delim)
+		}
+		if marker != `` {
+			q.Set(`marker`, marker)
+		}
+		var resp *http.Response
+		if resp, err = c.do(ctx, http.MethodGet, container, ``, q, nil, nil, 0); err != nil {
+			return
+		}
+		var ents []listEntry
+		if err = check(resp, http.MethodGet, container, ``, http.StatusOK, http.StatusNoContent); err == nil && resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&ents)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		for _, ent := range ents {
+			if err = fn(ent); err != nil {
+				return
+			}
+		}
+		if len(ents) < listLimit {
+			return
+		}
+		if marker = ents[len(ents)-1].Name; marker == `` {
+			marker = ents[len(ents)-1].Subdir
+		}
+	}
+}
+
+// putObject stores an object, size is -1 if unknown.  The MD5 Swift computed is returned.
+func (c *client) putObject(ctx context.Context, container, object string, rdr io.Reader, size int64) (etag string, err error) {
+	hdr := http.Header{}
+	hdr.Set(`Content-Type`, `application/octet-stream`)
+	var h http.Header
+	if h, err = c.request(ctx, http.MethodPut, container, object, nil, hdr, rdr, size, http.StatusCreated); err == nil {
+		etag = strings.Trim(h.Get(`Etag`), `"`)
+	}
+	return
+}
+
+// putManifest stores a static large object made up of the segments
+func (c *client) putManifest(ctx context.Context, container, object string, segs []sloSegment) (err error) {
+	var bts []byte
+	if bts, err = json.Marshal(segs); err != nil {
+		return
+	}
+	q := url.Values{}
+	q.Set(`multipart-manifest`, `put`)
+	_, err = c.request(ctx, http.MethodPut, container, object, q, nil, bytes.NewReader(bts), int64(len(bts)), http.StatusCreated)
+	return
+}
+
+// getObject opens an object, the caller closes the body
+func (c *client) getObject(ctx context.Context, container, object string) (body io.ReadCloser, size int64, err error) {
+	var resp *http.Response
+	if resp, err = c.do(ctx, http.MethodGet, container, object, nil, nil, nil, 0); err != nil {
+		return
+	}
+	if err = check(resp, http.MethodGet, container, object, http.StatusOK); err != nil {
+		resp.Body.Close()
+		return
+	}
+	body, size = resp.Body, resp.ContentLength
+	return
+}
+
+// deleteObject removes an object, the segments of a large object are removed with it
+func (c *client) deleteObject(ctx context.Context, container, object string) (err error) {
+	q := url.Values{}
+	q.Set(`multipart-manifest`, `delete`)
+	_, err = c.request(ctx, http.MethodDelete, container, object, q, nil, nil, 0, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	return
+}
+
+// escapeObject escapes each element of an object name, leaving the slashes between them
+func escapeObject(name string) string {
+	parts := strings.Split(name, `/`)
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, `/`)
+}
@@ -0,0 +1,672 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package swiftstore is a shard storage backend for OpenStack Swift, authenticating with
+// keystone v3.  Each customer's shards are kept in their own container named
+// <prefix><customer>, and every file of every shard is stored as an object named:
+//
+//	<indexer>/<well>/<shard>/<file>
+//
+// Files larger than the segment size are stored as static large objects whose segments are
+// kept in a <prefix><customer>_segments container.  Each indexer's tags.dat is stored alongside
+// its wells and a local copy is kept for merging tag updates.
+package swiftstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dolmen-go/contextio"
+	"github.com/gravwell/cloudarchive/pkg/safepath"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultSegmentSize     = 1024 * 1024 * 1024
+	MinSegmentSize         = 1024 * 1024
+	MaxSegmentSize         = 5 * 1024 * 1024 * 1024 // the largest object Swift accepts by default
+	DefaultDomain          = `Default`
+	DefaultContainerPrefix = `cloudarchive-`
+
+	segmentSuffix = `_segments`
+)
+
+var (
+	ErrMissingAuthURL  = errors.New("Missing keystone auth URL")
+	ErrMissingUsername = errors.New("Missing Swift username")
+	ErrMissingProject  = errors.New("Missing Swift project")
+	ErrMissingStore    = errors.New("Missing local storage directory")
+	ErrBadSegmentSize  = errors.New("Swift segment size must be between 1MB and 5GB")
+)
+
+type swiftstore struct {
+	cfg SwiftStoreConfig
+	util.UploadTracker
+	clnt   *client
+	tagMtx sync.Mutex // held while fetching or pushing a tags.dat
+
+	ctrMtx     sync.Mutex
+	containers map[string]bool // containers known to exist
+}
+
+type SwiftStoreConfig struct {
+	AuthURL       string // keystone v3 endpoint, such as https://keystone.example.com:5000/v3
+	Username      string
+	Password      string
+	UserDomain    string // DefaultDomain if empty
+	Project       string // project the containers belong to
+	ProjectDomain string // DefaultDomain if empty
+	Region        string // region of the object-store endpoint, the first public endpoint if empty
+	// Each customer's container is named with this prefix and the customer number,
+	// DefaultContainerPrefix if empty
+	ContainerPrefix string
+	LocalStore      string // path where we keep local copies of each tags.dat
+	Lgr             *log.Logger
+
+	// Shard files larger than SegmentSize are stored as static large objects made up of
+	// SegmentSize segments.  Zero selects DefaultSegmentSize.
+	SegmentSize uint64
+}
+
+func NewSwiftStoreHandler(cfg SwiftStoreConfig) (*swiftstore, error) {
+	if cfg.AuthURL == `` {
+		return nil, ErrMissingAuthURL
+	} else if cfg.Username == `` {
+		return nil, ErrMissingUsername
+	} else if cfg.Project == `` {
+		return nil, ErrMissingProject
+	} else if cfg.LocalStore == `` {
+		return nil, ErrMissingStore
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	if cfg.UserDomain == `` {
+		cfg.UserDomain = DefaultDomain
+	}
+	if cfg.ProjectDomain == `` {
+		cfg.ProjectDomain = DefaultDomain
+	}
+	if cfg.ContainerPrefix == `` {
+		cfg.ContainerPrefix = DefaultContainerPrefix
+	}
+	if cfg.SegmentSize == 0 {
+		cfg.SegmentSize = DefaultSegmentSize
+	} else if cfg.SegmentSize < MinSegmentSize || cfg.SegmentSize > MaxSegmentSize {
+		return nil, ErrBadSegmentSize
+	}
+	s := &swiftstore{
+		cfg:           cfg,
+		UploadTracker: util.NewUploadTracker(),
+		containers:    map[string]bool{},
+	}
+	//the client keeps a pointer so it sees the defaults filled in above
+	s.clnt = newClient(&s.cfg)
+	return s, nil
+}
+
+// Preflight ensures keystone and Swift are reachable and our credentials are accepted
+func (s *swiftstore) Preflight(ctx context.Context) error {
+	return s.clnt.headAccount(ctx)
+}
+
+// container returns the name of a customer's container
+func (s *swiftstore) container(cid uint64) string {
+	return s.cfg.ContainerPrefix + strconv.FormatUint(cid, 10)
+}
+
+// segmentContainer returns the name of the container holding a customer's large object segments
+func (s *swiftstore) segmentContainer(cid uint64) string {
+	return s.container(cid) + segmentSuffix
+}
+
+// ensureContainer creates a container the first time it is written to
+func (s *swiftstore) ensureContainer(ctx context.Context, name string) (err error) {
+	s.ctrMtx.Lock()
+	defer s.ctrMtx.Unlock()
+	if s.containers[name] {
+		return
+	}
+	if err = s.clnt.putContainer(ctx, name); err == nil {
+		s.containers[name] = true
+	}
+	return
+}
+
+// localIndexerDir is where the local copy of an indexer's tags.dat lives
+func (s *swiftstore) localIndexerDir(cid uint64, guid uuid.UUID) string {
+	return filepath.Join(s.cfg.LocalStore, strconv.FormatUint(cid, 10), guid.String())
+}
+
+// listDir lists the directories and objects immediately below a directory in a container
+func (s *swiftstore) listDir(ctx context.Context, container, dir string) (dirs []string, objs []listEntry, err error) {
+	prefix := ``
+	if dir != `` {
+		prefix = dir + `/`
+	}
+	err = s.clnt.list(ctx, container, prefix, `/`, func(ent listEntry) error {
+		if ent.Subdir != `` {
+			dirs = append(dirs, path.Base(ent.Subdir))
+		} else {
+			objs = append(objs, ent)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		s.cfg.Lgr.Error("Failed to list objects", log.KV("container", container), log.KV("prefix", prefix), log.KVErr(err))
+	}
+	return
+}
+
+// walk calls fn with every object below a directory in a container
+func (s *swiftstore) walk(ctx context.Context, container, dir string, fn func(listEntry) error) error {
+	return s.clnt.list(ctx, container, dir+`/`, ``, fn)
+}
+
+// dirExists reports whether any object is stored below a directory
+func (s *swiftstore) dirExists(ctx context.Context, container, dir string) (exists bool, err error) {
+	errFound := errors.New(`found`)
+	if err = s.walk(ctx, container, dir, func(listEntry) error { return errFound }); err == errFound {
+		exists = true
+		err = nil
+	} else if os.IsNotExist(err) {
+		err = nil //the container has not been created yet
+	}
+	return
+}
+
+// removeDir removes every object below a directory, along with the segments of large objects
+func (s *swiftstore) removeDir(ctx context.Context, container, dir string) (err error) {
+	var names []string
+	if err = s.walk(ctx, container, dir, func(ent listEntry) error {
+		names = append(names, ent.Name)
+		return nil
+	}); err != nil {
+		return
+	}
+	for _, name := range names {
+		if rerr := s.clnt.deleteObject(ctx, container, name); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return
+}
+
+func (s *swiftstore) ListIndexes(ctx context.Context, cid uint64) (indexes []string, err error) {
+	var dirs []string
+	if dirs, _, err = s.listDir(ctx, s.container(cid), ``); err != nil {
+		return
+	}
+	for _, name := range dirs {
+		if _, err := uuid.Parse(name); err == nil {
+			indexes = append(indexes, name)
+		}
+	}
+	return
+}
+
+func (s *swiftstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) (wells []string, err error) {
+	wells, _, err = s.listDir(ctx, s.container(cid), guid.String())
+	return
+}
+
+func (s *swiftstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	var shards []string
+	if shards, _, err = s.listDir(ctx, s.container(cid), path.Join(guid.String(), well)); err != nil {
+		return
+	}
+	for _, name := range shards {
+		st, e, err := util.ShardNameToDateRange(name)
+		if err != nil {
+			continue
+		}
+		if t.Start.IsZero() || st.Before(t.Start) {
+			t.Start = st
+		}
+		if t.End.IsZero() || e.After(t.End) {
+			t.End = e
+		}
+	}
+	return
+}
+
+func (s *swiftstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+	var names []string
+	if names, _, err = s.listDir(ctx, s.container(cid), path.Join(guid.String(), well)); err != nil {
+		return
+	}
+	for _, name := range names {
+		if ok, err := tf.ShardOverlaps(name); err == nil && ok {
+			shards = append(shards, name)
+		}
+	}
+	return
+}
+
+// CustomerUsage returns the bytes Swift reports for the customer's containers
+func (s *swiftstore) CustomerUsage(ctx context.Context, cid uint64) (sz uint64, err error) {
+	for _, name := range []string{s.container(cid), s.segmentContainer(cid)} {
+		var n uint64
+		if n, err = s.clnt.containerBytes(ctx, name); err != nil {
+			if !os.IsNotExist(err) {
+				return
+			}
+			err = nil //nothing has been stored yet
+		}
+		sz += n
+	}
+	return
+}
+
+func (s *swiftstore) UnpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return s.unpackShard(ctx, cid, idxUUID, well, shard, rdr, s.EnterUpload)
+}
+
+// UnpackShardWait is UnpackShard, but an upload of the same shard which is already in
+// progress is waited on for up to wait rather than immediately failing
+func (s *swiftstore) UnpackShardWait(ctx context.Context, wait time.Duration, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader) error {
+	return s.unpackShard(ctx, cid, idxUUID, well, shard, rdr, func(uid util.UploadID) error {
+		return s.EnterUploadWait(ctx, uid, wait)
+	})
+}
+
+func (s *swiftstore) unpackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, rdr io.Reader, enter func(util.UploadID) error) (err error) {
+	var up *shardpacker.Unpacker
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	if err = enter(uid); err != nil {
+		s.cfg.Lgr.Error("Failed to enter upload", log.KVErr(err))
+		return
+	}
+	rdr = s.CountReader(uid, rdr)
+
+	container := s.container(cid)
+	if err = s.ensureContainer(ctx, container); err != nil {
+		s.ExitUpload(uid)
+		return
+	}
+	shardKey := path.Join(idxUUID.String(), well, shard)
+	base := shardKey
+	// As with the FTP backend a shard which already exists gets a .N suffix, up to some
+	// arbitrary big number in case an indexer is somehow misconfigured.
+	for i := 1; i < 10000; i++ {
+		var exists bool
+		if exists, err = s.dirExists(ctx, container, shardKey); err != nil {
+			s.ExitUpload(uid)
+			return
+		} else if !exists {
+			break
+		}
+		shardKey = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	h := handler{
+		ctx:       ctx,
+		store:     s,
+		cid:       cid,
+		guid:      idxUUID,
+		container: container,
+		skey:      shardKey,
+	}
+	if up, err = shardpacker.NewUnpacker(shard, rdr); err != nil {
+		s.ExitUpload(uid)
+		s.cfg.Lgr.Error("Failed to create new shard unpacker",
+			log.KV("client-id", cid),
+			log.KV("uuid", idxUUID),
+			log.KV("shard", shardKey),
+			log.KVErr(err))
+		return
+	}
+	if err = up.Unpack(h); err != nil {
+		//the request context may be what failed, so clean up without it
+		if rerr := s.removeDir(context.Background(), container, shardKey); rerr != nil {
+			s.cfg.Lgr.Error("Failed to remove partial shard", log.KV("shard", shardKey), log.KVErr(rerr))
+		}
+		s.ExitUpload(uid)
+		s.cfg.Lgr.Error("Failed to unpack shard",
+			log.KV("client-id", cid),
+			log.KV("uuid", idxUUID),
+			log.KV("shard", shardKey),
+			log.KVErr(err))
+		return
+	}
+
+	//release the shard
+	err = s.ExitUpload(uid)
+	return
+}
+
+// PackShard streams each of a shard's objects straight into the packer, nothing is
+// staged locally
+func (s *swiftstore) PackShard(ctx context.Context, cid uint64, idxUUID uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	uid := util.UploadID{
+		CID:     cid,
+		IdxUUID: idxUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	container := s.container(cid)
+	shardKey := path.Join(idxUUID.String(), well, shard)
+	var objs []listEntry
+	if err = s.walk(ctx, container, shardKey, func(ent listEntry) error {
+		objs = append(objs, ent)
+		return nil
+	}); err != nil {
+		return
+	} else if len(objs) == 0 {
+		err = &os.PathError{Op: `open`, Path: path.Join(container, shardKey), Err: os.ErrNotExist}
+		return
+	}
+
+	if err = s.EnterUpload(uid); err != nil {
+		return
+	}
+	wtr = contextio.NewWriter(ctx, s.CountWriter(uid, wtr))
+	p := shardpacker.NewPacker(shard)
+
+	addErr := make(chan error, 1)
+	go func() {
+		err := s.addObjects(ctx, container, shardKey, shard, objs, p)
+		if err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Flush(); err != nil {
+			p.CloseWithError(err)
+		} else if err = p.Close(); err != nil {
+			p.CloseWithError(err)
+		}
+		addErr <- err
+	}()
+	if _, err = io.Copy(wtr, p); err != nil {
+		p.CloseWithError(err) //stop the adder and wait for it
+		<-addErr
+	} else {
+		err = <-addErr
+	}
+
+	//release the shard, setting error appropriately
+	if err == nil {
+		err = s.ExitUpload(uid)
+	} else {
+		s.ExitUpload(uid)
+	}
+	return
+}
+
+// addObjects adds every shard file object to the packer, other objects such as the shard
+// metadata are not part of a pull
+func (s *swiftstore) addObjects(ctx context.Context, container, shardKey, shard string, objs []listEntry, p *shardpacker.Packer) (err error) {
+	for _, ent := range objs {
+		name := strings.TrimPrefix(ent.Name, shardKey+`/`)
+		var ft shardpacker.Ftype
+		if !shardpacker.IsArtifact(name) {
+			if ft, err = util.PackedFileType(shard, name); err != nil {
+				err = nil
+				continue
+			}
+		}
+		var body io.ReadCloser
+		var sz int64
+		if body, sz, err = s.clnt.getObject(ctx, container, ent.Name); err != nil {
+			return
+		} else if sz < 0 {
+			sz = ent.Bytes
+		}
+		if shardpacker.IsArtifact(name) {
+			err = p.AddArtifact(name, sz, body)
+		} else {
+			err = p.AddFile(ft, sz, body)
+		}
+		body.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *swiftstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) (tgs []tags.TagPair, err error) {
+	if err = s.ensureTagsDat(ctx, cid, guid); err != nil {
+		return
+	}
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, s.localIndexerDir(cid, guid)); err != nil {
+		s.cfg.Lgr.Error("Failed enumerate tags", log.KVErr(err))
+		return
+	}
+	tgs, err = tm.TagSet()
+	if err == nil {
+		err = tags.ReleaseTagMan(cid, guid) //set the error on release
+	} else {
+		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
+	}
+	return
+}
+
+func (s *swiftstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	var updated bool
+	if updated, err = s.mergeTags(ctx, cid, guid, idxTags); err != nil {
+		return
+	}
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, s.localIndexerDir(cid, guid)); err != nil {
+		return
+	}
+	tgs, err = tm.TagSet()
+	if err == nil {
+		err = tags.ReleaseTagMan(cid, guid) //set the error on release
+	} else {
+		tags.ReleaseTagMan(cid, guid) //we are in an error state, so just release
+	}
+	if err == nil && updated {
+		err = s.pushTags(ctx, cid, guid)
+	}
+	return
+}
+
+// mergeTags merges tags into the local copy of an indexer's tags.dat
+func (s *swiftstore) mergeTags(ctx context.Context, cid uint64, guid uuid.UUID, tgs []tags.TagPair) (updated bool, err error) {
+	if err = s.ensureTagsDat(ctx, cid, guid); err != nil {
+		return
+	}
+	var tm tags.TagManager
+	if tm, err = tags.GetTagMan(cid, guid, s.localIndexerDir(cid, guid)); err != nil {
+		s.cfg.Lgr.Error("Failed enumerate tags", log.KVErr(err))
+		return
+	}
+	if updated, err = tm.Merge(tgs); err != nil {
+		tags.ReleaseTagMan(cid, guid)
+		s.cfg.Lgr.Error("Failed merge tags", log.KVErr(err))
+		return
+	}
+	err = tags.ReleaseTagMan(cid, guid)
+	return
+}
+
+// ensureTagsDat fetches an indexer's tags.dat from Swift if there is no local copy
+func (s *swiftstore) ensureTagsDat(ctx context.Context, cid uint64, guid uuid.UUID) (err error) {
+	s.tagMtx.Lock()
+	defer s.tagMtx.Unlock()
+	tagpath := tags.GetTagDatPath(s.localIndexerDir(cid, guid))
+	if _, err = os.Stat(tagpath); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(tagpath), 0770); err != nil {
+		return
+	}
+	var body io.ReadCloser
+	if body, _, err = s.clnt.getObject(ctx, s.container(cid), s.tagsKey(guid)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil //no tags yet, the tag manager creates an empty tags.dat
+		}
+		return
+	}
+	defer body.Close()
+	//fetch into a temporary file so a failed fetch never leaves a partial local copy
+	var fout *os.File
+	if fout, err = os.CreateTemp(filepath.Dir(tagpath), `tags-*.tmp`); err != nil {
+		return
+	}
+	defer os.Remove(fout.Name())
+	if _, err = io.Copy(fout, body); err != nil {
+		fout.Close()
+		return
+	} else if err = fout.Close(); err != nil {
+		return
+	}
+	err = os.Rename(fout.Name(), tagpath)
+	return
+}
+
+// pushTags uploads the local copy of an indexer's tags.dat
+func (s *swiftstore) pushTags(ctx context.Context, cid uint64, guid uuid.UUID) (err error) {
+	s.tagMtx.Lock()
+	defer s.tagMtx.Unlock()
+	var bts []byte
+	if bts, err = os.ReadFile(tags.GetTagDatPath(s.localIndexerDir(cid, guid))); err != nil {
+		return
+	}
+	if err = s.ensureContainer(ctx, s.container(cid)); err == nil {
+		_, err = s.clnt.putObject(ctx, s.container(cid), s.tagsKey(guid), bytes.NewReader(bts), int64(len(bts)))
+	}
+	if err != nil {
+		s.cfg.Lgr.Error("Failed to push tags.dat", log.KV("client-id", cid), log.KV("uuid", guid), log.KVErr(err))
+	}
+	return
+}
+
+func (s *swiftstore) tagsKey(guid uuid.UUID) string {
+	return path.Join(guid.String(), tags.TAG_MANAGER_FILENAME)
+}
+
+// BackupTags copies the local copy of every indexer's tags.dat into dir, the local
+// copies are the ones updated by tag syncs before being pushed to Swift
+func (s *swiftstore) BackupTags(ctx context.Context, dir string) (err error) {
+	_, err = tags.BackupTagDats(ctx, s.cfg.LocalStore, dir)
+	return
+}
+
+type handler struct {
+	ctx       context.Context
+	store     *swiftstore
+	cid       uint64    //customer number
+	guid      uuid.UUID //indexer GUID
+	container string    //customer container
+	skey      string    //shard directory
+}
+
+func (h handler) HandleFile(pth string, rdr io.Reader) error {
+	return h.HandleSizedFile(pth, -1, rdr)
+}
+
+// HandleSizedFile stores a shard file, files larger than the segment size or of unknown size are
+// sent as a static large object whose segments are removed if the stream fails part way
+func (h handler) HandleSizedFile(pth string, sz int64, rdr io.Reader) error {
+	//the path comes off the wire, make sure it stays inside the shard directory
+	pth, err := safepath.Sanitize(pth)
+	if err != nil {
+		return err
+	}
+	key := path.Join(h.skey, filepath.ToSlash(pth))
+	if sz >= 0 && uint64(sz) <= h.store.cfg.SegmentSize {
+		_, err = h.store.clnt.putObject(h.ctx, h.container, key, rdr, sz)
+		return err
+	}
+	return h.putLargeObject(key, rdr)
+}
+
+// putLargeObject sends the stream as segments and then stores the manifest joining them
+func (h handler) putLargeObject(key string, rdr io.Reader) (err error) {
+	clnt := h.store.clnt
+	segContainer := h.store.segmentContainer(h.cid)
+	if err = h.store.ensureContainer(h.ctx, segContainer); err != nil {
+		return
+	}
+	//segments of each upload are kept apart so a failed upload never touches a stored object
+	segBase := path.Join(key, uuid.New().String())
+	var segs []sloSegment
+	defer func() {
+		if err != nil {
+			for _, seg := range segs {
+				clnt.deleteObject(context.Background(), segContainer, strings.TrimPrefix(seg.Path, `/`+segContainer+`/`))
+			}
+		}
+	}()
+	brdr := bufio.NewReader(rdr)
+	for i := 0; ; i++ {
+		//a stream which ends on a segment boundary would otherwise leave an empty segment
+		if _, err = brdr.Peek(1); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		name := path.Join(segBase, fmt.Sprintf("%08d", i))
+		hsh := md5.New()
+		lr := &io.LimitedReader{R: brdr, N: int64(h.store.cfg.SegmentSize)}
+		var etag string
+		if etag, err = clnt.putObject(h.ctx, segContainer, name, io.TeeReader(lr, hsh), -1); err != nil {
+			return
+		}
+		seg := sloSegment{
+			Path:      `/` + segContainer + `/` + name,
+			Etag:      hex.EncodeToString(hsh.Sum(nil)),
+			SizeBytes: int64(h.store.cfg.SegmentSize) - lr.N,
+		}
+		segs = append(segs, seg)
+		if etag != `` && etag != seg.Etag {
+			err = fmt.Errorf("%w: segment %s was corrupted in transit", ErrRequestFailed, name)
+			return
+		}
+	}
+	if len(segs) == 0 {
+		//an empty file of unknown size
+		_, err = clnt.putObject(h.ctx, h.container, key, bytes.NewReader(nil), 0)
+		return
+	}
+	err = clnt.putManifest(h.ctx, h.container, key, segs)
+	return
+}
+
+func (h handler) HandleTagUpdate(tgs []tags.TagPair) error {
+	if _, err := h.store.mergeTags(h.ctx, h.cid, h.guid, tgs); err != nil {
+		return err
+	}
+	return h.store.pushTags(h.ctx, h.cid, h.guid)
+}
+
+// HandleMetadata stores the shard metadata alongside the shard files
+func (h handler) HandleMetadata(md shardpacker.ShardMetadata) error {
+	bts, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return h.HandleSizedFile(shardpacker.Metadata.Filepath(md.Shard), int64(len(bts)), bytes.NewReader(bts))
+}
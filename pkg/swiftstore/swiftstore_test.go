@@ -0,0 +1,462 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package swiftstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var _ webserver.ShardHandler = &swiftstore{}
+
+const (
+	testAccount  = `/v1/AUTH_test`
+	testPassword = `secret`
+)
+
+func newTestStore(t *testing.T) (*swiftstore, *fakeSwift) {
+	fk := newFakeSwift()
+	srv := httptest.NewServer(fk)
+	t.Cleanup(srv.Close)
+	fk.url = srv.URL
+	s, err := NewSwiftStoreHandler(SwiftStoreConfig{
+		AuthURL:    srv.URL + `/v3/`,
+		Username:   `archive`,
+		Password:   testPassword,
+		Project:    `storage`,
+		Region:     `RegionOne`,
+		LocalStore: t.TempDir(),
+		Lgr:        log.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.SegmentSize = MinSegmentSize
+	return s, fk
+}
+
+func TestNewSwiftStoreConfig(t *testing.T) {
+	bad := []SwiftStoreConfig{
+		{Username: `u`, Project: `p`, LocalStore: `/tmp`},
+		{AuthURL: `http://localhost:5000/v3`, Project: `p`, LocalStore: `/tmp`},
+		{AuthURL: `http://localhost:5000/v3`, Username: `u`, LocalStore: `/tmp`},
+		{AuthURL: `http://localhost:5000/v3`, Username: `u`, Project: `p`},
+		{AuthURL: `http://localhost:5000/v3`, Username: `u`, Project: `p`, LocalStore: `/tmp`, SegmentSize: 1024},
+	}
+	for _, c := range bad {
+		if _, err := NewSwiftStoreHandler(c); err == nil {
+			t.Fatalf("bad config accepted %+v", c)
+		}
+	}
+	s, err := NewSwiftStoreHandler(SwiftStoreConfig{AuthURL: `http://localhost:5000/v3`, Username: `u`, Project: `p`, LocalStore: `/tmp`})
+	if err != nil {
+		t.Fatal(err)
+	} else if s.cfg.SegmentSize != DefaultSegmentSize || s.cfg.UserDomain != DefaultDomain || s.cfg.ProjectDomain != DefaultDomain {
+		t.Fatalf("bad defaults %+v", s.cfg)
+	} else if c := s.segmentContainer(7); c != `cloudarchive-7_segments` {
+		t.Fatalf("bad segment container %q", c)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	s, fk := newTestStore(t)
+	ctx := context.Background()
+	guid := uuid.New()
+	tgs := []tags.TagPair{{Name: `default`, Value: 0}, {Name: `syslog`, Value: 1}}
+
+	if err := s.Preflight(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//the store file is larger than the segment size so it is stored as a large object
+	files := map[string][]byte{
+		`.index`: []byte(`index`),
+		`.store`: randBytes(2*MinSegmentSize + 1024),
+	}
+	sdir := storetest.WriteShard(t, `76a00`, files)
+	if err := s.UnpackShard(ctx, 1, guid, `default`, `76a00`, storetest.Pack(sdir, `76a00`, tgs)); err != nil {
+		t.Fatal(err)
+	} else if n := fk.count(`cloudarchive-1_segments`); n != 3 {
+		t.Fatalf("store file was sent in %d segments", n)
+	}
+	//pushing the same shard again keeps both copies
+	if err := s.UnpackShard(ctx, 1, guid, `default`, `76a00`, storetest.Pack(sdir, `76a00`, tgs)); err != nil {
+		t.Fatal(err)
+	}
+
+	if idxs, err := s.ListIndexes(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if len(idxs) != 1 || idxs[0] != guid.String() {
+		t.Fatalf("bad indexes %v", idxs)
+	}
+	if wells, err := s.ListIndexerWells(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else if len(wells) != 1 || wells[0] != `default` {
+		t.Fatalf("bad wells %v", wells)
+	}
+	st, e, _ := util.ShardNameToDateRange(`76a00`)
+	if tf, err := s.GetWellTimeframe(ctx, 1, guid, `default`); err != nil {
+		t.Fatal(err)
+	} else if !tf.Start.Equal(st) || !tf.End.Equal(e) {
+		t.Fatalf("bad timeframe %v", tf)
+	}
+	if shards, err := s.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: st, End: e}); err != nil {
+		t.Fatal(err)
+	} else if sort.Strings(shards); len(shards) != 2 || shards[0] != `76a00` || shards[1] != `76a00.1` {
+		t.Fatalf("bad shards %v", shards)
+	}
+
+	//a fresh store has no local tags.dat so it must fetch the pushed one
+	s2, err := NewSwiftStoreHandler(SwiftStoreConfig{
+		AuthURL:    s.cfg.AuthURL,
+		Username:   s.cfg.Username,
+		Password:   s.cfg.Password,
+		Project:    s.cfg.Project,
+		LocalStore: t.TempDir(),
+		Lgr:        log.NewDiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s2.GetTags(ctx, 1, guid); err != nil {
+		t.Fatal(err)
+	} else {
+		have := map[string]bool{}
+		for _, tp := range got {
+			have[tp.Name] = true
+		}
+		for _, tp := range tgs {
+			if !have[tp.Name] {
+				t.Fatalf("tag %s missing from %v", tp.Name, got)
+			}
+		}
+	}
+	if sz, err := s.CustomerUsage(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if sz < 2*uint64(len(files[`.store`])) {
+		t.Fatalf("bad usage %d", sz)
+	} else if sz, err = s.CustomerUsage(ctx, 2); err != nil || sz != 0 {
+		t.Fatalf("bad usage for a new customer %d %v", sz, err)
+	}
+
+	//pull it back and make sure we get the same files
+	got, err := storetest.Pull(s, 1, guid, `default`, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(files) {
+		t.Fatalf("pulled %d files, expected %d", len(got), len(files))
+	}
+	for ext, v := range files {
+		if !bytes.Equal(got[`76a00`+ext], v) {
+			t.Fatalf("pulled %s does not match", ext)
+		}
+	}
+	if err = s.PackShard(ctx, 1, guid, `default`, `76a01`, ioutil.Discard); !os.IsNotExist(err) {
+		t.Fatalf("pulled a missing shard: %v", err)
+	} else if _, err = s.ListIndexes(ctx, 2); !os.IsNotExist(err) {
+		t.Fatalf("listed a missing customer: %v", err)
+	}
+}
+
+func TestFailedPush(t *testing.T) {
+	s, fk := newTestStore(t)
+	guid := uuid.New()
+	sdir := storetest.WriteShard(t, `76a00`, map[string][]byte{
+		`.index`: []byte(`index`),
+		`.store`: randBytes(2*MinSegmentSize + 1024),
+	})
+	bb := bytes.NewBuffer(nil)
+	if _, err := io.Copy(bb, storetest.Pack(sdir, `76a00`, nil)); err != nil {
+		t.Fatal(err)
+	}
+	//cut the stream off part way through the store file
+	if err := s.UnpackShard(context.Background(), 1, guid, `default`, `76a00`, bytes.NewReader(bb.Bytes()[:bb.Len()/2])); err == nil {
+		t.Fatal("truncated shard accepted")
+	}
+	if n := fk.count(`cloudarchive-1`); n != 0 {
+		t.Fatalf("%d objects of a partial shard left behind", n)
+	} else if n = fk.count(`cloudarchive-1_segments`); n != 0 {
+		t.Fatalf("%d segments left behind", n)
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	s, fk := newTestStore(t)
+	ctx := context.Background()
+	if err := s.Preflight(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//a revoked token is replaced and the request retried
+	fk.revoke()
+	if err := s.Preflight(ctx); err != nil {
+		t.Fatal(err)
+	} else if n := fk.authCount(); n != 2 {
+		t.Fatalf("authenticated %d times", n)
+	}
+
+	s.cfg.Password = `wrong`
+	fk.revoke()
+	if err := s.Preflight(ctx); err == nil {
+		t.Fatal("bad credentials accepted")
+	}
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+type fakeObject struct {
+	data []byte
+	segs []string // /container/object of each segment if this is a large object manifest
+}
+
+// fakeSwift is just enough of keystone v3 and the Swift API for the store to run against
+type fakeSwift struct {
+	sync.Mutex
+	url        string
+	tokens     map[string]bool
+	auths      int
+	containers map[string]map[string]*fakeObject
+}
+
+func newFakeSwift() *fakeSwift {
+	return &fakeSwift{
+		tokens:     map[string]bool{},
+		containers: map[string]map[string]*fakeObject{},
+	}
+}
+
+func (fk *fakeSwift) revoke() {
+	fk.Lock()
+	fk.tokens = map[string]bool{}
+	fk.Unlock()
+}
+
+func (fk *fakeSwift) authCount() int {
+	fk.Lock()
+	defer fk.Unlock()
+	return fk.auths
+}
+
+// count returns how many objects are in a container, other than tags.dat
+func (fk *fakeSwift) count(container string) (n int) {
+	fk.Lock()
+	defer fk.Unlock()
+	for name := range fk.containers[container] {
+		if !strings.HasSuffix(name, `/tags.dat`) {
+			n++
+		}
+	}
+	return
+}
+
+func (fk *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fk.Lock()
+	defer fk.Unlock()
+	if r.URL.Path == `/v3/auth/tokens` && r.Method == http.MethodPost {
+		fk.auth(w, r)
+		return
+	} else if !fk.tokens[r.Header.Get(`X-Auth-Token`)] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !strings.HasPrefix(r.URL.Path, testAccount) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	container, object, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, testAccount), `/`), `/`)
+	q := r.URL.Query()
+	if container == `` {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+	objs, ok := fk.containers[container]
+	if object == `` {
+		switch {
+		case r.Method == http.MethodPut:
+			if !ok {
+				fk.containers[container] = map[string]*fakeObject{}
+				w.WriteHeader(http.StatusCreated)
+			} else {
+				w.WriteHeader(http.StatusAccepted)
+			}
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodHead:
+			var sz int
+			for _, o := range objs {
+				sz += len(o.data)
+			}
+			w.Header().Set(`X-Container-Bytes-Used`, strconv.Itoa(sz))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet:
+			fk.list(w, objs, q)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		bts, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		obj := &fakeObject{data: bts}
+		if q.Get(`multipart-manifest`) == `put` {
+			var segs []sloSegment
+			if err = json.Unmarshal(bts, &segs); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			obj.data = nil
+			for _, seg := range segs {
+				c, o, _ := strings.Cut(strings.TrimPrefix(seg.Path, `/`), `/`)
+				so, ok := fk.containers[c][o]
+				if !ok || etag(so.data) != seg.Etag || int64(len(so.data)) != seg.SizeBytes {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				obj.data = append(obj.data, so.data...)
+				obj.segs = append(obj.segs, seg.Path)
+			}
+		}
+		objs[object] = obj
+		w.Header().Set(`Etag`, etag(bts))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		obj, ok := objs[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(obj.data)))
+		w.Write(obj.data)
+	case http.MethodDelete:
+		obj, ok := objs[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if q.Get(`multipart-manifest`) == `delete` {
+			for _, seg := range obj.segs {
+				c, o, _ := strings.Cut(strings.TrimPrefix(seg, `/`), `/`)
+				delete(fk.containers[c], o)
+			}
+		}
+		delete(objs, object)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (fk *fakeSwift) auth(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Password struct {
+					User struct {
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if req.Auth.Identity.Password.User.Password != testPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fk.auths++
+	token := uuid.New().String()
+	fk.tokens[token] = true
+	w.Header().Set(`X-Subject-Token`, token)
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, `{"token":{"expires_at":"`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`","catalog":[`+
+		`{"type":"identity","endpoints":[{"interface":"public","region":"RegionOne","url":"`+fk.url+`/v3"}]},`+
+		`{"type":"object-store","endpoints":[`+
+		`{"interface":"internal","region":"RegionOne","url":"http://127.0.0.1:1`+testAccount+`"},`+
+		`{"interface":"public","region":"RegionOne","url":"`+fk.url+testAccount+`"}]}]}}`)
+}
+
+func (fk *fakeSwift) list(w http.ResponseWriter, objs map[string]*fakeObject, q url.Values) {
+	prefix, delim, marker := q.Get(`prefix`), q.Get(`delimiter`), q.Get(`marker`)
+	limit, _ := strconv.Atoi(q.Get(`limit`))
+	var names []string
+	for name := range objs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ents := []listEntry{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ent := listEntry{Name: name, Bytes: int64(len(objs[name].data))}
+		if delim != `` {
+			if i := strings.Index(name[len(prefix):], delim); i >= 0 {
+				ent = listEntry{Subdir: name[:len(prefix)+i+len(delim)]}
+				if seen[ent.Subdir] {
+					continue
+				}
+				seen[ent.Subdir] = true
+			}
+		}
+		if key := ent.Name + ent.Subdir; key <= marker {
+			continue
+		}
+		if limit > 0 && len(ents) == limit {
+			break
+		}
+		ents = append(ents, ent)
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(ents)
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,116 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package tags
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// CopyTo writes the backing tags.dat to w, tags cannot be added while it is copied
+func (tm *TagMan) CopyTo(w io.Writer) (err error) {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	if !tm.active {
+		return ErrNotActive
+	}
+	var fin *os.File
+	if fin, err = os.Open(tm.backingFile); err != nil {
+		return
+	}
+	defer fin.Close()
+	_, err = io.Copy(w, fin)
+	return
+}
+
+// CopyMetaTo writes the tag metadata to the metadata file of the tags file at pth
+func (tm *TagMan) CopyMetaTo(pth string) error {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	if !tm.active {
+		return ErrNotActive
+	}
+	return tm.writeMetaFile(pth + TAG_META_SUFFIX)
+}
+
+// BackupTagDats copies every tags.dat and its metadata under root, laid out as
+// root/<customer>/<indexer>/tags.dat, into the same layout under dst.  Tag files in use are copied through their tag manager so
+// the copy never catches a tag half written.
+func BackupTagDats(ctx context.Context, root, dst string) (n int, err error) {
+	var custs []os.DirEntry
+	if custs, err = os.ReadDir(root); err != nil {
+		if os.IsNotExist(err) {
+			err = nil //nothing stored yet
+		}
+		return
+	}
+	for _, cust := range custs {
+		cid, perr := strconv.ParseUint(cust.Name(), 10, 64)
+		if perr != nil || !cust.IsDir() {
+			continue
+		}
+		var idxs []os.DirEntry
+		if idxs, err = os.ReadDir(filepath.Join(root, cust.Name())); err != nil {
+			return
+		}
+		for _, idx := range idxs {
+			guid, perr := uuid.Parse(idx.Name())
+			if perr != nil || !idx.IsDir() {
+				continue
+			}
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			idxDir := filepath.Join(root, cust.Name(), idx.Name())
+			if _, serr := os.Stat(GetTagDatPath(idxDir)); serr != nil {
+				continue //indexer has never synced tags
+			}
+			if err = backupTagDat(cid, guid, idxDir, filepath.Join(dst, cust.Name(), idx.Name())); err != nil {
+				return
+			}
+			n++
+		}
+	}
+	return
+}
+
+func backupTagDat(cid uint64, guid uuid.UUID, idxDir, dstDir string) (err error) {
+	if err = os.MkdirAll(dstDir, 0770); err != nil {
+		return
+	}
+	var fout *os.File
+	if fout, err = os.Create(GetTagDatPath(dstDir)); err != nil {
+		return
+	}
+	var tm *TagMan
+	if tm, err = GetTagMan(cid, guid, idxDir); err != nil {
+		fout.Close()
+		return
+	}
+	if err = tm.CopyTo(fout); err != nil {
+		ReleaseTagMan(cid, guid)
+		fout.Close()
+		return
+	} else if err = tm.CopyMetaTo(GetTagDatPath(dstDir)); err != nil {
+		ReleaseTagMan(cid, guid)
+		fout.Close()
+		return
+	}
+	if err = ReleaseTagMan(cid, guid); err != nil {
+		fout.Close()
+		return
+	}
+	err = fout.Close()
+	return
+}
@@ -0,0 +1,71 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package tags
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestBackupTagDats(t *testing.T) {
+	root := t.TempDir()
+	dst := t.TempDir()
+	guid := uuid.New()
+	idxDir := filepath.Join(root, `1`, guid.String())
+	if err := os.MkdirAll(idxDir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	//an indexer which never synced tags and a stray directory are skipped
+	if err := os.MkdirAll(filepath.Join(root, `1`, uuid.New().String()), 0770); err != nil {
+		t.Fatal(err)
+	} else if err = os.MkdirAll(filepath.Join(root, `1`, `.trash`), 0770); err != nil {
+		t.Fatal(err)
+	}
+
+	//hold the tag manager open while backing up, as a tag sync would
+	tm, err := GetTagMan(1, guid, idxDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = tm.AddTag(`foo`); err != nil {
+		t.Fatal(err)
+	} else if _, err = tm.Merge([]TagPair{{Name: `bar`, Value: 7, Description: `firewall logs`}}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := BackupTagDats(context.Background(), root, dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("backed up %d tag files, expected 1", n)
+	}
+	if err = ReleaseTagMan(1, guid); err != nil {
+		t.Fatal(err)
+	}
+
+	bk, err := New(GetTagDatPath(filepath.Join(dst, `1`, guid.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bk.Close()
+	if _, err = bk.GetTag(`foo`); err != nil {
+		t.Fatalf("backup is missing a tag: %v", err)
+	}
+	set, err := bk.TagSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range set {
+		if tp.Name == `bar` && tp.Description != `firewall logs` {
+			t.Fatalf("backup is missing tag metadata: %+v", tp)
+		}
+	}
+}
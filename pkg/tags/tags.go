@@ -10,6 +10,7 @@ package tags
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gravwell/cloudarchive/pkg/flock"
 
@@ -48,11 +50,21 @@ type TagMan struct {
 	backingFile string
 	fout        *os.File
 	active      bool
+	meta        map[string]tagMeta //descriptions and origins, only for tags which have them
 }
 
+// TagPair maps a tag name to its id.  Description and Origin optionally record what the
+// tag holds and where its entries come from, they are kept alongside the tags file.
 type TagPair struct {
-	Name  string
-	Value entry.EntryTag
+	Name        string
+	Value       entry.EntryTag
+	Description string `json:",omitempty"`
+	Origin      string `json:",omitempty"`
+}
+
+type tagMeta struct {
+	Description string `json:",omitempty"`
+	Origin      string `json:",omitempty"`
 }
 
 var (
@@ -63,6 +75,11 @@ var (
 
 const (
 	TAG_MANAGER_FILENAME string = "tags.dat"
+	// tag metadata is kept beside the tags file so older readers of the file are unaffected
+	TAG_META_SUFFIX string = ".meta"
+
+	//how long to wait on another process holding the tags file lock
+	lockTimeout = 2 * time.Second
 )
 
 func StaticTagPairs() []TagPair {
@@ -95,7 +112,7 @@ func New(p string) (*TagMan, error) {
 			return nil, err
 		}
 	}
-	if err = flock.Flock(fout, true); err != nil {
+	if err = flock.FlockTimeout(fout, true, lockTimeout); err != nil {
 		fout.Close()
 		return nil, err
 	}
@@ -126,15 +143,90 @@ func New(p string) (*TagMan, error) {
 		fout:        fout,
 		mtx:         sync.Mutex{},
 		active:      true,
+		meta:        map[string]tagMeta{},
 	}
 	if err = tm.loadTags(); err != nil {
 		flock.Funlock(fout)
 		fout.Close()
 		return nil, err
 	}
+	if err = tm.loadMeta(); err != nil {
+		flock.Funlock(fout)
+		fout.Close()
+		return nil, err
+	}
 	return tm, nil
 }
 
+// loadMeta reads the tag metadata file, which only exists once a tag has been described
+func (tm *TagMan) loadMeta() error {
+	bts, err := os.ReadFile(tm.backingFile + TAG_META_SUFFIX)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	mp := map[string]tagMeta{}
+	if err = json.Unmarshal(bts, &mp); err != nil {
+		return fmt.Errorf("invalid tag metadata: %w", err)
+	}
+	for k, v := range mp {
+		if _, ok := tm.tags[k]; ok {
+			tm.meta[k] = v
+		}
+	}
+	return nil
+}
+
+// writeMeta replaces the tag metadata file
+// ** caller should hold the lock
+func (tm *TagMan) writeMeta() error {
+	return tm.writeMetaFile(tm.backingFile + TAG_META_SUFFIX)
+}
+
+// writeMetaFile writes the tag metadata to pth, which is removed when no tag has metadata
+// ** caller should hold the lock
+func (tm *TagMan) writeMetaFile(pth string) error {
+	if len(tm.meta) == 0 {
+		if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	bts, err := json.Marshal(tm.meta)
+	if err != nil {
+		return err
+	}
+	tmp := pth + `.tmp`
+	if err = os.WriteFile(tmp, bts, 0660); err != nil {
+		return err
+	} else if err = os.Rename(tmp, pth); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// mergeMeta records any description or origin carried by the tag pair, an empty field
+// leaves the stored value alone.  It returns true if the metadata changed.
+// ** caller should hold the lock
+func (tm *TagMan) mergeMeta(tp TagPair) bool {
+	cur := tm.meta[tp.Name]
+	upd := cur
+	if tp.Description != `` {
+		upd.Description = tp.Description
+	}
+	if tp.Origin != `` {
+		upd.Origin = tp.Origin
+	}
+	if upd == cur {
+		return false
+	}
+	tm.meta[tp.Name] = upd
+	return true
+}
+
 // findNextAvailableTag returns the next available integer tag.
 // ** caller should hold the lock
 func (tm *TagMan) findNextAvailableTag() (entry.EntryTag, error) {
@@ -323,6 +415,24 @@ func parseLine(line string) (string, entry.EntryTag, error) {
 	return tagName, entry.EntryTag(val), nil
 }
 
+// ParseTagDat reads the tag pairs from a tags.dat file without opening a tag manager on it
+func ParseTagDat(rdr io.Reader) (tps []TagPair, err error) {
+	scn := bufio.NewScanner(rdr)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == `` {
+			continue
+		}
+		var tp TagPair
+		if tp.Name, tp.Value, err = parseLine(line); err != nil {
+			return
+		}
+		tps = append(tps, tp)
+	}
+	err = scn.Err()
+	return
+}
+
 func (tm *TagMan) EnsureTag(id entry.EntryTag, name string) error {
 	return tm.ensureTag(id, name)
 }
@@ -410,7 +520,8 @@ func (tm *TagMan) TagSet() (pairs []TagPair, err error) {
 		return
 	}
 	for k, v := range tm.tags {
-		pairs = append(pairs, TagPair{Name: k, Value: v})
+		md := tm.meta[k]
+		pairs = append(pairs, TagPair{Name: k, Value: v, Description: md.Description, Origin: md.Origin})
 	}
 	tm.mtx.Unlock()
 	return
@@ -455,6 +566,7 @@ func (tm *TagMan) ResetOverride(s []TagPair) (err error) {
 	//delete verything
 	tm.tagKeys = make(map[entry.EntryTag]string, len(s))
 	tm.tags = make(map[string]entry.EntryTag, len(s))
+	tm.meta = map[string]tagMeta{}
 	//truncate our tags file
 	if err = tm.fout.Truncate(0); err != nil {
 		return
@@ -487,6 +599,10 @@ func (tm *TagMan) ResetOverride(s []TagPair) (err error) {
 			return
 		}
 	}
+	for _, v := range s {
+		tm.mergeMeta(v)
+	}
+	err = tm.writeMeta()
 	return
 }
 
@@ -505,7 +621,9 @@ func (tm *TagMan) Count() (cnt int, err error) {
 // Merge attempts to merge the given tag set pair list into the given tag manager
 // if two tag names are the same, we check that the tag ids are the same
 // if they are not the same, we throw an error
+// descriptions and origins in the list replace those stored, empty ones are ignored
 func (tm *TagMan) Merge(s []TagPair) (updated bool, err error) {
+	var metaUpdated bool
 	if err = checkTagSet(s); err != nil {
 		return
 	}
@@ -538,6 +656,14 @@ func (tm *TagMan) Merge(s []TagPair) (updated bool, err error) {
 			}
 			updated = true
 		}
+		if tm.mergeMeta(v) {
+			metaUpdated = true
+		}
+	}
+	if metaUpdated {
+		if err = tm.writeMeta(); err == nil {
+			updated = true
+		}
 	}
 	return
 }
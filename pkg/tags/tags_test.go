@@ -279,6 +279,84 @@ func TestTagmapMerge(t *testing.T) {
 	}
 }
 
+func TestTagMeta(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), `tags.dat`)
+	tm, err := New(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	described := []TagPair{
+		{Name: `syslog`, Value: 3, Description: `RFC5424 syslog from the DMZ`, Origin: `simplerelay`},
+		{Name: `netflow`, Value: 4},
+	}
+	if updated, err := tm.Merge(described); err != nil {
+		t.Fatal(err)
+	} else if !updated {
+		t.Fatal("merge did not report an update")
+	}
+	//an empty description leaves the stored one, a new origin replaces the old
+	if _, err = tm.Merge([]TagPair{{Name: `syslog`, Value: 3, Origin: `federator`}}); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := tm.Merge([]TagPair{{Name: `syslog`, Value: 3}}); err != nil {
+		t.Fatal(err)
+	} else if updated {
+		t.Fatal("merge without changes reported an update")
+	}
+	if err = tm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the tags file itself keeps its original format
+	fin, err := os.Open(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tps, err := ParseTagDat(fin)
+	fin.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(tps) != 4 {
+		t.Fatalf("bad tags file %+v", tps)
+	}
+
+	if tm, err = New(pth); err != nil {
+		t.Fatal(err)
+	}
+	defer tm.Close()
+	set, err := tm.TagSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range set {
+		switch tp.Name {
+		case `syslog`:
+			if tp.Description != `RFC5424 syslog from the DMZ` || tp.Origin != `federator` {
+				t.Fatalf("bad syslog metadata %+v", tp)
+			}
+		default:
+			if tp.Description != `` || tp.Origin != `` {
+				t.Fatalf("unexpected metadata %+v", tp)
+			}
+		}
+	}
+
+	//a reset replaces the metadata along with the tags
+	if err = tm.ResetOverride([]TagPair{{Name: `syslog`, Value: 3}}); err != nil {
+		t.Fatal(err)
+	} else if set, err = tm.TagSet(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range set {
+		if tp.Description != `` || tp.Origin != `` {
+			t.Fatalf("metadata survived reset %+v", tp)
+		}
+	}
+	if _, err = os.Stat(pth + TAG_META_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("metadata file not removed: %v", err)
+	}
+}
+
 func TestTagSubset(t *testing.T) {
 	var tags []entry.EntryTag
 	tm, err := New(tagFile)
@@ -0,0 +1,183 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package tierstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	migrateTimeout = 30 * time.Minute // longest a single shard move may take
+)
+
+var (
+	ErrColdCopyDiffers = errors.New("Cold store already has a different copy of the shard")
+
+	errMoveFinished = errors.New("Cold store stopped reading the shard")
+)
+
+func (ts *tierstore) migrateRoutine() {
+	defer ts.wg.Done()
+	ctx, cf := context.WithCancel(context.Background())
+	go func() {
+		<-ts.done
+		cf()
+	}()
+	tckr := time.NewTicker(ts.cfg.MigrateInterval)
+	defer tckr.Stop()
+	for {
+		if n, err := ts.Migrate(ctx); err != nil && ctx.Err() == nil {
+			ts.cfg.Lgr.Warn("Failed to move shards to cold storage", log.KV("moved", n), log.KVErr(err))
+		} else if n > 0 {
+			ts.cfg.Lgr.Info("Moved shards to cold storage", log.KV("moved", n))
+		}
+		select {
+		case <-ts.done:
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+// Migrate moves every shard in the hot store which is older than the maximum age to the
+// cold store, returning how many were moved.  Shards which are in use or under a legal
+// hold are left for a later pass, a shard which fails to move does not stop the others.
+func (ts *tierstore) Migrate(ctx context.Context) (moved int, err error) {
+	var cids []uint64
+	if cids, err = ts.cfg.Hot.ListCustomers(); err != nil {
+		return
+	}
+	for _, cid := range cids {
+		var idxs []string
+		if idxs, err = ts.cfg.Hot.ListIndexes(ctx, cid); err != nil {
+			return
+		}
+		for _, idx := range idxs {
+			guid, perr := uuid.Parse(idx)
+			if perr != nil {
+				continue
+			}
+			var n int
+			n, err = ts.migrateIndexer(ctx, cid, guid)
+			moved += n
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (ts *tierstore) migrateIndexer(ctx context.Context, cid uint64, guid uuid.UUID) (moved int, err error) {
+	var wells []string
+	if wells, err = ts.cfg.Hot.ListIndexerWells(ctx, cid, guid); err != nil {
+		return
+	}
+	var tagsSynced bool
+	for _, well := range wells {
+		if ts.held(cid, well) {
+			continue
+		}
+		var tf util.Timeframe
+		var shards []string
+		if tf, err = ts.cfg.Hot.GetWellTimeframe(ctx, cid, guid, well); err != nil {
+			return
+		} else if shards, err = ts.cfg.Hot.GetShardsInTimeframe(ctx, cid, guid, well, tf); err != nil {
+			return
+		}
+		for _, shard := range shards {
+			if !ts.cold(shard) {
+				continue
+			} else if err = ctx.Err(); err != nil {
+				return
+			}
+			//the cold store needs the indexer's tags before it holds any of its shards
+			if !tagsSynced {
+				if err = ts.syncColdTags(ctx, cid, guid); err != nil {
+					return
+				}
+				tagsSynced = true
+			}
+			if lerr := ts.moveShard(ctx, cid, guid, well, shard); lerr != nil {
+				ts.cfg.Lgr.Warn("Failed to move shard to cold storage", log.KV("cid", cid), log.KV("indexeruuid", guid),
+					log.KV("well", well), log.KV("shard", shard), log.KVErr(lerr))
+				continue
+			}
+			moved++
+		}
+	}
+	return
+}
+
+func (ts *tierstore) syncColdTags(ctx context.Context, cid uint64, guid uuid.UUID) error {
+	tgs, err := ts.cfg.Hot.GetTags(ctx, cid, guid)
+	if err != nil {
+		return err
+	}
+	_, err = ts.cfg.Cold.SyncTags(ctx, cid, guid, tgs)
+	return err
+}
+
+// moveShard copies a shard to the cold store and then removes it from the hot store, if the
+// cold store already has the shard the hot copy is only removed when the two match
+func (ts *tierstore) moveShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (err error) {
+	ctx, cf := context.WithTimeout(ctx, migrateTimeout)
+	defer cf()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ts.cfg.Hot.PackShard(ctx, cid, guid, well, shard, pw))
+	}()
+	if eu, ok := ts.cfg.Cold.(webserver.ExclusiveShardUnpacker); ok {
+		err = eu.UnpackNewShard(ctx, 0, cid, guid, well, shard, pr)
+	} else {
+		err = ts.cfg.Cold.UnpackShard(ctx, cid, guid, well, shard, pr)
+	}
+	pr.CloseWithError(errMoveFinished)
+	if errors.Is(err, util.ErrShardExists) {
+		err = ts.sameShard(ctx, cid, guid, well, shard)
+	}
+	if err != nil {
+		return
+	}
+	err = ts.cfg.Hot.EvictShard(cid, guid, well, shard)
+	return
+}
+
+// sameShard ensures the copy of a shard the cold store already has matches the hot copy,
+// it may have been pushed straight to the cold store rather than left by an earlier pass
+func (ts *tierstore) sameShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) error {
+	hot, ok := ts.cfg.Hot.(webserver.ShardInfoReporter)
+	if !ok {
+		return ErrColdCopyDiffers
+	}
+	cold, ok := ts.cfg.Cold.(webserver.ShardInfoReporter)
+	if !ok {
+		return ErrColdCopyDiffers
+	}
+	hsi, err := hot.GetShardInfo(ctx, cid, guid, well, shard)
+	if err != nil {
+		return err
+	}
+	csi, err := cold.GetShardInfo(ctx, cid, guid, well, shard)
+	if err != nil {
+		return err
+	} else if hsi.Checksum() != csi.Checksum() {
+		return ErrColdCopyDiffers
+	}
+	return nil
+}
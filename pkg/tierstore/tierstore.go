@@ -0,0 +1,294 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package tierstore is a storage backend which keeps recent shards on local disk and
+// moves shards older than a configured age to a second, usually cheaper, backend.
+// Pulls look in the local store first and fall back to the cold store, so clients do
+// not need to know where a shard lives.
+package tierstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	DefaultMigrateInterval = time.Hour
+)
+
+var (
+	ErrMissingHot  = errors.New("Missing hot storage backend")
+	ErrMissingCold = errors.New("Missing cold storage backend")
+	ErrBadMaxAge   = errors.New("Maximum hot shard age must be positive")
+	ErrNoUsage     = errors.New("Cold storage backend does not report customer usage")
+)
+
+// HotStore is the local store recent shards are kept in, the file backend implements it
+type HotStore interface {
+	webserver.ShardHandler
+	// ListCustomers returns every customer with shards in the store
+	ListCustomers() ([]uint64, error)
+	// EvictShard removes a shard which has been copied to the cold store
+	EvictShard(cid uint64, guid uuid.UUID, well, shard string) error
+}
+
+type TierStoreConfig struct {
+	Hot  HotStore
+	Cold webserver.ShardHandler
+	// Shards which end more than MaxAge ago are moved to the cold store, pushes of
+	// shards which are already this old go straight to the cold store
+	MaxAge time.Duration
+	// How often the hot store is checked for shards to move, zero selects
+	// DefaultMigrateInterval and a negative interval disables migration
+	MigrateInterval time.Duration
+	Lgr             *log.Logger
+}
+
+type tierstore struct {
+	cfg TierStoreConfig
+
+	mtx   sync.Mutex
+	holds util.LegalHolds
+	now   func() time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+func NewTierStoreHandler(cfg TierStoreConfig) (*tierstore, error) {
+	if cfg.Hot == nil {
+		return nil, ErrMissingHot
+	} else if cfg.Cold == nil {
+		return nil, ErrMissingCold
+	} else if cfg.MaxAge <= 0 {
+		return nil, ErrBadMaxAge
+	}
+	if cfg.MigrateInterval == 0 {
+		cfg.MigrateInterval = DefaultMigrateInterval
+	}
+	if cfg.Lgr == nil {
+		cfg.Lgr = log.New(os.Stderr)
+	}
+	ts := &tierstore{
+		cfg:  cfg,
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+	if cfg.MigrateInterval > 0 {
+		ts.wg.Add(1)
+		go ts.migrateRoutine()
+	}
+	return ts, nil
+}
+
+// Close stops migration and closes both stores if they can be closed
+func (ts *tierstore) Close() (err error) {
+	ts.once.Do(func() {
+		close(ts.done)
+		ts.wg.Wait()
+		for _, h := range []webserver.ShardHandler{ts.cfg.Hot, ts.cfg.Cold} {
+			if c, ok := h.(io.Closer); ok {
+				if lerr := c.Close(); lerr != nil && err == nil {
+					err = lerr
+				}
+			}
+		}
+	})
+	return
+}
+
+// cold reports whether a shard is old enough to belong in the cold store
+func (ts *tierstore) cold(shard string) bool {
+	_, e, err := util.ShardNameToDateRange(shard)
+	return err == nil && e.Before(ts.now().Add(-ts.cfg.MaxAge))
+}
+
+// both calls fn against each store, a store which does not know about the request is skipped
+// and the call only fails with not exist if neither does
+func (ts *tierstore) both(fn func(webserver.ShardHandler) error) (err error) {
+	var found bool
+	for _, h := range []webserver.ShardHandler{ts.cfg.Hot, ts.cfg.Cold} {
+		if lerr := fn(h); lerr == nil {
+			found = true
+		} else if !os.IsNotExist(lerr) {
+			return lerr
+		} else if err == nil {
+			err = lerr
+		}
+	}
+	if found {
+		err = nil
+	}
+	return
+}
+
+// union merges the names listed by each store
+func (ts *tierstore) union(fn func(webserver.ShardHandler) ([]string, error)) (r []string, err error) {
+	have := map[string]bool{}
+	err = ts.both(func(h webserver.ShardHandler) error {
+		names, lerr := fn(h)
+		for _, n := range names {
+			if !have[n] {
+				have[n] = true
+				r = append(r, n)
+			}
+		}
+		return lerr
+	})
+	return
+}
+
+func (ts *tierstore) ListIndexes(ctx context.Context, cid uint64) ([]string, error) {
+	return ts.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.ListIndexes(ctx, cid)
+	})
+}
+
+func (ts *tierstore) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error) {
+	return ts.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.ListIndexerWells(ctx, cid, guid)
+	})
+}
+
+func (ts *tierstore) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	return ts.union(func(h webserver.ShardHandler) ([]string, error) {
+		return h.GetShardsInTimeframe(ctx, cid, guid, well, tf)
+	})
+}
+
+func (ts *tierstore) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+	err = ts.both(func(h webserver.ShardHandler) error {
+		tf, lerr := h.GetWellTimeframe(ctx, cid, guid, well)
+		if lerr != nil || (tf.Start.IsZero() && tf.End.IsZero()) {
+			return lerr
+		}
+		if t.Start.IsZero() || tf.Start.Before(t.Start) {
+			t.Start = tf.Start
+		}
+		if t.End.IsZero() || tf.End.After(t.End) {
+			t.End = tf.End
+		}
+		return nil
+	})
+	return
+}
+
+// GetTags returns the tags from the hot store, which sees every tag sync
+func (ts *tierstore) GetTags(ctx context.Context, cid uint64, guid uuid.UUID) ([]tags.TagPair, error) {
+	return ts.cfg.Hot.GetTags(ctx, cid, guid)
+}
+
+// SyncTags merges the tags into the hot store and passes them on to the cold store, a
+// failure in the cold store is logged and repaired when shards are next moved to it
+func (ts *tierstore) SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
+	if tgs, err = ts.cfg.Hot.SyncTags(ctx, cid, guid, idxTags); err != nil {
+		return
+	}
+	if _, lerr := ts.cfg.Cold.SyncTags(ctx, cid, guid, tgs); lerr != nil {
+		ts.cfg.Lgr.Warn("Failed to sync tags to cold storage", log.KV("cid", cid), log.KV("indexeruuid", guid), log.KVErr(lerr))
+	}
+	return
+}
+
+// UnpackShard stores recent shards in the hot store, shards which are already old enough
+// to be moved are sent straight to the cold store
+func (ts *tierstore) UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	if ts.cold(shard) {
+		return ts.cfg.Cold.UnpackShard(ctx, cid, guid, well, shard, rdr)
+	}
+	return ts.cfg.Hot.UnpackShard(ctx, cid, guid, well, shard, rdr)
+}
+
+// PackShard pulls from the hot store, falling back to the cold store if the shard has been moved
+func (ts *tierstore) PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) (err error) {
+	cw := &countWriter{w: wtr}
+	if err = ts.cfg.Hot.PackShard(ctx, cid, guid, well, shard, cw); err == nil || !os.IsNotExist(err) || cw.n > 0 {
+		return
+	}
+	return ts.cfg.Cold.PackShard(ctx, cid, guid, well, shard, wtr)
+}
+
+// CustomerUsage adds up the usage of both stores
+func (ts *tierstore) CustomerUsage(ctx context.Context, cid uint64) (sz uint64, err error) {
+	hot, ok := ts.cfg.Hot.(webserver.UsageReporter)
+	if !ok {
+		err = ErrNoUsage
+		return
+	}
+	cold, ok := ts.cfg.Cold.(webserver.UsageReporter)
+	if !ok {
+		err = ErrNoUsage
+		return
+	}
+	var hsz, csz uint64
+	if hsz, err = hot.CustomerUsage(ctx, cid); err != nil && !os.IsNotExist(err) {
+		return
+	} else if csz, err = cold.CustomerUsage(ctx, cid); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	sz, err = hsz+csz, nil
+	return
+}
+
+// Preflight checks both stores, pushes may go to either one depending on the shard's age
+func (ts *tierstore) Preflight(ctx context.Context) error {
+	if pf, ok := ts.cfg.Hot.(webserver.Preflighter); ok {
+		if err := pf.Preflight(ctx); err != nil {
+			return fmt.Errorf("hot store: %w", err)
+		}
+	}
+	if pf, ok := ts.cfg.Cold.(webserver.Preflighter); ok {
+		if err := pf.Preflight(ctx); err != nil {
+			return fmt.Errorf("cold store: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetLegalHolds passes the holds to both stores, shards under hold are never moved
+func (ts *tierstore) SetLegalHolds(lh util.LegalHolds) {
+	ts.mtx.Lock()
+	ts.holds = lh
+	ts.mtx.Unlock()
+	for _, h := range []webserver.ShardHandler{ts.cfg.Hot, ts.cfg.Cold} {
+		if lhe, ok := h.(webserver.LegalHoldEnforcer); ok {
+			lhe.SetLegalHolds(lh)
+		}
+	}
+}
+
+func (ts *tierstore) held(cid uint64, well string) (r bool) {
+	ts.mtx.Lock()
+	r = ts.holds.Held(cid, well)
+	ts.mtx.Unlock()
+	return
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	return
+}
@@ -0,0 +1,141 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package tierstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/internal/storetest"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var testFiles = map[string][]byte{
+	`.index`:  []byte(`index`),
+	`.verify`: []byte(`verify`),
+	`.store`:  bytes.Repeat([]byte(`store data `), 10000),
+}
+
+// newTestStore tiers two file stores, returning the wrapper and the hot and cold directories
+func newTestStore(t *testing.T) (ts *tierstore, hot, cold string) {
+	//the hot store must be able to evict, so it is built directly
+	hot = t.TempDir()
+	hs, err := filestore.NewFilestoreHandler(hot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, cold := storetest.NewFileStore(t)
+	if ts, err = NewTierStoreHandler(TierStoreConfig{
+		Hot:             hs,
+		Cold:            cs,
+		MaxAge:          24 * time.Hour,
+		MigrateInterval: -1,
+		Lgr:             log.NewDiscardLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Close() })
+	return
+}
+
+func TestTiering(t *testing.T) {
+	ts, hot, cold := newTestStore(t)
+	ctx := context.Background()
+	guid := uuid.New()
+	recent := util.GetShardId(time.Now()).Name()
+	old := util.GetShardId(time.Now().Add(-7 * 24 * time.Hour)).Name()
+
+	//old shards skip the hot store
+	if err := ts.UnpackShard(ctx, 1, guid, `default`, old, storetest.NewShard(t, old, testFiles)); err != nil {
+		t.Fatal(err)
+	} else if storetest.Stored(hot, guid, old) || !storetest.Stored(cold, guid, old) {
+		t.Fatal("old shard not sent to cold storage")
+	}
+	//push a shard while it is recent
+	s, _, _ := util.ShardNameToDateRange(recent)
+	if err := ts.UnpackShard(ctx, 1, guid, `default`, recent, storetest.NewShard(t, recent, testFiles)); err != nil {
+		t.Fatal(err)
+	} else if !storetest.Stored(hot, guid, recent) || storetest.Stored(cold, guid, recent) {
+		t.Fatal("recent shard not kept in hot storage")
+	}
+	tgs := []tags.TagPair{{Name: `syslog`, Value: 1}}
+	if _, err := ts.SyncTags(ctx, 1, guid, tgs); err != nil {
+		t.Fatal(err)
+	}
+
+	//both tiers are listed and pulled from
+	if shards, err := ts.GetShardsInTimeframe(ctx, 1, guid, `default`, util.Timeframe{Start: s.Add(-30 * 24 * time.Hour), End: s.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 2 {
+		t.Fatalf("bad shards %v", shards)
+	}
+	if tf, err := ts.GetWellTimeframe(ctx, 1, guid, `default`); err != nil {
+		t.Fatal(err)
+	} else if start, _, _ := util.ShardNameToDateRange(old); !tf.Start.Equal(start) {
+		t.Fatalf("bad timeframe %v", tf)
+	}
+	storetest.CheckPull(t, ts, guid, old, testFiles)
+	storetest.CheckPull(t, ts, guid, recent, testFiles)
+
+	//nothing is old enough to move yet
+	if n, err := ts.Migrate(ctx); err != nil || n != 0 {
+		t.Fatalf("moved %d shards: %v", n, err)
+	}
+	//once the recent shard ages out it is moved and still pulled
+	ts.now = func() time.Time { return time.Now().Add(30 * 24 * time.Hour) }
+	if n, err := ts.Migrate(ctx); err != nil || n != 1 {
+		t.Fatalf("moved %d shards: %v", n, err)
+	} else if storetest.Stored(hot, guid, recent) || !storetest.Stored(cold, guid, recent) {
+		t.Fatal("aged shard not moved")
+	}
+	storetest.CheckPull(t, ts, guid, recent, testFiles)
+}
+
+func TestMigrateExisting(t *testing.T) {
+	ts, hot, cold := newTestStore(t)
+	ctx := context.Background()
+	guid := uuid.New()
+	shard := util.GetShardId(time.Now()).Name()
+	if err := ts.UnpackShard(ctx, 1, guid, `default`, shard, storetest.NewShard(t, shard, testFiles)); err != nil {
+		t.Fatal(err)
+	} else if err = ts.cfg.Cold.UnpackShard(ctx, 1, guid, `default`, shard, storetest.NewShard(t, shard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	//a matching copy in cold storage lets the hot copy go
+	ts.now = func() time.Time { return time.Now().Add(30 * 24 * time.Hour) }
+	if n, err := ts.Migrate(ctx); err != nil || n != 1 {
+		t.Fatalf("moved %d shards: %v", n, err)
+	} else if storetest.Stored(hot, guid, shard) || !storetest.Stored(cold, guid, shard) {
+		t.Fatal("shard not moved")
+	} else if _, err = os.Stat(filepath.Join(cold, `1`, guid.String(), `default`, shard+`.1`)); !os.IsNotExist(err) {
+		t.Fatalf("moved shard stored twice: %v", err)
+	}
+
+	//a held well stays put
+	ts.SetLegalHolds(util.LegalHolds{1: {Wells: []string{`default`}}})
+	ts.now = time.Now
+	if err := ts.UnpackShard(ctx, 1, guid, `default`, shard, storetest.NewShard(t, shard, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+	ts.now = func() time.Time { return time.Now().Add(30 * 24 * time.Hour) }
+	if n, err := ts.Migrate(ctx); err != nil || n != 0 {
+		t.Fatalf("moved %d held shards: %v", n, err)
+	} else if !storetest.Stored(hot, guid, shard) {
+		t.Fatal("held shard moved")
+	}
+}
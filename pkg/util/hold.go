@@ -0,0 +1,43 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"errors"
+)
+
+var (
+	ErrLegalHold = errors.New("Shard is under legal hold")
+)
+
+// CustomerHold places a customer's whole archive, or only some of its wells, under legal hold
+type CustomerHold struct {
+	All   bool     // every well of every indexer is held
+	Wells []string // wells held on all of the customer's indexers
+}
+
+// LegalHolds maps customer numbers to their holds, shards under hold may not be deleted
+// or replaced, although new shards may still be stored
+type LegalHolds map[uint64]CustomerHold
+
+// Held returns true if the customer's well is under legal hold
+func (lh LegalHolds) Held(cid uint64, well string) bool {
+	ch, ok := lh[cid]
+	if !ok {
+		return false
+	} else if ch.All {
+		return true
+	}
+	for _, w := range ch.Wells {
+		if w == well {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestLegalHolds(t *testing.T) {
+	lh := LegalHolds{
+		1: {All: true},
+		2: {Wells: []string{`default`, `syslog`}},
+	}
+	tests := []struct {
+		cid  uint64
+		well string
+		held bool
+	}{
+		{1, `anything`, true},
+		{2, `syslog`, true},
+		{2, `netflow`, false},
+		{3, `default`, false},
+	}
+	for _, tc := range tests {
+		if held := lh.Held(tc.cid, tc.well); held != tc.held {
+			t.Errorf("customer %d well %s: held %v, expected %v", tc.cid, tc.well, held, tc.held)
+		}
+	}
+	var none LegalHolds
+	if none.Held(1, `default`) {
+		t.Fatal("nil holds held a well")
+	}
+}
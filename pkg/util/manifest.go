@@ -0,0 +1,36 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const (
+	ManifestFilename = `manifest.json`
+)
+
+// WriteManifest stores the sizes and checksums of a shard's files as they were written,
+// so that later corruption of the stored copy can be detected
+func WriteManifest(spath string, files []ShardFile) error {
+	bts, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(spath, ManifestFilename), bts, 0660)
+}
+
+// ReadManifest loads the manifest from a shard directory, ok is false for shards
+// stored before manifests were recorded
+func ReadManifest(spath string) (files []ShardFile, ok bool, err error) {
+	ok, err = readJSON(filepath.Join(spath, ManifestFilename), &files)
+	return
+}
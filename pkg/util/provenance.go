@@ -0,0 +1,94 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ProvenanceFilename = `provenance.json`
+)
+
+// Provenance records who uploaded a shard, it is kept by the server for audits
+type Provenance struct {
+	CID        uint64    // customer which pushed the shard
+	IdxUUID    uuid.UUID // indexer the shard was pushed for
+	RemoteAddr string    // address the push came from
+	UserAgent  string    `json:",omitempty"`
+	Uploaded   time.Time
+}
+
+type provenanceKey struct{}
+
+// WithProvenance attaches the provenance of a push to the context handed to a storage backend
+func WithProvenance(ctx context.Context, p Provenance) context.Context {
+	return context.WithValue(ctx, provenanceKey{}, p)
+}
+
+// ProvenanceFromContext returns the provenance attached with WithProvenance, if any
+func ProvenanceFromContext(ctx context.Context) (p Provenance, ok bool) {
+	if ctx != nil {
+		p, ok = ctx.Value(provenanceKey{}).(Provenance)
+	}
+	return
+}
+
+// WriteProvenance stores the provenance sidecar in a shard directory
+func WriteProvenance(spath string, p Provenance) error {
+	bts, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(spath, ProvenanceFilename), bts, 0660)
+}
+
+// ReadProvenance loads the provenance sidecar from a shard directory, shards stored
+// before provenance was recorded have none and nil is returned
+func ReadProvenance(spath string) (p *Provenance, err error) {
+	var v Provenance
+	var ok bool
+	if ok, err = readJSON(filepath.Join(spath, ProvenanceFilename), &v); ok {
+		p = &v
+	}
+	return
+}
+
+// ReadShardMetadata loads the metadata the client sent with a shard, nil if it sent none
+func ReadShardMetadata(spath, id string) (md *shardpacker.ShardMetadata, err error) {
+	var v shardpacker.ShardMetadata
+	var ok bool
+	if ok, err = readJSON(filepath.Join(spath, shardpacker.Metadata.Filepath(trimVersion(id))), &v); ok {
+		md = &v
+	}
+	return
+}
+
+// readJSON decodes a JSON file, ok is false if the file does not exist
+func readJSON(p string, v interface{}) (ok bool, err error) {
+	var bts []byte
+	if bts, err = ioutil.ReadFile(p); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	} else if err = json.Unmarshal(bts, v); err == nil {
+		ok = true
+	}
+	return
+}
@@ -9,9 +9,15 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -24,10 +30,18 @@ const (
 	ShardSet          int64  = 0x1ffff //this 1.517
 	shardMaskBitCount uint64 = 17      //number of bits to remove when generating an a name
 	shardQuant        int64  = ShardSet + 1
+
+	tarBlockSize        int64 = 512
+	ustarMaxSize        int64 = 1<<33 - 1 //larger files need a PAX size record
+	ustarMaxName              = 100       //as do longer names
+	zlibStoredBlockSize int64 = 16383
 )
 
 var (
 	shardMask int64 = ^ShardSet
+
+	ErrNotShardFile = errors.New("not a shard data file")
+	ErrShardChanged = errors.New("Stored shard has changed since the delta was computed")
 )
 
 type ShardID int64
@@ -99,9 +113,181 @@ func AddShardFilesToPacker(spath, id string, pkr *shardpacker.Packer) (err error
 			}
 		}
 	}
+
+	//grab any registered artifacts
+	if len(shardpacker.Artifacts()) > 0 {
+		var ents []os.DirEntry
+		if ents, err = os.ReadDir(spath); err != nil {
+			return
+		}
+		for _, ent := range ents {
+			if ent.Type().IsRegular() && shardpacker.IsArtifact(ent.Name()) {
+				if err = addArtifact(spath, ent.Name(), pkr); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// GetShardSize sizes the files AddShardFilesToPacker would send for a shard and estimates the packed stream size
+func GetShardSize(spath, id string) (sz ShardSize, err error) {
+	var files []string
+	if files, err = packFiles(spath, id); err != nil {
+		return
+	}
+	var fi os.FileInfo
+	var tarSize int64 = 2 * tarBlockSize //end of archive marker
+	for _, f := range files {
+		if fi, err = os.Stat(filepath.Join(spath, f)); err != nil {
+			if os.IsNotExist(err) {
+				err = nil //only the verify file is optional, packing reports any others
+				continue
+			}
+			return
+		}
+		sz.Uncompressed += fi.Size()
+		tarSize += tarBlockSize + (fi.Size()+tarBlockSize-1)/tarBlockSize*tarBlockSize
+		if fi.Size() > ustarMaxSize || len(f) > ustarMaxName {
+			tarSize += 2 * tarBlockSize //PAX extended header and its records
+		}
+	}
+	//zlib adds a header and checksum, and stored blocks cost 5 bytes per 16KB when data does not compress
+	sz.Packed = tarSize + (tarSize/zlibStoredBlockSize+1)*5 + 6
+	return
+}
+
+// PackedFiles returns the files AddShardFilesToPacker would send for a shard as slash separated
+// paths relative to the shard directory, files which do not exist are left out
+func PackedFiles(spath, id string) (files []string, err error) {
+	var all []string
+	if all, err = packFiles(spath, id); err != nil {
+		return
+	}
+	for _, f := range all {
+		if _, err = os.Stat(filepath.Join(spath, f)); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		files = append(files, filepath.ToSlash(f))
+	}
 	return
 }
 
+// packFiles lists the files AddShardFilesToPacker sends for a shard, which may not all exist
+func packFiles(spath, id string) (files []string, err error) {
+	id = trimVersion(id)
+	for _, tp := range []shardpacker.Ftype{shardpacker.Verify, shardpacker.Index, shardpacker.Store} {
+		files = append(files, tp.Filepath(id))
+	}
+	var fi os.FileInfo
+	if fi, err = os.Stat(filepath.Join(spath, shardpacker.AccelFile.Filename(id))); err == nil {
+		if fi.Mode().IsRegular() {
+			files = append(files, shardpacker.AccelFile.Filepath(id))
+		} else {
+			files = append(files, shardpacker.IndexAccelKeyFile.Filepath(id), shardpacker.IndexAccelDataFile.Filepath(id))
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	if len(shardpacker.Artifacts()) > 0 {
+		var ents []os.DirEntry
+		if ents, err = os.ReadDir(spath); err != nil {
+			return
+		}
+		for _, ent := range ents {
+			if ent.Type().IsRegular() && shardpacker.IsArtifact(ent.Name()) {
+				files = append(files, ent.Name())
+			}
+		}
+	}
+	return
+}
+
+// AddShardFileListToPacker adds the named shard files to the packer, names are slash separated
+// paths relative to the shard directory as returned by PackedFiles.  Unlike AddShardFilesToPacker
+// no file is required, so the stream only describes part of a shard.
+func AddShardFileListToPacker(spath, id string, names []string, pkr *shardpacker.Packer) (err error) {
+	id = trimVersion(id)
+	for _, name := range names {
+		if shardpacker.IsArtifact(name) {
+			if err = addArtifact(spath, name, pkr); err != nil {
+				return
+			}
+			continue
+		}
+		var ft shardpacker.Ftype
+		if ft, err = PackedFileType(id, name); err != nil {
+			return
+		} else if err = addFile(spath, id, ft, pkr, false); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// PackedFileType returns the type of a shard data file given its slash separated path relative
+// to the shard directory, anything other than a file a pull sends is rejected
+func PackedFileType(id, name string) (ft shardpacker.Ftype, err error) {
+	id = trimVersion(id)
+	if ft, err = shardpacker.FilenameToType(path.Base(name)); err == nil {
+		switch ft {
+		case shardpacker.Store, shardpacker.Index, shardpacker.Verify, shardpacker.AccelFile,
+			shardpacker.IndexAccelKeyFile, shardpacker.IndexAccelDataFile:
+			if filepath.ToSlash(ft.Filepath(id)) == name {
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("%w %q", ErrNotShardFile, name)
+	return
+}
+
+// ShardComplete reports whether a shard directory holds every file required to pack the shard,
+// the same files AddShardFilesToPacker requires.  The modification time of the newest file is also returned.
+func ShardComplete(spath, id string) (complete bool, mod time.Time, err error) {
+	id = trimVersion(id)
+	req := []shardpacker.Ftype{shardpacker.Index, shardpacker.Store}
+	var fi os.FileInfo
+	if fi, err = os.Stat(filepath.Join(spath, shardpacker.AccelFile.Filename(id))); err == nil && fi.IsDir() {
+		req = append(req, shardpacker.IndexAccelKeyFile, shardpacker.IndexAccelDataFile)
+	} else if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	for _, tp := range req {
+		if fi, err = os.Stat(filepath.Join(spath, tp.Filepath(id))); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return
+		} else if !fi.Mode().IsRegular() {
+			return
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	complete = true
+	return
+}
+
+func addArtifact(spath, name string, pkr *shardpacker.Packer) error {
+	fin, sz, err := getHandleAndSize(filepath.Join(spath, name))
+	if err != nil {
+		return err
+	} else if err = pkr.AddArtifact(name, sz, fin); err != nil {
+		fin.Close()
+		return err
+	}
+	return fin.Close()
+}
+
 func addFile(spath, id string, tp shardpacker.Ftype, pkr *shardpacker.Packer, optional bool) error {
 	pth := filepath.Join(spath, tp.Filepath(id))
 	if fin, sz, err := getHandleAndSize(pth); err != nil {
@@ -134,6 +320,67 @@ func getHandleAndSize(p string) (fio *os.File, sz int64, err error) {
 	return
 }
 
+// ShardFiles returns every regular file within a shard directory along with its size and SHA256 checksum
+// files are returned in lexical order of their path relative to the shard directory.  The manifest is
+// the server's record of the other files rather than part of the shard, so it is left out.
+func ShardFiles(spath string) (files []ShardFile, err error) {
+	err = filepath.Walk(spath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(spath, p)
+		if err != nil {
+			return err
+		} else if rel == ManifestFilename {
+			return nil
+		}
+		sum, err := fileChecksum(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, ShardFile{
+			Name:   filepath.ToSlash(rel),
+			Size:   fi.Size(),
+			SHA256: sum,
+		})
+		return nil
+	})
+	return
+}
+
+// Checksum returns a single SHA256 over the shard's data files, its index, store, verify, and
+// accelerator files, so that two copies of a shard can be compared regardless of tags, metadata, or artifacts
+func (si ShardInfo) Checksum() string {
+	files := make([]ShardFile, 0, len(si.Files))
+	for _, f := range si.Files {
+		ft, err := shardpacker.FilenameToType(path.Base(f.Name))
+		if err == nil && ft != shardpacker.WellTags && ft != shardpacker.TagsUpdate && ft != shardpacker.Metadata {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	h := sha256.New()
+	for _, f := range files {
+		io.WriteString(h, f.Name+"\x00"+f.SHA256+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func fileChecksum(p string) (string, error) {
+	fin, err := os.Open(p)
+	if err != nil {
+		return ``, err
+	}
+	defer fin.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fin); err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func trimVersion(nm string) string {
 	return strings.TrimSuffix(nm, filepath.Ext(nm))
 }
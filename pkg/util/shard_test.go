@@ -0,0 +1,144 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+)
+
+func TestGetShardSize(t *testing.T) {
+	sdir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(sdir, `76a00.accel`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	//random data does not compress, so the estimate should be close
+	sizes := map[string]int{
+		`76a00.index`:      100 * 1024,
+		`76a00.store`:      1024*1024 + 17,
+		`76a00.accel/keys`: 10,
+		`76a00.accel/data`: 4096,
+		`unrelated`:        1000,
+	}
+	var want int64
+	for nm, sz := range sizes {
+		buf := make([]byte, sz)
+		rand.Read(buf)
+		if err := ioutil.WriteFile(filepath.Join(sdir, nm), buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if nm != `unrelated` {
+			want += int64(sz)
+		}
+	}
+	sz, err := GetShardSize(sdir, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	} else if sz.Uncompressed != want {
+		t.Fatalf("uncompressed size %d != %d", sz.Uncompressed, want)
+	}
+
+	pkr := shardpacker.NewPacker(`76a00`)
+	go func() {
+		if err := AddShardFilesToPacker(sdir, `76a00`, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else if err = pkr.Flush(); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	packed, err := ioutil.ReadAll(pkr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := int64(len(packed)); n > sz.Packed || n < sz.Packed*99/100 {
+		t.Fatalf("packed size %d, estimated %d", n, sz.Packed)
+	}
+}
+
+func TestPackedFiles(t *testing.T) {
+	sdir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(sdir, `76a00.accel`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, nm := range []string{`76a00.index`, `76a00.store`, `76a00.accel/keys`, `76a00.accel/data`, `unrelated`} {
+		if err := ioutil.WriteFile(filepath.Join(sdir, nm), []byte(nm), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the verify file is optional and missing, the unrelated file is never sent
+	files, err := PackedFiles(sdir, `76a00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`76a00.index`, `76a00.store`, `76a00.accel/keys`, `76a00.accel/data`}
+	if len(files) != len(want) {
+		t.Fatalf("bad packed files %v", files)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Fatalf("bad packed files %v", files)
+		}
+	}
+
+	for _, nm := range want {
+		if _, err = PackedFileType(`76a00`, nm); err != nil {
+			t.Fatalf("%s rejected: %v", nm, err)
+		}
+	}
+	for _, nm := range []string{`unrelated`, `76a01.index`, `../76a00.index`, `76a00.accel/../keys`, `tags`} {
+		if _, err = PackedFileType(`76a00`, nm); !errors.Is(err, ErrNotShardFile) {
+			t.Fatalf("%s accepted: %v", nm, err)
+		}
+	}
+
+	//only the listed files are packed, and the stream need not hold a complete shard
+	pkr := shardpacker.NewPacker(`76a00`)
+	go func() {
+		if err := AddShardFileListToPacker(sdir, `76a00`, []string{`76a00.accel/keys`}, pkr); err != nil {
+			pkr.CloseWithError(err)
+		} else {
+			pkr.Close()
+		}
+	}()
+	up, err := shardpacker.NewUnpacker(`76a00`, pkr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.SetPartial(true)
+	fh := &fileList{}
+	if err = up.Unpack(fh); err != nil {
+		t.Fatal(err)
+	} else if len(fh.names) != 1 || fh.names[0] != filepath.Join(`76a00.accel`, `keys`) {
+		t.Fatalf("bad unpacked files %v", fh.names)
+	}
+}
+
+type fileList struct {
+	names []string
+}
+
+func (fl *fileList) HandleFile(pth string, rdr io.Reader) error {
+	fl.names = append(fl.names, pth)
+	_, err := io.Copy(ioutil.Discard, rdr)
+	return err
+}
+
+func (fl *fileList) HandleTagUpdate(tgs []tags.TagPair) error {
+	return nil
+}
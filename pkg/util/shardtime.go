@@ -0,0 +1,102 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+var (
+	ErrInvalidShardName = errors.New("invalid shard name")
+	ErrInvalidTimeframe = errors.New("timeframe end is before start")
+)
+
+// Overlaps returns true if the span s through e intersects the timeframe
+// spans which only touch the edges of the timeframe are considered overlapping
+func (tf Timeframe) Overlaps(s, e time.Time) bool {
+	return !s.After(tf.End) && !e.Before(tf.Start)
+}
+
+// ShardOverlaps returns true if the named shard covers any part of the timeframe
+func (tf Timeframe) ShardOverlaps(nm string) (bool, error) {
+	s, e, err := ShardNameToDateRange(nm)
+	if err != nil {
+		return false, err
+	}
+	return tf.Overlaps(s, e), nil
+}
+
+// Validate ensures the timeframe does not end before it starts
+func (tf Timeframe) Validate() error {
+	if tf.End.Before(tf.Start) {
+		return ErrInvalidTimeframe
+	}
+	return nil
+}
+
+// ParseShardName splits a shard name into its ID and re-upload version
+// the original upload of a shard has no version suffix and a version of zero
+func ParseShardName(nm string) (id ShardID, version uint64, err error) {
+	base := nm
+	if idx := strings.IndexByte(nm, '.'); idx >= 0 {
+		base = nm[:idx]
+		if version, err = strconv.ParseUint(nm[idx+1:], 10, 64); err != nil || version == 0 {
+			err = fmt.Errorf("%w %q", ErrInvalidShardName, nm)
+			return
+		}
+	}
+	if base == `` || strings.ToLower(base) != base {
+		err = fmt.Errorf("%w %q", ErrInvalidShardName, nm)
+		return
+	}
+	var v int64
+	if v, err = strconv.ParseInt(base, 16, 64); err != nil || v < 0 {
+		err = fmt.Errorf("%w %q", ErrInvalidShardName, nm)
+		return
+	}
+	id = ShardID(v << shardMaskBitCount)
+	return
+}
+
+// ValidateShardName ensures a name is a shard ID with an optional numeric version suffix
+func ValidateShardName(nm string) (err error) {
+	_, _, err = ParseShardName(nm)
+	return
+}
+
+// Name returns the name a shard is stored under, without any version suffix
+func (s ShardID) Name() string {
+	return strconv.FormatInt(int64(s)>>shardMaskBitCount, 16)
+}
+
+// Timeframe returns the span of time covered by the shard
+func (s ShardID) Timeframe() Timeframe {
+	return Timeframe{
+		Start: entry.Timestamp{Sec: int64(s)}.StandardTime(),
+		End:   entry.Timestamp{Sec: int64(NextShardId(s))}.StandardTime(),
+	}
+}
+
+// ShardsInTimeframe enumerates the IDs of every shard which overlaps the timeframe
+func ShardsInTimeframe(tf Timeframe) (ids []ShardID, err error) {
+	if err = tf.Validate(); err != nil {
+		return
+	}
+	last := GetShardId(tf.End)
+	for id := GetShardId(tf.Start); id <= last; id = NextShardId(id) {
+		ids = append(ids, id)
+	}
+	return
+}
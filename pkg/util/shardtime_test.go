@@ -0,0 +1,134 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var (
+	baseTime = time.Date(2023, 3, 14, 12, 0, 0, 0, time.UTC)
+)
+
+func TestOverlaps(t *testing.T) {
+	tf := Timeframe{Start: baseTime, End: baseTime.Add(time.Hour)}
+	tests := []struct {
+		name string
+		s, e time.Time
+		ok   bool
+	}{
+		{`before`, baseTime.Add(-2 * time.Hour), baseTime.Add(-time.Hour), false},
+		{`after`, baseTime.Add(2 * time.Hour), baseTime.Add(3 * time.Hour), false},
+		{`touches start`, baseTime.Add(-time.Hour), baseTime, true},
+		{`touches end`, baseTime.Add(time.Hour), baseTime.Add(2 * time.Hour), true},
+		{`spans start`, baseTime.Add(-time.Minute), baseTime.Add(time.Minute), true},
+		{`spans end`, baseTime.Add(59 * time.Minute), baseTime.Add(61 * time.Minute), true},
+		{`contained`, baseTime.Add(time.Minute), baseTime.Add(2 * time.Minute), true},
+		{`contains`, baseTime.Add(-time.Hour), baseTime.Add(2 * time.Hour), true},
+		{`equal`, baseTime, baseTime.Add(time.Hour), true},
+	}
+	for _, tt := range tests {
+		if ok := tf.Overlaps(tt.s, tt.e); ok != tt.ok {
+			t.Fatalf("%s: got %v, expected %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+// legacyOverlaps is the overlap test formerly duplicated in each storage backend
+func legacyOverlaps(tf Timeframe, s, e time.Time) bool {
+	switch {
+	case s.Before(tf.Start) && e.After(tf.Start):
+		fallthrough
+	case s.Before(tf.End) && e.After(tf.End):
+		fallthrough
+	case s.Equal(tf.End) || s.Equal(tf.Start) || e.Equal(tf.End) || e.Equal(tf.Start):
+		fallthrough
+	case tf.Start.Before(s) && tf.End.After(e):
+		return true
+	}
+	return false
+}
+
+func TestOverlapsLegacy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	offset := func() time.Time {
+		return baseTime.Add(time.Duration(r.Intn(20)) * time.Minute)
+	}
+	for i := 0; i < 10000; i++ {
+		tf := Timeframe{Start: offset()}
+		tf.End = tf.Start.Add(time.Duration(r.Intn(10)) * time.Minute)
+		s := offset()
+		e := s.Add(time.Duration(r.Intn(10)+1) * time.Minute)
+		if tf.Overlaps(s, e) != legacyOverlaps(tf, s, e) {
+			t.Fatalf("mismatch for %v - %v in %v - %v", s, e, tf.Start, tf.End)
+		}
+	}
+}
+
+func TestParseShardName(t *testing.T) {
+	good := map[string]uint64{
+		`769f2`:    0,
+		`769f2.1`:  1,
+		`769f2.12`: 12,
+	}
+	for nm, ver := range good {
+		id, v, err := ParseShardName(nm)
+		if err != nil {
+			t.Fatalf("%s: %v", nm, err)
+		} else if v != ver {
+			t.Fatalf("%s: bad version %d != %d", nm, v, ver)
+		} else if id.Name() != `769f2` {
+			t.Fatalf("%s: bad name %s", nm, id.Name())
+		}
+	}
+	bad := []string{``, `.1`, `769f2.`, `769f2.0`, `769f2.a`, `769f2.1.2`, `769F2`, `-769f2`, `xyz`, `..`, `769f2/..`}
+	for _, nm := range bad {
+		if _, _, err := ParseShardName(nm); !errors.Is(err, ErrInvalidShardName) {
+			t.Fatalf("%q: failed to catch invalid name: %v", nm, err)
+		}
+	}
+}
+
+func TestShardIDTimeframe(t *testing.T) {
+	id := GetShardId(baseTime)
+	s, e, err := ShardNameToDateRange(id.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf := id.Timeframe()
+	if !tf.Start.Equal(s) || !tf.End.Equal(e) {
+		t.Fatalf("bad timeframe %v - %v != %v - %v", tf.Start, tf.End, s, e)
+	} else if baseTime.Before(s) || !baseTime.Before(e) {
+		t.Fatalf("%v not within shard %v - %v", baseTime, s, e)
+	}
+}
+
+func TestShardsInTimeframe(t *testing.T) {
+	first := GetShardId(baseTime)
+	tf := Timeframe{Start: baseTime, End: NextShardId(NextShardId(first)).Timeframe().Start.Add(time.Second)}
+	ids, err := ShardsInTimeframe(tf)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 3 {
+		t.Fatalf("bad shard count %d", len(ids))
+	}
+	for i, id := range ids {
+		if ok, err := tf.ShardOverlaps(id.Name()); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("shard %d %s does not overlap", i, id.Name())
+		}
+	}
+	if _, err = ShardsInTimeframe(Timeframe{Start: tf.End, End: tf.Start}); err != ErrInvalidTimeframe {
+		t.Fatalf("failed to catch inverted timeframe: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var sizeSuffixes = []string{`K`, `M`, `G`, `T`, `P`}
+
+// ParseSize parses a byte count with an optional binary K, M, G, T, or P suffix
+func ParseSize(v string) (sz uint64, err error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, `B`), `I`)
+	mult := uint64(1)
+	for i, sfx := range sizeSuffixes {
+		if strings.HasSuffix(v, sfx) {
+			v = strings.TrimSuffix(v, sfx)
+			mult = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	if sz, err = strconv.ParseUint(strings.TrimSpace(v), 10, 64); err != nil {
+		return
+	} else if sz > math.MaxUint64/mult {
+		err = errors.New("size overflows")
+		return
+	}
+	sz *= mult
+	return
+}
+
+// FormatSize renders a byte count using the largest binary suffix that divides it evenly
+func FormatSize(sz uint64) string {
+	for i := len(sizeSuffixes) - 1; i >= 0; i-- {
+		if mult := uint64(1) << (10 * uint(i+1)); sz%mult == 0 {
+			return fmt.Sprintf("%d%s", sz/mult, sizeSuffixes[i])
+		}
+	}
+	return strconv.FormatUint(sz, 10)
+}
@@ -0,0 +1,36 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]uint64{
+		`512`:   512,
+		`4K`:    4096,
+		`1MB`:   1024 * 1024,
+		` 2gib`: 2 << 30,
+	}
+	for v, want := range tests {
+		if sz, err := ParseSize(v); err != nil {
+			t.Fatalf("%q: %v", v, err)
+		} else if sz != want {
+			t.Fatalf("%q parsed to %d, expected %d", v, sz, want)
+		} else if back, err := ParseSize(FormatSize(sz)); err != nil || back != sz {
+			t.Fatalf("%d did not round trip through %q", sz, FormatSize(sz))
+		}
+	}
+	for _, v := range []string{``, `lots`, `-1K`, `20000000P`} {
+		if _, err := ParseSize(v); err == nil {
+			t.Fatalf("%q parsed", v)
+		}
+	}
+}
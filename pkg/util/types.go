@@ -8,9 +8,182 @@
 
 package util
 
-import "time"
+import (
+	"errors"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrReencryptRunning = errors.New("A re-encryption pass is already running")
+)
 
 type Timeframe struct {
 	Start time.Time
 	End   time.Time
 }
+
+// ShardInfo describes the files stored for a single shard
+type ShardInfo struct {
+	Shard      string
+	Files      []ShardFile
+	Metadata   *shardpacker.ShardMetadata `json:",omitempty"` // sent by the client with the shard
+	Provenance *Provenance                `json:",omitempty"` // recorded by the server when the shard was stored
+}
+
+// ShardFile is a single file within a shard, the name is relative to the shard directory
+type ShardFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// ShardSize describes how much data pulling a shard transfers
+type ShardSize struct {
+	Uncompressed int64 // total size of the shard files
+	Packed       int64 // estimated size of the packed stream, an upper bound as shard files seldom compress well
+}
+
+// WellStats summarizes the shards stored for a single well
+type WellStats struct {
+	Well       string
+	Shards     int       // stored shards, re-uploaded copies included
+	Duplicates int       // re-uploaded copies, which carry a .N suffix on the shard name
+	Bytes      int64     // total size of the stored shard files
+	Oldest     time.Time // start of the oldest shard
+	Newest     time.Time // end of the newest shard
+}
+
+// ShardVerification reports the outcome of a deep verification of a stored shard
+type ShardVerification struct {
+	Shard    string
+	Checked  time.Time
+	Passed   bool
+	Manifest bool        // false for shards stored before checksums were recorded on push, which can only be checked for readability
+	Files    []ShardFile // the stored files as they were read back
+	Problems []string    `json:",omitempty"` // everything wrong with the shard, empty if it passed
+}
+
+// CompactionResult describes the duplicate copies of a single shard found by a compaction pass
+type CompactionResult struct {
+	CID       uint64
+	IdxUUID   uuid.UUID
+	Well      string
+	Shard     string   // the unsuffixed shard name
+	Kept      string   // the copy which was kept and moved to the shard name, empty if no copy was complete
+	Removed   []string // redundant copies which were, or in a dry run would be, removed
+	Reclaimed int64    // bytes freed by removing the redundant copies
+}
+
+// ReencryptResult summarizes a pass which re-encrypts stored shards under the current keys
+type ReencryptResult struct {
+	Checked     int // shards which were read
+	Reencrypted int // shards which had files rewritten under the current key, or in a dry run would have
+	Files       int // files which were, or in a dry run would be, rewritten
+	Skipped     int // shards which were busy, held, or pushed again during the pass, a later pass retries them
+}
+
+// DiskUsage is a sample of the space a storage backend uses and has left on its volume
+type DiskUsage struct {
+	Path        string
+	Sampled     time.Time
+	StoredBytes uint64 // bytes stored under the backend's base directory
+	TotalBytes  uint64 // size of the volume
+	FreeBytes   uint64 // bytes available to the server
+	TotalInodes uint64
+	FreeInodes  uint64
+}
+
+// FreePercent returns the percentage of the volume still available
+func (du DiskUsage) FreePercent() float64 {
+	if du.TotalBytes == 0 {
+		return 100
+	}
+	return 100 * float64(du.FreeBytes) / float64(du.TotalBytes)
+}
+
+// FreeInodePercent returns the percentage of inodes still available, filesystems
+// without a fixed inode count report 100
+func (du DiskUsage) FreeInodePercent() float64 {
+	if du.TotalInodes == 0 {
+		return 100
+	}
+	return 100 * float64(du.FreeInodes) / float64(du.TotalInodes)
+}
+
+// TrashEntry is a deleted shard held in a customer's trash until it expires
+type TrashEntry struct {
+	ID      string // identifies the entry when restoring it
+	CID     uint64
+	IdxUUID uuid.UUID
+	Well    string
+	Shard   string
+	Size    int64 // bytes held by the trashed shard
+	Deleted time.Time
+	Expires time.Time // the shard is destroyed once this passes
+}
+
+// Shard operations recorded in a customer's access history
+const (
+	AccessPush   = `push`
+	AccessDelta  = `delta`
+	AccessPull   = `pull`
+	AccessDelete = `delete`
+)
+
+// AccessEvent records a single push, pull, or delete of a shard
+type AccessEvent struct {
+	Time       time.Time
+	Operation  string
+	CID        uint64
+	IdxUUID    uuid.UUID
+	Well       string
+	Shard      string
+	RemoteAddr string `json:",omitempty"`
+	Error      string `json:",omitempty"` // empty if the operation succeeded
+}
+
+// AccessQuery selects events from a customer's access history, zero fields match everything
+type AccessQuery struct {
+	Start     time.Time // events at or after
+	End       time.Time // events before
+	Indexer   uuid.UUID
+	Well      string
+	Shard     string
+	Operation string
+	Limit     int // maximum events returned, the most recent are kept
+
+	Indexers []uuid.UUID `json:"-"` // set by the server to the indexers the customer is restricted to
+}
+
+// Match reports whether the event is selected by the query
+func (q AccessQuery) Match(ev AccessEvent) bool {
+	if !q.Start.IsZero() && ev.Time.Before(q.Start) {
+		return false
+	} else if !q.End.IsZero() && !ev.Time.Before(q.End) {
+		return false
+	} else if q.Indexer != uuid.Nil && ev.IdxUUID != q.Indexer {
+		return false
+	} else if len(q.Indexers) > 0 && !containsUUID(q.Indexers, ev.IdxUUID) {
+		return false
+	} else if q.Well != `` && ev.Well != q.Well {
+		return false
+	} else if q.Shard != `` && ev.Shard != q.Shard {
+		return false
+	} else if q.Operation != `` && ev.Operation != q.Operation {
+		return false
+	}
+	return true
+}
+
+func containsUUID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -9,29 +9,52 @@
 package util
 
 import (
+	"context"
 	"errors"
+	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 var (
-	empty                  es
 	ErrUploadInProgress    = errors.New("Shard upload already in progress")
 	ErrUploadNotInProgress = errors.New("Shard upload not in progress")
+	ErrShardExists         = errors.New("Shard already exists")
 )
 
-// empty struct for efficient map storage
-type es struct{}
-
 type UploadTracker struct {
 	sync.Mutex
-	active map[UploadID]es
+	active map[UploadID]*upload
+}
+
+// upload is the state of a single active upload, done is closed when the upload exits
+type upload struct {
+	done  chan struct{}
+	start time.Time
+	bytes int64
+}
+
+// UploadStatus is a snapshot of an active upload
+type UploadStatus struct {
+	UploadID
+	Start time.Time
+	Bytes int64 //bytes transferred so far
 }
 
 func NewUploadTracker() UploadTracker {
 	return UploadTracker{
-		active: make(map[UploadID]es, 16),
+		active: make(map[UploadID]*upload, 16),
+	}
+}
+
+func newUpload() *upload {
+	return &upload{
+		done:  make(chan struct{}),
+		start: time.Now(),
 	}
 }
 
@@ -49,21 +72,115 @@ func (t *UploadTracker) EnterUpload(uid UploadID) (err error) {
 	if _, ok := t.active[uid]; ok {
 		err = ErrUploadInProgress
 	} else {
-		t.active[uid] = empty
+		t.active[uid] = newUpload()
 	}
 	t.Unlock()
 	return
 }
 
+// EnterUploadWait is EnterUploadCtx, but waits at most the given duration for an existing upload to exit
+func (t *UploadTracker) EnterUploadWait(ctx context.Context, uid UploadID, wait time.Duration) error {
+	ctx, cf := context.WithTimeout(ctx, wait)
+	defer cf()
+	return t.EnterUploadCtx(ctx, uid)
+}
+
+// EnterUploadCtx attempts to claim an upload ID, if an upload with the existing ID
+// exists it waits for that upload to exit.  If the context is done before the upload
+// ID can be claimed ErrUploadInProgress is returned.
+func (t *UploadTracker) EnterUploadCtx(ctx context.Context, uid UploadID) error {
+	for {
+		t.Lock()
+		up, ok := t.active[uid]
+		if !ok {
+			t.active[uid] = newUpload()
+			t.Unlock()
+			return nil
+		}
+		t.Unlock()
+		select {
+		case <-up.done:
+		case <-ctx.Done():
+			return ErrUploadInProgress
+		}
+	}
+}
+
 // ExitUpload releases an existing upload lock for a given shard
 // if the shard wasn't locked, and error is returned
 func (t *UploadTracker) ExitUpload(uid UploadID) (err error) {
 	t.Lock()
-	if _, ok := t.active[uid]; ok {
+	if up, ok := t.active[uid]; ok {
 		delete(t.active, uid)
+		close(up.done)
 	} else {
 		err = ErrUploadNotInProgress
 	}
 	t.Unlock()
 	return
 }
+
+// CountReader returns a reader which adds the bytes read from r to the byte counter of an
+// active upload, r is returned unchanged if the upload is not active
+func (t *UploadTracker) CountReader(uid UploadID, r io.Reader) io.Reader {
+	if up := t.get(uid); up != nil {
+		return &countReader{Reader: r, up: up}
+	}
+	return r
+}
+
+// CountWriter returns a writer which adds the bytes written to w to the byte counter of an
+// active upload, w is returned unchanged if the upload is not active
+func (t *UploadTracker) CountWriter(uid UploadID, w io.Writer) io.Writer {
+	if up := t.get(uid); up != nil {
+		return &countWriter{Writer: w, up: up}
+	}
+	return w
+}
+
+// ActiveUploads returns a snapshot of every active upload, oldest first
+func (t *UploadTracker) ActiveUploads() (r []UploadStatus) {
+	t.Lock()
+	r = make([]UploadStatus, 0, len(t.active))
+	for uid, up := range t.active {
+		r = append(r, UploadStatus{
+			UploadID: uid,
+			Start:    up.start,
+			Bytes:    atomic.LoadInt64(&up.bytes),
+		})
+	}
+	t.Unlock()
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Start.Before(r[j].Start)
+	})
+	return
+}
+
+func (t *UploadTracker) get(uid UploadID) (up *upload) {
+	t.Lock()
+	up = t.active[uid]
+	t.Unlock()
+	return
+}
+
+type countReader struct {
+	io.Reader
+	up *upload
+}
+
+func (cr *countReader) Read(b []byte) (n int, err error) {
+	n, err = cr.Reader.Read(b)
+	atomic.AddInt64(&cr.up.bytes, int64(n))
+	return
+}
+
+type countWriter struct {
+	io.Writer
+	up *upload
+}
+
+func (cw *countWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.Writer.Write(b)
+	atomic.AddInt64(&cw.up.bytes, int64(n))
+	return
+}
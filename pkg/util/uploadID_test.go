@@ -0,0 +1,105 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEnterUploadCtx(t *testing.T) {
+	ut := NewUploadTracker()
+	uid := UploadID{CID: 1, IdxUUID: uuid.New(), Well: `foo`, Shard: `769f2`}
+	if err := ut.EnterUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if err = ut.EnterUpload(uid); err != ErrUploadInProgress {
+		t.Fatalf("failed to catch duplicate upload: %v", err)
+	}
+
+	// an expired wait fails just like EnterUpload
+	ctx, cf := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err := ut.EnterUploadCtx(ctx, uid)
+	cf()
+	if err != ErrUploadInProgress {
+		t.Fatalf("failed to time out waiting on upload: %v", err)
+	}
+	if err = ut.EnterUploadWait(context.Background(), uid, 20*time.Millisecond); err != ErrUploadInProgress {
+		t.Fatalf("failed to time out waiting on upload: %v", err)
+	}
+
+	// a waiter claims the upload once it is released
+	errch := make(chan error, 1)
+	go func() {
+		ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cf()
+		errch <- ut.EnterUploadCtx(ctx, uid)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err = ut.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errch; err != nil {
+		t.Fatalf("waiter failed to claim upload: %v", err)
+	}
+	if err = ut.EnterUpload(uid); err != ErrUploadInProgress {
+		t.Fatalf("waiter did not hold upload: %v", err)
+	}
+	if err = ut.ExitUpload(uid); err != nil {
+		t.Fatal(err)
+	} else if err = ut.ExitUpload(uid); err != ErrUploadNotInProgress {
+		t.Fatalf("failed to catch double exit: %v", err)
+	}
+}
+
+func TestActiveUploads(t *testing.T) {
+	ut := NewUploadTracker()
+	a := UploadID{CID: 1, IdxUUID: uuid.New(), Well: `foo`, Shard: `769f2`}
+	b := UploadID{CID: 2, IdxUUID: uuid.New(), Well: `bar`, Shard: `769f3`}
+	if err := ut.EnterUpload(a); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := ut.EnterUpload(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, ut.CountReader(a, strings.NewReader(`hello`))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(ut.CountWriter(b, ioutil.Discard), `hello world`); err != nil {
+		t.Fatal(err)
+	}
+	act := ut.ActiveUploads()
+	if len(act) != 2 {
+		t.Fatalf("bad active count %d", len(act))
+	} else if act[0].UploadID != a || act[1].UploadID != b {
+		t.Fatalf("bad upload order: %+v", act)
+	} else if act[0].Bytes != 5 || act[1].Bytes != 11 {
+		t.Fatalf("bad byte counts: %d %d", act[0].Bytes, act[1].Bytes)
+	} else if act[0].Start.After(act[1].Start) {
+		t.Fatalf("bad start times: %v %v", act[0].Start, act[1].Start)
+	}
+
+	if err := ut.ExitUpload(a); err != nil {
+		t.Fatal(err)
+	}
+	if act = ut.ActiveUploads(); len(act) != 1 || act[0].UploadID != b {
+		t.Fatalf("bad active uploads after exit: %+v", act)
+	}
+	// inactive uploads are not counted
+	r := strings.NewReader(`x`)
+	if ut.CountReader(a, r) != r {
+		t.Fatal("wrapped reader for inactive upload")
+	}
+}
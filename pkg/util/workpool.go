@@ -0,0 +1,133 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	jobQueued int32 = iota
+	jobRunning
+	jobAbandoned
+)
+
+var (
+	ErrQueueFull      = errors.New("Too many requests waiting, try again later")
+	ErrWorkPoolClosed = errors.New("Work pool closed")
+)
+
+// WorkPool runs jobs on a fixed number of workers, jobs submitted while every worker is
+// busy wait in a bounded queue and are refused once it is full.  Backends use it so that
+// a burst of requests queues up rather than each opening its own session.
+type WorkPool struct {
+	sync.RWMutex
+	jobs    chan *poolJob
+	wg      sync.WaitGroup
+	closed  bool
+	running int32
+}
+
+type poolJob struct {
+	ctx   context.Context
+	fn    func() error
+	state int32
+	err   error
+	done  chan struct{}
+}
+
+// NewWorkPool starts a pool of workers with room for queue jobs to wait for them
+func NewWorkPool(workers, queue int) *WorkPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	wp := &WorkPool{
+		jobs: make(chan *poolJob, queue),
+	}
+	wp.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go wp.worker()
+	}
+	return wp
+}
+
+func (wp *WorkPool) worker() {
+	defer wp.wg.Done()
+	for j := range wp.jobs {
+		if !atomic.CompareAndSwapInt32(&j.state, jobQueued, jobRunning) {
+			continue //the submitter gave up while the job was queued
+		}
+		atomic.AddInt32(&wp.running, 1)
+		if j.err = j.ctx.Err(); j.err == nil {
+			j.err = j.fn()
+		}
+		atomic.AddInt32(&wp.running, -1)
+		close(j.done)
+	}
+}
+
+// Do runs fn on a worker and returns its error, it fails with ErrQueueFull if the queue has
+// no room.  If ctx is done while the job is waiting Do returns straight away, once the job
+// is running Do waits for fn to return, so fn must honor ctx itself.
+func (wp *WorkPool) Do(ctx context.Context, fn func() error) error {
+	j := &poolJob{
+		ctx:  ctx,
+		fn:   fn,
+		done: make(chan struct{}),
+	}
+	wp.RLock()
+	if wp.closed {
+		wp.RUnlock()
+		return ErrWorkPoolClosed
+	}
+	select {
+	case wp.jobs <- j:
+	default:
+		wp.RUnlock()
+		return ErrQueueFull
+	}
+	wp.RUnlock()
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&j.state, jobQueued, jobAbandoned) {
+			return ctx.Err()
+		}
+		<-j.done //already running, fn must finish before its caller can move on
+	}
+	return j.err
+}
+
+// Running returns the number of jobs currently running
+func (wp *WorkPool) Running() int {
+	return int(atomic.LoadInt32(&wp.running))
+}
+
+// Queued returns the number of jobs waiting for a worker
+func (wp *WorkPool) Queued() int {
+	return len(wp.jobs)
+}
+
+// Close stops the workers once they have finished the jobs already submitted
+func (wp *WorkPool) Close() {
+	wp.Lock()
+	if !wp.closed {
+		wp.closed = true
+		close(wp.jobs)
+	}
+	wp.Unlock()
+	wp.wg.Wait()
+}
@@ -0,0 +1,72 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorkPool(t *testing.T) {
+	wp := NewWorkPool(1, 1)
+	defer wp.Close()
+	ctx := context.Background()
+
+	//occupy the only worker
+	block := make(chan struct{})
+	started := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		first <- wp.Do(ctx, func() error {
+			close(started)
+			<-block
+			return errors.New("first")
+		})
+	}()
+	<-started
+
+	//one job may wait, the next is refused
+	qctx, qcf := context.WithCancel(ctx)
+	queued := make(chan error, 1)
+	var ran bool
+	go func() {
+		queued <- wp.Do(qctx, func() error {
+			ran = true
+			return nil
+		})
+	}()
+	for wp.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := wp.Do(ctx, func() error { return nil }); err != ErrQueueFull {
+		t.Fatalf("full queue accepted a job: %v", err)
+	}
+
+	//giving up on a queued job returns straight away and the job never runs
+	qcf()
+	if err := <-queued; err != context.Canceled {
+		t.Fatalf("abandoned job returned %v", err)
+	}
+	close(block)
+	if err := <-first; err == nil || err.Error() != `first` {
+		t.Fatalf("job error lost: %v", err)
+	}
+	if err := wp.Do(ctx, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	} else if ran {
+		t.Fatal("abandoned job ran")
+	}
+
+	wp.Close()
+	if err := wp.Do(ctx, func() error { return nil }); err != ErrWorkPoolClosed {
+		t.Fatalf("closed pool accepted a job: %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrNotAdmin         = errors.New("Credentials are not an administrator's")
+	ErrNoUserManagement = errors.New("Authentication module does not support user management")
+	ErrAdminDeleteSelf  = errors.New("Administrators may not delete their own account")
+	ErrAdminDemoteSelf  = errors.New("Administrators may not lock their own account or give up the admin role")
+	ErrNoUserEditing    = errors.New("Authentication module does not support changing customer accounts")
+	ErrMissingUserID    = errors.New("Missing user ID")
+	ErrNoReencrypt      = errors.New("Storage backend does not support re-encrypting shards in place")
+)
+
+// UserManager is an optional interface an Authenticator may implement so that
+// administrators can create, delete, and reset the passwords of customers over the HTTP API
+type UserManager interface {
+	ListUsers() ([]auth.UserInfo, error)
+	GetUser(cid uint64) (auth.UserInfo, error)
+	AddUserWithMetadata(cid uint64, passwd string, cost int, md auth.Metadata) error
+	DeleteUser(cid uint64) error
+	ChangePassword(cid uint64, passwd string) error
+}
+
+// UserEditor is an optional interface an Authenticator may implement so that administrators
+// can change customers' accounts and import customers over the HTTP API
+type UserEditor interface {
+	SetMetadata(cid uint64, md auth.Metadata) error
+	SetDisabled(cid uint64, disabled bool) error
+	SetTOTPSecret(cid uint64, secret string) error
+	SetIndexers(cid uint64, indexers []uuid.UUID) error
+	SetRole(cid uint64, role string) error
+	SetQuota(cid uint64, quota uint64) error
+	ImportUsers(ius []auth.ImportUser, cost int) error
+}
+
+// AdminUserRequest creates a customer or resets a customer's password.
+// A blank Password has the server generate one, which is returned once in the AdminUserResponse.
+type AdminUserRequest struct {
+	ID       uint64 `json:",omitempty"` // only used when creating a customer
+	Password string `json:",omitempty"`
+	auth.Metadata
+}
+
+// AdminUserResponse reports the customer created or reset along with any generated password
+type AdminUserResponse struct {
+	ID       uint64
+	Password string `json:",omitempty"`
+}
+
+// AdminUserUpdate changes a customer's account, only the fields which are given are changed
+type AdminUserUpdate struct {
+	Description *string      `json:",omitempty"`
+	Email       *string      `json:",omitempty"`
+	Disabled    *bool        `json:",omitempty"`
+	Role        *string      `json:",omitempty"`
+	Quota       *uint64      `json:",omitempty"` // zero removes the quota
+	Indexers    *[]uuid.UUID `json:",omitempty"` // an empty list allows any indexer
+	TOTPSecret  *string      `json:",omitempty"` // base32 encoded, empty disables TOTP
+}
+
+// AdminReencryptRequest starts a re-encryption pass, a dry run only counts the shards which would be rewritten
+type AdminReencryptRequest struct {
+	DryRun bool
+}
+
+// AuthAdminUser ensures the user is authenticated and holds the admin role.  The role is
+// checked against the authentication module, so an administrator demoted since logging in is refused.
+func (w *Webserver) AuthAdminUser(res http.ResponseWriter, req *http.Request) (cust *CustomerDetails) {
+	if cust = w.AuthUser(res, req); cust == nil {
+		return
+	}
+	role := auth.RoleFull
+	if rp, ok := w.authModule.(RoleProvider); ok {
+		var err error
+		if role, err = rp.UserRole(cust.CustomerNumber); err != nil {
+			serverFail(res, err)
+			return nil
+		}
+	}
+	if cust.Role != auth.RoleAdmin || role != auth.RoleAdmin {
+		w.lgr.Info("AuthAdminUser forbidden", log.KV("cid", cust.CustomerNumber), log.KV("role", role))
+		serverForbidden(res, ErrNotAdmin)
+		cust = nil
+	}
+	return
+}
+
+// userManager returns the authentication module's user management, answering 501 if it has none
+func (w *Webserver) userManager(res http.ResponseWriter) (um UserManager, ok bool) {
+	if um, ok = w.authModule.(UserManager); !ok {
+		serverNotImplemented(res, ErrNoUserManagement)
+	}
+	return
+}
+
+func (w *Webserver) adminListUsers(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	um, ok := w.userManager(res)
+	if !ok {
+		return
+	}
+	uis, err := um.ListUsers()
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	sendObject(res, uis)
+}
+
+func (w *Webserver) adminGetUser(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	um, ok := w.userManager(res)
+	if !ok {
+		return
+	}
+	ui, err := um.GetUser(custID)
+	if err != nil {
+		sendUserError(res, err)
+		return
+	}
+	sendObject(res, ui)
+}
+
+func (w *Webserver) adminAddUser(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	var aur AdminUserRequest
+	if err := getObject(req, &aur); err != nil {
+		serverInvalid(res, err)
+		return
+	} else if aur.ID == 0 {
+		serverInvalid(res, ErrMissingUserID)
+		return
+	}
+	um, ok := w.userManager(res)
+	if !ok {
+		return
+	}
+	resp := AdminUserResponse{ID: aur.ID}
+	pass, err := adminPassword(aur, &resp)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	//a zero cost hashes at the server's configured password cost
+	if err = um.AddUserWithMetadata(aur.ID, pass, 0, aur.Metadata); err != nil {
+		w.lgr.Error("Failed to add user", log.KV("admin", cust.CustomerNumber), log.KV("cid", aur.ID), log.KVErr(err))
+		sendUserError(res, err)
+		return
+	}
+	w.lgr.Info("User added", log.KV("admin", cust.CustomerNumber), log.KV("cid", aur.ID))
+	sendObject(res, resp)
+}
+
+func (w *Webserver) adminDeleteUser(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	} else if custID == cust.CustomerNumber {
+		//an administrator deleting itself could leave nobody able to manage users
+		serverInvalid(res, ErrAdminDeleteSelf)
+		return
+	}
+	um, ok := w.userManager(res)
+	if !ok {
+		return
+	}
+	if err = um.DeleteUser(custID); err != nil {
+		w.lgr.Error("Failed to delete user", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID), log.KVErr(err))
+		sendUserError(res, err)
+		return
+	}
+	w.lgr.Info("User deleted", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID))
+}
+
+func (w *Webserver) adminResetPassword(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	//an empty body asks for a generated password
+	var aur AdminUserRequest
+	if err = getObject(req, &aur); err != nil && err != io.EOF {
+		serverInvalid(res, err)
+		return
+	}
+	um, ok := w.userManager(res)
+	if !ok {
+		return
+	}
+	resp := AdminUserResponse{ID: custID}
+	pass, err := adminPassword(aur, &resp)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	if err = um.ChangePassword(custID, pass); err != nil {
+		w.lgr.Error("Failed to reset password", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID), log.KVErr(err))
+		sendUserError(res, err)
+		return
+	}
+	w.lgr.Info("User password reset", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID))
+	sendObject(res, resp)
+}
+
+// adminReencrypt runs a re-encryption pass and answers with its result once it finishes.
+// Shards are rewritten one at a time while the store stays in use, a pass which is
+// interrupted by the request going away can simply be started again.
+func (w *Webserver) adminReencrypt(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	var arr AdminReencryptRequest
+	if err := getObject(req, &arr); err != nil && err != io.EOF {
+		serverInvalid(res, err)
+		return
+	}
+	re, ok := w.shardHandler.(ShardReencrypter)
+	if !ok {
+		serverNotImplemented(res, ErrNoReencrypt)
+		return
+	} else if w.readOnly && !arr.DryRun {
+		sendError(res, ErrArchiveReadOnly, http.StatusServiceUnavailable)
+		return
+	}
+	w.lgr.Info("Re-encryption started", log.KV("admin", cust.CustomerNumber), log.KV("dryrun", arr.DryRun))
+	r, err := re.Reencrypt(req.Context(), arr.DryRun)
+	if errors.Is(err, util.ErrReencryptRunning) {
+		sendError(res, err, http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrNoReencrypt) {
+		serverNotImplemented(res, err)
+		return
+	} else if err != nil {
+		w.lgr.Error("Re-encryption failed", log.KV("admin", cust.CustomerNumber), log.KVErr(err))
+		serverFail(res, err)
+		return
+	}
+	w.lgr.Info("Re-encryption finished", log.KV("admin", cust.CustomerNumber), log.KV("checked", r.Checked),
+		log.KV("shards", r.Reencrypted), log.KV("files", r.Files), log.KV("skipped", r.Skipped))
+	sendObject(res, r)
+}
+
+// userEditor returns the authentication module's account editing, answering 501 if it has none
+func (w *Webserver) userEditor(res http.ResponseWriter) (ue UserEditor, ok bool) {
+	if ue, ok = w.authModule.(UserEditor); !ok {
+		serverNotImplemented(res, ErrNoUserEditing)
+	}
+	return
+}
+
+// adminUpdateUser applies the given changes to a customer's account and answers with the
+// updated account.  The request is checked before anything is changed, but the changes are
+// applied one at a time so a failure part way leaves the earlier ones in place.
+func (w *Webserver) adminUpdateUser(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	var auu AdminUserUpdate
+	if err = getObject(req, &auu); err != nil {
+		serverInvalid(res, err)
+		return
+	} else if auu.Role != nil && !auth.ValidRole(*auu.Role) {
+		serverInvalid(res, auth.ErrInvalidRole)
+		return
+	} else if custID == cust.CustomerNumber && ((auu.Disabled != nil && *auu.Disabled) || (auu.Role != nil && *auu.Role != auth.RoleAdmin)) {
+		//as with deleting, an administrator locking itself out could leave nobody able to manage users
+		serverInvalid(res, ErrAdminDemoteSelf)
+		return
+	}
+	um, ok := w.userManager(res)
+	if !ok {
+		return
+	}
+	ue, ok := w.userEditor(res)
+	if !ok {
+		return
+	}
+	ui, err := um.GetUser(custID)
+	if err != nil {
+		sendUserError(res, err)
+		return
+	}
+	md := ui.Metadata
+	if auu.Description != nil {
+		md.Description = *auu.Description
+	}
+	if auu.Email != nil {
+		md.Email = *auu.Email
+	}
+	if auu.Description != nil || auu.Email != nil {
+		err = ue.SetMetadata(custID, md)
+	}
+	if err == nil && auu.Disabled != nil {
+		err = ue.SetDisabled(custID, *auu.Disabled)
+	}
+	if err == nil && auu.Role != nil {
+		err = ue.SetRole(custID, *auu.Role)
+	}
+	if err == nil && auu.Quota != nil {
+		err = ue.SetQuota(custID, *auu.Quota)
+	}
+	if err == nil && auu.Indexers != nil {
+		err = ue.SetIndexers(custID, *auu.Indexers)
+	}
+	if err == nil && auu.TOTPSecret != nil {
+		err = ue.SetTOTPSecret(custID, *auu.TOTPSecret)
+	}
+	if err != nil {
+		w.lgr.Error("Failed to update user", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID), log.KVErr(err))
+		sendUserError(res, err)
+		return
+	}
+	w.lgr.Info("User updated", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID))
+	if ui, err = um.GetUser(custID); err != nil {
+		sendUserError(res, err)
+		return
+	}
+	sendObject(res, ui)
+}
+
+// adminImportUsers adds every customer in the request or none of them, customers may be
+// given either a password or a bcrypt hash of one
+func (w *Webserver) adminImportUsers(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	var ius []auth.ImportUser
+	if err := getObject(req, &ius); err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	ue, ok := w.userEditor(res)
+	if !ok {
+		return
+	}
+	//a zero cost hashes passwords at the server's configured password cost
+	if err := ue.ImportUsers(ius, 0); err != nil {
+		w.lgr.Error("Failed to import users", log.KV("admin", cust.CustomerNumber), log.KV("count", len(ius)), log.KVErr(err))
+		if errors.Is(err, auth.ErrCustnumExists) {
+			sendError(res, err, http.StatusConflict)
+		} else {
+			//anything else wrong with an import is a problem with the records given
+			serverInvalid(res, err)
+		}
+		return
+	}
+	w.lgr.Info("Users imported", log.KV("admin", cust.CustomerNumber), log.KV("count", len(ius)))
+}
+
+// adminPassword returns the requested password, generating one and placing it in the response if none was given
+func adminPassword(aur AdminUserRequest, resp *AdminUserResponse) (pass string, err error) {
+	if pass = aur.Password; pass == `` {
+		if pass, err = auth.GeneratePassword(auth.DefaultPasswordLength); err == nil {
+			resp.Password = pass
+		}
+	}
+	return
+}
+
+// sendUserError answers with the status matching a user management error
+func sendUserError(res http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrNotFound) {
+		serverNotFound(res, err)
+	} else if errors.Is(err, auth.ErrCustnumExists) {
+		sendError(res, err, http.StatusConflict)
+	} else if errors.Is(err, auth.ErrInvalidRole) || errors.Is(err, auth.ErrInvalidTOTPSecret) {
+		serverInvalid(res, err)
+	} else {
+		serverFail(res, err)
+	}
+}
@@ -0,0 +1,326 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestAdminUsers(t *testing.T) {
+	am, err := auth.NewAuthModule(filepath.Join(t.TempDir(), `passwd`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.SetCost(8)
+	for _, id := range []uint64{1, 2} {
+		if err = am.AddUser(id, `password`, 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = am.SetRole(1, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		authModule:    am,
+	}
+	if err = w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := w.generateLoginToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := w.generateLoginToken(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, tok, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(jwtAuthHeader, `Bearer `+tok)
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//only administrators may manage users
+	if rec := do(http.MethodGet, ADMIN_USERS_PATH, full, ``); rec.Code != http.StatusForbidden {
+		t.Fatalf("full user listed users with %d", rec.Code)
+	}
+	var uis []auth.UserInfo
+	if rec := do(http.MethodGet, ADMIN_USERS_PATH, admin, ``); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &uis); err != nil {
+		t.Fatal(err)
+	} else if len(uis) != 2 || uis[0].Role != auth.RoleAdmin {
+		t.Fatalf("bad users %+v", uis)
+	}
+
+	//creating a user without a password returns a generated one
+	var aur AdminUserResponse
+	if rec := do(http.MethodPost, ADMIN_USERS_PATH, admin, `{"ID":3,"Email":"ops@example.org"}`); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d %s", rec.Code, rec.Body.String())
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &aur); err != nil {
+		t.Fatal(err)
+	} else if aur.ID != 3 || aur.Password == `` {
+		t.Fatalf("bad response %+v", aur)
+	} else if _, err = am.Authenticate(`3`, aur.Password); err != nil {
+		t.Fatalf("generated password refused: %v", err)
+	}
+	if rec := do(http.MethodPost, ADMIN_USERS_PATH, admin, `{"ID":3,"Password":"x"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate user answered %d", rec.Code)
+	}
+
+	//a given password is set and not echoed back
+	aur = AdminUserResponse{}
+	if rec := do(http.MethodPut, apiPath(APIv2, `/api/admin/users/3/password`), admin, `{"Password":"hunter22"}`); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d %s", rec.Code, rec.Body.String())
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &aur); err != nil {
+		t.Fatal(err)
+	} else if aur.Password != `` {
+		t.Fatal("requested password echoed back")
+	} else if _, err = am.Authenticate(`3`, `hunter22`); err != nil {
+		t.Fatalf("reset password refused: %v", err)
+	}
+	if rec := do(http.MethodPut, `/api/admin/users/4/password`, admin, ``); rec.Code != http.StatusNotFound {
+		t.Fatalf("reset of missing user answered %d", rec.Code)
+	}
+
+	var ui auth.UserInfo
+	if rec := do(http.MethodGet, `/api/admin/users/3`, admin, ``); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &ui); err != nil {
+		t.Fatal(err)
+	} else if ui.ID != 3 || ui.Email != `ops@example.org` {
+		t.Fatalf("bad user %+v", ui)
+	}
+
+	if rec := do(http.MethodDelete, `/api/admin/users/1`, admin, ``); rec.Code != http.StatusBadRequest {
+		t.Fatalf("admin deleted itself with %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, `/api/admin/users/3`, admin, ``); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, `/api/admin/users/3`, admin, ``); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleted user answered %d", rec.Code)
+	}
+
+	//a token claiming the admin role is refused once the user is demoted
+	forged, err := w.generateToken(2, jwt.MapClaims{roleClaim: auth.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodGet, ADMIN_USERS_PATH, forged, ``); rec.Code != http.StatusForbidden {
+		t.Fatalf("stale admin token answered %d", rec.Code)
+	}
+	//administrators keep full access to their own data
+	if cust, err := w.decodeJWTToken(admin); err != nil || cust.ReadOnly() {
+		t.Fatalf("admin credentials are read-only %+v %v", cust, err)
+	}
+}
+
+// reencryptBackend records the re-encryption passes it is asked to run
+type reencryptBackend struct {
+	ShardHandler
+	dryRuns []bool
+	err     error
+}
+
+func (rb *reencryptBackend) Reencrypt(ctx context.Context, dryRun bool) (util.ReencryptResult, error) {
+	rb.dryRuns = append(rb.dryRuns, dryRun)
+	return util.ReencryptResult{Checked: 3, Reencrypted: 1, Files: 2}, rb.err
+}
+
+func TestAdminReencrypt(t *testing.T) {
+	am, err := auth.NewAuthModule(filepath.Join(t.TempDir(), `passwd`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.SetCost(8)
+	for _, id := range []uint64{1, 2} {
+		if err = am.AddUser(id, `password`, 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = am.SetRole(1, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	rb := &reencryptBackend{}
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		authModule:    am,
+		shardHandler:  rb,
+	}
+	if err = w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := w.generateLoginToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := w.generateLoginToken(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(tok, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, ADMIN_REKEY_PATH, strings.NewReader(body))
+		req.Header.Set(jwtAuthHeader, `Bearer `+tok)
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(full, ``); rec.Code != http.StatusForbidden {
+		t.Fatalf("full user re-encrypted with %d", rec.Code)
+	}
+	var res util.ReencryptResult
+	if rec := do(admin, ``); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d %s", rec.Code, rec.Body.String())
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	} else if res.Checked != 3 || res.Reencrypted != 1 || res.Files != 2 {
+		t.Fatalf("bad result %+v", res)
+	}
+	if rec := do(admin, `{"DryRun":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if len(rb.dryRuns) != 2 || rb.dryRuns[0] || !rb.dryRuns[1] {
+		t.Fatalf("bad passes %v", rb.dryRuns)
+	}
+
+	//only dry runs are allowed while the archive is read-only
+	w.readOnly = true
+	if rec := do(admin, ``); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("read-only archive re-encrypted with %d", rec.Code)
+	} else if rec = do(admin, `{"DryRun":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("read-only dry run answered %d", rec.Code)
+	}
+	w.readOnly = false
+
+	rb.err = util.ErrReencryptRunning
+	if rec := do(admin, ``); rec.Code != http.StatusConflict {
+		t.Fatalf("concurrent pass answered %d", rec.Code)
+	}
+	rb.err = ErrNoReencrypt
+	if rec := do(admin, ``); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("unsupported backend answered %d", rec.Code)
+	}
+}
+
+func TestAdminUpdateUser(t *testing.T) {
+	am, err := auth.NewAuthModule(filepath.Join(t.TempDir(), `passwd`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.SetCost(8)
+	for _, id := range []uint64{1, 2} {
+		if err = am.AddUser(id, `password`, 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = am.SetRole(1, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		authModule:    am,
+	}
+	if err = w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := w.generateLoginToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(jwtAuthHeader, `Bearer `+admin)
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//only the given fields change
+	guid := uuid.New()
+	var ui auth.UserInfo
+	body := `{"Email":"ops@example.org","Disabled":true,"Role":"readonly","Quota":1024,"Indexers":["` + guid.String() + `"]}`
+	if rec := do(http.MethodPatch, `/api/admin/users/2`, body); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d %s", rec.Code, rec.Body.String())
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &ui); err != nil {
+		t.Fatal(err)
+	} else if ui.Email != `ops@example.org` || !ui.Disabled || ui.Role != auth.RoleReadOnly || ui.Quota != 1024 ||
+		len(ui.Indexers) != 1 || ui.Indexers[0] != guid || ui.TOTP {
+		t.Fatalf("bad user %+v", ui)
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodPatch, `/api/admin/users/2`, `{"Disabled":false,"Indexers":[],"TOTPSecret":"`+secret+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d %s", rec.Code, rec.Body.String())
+	} else if ui, err = am.GetUser(2); err != nil {
+		t.Fatal(err)
+	} else if ui.Disabled || len(ui.Indexers) != 0 || !ui.TOTP || ui.Email != `ops@example.org` || ui.Quota != 1024 {
+		t.Fatalf("bad user %+v", ui)
+	}
+
+	for _, c := range []struct {
+		path, body string
+		code       int
+	}{
+		{`/api/admin/users/2`, `{"Role":"root"}`, http.StatusBadRequest},
+		{`/api/admin/users/2`, `{"TOTPSecret":"not base32!"}`, http.StatusBadRequest},
+		{`/api/admin/users/3`, `{"Quota":1}`, http.StatusNotFound},
+		{`/api/admin/users/1`, `{"Disabled":true}`, http.StatusBadRequest},
+		{`/api/admin/users/1`, `{"Role":"full"}`, http.StatusBadRequest},
+	} {
+		if rec := do(http.MethodPatch, c.path, c.body); rec.Code != c.code {
+			t.Fatalf("%s %s answered %d, expected %d", c.path, c.body, rec.Code, c.code)
+		}
+	}
+	if ui, err = am.GetUser(1); err != nil || ui.Disabled || ui.Role != auth.RoleAdmin {
+		t.Fatalf("admin changed itself %+v %v", ui, err)
+	}
+
+	//imports are all or nothing
+	if rec := do(http.MethodPost, ADMIN_IMPORT_PATH, `[{"ID":3,"Password":"pass3"},{"ID":2,"Password":"pass2"}]`); rec.Code != http.StatusConflict {
+		t.Fatalf("import of existing user answered %d", rec.Code)
+	} else if _, err = am.GetUser(3); err == nil {
+		t.Fatal("partial import")
+	}
+	if rec := do(http.MethodPost, ADMIN_IMPORT_PATH, `[{"ID":3}]`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("import without a password answered %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, ADMIN_IMPORT_PATH, `[{"ID":3,"Password":"pass3"},{"ID":4,"Password":"pass4","Email":"four@example.org"}]`); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d %s", rec.Code, rec.Body.String())
+	} else if _, err = am.Authenticate(`4`, `pass4`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,27 +13,93 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 	"github.com/gravwell/gravwell/v3/ingest/log"
 )
 
 const (
-	jwtAuthHeader string = `Authorization`
+	jwtAuthHeader    string = `Authorization`
+	totpPendingClaim string = `TOTPPending`
+	roleClaim        string = `Role`
+
+	totpChallengeTimeout = 2 * time.Minute
+
+	defaultTokenIssuer   = `cloudarchive`
+	defaultTokenAudience = `cloudarchive`
 )
 
 var (
-	ErrMissingJWTToken = errors.New("Missing JWT token")
+	ErrMissingJWTToken   = errors.New("Missing JWT token")
+	ErrIndexerNotAllowed = errors.New("Indexer is not authorized for this customer")
+	ErrReadOnly          = errors.New("Credentials are read-only")
 )
 
 type CustomerDetails struct {
 	CustomerNumber uint64
+	Indexers       []uuid.UUID // indexers the customer is restricted to, empty allows any
+	Role           string      // auth.RoleFull, auth.RoleReadOnly, or auth.RoleAdmin
+	Quota          uint64      // storage quota in bytes, zero is unlimited
+}
+
+// ReadOnly returns true if the customer's credentials may not push shards or modify tags
+func (cd *CustomerDetails) ReadOnly() bool {
+	return cd.Role != auth.RoleFull && cd.Role != auth.RoleAdmin
+}
+
+// IndexerAllowed returns true if the customer may push and pull shards for the given indexer
+func (cd *CustomerDetails) IndexerAllowed(guid uuid.UUID) bool {
+	if len(cd.Indexers) == 0 {
+		return true
+	}
+	for _, id := range cd.Indexers {
+		if id == guid {
+			return true
+		}
+	}
+	return false
 }
 
 type Authenticator interface {
 	Authenticate(custnum, passwd string) (cid uint64, err error)
 }
 
+// TOTPAuthenticator is an optional interface an Authenticator may implement
+// to require a second TOTP factor for users which have it enabled
+type TOTPAuthenticator interface {
+	TOTPEnabled(cid uint64) (bool, error)
+	ValidateTOTP(cid uint64, code string) error
+}
+
+// UserStatusChecker is an optional interface an Authenticator may implement
+// so that tokens issued to a user are rejected once the user is disabled
+type UserStatusChecker interface {
+	UserDisabled(cid uint64) (bool, error)
+}
+
+// RoleProvider is an optional interface an Authenticator may implement
+// to assign credential roles, users of Authenticators without it have full access
+type RoleProvider interface {
+	UserRole(cid uint64) (string, error)
+}
+
+// QuotaProvider is an optional interface an Authenticator may implement
+// to limit the amount of storage each customer may consume
+type QuotaProvider interface {
+	UserQuota(cid uint64) (uint64, error)
+}
+
+// IndexerAuthorizer is an optional interface an Authenticator may implement
+// to restrict customers to an allowlist of indexer UUIDs
+type IndexerAuthorizer interface {
+	AllowedIndexers(cid uint64) ([]uuid.UUID, error)
+}
+
 // AuthUser ensures the user is authenticated and allows the mux to continue
 func (w *Webserver) AuthUser(res http.ResponseWriter, req *http.Request) (cust *CustomerDetails) {
 	var err error
@@ -45,25 +111,81 @@ func (w *Webserver) AuthUser(res http.ResponseWriter, req *http.Request) (cust *
 	return
 }
 
+// AuthFullUser ensures the user is authenticated and holds credentials which may modify data
+func (w *Webserver) AuthFullUser(res http.ResponseWriter, req *http.Request) (cust *CustomerDetails) {
+	if cust = w.AuthUser(res, req); cust != nil && cust.ReadOnly() {
+		w.lgr.Info("AuthFullUser forbidden", log.KV("cid", cust.CustomerNumber), log.KV("role", cust.Role))
+		serverForbidden(res, ErrReadOnly)
+		cust = nil
+	}
+	return
+}
+
 func (w *Webserver) authRequest(req *http.Request) (cust *CustomerDetails, err error) {
 	tok, err := w.getJWTToken(req)
 	if err != nil {
 		return nil, err
 	}
+	return w.authToken(tok)
+}
+
+// authToken validates a session token and looks up the current details of its customer
+func (w *Webserver) authToken(tok string) (cust *CustomerDetails, err error) {
 	if cust, err = w.decodeJWTToken(tok); err != nil {
 		return nil, err
+	} else if cust == nil {
+		return nil, errors.New("Invalid token claims")
+	}
+	if err = w.lookupCustomer(cust); err != nil {
+		return nil, err
 	}
-
 	return cust, nil
 }
 
+// lookupCustomer fills in the current role, quota, and indexer restrictions of a customer,
+// failing if the customer has been disabled.  The role in a session token is only what it
+// was at login, so a credential which has since been demoted loses access straight away.
+func (w *Webserver) lookupCustomer(cust *CustomerDetails) (err error) {
+	if usc, ok := w.authModule.(UserStatusChecker); ok {
+		var disabled bool
+		if disabled, err = usc.UserDisabled(cust.CustomerNumber); err != nil {
+			return
+		} else if disabled {
+			return auth.ErrUserDisabled
+		}
+	}
+	if rp, ok := w.authModule.(RoleProvider); ok {
+		if cust.Role, err = rp.UserRole(cust.CustomerNumber); err != nil {
+			return
+		} else if !auth.ValidRole(cust.Role) {
+			return auth.ErrInvalidRole
+		}
+	}
+	if qp, ok := w.authModule.(QuotaProvider); ok {
+		if cust.Quota, err = qp.UserQuota(cust.CustomerNumber); err != nil {
+			return
+		}
+	}
+	if ia, ok := w.authModule.(IndexerAuthorizer); ok {
+		if cust.Indexers, err = ia.AllowedIndexers(cust.CustomerNumber); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (w *Webserver) getJWTToken(req *http.Request) (tok string, err error) {
-	var n int
 	if tok = req.Header.Get(jwtAuthHeader); tok == `` {
 		err = ErrMissingJWTToken
 		return
 	}
-	if n, err = fmt.Sscanf(tok, "Bearer %s", &tok); err != nil {
+	return parseBearer(tok)
+}
+
+// parseBearer extracts the token from an authorization value of the form "Bearer <token>"
+func parseBearer(v string) (tok string, err error) {
+	var n int
+	if n, err = fmt.Sscanf(v, "Bearer %s", &tok); err != nil {
 		return
 	} else if n != 1 {
 		err = ErrMissingJWTToken
@@ -73,6 +195,39 @@ func (w *Webserver) getJWTToken(req *http.Request) (tok string, err error) {
 }
 
 func (w *Webserver) decodeJWTToken(tok string) (cust *CustomerDetails, err error) {
+	var claims jwt.MapClaims
+	if claims, err = w.parseJWTToken(tok); err != nil {
+		return
+	}
+	//challenge tokens handed out during a TOTP login are not valid for API access
+	if _, ok := claims[totpPendingClaim]; ok {
+		err = errors.New("Token is pending a TOTP code")
+		return
+	}
+	//nor are the tokens in signed download URLs
+	if _, ok := claims[signedPullClaim]; ok {
+		err = errors.New("Token is a signed download URL")
+		return
+	}
+	var custNum uint64
+	if custNum, err = claimsCustomerNumber(claims); err != nil {
+		return
+	}
+	cust = &CustomerDetails{
+		CustomerNumber: custNum,
+		Role:           auth.RoleFull,
+	}
+	if v, ok := claims[roleClaim]; ok {
+		if cust.Role, ok = v.(string); !ok || !auth.ValidRole(cust.Role) {
+			cust = nil
+			err = errors.New("Invalid role in token claims")
+		}
+	}
+	return
+}
+
+// parseJWTToken validates the signature and standard claims on a token and returns the claims
+func (w *Webserver) parseJWTToken(tok string) (claims jwt.MapClaims, err error) {
 	var token *jwt.Token
 	token, err = jwt.Parse(tok, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
@@ -87,20 +242,152 @@ func (w *Webserver) decodeJWTToken(tok string) (cust *CustomerDetails, err error
 		return
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		cn, ok := claims["CustomerNumber"]
-		if !ok {
-			err = errors.New("No customer number in token claims")
-		}
-		custNum, ok := cn.(float64)
-		if !ok {
-			err = errors.New("Customer number could not be converted to a float64")
+	var ok bool
+	if claims, ok = token.Claims.(jwt.MapClaims); !ok || !token.Valid {
+		err = errors.New("Invalid token claims")
+		return
+	}
+	//tokens must name this server, so one signed elsewhere with the same key cannot be replayed here
+	now := jwt.TimeFunc().Unix()
+	if !claims.VerifyIssuer(w.tokenIssuer, true) {
+		err = errors.New("Invalid token issuer")
+	} else if !claims.VerifyAudience(w.tokenAudience, true) {
+		err = errors.New("Invalid token audience")
+	} else if !claims.VerifyIssuedAt(now, true) {
+		err = errors.New("Invalid token issue time")
+	} else if !claims.VerifyNotBefore(now, true) {
+		err = errors.New("Token is not valid yet")
+	}
+	if err != nil {
+		claims = nil
+	}
+	return
+}
+
+func claimsCustomerNumber(claims jwt.MapClaims) (uint64, error) {
+	cn, ok := claims["CustomerNumber"]
+	if !ok {
+		return 0, errors.New("No customer number in token claims")
+	}
+	custNum, ok := cn.(float64)
+	if !ok {
+		return 0, errors.New("Customer number could not be converted to a float64")
+	}
+	return uint64(custNum), nil
+}
+
+// generateToken signs a token for the given customer, adding any extra claims
+func (w *Webserver) generateToken(cid uint64, extra jwt.MapClaims) (string, error) {
+	now := jwt.TimeFunc().Unix()
+	claims := jwt.MapClaims{
+		"CustomerNumber": cid,
+		"iss":            w.tokenIssuer,
+		"aud":            w.tokenAudience,
+		"iat":            now,
+		"nbf":            now,
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	// Create a new token object, specifying signing method and the claims
+	// you would like it to contain.
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	// Sign and get the complete encoded token as a string using the secret
+	return token.SignedString(w.hmacSecret)
+}
+
+// generateLoginToken signs a session token for a fully authenticated customer, including its role
+func (w *Webserver) generateLoginToken(cid uint64) (string, error) {
+	role := auth.RoleFull
+	if rp, ok := w.authModule.(RoleProvider); ok {
+		var err error
+		if role, err = rp.UserRole(cid); err != nil {
+			return ``, err
 		}
-		cust = &CustomerDetails{CustomerNumber: uint64(custNum)}
 	}
+	return w.generateToken(cid, jwt.MapClaims{roleClaim: role})
+}
+
+// totpChallenge returns a challenge token if the customer must provide a TOTP code to
+// complete a login, an empty challenge means the login is already complete
+func (w *Webserver) totpChallenge(cid uint64) (challenge string, err error) {
+	ta, ok := w.authModule.(TOTPAuthenticator)
+	if !ok {
+		return
+	}
+	var enabled bool
+	if enabled, err = ta.TOTPEnabled(cid); err != nil || !enabled {
+		return
+	}
+	challenge, err = w.generateToken(cid, jwt.MapClaims{
+		totpPendingClaim: true,
+		"exp":            time.Now().Add(totpChallengeTimeout).Unix(),
+		"jti":            uuid.New().String(),
+	})
 	return
 }
 
+// validateTOTPChallenge checks a TOTP code against the challenge token handed out by the
+// first step of a login and returns the customer the challenge was issued to
+func (w *Webserver) validateTOTPChallenge(challenge, code string) (cid uint64, err error) {
+	ta, ok := w.authModule.(TOTPAuthenticator)
+	if !ok {
+		err = errors.New("TOTP is not supported")
+		return
+	}
+	var claims jwt.MapClaims
+	if claims, err = w.parseJWTToken(challenge); err != nil {
+		return
+	} else if pending, ok := claims[totpPendingClaim].(bool); !ok || !pending {
+		err = errors.New("Token is not a TOTP challenge")
+		return
+	}
+	if cid, err = claimsCustomerNumber(claims); err != nil {
+		return
+	}
+	//a challenge gets a single attempt, so it can neither be replayed nor used to guess codes
+	jti, _ := claims["jti"].(string)
+	if !w.challenges.use(jti, time.Now()) {
+		err = errors.New("TOTP challenge has already been used")
+		w.lgr.Info("Reused TOTP challenge", log.KV("cid", cid))
+		return
+	}
+	if err = ta.ValidateTOTP(cid, code); err != nil {
+		w.lgr.Info("Invalid TOTP code", log.KV("cid", cid), log.KVErr(err))
+	}
+	return
+}
+
+// challengeSet holds the IDs of TOTP challenges which have been used until they expire
+type challengeSet struct {
+	sync.Mutex
+	used map[string]time.Time //challenge ID to the time it expires
+}
+
+// use marks a challenge as used, returning false if it was already used or has no ID
+func (cs *challengeSet) use(jti string, now time.Time) bool {
+	if jti == `` {
+		return false
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.used == nil {
+		cs.used = map[string]time.Time{}
+	}
+	for k, exp := range cs.used {
+		if now.After(exp) {
+			delete(cs.used, k)
+		}
+	}
+	if _, ok := cs.used[jti]; ok {
+		return false
+	}
+	//challenges are refused once they expire, so they need only be held until then
+	cs.used[jti] = now.Add(totpChallengeTimeout)
+	return true
+}
+
 type loginType struct {
 	User string
 	Pass string
@@ -109,6 +396,9 @@ type loginType struct {
 func (w *Webserver) loginPostPage(res http.ResponseWriter, req *http.Request) {
 	var user string
 	var pass string
+	if !w.loginAllowed(res, req) {
+		return
+	}
 	err := req.ParseForm()
 	if err != nil {
 		serverFail(res, err)
@@ -128,7 +418,7 @@ func (w *Webserver) loginPostPage(res http.ResponseWriter, req *http.Request) {
 		var lt loginType
 		dec := json.NewDecoder(req.Body)
 		if err := dec.Decode(&lt); err != nil {
-			loginFail(res)
+			w.failLogin(res, req)
 			w.lgr.Info("Invalid JSON post to login page")
 			return
 		}
@@ -138,18 +428,18 @@ func (w *Webserver) loginPostPage(res http.ResponseWriter, req *http.Request) {
 		//using the form data
 		users, ok := req.PostForm["User"]
 		if !ok {
-			loginFail(res)
+			w.failLogin(res, req)
 			w.lgr.Info("Invalid Post to login page.  No \"User\" field")
 			return
 		}
 		passes, ok := req.PostForm["Pass"]
 		if !ok {
-			loginFail(res)
+			w.failLogin(res, req)
 			w.lgr.Info("Invalid Post to login page.  No \"Pass\" field")
 			return
 		}
 		if len(users) != 1 || len(passes) != 1 {
-			loginFail(res)
+			w.failLogin(res, req)
 			w.lgr.Info("Invalid Post to login page.  Invalid \"User\" or \"Pass\" field count")
 			return
 		}
@@ -159,31 +449,91 @@ func (w *Webserver) loginPostPage(res http.ResponseWriter, req *http.Request) {
 
 	cid, err := w.authModule.Authenticate(user, pass)
 	if err != nil {
+		if errors.Is(err, auth.ErrUserDisabled) {
+			w.lgr.Info("Login attempt for disabled customer", log.KV("cid", cid))
+			w.backoff.fail(remoteHost(req.RemoteAddr), time.Now())
+			loginLocked(res)
+		} else {
+			w.failLogin(res, req)
+		}
+		return
+	}
+
+	// Check if the user must also provide a TOTP code
+	if challenge, err := w.totpChallenge(cid); err != nil {
 		loginFail(res)
 		return
+	} else if challenge != `` {
+		w.lgr.Info("Login requires TOTP code", log.KV("cid", cid))
+		loginTOTPRequired(res, challenge)
+		return
 	}
 
-	// Create a new token object, specifying signing method and the claims
-	// you would like it to contain.
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"CustomerNumber": cid,
-	})
+	tokenString, err := w.generateLoginToken(cid)
+	if err != nil {
+		loginFail(res)
+		return
+	}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString(w.hmacSecret)
+	w.backoff.succeed(remoteHost(req.RemoteAddr))
+	w.lgr.Info("Login successful for customer", log.KV("cid", cid))
+	loginSucceed(res, tokenString)
+}
+
+type loginTOTPType struct {
+	Challenge string
+	Code      string
+}
+
+// loginTOTPPostPage is the second step of a login for users with TOTP enabled
+// the client hands back the challenge token from the first step along with a TOTP code
+func (w *Webserver) loginTOTPPostPage(res http.ResponseWriter, req *http.Request) {
+	var lt loginTOTPType
+	if !w.loginAllowed(res, req) {
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		serverFail(res, err)
+		return
+	}
+	if challenges, ok := req.PostForm["Challenge"]; ok {
+		codes, ok := req.PostForm["Code"]
+		if !ok || len(challenges) != 1 || len(codes) != 1 {
+			w.failLogin(res, req)
+			w.lgr.Info("Invalid Post to TOTP login page.  Invalid \"Challenge\" or \"Code\" field")
+			return
+		}
+		lt.Challenge = challenges[0]
+		lt.Code = codes[0]
+	} else if err := json.NewDecoder(req.Body).Decode(&lt); err != nil {
+		w.failLogin(res, req)
+		w.lgr.Info("Invalid JSON post to TOTP login page")
+		return
+	}
+
+	cid, err := w.validateTOTPChallenge(lt.Challenge, lt.Code)
+	if err != nil {
+		w.failLogin(res, req)
+		return
+	}
+
+	tokenString, err := w.generateLoginToken(cid)
 	if err != nil {
 		loginFail(res)
 		return
 	}
 
+	w.backoff.succeed(remoteHost(req.RemoteAddr))
 	w.lgr.Info("Login successful for customer", log.KV("cid", cid))
 	loginSucceed(res, tokenString)
 }
 
 type LoginResponse struct {
-	LoginStatus bool
-	Reason      string
-	JWT         string
+	LoginStatus  bool
+	Reason       string
+	JWT          string
+	TOTPRequired bool   `json:",omitempty"`
+	Challenge    string `json:",omitempty"` //handed back to the TOTP login path along with a code
 }
 
 func loginFail(res http.ResponseWriter) {
@@ -196,6 +546,27 @@ func loginFail(res http.ResponseWriter) {
 	json.NewEncoder(res).Encode(lr)
 }
 
+func loginLocked(res http.ResponseWriter) {
+	res.WriteHeader(http.StatusLocked)
+	res.Header().Set("Content-Type", "application/json")
+	lr := LoginResponse{
+		LoginStatus: false,
+		Reason:      "Account is locked",
+	}
+	json.NewEncoder(res).Encode(lr)
+}
+
+func loginTOTPRequired(res http.ResponseWriter, challenge string) {
+	res.Header().Set("Content-Type", "application/json")
+	lr := LoginResponse{
+		LoginStatus:  false,
+		Reason:       "TOTP code required",
+		TOTPRequired: true,
+		Challenge:    challenge,
+	}
+	json.NewEncoder(res).Encode(lr)
+}
+
 func loginSucceed(res http.ResponseWriter, jwt string) {
 	res.Header().Set("Content-Type", "application/json")
 	lr := LoginResponse{
@@ -0,0 +1,154 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestTokenClaims(t *testing.T) {
+	secret := []byte(`0123456789abcdef`)
+	prod := &Webserver{hmacSecret: secret, tokenIssuer: `archive.example.org`, tokenAudience: `indexers`}
+
+	tok, err := prod.generateToken(1337, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cust, err := prod.decodeJWTToken(tok); err != nil {
+		t.Fatal(err)
+	} else if cust.CustomerNumber != 1337 {
+		t.Fatalf("bad customer %d", cust.CustomerNumber)
+	}
+
+	//a server sharing the key but with another issuer or audience must refuse the token
+	staging := &Webserver{hmacSecret: secret, tokenIssuer: `staging.example.org`, tokenAudience: `indexers`}
+	if _, err = staging.decodeJWTToken(tok); err == nil {
+		t.Fatal("accepted a token from another issuer")
+	}
+	other := &Webserver{hmacSecret: secret, tokenIssuer: `archive.example.org`, tokenAudience: `other`}
+	if _, err = other.decodeJWTToken(tok); err == nil {
+		t.Fatal("accepted a token for another audience")
+	}
+
+	//tokens missing the standard claims, or which are not valid yet, are refused
+	now := time.Now().Unix()
+	for _, claims := range []jwt.MapClaims{
+		{"CustomerNumber": 1337, "aud": `indexers`, "iat": now, "nbf": now},
+		{"CustomerNumber": 1337, "iss": `archive.example.org`, "iat": now, "nbf": now},
+		{"CustomerNumber": 1337, "iss": `archive.example.org`, "aud": `indexers`, "nbf": now},
+		{"CustomerNumber": 1337, "iss": `archive.example.org`, "aud": `indexers`, "iat": now},
+		{"CustomerNumber": 1337, "iss": `archive.example.org`, "aud": `indexers`, "iat": now, "nbf": now + 3600},
+	} {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = prod.decodeJWTToken(s); err == nil {
+			t.Fatalf("accepted token with claims %v", claims)
+		}
+	}
+}
+
+func TestTOTPChallenge(t *testing.T) {
+	am, err := auth.NewAuthModule(filepath.Join(t.TempDir(), `passwd`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.SetCost(8)
+	if err = am.AddUser(1337, `password`, 8); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = am.SetTOTPSecret(1337, secret); err != nil {
+		t.Fatal(err)
+	}
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		authModule:    am,
+	}
+	challenge := func() string {
+		c, err := w.totpChallenge(1337)
+		if err != nil {
+			t.Fatal(err)
+		} else if c == `` {
+			t.Fatal("no challenge for a TOTP user")
+		}
+		return c
+	}
+	now := time.Now()
+	code, err := auth.GenerateTOTPCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := auth.GenerateTOTPCode(secret, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := challenge()
+	if cid, err := w.validateTOTPChallenge(first, code); err != nil {
+		t.Fatal(err)
+	} else if cid != 1337 {
+		t.Fatalf("bad customer %d", cid)
+	}
+	//the challenge cannot be used again, even with a fresh code
+	if _, err = w.validateTOTPChallenge(first, next); err == nil {
+		t.Fatal("accepted a used challenge")
+	}
+	//nor can the code be used again with a fresh challenge
+	if _, err = w.validateTOTPChallenge(challenge(), code); err == nil {
+		t.Fatal("accepted a used code")
+	}
+	//a failed attempt uses up the challenge
+	c := challenge()
+	if _, err = w.validateTOTPChallenge(c, `abcdef`); err == nil {
+		t.Fatal("accepted a bad code")
+	}
+	if _, err = w.validateTOTPChallenge(c, next); err == nil {
+		t.Fatal("accepted a challenge after a failed attempt")
+	}
+	if _, err = w.validateTOTPChallenge(challenge(), next); err != nil {
+		t.Fatal(err)
+	}
+
+	//challenges without an ID are refused
+	noID, err := w.generateToken(1337, jwt.MapClaims{totpPendingClaim: true, "exp": now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = w.validateTOTPChallenge(noID, next); err == nil {
+		t.Fatal("accepted a challenge without an ID")
+	}
+}
+
+func TestChallengeSet(t *testing.T) {
+	var cs challengeSet
+	now := time.Now()
+	if !cs.use(`a`, now) {
+		t.Fatal("refused a new challenge")
+	} else if cs.use(`a`, now) {
+		t.Fatal("accepted a used challenge")
+	}
+	//expired entries are dropped
+	cs.use(`b`, now.Add(2*totpChallengeTimeout))
+	if _, ok := cs.used[`a`]; ok {
+		t.Fatal("expired challenge was kept")
+	}
+}
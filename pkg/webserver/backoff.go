@@ -0,0 +1,202 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	defaultBackoffFree = 5
+	defaultBackoffMax  = 15 * time.Minute
+	loginBackoffBase   = time.Second
+	backoffMaxTracked  = 4096 //most addresses tracked, idle ones are dropped first and then the oldest
+	backoffIPv6Prefix  = 64   //IPv6 clients are tracked by network, as each is usually handed a whole /64
+)
+
+// LoginBackoff controls the delay imposed on a source address after failed logins, it is
+// applied on top of any lockout performed by the authentication module
+type LoginBackoff struct {
+	Disable  bool
+	Free     int           // failed logins allowed before the address must wait, 5 if zero
+	MaxDelay time.Duration // longest an address is made to wait, 15 minutes if zero
+}
+
+type backoffEntry struct {
+	failures int
+	last     time.Time //most recent failure
+	until    time.Time //no logins are attempted before this time
+}
+
+// loginBackoff tracks failed logins by source address, once an address uses up its free
+// failures each further failure doubles how long it must wait before trying again.
+// IPv6 addresses are tracked by their /64 so a client cannot reset its count by
+// moving to another address in its own network.
+type loginBackoff struct {
+	sync.Mutex
+	free     int
+	maxDelay time.Duration
+	addrs    map[string]*backoffEntry
+}
+
+func newLoginBackoff(cfg LoginBackoff) *loginBackoff {
+	if cfg.Disable {
+		return nil
+	}
+	if cfg.Free <= 0 {
+		cfg.Free = defaultBackoffFree
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultBackoffMax
+	}
+	return &loginBackoff{
+		free:     cfg.Free,
+		maxDelay: cfg.MaxDelay,
+		addrs:    map[string]*backoffEntry{},
+	}
+}
+
+// wait returns how long addr must wait before it may attempt another login
+func (lb *loginBackoff) wait(addr string, now time.Time) time.Duration {
+	if lb == nil {
+		return 0
+	}
+	lb.Lock()
+	defer lb.Unlock()
+	if e, ok := lb.addrs[backoffKey(addr)]; ok && now.Before(e.until) {
+		return e.until.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failed login from addr
+func (lb *loginBackoff) fail(addr string, now time.Time) {
+	if lb == nil {
+		return
+	}
+	lb.Lock()
+	defer lb.Unlock()
+	key := backoffKey(addr)
+	e, ok := lb.addrs[key]
+	if !ok || lb.idle(e, now) {
+		if !ok && len(lb.addrs) >= backoffMaxTracked {
+			lb.prune(now)
+			for len(lb.addrs) >= backoffMaxTracked {
+				lb.evictOldest()
+			}
+		}
+		e = &backoffEntry{}
+		lb.addrs[key] = e
+	}
+	e.failures++
+	e.last = now
+	if n := e.failures - lb.free; n > 0 {
+		e.until = now.Add(lb.delay(n))
+	}
+}
+
+// succeed forgets the failures of an address which has logged in
+func (lb *loginBackoff) succeed(addr string) {
+	if lb == nil {
+		return
+	}
+	lb.Lock()
+	delete(lb.addrs, backoffKey(addr))
+	lb.Unlock()
+}
+
+// delay is the wait imposed after the nth failure beyond the free ones
+func (lb *loginBackoff) delay(n int) time.Duration {
+	if n > 32 {
+		return lb.maxDelay
+	}
+	d := loginBackoffBase * time.Duration(math.Pow(2, float64(n-1)))
+	if d <= 0 || d > lb.maxDelay {
+		d = lb.maxDelay
+	}
+	return d
+}
+
+// idle reports whether an address has gone long enough without failing that its
+// history is forgotten, the caller must hold the lock
+func (lb *loginBackoff) idle(e *backoffEntry, now time.Time) bool {
+	last := e.last
+	if e.until.After(last) {
+		last = e.until
+	}
+	return now.Sub(last) > lb.maxDelay
+}
+
+// prune drops idle addresses, the caller must hold the lock
+func (lb *loginBackoff) prune(now time.Time) {
+	for k, e := range lb.addrs {
+		if lb.idle(e, now) {
+			delete(lb.addrs, k)
+		}
+	}
+}
+
+// evictOldest drops the address whose last failure is the oldest, the caller must hold the lock
+func (lb *loginBackoff) evictOldest() {
+	var oldest string
+	var last time.Time
+	for k, e := range lb.addrs {
+		if oldest == `` || e.last.Before(last) {
+			oldest, last = k, e.last
+		}
+	}
+	delete(lb.addrs, oldest)
+}
+
+// backoffKey is the key failures from addr are tracked under, IPv6 addresses are reduced to their network
+func backoffKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	mask := net.CIDRMask(backoffIPv6Prefix, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// loginAllowed rejects the login with 429 if the source address is still backing off
+func (w *Webserver) loginAllowed(res http.ResponseWriter, req *http.Request) bool {
+	addr := remoteHost(req.RemoteAddr)
+	d := w.backoff.wait(addr, time.Now())
+	if d <= 0 {
+		return true
+	}
+	w.lgr.Info("Login refused during backoff", log.KV("remote", addr), log.KV("wait", d))
+	loginThrottled(res, d)
+	return false
+}
+
+// failLogin records a failed login against the source address before rejecting it
+func (w *Webserver) failLogin(res http.ResponseWriter, req *http.Request) {
+	w.backoff.fail(remoteHost(req.RemoteAddr), time.Now())
+	loginFail(res)
+}
+
+func loginThrottled(res http.ResponseWriter, d time.Duration) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10))
+	res.WriteHeader(http.StatusTooManyRequests)
+	lr := LoginResponse{
+		LoginStatus: false,
+		Reason:      "Too many failed logins, try again later",
+	}
+	json.NewEncoder(res).Encode(lr)
+}
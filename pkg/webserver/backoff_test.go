@@ -0,0 +1,124 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	lb := newLoginBackoff(LoginBackoff{Free: 2, MaxDelay: 10 * time.Second})
+	now := time.Now()
+	addr := `10.0.0.1`
+
+	//the free failures impose no wait
+	for i := 0; i < 2; i++ {
+		lb.fail(addr, now)
+		if d := lb.wait(addr, now); d != 0 {
+			t.Fatalf("free failure %d imposed a wait of %v", i, d)
+		}
+	}
+	//then each failure doubles the wait up to the maximum
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		lb.fail(addr, now)
+		if d := lb.wait(addr, now); d != want {
+			t.Fatalf("expected a wait of %v, got %v", want, d)
+		}
+	}
+	if d := lb.wait(`10.0.0.2`, now); d != 0 {
+		t.Fatalf("another address must not wait, got %v", d)
+	}
+	if d := lb.wait(addr, now.Add(10*time.Second)); d != 0 {
+		t.Fatalf("wait did not expire, got %v", d)
+	}
+
+	//a failure shortly after the wait keeps counting
+	lb.fail(addr, now.Add(11*time.Second))
+	if d := lb.wait(addr, now.Add(11*time.Second)); d != 10*time.Second {
+		t.Fatalf("expected the maximum wait, got %v", d)
+	}
+	//but an address which stays quiet long enough starts over
+	later := now.Add(time.Minute)
+	lb.fail(addr, later)
+	if d := lb.wait(addr, later); d != 0 {
+		t.Fatalf("idle address was not forgotten, wait %v", d)
+	}
+
+	//logging in forgets the failures
+	for i := 0; i < 4; i++ {
+		lb.fail(addr, later)
+	}
+	if lb.wait(addr, later) == 0 {
+		t.Fatal("expected a wait")
+	}
+	lb.succeed(addr)
+	if d := lb.wait(addr, later); d != 0 {
+		t.Fatalf("success did not reset the address, wait %v", d)
+	}
+
+	//a disabled backoff never waits
+	lb = newLoginBackoff(LoginBackoff{Disable: true})
+	for i := 0; i < 10; i++ {
+		lb.fail(addr, now)
+	}
+	if d := lb.wait(addr, now); d != 0 {
+		t.Fatalf("disabled backoff imposed a wait of %v", d)
+	}
+}
+
+func TestLoginBackoffIPv6(t *testing.T) {
+	lb := newLoginBackoff(LoginBackoff{Free: 1, MaxDelay: 10 * time.Second})
+	now := time.Now()
+	//hopping between addresses in the same /64 does not escape the backoff
+	lb.fail(`2001:db8:1:2::1`, now)
+	lb.fail(`2001:db8:1:2:ffff::2`, now)
+	if d := lb.wait(`2001:db8:1:2::3`, now); d != time.Second {
+		t.Fatalf("expected the /64 to wait, got %v", d)
+	}
+	if d := lb.wait(`2001:db8:1:3::1`, now); d != 0 {
+		t.Fatalf("another network must not wait, got %v", d)
+	}
+	lb.succeed(`2001:db8:1:2::4`)
+	if d := lb.wait(`2001:db8:1:2::1`, now); d != 0 {
+		t.Fatalf("success did not reset the network, wait %v", d)
+	}
+	if k := backoffKey(`10.0.0.1`); k != `10.0.0.1` {
+		t.Fatalf("IPv4 address keyed as %s", k)
+	}
+}
+
+func TestLoginBackoffCap(t *testing.T) {
+	lb := newLoginBackoff(LoginBackoff{Free: 1, MaxDelay: time.Hour})
+	now := time.Now()
+	//none of these addresses are idle, so the oldest are evicted to make room
+	for i := 0; i < backoffMaxTracked+100; i++ {
+		lb.fail(fmt.Sprintf(`10.%d.%d.%d`, i>>16&0xff, i>>8&0xff, i&0xff), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(lb.addrs) != backoffMaxTracked {
+		t.Fatalf("tracking %d addresses, expected at most %d", len(lb.addrs), backoffMaxTracked)
+	} else if _, ok := lb.addrs[`10.0.0.0`]; ok {
+		t.Fatal("oldest address was not evicted")
+	} else if _, ok = lb.addrs[fmt.Sprintf(`10.0.%d.%d`, (backoffMaxTracked+99)>>8&0xff, (backoffMaxTracked+99)&0xff)]; !ok {
+		t.Fatal("newest address was evicted")
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	rec := httptest.NewRecorder()
+	loginThrottled(rec, 1500*time.Millisecond)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if ra := rec.Header().Get(`Retry-After`); ra != `2` {
+		t.Fatalf("bad Retry-After %q", ra)
+	}
+}
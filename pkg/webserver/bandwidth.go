@@ -0,0 +1,146 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxShapeBurst = 256 * 1024 //largest single read or write handed through a limiter
+)
+
+// RateLimits caps a customer's shard transfer throughput in bytes per second, zero is unlimited
+type RateLimits struct {
+	Ingress int64 // shard pushes
+	Egress  int64 // shard pulls
+}
+
+// bandwidthShaper hands out per-customer limiters, every transfer a customer
+// has in flight draws from the same pair so the caps hold across connections
+type bandwidthShaper struct {
+	sync.Mutex
+	def  RateLimits
+	cust map[uint64]RateLimits
+	lims map[uint64]customerLimiters
+}
+
+type customerLimiters struct {
+	in  *rate.Limiter
+	out *rate.Limiter
+}
+
+func newBandwidthShaper(def RateLimits, cust map[uint64]RateLimits) *bandwidthShaper {
+	if def == (RateLimits{}) && len(cust) == 0 {
+		return nil //nothing to shape
+	}
+	return &bandwidthShaper{
+		def:  def,
+		cust: cust,
+		lims: map[uint64]customerLimiters{},
+	}
+}
+
+func newLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	burst := bps
+	if burst > maxShapeBurst {
+		burst = maxShapeBurst
+	}
+	return rate.NewLimiter(rate.Limit(bps), int(burst))
+}
+
+func (bs *bandwidthShaper) limiters(cid uint64) customerLimiters {
+	bs.Lock()
+	defer bs.Unlock()
+	cl, ok := bs.lims[cid]
+	if !ok {
+		rl, ok := bs.cust[cid]
+		if !ok {
+			rl = bs.def
+		}
+		cl = customerLimiters{in: newLimiter(rl.Ingress), out: newLimiter(rl.Egress)}
+		bs.lims[cid] = cl
+	}
+	return cl
+}
+
+// reader wraps a push reader so that it draws from the customer's ingress cap
+func (bs *bandwidthShaper) reader(ctx context.Context, cid uint64, rdr io.Reader) io.Reader {
+	if bs == nil {
+		return rdr
+	}
+	if lim := bs.limiters(cid).in; lim != nil {
+		return &shapedReader{ctx: ctx, lim: lim, rdr: rdr}
+	}
+	return rdr
+}
+
+// writer wraps a pull writer so that it draws from the customer's egress cap
+func (bs *bandwidthShaper) writer(ctx context.Context, cid uint64, wtr io.Writer) io.Writer {
+	if bs == nil {
+		return wtr
+	}
+	if lim := bs.limiters(cid).out; lim != nil {
+		return &shapedWriter{ctx: ctx, lim: lim, wtr: wtr}
+	}
+	return wtr
+}
+
+type shapedReader struct {
+	ctx context.Context
+	lim *rate.Limiter
+	rdr io.Reader
+}
+
+// Read waits for the bytes it has read, so the client is held back by TCP flow control
+func (sr *shapedReader) Read(b []byte) (n int, err error) {
+	if burst := sr.lim.Burst(); len(b) > burst {
+		b = b[:burst]
+	}
+	if n, err = sr.rdr.Read(b); n > 0 {
+		if lerr := sr.lim.WaitN(sr.ctx, n); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return
+}
+
+type shapedWriter struct {
+	ctx context.Context
+	lim *rate.Limiter
+	wtr io.Writer
+}
+
+func (sw *shapedWriter) Write(b []byte) (n int, err error) {
+	burst := sw.lim.Burst()
+	for len(b) > 0 {
+		sz := len(b)
+		if sz > burst {
+			sz = burst
+		}
+		if err = sw.lim.WaitN(sw.ctx, sz); err != nil {
+			return
+		}
+		var wn int
+		wn, err = sw.wtr.Write(b[:sz])
+		n += wn
+		if err != nil {
+			return
+		}
+		b = b[sz:]
+	}
+	return
+}
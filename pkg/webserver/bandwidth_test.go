@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBandwidthShaper(t *testing.T) {
+	const rate = 32 * 1024
+	if bs := newBandwidthShaper(RateLimits{}, nil); bs != nil {
+		t.Fatal("shaper created without limits")
+	}
+	bs := newBandwidthShaper(RateLimits{Ingress: rate}, map[uint64]RateLimits{
+		1337: {Egress: rate},
+	})
+	ctx := context.Background()
+	buf := make([]byte, rate)
+
+	//customer 1337 overrides the default ingress cap, so only egress is shaped
+	var out bytes.Buffer
+	if w := bs.writer(ctx, 1337, &out); w == io.Writer(&out) {
+		t.Fatal("egress not shaped")
+	} else if r := bs.reader(ctx, 1337, bytes.NewReader(buf)); r == nil {
+		t.Fatal("nil reader")
+	} else if _, ok := r.(*shapedReader); ok {
+		t.Fatal("ingress shaped for overridden customer")
+	}
+
+	//the first second of data passes immediately, the next waits for the cap
+	//the limiter is shared by every transfer belonging to the customer
+	start := time.Now()
+	if _, err := bs.writer(ctx, 1337, &out).Write(buf); err != nil {
+		t.Fatal(err)
+	} else if _, err = bs.writer(ctx, 1337, &out).Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Fatalf("egress not limited, %d bytes took %v", 2*rate, d)
+	} else if out.Len() != 2*rate {
+		t.Fatalf("wrote %d bytes", out.Len())
+	}
+
+	//other customers get the default ingress cap
+	start = time.Now()
+	n, err := io.Copy(ioutil.Discard, bs.reader(ctx, 42, bytes.NewReader(append(buf, buf...))))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 2*rate {
+		t.Fatalf("read %d bytes", n)
+	} else if d := time.Since(start); d < 900*time.Millisecond {
+		t.Fatalf("ingress not limited, %d bytes took %v", n, d)
+	}
+
+	//waits are abandoned when the transfer is cancelled
+	cctx, cf := context.WithCancel(ctx)
+	cf()
+	if _, err = bs.writer(cctx, 1337, &out).Write(buf); err == nil {
+		t.Fatal("cancelled write succeeded")
+	}
+
+	//without a shaper everything passes through untouched
+	var nbs *bandwidthShaper
+	if w := nbs.writer(ctx, 1, &out); w != io.Writer(&out) {
+		t.Fatal("nil shaper wrapped writer")
+	}
+}
@@ -0,0 +1,102 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// APIv1 is the API served at the unversioned /api paths
+	APIv1 = `v1`
+	// APIv2 is the API served under /api/v2, it differs from v1 only in that listings
+	// always answer with a ListPage
+	APIv2 = `v2`
+
+	// CompressionZlib is the compression of packed shard streams
+	CompressionZlib = `zlib`
+
+	apiPrefix = `/api`
+)
+
+// apiVersions are the versions every API route is installed for, oldest first
+var apiVersions = []string{APIv1, APIv2}
+
+// Capabilities advertises the API versions and optional features a server supports so
+// clients can adapt to older servers and to storage backends which lack some features
+type Capabilities struct {
+	APIVersions     []string // served API versions, see APIv1 and APIv2
+	Compression     []string // compression modes of packed shard streams
+	ResumableUpload bool     // an interrupted push can be resumed, otherwise it must be sent again
+	Delete          bool     // shards can be deleted
+	Trash           bool     // deleted shards are held and can be restored
+	DeltaPush       bool     // only the changed files of a stored shard need be pushed
+	ShardInfo       bool     // stored shard files and checksums can be queried
+	Verify          bool     // stored shards can be checked for corruption
+	WellStats       bool
+	WellTags        bool
+	AccessHistory   bool
+	TransferStatus  bool
+	UserManagement  bool            // administrators can manage customers over the API
+	UserEditing     bool            // administrators can change customers' accounts and import customers over the API
+	Reencrypt       bool            // administrators can re-encrypt stored shards under the current keys
+	MaxListLimit    int             // the largest page a listing returns
+	DuplicatePolicy DuplicatePolicy // what happens to a push of a shard which is already stored
+	ReadOnly        bool            // pushes, deletes, and tag updates are refused
+}
+
+// apiPath returns the path of an API route for a version, v1 routes are served at
+// their unversioned paths and later versions under /api/<version>
+func apiPath(ver, path string) string {
+	if ver == APIv1 || !strings.HasPrefix(path, apiPrefix+`/`) {
+		return path
+	}
+	return apiPrefix + `/` + ver + strings.TrimPrefix(path, apiPrefix)
+}
+
+// apiVersion splits a route path template into its API version and unversioned template
+func apiVersion(path string) (ver, tmpl string) {
+	for _, v := range apiVersions[1:] {
+		pfx := apiPrefix + `/` + v
+		if strings.HasPrefix(path, pfx+`/`) {
+			return v, apiPrefix + strings.TrimPrefix(path, pfx)
+		}
+	}
+	return APIv1, path
+}
+
+// capabilities reports what this server and its storage backend support
+func (w *Webserver) capabilities() (c Capabilities) {
+	c.APIVersions = apiVersions
+	c.Compression = []string{CompressionZlib}
+	c.MaxListLimit = MaxListLimit
+	c.ReadOnly = w.readOnly
+	if c.DuplicatePolicy = w.dupPolicy; c.DuplicatePolicy == `` {
+		c.DuplicatePolicy = DuplicateVersion
+	}
+	_, c.Delete = w.shardHandler.(ShardDeleter)
+	_, c.Trash = w.shardHandler.(ShardTrash)
+	_, c.DeltaPush = w.shardHandler.(DeltaShardUnpacker)
+	_, c.ShardInfo = w.shardHandler.(ShardInfoReporter)
+	_, c.Verify = w.shardHandler.(ShardVerifier)
+	_, c.WellStats = w.shardHandler.(WellStatsReporter)
+	_, c.WellTags = w.shardHandler.(WellTagReporter)
+	_, c.AccessHistory = w.shardHandler.(AccessHistory)
+	_, c.TransferStatus = w.shardHandler.(TransferReporter)
+	_, c.UserManagement = w.authModule.(UserManager)
+	_, c.UserEditing = w.authModule.(UserEditor)
+	_, c.Reencrypt = w.shardHandler.(ShardReencrypter)
+	return
+}
+
+// capabilitiesHandler answers with the server's Capabilities, clients may ask before logging in
+func (w *Webserver) capabilitiesHandler(res http.ResponseWriter, req *http.Request) {
+	sendObject(res, w.capabilities())
+}
@@ -0,0 +1,106 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestAPIPath(t *testing.T) {
+	for _, tc := range []struct {
+		ver, path, want string
+	}{
+		{APIv1, SHARD_PATH, SHARD_PATH},
+		{APIv2, SHARD_PATH, `/api/v2/shard/{custid}/{uuid}/{well}/{shardid}`},
+		{APIv2, METRICS_PATH, METRICS_PATH},
+	} {
+		got := apiPath(tc.ver, tc.path)
+		if got != tc.want {
+			t.Fatalf("%s %s became %s, expected %s", tc.ver, tc.path, got, tc.want)
+		}
+		if ver, tmpl := apiVersion(got); tmpl != tc.path || (ver != tc.ver && got != tc.path) {
+			t.Fatalf("%s split to %s %s", got, ver, tmpl)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	get := func(sh ShardHandler) (c Capabilities) {
+		w := &Webserver{
+			lgr:          log.NewDiscardLogger(),
+			shardHandler: sh,
+			readOnly:     true,
+		}
+		if err := w.buildRequestRouter(); err != nil {
+			t.Fatal(err)
+		}
+		//no token is needed
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, CAPABILITIES_PATH, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("bad status %d", rec.Code)
+		} else if err := json.Unmarshal(rec.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	c := get(&listedBackend{})
+	if !reflect.DeepEqual(c.APIVersions, apiVersions) || c.MaxListLimit != MaxListLimit {
+		t.Fatalf("bad capabilities %+v", c)
+	} else if c.Delete || c.ShardInfo || c.ResumableUpload {
+		t.Fatalf("features advertised for a backend without them %+v", c)
+	} else if !c.ReadOnly || c.DuplicatePolicy != DuplicateVersion {
+		t.Fatalf("bad server configuration %+v", c)
+	}
+	if c = get(&infoBackend{}); !c.ShardInfo || c.Delete {
+		t.Fatalf("bad capabilities %+v", c)
+	}
+}
+
+func TestAPIv2Listing(t *testing.T) {
+	const guid = `6b9e4d4e-5b0f-4b8e-9d3e-3f1f1e0f6a11`
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		shardHandler:  &listedBackend{shards: []string{`76a08`, `76a00`}},
+	}
+	if err := w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := w.generateToken(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"Start":"` + time.Unix(0, 0).UTC().Format(time.RFC3339) + `","End":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
+	req := httptest.NewRequest(http.MethodPost, `/api/v2/shard/1/`+guid+`/default`, strings.NewReader(body))
+	req.Header.Set(jwtAuthHeader, `Bearer `+tok)
+	rec := httptest.NewRecorder()
+	w.m.ServeHTTP(rec, req)
+
+	//v2 listings are paged even without any listing parameters
+	var lp ListPage
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &lp); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(lp, ListPage{Items: []string{`76a00`, `76a08`}, Total: 2}) {
+		t.Fatalf("bad page %+v", lp)
+	}
+}
@@ -0,0 +1,162 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	// ShardDeltaBaseHeader carries the checksum of the stored shard a delta was computed
+	// against, see util.ShardInfo.Checksum, the delta is refused if the shard has changed since
+	ShardDeltaBaseHeader = `X-Shard-Delta-Base`
+	// ShardDeltaRemoveHeader lists, comma separated, stored data files the local copy no longer has
+	ShardDeltaRemoveHeader = `X-Shard-Delta-Remove`
+)
+
+var (
+	ErrNoDelta          = errors.New("Storage backend does not support delta pushes")
+	ErrMissingDeltaBase = errors.New("Delta push is missing the " + ShardDeltaBaseHeader + " header")
+)
+
+// DeltaShardUnpacker is an optional interface a ShardHandler may implement to update a stored
+// shard from a packed stream holding only the files which changed, and to remove the listed
+// files.  A shard which no longer matches base is refused with util.ErrShardChanged.
+type DeltaShardUnpacker interface {
+	UnpackShardDelta(ctx context.Context, cid uint64, guid uuid.UUID, well, shard, base string, remove []string, rdr io.Reader) error
+}
+
+// shardDeltaHandler re-pushes part of a stored shard, the client fetches the shard info
+// and sends only the files whose checksums differ from its local copy
+func (w *Webserver) shardDeltaHandler(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	defer req.Body.Close()
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	dsu, ok := w.shardHandler.(DeltaShardUnpacker)
+	if !ok {
+		serverNotImplemented(res, ErrNoDelta)
+		return
+	}
+	base := req.Header.Get(ShardDeltaBaseHeader)
+	if base == `` {
+		serverInvalid(res, ErrMissingDeltaBase)
+		return
+	}
+	var remove []string
+	for _, v := range req.Header.Values(ShardDeltaRemoveHeader) {
+		for _, name := range strings.Split(v, `,`) {
+			if name = strings.TrimSpace(name); name != `` {
+				remove = append(remove, name)
+			}
+		}
+	}
+	if w.backendDown(res) {
+		return
+	}
+	if err = w.checkQuota(req.Context(), cust); err != nil {
+		w.lgr.Info("Shard delta push rejected", log.KV("cid", custID), log.KV("quota", cust.Quota), log.KVErr(err))
+		if err == ErrQuotaExceeded {
+			sendError(res, err, http.StatusInsufficientStorage)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	release, err := w.acquirePush(req.Context())
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	defer release()
+	crdr := newChecksumReader(req)
+	rdr, err := newRateTimeoutReader(crdr, transferTickTimeout, res)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	defer rdr.Close()
+	rdr.limit(w.maxPush)
+	tctx, cf := transferContext(req.Context(), w.maxPush)
+	defer cf()
+
+	srdr := w.shaper.reader(tctx, custID, rdr)
+
+	w.lgr.Info("Shard delta push", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KV("removed", len(remove)))
+	ctx := util.WithProvenance(tctx, util.Provenance{
+		CID:        custID,
+		IdxUUID:    indexerUUID,
+		RemoteAddr: remoteHost(req.RemoteAddr),
+		UserAgent:  req.UserAgent(),
+		Uploaded:   time.Now().UTC(),
+	})
+	err = dsu.UnpackShardDelta(ctx, custID, indexerUUID, well, shard, base, remove, srdr)
+	err = deadlineError(tctx, err)
+	w.recordAccess(util.AccessDelta, custID, indexerUUID, well, shard, remoteHost(req.RemoteAddr), err)
+	if err != nil {
+		w.lgr.Error("Failed to unpack shard delta", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
+		switch {
+		case os.IsNotExist(err):
+			serverNotFound(res, err)
+		case errors.Is(err, util.ErrShardChanged):
+			sendError(res, err, http.StatusPreconditionFailed)
+		case errors.Is(err, util.ErrLegalHold):
+			sendError(res, err, http.StatusLocked)
+		case errors.Is(err, ErrChecksumMismatch), errors.Is(err, util.ErrNotShardFile), errors.Is(err, util.ErrInvalidShardName):
+			serverInvalid(res, err)
+		default:
+			serverFail(res, err)
+		}
+		return
+	}
+	if crdr.missing {
+		w.lgr.Warn("Shard delta push checksum trailer never arrived, stream not verified", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+	}
+	res.Header().Set(ShardVerifiedHeader, strconv.FormatBool(crdr.verified))
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,497 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/archivepb"
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	grpcAuthKey   = `authorization`
+	grpcChunkSize = 64 * 1024 //largest data chunk sent in a single message
+)
+
+type grpcCustKey struct{}
+
+// grpcServer implements the archive gRPC service on top of the webserver's
+// authentication module and shard handler
+type grpcServer struct {
+	archivepb.UnimplementedArchiveServer
+	w *Webserver
+}
+
+func (w *Webserver) newGRPCServer() *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(w.grpcUnaryAuth),
+		grpc.StreamInterceptor(w.grpcStreamAuth),
+	}
+	if w.tlsConfig != nil {
+		cfg := w.tlsConfig.Clone()
+		cfg.NextProtos = nil //the credentials negotiate HTTP/2
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+	srv := grpc.NewServer(opts...)
+	archivepb.RegisterArchiveServer(srv, &grpcServer{w: w})
+	return srv
+}
+
+func (w *Webserver) grpcRoutine() {
+	if err := w.grpcSrv.Serve(w.grpcLst); err != nil {
+		w.lgr.Error("gRPC server exited", log.KVErr(err))
+	}
+}
+
+// grpcUnaryAuth authenticates every unary call other than the logins
+func (w *Webserver) grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	switch info.FullMethod {
+	case archivepb.Archive_Login_FullMethodName, archivepb.Archive_LoginTOTP_FullMethodName:
+	default:
+		var cust *CustomerDetails
+		if cust, err = w.grpcAuth(ctx); err != nil {
+			w.logGRPCAccess(ctx, info.FullMethod, err)
+			return
+		}
+		ctx = context.WithValue(ctx, grpcCustKey{}, cust)
+	}
+	resp, err = handler(ctx, req)
+	w.logGRPCAccess(ctx, info.FullMethod, err)
+	return
+}
+
+// grpcStreamAuth authenticates every streaming call
+func (w *Webserver) grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	var cust *CustomerDetails
+	if cust, err = w.grpcAuth(ss.Context()); err == nil {
+		err = handler(srv, authedStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ss.Context(), grpcCustKey{}, cust),
+		})
+	}
+	w.logGRPCAccess(ss.Context(), info.FullMethod, err)
+	return
+}
+
+func (w *Webserver) grpcAuth(ctx context.Context) (cust *CustomerDetails, err error) {
+	var tok string
+	if md, ok := metadata.FromIncomingContext(ctx); !ok || len(md.Get(grpcAuthKey)) != 1 {
+		err = ErrMissingJWTToken
+	} else if tok, err = parseBearer(md.Get(grpcAuthKey)[0]); err == nil {
+		cust, err = w.authToken(tok)
+	}
+	if err != nil {
+		w.lgr.Info("gRPC unauthorized", log.KVErr(err))
+		cust = nil
+		err = status.Error(codes.Unauthenticated, err.Error())
+	}
+	return
+}
+
+func (w *Webserver) logGRPCAccess(ctx context.Context, method string, err error) {
+	w.lgr.Info("access",
+		log.KV("remote", grpcRemoteHost(ctx)),
+		log.KV("method", method),
+		log.KV("status", status.Code(err).String()))
+}
+
+// grpcRemoteHost returns the address of the peer which made a gRPC call
+func grpcRemoteHost(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return remoteHost(p.Addr.String())
+	}
+	return ``
+}
+
+// authedStream hands the authenticated customer to streaming handlers
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (as authedStream) Context() context.Context {
+	return as.ctx
+}
+
+func grpcCustomer(ctx context.Context) (*CustomerDetails, error) {
+	if cust, ok := ctx.Value(grpcCustKey{}).(*CustomerDetails); ok && cust != nil {
+		return cust, nil
+	}
+	return nil, status.Error(codes.Unauthenticated, ErrMissingJWTToken.Error())
+}
+
+// grpcFullCustomer returns the authenticated customer if it holds credentials which may modify data
+func grpcFullCustomer(ctx context.Context) (cust *CustomerDetails, err error) {
+	if cust, err = grpcCustomer(ctx); err == nil && cust.ReadOnly() {
+		cust = nil
+		err = status.Error(codes.PermissionDenied, ErrReadOnly.Error())
+	}
+	return
+}
+
+// grpcIndexer parses an indexer UUID and ensures the customer may access it
+func grpcIndexer(cust *CustomerDetails, v string) (guid uuid.UUID, err error) {
+	if guid, err = uuid.Parse(v); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+	} else if !cust.IndexerAllowed(guid) {
+		err = status.Error(codes.PermissionDenied, ErrIndexerNotAllowed.Error())
+	}
+	return
+}
+
+// grpcError translates a shard handler error into a gRPC status
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return status.Error(codes.NotFound, err.Error())
+	case err == ErrQuotaExceeded:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, util.ErrUploadInProgress):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, util.ErrShardExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, util.ErrLegalHold):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrTransferDeadline):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, util.ErrQueueFull):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (g *grpcServer) Login(ctx context.Context, req *archivepb.LoginRequest) (*archivepb.LoginResponse, error) {
+	addr := grpcRemoteHost(ctx)
+	if err := g.loginAllowed(addr); err != nil {
+		return nil, err
+	}
+	cid, err := g.w.authModule.Authenticate(req.User, req.Pass)
+	if err != nil {
+		g.w.backoff.fail(addr, time.Now())
+		if errors.Is(err, auth.ErrUserDisabled) {
+			g.w.lgr.Info("Login attempt for disabled customer", log.KV("cid", cid))
+			return nil, status.Error(codes.PermissionDenied, "Account is locked")
+		}
+		return nil, status.Error(codes.Unauthenticated, "Invalid username or password")
+	}
+	if challenge, err := g.w.totpChallenge(cid); err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid username or password")
+	} else if challenge != `` {
+		g.w.lgr.Info("Login requires TOTP code", log.KV("cid", cid))
+		return &archivepb.LoginResponse{TotpRequired: true, Challenge: challenge}, nil
+	}
+	return g.loginToken(addr, cid)
+}
+
+func (g *grpcServer) LoginTOTP(ctx context.Context, req *archivepb.LoginTOTPRequest) (*archivepb.LoginResponse, error) {
+	addr := grpcRemoteHost(ctx)
+	if err := g.loginAllowed(addr); err != nil {
+		return nil, err
+	}
+	cid, err := g.w.validateTOTPChallenge(req.Challenge, req.Code)
+	if err != nil {
+		g.w.backoff.fail(addr, time.Now())
+		return nil, status.Error(codes.Unauthenticated, "Invalid username or password")
+	}
+	return g.loginToken(addr, cid)
+}
+
+// loginAllowed refuses logins from an address which is still backing off after failed logins
+func (g *grpcServer) loginAllowed(addr string) error {
+	if d := g.w.backoff.wait(addr, time.Now()); d > 0 {
+		g.w.lgr.Info("Login refused during backoff", log.KV("remote", addr), log.KV("wait", d))
+		return status.Errorf(codes.ResourceExhausted, "Too many failed logins, try again in %v", d.Round(time.Second))
+	}
+	return nil
+}
+
+func (g *grpcServer) loginToken(addr string, cid uint64) (*archivepb.LoginResponse, error) {
+	tok, err := g.w.generateLoginToken(cid)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid username or password")
+	}
+	g.w.backoff.succeed(addr)
+	g.w.lgr.Info("Login successful for customer", log.KV("cid", cid))
+	return &archivepb.LoginResponse{Jwt: tok}, nil
+}
+
+func (g *grpcServer) ListIndexers(ctx context.Context, req *archivepb.ListIndexersRequest) (*archivepb.ListIndexersResponse, error) {
+	cust, err := grpcCustomer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := g.w.shardHandler.ListIndexes(ctx, cust.CustomerNumber)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &archivepb.ListIndexersResponse{}
+	for _, v := range idx {
+		// Only report indexers the customer is allowed to access
+		if guid, err := uuid.Parse(v); len(cust.Indexers) == 0 || (err == nil && cust.IndexerAllowed(guid)) {
+			resp.Indexers = append(resp.Indexers, v)
+		}
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) ListWells(ctx context.Context, req *archivepb.ListWellsRequest) (*archivepb.ListWellsResponse, error) {
+	cust, err := grpcCustomer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	guid, err := grpcIndexer(cust, req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	wells, err := g.w.shardHandler.ListIndexerWells(ctx, cust.CustomerNumber, guid)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &archivepb.ListWellsResponse{Wells: wells}, nil
+}
+
+func (g *grpcServer) GetWellTimeframe(ctx context.Context, req *archivepb.WellRequest) (*archivepb.Timeframe, error) {
+	cust, err := grpcCustomer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	guid, err := grpcIndexer(cust, req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := g.w.shardHandler.GetWellTimeframe(ctx, cust.CustomerNumber, guid, req.Well)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &archivepb.Timeframe{
+		Start: timestamppb.New(tf.Start),
+		End:   timestamppb.New(tf.End),
+	}, nil
+}
+
+func (g *grpcServer) ListShards(ctx context.Context, req *archivepb.ListShardsRequest) (*archivepb.ListShardsResponse, error) {
+	cust, err := grpcCustomer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	guid, err := grpcIndexer(cust, req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	if req.Timeframe == nil || req.Timeframe.Start == nil || req.Timeframe.End == nil {
+		return nil, status.Error(codes.InvalidArgument, "Start/end times must not be zero")
+	}
+	tf := util.Timeframe{
+		Start: req.Timeframe.Start.AsTime(),
+		End:   req.Timeframe.End.AsTime(),
+	}
+	if err = tf.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	shards, err := g.w.shardHandler.GetShardsInTimeframe(ctx, cust.CustomerNumber, guid, req.Well, tf)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &archivepb.ListShardsResponse{Shards: shards}, nil
+}
+
+func (g *grpcServer) GetTags(ctx context.Context, req *archivepb.GetTagsRequest) (*archivepb.TagsResponse, error) {
+	cust, err := grpcCustomer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	guid, err := grpcIndexer(cust, req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	tgs, err := g.w.shardHandler.GetTags(ctx, cust.CustomerNumber, guid)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &archivepb.TagsResponse{Tags: toPBTags(tgs)}, nil
+}
+
+func (g *grpcServer) SyncTags(ctx context.Context, req *archivepb.SyncTagsRequest) (*archivepb.TagsResponse, error) {
+	cust, err := g.writeCustomer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	guid, err := grpcIndexer(cust, req.Indexer)
+	if err != nil {
+		return nil, err
+	}
+	idxTags := make([]tags.TagPair, 0, len(req.Tags))
+	for _, t := range req.Tags {
+		if t.Value > uint32(^entry.EntryTag(0)) {
+			return nil, status.Errorf(codes.InvalidArgument, "Tag %s value %d is out of range", t.Name, t.Value)
+		}
+		idxTags = append(idxTags, tags.TagPair{Name: t.Name, Value: entry.EntryTag(t.Value), Description: t.Description, Origin: t.Origin})
+	}
+	tgs, err := g.w.shardHandler.SyncTags(ctx, cust.CustomerNumber, guid, idxTags)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &archivepb.TagsResponse{Tags: toPBTags(tgs)}, nil
+}
+
+func toPBTags(tgs []tags.TagPair) (r []*archivepb.Tag) {
+	r = make([]*archivepb.Tag, 0, len(tgs))
+	for _, t := range tgs {
+		r = append(r, &archivepb.Tag{Name: t.Name, Value: uint32(t.Value), Description: t.Description, Origin: t.Origin})
+	}
+	return
+}
+
+func (g *grpcServer) PushShard(stream archivepb.Archive_PushShardServer) error {
+	cust, err := g.writeCustomer(stream.Context())
+	if err != nil {
+		return err
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	ref := first.GetShard()
+	if ref == nil {
+		return status.Error(codes.InvalidArgument, "The first message must name the shard")
+	}
+	guid, err := grpcIndexer(cust, ref.Indexer)
+	if err != nil {
+		return err
+	}
+	custID := cust.CustomerNumber
+	if !g.w.health.healthy() {
+		return status.Error(codes.Unavailable, ErrBackendDown.Error())
+	}
+	if err = g.w.checkQuota(stream.Context(), cust); err != nil {
+		g.w.lgr.Info("Shard push rejected", log.KV("cid", custID), log.KV("quota", cust.Quota), log.KVErr(err))
+		return grpcError(err)
+	}
+	if dup, err := g.w.existingShard(stream.Context(), custID, guid, ref.Well, ref.Shard); err != nil {
+		return grpcError(err)
+	} else if dup != nil {
+		g.w.lgr.Info("Duplicate shard push rejected", log.KV("cid", custID), log.KV("indexeruuid", guid), log.KV("well", ref.Well), log.KV("shard", ref.Shard))
+		return status.Errorf(codes.AlreadyExists, "%s, checksum %s", dup.Error, dup.Checksum)
+	}
+	release, err := g.w.acquirePush(stream.Context())
+	if err != nil {
+		return status.FromContextError(err).Err()
+	}
+	defer release()
+	ctx, cf := transferContext(stream.Context(), g.w.maxPush)
+	defer cf()
+	rdr := g.w.shaper.reader(ctx, custID, &pushReader{ctx: ctx, stream: stream, buf: first.Data})
+
+	g.w.lgr.Info("Shard push", log.KV("cid", custID), log.KV("indexeruuid", guid), log.KV("well", ref.Well), log.KV("shard", ref.Shard))
+	prov := util.Provenance{
+		CID:        custID,
+		IdxUUID:    guid,
+		RemoteAddr: grpcRemoteHost(stream.Context()),
+		Uploaded:   time.Now().UTC(),
+	}
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok && len(md.Get(`user-agent`)) > 0 {
+		prov.UserAgent = md.Get(`user-agent`)[0]
+	}
+	err = g.w.unpackShard(util.WithProvenance(ctx, prov), custID, guid, ref.Well, ref.Shard, rdr)
+	err = deadlineError(ctx, err)
+	g.w.recordAccess(util.AccessPush, custID, guid, ref.Well, ref.Shard, prov.RemoteAddr, err)
+	if err != nil {
+		g.w.lgr.Error("Failed to unpack shard", log.KV("cid", custID), log.KV("indexeruuid", guid), log.KV("well", ref.Well), log.KV("shard", ref.Shard), log.KVErr(err))
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&archivepb.PushShardResponse{})
+}
+
+func (g *grpcServer) PullShard(req *archivepb.ShardRequest, stream archivepb.Archive_PullShardServer) error {
+	cust, err := grpcCustomer(stream.Context())
+	if err != nil {
+		return err
+	}
+	guid, err := grpcIndexer(cust, req.Indexer)
+	if err != nil {
+		return err
+	}
+	custID := cust.CustomerNumber
+	ctx, cf := transferContext(stream.Context(), g.w.maxPull)
+	defer cf()
+	g.w.lgr.Info("Shard pull", log.KV("cid", custID), log.KV("indexeruuid", guid), log.KV("well", req.Well), log.KV("shard", req.Shard))
+	err = g.w.shardHandler.PackShard(ctx, custID, guid, req.Well, req.Shard, g.w.shaper.writer(ctx, custID, pullWriter{ctx: ctx, stream: stream}))
+	err = deadlineError(ctx, err)
+	g.w.recordAccess(util.AccessPull, custID, guid, req.Well, req.Shard, grpcRemoteHost(stream.Context()), err)
+	if err != nil {
+		g.w.lgr.Error("Failed to pack shard", log.KV("cid", custID), log.KV("indexeruuid", guid), log.KV("well", req.Well), log.KV("shard", req.Shard), log.KVErr(err))
+		return grpcError(err)
+	}
+	return nil
+}
+
+// pushReader presents the data chunks of a push stream as an io.Reader
+type pushReader struct {
+	ctx    context.Context // checked between chunks, a blocked Recv only returns with the stream
+	stream archivepb.Archive_PushShardServer
+	buf    []byte
+}
+
+func (pr *pushReader) Read(b []byte) (n int, err error) {
+	for len(pr.buf) == 0 {
+		var msg *archivepb.PushShardRequest
+		if err = pr.ctx.Err(); err != nil {
+			return
+		} else if msg, err = pr.stream.Recv(); err != nil {
+			return //io.EOF once the client closes its side
+		}
+		pr.buf = msg.Data
+	}
+	n = copy(b, pr.buf)
+	pr.buf = pr.buf[n:]
+	return
+}
+
+// pullWriter sends everything written to it as a series of shard chunks
+type pullWriter struct {
+	ctx    context.Context
+	stream archivepb.Archive_PullShardServer
+}
+
+func (pw pullWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if err = pw.ctx.Err(); err != nil {
+			return
+		}
+		sz := len(b)
+		if sz > grpcChunkSize {
+			sz = grpcChunkSize
+		}
+		if err = pw.stream.Send(&archivepb.ShardChunk{Data: b[:sz]}); err != nil {
+			return
+		}
+		n += sz
+		b = b[sz:]
+	}
+	return
+}
@@ -0,0 +1,176 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	healthCheckTimeout         = 10 * time.Second // longest a single Preflight may take
+)
+
+var (
+	ErrBackendDown = errors.New("Storage backend is unavailable, shard pushes are refused until it recovers")
+)
+
+// BackendHealth is the outcome of the most recent storage backend health check
+type BackendHealth struct {
+	Checked  bool      // false if the backend does not support health checks, it is then assumed healthy
+	Healthy  bool      // false puts the server in a degraded state where shard pushes are refused
+	LastRun  time.Time // when the backend was last checked
+	Since    time.Time // when the backend last became healthy or unhealthy
+	Failures int       // consecutive failed checks
+}
+
+// healthChecker calls the backend's Preflight on an interval and tracks whether it is down
+type healthChecker struct {
+	pf       Preflighter
+	interval time.Duration
+	lgr      *log.Logger
+
+	mtx    sync.Mutex
+	status BackendHealth
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// newHealthChecker returns a checker for the handler, zero selects DefaultHealthCheckInterval
+// and a negative interval disables checks
+func newHealthChecker(h ShardHandler, interval time.Duration, lgr *log.Logger) *healthChecker {
+	hc := &healthChecker{
+		interval: interval,
+		lgr:      lgr,
+		status:   BackendHealth{Healthy: true, Since: time.Now()},
+		done:     make(chan struct{}),
+	}
+	if hc.interval == 0 {
+		hc.interval = DefaultHealthCheckInterval
+	}
+	if pf, ok := h.(Preflighter); ok && hc.interval > 0 {
+		hc.pf = pf
+		hc.status.Checked = true
+	}
+	return hc
+}
+
+func (hc *healthChecker) start() {
+	if hc == nil || hc.pf == nil {
+		return
+	}
+	hc.wg.Add(1)
+	go hc.routine()
+}
+
+func (hc *healthChecker) stop() {
+	if hc == nil {
+		return
+	}
+	hc.once.Do(func() {
+		close(hc.done)
+	})
+	hc.wg.Wait()
+}
+
+func (hc *healthChecker) routine() {
+	defer hc.wg.Done()
+	tckr := time.NewTicker(hc.interval)
+	defer tckr.Stop()
+	for {
+		hc.check()
+		select {
+		case <-hc.done:
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+// check runs one Preflight and records the outcome, logging when the backend goes down or recovers
+func (hc *healthChecker) check() {
+	ctx, cf := context.WithTimeout(context.Background(), healthCheckTimeout)
+	go func() {
+		select {
+		case <-hc.done:
+			cf()
+		case <-ctx.Done():
+		}
+	}()
+	err := hc.pf.Preflight(ctx)
+	cf()
+
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	now := time.Now()
+	hc.status.LastRun = now
+	if err == nil {
+		if !hc.status.Healthy {
+			hc.lgr.Info("Storage backend recovered, accepting shard pushes", log.KV("failures", hc.status.Failures))
+			hc.status.Healthy = true
+			hc.status.Since = now
+		}
+		hc.status.Failures = 0
+		return
+	}
+	hc.status.Failures++
+	if hc.status.Healthy {
+		hc.lgr.Error("Storage backend health check failed, refusing shard pushes", log.KVErr(err))
+		hc.status.Healthy = false
+		hc.status.Since = now
+	} else {
+		hc.lgr.Warn("Storage backend still failing health checks", log.KV("failures", hc.status.Failures), log.KVErr(err))
+	}
+}
+
+// get returns the latest status, a missing checker always reports healthy
+func (hc *healthChecker) get() BackendHealth {
+	if hc == nil {
+		return BackendHealth{Healthy: true}
+	}
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	return hc.status
+}
+
+func (hc *healthChecker) healthy() bool {
+	return hc.get().Healthy
+}
+
+// backendDown refuses a push with 503 while the backend is failing health checks,
+// returning true if the request was answered
+func (w *Webserver) backendDown(res http.ResponseWriter) bool {
+	if w.health.healthy() {
+		return false
+	}
+	res.Header().Set(`Retry-After`, strconv.Itoa(int(w.health.interval/time.Second)))
+	sendError(res, ErrBackendDown, http.StatusServiceUnavailable)
+	return true
+}
+
+// backendHealthHandler reports the outcome of the latest backend health check, answering
+// 503 while the backend is down so load balancers can act on the status alone
+func (w *Webserver) backendHealthHandler(res http.ResponseWriter, req *http.Request) {
+	bh := w.health.get()
+	res.Header().Set("Content-Type", "application/json")
+	if !bh.Healthy {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(res).Encode(bh)
+}
@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// checkedBackend is a backend whose health checks can be made to fail
+type checkedBackend struct {
+	ShardHandler
+	err error
+}
+
+func (cb *checkedBackend) Preflight(ctx context.Context) error {
+	return cb.err
+}
+
+func TestBackendHealth(t *testing.T) {
+	cb := &checkedBackend{}
+	w := &Webserver{lgr: log.NewDiscardLogger()}
+	w.health = newHealthChecker(cb, 0, w.lgr)
+	if err := w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	getHealth := func() (code int, bh BackendHealth) {
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, HEALTH_PATH, nil))
+		if err := json.NewDecoder(rec.Body).Decode(&bh); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, bh
+	}
+
+	w.health.check()
+	if code, bh := getHealth(); code != http.StatusOK || !bh.Checked || !bh.Healthy || bh.LastRun.IsZero() {
+		t.Fatalf("bad healthy status %d %+v", code, bh)
+	} else if w.backendDown(httptest.NewRecorder()) {
+		t.Fatal("push refused while the backend is healthy")
+	}
+
+	//a failing check puts the server in the degraded state
+	cb.err = errors.New("storage unreachable")
+	w.health.check()
+	w.health.check()
+	if code, bh := getHealth(); code != http.StatusServiceUnavailable || bh.Healthy || bh.Failures != 2 {
+		t.Fatalf("bad degraded status %d %+v", code, bh)
+	}
+	rec := httptest.NewRecorder()
+	if !w.backendDown(rec) || rec.Code != http.StatusServiceUnavailable || rec.Header().Get(`Retry-After`) != `30` {
+		t.Fatalf("push not refused while the backend is down: %d %v", rec.Code, rec.Header())
+	}
+
+	//and recovering lifts it
+	cb.err = nil
+	w.health.check()
+	if code, bh := getHealth(); code != http.StatusOK || !bh.Healthy || bh.Failures != 0 {
+		t.Fatalf("bad recovered status %d %+v", code, bh)
+	}
+
+	//backends which cannot be checked are always healthy
+	if hc := newHealthChecker(nil, 0, w.lgr); hc.get().Checked || !hc.healthy() {
+		t.Fatal("unchecked backend reported unhealthy")
+	}
+}
@@ -0,0 +1,99 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrNoHistory = errors.New("Storage backend does not keep access history")
+)
+
+// AccessHistory is an optional interface a ShardHandler may implement to keep a record of
+// every shard push, pull, and delete, so customers can look up when a shard was archived
+// or restored.  PurgeHistory drops history older than the backend's retention period.
+type AccessHistory interface {
+	RecordAccess(util.AccessEvent) error
+	AccessHistory(ctx context.Context, cid uint64, q util.AccessQuery) ([]util.AccessEvent, error)
+	PurgeHistory(ctx context.Context) (int, error)
+}
+
+// recordAccess adds a shard operation to the customer's access history, if the backend keeps one.
+// Failing to record is logged but does not fail the operation.
+func (w *Webserver) recordAccess(op string, cid uint64, guid uuid.UUID, well, shard, remote string, opErr error) {
+	ah, ok := w.shardHandler.(AccessHistory)
+	if !ok {
+		return
+	}
+	ev := util.AccessEvent{
+		Time:       time.Now().UTC(),
+		Operation:  op,
+		CID:        cid,
+		IdxUUID:    guid,
+		Well:       well,
+		Shard:      shard,
+		RemoteAddr: remote,
+	}
+	if opErr != nil {
+		ev.Error = opErr.Error()
+	}
+	if err := ah.RecordAccess(ev); err != nil {
+		w.lgr.Warn("Failed to record shard access", log.KV("cid", cid), log.KV("indexeruuid", guid), log.KV("well", well), log.KV("shard", shard), log.KV("operation", op), log.KVErr(err))
+	}
+}
+
+func (w *Webserver) getAccessHistory(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	var q util.AccessQuery
+	if err = getObject(req, &q); err != nil {
+		serverInvalid(res, err)
+		return
+	} else if !q.Start.IsZero() && !q.End.IsZero() && !q.End.After(q.Start) {
+		serverInvalid(res, errors.New("End must be after Start"))
+		return
+	}
+	if q.Indexer != uuid.Nil && !cust.IndexerAllowed(q.Indexer) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	ah, ok := w.shardHandler.(AccessHistory)
+	if !ok {
+		serverNotImplemented(res, ErrNoHistory)
+		return
+	}
+	q.Indexers = cust.Indexers
+	evs, err := ah.AccessHistory(req.Context(), custID, q)
+	if err != nil {
+		w.lgr.Error("Failed to query access history", log.KV("cid", custID), log.KVErr(err))
+		serverFail(res, err)
+		return
+	}
+	if evs == nil {
+		evs = []util.AccessEvent{}
+	}
+	sendObject(res, evs)
+}
@@ -12,9 +12,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/gravwell/cloudarchive/pkg/tags"
 	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
 )
 
 func (w *Webserver) customerListIndexers(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
@@ -30,13 +34,28 @@ func (w *Webserver) customerListIndexers(res http.ResponseWriter, req *http.Requ
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	lo, err := getListOptions(req)
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
 
-	idx, err := w.shardHandler.ListIndexes(custID)
+	idx, err := w.shardHandler.ListIndexes(req.Context(), custID)
 	if err != nil {
 		serverFail(res, err)
 		return
 	}
-	sendObject(res, idx)
+	// Only report indexers the customer is allowed to access
+	if len(cust.Indexers) > 0 {
+		allowed := make([]string, 0, len(idx))
+		for _, v := range idx {
+			if guid, err := uuid.Parse(v); err == nil && cust.IndexerAllowed(guid) {
+				allowed = append(allowed, v)
+			}
+		}
+		idx = allowed
+	}
+	sendList(res, lo, idx)
 }
 
 func (w *Webserver) indexerListWells(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
@@ -58,13 +77,22 @@ func (w *Webserver) indexerListWells(res http.ResponseWriter, req *http.Request,
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	lo, err := getListOptions(req)
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
 
-	wells, err := w.shardHandler.ListIndexerWells(custID, indexerUUID)
+	wells, err := w.shardHandler.ListIndexerWells(req.Context(), custID, indexerUUID)
 	if err != nil {
 		serverFail(res, err)
 		return
 	}
-	sendObject(res, wells)
+	sendList(res, lo, wells)
 }
 
 func (w *Webserver) indexerGetTags(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
@@ -86,8 +114,12 @@ func (w *Webserver) indexerGetTags(res http.ResponseWriter, req *http.Request, c
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
 
-	tgs, err := w.shardHandler.GetTags(custID, indexerUUID)
+	tgs, err := w.shardHandler.GetTags(req.Context(), custID, indexerUUID)
 	if err != nil {
 		serverFail(res, err)
 		return
@@ -114,6 +146,10 @@ func (w *Webserver) indexerSyncTags(res http.ResponseWriter, req *http.Request,
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
 
 	// read out the tags the indexer sent us
 	var idxTags []tags.TagPair
@@ -122,7 +158,7 @@ func (w *Webserver) indexerSyncTags(res http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	tgs, err := w.shardHandler.SyncTags(custID, indexerUUID, idxTags)
+	tgs, err := w.shardHandler.SyncTags(req.Context(), custID, indexerUUID, idxTags)
 	if err != nil {
 		serverFail(res, err)
 		return
@@ -130,6 +166,83 @@ func (w *Webserver) indexerSyncTags(res http.ResponseWriter, req *http.Request,
 	sendObject(res, tgs)
 }
 
+// IndexerTags holds the tag sets of several indexers, keyed by indexer UUID
+type IndexerTags map[uuid.UUID][]tags.TagPair
+
+// customerGetTags returns the tags stored for each of the customer's indexers, keyed by indexer UUID
+func (w *Webserver) customerGetTags(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	// Get the customer ID
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+
+	idx, err := w.shardHandler.ListIndexes(req.Context(), custID)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	r := IndexerTags{}
+	for _, v := range idx {
+		guid, err := uuid.Parse(v)
+		if err != nil || !cust.IndexerAllowed(guid) {
+			continue
+		}
+		if r[guid], err = w.shardHandler.GetTags(req.Context(), custID, guid); err != nil {
+			serverFail(res, err)
+			return
+		}
+	}
+	sendObject(res, r)
+}
+
+// customerSyncTags merges the tag sets of several indexers in one request, every indexer
+// is checked before any tags are merged so a forbidden indexer changes nothing
+func (w *Webserver) customerSyncTags(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	// Get the customer ID
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+
+	// read out the tags the indexers sent us
+	var idxTags IndexerTags
+	if err := getObject(req, &idxTags); err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	for guid := range idxTags {
+		if !cust.IndexerAllowed(guid) {
+			serverForbidden(res, ErrIndexerNotAllowed)
+			return
+		}
+	}
+
+	r := make(IndexerTags, len(idxTags))
+	for guid, tps := range idxTags {
+		if r[guid], err = w.shardHandler.SyncTags(req.Context(), custID, guid, tps); err != nil {
+			w.lgr.Error("Failed to sync indexer tags", log.KV("cid", custID), log.KV("indexeruuid", guid), log.KVErr(err))
+			serverFail(res, err)
+			return
+		}
+	}
+	sendObject(res, r)
+}
+
 func (w *Webserver) getWellTimeframe(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
 	// Get the customer ID
 	custID, err := getMuxUint64(req, "custid")
@@ -156,8 +269,12 @@ func (w *Webserver) getWellTimeframe(res http.ResponseWriter, req *http.Request,
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
 
-	t, err := w.shardHandler.GetWellTimeframe(custID, indexerUUID, well)
+	t, err := w.shardHandler.GetWellTimeframe(req.Context(), custID, indexerUUID, well)
 	if err != nil {
 		serverFail(res, err)
 		return
@@ -191,6 +308,16 @@ func (w *Webserver) getWellShardsInTimeframe(res http.ResponseWriter, req *http.
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+
+	lo, err := getListOptions(req)
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
 
 	// Now get the arguments
 	var tf util.Timeframe
@@ -209,12 +336,107 @@ func (w *Webserver) getWellShardsInTimeframe(res http.ResponseWriter, req *http.
 
 	// Walk the list of shards we have for this well, grabbing
 	// those which fall within the time range.
-	shards, err := w.shardHandler.GetShardsInTimeframe(custID, indexerUUID, well, tf)
+	shards, err := w.shardHandler.GetShardsInTimeframe(req.Context(), custID, indexerUUID, well, tf)
 	if err != nil {
 		serverFail(res, err)
 		return
 	}
 
 	// Return the list
-	sendObject(res, shards)
+	sendList(res, lo, shards)
+}
+
+func (w *Webserver) getWellTags(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	// Get the customer ID
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	// Get the indexer UUID
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	// Get the well name
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+
+	wtr, ok := w.shardHandler.(WellTagReporter)
+	if !ok {
+		serverNotImplemented(res, ErrNoWellTags)
+		return
+	}
+	tgs, err := wtr.GetWellTags(req.Context(), custID, indexerUUID, well)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	if tgs == nil {
+		tgs = []string{}
+	}
+	sendObject(res, tgs)
+}
+
+func (w *Webserver) getWellStats(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	// Get the customer ID
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	// Get the indexer UUID
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	// Get the well name
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+
+	wsr, ok := w.shardHandler.(WellStatsReporter)
+	if !ok {
+		serverNotImplemented(res, ErrNoWellStats)
+		return
+	}
+	ws, err := wsr.GetWellStats(req.Context(), custID, indexerUUID, well)
+	if err != nil {
+		if os.IsNotExist(err) {
+			serverNotFound(res, err)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	sendObject(res, ws)
 }
@@ -0,0 +1,134 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// query parameters accepted by the indexer, well, and shard listings
+	ListLimitParam  = `limit`
+	ListOffsetParam = `offset`
+	ListPrefixParam = `prefix`
+
+	// MaxListLimit is the largest page a listing returns, larger limits are reduced to it
+	MaxListLimit = 10000
+)
+
+var (
+	ErrBadListLimit  = errors.New("Listing limit must be a positive integer")
+	ErrBadListOffset = errors.New("Listing offset must be a non-negative integer")
+)
+
+// ListOptions selects a page of a listing and filters it by name prefix
+type ListOptions struct {
+	Prefix string // only names starting with Prefix are listed
+	Offset int    // number of matching names skipped before the page starts
+	Limit  int    // largest number of names returned, zero returns up to MaxListLimit
+}
+
+// ListPage is one page of a listing, returned in place of the bare list of names when any of
+// the listing query parameters is given.  Pages are sorted by name so that successive
+// offsets walk the whole listing.
+type ListPage struct {
+	Items  []string
+	Offset int  // offset of the first item within the filtered listing
+	Total  int  // number of names matching the prefix across all pages
+	More   bool // names follow this page, request the next one at Offset+len(Items)
+}
+
+// Query encodes the options as listing query parameters, a limit is always included so
+// the server answers with a ListPage
+func (lo ListOptions) Query() string {
+	v := url.Values{}
+	if lo.Prefix != `` {
+		v.Set(ListPrefixParam, lo.Prefix)
+	}
+	if lo.Offset > 0 {
+		v.Set(ListOffsetParam, strconv.Itoa(lo.Offset))
+	}
+	if lo.Limit <= 0 || lo.Limit > MaxListLimit {
+		lo.Limit = MaxListLimit
+	}
+	v.Set(ListLimitParam, strconv.Itoa(lo.Limit))
+	return `?` + v.Encode()
+}
+
+// getListOptions reads the listing query parameters, nil is returned if none were given
+// and the listing should be answered as before with a bare list.  Listings under /api/v2
+// are always paged.
+func getListOptions(req *http.Request) (lo *ListOptions, err error) {
+	q := req.URL.Query()
+	if ver, _ := apiVersion(req.URL.Path); ver != APIv1 {
+		lo = &ListOptions{}
+	}
+	for _, k := range []string{ListLimitParam, ListOffsetParam, ListPrefixParam} {
+		if _, ok := q[k]; ok {
+			lo = &ListOptions{}
+		}
+	}
+	if lo == nil {
+		return
+	}
+	lo.Prefix = q.Get(ListPrefixParam)
+	if v := q.Get(ListOffsetParam); v != `` {
+		if lo.Offset, err = strconv.Atoi(v); err != nil || lo.Offset < 0 {
+			return nil, ErrBadListOffset
+		}
+	}
+	if v := q.Get(ListLimitParam); v != `` {
+		if lo.Limit, err = strconv.Atoi(v); err != nil || lo.Limit <= 0 {
+			return nil, ErrBadListLimit
+		}
+	}
+	if lo.Limit == 0 || lo.Limit > MaxListLimit {
+		lo.Limit = MaxListLimit
+	}
+	return
+}
+
+// page filters and sorts names and returns the requested page of them
+func (lo ListOptions) page(names []string) (lp ListPage) {
+	matched := make([]string, 0, len(names))
+	for _, v := range names {
+		if strings.HasPrefix(v, lo.Prefix) {
+			matched = append(matched, v)
+		}
+	}
+	sort.Strings(matched)
+	lp.Total = len(matched)
+	lp.Offset = lo.Offset
+	if lo.Offset >= len(matched) {
+		lp.Items = []string{}
+		return
+	}
+	end := len(matched)
+	if lo.Limit > 0 && lo.Offset+lo.Limit < end {
+		end = lo.Offset + lo.Limit
+		lp.More = true
+	}
+	lp.Items = matched[lo.Offset:end]
+	return
+}
+
+// sendList answers a listing request with the bare list of names, or with a page of them
+// when the request asked for one
+func sendList(res http.ResponseWriter, lo *ListOptions, names []string) {
+	if lo == nil {
+		sendObject(res, names)
+	} else {
+		sendObject(res, lo.page(names))
+	}
+}
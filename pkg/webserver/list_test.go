@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestListPage(t *testing.T) {
+	names := []string{`76a10`, `76a00`, `76b00`, `76a08`, `77000`}
+	for _, tc := range []struct {
+		lo   ListOptions
+		want ListPage
+	}{
+		{ListOptions{Limit: 2}, ListPage{Items: []string{`76a00`, `76a08`}, Total: 5, More: true}},
+		{ListOptions{Offset: 2, Limit: 2}, ListPage{Items: []string{`76a10`, `76b00`}, Offset: 2, Total: 5, More: true}},
+		{ListOptions{Offset: 4, Limit: 2}, ListPage{Items: []string{`77000`}, Offset: 4, Total: 5}},
+		{ListOptions{Prefix: `76a`, Limit: 10}, ListPage{Items: []string{`76a00`, `76a08`, `76a10`}, Total: 3}},
+		{ListOptions{Prefix: `76a`, Offset: 3, Limit: 10}, ListPage{Items: []string{}, Offset: 3, Total: 3}},
+		{ListOptions{Prefix: `78`, Limit: 10}, ListPage{Items: []string{}, Total: 0}},
+	} {
+		if got := tc.lo.page(names); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%+v paged to %+v, expected %+v", tc.lo, got, tc.want)
+		}
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	get := func(q string) (*ListOptions, error) {
+		return getListOptions(httptest.NewRequest(http.MethodGet, `/api/shard/1`+q, nil))
+	}
+	if lo, err := get(``); err != nil || lo != nil {
+		t.Fatalf("options without parameters %+v %v", lo, err)
+	}
+	if lo, err := get(`?prefix=76a`); err != nil || lo == nil || lo.Prefix != `76a` || lo.Limit != MaxListLimit {
+		t.Fatalf("bad prefix options %+v %v", lo, err)
+	}
+	if lo, err := get(`?offset=20&limit=50000`); err != nil || lo.Offset != 20 || lo.Limit != MaxListLimit {
+		t.Fatalf("bad limit options %+v %v", lo, err)
+	}
+	for _, q := range []string{`?limit=0`, `?limit=x`, `?offset=-1`} {
+		if _, err := get(q); err == nil {
+			t.Fatalf("bad options %s accepted", q)
+		}
+	}
+	//the client's encoding always asks for a page
+	lo := ListOptions{Prefix: `76a`, Offset: 5}
+	if got, err := get(lo.Query()); err != nil || got == nil || *got != (ListOptions{Prefix: `76a`, Offset: 5, Limit: MaxListLimit}) {
+		t.Fatalf("options %+v round tripped to %+v %v", lo, got, err)
+	}
+}
+
+func TestPagedShardListing(t *testing.T) {
+	const guid = `6b9e4d4e-5b0f-4b8e-9d3e-3f1f1e0f6a11`
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		shardHandler:  &listedBackend{shards: []string{`76a08`, `76a00`, `76a10`}},
+	}
+	if err := w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := w.generateToken(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := func(q string) *httptest.ResponseRecorder {
+		body := `{"Start":"` + time.Unix(0, 0).UTC().Format(time.RFC3339) + `","End":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
+		req := httptest.NewRequest(http.MethodPost, `/api/shard/1/`+guid+`/default`+q, strings.NewReader(body))
+		req.Header.Set(jwtAuthHeader, `Bearer `+tok)
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//without any listing parameters the bare list comes back as it always has
+	var shards []string
+	if rec := list(``); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &shards); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(shards, []string{`76a08`, `76a00`, `76a10`}) {
+		t.Fatalf("bad shards %v", shards)
+	}
+
+	var lp ListPage
+	if rec := list(`?limit=2&offset=1`); rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	} else if err = json.Unmarshal(rec.Body.Bytes(), &lp); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(lp, ListPage{Items: []string{`76a08`, `76a10`}, Offset: 1, Total: 3}) {
+		t.Fatalf("bad page %+v", lp)
+	}
+	if rec := list(`?limit=-1`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad limit answered %d", rec.Code)
+	}
+}
@@ -0,0 +1,635 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/tags"
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	OpenAPIVersion = `3.0.3`
+	APIVersion     = `2.0.0`
+
+	bearerScheme = `bearerAuth`
+)
+
+// routeDoc describes a single method on a route for the OpenAPI specification
+// Request and Response are example values whose types are reflected into schemas,
+// a nil Response means the route answers with a bare status code
+type routeDoc struct {
+	OperationID  string // unique name client generators use for the call
+	Summary      string
+	Auth         bool // requires a JWT from the login route
+	Request      interface{}
+	RequestType  string // content type of the request body, defaults to application/json
+	Response     interface{}
+	ResponseType string // content type of the response body, defaults to application/json
+	Errors       []int  // status codes the route may answer with beyond the common ones
+	Writes       bool   // modifies stored data, so it is refused with 503 while the archive is read-only
+	Paged        bool   // a listing which accepts the listing query parameters and may answer with a ListPage
+}
+
+// apiDocs holds the documentation for every route the webserver installs, keyed by
+// method and unversioned path template.  Every route in installAPIRoutes must have an
+// entry here, the /api/v2 copies of the routes are described by the same entries.
+var apiDocs = map[string]routeDoc{
+	http.MethodGet + ` ` + TEST_PATH: {
+		OperationID: `test`,
+		Summary:     `Check that the server is alive`,
+	},
+	http.MethodGet + ` ` + OPENAPI_PATH: {
+		OperationID: `getOpenAPI`,
+		Summary:     `Get the OpenAPI specification of the HTTP API`,
+		Response:    map[string]interface{}{},
+	},
+	http.MethodGet + ` ` + HEALTH_PATH: {
+		OperationID: `getBackendHealth`,
+		Summary:     `Get the outcome of the latest storage backend health check, answered with 503 while the backend is down and shard pushes are refused`,
+		Response:    BackendHealth{},
+		Errors:      []int{http.StatusServiceUnavailable},
+	},
+	http.MethodGet + ` ` + CAPABILITIES_PATH: {
+		OperationID: `getCapabilities`,
+		Summary:     `Get the API versions and optional features supported by the server and its storage backend`,
+		Response:    Capabilities{},
+	},
+	http.MethodGet + ` ` + ADMIN_USERS_PATH: {
+		OperationID: `adminListUsers`,
+		Summary:     `List every customer, requires the admin role`,
+		Auth:        true,
+		Response:    []auth.UserInfo{},
+		Errors:      []int{http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + ADMIN_USERS_PATH: {
+		OperationID: `adminAddUser`,
+		Summary:     `Create a customer, requires the admin role.  A password is generated and returned once if none is given`,
+		Auth:        true,
+		Request:     AdminUserRequest{},
+		Response:    AdminUserResponse{},
+		Errors:      []int{http.StatusConflict, http.StatusNotImplemented},
+	},
+	http.MethodGet + ` ` + ADMIN_USER_PATH: {
+		OperationID: `adminGetUser`,
+		Summary:     `Get a customer's account details, requires the admin role`,
+		Auth:        true,
+		Response:    auth.UserInfo{},
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodDelete + ` ` + ADMIN_USER_PATH: {
+		OperationID: `adminDeleteUser`,
+		Summary:     `Delete a customer, requires the admin role.  Administrators may not delete themselves`,
+		Auth:        true,
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodPatch + ` ` + ADMIN_USER_PATH: {
+		OperationID: `adminUpdateUser`,
+		Summary:     `Change a customer's account and get the updated account, requires the admin role.  Only the fields given are changed, and administrators may not lock themselves or give up the admin role`,
+		Auth:        true,
+		Request:     AdminUserUpdate{},
+		Response:    auth.UserInfo{},
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + ADMIN_IMPORT_PATH: {
+		OperationID: `adminImportUsers`,
+		Summary:     `Create several customers at once, requires the admin role.  Each is given a password or a bcrypt hash of one, and if any customer is invalid or already exists none are created`,
+		Auth:        true,
+		Request:     []auth.ImportUser{},
+		Errors:      []int{http.StatusConflict, http.StatusNotImplemented},
+	},
+	http.MethodPut + ` ` + ADMIN_PASSWD_PATH: {
+		OperationID: `adminResetPassword`,
+		Summary:     `Reset a customer's password, requires the admin role.  A password is generated and returned once if none is given`,
+		Auth:        true,
+		Request:     AdminUserRequest{},
+		Response:    AdminUserResponse{},
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + ADMIN_REKEY_PATH: {
+		OperationID: `adminReencrypt`,
+		Summary:     `Re-encrypt every stored file which is not encrypted with its customer's current key and answer with the outcome once the pass finishes, requires the admin role.  Only one pass runs at a time`,
+		Auth:        true,
+		Request:     AdminReencryptRequest{},
+		Response:    util.ReencryptResult{},
+		Errors:      []int{http.StatusConflict, http.StatusNotImplemented},
+		Writes:      true,
+	},
+	http.MethodGet + ` ` + METRICS_PATH: {
+		OperationID:  `getMetrics`,
+		Summary:      `Get server gauges in the Prometheus text exposition format, only installed when metrics are enabled`,
+		Response:     ``,
+		ResponseType: `text/plain`,
+	},
+	http.MethodGet + ` ` + AUTH_TEST_PATH: {
+		OperationID: `testAuth`,
+		Summary:     `Check that a token is valid`,
+		Auth:        true,
+	},
+	http.MethodPost + ` ` + LOGIN_TOTP_PATH: {
+		OperationID: `loginTOTP`,
+		Summary:     `Complete a login with the challenge from the login route and a TOTP code`,
+		Request:     loginTOTPType{},
+		Response:    LoginResponse{},
+		Errors:      []int{http.StatusUnprocessableEntity, http.StatusTooManyRequests},
+	},
+	http.MethodPost + ` ` + LOGIN_PATH: {
+		OperationID: `login`,
+		Summary:     `Log in and receive a JWT, or a challenge if a TOTP code is also required`,
+		Request:     loginType{},
+		Response:    LoginResponse{},
+		Errors:      []int{http.StatusUnprocessableEntity, http.StatusLocked, http.StatusTooManyRequests},
+	},
+	http.MethodGet + ` ` + TAG_PATH: {
+		OperationID: `getTags`,
+		Summary:     `Get the tags stored for an indexer`,
+		Auth:        true,
+		Response:    []tags.TagPair{},
+	},
+	http.MethodPost + ` ` + TAG_PATH: {
+		OperationID: `syncTags`,
+		Summary:     `Merge an indexer's tags into the stored set and return the result`,
+		Auth:        true,
+		Writes:      true,
+		Request:     []tags.TagPair{},
+		Response:    []tags.TagPair{},
+	},
+	http.MethodGet + ` ` + CUST_TAGS_PATH: {
+		OperationID: `getAllTags`,
+		Summary:     `Get the tags stored for each of the customer's indexers, keyed by indexer UUID`,
+		Auth:        true,
+		Response:    IndexerTags{},
+	},
+	http.MethodPost + ` ` + CUST_TAGS_PATH: {
+		OperationID: `syncAllTags`,
+		Summary:     `Merge the tags of several indexers, keyed by indexer UUID, into their stored sets and return the results`,
+		Auth:        true,
+		Writes:      true,
+		Request:     IndexerTags{},
+		Response:    IndexerTags{},
+	},
+	http.MethodGet + ` ` + WELL_TAGS_PATH: {
+		OperationID: `getWellTags`,
+		Summary:     `Get the tags assigned to a well`,
+		Auth:        true,
+		Response:    []string{},
+		Errors:      []int{http.StatusNotImplemented},
+	},
+	http.MethodGet + ` ` + WELL_STATS_PATH: {
+		OperationID: `getWellStats`,
+		Summary:     `Get the number of shards stored in a well, their total size, and the time span they cover`,
+		Auth:        true,
+		Response:    util.WellStats{},
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodGet + ` ` + SHARD_INFO_PATH: {
+		OperationID: `getShardInfo`,
+		Summary:     `Get the files, checksums, metadata, and upload provenance stored for a shard`,
+		Auth:        true,
+		Response:    util.ShardInfo{},
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + VERIFY_PATH: {
+		OperationID: `verifyShard`,
+		Summary:     `Unpack a stored shard of the customer in a scratch area and check it against the stored files, requires the admin role.  The report lists any problems found`,
+		Auth:        true,
+		Response:    util.ShardVerification{},
+		Errors:      []int{http.StatusNotFound, http.StatusNotImplemented},
+	},
+	http.MethodGet + ` ` + STATUS_PATH: {
+		OperationID: `getStatus`,
+		Summary:     `Get the customer's in-flight shard transfers`,
+		Auth:        true,
+		Response:    Status{},
+		Errors:      []int{http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + RESERVE_PATH: {
+		OperationID: `reserveShard`,
+		Summary:     `Declare the size of a shard about to be pushed, capacity is held for the push or it is refused with 507 before any data is sent`,
+		Auth:        true,
+		Writes:      true,
+		Request:     ReserveRequest{},
+		Response:    Reservation{},
+		Errors:      []int{http.StatusConflict, http.StatusInsufficientStorage},
+	},
+	http.MethodPost + ` ` + HISTORY_PATH: {
+		OperationID: `getAccessHistory`,
+		Summary:     `Query the customer's record of shard pushes, pulls, and deletes, most recent first, zero fields in the query match everything`,
+		Auth:        true,
+		Request:     util.AccessQuery{},
+		Response:    []util.AccessEvent{},
+		Errors:      []int{http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + SIGN_PATH: {
+		OperationID: `signShardURL`,
+		Summary:     `Mint a URL which anyone holding it may use to pull the shard without a session token until it expires, at most 7 days away`,
+		Auth:        true,
+		Request:     SignURLRequest{},
+		Response:    SignedURL{},
+	},
+	http.MethodGet + ` ` + SIGNED_PATH: {
+		OperationID:  `pullSignedShard`,
+		Summary:      `Download a packed shard through a signed URL, the token in the path takes the place of a session token.  Object store backends may answer with a 302 to the packed shard object`,
+		Response:     []byte{},
+		ResponseType: `application/octet-stream`,
+		Errors:       []int{http.StatusForbidden, http.StatusServiceUnavailable},
+	},
+	http.MethodPost + ` ` + DELTA_PATH: {
+		OperationID: `pushShardDelta`,
+		Summary:     `Upload a packed stream holding only the changed files of a stored shard, the shard's checksum must match the X-Shard-Delta-Base header and the files listed in X-Shard-Delta-Remove are deleted`,
+		Auth:        true,
+		Writes:      true,
+		Request:     []byte{},
+		RequestType: `application/octet-stream`,
+		Errors:      []int{http.StatusNotFound, http.StatusPreconditionFailed, http.StatusLocked, http.StatusNotImplemented, http.StatusInsufficientStorage},
+	},
+	http.MethodPost + ` ` + SHARD_PATH: {
+		OperationID: `pushShard`,
+		Summary:     `Upload a packed shard, a shard which is already stored is refused with 409 when duplicates are rejected or its well is under legal hold`,
+		Auth:        true,
+		Writes:      true,
+		Request:     []byte{},
+		RequestType: `application/octet-stream`,
+		Errors:      []int{http.StatusConflict, http.StatusInsufficientStorage},
+	},
+	http.MethodGet + ` ` + SHARD_PATH: {
+		OperationID:  `pullShard`,
+		Summary:      `Download a packed shard, X-Shard-Uncompressed-Size and X-Shard-Packed-Size-Estimate headers give its size when the backend can compute it.  Object store backends may answer with a 302 to the packed shard object, marked by the X-Shard-Pull-Redirect header`,
+		Auth:         true,
+		Response:     []byte{},
+		ResponseType: `application/octet-stream`,
+		Errors:       []int{http.StatusServiceUnavailable},
+	},
+	http.MethodHead + ` ` + SHARD_PATH: {
+		OperationID: `statShard`,
+		Summary:     `Check whether a shard is stored without downloading it, answering 404 if it is not.  X-Shard-Uncompressed-Size, X-Shard-Packed-Size-Estimate, and X-Shard-Checksum headers describe the stored shard when the backend can report them`,
+		Auth:        true,
+		Errors:      []int{http.StatusNotFound},
+	},
+	http.MethodDelete + ` ` + SHARD_PATH: {
+		OperationID: `deleteShard`,
+		Summary:     `Delete a shard, backends with a trash retention period hold it for restoring until the period expires`,
+		Auth:        true,
+		Writes:      true,
+		Errors:      []int{http.StatusNotFound, http.StatusLocked, http.StatusNotImplemented},
+	},
+	http.MethodGet + ` ` + TRASH_PATH: {
+		OperationID: `listTrash`,
+		Summary:     `List the customer's deleted shards which can still be restored`,
+		Auth:        true,
+		Response:    []util.TrashEntry{},
+		Errors:      []int{http.StatusNotImplemented},
+	},
+	http.MethodPost + ` ` + TRASH_ENT_PATH: {
+		OperationID: `restoreShard`,
+		Summary:     `Restore a deleted shard, refused with 409 if the shard has been stored again since it was deleted`,
+		Auth:        true,
+		Writes:      true,
+		Response:    util.TrashEntry{},
+		Errors:      []int{http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented},
+	},
+	http.MethodGet + ` ` + WELL_PATH: {
+		OperationID: `getWellTimeframe`,
+		Summary:     `Get the timeframe covered by the shards in a well`,
+		Auth:        true,
+		Response:    util.Timeframe{},
+	},
+	http.MethodPost + ` ` + WELL_PATH: {
+		OperationID: `listShardsInTimeframe`,
+		Summary:     `List the stored shards of a well which fall within a timeframe, a ListPage of them sorted by name when limit, offset, or prefix is given and always under /api/v2`,
+		Auth:        true,
+		Request:     util.Timeframe{},
+		Response:    []string{},
+		Paged:       true,
+	},
+	http.MethodGet + ` ` + INDEXER_PATH: {
+		OperationID: `listWells`,
+		Summary:     `List the wells stored for an indexer, a ListPage of them sorted by name when limit, offset, or prefix is given and always under /api/v2`,
+		Auth:        true,
+		Response:    []string{},
+		Paged:       true,
+	},
+	http.MethodGet + ` ` + CUST_PATH: {
+		OperationID: `listIndexers`,
+		Summary:     `List the customer's indexers, a ListPage of them sorted by name when limit, offset, or prefix is given and always under /api/v2`,
+		Auth:        true,
+		Response:    []string{},
+		Paged:       true,
+	},
+}
+
+// listParams describes the query parameters accepted by paged listings
+var listParams = []parameter{
+	{Name: ListPrefixParam, In: `query`, Schema: schema{Type: `string`}},
+	{Name: ListOffsetParam, In: `query`, Schema: schema{Type: `integer`, Format: `int64`}},
+	{Name: ListLimitParam, In: `query`, Schema: schema{Type: `integer`, Format: `int64`}},
+}
+
+// pathParams describes the variables used in route path templates
+var pathParams = map[string]schema{
+	`custid`:  {Type: `integer`, Format: `uint64`},
+	`uuid`:    {Type: `string`, Format: `uuid`},
+	`well`:    {Type: `string`},
+	`shardid`: {Type: `string`},
+	`trashid`: {Type: `string`, Format: `uuid`},
+	`token`:   {Type: `string`},
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	OneOf                []*schema          `json:"oneOf,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Schema   schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type operation struct {
+	Summary     string                `json:"summary"`
+	OperationID string                `json:"operationId"`
+	Parameters  []parameter           `json:"parameters,omitempty"`
+	RequestBody *requestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type securityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat"`
+}
+
+// OpenAPISpec is an OpenAPI document describing the HTTP API
+type OpenAPISpec struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas         map[string]*schema        `json:"schemas"`
+		SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+	} `json:"components"`
+}
+
+// GenerateOpenAPI builds the OpenAPI specification for the full set of HTTP routes,
+// including optional routes such as the metrics endpoint, without starting a webserver
+func GenerateOpenAPI() ([]byte, error) {
+	w := &Webserver{metrics: true}
+	if err := w.buildRequestRouter(); err != nil {
+		return nil, err
+	}
+	spec, err := w.openAPISpec()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(spec, ``, "\t")
+}
+
+// openAPISpec walks the installed routes and describes each of them
+func (w *Webserver) openAPISpec() (spec OpenAPISpec, err error) {
+	spec.OpenAPI = OpenAPIVersion
+	spec.Info.Title = `Gravwell Cloud Archive`
+	spec.Info.Version = APIVersion
+	spec.Paths = map[string]map[string]operation{}
+	spec.Components.Schemas = map[string]*schema{}
+	spec.Components.SecuritySchemes = map[string]securityScheme{
+		bearerScheme: {Type: `http`, Scheme: `bearer`, BearerFormat: `JWT`},
+	}
+	err = w.m.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil //routes without a path, such as the scheme matcher, are not API calls
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		ver, key := apiVersion(tmpl)
+		for _, method := range methods {
+			rd, ok := apiDocs[method+` `+key]
+			if !ok {
+				return fmt.Errorf("route %s %s is not documented", method, tmpl)
+			}
+			op, err := rd.versioned(ver).operation(method, key, spec.Components.Schemas)
+			if err != nil {
+				return err
+			}
+			if spec.Paths[tmpl] == nil {
+				spec.Paths[tmpl] = map[string]operation{}
+			}
+			spec.Paths[tmpl][strings.ToLower(method)] = op
+		}
+		return nil
+	})
+	return
+}
+
+// versioned adjusts the documentation of a route for the API version it is served under
+func (rd routeDoc) versioned(ver string) routeDoc {
+	if ver == APIv1 {
+		return rd
+	}
+	rd.OperationID += strings.ToUpper(ver)
+	if rd.Paged {
+		rd.Response = ListPage{}
+	}
+	return rd
+}
+
+func (rd routeDoc) operation(method, tmpl string, defs map[string]*schema) (op operation, err error) {
+	op.Summary = rd.Summary
+	op.OperationID = rd.OperationID
+	for _, seg := range strings.Split(tmpl, `/`) {
+		if !strings.HasPrefix(seg, `{`) || !strings.HasSuffix(seg, `}`) {
+			continue
+		}
+		name := strings.Trim(seg, `{}`)
+		ps, ok := pathParams[name]
+		if !ok {
+			err = fmt.Errorf("route %s %s has undocumented path parameter %s", method, tmpl, name)
+			return
+		}
+		op.Parameters = append(op.Parameters, parameter{Name: name, In: `path`, Required: true, Schema: ps})
+	}
+	if rd.Request != nil {
+		op.RequestBody = &requestBody{
+			Required: true,
+			Content:  content(rd.RequestType, rd.Request, defs),
+		}
+	}
+	op.Responses = map[string]response{
+		`200`: {Description: `OK`},
+	}
+	if rd.Response != nil {
+		op.Responses[`200`] = response{Description: `OK`, Content: content(rd.ResponseType, rd.Response, defs)}
+	}
+	if rd.Paged {
+		op.Parameters = append(op.Parameters, listParams...)
+	}
+	if _, ok := rd.Response.(ListPage); rd.Paged && !ok {
+		//the bare list is kept for requests without any of the listing parameters
+		op.Responses[`200`] = response{Description: `OK`, Content: map[string]mediaType{
+			`application/json`: {Schema: &schema{OneOf: []*schema{
+				schemaOf(reflect.TypeOf(rd.Response), defs),
+				schemaOf(reflect.TypeOf(ListPage{}), defs),
+			}}},
+		}}
+	}
+	errs := append([]int{}, rd.Errors...)
+	if rd.Writes {
+		errs = append(errs, http.StatusServiceUnavailable)
+	}
+	if rd.Auth {
+		op.Security = []map[string][]string{{bearerScheme: {}}}
+		errs = append(errs, http.StatusUnauthorized, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError)
+	}
+	for _, code := range errs {
+		r := response{Description: http.StatusText(code)}
+		if code != http.StatusUnauthorized {
+			r.Content = content(``, struct{ Error string }{}, defs)
+		}
+		if (code == http.StatusUnprocessableEntity || code == http.StatusLocked || code == http.StatusTooManyRequests) && strings.HasPrefix(tmpl, LOGIN_PATH) {
+			r.Content = content(``, LoginResponse{}, defs)
+		} else if code == http.StatusConflict && tmpl == SHARD_PATH {
+			r.Content = content(``, DuplicateShard{}, defs)
+		} else if code == http.StatusServiceUnavailable && tmpl == HEALTH_PATH {
+			r.Content = content(``, BackendHealth{}, defs)
+		}
+		op.Responses[strconv.Itoa(code)] = r
+	}
+	return
+}
+
+func content(ct string, v interface{}, defs map[string]*schema) map[string]mediaType {
+	if ct == `` {
+		ct = `application/json`
+	}
+	return map[string]mediaType{
+		ct: {Schema: schemaOf(reflect.TypeOf(v), defs)},
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+// schemaOf reflects a type into a schema as encoding/json would marshal it,
+// named structs are added to defs and referenced
+func schemaOf(t reflect.Type, defs map[string]*schema) *schema {
+	switch t {
+	case timeType:
+		return &schema{Type: `string`, Format: `date-time`}
+	case uuidType:
+		return &schema{Type: `string`, Format: `uuid`}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), defs)
+	case reflect.Bool:
+		return &schema{Type: `boolean`}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &schema{Type: `integer`, Format: `int64`}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: `integer`, Format: `uint64`}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: `number`}
+	case reflect.String:
+		return &schema{Type: `string`}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &schema{Type: `string`, Format: `binary`}
+		}
+		return &schema{Type: `array`, Items: schemaOf(t.Elem(), defs)}
+	case reflect.Map:
+		return &schema{Type: `object`, AdditionalProperties: schemaOf(t.Elem(), defs)}
+	case reflect.Struct:
+		if t.Name() == `` {
+			return structSchema(t, defs)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := defs[name]; !ok {
+			defs[name] = nil //reserve the name in case the type refers to itself
+			defs[name] = structSchema(t, defs)
+		}
+		return &schema{Ref: `#/components/schemas/` + name}
+	}
+	return &schema{}
+}
+
+func structSchema(t reflect.Type, defs map[string]*schema) *schema {
+	s := &schema{Type: `object`, Properties: map[string]*schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := f.Tag.Get(`json`); tag != `` {
+			if tag == `-` {
+				continue
+			} else if n, _, _ := strings.Cut(tag, `,`); n != `` {
+				name = n
+			}
+		}
+		if f.Anonymous && f.Tag.Get(`json`) == `` && f.Type.Kind() == reflect.Struct {
+			//embedded struct fields are promoted into the parent object
+			for k, v := range structSchema(f.Type, defs).Properties {
+				s.Properties[k] = v
+			}
+			continue
+		} else if !f.IsExported() {
+			continue
+		}
+		s.Properties[name] = schemaOf(f.Type, defs)
+	}
+	return s
+}
+
+// openAPIHandler serves the specification for the routes installed on this webserver
+func (w *Webserver) openAPIHandler(res http.ResponseWriter, req *http.Request) {
+	spec, err := w.openAPISpec()
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	sendObject(res, spec)
+}
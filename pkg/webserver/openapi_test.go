@@ -0,0 +1,129 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPIRoutes ensures the route documentation and the installed routes match exactly
+// and that every API route is served under each API version
+func TestOpenAPIRoutes(t *testing.T) {
+	w := &Webserver{metrics: true}
+	if err := w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	installed := map[string]bool{}
+	versioned := map[string]bool{}
+	err := w.m.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil //not a path route
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("route %s has no methods", tmpl)
+		}
+		ver, key := apiVersion(tmpl)
+		for _, m := range methods {
+			installed[m+` `+key] = true
+			versioned[ver+` `+m+` `+key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range installed {
+		if _, ok := apiDocs[k]; !ok {
+			t.Errorf("route %s is missing from apiDocs", k)
+		}
+	}
+	ids := map[string]string{}
+	for k, rd := range apiDocs {
+		if !installed[k] {
+			t.Errorf("apiDocs entry %s has no route", k)
+		}
+		if rd.OperationID == `` {
+			t.Errorf("apiDocs entry %s has no operation ID", k)
+		} else if prev, ok := ids[rd.OperationID]; ok {
+			t.Errorf("apiDocs entries %s and %s share operation ID %s", prev, k, rd.OperationID)
+		}
+		ids[rd.OperationID] = k
+	}
+	for k := range installed {
+		if !strings.HasPrefix(k[strings.Index(k, ` `)+1:], apiPrefix+`/`) {
+			continue
+		}
+		for _, ver := range apiVersions {
+			if !versioned[ver+` `+k] {
+				t.Errorf("route %s is not served under API %s", k, ver)
+			}
+		}
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	bts, err := GenerateOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec OpenAPISpec
+	if err = json.Unmarshal(bts, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Paths) == 0 {
+		t.Fatal("no paths in specification")
+	}
+	pull, ok := spec.Paths[SHARD_PATH][`get`]
+	if !ok {
+		t.Fatalf("missing shard pull operation")
+	} else if len(pull.Parameters) != 4 || len(pull.Security) != 1 {
+		t.Fatalf("bad shard pull operation: %+v", pull)
+	}
+	if _, ok := spec.Paths[apiPath(APIv2, SHARD_PATH)][`get`]; !ok {
+		t.Fatalf("missing v2 shard pull operation")
+	}
+	if _, ok := spec.Components.Schemas[`ShardInfo`]; !ok {
+		t.Fatalf("missing ShardInfo schema")
+	}
+	//every schema reference must resolve
+	for _, ref := range strings.Split(string(bts), `"$ref": "#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Fatalf("unresolved schema reference %s", name)
+		}
+	}
+
+	//a running server serves the specification for its own routes, without metrics if disabled
+	w := &Webserver{}
+	if err = w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	w.m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, OPENAPI_PATH, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	}
+	spec = OpenAPISpec{}
+	if err = json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spec.Paths[METRICS_PATH]; ok {
+		t.Fatal("metrics path served when disabled")
+	} else if _, ok := spec.Paths[OPENAPI_PATH]; !ok {
+		t.Fatal("served specification is missing its own path")
+	}
+}
@@ -9,18 +9,105 @@
 package webserver
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// ShardChecksumHeader carries the hex encoded SHA256 of a packed shard push, it may be sent
+	// as a header or, since clients pack as they upload, as a trailer
+	ShardChecksumHeader = `X-Shard-Sha256`
+	// ShardVerifiedHeader on a push response reports whether the stream was checked against the client's checksum
+	ShardVerifiedHeader = `X-Shard-Sha256-Verified`
+)
+
+var (
+	ErrChecksumMismatch = errors.New("Shard checksum mismatch")
+)
+
+// checksumReader verifies a push body against the checksum the client sent with it,
+// a mismatch is returned in place of io.EOF so that the unpack fails.  Clients which
+// cannot send trailers, or whose trailers are stripped along the way, are not verified.
+type checksumReader struct {
+	io.ReadCloser
+	req      *http.Request
+	h        hash.Hash // nil if the client did not offer a checksum
+	verified bool
+	missing  bool // a checksum trailer was announced but never arrived
+}
+
+func newChecksumReader(req *http.Request) *checksumReader {
+	cr := &checksumReader{
+		ReadCloser: req.Body,
+		req:        req,
+	}
+	if _, ok := req.Trailer[ShardChecksumHeader]; ok || req.Header.Get(ShardChecksumHeader) != `` {
+		cr.h = sha256.New()
+	}
+	return cr
+}
+
+func (cr *checksumReader) Read(b []byte) (n int, err error) {
+	n, err = cr.ReadCloser.Read(b)
+	if cr.h == nil {
+		return
+	}
+	cr.h.Write(b[:n])
+	if err == io.EOF {
+		//trailers are only populated once the body has been read
+		want := cr.req.Header.Get(ShardChecksumHeader)
+		if want == `` {
+			want = cr.req.Trailer.Get(ShardChecksumHeader)
+		}
+		if got := hex.EncodeToString(cr.h.Sum(nil)); want == `` {
+			cr.missing = true
+		} else if strings.EqualFold(want, got) {
+			cr.verified = true
+		} else {
+			err = fmt.Errorf("%w: received %s, client sent %q", ErrChecksumMismatch, got, want)
+		}
+		cr.h = nil
+	}
+	return
+}
+
+var (
+	ErrTransferDeadline = errors.New("Transfer exceeded the maximum duration")
+)
+
+// transferContext bounds a push or pull by an absolute maximum duration, zero is unlimited
+func transferContext(ctx context.Context, max time.Duration) (context.Context, context.CancelFunc) {
+	if max <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, max)
+}
+
+// deadlineError reports a transfer which failed because it ran out of time as such
+func deadlineError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded && !errors.Is(err, ErrTransferDeadline) {
+		err = fmt.Errorf("%w: %v", ErrTransferDeadline, err)
+	}
+	return err
+}
+
 type rateTimeoutReader struct {
-	res http.ResponseWriter
-	rdr io.ReadCloser
-	tmr *time.Timer
-	to  time.Duration
-	err error
+	res  http.ResponseWriter
+	rdr  io.ReadCloser
+	tmr  *time.Timer
+	dtmr *time.Timer // absolute deadline, nil if unlimited
+	to   time.Duration
+	mtx  sync.Mutex // err is set by the timers
+	err  error
 }
 
 func newRateTimeoutReader(rdr io.ReadCloser, to time.Duration, res http.ResponseWriter) (rtr *rateTimeoutReader, err error) {
@@ -45,8 +132,22 @@ func (rtr *rateTimeoutReader) resetReader(rdr io.ReadCloser) {
 // the response writer to get a handle on the underlying net.Conn, THEN we close that conn.  This will cause
 // reads to fail on the request.Body and things to exit and clean up.
 func (rtr *rateTimeoutReader) timeout() {
+	rtr.abort(errors.New("Timeout"))
+}
+
+// limit closes the connection once the transfer has run for max, no matter how fast it is going,
+// so that a pathologically slow client cannot hold a shard for days
+func (rtr *rateTimeoutReader) limit(max time.Duration) {
+	if max > 0 && rtr.dtmr == nil {
+		rtr.dtmr = time.AfterFunc(max, func() { rtr.abort(ErrTransferDeadline) })
+	}
+}
+
+func (rtr *rateTimeoutReader) abort(err error) {
 	if rtr.rdr != nil && rtr.res != nil {
-		rtr.err = errors.New("Timeout")
+		rtr.mtx.Lock()
+		rtr.err = err
+		rtr.mtx.Unlock()
 		if hj, ok := rtr.res.(http.Hijacker); ok {
 			if conn, _, err := hj.Hijack(); err != nil {
 				return
@@ -69,30 +170,40 @@ func (rtr *rateTimeoutReader) Close() error {
 	if rtr.tmr != nil {
 		rtr.tmr.Stop()
 	}
+	if rtr.dtmr != nil {
+		rtr.dtmr.Stop()
+	}
 	return rtr.rdr.Close()
 }
 
 func (rtr *rateTimeoutReader) Read(b []byte) (n int, err error) {
-	if rtr.err != nil {
+	if err = rtr.timeoutErr(); err != nil {
 		//short circuit out
-		err = rtr.err
 		return
 	}
 	//issue the read
 	if n, err = rtr.rdr.Read(b); err == nil {
 		rtr.tmr.Reset(rtr.to)
-	} else if rtr.err != nil {
+	} else if terr := rtr.timeoutErr(); terr != nil {
 		//check if the internal errors should override the return of the read call
-		err = rtr.err
+		err = terr
 	}
 	return
 }
 
+func (rtr *rateTimeoutReader) timeoutErr() error {
+	rtr.mtx.Lock()
+	defer rtr.mtx.Unlock()
+	return rtr.err
+}
+
 type rateTimeoutWriter struct {
-	tmr *time.Timer
-	to  time.Duration
-	res http.ResponseWriter
-	err error
+	tmr  *time.Timer
+	dtmr *time.Timer // absolute deadline, nil if unlimited
+	to   time.Duration
+	res  http.ResponseWriter
+	mtx  sync.Mutex // err is set by the deadline timer
+	err  error
 }
 
 func newRateTimeoutWriter(res http.ResponseWriter, to time.Duration) (wtw *rateTimeoutWriter, err error) {
@@ -119,6 +230,18 @@ func (wtw *rateTimeoutWriter) timeout() {
 	}
 }
 
+// limit closes the connection once the transfer has run for max, no matter how fast it is going
+func (wtw *rateTimeoutWriter) limit(max time.Duration) {
+	if max > 0 && wtw.dtmr == nil {
+		wtw.dtmr = time.AfterFunc(max, func() {
+			wtw.mtx.Lock()
+			wtw.err = ErrTransferDeadline
+			wtw.mtx.Unlock()
+			wtw.timeout()
+		})
+	}
+}
+
 func (wtw *rateTimeoutWriter) start() error {
 	if wtw.tmr == nil {
 		wtw.tmr = time.AfterFunc(wtw.to, wtw.timeout)
@@ -131,13 +254,15 @@ func (wtw *rateTimeoutWriter) Close() (err error) {
 	if wtw.tmr != nil {
 		wtw.tmr.Stop()
 	}
+	if wtw.dtmr != nil {
+		wtw.dtmr.Stop()
+	}
 	return nil
 }
 
 func (wtw *rateTimeoutWriter) Write(b []byte) (n int, err error) {
-	if wtw.err != nil {
+	if err = wtw.timeoutErr(); err != nil {
 		//short circuit out
-		err = wtw.err
 		return
 	} else if wtw.res == nil {
 		err = errors.New("Empty connection")
@@ -146,9 +271,15 @@ func (wtw *rateTimeoutWriter) Write(b []byte) (n int, err error) {
 	//issue the read
 	if n, err = wtw.res.Write(b); err == nil {
 		wtw.tmr.Reset(wtw.to)
-	} else if wtw.err != nil {
+	} else if terr := wtw.timeoutErr(); terr != nil {
 		//check if the internal errors should override the return of the read call
-		err = wtw.err
+		err = terr
 	}
 	return
 }
+
+func (wtw *rateTimeoutWriter) timeoutErr() error {
+	wtw.mtx.Lock()
+	defer wtw.mtx.Unlock()
+	return wtw.err
+}
@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransferDeadline(t *testing.T) {
+	errch := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		rdr, err := newRateTimeoutReader(req.Body, time.Second, res)
+		if err != nil {
+			errch <- err
+			return
+		}
+		defer rdr.Close()
+		rdr.limit(200 * time.Millisecond)
+		_, err = io.Copy(ioutil.Discard, rdr)
+		errch <- err
+	}))
+	defer srv.Close()
+
+	//trickle a byte at a time, fast enough to keep the stall watchdog happy
+	prdr, pwtr := io.Pipe()
+	go func() {
+		for {
+			if _, err := pwtr.Write([]byte{0}); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	defer prdr.Close()
+	go http.Post(srv.URL, `application/octet-stream`, prdr)
+
+	select {
+	case err := <-errch:
+		if !errors.Is(err, ErrTransferDeadline) {
+			t.Fatalf("slow push was not cut off by the deadline: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow push was never cut off")
+	}
+
+	ctx, cf := transferContext(context.Background(), time.Millisecond)
+	defer cf()
+	<-ctx.Done()
+	if err := deadlineError(ctx, ctx.Err()); !errors.Is(err, ErrTransferDeadline) {
+		t.Fatalf("expired transfer reported as %v", err)
+	} else if err = deadlineError(ctx, nil); err != nil {
+		t.Fatalf("successful transfer reported as %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrArchiveReadOnly = errors.New("Archive is read-only, shard pushes, deletes, and tag changes are not accepted")
+)
+
+// AuthWriteUser ensures the user holds credentials which may modify data and that the
+// archive is accepting changes.  Pulls, listings, and tag reads are unaffected by read-only mode.
+func (w *Webserver) AuthWriteUser(res http.ResponseWriter, req *http.Request) (cust *CustomerDetails) {
+	if cust = w.AuthFullUser(res, req); cust != nil && w.readOnly {
+		w.lgr.Info("AuthWriteUser refused, archive is read-only", log.KV("cid", cust.CustomerNumber), log.KV("method", req.Method), log.KV("url", req.URL.Path))
+		sendError(res, ErrArchiveReadOnly, http.StatusServiceUnavailable)
+		cust = nil
+	}
+	return
+}
+
+// writeCustomer returns the authenticated customer if it may modify data and the archive is accepting changes
+func (g *grpcServer) writeCustomer(ctx context.Context) (cust *CustomerDetails, err error) {
+	if cust, err = grpcFullCustomer(ctx); err == nil && g.w.readOnly {
+		cust = nil
+		err = status.Error(codes.Unavailable, ErrArchiveReadOnly.Error())
+	}
+	return
+}
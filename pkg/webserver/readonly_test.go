@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+func TestReadOnly(t *testing.T) {
+	w := &Webserver{
+		lgr:           log.NewDiscardLogger(),
+		hmacSecret:    []byte(`0123456789abcdef`),
+		tokenIssuer:   defaultTokenIssuer,
+		tokenAudience: defaultTokenAudience,
+		readOnly:      true,
+	}
+	if err := w.buildRequestRouter(); err != nil {
+		t.Fatal(err)
+	}
+	full, err := w.generateToken(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err := w.generateToken(1, jwt.MapClaims{roleClaim: auth.RoleReadOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const guid = `6b9e4d4e-5b0f-4b8e-9d3e-3f1f1e0f6a11`
+	for _, tc := range []struct {
+		method, path, tok string
+		status            int
+	}{
+		{http.MethodPost, `/api/shard/1/` + guid + `/default/76a00`, full, http.StatusServiceUnavailable},
+		{http.MethodDelete, `/api/shard/1/` + guid + `/default/76a00`, full, http.StatusServiceUnavailable},
+		{http.MethodPost, `/api/tags/1/` + guid, full, http.StatusServiceUnavailable},
+		{http.MethodPost, `/api/tags/1`, full, http.StatusServiceUnavailable},
+		//read-only credentials are still refused as such
+		{http.MethodPost, `/api/shard/1/` + guid + `/default/76a00`, ro, http.StatusForbidden},
+		{http.MethodPost, `/api/shard/1/` + guid + `/default/76a00`, ``, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.tok != `` {
+			req.Header.Set(jwtAuthHeader, `Bearer `+tc.tok)
+		}
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Fatalf("%s %s answered %d, expected %d", tc.method, tc.path, rec.Code, tc.status)
+		} else if tc.status == http.StatusServiceUnavailable && !strings.Contains(rec.Body.String(), ErrArchiveReadOnly.Error()) {
+			t.Fatalf("%s %s did not report read-only mode: %s", tc.method, tc.path, rec.Body.String())
+		}
+	}
+}
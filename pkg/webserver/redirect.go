@@ -0,0 +1,60 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	// PullRedirectHeader marks a pull answered with a redirect to the object holding the
+	// packed shard, clients fetch the object without their session token
+	PullRedirectHeader = `X-Shard-Pull-Redirect`
+)
+
+var (
+	ErrNoRedirect = errors.New("Shard cannot be pulled by redirect")
+)
+
+// PullRedirector is an optional interface for object store backends which keep each shard as
+// a single packed object.  RedirectPull returns a presigned URL which serves the shard exactly
+// as PackShard would write it, pulls are then redirected there so the shard data bypasses the
+// archive server.  ErrNoRedirect, such as when redirects are disabled or the shard is not held
+// as one object, has the webserver stream the shard itself.
+type PullRedirector interface {
+	RedirectPull(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (string, error)
+}
+
+// redirectPull answers a pull with a redirect when the backend can hand out a URL for the
+// shard, returning false if the shard must be streamed instead
+func (w *Webserver) redirectPull(res http.ResponseWriter, req *http.Request, custID uint64, indexerUUID uuid.UUID, well, shard string) bool {
+	pr, ok := w.shardHandler.(PullRedirector)
+	if !ok {
+		return false
+	}
+	url, err := pr.RedirectPull(req.Context(), custID, indexerUUID, well, shard)
+	if err != nil {
+		if !errors.Is(err, ErrNoRedirect) {
+			w.lgr.Warn("Failed to redirect shard pull, streaming it", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
+		}
+		return false
+	}
+	w.lgr.Info("Shard pull redirected", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+	w.recordAccess(util.AccessPull, custID, indexerUUID, well, shard, remoteHost(req.RemoteAddr), nil)
+	res.Header().Set(PullRedirectHeader, `true`)
+	http.Redirect(res, req, url, http.StatusFound)
+	return true
+}
@@ -0,0 +1,215 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	reserveHeadroom = 64 * 1024 * 1024 //free space left over after every reservation is met
+)
+
+var (
+	reservationTTL = 15 * time.Minute //how long a reservation waits for its push
+
+	ErrInsufficientCapacity = errors.New("Insufficient storage capacity for shard")
+	ErrInvalidReservation   = errors.New("Reservation size must be greater than zero")
+)
+
+// FreeSpaceReporter is an optional interface a ShardHandler may implement so that upload
+// reservations are refused when its storage cannot hold the shard
+type FreeSpaceReporter interface {
+	FreeSpace() (uint64, error)
+}
+
+// ReserveRequest declares the size of a shard which is about to be pushed
+type ReserveRequest struct {
+	Size uint64 // estimated size of the shard files in bytes
+}
+
+// Reservation is capacity held for a shard push until the push finishes or the reservation expires
+type Reservation struct {
+	Shard   string
+	Size    uint64
+	Expires time.Time
+}
+
+type reservation struct {
+	Reservation
+	uid util.UploadID
+}
+
+// reservations tracks the capacity promised to shard pushes which have not finished yet,
+// a shard holds at most one reservation and reserving it again replaces the old one
+type reservations struct {
+	sync.Mutex
+	res map[util.UploadID]reservation
+}
+
+func newReservations() *reservations {
+	return &reservations{
+		res: map[util.UploadID]reservation{},
+	}
+}
+
+// reserve holds size bytes for the shard if check, handed the bytes already reserved for the
+// customer and for everyone, approves.  Checking and reserving under one lock ensures concurrent
+// reservations cannot together promise more than is available.
+func (rs *reservations) reserve(uid util.UploadID, size uint64, check func(cust, total uint64) error) (r Reservation, err error) {
+	rs.Lock()
+	defer rs.Unlock()
+	now := time.Now()
+	var cust, total uint64
+	for k, v := range rs.res {
+		if k == uid || v.Expires.Before(now) {
+			delete(rs.res, k)
+			continue
+		}
+		if k.CID == uid.CID {
+			cust += v.Size
+		}
+		total += v.Size
+	}
+	if err = check(cust, total); err != nil {
+		return
+	}
+	r = Reservation{
+		Shard:   uid.Shard,
+		Size:    size,
+		Expires: now.Add(reservationTTL).UTC(),
+	}
+	rs.res[uid] = reservation{Reservation: r, uid: uid}
+	return
+}
+
+// release drops the reservation for a shard, if it has one
+func (rs *reservations) release(uid util.UploadID) {
+	rs.Lock()
+	delete(rs.res, uid)
+	rs.Unlock()
+}
+
+// reserved returns the bytes currently reserved across all customers
+func (rs *reservations) reserved() (total uint64) {
+	rs.Lock()
+	defer rs.Unlock()
+	now := time.Now()
+	for _, v := range rs.res {
+		if !v.Expires.Before(now) {
+			total += v.Size
+		}
+	}
+	return
+}
+
+// reserveShard lets a client check that a shard will be accepted before sending any of it
+func (w *Webserver) reserveShard(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	var rr ReserveRequest
+	if err = getObject(req, &rr); err != nil {
+		serverInvalid(res, err)
+		return
+	} else if rr.Size == 0 {
+		serverInvalid(res, ErrInvalidReservation)
+		return
+	}
+	if w.backendDown(res) {
+		return
+	}
+	if dup, err := w.existingShard(req.Context(), custID, indexerUUID, well, shard); err != nil {
+		serverFail(res, err)
+		return
+	} else if dup != nil {
+		w.lgr.Info("Duplicate shard reservation rejected", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+		sendConflict(res, dup)
+		return
+	}
+
+	uid := util.UploadID{
+		CID:     custID,
+		IdxUUID: indexerUUID,
+		Well:    well,
+		Shard:   shard,
+	}
+	r, err := w.reservations.reserve(uid, rr.Size, func(custReserved, totalReserved uint64) error {
+		return w.checkCapacity(req.Context(), cust, rr.Size, custReserved, totalReserved)
+	})
+	if err != nil {
+		w.lgr.Info("Shard reservation rejected", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KV("size", rr.Size), log.KVErr(err))
+		if err == ErrQuotaExceeded || err == ErrInsufficientCapacity {
+			sendError(res, err, http.StatusInsufficientStorage)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	w.lgr.Info("Shard reserved", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KV("size", rr.Size))
+	sendObject(res, r)
+}
+
+// checkCapacity ensures a shard of the given size fits within the customer's quota and the
+// backend's free space once the outstanding reservations are accounted for
+func (w *Webserver) checkCapacity(ctx context.Context, cust *CustomerDetails, size, custReserved, totalReserved uint64) error {
+	if ur, ok := w.shardHandler.(UsageReporter); ok && cust.Quota != 0 {
+		usage, err := ur.CustomerUsage(ctx, cust.CustomerNumber)
+		if err != nil {
+			return err
+		} else if usage+custReserved+size > cust.Quota {
+			return ErrQuotaExceeded
+		}
+	}
+	if fsr, ok := w.shardHandler.(FreeSpaceReporter); ok {
+		free, err := fsr.FreeSpace()
+		if err != nil {
+			//platforms without free space checks just don't get them
+			w.lgr.Debug("Unable to check free space for shard reservation", log.KVErr(err))
+		} else if totalReserved+size+reserveHeadroom > free {
+			return ErrInsufficientCapacity
+		}
+	}
+	return nil
+}
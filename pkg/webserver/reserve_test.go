@@ -0,0 +1,69 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+)
+
+func TestReservations(t *testing.T) {
+	rs := newReservations()
+	guid := uuid.New()
+	a := util.UploadID{CID: 1, IdxUUID: guid, Well: `default`, Shard: `76a00`}
+	b := util.UploadID{CID: 1, IdxUUID: guid, Well: `default`, Shard: `76a08`}
+	c := util.UploadID{CID: 2, IdxUUID: guid, Well: `default`, Shard: `76a00`}
+
+	//a check which allows at most 250 bytes in total and 150 per customer
+	limit := func(size uint64) func(cust, total uint64) error {
+		return func(cust, total uint64) error {
+			if cust+size > 150 {
+				return ErrQuotaExceeded
+			} else if total+size > 250 {
+				return ErrInsufficientCapacity
+			}
+			return nil
+		}
+	}
+	if r, err := rs.reserve(a, 100, limit(100)); err != nil {
+		t.Fatal(err)
+	} else if r.Shard != `76a00` || r.Size != 100 || r.Expires.Before(time.Now()) {
+		t.Fatalf("bad reservation %+v", r)
+	}
+	if _, err := rs.reserve(b, 100, limit(100)); err != ErrQuotaExceeded {
+		t.Fatalf("customer over reserved: %v", err)
+	}
+	//reserving the same shard again replaces the old reservation
+	if _, err := rs.reserve(a, 140, limit(140)); err != nil {
+		t.Fatal(err)
+	} else if n := rs.reserved(); n != 140 {
+		t.Fatalf("bad reserved total %d", n)
+	}
+	if _, err := rs.reserve(c, 120, limit(120)); err != ErrInsufficientCapacity {
+		t.Fatalf("capacity over reserved: %v", err)
+	}
+	//finishing a push frees its reservation
+	rs.release(a)
+	if _, err := rs.reserve(c, 120, limit(120)); err != nil {
+		t.Fatal(err)
+	}
+
+	//expired reservations no longer count
+	defer func(ttl time.Duration) { reservationTTL = ttl }(reservationTTL)
+	reservationTTL = -time.Second
+	if _, err := rs.reserve(b, 100, limit(100)); err != nil {
+		t.Fatal(err)
+	} else if n := rs.reserved(); n != 120 {
+		t.Fatalf("expired reservation counted, reserved %d", n)
+	}
+}
@@ -9,10 +9,14 @@
 package webserver
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/gravwell/cloudarchive/pkg/tags"
@@ -23,19 +27,134 @@ import (
 	"github.com/gravwell/gravwell/v3/ingest/log"
 )
 
+const (
+	// size hints sent with shard pulls when the storage backend can compute them
+	ShardUncompressedSizeHeader = `X-Shard-Uncompressed-Size`
+	ShardPackedSizeHeader       = `X-Shard-Packed-Size-Estimate`
+	// ShardStoredChecksumHeader carries the checksum of a stored shard's files on a HEAD of the
+	// shard, it is the checksum reported for duplicate pushes and expected in X-Shard-Delta-Base
+	ShardStoredChecksumHeader = `X-Shard-Checksum`
+)
+
 var (
 	transferTickTimeout = 30 * time.Second
+	shardLockWait       = time.Minute //how long a push waits on another upload of the same shard
+	pullRetryAfter      = 30          //seconds a refused pull is told to wait before retrying
+
+	ErrQuotaExceeded = errors.New("Storage quota exceeded")
+	ErrNoWellTags    = errors.New("Storage backend does not support well tag queries")
+	ErrNoShardInfo   = errors.New("Storage backend does not support shard metadata queries")
+	ErrNoWellStats   = errors.New("Storage backend does not support well statistics")
+	ErrNoDelete      = errors.New("Storage backend does not support deleting shards")
+
+	ErrInvalidDuplicatePolicy = errors.New("Invalid duplicate shard policy")
+)
+
+// DuplicatePolicy controls what happens when a shard which is already stored is pushed again
+type DuplicatePolicy string
+
+const (
+	DuplicateVersion DuplicatePolicy = `version` // keep both, the storage backend stores the new copy with a .N suffix
+	DuplicateReject  DuplicatePolicy = `reject`  // refuse the push with 409 Conflict
 )
 
+// DuplicateShard is the body of the 409 Conflict response to a rejected duplicate push, clients
+// can compare the checksum against their own copy to decide whether the push was redundant
+type DuplicateShard struct {
+	Error    string
+	Checksum string         // see util.ShardInfo.Checksum
+	Shard    util.ShardInfo // the stored copy
+}
+
+// ShardHandler is a storage backend, the context passed to each method is the context of
+// the request being served and backends should abandon their work once it is done
 type ShardHandler interface {
-	UnpackShard(cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error
-	PackShard(cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) error
-	ListIndexes(cid uint64) ([]string, error)
-	ListIndexerWells(cid uint64, guid uuid.UUID) ([]string, error)
-	GetWellTimeframe(cid uint64, guid uuid.UUID, well string) (util.Timeframe, error)
-	GetShardsInTimeframe(cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error)
-	GetTags(cid uint64, guid uuid.UUID) ([]tags.TagPair, error)
-	SyncTags(cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error)
+	UnpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error
+	PackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, wtr io.Writer) error
+	ListIndexes(ctx context.Context, cid uint64) ([]string, error)
+	ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) ([]string, error)
+	GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (util.Timeframe, error)
+	GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error)
+	GetTags(ctx context.Context, cid uint64, guid uuid.UUID) ([]tags.TagPair, error)
+	SyncTags(ctx context.Context, cid uint64, guid uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error)
+}
+
+// UsageReporter is an optional interface a ShardHandler may implement
+// so that customer storage quotas can be enforced
+type UsageReporter interface {
+	CustomerUsage(ctx context.Context, cid uint64) (uint64, error)
+}
+
+// WellTagReporter is an optional interface a ShardHandler may implement
+// so that the tags assigned to a well can be retrieved without pulling a shard
+type WellTagReporter interface {
+	GetWellTags(ctx context.Context, cid uint64, guid uuid.UUID, well string) ([]string, error)
+}
+
+// WellStatsReporter is an optional interface a ShardHandler may implement so that
+// clients can size a well without listing and querying each of its shards
+type WellStatsReporter interface {
+	GetWellStats(ctx context.Context, cid uint64, guid uuid.UUID, well string) (util.WellStats, error)
+}
+
+// ShardInfoReporter is an optional interface a ShardHandler may implement
+// so that clients can verify their shards against the stored copy
+type ShardInfoReporter interface {
+	GetShardInfo(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (util.ShardInfo, error)
+}
+
+// ShardSizer is an optional interface a ShardHandler may implement so that
+// pulls advertise how much data they will transfer
+type ShardSizer interface {
+	GetShardSize(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (util.ShardSize, error)
+}
+
+// WaitingShardUnpacker is an optional interface a ShardHandler may implement so that a push
+// of a shard which is already being uploaded waits up to wait for that upload rather than failing
+type WaitingShardUnpacker interface {
+	UnpackShardWait(ctx context.Context, wait time.Duration, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error
+}
+
+// ExclusiveShardUnpacker is an optional interface a ShardHandler may implement so that duplicate
+// pushes are rejected even when racing each other, it must fail with util.ErrShardExists if the shard is already stored
+type ExclusiveShardUnpacker interface {
+	UnpackNewShard(ctx context.Context, wait time.Duration, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error
+}
+
+// Preflighter is an optional interface a ShardHandler may implement to report whether it can
+// currently store shards, such as whether its storage is reachable and writable.  It should be
+// cheap enough to call every few seconds.
+type Preflighter interface {
+	Preflight(ctx context.Context) error
+}
+
+// PushThrottle may be supplied to the webserver to hold back shard pushes, for example
+// while maintenance tasks are running.  The returned function is called when the push completes.
+type PushThrottle interface {
+	AcquirePush(ctx context.Context) (release func(), err error)
+}
+
+// DuplicateCompactor is an optional interface a ShardHandler may implement to remove the
+// redundant copies left behind when the same shard is pushed more than once
+type DuplicateCompactor interface {
+	CompactDuplicates(ctx context.Context, dryRun bool) ([]util.CompactionResult, error)
+}
+
+// ShardReencrypter is an optional interface a ShardHandler may implement to rewrite stored
+// shards under the current encryption keys while the server is running
+type ShardReencrypter interface {
+	Reencrypt(ctx context.Context, dryRun bool) (util.ReencryptResult, error)
+}
+
+// ShardDeleter is an optional interface a ShardHandler may implement to allow shards to be removed
+type ShardDeleter interface {
+	DeleteShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) error
+}
+
+// LegalHoldEnforcer is an optional interface a ShardHandler may implement to refuse deleting or
+// replacing held shards, it fails such requests with util.ErrLegalHold or util.ErrShardExists
+type LegalHoldEnforcer interface {
+	SetLegalHolds(util.LegalHolds)
 }
 
 func (w *Webserver) shardPushHandler(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
@@ -66,18 +185,83 @@ func (w *Webserver) shardPushHandler(res http.ResponseWriter, req *http.Request,
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
-	rdr, err := newRateTimeoutReader(req.Body, transferTickTimeout, res)
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	//the push settles any reservation made for it, whether or not it succeeds
+	defer w.reservations.release(util.UploadID{CID: custID, IdxUUID: indexerUUID, Well: well, Shard: shard})
+	if w.backendDown(res) {
+		return
+	}
+	if err = w.checkQuota(req.Context(), cust); err != nil {
+		w.lgr.Info("Shard push rejected", log.KV("cid", custID), log.KV("quota", cust.Quota), log.KVErr(err))
+		if err == ErrQuotaExceeded {
+			sendError(res, err, http.StatusInsufficientStorage)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	if dup, err := w.existingShard(req.Context(), custID, indexerUUID, well, shard); err != nil {
+		serverFail(res, err)
+		return
+	} else if dup != nil {
+		w.lgr.Info("Duplicate shard push rejected", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+		sendConflict(res, dup)
+		return
+	}
+	release, err := w.acquirePush(req.Context())
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	defer release()
+	crdr := newChecksumReader(req)
+	rdr, err := newRateTimeoutReader(crdr, transferTickTimeout, res)
 	if err != nil {
 		serverFail(res, err)
 		return
 	}
 	defer rdr.Close()
+	rdr.limit(w.maxPush)
+	tctx, cf := transferContext(req.Context(), w.maxPush)
+	defer cf()
+
+	srdr := w.shaper.reader(tctx, custID, rdr)
 
 	w.lgr.Info("Shard push", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
-	if err = w.shardHandler.UnpackShard(custID, indexerUUID, well, shard, rdr); err != nil {
+	ctx := util.WithProvenance(tctx, util.Provenance{
+		CID:        custID,
+		IdxUUID:    indexerUUID,
+		RemoteAddr: remoteHost(req.RemoteAddr),
+		UserAgent:  req.UserAgent(),
+		Uploaded:   time.Now().UTC(),
+	})
+	if err = w.unpackShard(ctx, custID, indexerUUID, well, shard, srdr); errors.Is(err, util.ErrShardExists) {
+		//another push stored the shard after we checked, or the well is under legal hold
+		var dup *DuplicateShard
+		if dup, err = w.storedShard(ctx, custID, indexerUUID, well, shard); err == nil && dup != nil {
+			sendConflict(res, dup)
+			return
+		} else if err == nil {
+			err = util.ErrShardExists
+		}
+	}
+	err = deadlineError(tctx, err)
+	w.recordAccess(util.AccessPush, custID, indexerUUID, well, shard, remoteHost(req.RemoteAddr), err)
+	if err != nil {
 		w.lgr.Error("Failed to unpack shard", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
-		serverFail(res, err)
+		if errors.Is(err, ErrChecksumMismatch) {
+			serverInvalid(res, err)
+		} else {
+			serverFail(res, err)
+		}
 	} else {
+		if crdr.missing {
+			w.lgr.Warn("Shard push checksum trailer never arrived, stream not verified", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+		}
+		res.Header().Set(ShardVerifiedHeader, strconv.FormatBool(crdr.verified))
 		res.WriteHeader(http.StatusOK)
 	}
 }
@@ -110,15 +294,45 @@ func (w *Webserver) shardPullHandler(res http.ResponseWriter, req *http.Request,
 		serverInvalid(res, errors.New("Wrong customer number"))
 		return
 	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	w.pullShard(res, req, custID, indexerUUID, well, shard)
+}
+
+// pullShard streams a packed shard to the client once the request has been authorized
+func (w *Webserver) pullShard(res http.ResponseWriter, req *http.Request, custID uint64, indexerUUID uuid.UUID, well, shard string) {
+	if ss, ok := w.shardHandler.(ShardSizer); ok {
+		//sizes are only hints, the pull reports any real problem with the shard
+		if sz, err := ss.GetShardSize(req.Context(), custID, indexerUUID, well, shard); err == nil {
+			res.Header().Set(ShardUncompressedSizeHeader, strconv.FormatInt(sz.Uncompressed, 10))
+			res.Header().Set(ShardPackedSizeHeader, strconv.FormatInt(sz.Packed, 10))
+		}
+	}
+	if w.redirectPull(res, req, custID, indexerUUID, well, shard) {
+		return
+	}
+
 	wtr, err := newRateTimeoutWriter(res, transferTickTimeout)
 	if err != nil {
 		serverFail(res, err)
 		return
 	}
 	defer wtr.Close()
+	wtr.limit(w.maxPull)
+	ctx, cf := transferContext(req.Context(), w.maxPull)
+	defer cf()
 
 	w.lgr.Info("Shard pull", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
-	if err = w.shardHandler.PackShard(custID, indexerUUID, well, shard, wtr); err != nil {
+	err = w.shardHandler.PackShard(ctx, custID, indexerUUID, well, shard, w.shaper.writer(ctx, custID, wtr))
+	err = deadlineError(ctx, err)
+	w.recordAccess(util.AccessPull, custID, indexerUUID, well, shard, remoteHost(req.RemoteAddr), err)
+	if errors.Is(err, util.ErrQueueFull) {
+		w.lgr.Warn("Shard pull refused, backend is busy", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+		res.Header().Set(`Retry-After`, strconv.Itoa(pullRetryAfter))
+		sendError(res, err, http.StatusServiceUnavailable)
+	} else if err != nil {
 		w.lgr.Error("Failed to pack shard", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
 		serverFail(res, err)
 	} else {
@@ -126,41 +340,320 @@ func (w *Webserver) shardPullHandler(res http.ResponseWriter, req *http.Request,
 	}
 }
 
+// shardHeadHandler reports whether a shard is stored without transferring it, so an indexer
+// can skip packing and pushing a shard which is already archived
+func (w *Webserver) shardHeadHandler(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	found, err := w.statShard(req.Context(), res.Header(), custID, indexerUUID, well, shard)
+	if err != nil {
+		w.lgr.Error("Failed to check shard", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
+		serverFail(res, err)
+	} else if !found {
+		res.WriteHeader(http.StatusNotFound)
+	} else {
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// statShard reports whether a shard is stored, setting its size and checksum headers when the
+// backend can report them.  A shard which is still being pushed is not yet stored.
+func (w *Webserver) statShard(ctx context.Context, hdr http.Header, cid uint64, guid uuid.UUID, well, shard string) (found bool, err error) {
+	var si util.ShardInfo
+	if sir, ok := w.shardHandler.(ShardInfoReporter); ok {
+		if si, err = sir.GetShardInfo(ctx, cid, guid, well, shard); err != nil {
+			if os.IsNotExist(err) || errors.Is(err, util.ErrUploadInProgress) {
+				err = nil
+			}
+			return
+		}
+		hdr.Set(ShardStoredChecksumHeader, si.Checksum())
+	} else if found, err = w.shardListed(ctx, cid, guid, well, shard); err != nil || !found {
+		return
+	}
+	found = true
+	if ss, ok := w.shardHandler.(ShardSizer); ok {
+		//sizes are only hints, so a failure to size the shard is not an error
+		if sz, serr := ss.GetShardSize(ctx, cid, guid, well, shard); serr == nil {
+			hdr.Set(ShardUncompressedSizeHeader, strconv.FormatInt(sz.Uncompressed, 10))
+			hdr.Set(ShardPackedSizeHeader, strconv.FormatInt(sz.Packed, 10))
+			return
+		}
+	}
+	if len(si.Files) > 0 {
+		var sz int64
+		for _, f := range si.Files {
+			sz += f.Size
+		}
+		hdr.Set(ShardUncompressedSizeHeader, strconv.FormatInt(sz, 10))
+	}
+	return
+}
+
+// shardListed checks for a shard by listing the shards of its well over the shard's own time
+// span, for backends which cannot report shard metadata
+func (w *Webserver) shardListed(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (bool, error) {
+	s, e, err := util.ShardNameToDateRange(shard)
+	if err != nil {
+		return false, nil //not a shard name, so it cannot be stored
+	}
+	shards, err := w.shardHandler.GetShardsInTimeframe(ctx, cid, guid, well, util.Timeframe{Start: s, End: e})
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return false, err
+	}
+	for _, v := range shards {
+		if v == shard {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (w *Webserver) shardDeleteHandler(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	sd, ok := w.shardHandler.(ShardDeleter)
+	if !ok {
+		serverNotImplemented(res, ErrNoDelete)
+		return
+	}
+
+	w.lgr.Info("Shard delete", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+	err = sd.DeleteShard(req.Context(), custID, indexerUUID, well, shard)
+	w.recordAccess(util.AccessDelete, custID, indexerUUID, well, shard, remoteHost(req.RemoteAddr), err)
+	if err != nil {
+		w.lgr.Error("Failed to delete shard", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
+		if os.IsNotExist(err) {
+			serverNotFound(res, err)
+		} else if errors.Is(err, util.ErrLegalHold) {
+			sendError(res, err, http.StatusLocked)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+func (w *Webserver) getShardInfo(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	sir, ok := w.shardHandler.(ShardInfoReporter)
+	if !ok {
+		serverNotImplemented(res, ErrNoShardInfo)
+		return
+	}
+	si, err := sir.GetShardInfo(req.Context(), custID, indexerUUID, well, shard)
+	if err != nil {
+		if os.IsNotExist(err) {
+			serverNotFound(res, err)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	sendObject(res, si)
+}
+
+// existingShard returns the stored copy of a shard when duplicate pushes are rejected,
+// nil means the push may go ahead
+func (w *Webserver) existingShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (*DuplicateShard, error) {
+	if w.dupPolicy != DuplicateReject {
+		return nil, nil
+	}
+	return w.storedShard(ctx, cid, guid, well, shard)
+}
+
+// storedShard returns the stored copy of a shard, nil if it is not stored or the
+// storage backend cannot report shard metadata
+func (w *Webserver) storedShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (*DuplicateShard, error) {
+	sir, ok := w.shardHandler.(ShardInfoReporter)
+	if !ok {
+		return nil, nil
+	}
+	si, err := sir.GetShardInfo(ctx, cid, guid, well, shard)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, util.ErrUploadInProgress) {
+			//not stored, or being stored by another push which the unpack will wait on
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &DuplicateShard{
+		Error:    util.ErrShardExists.Error(),
+		Checksum: si.Checksum(),
+		Shard:    si,
+	}, nil
+}
+
+// unpackShard stores a pushed shard according to the duplicate policy
+func (w *Webserver) unpackShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string, rdr io.Reader) error {
+	if w.dupPolicy == DuplicateReject {
+		if esu, ok := w.shardHandler.(ExclusiveShardUnpacker); ok {
+			return esu.UnpackNewShard(ctx, shardLockWait, cid, guid, well, shard, rdr)
+		}
+	}
+	if wsu, ok := w.shardHandler.(WaitingShardUnpacker); ok {
+		return wsu.UnpackShardWait(ctx, shardLockWait, cid, guid, well, shard, rdr)
+	}
+	return w.shardHandler.UnpackShard(ctx, cid, guid, well, shard, rdr)
+}
+
+func sendConflict(res http.ResponseWriter, dup *DuplicateShard) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusConflict)
+	json.NewEncoder(res).Encode(dup)
+}
+
+// acquirePush waits for the push throttle, if there is one
+func (w *Webserver) acquirePush(ctx context.Context) (release func(), err error) {
+	if w.pushThrottle == nil {
+		release = func() {}
+		return
+	}
+	return w.pushThrottle.AcquirePush(ctx)
+}
+
+// checkQuota returns ErrQuotaExceeded if the customer has a quota and is already at or above it
+func (w *Webserver) checkQuota(ctx context.Context, cust *CustomerDetails) error {
+	if cust.Quota == 0 {
+		return nil
+	}
+	ur, ok := w.shardHandler.(UsageReporter)
+	if !ok {
+		return nil
+	}
+	usage, err := ur.CustomerUsage(ctx, cust.CustomerNumber)
+	if err != nil {
+		return err
+	} else if usage >= cust.Quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
 // mock handler for use in testing
 type HashHandler struct {
 	Hash []byte
 }
 
-func (hh *HashHandler) ListIndexes(cid uint64) (r []string, err error) {
+func (hh *HashHandler) ListIndexes(ctx context.Context, cid uint64) (r []string, err error) {
 	return
 }
 
-func (hh *HashHandler) ListIndexerWells(cid uint64, guid uuid.UUID) (r []string, err error) {
+func (hh *HashHandler) ListIndexerWells(ctx context.Context, cid uint64, guid uuid.UUID) (r []string, err error) {
 	return
 }
 
-func (hh *HashHandler) GetWellTimeframe(cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
+func (hh *HashHandler) GetWellTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string) (t util.Timeframe, err error) {
 	t.Start = time.Now().Add(-5 * time.Minute)
 	t.End = time.Now()
 	return
 }
 
-func (hh *HashHandler) GetShardsInTimeframe(cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
+func (hh *HashHandler) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) (shards []string, err error) {
 	return
 }
 
-func (hh *HashHandler) UnpackShard(custid uint64, indexerUUID uuid.UUID, well string, shardID string, reader io.Reader) error {
+func (hh *HashHandler) UnpackShard(ctx context.Context, custid uint64, indexerUUID uuid.UUID, well string, shardID string, reader io.Reader) error {
 	hasher := sha256.New()
 	io.Copy(hasher, reader)
 	hh.Hash = hasher.Sum(nil)
 	return nil
 }
 
-func (hh *HashHandler) PackShard(custid uint64, indexerUUID uuid.UUID, well string, shardID string, wtr io.Writer) error {
+func (hh *HashHandler) PackShard(ctx context.Context, custid uint64, indexerUUID uuid.UUID, well string, shardID string, wtr io.Writer) error {
 	return errors.New("HashHandler is a write only, no retrieval")
 }
 
-func (hh *HashHandler) GetTags(custid uint64, indexerUUID uuid.UUID) (tgs []tags.TagPair, err error) {
+func (hh *HashHandler) GetTags(ctx context.Context, custid uint64, indexerUUID uuid.UUID) (tgs []tags.TagPair, err error) {
 	tgs = []tags.TagPair{
 		tags.TagPair{Name: entry.DefaultTagName, Value: 0},
 		tags.TagPair{Name: entry.GravwellTagName, Value: 0xffff},
@@ -168,7 +661,7 @@ func (hh *HashHandler) GetTags(custid uint64, indexerUUID uuid.UUID) (tgs []tags
 	return
 }
 
-func (hh *HashHandler) SyncTags(custid uint64, indexerUUID uuid.UUID) (tgs []tags.TagPair, err error) {
+func (hh *HashHandler) SyncTags(ctx context.Context, custid uint64, indexerUUID uuid.UUID, idxTags []tags.TagPair) (tgs []tags.TagPair, err error) {
 	// ignore the update, just send back the default.
 	tgs = []tags.TagPair{
 		tags.TagPair{Name: entry.DefaultTagName, Value: 0},
@@ -0,0 +1,108 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// listedBackend only reports its shards through listings
+type listedBackend struct {
+	ShardHandler
+	shards []string
+}
+
+func (lb *listedBackend) GetShardsInTimeframe(ctx context.Context, cid uint64, guid uuid.UUID, well string, tf util.Timeframe) ([]string, error) {
+	if cid != 1 {
+		return nil, os.ErrNotExist
+	}
+	return lb.shards, nil
+}
+
+// infoBackend reports shard metadata
+type infoBackend struct {
+	listedBackend
+	si util.ShardInfo
+}
+
+func (ib *infoBackend) GetShardInfo(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (util.ShardInfo, error) {
+	if shard != ib.si.Shard {
+		return util.ShardInfo{}, &os.PathError{Op: `open`, Path: shard, Err: os.ErrNotExist}
+	}
+	return ib.si, nil
+}
+
+func TestShardHead(t *testing.T) {
+	const guid = `6b9e4d4e-5b0f-4b8e-9d3e-3f1f1e0f6a11`
+	head := func(t *testing.T, sh ShardHandler, shard string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := &Webserver{
+			lgr:           log.NewDiscardLogger(),
+			hmacSecret:    []byte(`0123456789abcdef`),
+			tokenIssuer:   defaultTokenIssuer,
+			tokenAudience: defaultTokenAudience,
+			shardHandler:  sh,
+		}
+		if err := w.buildRequestRouter(); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := w.generateToken(1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodHead, `/api/shard/1/`+guid+`/default/`+shard, nil)
+		req.Header.Set(jwtAuthHeader, `Bearer `+tok)
+		rec := httptest.NewRecorder()
+		w.m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	lb := &listedBackend{shards: []string{`76a00`, `76a08`}}
+	if rec := head(t, lb, `76a08`); rec.Code != http.StatusOK {
+		t.Fatalf("listed shard answered %d", rec.Code)
+	} else if rec.Header().Get(ShardStoredChecksumHeader) != `` {
+		t.Fatal("checksum sent by a backend without shard metadata")
+	}
+	if rec := head(t, lb, `76a10`); rec.Code != http.StatusNotFound {
+		t.Fatalf("missing shard answered %d", rec.Code)
+	}
+
+	ib := &infoBackend{
+		listedBackend: *lb,
+		si: util.ShardInfo{
+			Shard: `76a00`,
+			Files: []util.ShardFile{
+				{Name: `76a00.index`, Size: 10, SHA256: `aa`},
+				{Name: `76a00.store`, Size: 100, SHA256: `bb`},
+			},
+		},
+	}
+	if rec := head(t, ib, `76a00`); rec.Code != http.StatusOK {
+		t.Fatalf("stored shard answered %d", rec.Code)
+	} else if sum := rec.Header().Get(ShardStoredChecksumHeader); sum != ib.si.Checksum() {
+		t.Fatalf("bad checksum %q", sum)
+	} else if sz := rec.Header().Get(ShardUncompressedSizeHeader); sz != `110` {
+		t.Fatalf("bad size %q", sz)
+	} else if rec.Body.Len() != 0 {
+		t.Fatal("HEAD answered with a body")
+	}
+	//the metadata is authoritative, a listed shard without any is not stored
+	if rec := head(t, ib, `76a08`); rec.Code != http.StatusNotFound {
+		t.Fatalf("shard without metadata answered %d", rec.Code)
+	}
+}
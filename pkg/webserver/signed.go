@@ -0,0 +1,168 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	signedPullClaim    string = `SignedPull`
+	signedIndexerClaim string = `Indexer`
+	signedWellClaim    string = `Well`
+	signedShardClaim   string = `Shard`
+
+	defaultSignedLifetime = time.Hour
+	maxSignedLifetime     = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidExpiry    = errors.New("Expires must be in the future and at most 7 days away")
+	ErrInvalidSignedURL = errors.New("Signed URL is invalid or has expired")
+)
+
+// SignURLRequest asks for a signed URL which pulls one shard without a session token
+type SignURLRequest struct {
+	Expires time.Time // when the URL stops working, an hour from now if zero
+}
+
+// SignedURL is a shard pull URL which anyone holding it may redeem until it expires
+type SignedURL struct {
+	Path    string // redeemed with a GET against the archive server
+	Expires time.Time
+}
+
+// signedPull is the shard named by a signed URL
+type signedPull struct {
+	cid   uint64
+	guid  uuid.UUID
+	well  string
+	shard string
+}
+
+func (w *Webserver) signShardURL(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	if !cust.IndexerAllowed(indexerUUID) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	var sr SignURLRequest
+	if err = getObject(req, &sr); err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	now := time.Now()
+	if sr.Expires.IsZero() {
+		sr.Expires = now.Add(defaultSignedLifetime)
+	} else if !sr.Expires.After(now) || sr.Expires.Sub(now) > maxSignedLifetime {
+		serverInvalid(res, ErrInvalidExpiry)
+		return
+	}
+	sr.Expires = sr.Expires.Truncate(time.Second)
+	tok, err := w.generateToken(custID, jwt.MapClaims{
+		signedPullClaim:    true,
+		signedIndexerClaim: indexerUUID.String(),
+		signedWellClaim:    well,
+		signedShardClaim:   shard,
+		"exp":              sr.Expires.Unix(),
+	})
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	w.lgr.Info("Signed shard pull URL", log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KV("expires", sr.Expires))
+	sendObject(res, SignedURL{
+		Path:    strings.Replace(SIGNED_PATH, `{token}`, tok, 1),
+		Expires: sr.Expires,
+	})
+}
+
+// signedPullHandler redeems a signed URL, the token in the path stands in for a session
+func (w *Webserver) signedPullHandler(res http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	tok, err := getMuxString(req, "token")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	sp, err := w.decodeSignedPull(tok)
+	if err != nil {
+		w.lgr.Info("Invalid signed URL", log.KV("remote", remoteHost(req.RemoteAddr)), log.KVErr(err))
+		serverForbidden(res, ErrInvalidSignedURL)
+		return
+	}
+	//the customer may have been disabled or restricted since the URL was signed
+	cust := &CustomerDetails{CustomerNumber: sp.cid}
+	if err = w.lookupCustomer(cust); err != nil {
+		w.lgr.Info("Signed URL refused", log.KV("cid", sp.cid), log.KVErr(err))
+		serverForbidden(res, ErrInvalidSignedURL)
+		return
+	} else if !cust.IndexerAllowed(sp.guid) {
+		serverForbidden(res, ErrIndexerNotAllowed)
+		return
+	}
+	w.pullShard(res, req, sp.cid, sp.guid, sp.well, sp.shard)
+}
+
+func (w *Webserver) decodeSignedPull(tok string) (sp signedPull, err error) {
+	var claims jwt.MapClaims
+	if claims, err = w.parseJWTToken(tok); err != nil {
+		return
+	} else if v, ok := claims[signedPullClaim].(bool); !ok || !v {
+		err = errors.New("Token is not a signed URL")
+		return
+	} else if !claims.VerifyExpiresAt(jwt.TimeFunc().Unix(), true) {
+		err = errors.New("Token has no expiry")
+		return
+	}
+	if sp.cid, err = claimsCustomerNumber(claims); err != nil {
+		return
+	}
+	guid, _ := claims[signedIndexerClaim].(string)
+	if sp.guid, err = uuid.Parse(guid); err != nil {
+		return
+	}
+	sp.well, _ = claims[signedWellClaim].(string)
+	sp.shard, _ = claims[signedShardClaim].(string)
+	if sp.well == `` || sp.shard == `` {
+		err = errors.New("Token does not name a shard")
+	}
+	return
+}
@@ -0,0 +1,109 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+)
+
+var (
+	ErrNoTransferStatus = errors.New("Storage backend does not support transfer status queries")
+)
+
+// TransferReporter is an optional interface a ShardHandler may implement
+// so that in-flight shard transfers can be reported
+type TransferReporter interface {
+	ActiveUploads() []util.UploadStatus
+}
+
+// DiskUsageReporter is an optional interface a ShardHandler may implement to report the
+// space it uses and has left, backends which sample periodically return their latest sample
+type DiskUsageReporter interface {
+	DiskUsage() (util.DiskUsage, error)
+}
+
+// Status describes the server's activity on behalf of a customer
+type Status struct {
+	Transfers []util.UploadStatus
+}
+
+func (w *Webserver) getStatus(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	tr, ok := w.shardHandler.(TransferReporter)
+	if !ok {
+		serverNotImplemented(res, ErrNoTransferStatus)
+		return
+	}
+	st := Status{
+		Transfers: []util.UploadStatus{},
+	}
+	for _, us := range tr.ActiveUploads() {
+		if us.CID == custID && cust.IndexerAllowed(us.IdxUUID) {
+			st.Transfers = append(st.Transfers, us)
+		}
+	}
+	sendObject(res, st)
+}
+
+// metricsHandler reports server gauges in the Prometheus text exposition format
+// only aggregate values are reported, so no customer details are exposed
+func (w *Webserver) metricsHandler(res http.ResponseWriter, req *http.Request) {
+	var count, bytes int64
+	var oldest float64
+	if tr, ok := w.shardHandler.(TransferReporter); ok {
+		now := time.Now()
+		for _, us := range tr.ActiveUploads() {
+			count++
+			bytes += us.Bytes
+			if age := now.Sub(us.Start).Seconds(); age > oldest {
+				oldest = age
+			}
+		}
+	}
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeGauge(res, `cloudarchive_active_transfers`, `Number of shard transfers in progress.`, float64(count))
+	writeGauge(res, `cloudarchive_active_transfer_bytes`, `Bytes moved so far by shard transfers in progress.`, float64(bytes))
+	writeGauge(res, `cloudarchive_oldest_transfer_seconds`, `Age in seconds of the oldest shard transfer in progress.`, oldest)
+	writeGauge(res, `cloudarchive_reserved_bytes`, `Bytes reserved for shard pushes which have not finished.`, float64(w.reservations.reserved()))
+	if bh := w.health.get(); bh.Checked {
+		var up float64
+		if bh.Healthy {
+			up = 1
+		}
+		writeGauge(res, `cloudarchive_backend_healthy`, `Whether the storage backend passed its latest health check.`, up)
+	}
+	if dur, ok := w.shardHandler.(DiskUsageReporter); ok {
+		if du, err := dur.DiskUsage(); err == nil {
+			writeGauge(res, `cloudarchive_storage_stored_bytes`, `Bytes stored under the storage directory.`, float64(du.StoredBytes))
+			writeGauge(res, `cloudarchive_storage_volume_bytes`, `Size of the volume holding the storage directory.`, float64(du.TotalBytes))
+			writeGauge(res, `cloudarchive_storage_free_bytes`, `Bytes available on the volume holding the storage directory.`, float64(du.FreeBytes))
+			writeGauge(res, `cloudarchive_storage_inodes`, `Inodes on the volume holding the storage directory.`, float64(du.TotalInodes))
+			writeGauge(res, `cloudarchive_storage_free_inodes`, `Inodes available on the volume holding the storage directory.`, float64(du.FreeInodes))
+			writeGauge(res, `cloudarchive_storage_sample_age_seconds`, `Age in seconds of the disk usage sample.`, time.Since(du.Sampled).Seconds())
+		}
+	}
+}
+
+func writeGauge(res http.ResponseWriter, name, help string, v float64) {
+	fmt.Fprintf(res, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
@@ -0,0 +1,122 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrNoTrash = errors.New("Storage backend does not support restoring deleted shards")
+)
+
+// ShardTrash is an optional interface a ShardHandler may implement when deleted shards are
+// held for a retention period before being destroyed, so that they can be restored
+type ShardTrash interface {
+	ListTrash(cid uint64) ([]util.TrashEntry, error)
+	RestoreShard(cid uint64, id string) (util.TrashEntry, error)
+	PurgeTrash(ctx context.Context) ([]util.TrashEntry, error)
+}
+
+func (w *Webserver) listTrash(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	st, ok := w.shardHandler.(ShardTrash)
+	if !ok {
+		serverNotImplemented(res, ErrNoTrash)
+		return
+	}
+	ents, err := st.ListTrash(custID)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	allowed := []util.TrashEntry{}
+	for _, te := range ents {
+		if cust.IndexerAllowed(te.IdxUUID) {
+			allowed = append(allowed, te)
+		}
+	}
+	sendObject(res, allowed)
+}
+
+func (w *Webserver) restoreShard(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	id, err := getMuxString(req, "trashid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	if custID != cust.CustomerNumber {
+		// Wrong customer!
+		serverInvalid(res, errors.New("Wrong customer number"))
+		return
+	}
+	st, ok := w.shardHandler.(ShardTrash)
+	if !ok {
+		serverNotImplemented(res, ErrNoTrash)
+		return
+	}
+
+	//check the entry is for an indexer the customer may touch before moving anything
+	ents, err := st.ListTrash(custID)
+	if err != nil {
+		serverFail(res, err)
+		return
+	}
+	var found bool
+	for _, te := range ents {
+		if te.ID != id {
+			continue
+		} else if !cust.IndexerAllowed(te.IdxUUID) {
+			serverForbidden(res, ErrIndexerNotAllowed)
+			return
+		}
+		found = true
+		break
+	}
+	if !found {
+		serverNotFound(res, os.ErrNotExist)
+		return
+	}
+
+	te, err := st.RestoreShard(custID, id)
+	if err != nil {
+		w.lgr.Error("Failed to restore shard", log.KV("cid", custID), log.KV("trashid", id), log.KVErr(err))
+		if os.IsNotExist(err) {
+			serverNotFound(res, err)
+		} else if errors.Is(err, util.ErrShardExists) {
+			sendError(res, err, http.StatusConflict)
+		} else {
+			serverFail(res, err)
+		}
+		return
+	}
+	w.lgr.Info("Shard restored", log.KV("cid", custID), log.KV("indexeruuid", te.IdxUUID), log.KV("well", te.Well), log.KV("shard", te.Shard))
+	sendObject(res, te)
+}
@@ -0,0 +1,81 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/gravwell/cloudarchive/pkg/util"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrNoVerify = errors.New("Storage backend does not support verifying stored shards")
+)
+
+// ShardVerifier is an optional interface a ShardHandler may implement so that a stored
+// shard can be checked for corruption without downloading it.  Problems with the shard
+// are reported in the result, an error means the shard could not be checked.
+type ShardVerifier interface {
+	VerifyShard(ctx context.Context, cid uint64, guid uuid.UUID, well, shard string) (util.ShardVerification, error)
+}
+
+// verifyShard checks a stored shard for an administrator, the {custid} names the customer
+// owning the shard.  Verifying reads and unpacks the whole shard, so it is not left to customers.
+func (w *Webserver) verifyShard(res http.ResponseWriter, req *http.Request, cust *CustomerDetails) {
+	custID, err := getMuxUint64(req, "custid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	indexerUUID, err := getMuxUUID(req, "uuid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	well, err := getMuxString(req, "well")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+	shard, err := getMuxString(req, "shardid")
+	if err != nil {
+		serverInvalid(res, err)
+		return
+	}
+
+	sv, ok := w.shardHandler.(ShardVerifier)
+	if !ok {
+		serverNotImplemented(res, ErrNoVerify)
+		return
+	}
+	r, err := sv.VerifyShard(req.Context(), custID, indexerUUID, well, shard)
+	if err != nil {
+		if os.IsNotExist(err) {
+			serverNotFound(res, err)
+		} else if errors.Is(err, util.ErrInvalidShardName) {
+			serverInvalid(res, err)
+		} else {
+			w.lgr.Error("Failed to verify shard", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KVErr(err))
+			serverFail(res, err)
+		}
+		return
+	}
+	if r.Passed {
+		w.lgr.Info("Shard verified", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard))
+	} else {
+		w.lgr.Warn("Shard failed verification", log.KV("admin", cust.CustomerNumber), log.KV("cid", custID), log.KV("indexeruuid", indexerUUID), log.KV("well", well), log.KV("shard", shard), log.KV("problems", len(r.Problems)))
+	}
+	sendObject(res, r)
+}
@@ -10,7 +10,9 @@ package webserver
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,17 +25,41 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gravwell/gravwell/v3/ingest/log"
+	"google.golang.org/grpc"
 )
 
 const (
-	LOGIN_PATH     string = "/api/login"
-	TEST_PATH      string = "/api/test"
-	AUTH_TEST_PATH string = "/api/testauth"
-	SHARD_PATH     string = "/api/shard/{custid}/{uuid}/{well}/{shardid}"
-	CUST_PATH      string = "/api/shard/{custid}"
-	INDEXER_PATH   string = "/api/shard/{custid}/{uuid}"
-	WELL_PATH      string = "/api/shard/{custid}/{uuid}/{well}"
-	TAG_PATH       string = "/api/tags/{custid}/{uuid}"
+	LOGIN_PATH        string = "/api/login"
+	LOGIN_TOTP_PATH   string = "/api/login/totp"
+	TEST_PATH         string = "/api/test"
+	AUTH_TEST_PATH    string = "/api/testauth"
+	SHARD_PATH        string = "/api/shard/{custid}/{uuid}/{well}/{shardid}"
+	CUST_PATH         string = "/api/shard/{custid}"
+	INDEXER_PATH      string = "/api/shard/{custid}/{uuid}"
+	WELL_PATH         string = "/api/shard/{custid}/{uuid}/{well}"
+	TAG_PATH          string = "/api/tags/{custid}/{uuid}"
+	CUST_TAGS_PATH    string = "/api/tags/{custid}"
+	WELL_TAGS_PATH    string = "/api/welltags/{custid}/{uuid}/{well}"
+	SHARD_INFO_PATH   string = "/api/shardinfo/{custid}/{uuid}/{well}/{shardid}"
+	WELL_STATS_PATH   string = "/api/stats/{custid}/{uuid}/{well}"
+	VERIFY_PATH       string = "/api/verify/{custid}/{uuid}/{well}/{shardid}"
+	RESERVE_PATH      string = "/api/reserve/{custid}/{uuid}/{well}/{shardid}"
+	DELTA_PATH        string = "/api/delta/{custid}/{uuid}/{well}/{shardid}"
+	HISTORY_PATH      string = "/api/history/{custid}"
+	SIGN_PATH         string = "/api/sign/{custid}/{uuid}/{well}/{shardid}"
+	SIGNED_PATH       string = "/api/signed/{token}"
+	STATUS_PATH       string = "/api/status/{custid}"
+	TRASH_PATH        string = "/api/trash/{custid}"
+	TRASH_ENT_PATH    string = "/api/trash/{custid}/{trashid}"
+	METRICS_PATH      string = "/metrics"
+	OPENAPI_PATH      string = "/api/openapi.json"
+	HEALTH_PATH       string = "/api/health/backend"
+	CAPABILITIES_PATH string = "/api/capabilities"
+	ADMIN_USERS_PATH  string = "/api/admin/users"
+	ADMIN_USER_PATH   string = "/api/admin/users/{custid}"
+	ADMIN_PASSWD_PATH string = "/api/admin/users/{custid}/password"
+	ADMIN_IMPORT_PATH string = "/api/admin/import"
+	ADMIN_REKEY_PATH  string = "/api/admin/reencrypt"
 )
 
 type Webserver struct {
@@ -45,8 +71,25 @@ type Webserver struct {
 	lgr          *log.Logger
 	authModule   Authenticator
 	shardHandler ShardHandler
-
-	hmacSecret []byte
+	metrics      bool
+	shaper       *bandwidthShaper
+	pushThrottle PushThrottle
+	dupPolicy    DuplicatePolicy
+	readOnly     bool
+	maxPush      time.Duration
+	maxPull      time.Duration
+	reservations *reservations
+	backoff      *loginBackoff
+	health       *healthChecker
+	challenges   challengeSet //TOTP challenges which have been used
+
+	grpcListenString string
+	grpcLst          net.Listener
+	grpcSrv          *grpc.Server
+
+	hmacSecret    []byte
+	tokenIssuer   string
+	tokenAudience string
 
 	initialized bool
 	running     bool
@@ -60,10 +103,47 @@ type WebserverConfig struct {
 	Logger       *log.Logger
 	ShardHandler ShardHandler
 	Auth         Authenticator
+	Metrics      bool // serve unauthenticated Prometheus metrics on METRICS_PATH
+
+	RateLimits         RateLimits            // transfer caps applied to each customer
+	CustomerRateLimits map[uint64]RateLimits // overrides RateLimits for specific customers
+	PushThrottle       PushThrottle          // optional, consulted before each shard push
+	DuplicatePolicy    DuplicatePolicy       // defaults to DuplicateVersion
+	ReadOnly           bool                  // refuse shard pushes, deletes, restores, and tag syncs
+
+	// Absolute limits on how long a single shard push or pull may run, on top of the
+	// watchdog which aborts stalled transfers, zero is unlimited
+	MaxPushDuration time.Duration
+	MaxPullDuration time.Duration
+
+	LoginBackoff LoginBackoff // delays logins from addresses which keep failing
+
+	// How often the backend's Preflight is called, shard pushes are refused while it fails.
+	// Zero selects DefaultHealthCheckInterval and a negative interval disables checks.
+	HealthCheckInterval time.Duration
+
+	// Issuer and audience claims placed in every token and required on every request,
+	// both default to "cloudarchive"
+	TokenIssuer   string
+	TokenAudience string
+
+	GRPCListenString string // addr:port for the gRPC API, empty disables it
 }
 
 func NewWebserver(conf WebserverConfig) (*Webserver, error) {
 	var err error
+	switch conf.DuplicatePolicy {
+	case ``:
+		conf.DuplicatePolicy = DuplicateVersion
+	case DuplicateVersion:
+	case DuplicateReject:
+		//the stored copy is reported back to the client
+		if _, ok := conf.ShardHandler.(ShardInfoReporter); !ok {
+			return nil, ErrNoShardInfo
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrInvalidDuplicatePolicy, conf.DuplicatePolicy)
+	}
 	var config *tls.Config
 	if !conf.DisableTLS {
 		config = &tls.Config{
@@ -95,8 +175,29 @@ func NewWebserver(conf WebserverConfig) (*Webserver, error) {
 		lgr:          conf.Logger,
 		shardHandler: conf.ShardHandler,
 		authModule:   conf.Auth,
+		metrics:      conf.Metrics,
+		shaper:       newBandwidthShaper(conf.RateLimits, conf.CustomerRateLimits),
+		pushThrottle: conf.PushThrottle,
+		dupPolicy:    conf.DuplicatePolicy,
+		readOnly:     conf.ReadOnly,
+		maxPush:      conf.MaxPushDuration,
+		maxPull:      conf.MaxPullDuration,
+		reservations: newReservations(),
+		backoff:      newLoginBackoff(conf.LoginBackoff),
+		health:       newHealthChecker(conf.ShardHandler, conf.HealthCheckInterval, conf.Logger),
+
+		tokenIssuer:   conf.TokenIssuer,
+		tokenAudience: conf.TokenAudience,
+
+		grpcListenString: conf.GRPCListenString,
 	}
 
+	if ws.tokenIssuer == `` {
+		ws.tokenIssuer = defaultTokenIssuer
+	}
+	if ws.tokenAudience == `` {
+		ws.tokenAudience = defaultTokenAudience
+	}
 	ws.hmacSecret = make([]byte, 16)
 	_, err = rand.Read(ws.hmacSecret)
 	if err != nil {
@@ -106,6 +207,9 @@ func NewWebserver(conf WebserverConfig) (*Webserver, error) {
 	if err = ws.buildRequestRouter(); err != nil {
 		return nil, err
 	}
+	if ws.grpcListenString != `` {
+		ws.grpcSrv = ws.newGRPCServer()
+	}
 
 	return ws, nil
 }
@@ -119,6 +223,12 @@ func (w *Webserver) Init() error {
 	if err != nil {
 		return err
 	}
+	if w.grpcSrv != nil {
+		if w.grpcLst, err = net.Listen("tcp", w.grpcListenString); err != nil {
+			lst.Close()
+			return err
+		}
+	}
 	w.lst = &lst
 
 	w.initialized = true
@@ -141,6 +251,10 @@ func (w *Webserver) Run() error {
 		return errors.New("Invalid listener")
 	}
 	go w.routine()
+	w.health.start()
+	if w.grpcSrv != nil {
+		go w.grpcRoutine()
+	}
 	return nil
 }
 
@@ -179,6 +293,8 @@ func (w *Webserver) Close() error {
 	var finalError error
 	var err error
 
+	w.health.stop()
+
 	//was never running, so lets not worry about it
 	if !w.running {
 		return nil
@@ -190,6 +306,10 @@ func (w *Webserver) Close() error {
 			finalError = err
 		}
 	}
+	if w.grpcSrv != nil {
+		//also closes the gRPC listener
+		w.grpcSrv.Stop()
+	}
 
 	tmr := time.NewTimer(time.Millisecond * 500)
 	defer tmr.Stop()
@@ -233,56 +353,177 @@ func (w *Webserver) buildRequestRouter() error {
 		return err
 	}
 
+	//for routes that modify data, read-only credentials are rejected and so is everything while the archive is read-only
+	writeChain, err := newBaseChain(w.logAccess, w.AuthWriteUser)
+	if err != nil {
+		return err
+	}
+
+	//logging and authorization for user management and shard maintenance, only administrators are allowed
+	adminChain, err := newBaseChain(w.logAccess, w.AuthAdminUser)
+	if err != nil {
+		return err
+	}
+
+	//install the metrics path if enabled.  It is not logged nor authenticated
+	if w.metrics {
+		w.m.HandleFunc(METRICS_PATH, w.metricsHandler).Methods(http.MethodGet)
+	}
+
+	c := routeChains{
+		log:       logChain,
+		noLogAuth: noLogAuthChain,
+		auth:      authChain,
+		write:     writeChain,
+		admin:     adminChain,
+	}
+	//the v2 routes are matched after every unversioned route, none of which match under /api/v2
+	for _, ver := range apiVersions {
+		w.installAPIRoutes(w.m, ver, c)
+	}
+
+	return nil
+}
+
+// routeChains are the handler chains API routes are installed with
+type routeChains struct {
+	log       *logChain
+	noLogAuth *baseChain
+	auth      *baseChain
+	write     *baseChain
+	admin     *baseChain
+}
+
+// installAPIRoutes installs every API route for an API version, see apiPath
+func (w *Webserver) installAPIRoutes(r *mux.Router, ver string, c routeChains) {
+	p := func(path string) string {
+		return apiPath(ver, path)
+	}
+
 	//install the test path.  It is not logged nor authenticated
-	w.m.HandleFunc(TEST_PATH, w.testHandler).Methods(http.MethodGet)
+	r.HandleFunc(p(TEST_PATH), w.testHandler).Methods(http.MethodGet)
+
+	//install the API specification path.  It is not logged nor authenticated
+	r.HandleFunc(p(OPENAPI_PATH), w.openAPIHandler).Methods(http.MethodGet)
+
+	//install the backend health path.  It is not logged nor authenticated
+	r.HandleFunc(p(HEALTH_PATH), w.backendHealthHandler).Methods(http.MethodGet)
+
+	//install the capabilities path.  It is not logged nor authenticated
+	r.HandleFunc(p(CAPABILITIES_PATH), w.capabilitiesHandler).Methods(http.MethodGet)
 
 	// install the auth test path. It is not logged but is authenticated
-	w.m.PathPrefix(AUTH_TEST_PATH).Handler(noLogAuthChain.Handler(w.authTestHandler)).Methods(http.MethodGet)
+	r.PathPrefix(p(AUTH_TEST_PATH)).Handler(c.noLogAuth.Handler(w.authTestHandler)).Methods(http.MethodGet)
+
+	//install the TOTP second step login handler, this must come before the login prefix
+	r.Path(p(LOGIN_TOTP_PATH)).Handler(c.log.Handler(w.loginTOTPPostPage)).Methods(http.MethodPost)
 
 	//install the authentication/login post handler
-	w.m.PathPrefix(LOGIN_PATH).Handler(logChain.Handler(w.loginPostPage)).Methods(http.MethodPost)
+	r.PathPrefix(p(LOGIN_PATH)).Handler(c.log.Handler(w.loginPostPage)).Methods(http.MethodPost)
 
 	// The order of these handlers is IMPORTANT!
 
 	// Handler to get back a list of tags for the indexer
-	w.m.PathPrefix(TAG_PATH).Handler(authChain.Handler(w.indexerGetTags)).Methods(http.MethodGet)
+	r.PathPrefix(p(TAG_PATH)).Handler(c.auth.Handler(w.indexerGetTags)).Methods(http.MethodGet)
 	// Handler to let an indexer update its tag set
-	w.m.PathPrefix(TAG_PATH).Handler(authChain.Handler(w.indexerSyncTags)).Methods(http.MethodPost)
+	r.PathPrefix(p(TAG_PATH)).Handler(c.write.Handler(w.indexerSyncTags)).Methods(http.MethodPost)
+
+	// Handler to get back the tags of every one of the customer's indexers
+	r.Path(p(CUST_TAGS_PATH)).Handler(c.auth.Handler(w.customerGetTags)).Methods(http.MethodGet)
+	// Handler to update the tag sets of several indexers at once
+	r.Path(p(CUST_TAGS_PATH)).Handler(c.write.Handler(w.customerSyncTags)).Methods(http.MethodPost)
+
+	// Handler to get the tags currently assigned to a well
+	r.Path(p(WELL_TAGS_PATH)).Handler(c.auth.Handler(w.getWellTags)).Methods(http.MethodGet)
+
+	// Handler to get the shard count, size, and time span of a well
+	r.Path(p(WELL_STATS_PATH)).Handler(c.auth.Handler(w.getWellStats)).Methods(http.MethodGet)
+
+	// Handler to get the files, sizes, and checksums stored for a shard
+	r.Path(p(SHARD_INFO_PATH)).Handler(c.auth.Handler(w.getShardInfo)).Methods(http.MethodGet)
+
+	// Handler for administrators to check a stored shard for corruption, the {custid} names the customer owning the shard
+	r.Path(p(VERIFY_PATH)).Handler(c.admin.Handler(w.verifyShard)).Methods(http.MethodPost)
+
+	// Handler to report the customer's in-flight shard transfers
+	r.Path(p(STATUS_PATH)).Handler(c.auth.Handler(w.getStatus)).Methods(http.MethodGet)
+
+	// Handler to list the customer's deleted shards which can still be restored
+	r.Path(p(TRASH_PATH)).Handler(c.auth.Handler(w.listTrash)).Methods(http.MethodGet)
+	// Handler to restore a deleted shard
+	r.Path(p(TRASH_ENT_PATH)).Handler(c.write.Handler(w.restoreShard)).Methods(http.MethodPost)
+
+	// Handler to reserve capacity for a shard before uploading it
+	r.Path(p(RESERVE_PATH)).Handler(c.write.Handler(w.reserveShard)).Methods(http.MethodPost)
+
+	// Handler to query the customer's shard access history
+	r.Path(p(HISTORY_PATH)).Handler(c.auth.Handler(w.getAccessHistory)).Methods(http.MethodPost)
+
+	// Handler to mint a URL which pulls a shard without a session token
+	r.Path(p(SIGN_PATH)).Handler(c.auth.Handler(w.signShardURL)).Methods(http.MethodPost)
+	// Handler to redeem a signed URL, the token in the path authorizes the pull
+	r.Path(p(SIGNED_PATH)).Handler(c.log.Handler(w.signedPullHandler)).Methods(http.MethodGet)
+
+	// Handler to re-push only the changed files of a stored shard
+	r.Path(p(DELTA_PATH)).Handler(c.write.Handler(w.shardDeltaHandler)).Methods(http.MethodPost)
 
 	// Handler to upload a shard
-	w.m.PathPrefix(SHARD_PATH).Handler(authChain.Handler(w.shardPushHandler)).Methods(http.MethodPost)
+	r.PathPrefix(p(SHARD_PATH)).Handler(c.write.Handler(w.shardPushHandler)).Methods(http.MethodPost)
 
 	// Handler to download a shard
-	w.m.PathPrefix(SHARD_PATH).Handler(authChain.Handler(w.shardPullHandler)).Methods(http.MethodGet)
+	r.PathPrefix(p(SHARD_PATH)).Handler(c.auth.Handler(w.shardPullHandler)).Methods(http.MethodGet)
+
+	// Handler to check whether a shard is stored without downloading it
+	r.PathPrefix(p(SHARD_PATH)).Handler(c.auth.Handler(w.shardHeadHandler)).Methods(http.MethodHead)
+
+	// Handler to delete a shard
+	r.PathPrefix(p(SHARD_PATH)).Handler(c.write.Handler(w.shardDeleteHandler)).Methods(http.MethodDelete)
 
 	// Handler to get timeframe contained in a given well
-	w.m.PathPrefix(WELL_PATH).Handler(authChain.Handler(w.getWellTimeframe)).Methods(http.MethodGet)
+	r.PathPrefix(p(WELL_PATH)).Handler(c.auth.Handler(w.getWellTimeframe)).Methods(http.MethodGet)
 
 	// Handler to request a list of shards that fall in a timeframe AND exist on the server
-	w.m.PathPrefix(WELL_PATH).Handler(authChain.Handler(w.getWellShardsInTimeframe)).Methods(http.MethodPost)
+	r.PathPrefix(p(WELL_PATH)).Handler(c.auth.Handler(w.getWellShardsInTimeframe)).Methods(http.MethodPost)
 
 	// Handler to list all wells on an indexer
-	w.m.PathPrefix(INDEXER_PATH).Handler(authChain.Handler(w.indexerListWells)).Methods(http.MethodGet)
+	r.PathPrefix(p(INDEXER_PATH)).Handler(c.auth.Handler(w.indexerListWells)).Methods(http.MethodGet)
 
 	// Handler to list a customer's indexers
-	w.m.PathPrefix(CUST_PATH).Handler(authChain.Handler(w.customerListIndexers)).Methods(http.MethodGet)
-
-	return nil
+	r.PathPrefix(p(CUST_PATH)).Handler(c.auth.Handler(w.customerListIndexers)).Methods(http.MethodGet)
+
+	// Handlers for administrators to manage customers, the {custid} here names the customer being managed
+	r.Path(p(ADMIN_USERS_PATH)).Handler(c.admin.Handler(w.adminListUsers)).Methods(http.MethodGet)
+	r.Path(p(ADMIN_USERS_PATH)).Handler(c.admin.Handler(w.adminAddUser)).Methods(http.MethodPost)
+	r.Path(p(ADMIN_USER_PATH)).Handler(c.admin.Handler(w.adminGetUser)).Methods(http.MethodGet)
+	r.Path(p(ADMIN_USER_PATH)).Handler(c.admin.Handler(w.adminDeleteUser)).Methods(http.MethodDelete)
+	r.Path(p(ADMIN_USER_PATH)).Handler(c.admin.Handler(w.adminUpdateUser)).Methods(http.MethodPatch)
+	r.Path(p(ADMIN_PASSWD_PATH)).Handler(c.admin.Handler(w.adminResetPassword)).Methods(http.MethodPut)
+	r.Path(p(ADMIN_IMPORT_PATH)).Handler(c.admin.Handler(w.adminImportUsers)).Methods(http.MethodPost)
+	// Handler for administrators to re-encrypt stored shards under the current keys
+	r.Path(p(ADMIN_REKEY_PATH)).Handler(c.admin.Handler(w.adminReencrypt)).Methods(http.MethodPost)
+
+	// every route above must be described in apiDocs for the OpenAPI specification
 }
 
 func (w *Webserver) logAccess(res *trackingResponseWriter, req *http.Request) {
-	remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		remoteAddr = req.RemoteAddr
-	}
 	w.lgr.Info("access",
-		log.KV("remote", remoteAddr),
+		log.KV("remote", remoteHost(req.RemoteAddr)),
 		log.KV("method", req.Method),
-		log.KV("url", req.URL.Path),
+		log.KV("url", accessPath(req)),
 		log.KV("status", res.status),
 		log.KV("useragent", req.UserAgent()))
 }
 
+// accessPath returns the request path to log.  The token of a signed URL is a credential, so it
+// is replaced with a short hash which still ties together the requests made with one URL.
+func accessPath(req *http.Request) string {
+	if tok := mux.Vars(req)["token"]; tok != `` {
+		sum := sha256.Sum256([]byte(tok))
+		return strings.Replace(req.URL.Path, tok, `sha256:`+hex.EncodeToString(sum[:8]), 1)
+	}
+	return req.URL.Path
+}
+
 func (w *Webserver) noLogAccess(res *trackingResponseWriter, req *http.Request) {
 }
 
@@ -333,3 +574,23 @@ func serverFail(res http.ResponseWriter, err error) {
 func serverInvalid(res http.ResponseWriter, err error) {
 	sendError(res, err, http.StatusBadRequest)
 }
+
+func serverNotImplemented(res http.ResponseWriter, err error) {
+	sendError(res, err, http.StatusNotImplemented)
+}
+
+func serverNotFound(res http.ResponseWriter, err error) {
+	sendError(res, err, http.StatusNotFound)
+}
+
+func serverForbidden(res http.ResponseWriter, err error) {
+	sendError(res, err, http.StatusForbidden)
+}
+
+// remoteHost strips the port from a remote address
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
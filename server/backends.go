@@ -0,0 +1,746 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/backend"
+	"github.com/gravwell/cloudarchive/pkg/casstore"
+	"github.com/gravwell/cloudarchive/pkg/failoverstore"
+	"github.com/gravwell/cloudarchive/pkg/filestore"
+	"github.com/gravwell/cloudarchive/pkg/ftpstore"
+	"github.com/gravwell/cloudarchive/pkg/remotestore"
+	"github.com/gravwell/cloudarchive/pkg/replicastore"
+	"github.com/gravwell/cloudarchive/pkg/s3store"
+	"github.com/gravwell/cloudarchive/pkg/swiftstore"
+	"github.com/gravwell/cloudarchive/pkg/tierstore"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// backend options carrying the FTP settings from the Global config section
+const (
+	ftpServerOption   = `ftp-server`
+	ftpBaseDirOption  = `remote-base-directory`
+	ftpUsernameOption = `ftp-username`
+	ftpPasswordOption = `ftp-password`
+	ftpPullWorkersOpt = `ftp-pull-workers`
+	ftpPullQueueOpt   = `ftp-pull-queue`
+)
+
+// backend options carrying the S3 settings from the Global config section
+const (
+	s3EndpointOption  = `s3-endpoint`
+	s3BucketOption    = `s3-bucket`
+	s3PrefixOption    = `s3-prefix`
+	s3RegionOption    = `s3-region`
+	s3AccessKeyOption = `s3-access-key`
+	s3SecretKeyOption = `s3-secret-key`
+	s3InsecureOption  = `s3-insecure`
+	s3PartSizeOption  = `s3-part-size`
+)
+
+// backend options carrying the Swift settings from the Global config section
+const (
+	swiftAuthURLOption       = `swift-auth-url`
+	swiftUsernameOption      = `swift-username`
+	swiftPasswordOption      = `swift-password`
+	swiftUserDomainOption    = `swift-user-domain`
+	swiftProjectOption       = `swift-project`
+	swiftProjectDomainOption = `swift-project-domain`
+	swiftRegionOption        = `swift-region`
+	swiftPrefixOption        = `swift-container-prefix`
+	swiftSegmentSizeOption   = `swift-segment-size`
+)
+
+// remoteAddressOption carries Remote-Backend-Address to the remote backend
+const remoteAddressOption = `remote-address`
+
+// options carrying CAS-Sweep-Interval to the content addressed backend
+const (
+	casSweepOption       = `cas-sweep-interval`
+	defaultSweepInterval = time.Hour
+)
+
+// options carrying the Replica settings to the replicated backend
+const (
+	replicaBackendsOption    = `replica-backends` // comma separated backend types
+	replicaMinWritesOption   = `replica-min-writes`
+	replicaReconcileOption   = `replica-reconcile-interval`
+	defaultReconcileInterval = 5 * time.Minute
+)
+
+// options carrying the Tier settings to the tiered backend
+const (
+	tierColdBackendOption  = `tier-cold-backend`
+	tierMaxAgeOption       = `tier-max-age`
+	tierMigrateOption      = `tier-migrate-interval`
+	defaultMigrateInterval = time.Hour
+)
+
+// options carrying the Failover settings to the failover backend
+const (
+	failoverPrimaryOption   = `failover-primary-backend`
+	failoverSecondaryOption = `failover-secondary-backend`
+	failoverReconcileOption = `failover-reconcile-interval`
+)
+
+// trashRetentionOption carries Trash-Retention to the file backend
+const (
+	trashRetentionOption  = `trash-retention`
+	defaultTrashRetention = 7 * 24 * time.Hour
+)
+
+// historyRetentionOption carries Access-History-Retention to the file backend
+const (
+	historyRetentionOption  = `history-retention`
+	defaultHistoryRetention = 90 * 24 * time.Hour
+)
+
+// options carrying Disk-Report-Interval and Disk-Warn-Percent to the file backend
+const (
+	diskReportIntervalOption  = `disk-report-interval`
+	diskWarnPercentOption     = `disk-warn-percent`
+	defaultDiskReportInterval = 5 * time.Minute
+)
+
+// options carrying Write-Strategy, Write-Buffer-Size, and Preallocate-Files to the file backend
+const (
+	writeStrategyOption   = `write-strategy`
+	writeBufferSizeOption = `write-buffer-size`
+	preallocateOption     = `preallocate`
+)
+
+// options carrying Shared-Storage and Shared-Storage-Lease to the file backend
+const (
+	sharedStorageOption      = `shared-storage`
+	sharedStorageLeaseOption = `shared-storage-lease`
+)
+
+// Backends built outside of this repository can be compiled in by adding a blank import
+// of their package here, their init functions register them with the backend package.
+func init() {
+	if err := backend.Register(BackendTypeFile, newFileBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeFTP, newFTPBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeS3, newS3Backend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeSwift, newSwiftBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeRemote, newRemoteBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeCAS, newCASBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeReplicated, newReplicatedBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeTiered, newTieredBackend); err != nil {
+		panic(err)
+	}
+	if err := backend.Register(BackendTypeFailover, newFailoverBackend); err != nil {
+		panic(err)
+	}
+}
+
+func newFileBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	ret, err := parseTrashRetention(cfg.Options[trashRetentionOption])
+	if err != nil {
+		return nil, err
+	}
+	hret, err := parseHistoryRetention(cfg.Options[historyRetentionOption])
+	if err != nil {
+		return nil, err
+	}
+	wc, err := parseWriteConfig(cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	dmc, err := parseDiskMonitor(cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	slc, shared, err := parseSharedLocking(cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := filestore.NewFilestoreHandler(cfg.StorageDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		if err = fs.SetSharedLocking(slc); err != nil {
+			return nil, err
+		}
+	}
+	rec, err := fs.RecoverUnpacks()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rec {
+		if r.Completed {
+			cfg.Logger.Info("Shard unpack finished before restart", log.KV("cid", r.CID), log.KV("indexeruuid", r.IdxUUID), log.KV("well", r.Well), log.KV("shard", r.Shard), log.KV("path", r.ShardDir))
+		} else {
+			cfg.Logger.Warn("Removed partial shard unpack interrupted by restart", log.KV("cid", r.CID), log.KV("indexeruuid", r.IdxUUID), log.KV("well", r.Well), log.KV("shard", r.Shard), log.KV("started", r.Started))
+		}
+	}
+	fs.SetTrashRetention(ret)
+	fs.SetHistoryRetention(hret)
+	if err = fs.SetWriteConfig(wc); err != nil {
+		return nil, err
+	}
+	if dmc.Interval > 0 {
+		dmc.Lgr = cfg.Logger
+		if err = fs.MonitorDisk(dmc); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+func newFTPBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	workers, err := intOption(cfg.Options, ftpPullWorkersOpt)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := intOption(cfg.Options, ftpPullQueueOpt)
+	if err != nil {
+		return nil, err
+	}
+	return ftpstore.NewFtpStoreHandler(ftpstore.FtpStoreConfig{
+		LocalStore:  cfg.StorageDirectory,
+		FtpServer:   cfg.Options[ftpServerOption],
+		BaseDir:     cfg.Options[ftpBaseDirOption],
+		Username:    cfg.Options[ftpUsernameOption],
+		Password:    cfg.Options[ftpPasswordOption],
+		Lgr:         cfg.Logger,
+		PullWorkers: workers,
+		PullQueue:   queue,
+	})
+}
+
+func newS3Backend(cfg backend.Config) (webserver.ShardHandler, error) {
+	sc := s3store.S3StoreConfig{
+		LocalStore: cfg.StorageDirectory,
+		Endpoint:   cfg.Options[s3EndpointOption],
+		Bucket:     cfg.Options[s3BucketOption],
+		Prefix:     cfg.Options[s3PrefixOption],
+		Region:     cfg.Options[s3RegionOption],
+		AccessKey:  cfg.Options[s3AccessKeyOption],
+		SecretKey:  cfg.Options[s3SecretKeyOption],
+		Lgr:        cfg.Logger,
+	}
+	if v := cfg.Options[s3InsecureOption]; v != `` {
+		var err error
+		if sc.Insecure, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid %s option %q: %w", s3InsecureOption, v, err)
+		}
+	}
+	if v := cfg.Options[s3PartSizeOption]; v != `` {
+		var err error
+		if sc.PartSize, err = util.ParseSize(v); err != nil {
+			return nil, fmt.Errorf("Invalid S3-Part-Size %q: %w", v, err)
+		}
+	}
+	return s3store.NewS3StoreHandler(sc)
+}
+
+func newSwiftBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	sc := swiftstore.SwiftStoreConfig{
+		LocalStore:      cfg.StorageDirectory,
+		AuthURL:         cfg.Options[swiftAuthURLOption],
+		Username:        cfg.Options[swiftUsernameOption],
+		Password:        cfg.Options[swiftPasswordOption],
+		UserDomain:      cfg.Options[swiftUserDomainOption],
+		Project:         cfg.Options[swiftProjectOption],
+		ProjectDomain:   cfg.Options[swiftProjectDomainOption],
+		Region:          cfg.Options[swiftRegionOption],
+		ContainerPrefix: cfg.Options[swiftPrefixOption],
+		Lgr:             cfg.Logger,
+	}
+	if v := cfg.Options[swiftSegmentSizeOption]; v != `` {
+		var err error
+		if sc.SegmentSize, err = util.ParseSize(v); err != nil {
+			return nil, fmt.Errorf("Invalid Swift-Segment-Size %q: %w", v, err)
+		}
+	}
+	return swiftstore.NewSwiftStoreHandler(sc)
+}
+
+func newRemoteBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	return remotestore.NewRemoteStoreHandler(remotestore.RemoteStoreConfig{
+		Address: cfg.Options[remoteAddressOption],
+		Lgr:     cfg.Logger,
+	})
+}
+
+// newCASBackend stores each shard file once under Storage-Directory, named by its digest
+func newCASBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	interval, err := parseSweepInterval(cfg.Options[casSweepOption])
+	if err != nil {
+		return nil, err
+	} else if interval == 0 {
+		interval = -1 //the casstore treats zero as the default
+	}
+	return casstore.NewCASStoreHandler(casstore.CASStoreConfig{
+		Dir:           cfg.StorageDirectory,
+		SweepInterval: interval,
+		Lgr:           cfg.Logger,
+	})
+}
+
+// newReplicatedBackend creates each replica with the same configuration and wraps them,
+// the replicas share Storage-Directory and so share each indexer's tags.dat
+func newReplicatedBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	minWrites, err := intOption(cfg.Options, replicaMinWritesOption)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := parseReconcileInterval(`Replica-Reconcile-Interval`, cfg.Options[replicaReconcileOption])
+	if err != nil {
+		return nil, err
+	} else if interval == 0 {
+		interval = -1 //the replicastore treats zero as the default
+	}
+	rc := replicastore.ReplicaStoreConfig{
+		MinWrites:         minWrites,
+		ReconcileInterval: interval,
+		LocalStore:        cfg.StorageDirectory,
+		Lgr:               cfg.Logger,
+	}
+	for _, name := range strings.Split(cfg.Options[replicaBackendsOption], `,`) {
+		if name = strings.TrimSpace(name); name == `` {
+			continue
+		} else if name == BackendTypeReplicated {
+			err = errors.New("A replicated backend may not replicate itself")
+		} else {
+			var h webserver.ShardHandler
+			if h, err = backend.New(name, cfg); err == nil {
+				rc.Replicas = append(rc.Replicas, replicastore.Replica{Name: name, Handler: h})
+				continue
+			}
+			err = fmt.Errorf("Failed to create %s replica: %w", name, err)
+		}
+		break
+	}
+	var rs webserver.ShardHandler
+	if err == nil {
+		rs, err = replicastore.NewReplicaStoreHandler(rc)
+	}
+	if err != nil {
+		for _, r := range rc.Replicas {
+			if c, ok := r.Handler.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		return nil, err
+	}
+	return rs, nil
+}
+
+// newTieredBackend keeps recent shards in a file backend on Storage-Directory and moves
+// older shards to the configured cold backend
+func newTieredBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	maxAge, err := parseTierMaxAge(cfg.Options[tierMaxAgeOption])
+	if err != nil {
+		return nil, err
+	}
+	interval, err := parseMigrateInterval(cfg.Options[tierMigrateOption])
+	if err != nil {
+		return nil, err
+	} else if interval == 0 {
+		interval = -1 //the tierstore treats zero as the default
+	}
+	name := cfg.Options[tierColdBackendOption]
+	switch name {
+	case ``, BackendTypeFile, BackendTypeFTP, BackendTypeCAS, BackendTypeReplicated, BackendTypeTiered, BackendTypeFailover:
+		return nil, fmt.Errorf("Invalid tiered cold backend %q", name)
+	}
+	fh, err := newFileBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	hot, ok := fh.(tierstore.HotStore)
+	if !ok {
+		return nil, errors.New("The file backend cannot be used as a hot tier")
+	}
+	tc := tierstore.TierStoreConfig{
+		Hot:             hot,
+		MaxAge:          maxAge,
+		MigrateInterval: interval,
+		Lgr:             cfg.Logger,
+	}
+	var ts webserver.ShardHandler
+	if tc.Cold, err = backend.New(name, cfg); err != nil {
+		err = fmt.Errorf("Failed to create %s cold tier: %w", name, err)
+	} else {
+		ts, err = tierstore.NewTierStoreHandler(tc)
+	}
+	if err != nil {
+		for _, h := range []webserver.ShardHandler{tc.Hot, tc.Cold} {
+			if c, ok := h.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		return nil, err
+	}
+	return ts, nil
+}
+
+// newFailoverBackend creates the primary and secondary backends with the same configuration
+// and wraps them, writes go to the secondary while the primary is failing
+func newFailoverBackend(cfg backend.Config) (webserver.ShardHandler, error) {
+	interval, err := parseReconcileInterval(`Failover-Reconcile-Interval`, cfg.Options[failoverReconcileOption])
+	if err != nil {
+		return nil, err
+	} else if interval == 0 {
+		interval = -1 //the failoverstore treats zero as the default
+	}
+	fc := failoverstore.FailoverStoreConfig{
+		ReconcileInterval: interval,
+		LocalStore:        cfg.StorageDirectory,
+		Lgr:               cfg.Logger,
+	}
+	pri, sec := cfg.Options[failoverPrimaryOption], cfg.Options[failoverSecondaryOption]
+	for _, name := range []string{pri, sec} {
+		switch name {
+		case ``, BackendTypeReplicated, BackendTypeTiered, BackendTypeFailover:
+			return nil, fmt.Errorf("Invalid failover backend %q", name)
+		}
+	}
+	var fs webserver.ShardHandler
+	if fc.Primary, err = backend.New(pri, cfg); err != nil {
+		err = fmt.Errorf("Failed to create %s primary backend: %w", pri, err)
+	} else if fc.Secondary, err = backend.New(sec, cfg); err != nil {
+		err = fmt.Errorf("Failed to create %s secondary backend: %w", sec, err)
+	} else {
+		fs, err = failoverstore.NewFailoverStoreHandler(fc)
+	}
+	if err != nil {
+		for _, h := range []webserver.ShardHandler{fc.Primary, fc.Secondary} {
+			if c, ok := h.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		return nil, err
+	}
+	return fs, nil
+}
+
+// intOption parses a non-negative integer backend option, missing options are zero
+func intOption(opts map[string]string, key string) (v int, err error) {
+	if s := opts[key]; s != `` {
+		if v, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("Invalid %s option %q: %w", key, s, err)
+		} else if v < 0 {
+			err = fmt.Errorf("%s option %q must not be negative", key, s)
+		}
+	}
+	return
+}
+
+// backendConfig builds the configuration handed to the selected backend
+func backendConfig(c *cfgType) (bc backend.Config, err error) {
+	bc.StorageDirectory = c.Global.Storage_Directory
+	bc.Options = map[string]string{}
+	for _, v := range c.Global.Backend_Option {
+		var key, val string
+		if key, val, err = backend.ParseOption(v); err != nil {
+			return
+		}
+		bc.Options[key] = val
+	}
+	if usesBackend(c, BackendTypeFTP) {
+		bc.Options[ftpServerOption] = c.Global.FTP_Server
+		bc.Options[ftpBaseDirOption] = c.Global.Remote_Base_Directory
+		bc.Options[ftpUsernameOption] = c.Global.FTP_Username
+		bc.Options[ftpPasswordOption] = c.Global.FTP_Password
+		if c.Global.FTP_Pull_Workers > 0 {
+			bc.Options[ftpPullWorkersOpt] = strconv.Itoa(c.Global.FTP_Pull_Workers)
+		}
+		if c.Global.FTP_Pull_Queue > 0 {
+			bc.Options[ftpPullQueueOpt] = strconv.Itoa(c.Global.FTP_Pull_Queue)
+		}
+	}
+	if usesBackend(c, BackendTypeS3) {
+		bc.Options[s3EndpointOption] = c.Global.S3_Endpoint
+		bc.Options[s3BucketOption] = c.Global.S3_Bucket
+		bc.Options[s3PrefixOption] = c.Global.S3_Prefix
+		bc.Options[s3RegionOption] = c.Global.S3_Region
+		bc.Options[s3AccessKeyOption] = c.Global.S3_Access_Key
+		bc.Options[s3SecretKeyOption] = c.Global.S3_Secret_Key
+		if c.Global.S3_Insecure {
+			bc.Options[s3InsecureOption] = `true`
+		}
+		if c.Global.S3_Part_Size != `` {
+			bc.Options[s3PartSizeOption] = c.Global.S3_Part_Size
+		}
+	}
+	if usesBackend(c, BackendTypeSwift) {
+		bc.Options[swiftAuthURLOption] = c.Global.Swift_Auth_URL
+		bc.Options[swiftUsernameOption] = c.Global.Swift_Username
+		bc.Options[swiftPasswordOption] = c.Global.Swift_Password
+		bc.Options[swiftUserDomainOption] = c.Global.Swift_User_Domain
+		bc.Options[swiftProjectOption] = c.Global.Swift_Project
+		bc.Options[swiftProjectDomainOption] = c.Global.Swift_Project_Domain
+		bc.Options[swiftRegionOption] = c.Global.Swift_Region
+		bc.Options[swiftPrefixOption] = c.Global.Swift_Container_Prefix
+		if c.Global.Swift_Segment_Size != `` {
+			bc.Options[swiftSegmentSizeOption] = c.Global.Swift_Segment_Size
+		}
+	}
+	if usesBackend(c, BackendTypeRemote) {
+		bc.Options[remoteAddressOption] = c.Global.Remote_Backend_Address
+	}
+	if usesBackend(c, BackendTypeCAS) && c.Global.CAS_Sweep_Interval != `` {
+		bc.Options[casSweepOption] = c.Global.CAS_Sweep_Interval
+	}
+	if c.Global.Backend_Type == BackendTypeTiered {
+		bc.Options[tierColdBackendOption] = c.Global.Tier_Cold_Backend
+		bc.Options[tierMaxAgeOption] = c.Global.Tier_Max_Age
+		if c.Global.Tier_Migrate_Interval != `` {
+			bc.Options[tierMigrateOption] = c.Global.Tier_Migrate_Interval
+		}
+	}
+	if c.Global.Backend_Type == BackendTypeFailover {
+		bc.Options[failoverPrimaryOption] = c.Global.Failover_Primary_Backend
+		bc.Options[failoverSecondaryOption] = c.Global.Failover_Secondary_Backend
+		if c.Global.Failover_Reconcile_Interval != `` {
+			bc.Options[failoverReconcileOption] = c.Global.Failover_Reconcile_Interval
+		}
+	}
+	if c.Global.Backend_Type == BackendTypeReplicated {
+		bc.Options[replicaBackendsOption] = strings.Join(c.Global.Replica_Backend, `,`)
+		if c.Global.Replica_Min_Writes > 0 {
+			bc.Options[replicaMinWritesOption] = strconv.Itoa(c.Global.Replica_Min_Writes)
+		}
+		if c.Global.Replica_Reconcile_Interval != `` {
+			bc.Options[replicaReconcileOption] = c.Global.Replica_Reconcile_Interval
+		}
+	}
+	if c.Global.Trash_Retention != `` {
+		bc.Options[trashRetentionOption] = c.Global.Trash_Retention
+	}
+	if c.Global.Access_History_Retention != `` {
+		bc.Options[historyRetentionOption] = c.Global.Access_History_Retention
+	}
+	if c.Global.Write_Strategy != `` {
+		bc.Options[writeStrategyOption] = c.Global.Write_Strategy
+	}
+	if c.Global.Write_Buffer_Size != `` {
+		bc.Options[writeBufferSizeOption] = c.Global.Write_Buffer_Size
+	}
+	if c.Global.Preallocate_Files {
+		bc.Options[preallocateOption] = `true`
+	}
+	if c.Global.Disk_Report_Interval != `` {
+		bc.Options[diskReportIntervalOption] = c.Global.Disk_Report_Interval
+	}
+	if c.Global.Disk_Warn_Percent != 0 {
+		bc.Options[diskWarnPercentOption] = strconv.Itoa(c.Global.Disk_Warn_Percent)
+	}
+	if c.Global.Shared_Storage {
+		bc.Options[sharedStorageOption] = `true`
+	}
+	if c.Global.Shared_Storage_Lease != `` {
+		bc.Options[sharedStorageLeaseOption] = c.Global.Shared_Storage_Lease
+	}
+	return
+}
+
+// usesBackend reports whether the backend type is selected, either directly, as a
+// replica, as a tier, or for failover
+func usesBackend(c *cfgType, typ string) bool {
+	switch c.Global.Backend_Type {
+	case typ:
+		return true
+	case BackendTypeTiered:
+		return typ == BackendTypeFile || strings.ToLower(strings.TrimSpace(c.Global.Tier_Cold_Backend)) == typ
+	case BackendTypeFailover:
+		return strings.ToLower(strings.TrimSpace(c.Global.Failover_Primary_Backend)) == typ ||
+			strings.ToLower(strings.TrimSpace(c.Global.Failover_Secondary_Backend)) == typ
+	case BackendTypeReplicated:
+	default:
+		return false
+	}
+	for _, v := range c.Global.Replica_Backend {
+		if strings.ToLower(strings.TrimSpace(v)) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReconcileInterval parses a Replica-Reconcile-Interval or Failover-Reconcile-Interval value,
+// empty selects the default and zero disables reconciliation
+func parseReconcileInterval(name, v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		d = defaultReconcileInterval
+	} else if v == `0` {
+		d = 0
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid %s %q: %w", name, v, err)
+	} else if d < 0 {
+		err = fmt.Errorf("%s %q must not be negative", name, v)
+	}
+	return
+}
+
+// parseTierMaxAge parses the required Tier-Max-Age value
+func parseTierMaxAge(v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		err = errors.New("The tiered backend requires Tier-Max-Age")
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid Tier-Max-Age %q: %w", v, err)
+	} else if d <= 0 {
+		err = fmt.Errorf("Tier-Max-Age %q must be positive", v)
+	}
+	return
+}
+
+// parseMigrateInterval parses a Tier-Migrate-Interval value, empty selects the default and zero disables migration
+func parseMigrateInterval(v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		d = defaultMigrateInterval
+	} else if v == `0` {
+		d = 0
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid Tier-Migrate-Interval %q: %w", v, err)
+	} else if d < 0 {
+		err = fmt.Errorf("Tier-Migrate-Interval %q must not be negative", v)
+	}
+	return
+}
+
+// parseSweepInterval parses a CAS-Sweep-Interval value, empty selects the default and zero disables sweeping
+func parseSweepInterval(v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		d = defaultSweepInterval
+	} else if v == `0` {
+		d = 0
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid CAS-Sweep-Interval %q: %w", v, err)
+	} else if d < 0 {
+		err = fmt.Errorf("CAS-Sweep-Interval %q must not be negative", v)
+	}
+	return
+}
+
+// parseTrashRetention parses a Trash-Retention value, empty selects the default and zero disables the trash
+func parseTrashRetention(v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		d = defaultTrashRetention
+	} else if v == `0` {
+		d = 0
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid Trash-Retention %q: %w", v, err)
+	} else if d < 0 {
+		err = fmt.Errorf("Trash-Retention %q must not be negative", v)
+	}
+	return
+}
+
+// parseHistoryRetention parses an Access-History-Retention value, empty selects the default and zero keeps history forever
+func parseHistoryRetention(v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		d = defaultHistoryRetention
+	} else if v == `0` {
+		d = 0
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid Access-History-Retention %q: %w", v, err)
+	} else if d < 0 {
+		err = fmt.Errorf("Access-History-Retention %q must not be negative", v)
+	}
+	return
+}
+
+// parseWriteConfig builds the file backend's write settings from its options
+func parseWriteConfig(opts map[string]string) (wc filestore.WriteConfig, err error) {
+	wc.Strategy = filestore.WriteStrategy(strings.ToLower(strings.TrimSpace(opts[writeStrategyOption])))
+	if v := opts[writeBufferSizeOption]; v != `` {
+		var sz uint64
+		if sz, err = util.ParseSize(v); err != nil {
+			err = fmt.Errorf("Invalid Write-Buffer-Size %q: %w", v, err)
+			return
+		} else if sz > math.MaxInt32 {
+			err = fmt.Errorf("Write-Buffer-Size %q is too large", v)
+			return
+		}
+		wc.BufferSize = int(sz)
+	}
+	if v := opts[preallocateOption]; v != `` {
+		if wc.Preallocate, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("Invalid preallocate option %q: %w", v, err)
+			return
+		}
+	}
+	err = wc.Validate()
+	return
+}
+
+// parseDiskMonitor builds the file backend's disk monitor settings from its options,
+// a zero interval means the monitor is disabled
+func parseDiskMonitor(opts map[string]string) (dmc filestore.DiskMonitorConfig, err error) {
+	if v := strings.TrimSpace(opts[diskReportIntervalOption]); v == `` {
+		dmc.Interval = defaultDiskReportInterval
+	} else if v != `0` {
+		if dmc.Interval, err = time.ParseDuration(v); err != nil {
+			err = fmt.Errorf("Invalid Disk-Report-Interval %q: %w", v, err)
+			return
+		} else if dmc.Interval < 0 {
+			err = fmt.Errorf("Disk-Report-Interval %q must not be negative", v)
+			return
+		}
+	}
+	var pct int
+	if pct, err = intOption(opts, diskWarnPercentOption); err != nil {
+		return
+	} else if pct > 100 {
+		err = fmt.Errorf("Disk-Warn-Percent %d must not exceed 100", pct)
+		return
+	}
+	dmc.WarnPercent = float64(pct)
+	return
+}
+
+// parseSharedLocking builds the file backend's lockfile settings from its options,
+// shared is false if lockfiles are not used
+func parseSharedLocking(opts map[string]string) (slc filestore.SharedLockConfig, shared bool, err error) {
+	if v := opts[sharedStorageOption]; v != `` {
+		if shared, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("Invalid shared-storage option %q: %w", v, err)
+			return
+		}
+	}
+	if v := strings.TrimSpace(opts[sharedStorageLeaseOption]); v != `` {
+		if slc.Lease, err = time.ParseDuration(v); err != nil {
+			err = fmt.Errorf("Invalid Shared-Storage-Lease %q: %w", v, err)
+			return
+		} else if slc.Lease < filestore.MinLockLease {
+			err = fmt.Errorf("Shared-Storage-Lease %q must be at least %v", v, filestore.MinLockLease)
+			return
+		}
+	}
+	return
+}
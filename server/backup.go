@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/backup"
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	defaultBackupRetention = 30 * 24 * time.Hour
+)
+
+// backupTask returns a maintenance task which snapshots the password file and the
+// tags.dat files held by the storage backend, then removes expired snapshots
+func backupTask(c *cfgType, handler webserver.ShardHandler, lgr *log.Logger) (maintenance.Task, error) {
+	ret, err := parseBackupRetention(c.Global.Backup_Retention)
+	if err != nil {
+		return nil, err
+	}
+	bc := backup.Config{
+		Dir:       c.Global.Backup_Directory,
+		Retention: ret,
+	}
+	switch c.Global.Auth_Type {
+	case AuthTypeFile:
+		bc.Files = []string{c.Global.Password_File}
+	case AuthTypeHtpasswd:
+		bc.Files = []string{c.Global.Password_File, c.Global.Htpasswd_Map_File}
+	}
+	if ts, ok := handler.(backup.TagSource); ok {
+		bc.Tags = ts
+	} else {
+		lgr.Warn("storage backend cannot back up tags, only the password file will be saved", log.KV("backend", c.Global.Backend_Type))
+	}
+	b, err := backup.New(bc)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		now := time.Now()
+		dir, err := b.Snapshot(ctx, now)
+		if err != nil {
+			return err
+		}
+		lgr.Info("state backup written", log.KV("path", dir))
+		removed, err := b.Prune(now)
+		if len(removed) > 0 {
+			lgr.Info("removed expired state backups", log.KV("backups", strings.Join(removed, ` `)))
+		}
+		return err
+	}, nil
+}
+
+// parseBackupRetention parses a Backup-Retention value, empty selects the default
+func parseBackupRetention(v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		d = defaultBackupRetention
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid Backup-Retention %q: %w", v, err)
+	} else if d <= 0 {
+		err = fmt.Errorf("Backup-Retention %q must be positive", v)
+	}
+	return
+}
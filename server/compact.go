@@ -0,0 +1,71 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrCompactionUnsupported = errors.New("storage backend does not support duplicate shard compaction")
+)
+
+// compactDuplicates runs a single compaction pass and prints what was, or would be, removed
+func compactDuplicates(handler webserver.ShardHandler, dryRun bool) error {
+	dc, ok := handler.(webserver.DuplicateCompactor)
+	if !ok {
+		return ErrCompactionUnsupported
+	}
+	res, err := dc.CompactDuplicates(context.Background(), dryRun)
+	var total int64
+	for _, r := range res {
+		total += r.Reclaimed
+		if r.Kept == `` {
+			fmt.Printf("%d/%s/%s/%s: no complete copy, left untouched\n", r.CID, r.IdxUUID, r.Well, r.Shard)
+			continue
+		}
+		fmt.Printf("%d/%s/%s/%s: kept %s, removed %s (%d bytes)\n",
+			r.CID, r.IdxUUID, r.Well, r.Shard, r.Kept, strings.Join(r.Removed, ` `), r.Reclaimed)
+	}
+	verb := `reclaimed`
+	if dryRun {
+		verb = `would reclaim`
+	}
+	fmt.Printf("%d shards with duplicates, %s %d bytes\n", len(res), verb, total)
+	return err
+}
+
+// compactionTask returns a maintenance task which compacts duplicate shards and logs the outcome
+func compactionTask(dc webserver.DuplicateCompactor, lgr *log.Logger) maintenance.Task {
+	return func(ctx context.Context) error {
+		res, err := dc.CompactDuplicates(ctx, false)
+		var total int64
+		for _, r := range res {
+			total += r.Reclaimed
+			if r.Kept == `` {
+				lgr.Warn("shard has duplicates but no complete copy",
+					log.KV("customer", r.CID), log.KV("indexer", r.IdxUUID), log.KV("well", r.Well), log.KV("shard", r.Shard))
+			} else {
+				lgr.Info("removed duplicate shard copies",
+					log.KV("customer", r.CID), log.KV("indexer", r.IdxUUID), log.KV("well", r.Well), log.KV("shard", r.Shard),
+					log.KV("kept", r.Kept), log.KV("removed", strings.Join(r.Removed, ` `)), log.KV("bytes", r.Reclaimed))
+			}
+		}
+		lgr.Info("duplicate shard compaction finished", log.KV("shards", len(res)), log.KV("bytes", total))
+		return err
+	}
+}
@@ -11,8 +11,16 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/backend"
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
 
 	"github.com/gravwell/gcfg"
 	icfg "github.com/gravwell/gravwell/v3/ingest/config"
@@ -22,11 +30,30 @@ import (
 const (
 	MAX_CONFIG_SIZE   int64  = (1024 * 1024 * 2) //2MB, even this is crazy large
 	defaultListenPort uint16 = 443
+	defaultGRPCPort   uint16 = 8887
+	defaultS3Port     uint16 = 8888
+
+	defaultKeyRefresh = 5 * time.Minute
+
+	BackendTypeFTP    = "ftp"
+	BackendTypeFile   = "file"
+	BackendTypeS3     = "s3"
+	BackendTypeRemote = "remote"
+	BackendTypeCAS    = "cas"
+	BackendTypeSwift  = "swift"
 
-	BackendTypeFTP  = "ftp"
-	BackendTypeFile = "file"
+	BackendTypeReplicated = "replicated"
+	BackendTypeTiered     = "tiered"
+	BackendTypeFailover   = "failover"
 
 	DefaultBackendType = BackendTypeFile
+
+	AuthTypeFile     = "file"
+	AuthTypePostgres = "postgres"
+	AuthTypeMySQL    = "mysql"
+	AuthTypeHtpasswd = "htpasswd"
+
+	DefaultAuthType = AuthTypeFile
 )
 
 type cfgType struct {
@@ -36,22 +63,224 @@ type cfgType struct {
 		Cert_File      string
 		Key_File       string
 		Password_File  string
-		Log_File       string
-		Log_Level      string
+		Password_Cost  int // target bcrypt cost, weaker hashes are upgraded on login
+		// Select the authentication backend, Password-File is required for
+		// the file backend, Auth-DB-* options for the SQL backends
+		Auth_Type     string
+		Auth_DB_DSN   string
+		Auth_DB_Table string // defaults to "users"
+		// htpasswd backend, Password-File points at the htpasswd file
+		Htpasswd_Map_File string // maps htpasswd usernames to customer numbers
+		// Failed logins a source address may make before it must wait, the wait starts at
+		// one second and doubles with each further failure up to Login-Backoff-Max, such
+		// as "15m".  Zero attempts selects 5 and an empty maximum is 15 minutes.
+		Login_Backoff_Attempts int
+		Login_Backoff_Max      string
+		Disable_Login_Backoff  bool
+		// Issuer and audience claims placed in session tokens and required on every request,
+		// give each archive server distinct values so tokens cannot be replayed between
+		// them, both default to "cloudarchive"
+		Token_Issuer   string
+		Token_Audience string
 
-		// Select the storage backend
+		Log_File  string
+		Log_Level string
+
+		Enable_Metrics bool // serve Prometheus metrics on /metrics
+
+		GRPC_Listen_Address string // serve the gRPC API on this address, disabled if empty
+
+		// Read-only S3 gateway, disabled if the listen address is empty
+		S3_Gateway_Listen_Address   string
+		S3_Gateway_Credentials_File string // access key, secret, and customer number per line
+		S3_Gateway_Bucket           string
+		S3_Gateway_Region           string
+
+		// Select the storage backend, any backend registered with the backend package may be named
 		Backend_Type string
-		// Storage-Directory is used by file *and* ftp, because the FTP backend
-		// also needs a place to stage some files.
+		// Go plugins loaded at startup, each registers one or more backends from its init functions
+		Backend_Plugin []string
+		// Backend specific options in key=value form
+		Backend_Option []string
+		// Storage-Directory is used by every backend, the FTP and S3 backends
+		// need a place to keep tags.dat and stage some files.
 		Storage_Directory string
 		// File backend options
-		// (currently no file-specific options)
+		// How shard files are written, "buffered" (default) or "direct" which flushes each
+		// buffer and drops it from the page cache.  Write-Buffer-Size accepts K, M, and G
+		// suffixes, 1M if empty.  Preallocate-Files reserves each file's size up front.
+		Write_Strategy    string
+		Write_Buffer_Size string
+		Preallocate_Files bool
+		// How often the file backend logs and publishes the usage of its volume, such as
+		// "1m", empty is every 5 minutes and zero disables it.  A warning is logged when free
+		// space or inodes fall below Disk-Warn-Percent, 10 if unset.
+		Disk_Report_Interval string
+		Disk_Warn_Percent    int
+		// Set Shared-Storage when several servers use the same Storage-Directory, such as an
+		// NFS export, shards are then also locked with lockfiles in the directory.  A lock not
+		// renewed for Shared-Storage-Lease, "2m" if empty, is taken over from its holder.
+		Shared_Storage       bool
+		Shared_Storage_Lease string
 		// FTP backend options
 		FTP_Server            string // addr:port
 		Remote_Base_Directory string // the base directory on the FTP server to use, if the default dir isn't acceptable
 		FTP_Username          string
 		FTP_Password          string
+		// Concurrent shard pulls and how many more may wait for one to finish,
+		// zero selects the defaults of 4 and 32
+		FTP_Pull_Workers int
+		FTP_Pull_Queue   int
+		// S3 backend options
+		S3_Endpoint   string // host:port of the object store, such as s3.us-west-2.amazonaws.com
+		S3_Bucket     string
+		S3_Prefix     string // prepended to every object key, may be empty
+		S3_Region     string // empty asks the object store for the bucket's region
+		S3_Access_Key string
+		S3_Secret_Key string
+		S3_Insecure   bool // connect to the object store without TLS
+		// Shard files larger than S3-Part-Size are sent as multipart uploads of parts this
+		// size, accepts K, M, and G suffixes, 64M if empty
+		S3_Part_Size string
+		// Content addressed backend options, objects no shard refers to any more are
+		// removed every CAS-Sweep-Interval, 1h if empty and 0 disables removal.
+		CAS_Sweep_Interval string
+		// Swift backend options, each customer gets a container named Swift-Container-Prefix
+		// and their customer number, "cloudarchive-" if the prefix is empty
+		Swift_Auth_URL         string // keystone v3 endpoint, such as https://keystone.example.com:5000/v3
+		Swift_Username         string
+		Swift_Password         string
+		Swift_User_Domain      string // "Default" if empty
+		Swift_Project          string
+		Swift_Project_Domain   string // "Default" if empty
+		Swift_Region           string // empty uses the first object-store endpoint in the catalog
+		Swift_Container_Prefix string
+		// Shard files larger than Swift-Segment-Size are stored as static large objects of
+		// segments this size, accepts K, M, and G suffixes, 1G if empty
+		Swift_Segment_Size string
+		// Remote backend options, the address of a backend running in its own process
+		// as unix:///path/to/socket or a loopback host:port
+		Remote_Backend_Address string
+		// Replicated backend options, every shard is stored on each Replica-Backend using the
+		// settings above.  A push succeeds once Replica-Min-Writes replicas have it, 1 if unset,
+		// and the others are repaired every Replica-Reconcile-Interval, 5m if empty and 0 disables.
+		Replica_Backend            []string
+		Replica_Min_Writes         int
+		Replica_Reconcile_Interval string
+		// Tiered backend options, shards are kept by the file backend until they are
+		// Tier-Max-Age old, such as "2160h", and then moved to Tier-Cold-Backend.  The file
+		// backend is checked every Tier-Migrate-Interval, 1h if empty and 0 disables moves.
+		Tier_Cold_Backend     string
+		Tier_Max_Age          string
+		Tier_Migrate_Interval string
+		// Failover backend options, writes go to Failover-Primary-Backend unless it is failing,
+		// in which case they go to Failover-Secondary-Backend and are copied to the primary
+		// every Failover-Reconcile-Interval once it recovers, 5m if empty and 0 disables copies.
+		Failover_Primary_Backend    string
+		Failover_Secondary_Backend  string
+		Failover_Reconcile_Interval string
+
+		// Additional per-shard files to store and return alongside the standard shard files,
+		// each is a glob pattern matched against names in the shard directory
+		Shard_Artifact []string
+
+		// Transfer caps applied to each customer, in the ingester Rate-Limit format
+		// e.g. 100Mbit or 10MBps, empty is unlimited
+		Ingress_Rate_Limit string
+		Egress_Rate_Limit  string
+
+		// Absolute limits on how long one shard push or pull may take, such as "6h", stalled
+		// transfers are always aborted after 30 seconds, empty is unlimited
+		Max_Push_Duration string
+		Max_Pull_Duration string
+
+		// Windows during which background maintenance tasks run, such as "Mon-Fri 01:00-05:00"
+		// tasks run once a day at midnight if no windows are given
+		Maintenance_Window []string
+		// Maximum concurrent shard pushes while a maintenance window is open, zero is unlimited
+		Maintenance_Push_Limit int
+		// Remove redundant copies of re-pushed shards during maintenance windows
+		Compact_Duplicate_Shards bool
+		// Re-encrypt files which are not encrypted with the current key during maintenance windows
+		Reencrypt_Shards bool
+		// What to do when a stored shard is pushed again, "version" keeps both
+		// copies and "reject" refuses the push with 409 Conflict
+		Duplicate_Shard_Policy string
+		// Refuse shard pushes, deletes, restores, and tag syncs while still serving pulls,
+		// listings, and tag reads, such as during storage migrations or legal-hold freezes.
+		// Duplicate compaction, re-encryption, and trash purging are paused as well.
+		Read_Only bool
+		// How often the storage backend is checked, such as "1m", shard pushes are refused
+		// while it fails.  Empty checks every 30 seconds and zero disables checks.
+		Health_Check_Interval string
+		// How long the file backend keeps deleted shards for restoring, such as "72h",
+		// empty keeps them for a week and zero destroys them immediately
+		Trash_Retention string
+		// How long the file backend keeps each customer's record of shard pushes, pulls,
+		// and deletes, such as "8760h", empty keeps it for 90 days and zero keeps it forever
+		Access_History_Retention string
+		// Snapshot the password file and every tags.dat here during maintenance windows,
+		// snapshots are kept for Backup-Retention, a month if empty
+		Backup_Directory string
+		Backup_Retention string
+		// Encrypt shards and tag names before they reach the storage backend, each file holds
+		// a 256 bit key as 64 hex characters.  The last key listed encrypts new data and the
+		// others are kept to read data written before a rotation, keys must never be removed
+		// while data encrypted with them is stored.
+		Encryption_Key_File []string
+		// Fetch keys from a HashiCorp Vault KV version 2 engine instead of, or as well as, key
+		// files.  Each secret's Encryption-Key-Vault-Field holds a key as 64 hex characters and
+		// every live version is used, the newest encrypting new data.  The token is read from
+		// Encryption-Key-Vault-Token-File or the VAULT_TOKEN environment variable.  Secrets are
+		// fetched again every Encryption-Key-Refresh, 5 minutes if empty, to pick up new versions.
+		Encryption_Key_Vault_Address    string
+		Encryption_Key_Vault_Token_File string
+		Encryption_Key_Vault_Mount      string
+		Encryption_Key_Vault_Field      string
+		Encryption_Key_Vault_Secret     []string
+		// Unwrap keys with AWS KMS.  Each Encryption-Key-AWS-KMS-File holds base64 encoded
+		// CiphertextBlobs of data keys, one per line with the newest last.  Credentials are
+		// read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN, and the
+		// region from AWS_REGION if Encryption-Key-AWS-KMS-Region is empty.
+		Encryption_Key_AWS_KMS_Region   string
+		Encryption_Key_AWS_KMS_Endpoint string
+		Encryption_Key_AWS_KMS_Key_ID   string
+		Encryption_Key_AWS_KMS_File     []string
+		// Unwrap keys with a Google Cloud KMS key, named as projects/*/locations/*/keyRings/*/cryptoKeys/*.
+		// Each Encryption-Key-GCP-KMS-File holds base64 encoded ciphertexts, one per line with
+		// the newest last.  The instance's service account is used unless a token file is set.
+		Encryption_Key_GCP_KMS_Key        string
+		Encryption_Key_GCP_KMS_Token_File string
+		Encryption_Key_GCP_KMS_File       []string
+		// Vault secrets and KMS files are fetched again every Encryption-Key-Refresh
+		Encryption_Key_Refresh string
+		// Refuse to serve files which are not encrypted.  Files stored before encryption was
+		// enabled are served as they are unless this is set, which would also serve a file
+		// put in place of an encrypted one.  Set it once -reencrypt finds nothing left to do.
+		Encryption_Require bool
+		// Keep recently pulled shards from a remote backend on local disk in Cache-Directory,
+		// the least recently used are evicted to stay under Cache-Size, such as "50G"
+		Cache_Directory string
+		Cache_Size      string
 	}
+	// Per-customer settings keyed by customer number
+	Customer map[string]*customerCfg
+}
+
+type customerCfg struct {
+	Ingress_Rate_Limit string // overrides the Global setting for this customer
+	Egress_Rate_Limit  string
+
+	// Legal holds block deleting or replacing shards until an admin removes them,
+	// either for the whole customer or for the named wells on all of its indexers
+	Legal_Hold      bool
+	Legal_Hold_Well []string
+
+	// Keys used for this customer's new data instead of ones derived from the Global keys
+	Encryption_Key_File         []string
+	Encryption_Key_Vault_Secret []string
+	Encryption_Key_AWS_KMS_File []string
+	Encryption_Key_GCP_KMS_File []string
 }
 
 func GetConfig(path string) (*cfgType, error) {
@@ -96,12 +325,31 @@ func verifyConfig(c *cfgType) error {
 			return errors.New("Must specify Key-File")
 		}
 	}
-	if c.Global.Password_File == `` {
-		return errors.New("Must specify Password-File")
+	if c.Global.Auth_Type == `` {
+		c.Global.Auth_Type = DefaultAuthType
+	}
+	switch c.Global.Auth_Type {
+	case AuthTypeFile:
+		if c.Global.Password_File == `` {
+			return errors.New("Must specify Password-File")
+		}
+	case AuthTypePostgres, AuthTypeMySQL:
+		if c.Global.Auth_DB_DSN == `` {
+			return errors.New("Must specify Auth-DB-DSN")
+		}
+	case AuthTypeHtpasswd:
+		if c.Global.Password_File == `` {
+			return errors.New("Must specify Password-File")
+		}
+		if c.Global.Htpasswd_Map_File == `` {
+			return errors.New("Must specify Htpasswd-Map-File")
+		}
+	default:
+		return fmt.Errorf("%s is an invalid Auth-Type", c.Global.Auth_Type)
 	}
 
 	// Figure out what kind of backend we're going to use
-	if c.Global.Backend_Type == `` {
+	if c.Global.Backend_Type = strings.ToLower(strings.TrimSpace(c.Global.Backend_Type)); c.Global.Backend_Type == `` {
 		c.Global.Backend_Type = DefaultBackendType
 	}
 	if c.Global.Storage_Directory == `` {
@@ -109,17 +357,13 @@ func verifyConfig(c *cfgType) error {
 	} else if err := writableDir(c.Global.Storage_Directory); err != nil {
 		return fmt.Errorf("Storage-Directory error %v", err)
 	}
-	switch c.Global.Backend_Type {
-	case BackendTypeFile:
-	case BackendTypeFTP:
-		if c.Global.FTP_Server == `` {
-			return errors.New("Must specify FTP-Server")
-		} else if c.Global.FTP_Username == `` {
-			return errors.New("Must specify FTP-Username")
-		} else if c.Global.FTP_Password == `` {
-			return errors.New("Must specify FTP-Password")
+	if err := verifyBackend(c, c.Global.Backend_Type); err != nil {
+		return err
+	}
+	for _, v := range c.Global.Backend_Option {
+		if _, _, err := backend.ParseOption(v); err != nil {
+			return err
 		}
-		// it's ok to leave Remote-Base-Directory empty.
 	}
 	if c.Global.Listen_Address == `` {
 		return fmt.Errorf("Listen-Address is empty")
@@ -127,6 +371,87 @@ func verifyConfig(c *cfgType) error {
 		//potentially append the default port
 		c.Global.Listen_Address = icfg.AppendDefaultPort(c.Global.Listen_Address, defaultListenPort)
 	}
+	if c.Global.GRPC_Listen_Address != `` {
+		c.Global.GRPC_Listen_Address = icfg.AppendDefaultPort(c.Global.GRPC_Listen_Address, defaultGRPCPort)
+	}
+	if c.Global.S3_Gateway_Listen_Address != `` {
+		if c.Global.S3_Gateway_Credentials_File == `` {
+			return errors.New("Must specify S3-Gateway-Credentials-File")
+		}
+		c.Global.S3_Gateway_Listen_Address = icfg.AppendDefaultPort(c.Global.S3_Gateway_Listen_Address, defaultS3Port)
+	}
+	if _, _, err := rateLimits(c); err != nil {
+		return err
+	}
+	switch c.Global.Duplicate_Shard_Policy = strings.ToLower(strings.TrimSpace(c.Global.Duplicate_Shard_Policy)); webserver.DuplicatePolicy(c.Global.Duplicate_Shard_Policy) {
+	case ``, webserver.DuplicateVersion, webserver.DuplicateReject:
+	default:
+		return fmt.Errorf("%s is an invalid Duplicate-Shard-Policy", c.Global.Duplicate_Shard_Policy)
+	}
+	if _, err := parseMaxDuration(`Max-Push-Duration`, c.Global.Max_Push_Duration); err != nil {
+		return err
+	} else if _, err = parseMaxDuration(`Max-Pull-Duration`, c.Global.Max_Pull_Duration); err != nil {
+		return err
+	}
+	if _, err := loginBackoff(c); err != nil {
+		return err
+	}
+	if _, err := legalHolds(c); err != nil {
+		return err
+	}
+	//keys held in Vault or KMS are only fetched once the server starts
+	if enabled, err := checkEncryption(c); err != nil {
+		return err
+	} else if enabled && webserver.DuplicatePolicy(c.Global.Duplicate_Shard_Policy) == webserver.DuplicateReject {
+		//rejecting duplicates needs the stored shard's checksums, which encryption hides
+		return errors.New("Duplicate-Shard-Policy reject cannot be used with Encryption-Key-File")
+	} else if !enabled && c.Global.Encryption_Require {
+		return errors.New("Encryption-Require needs encryption keys")
+	}
+	if _, err := cacheSize(c); err != nil {
+		return err
+	}
+	if _, err := parseBackupRetention(c.Global.Backup_Retention); err != nil {
+		return err
+	}
+	if _, err := parseTrashRetention(c.Global.Trash_Retention); err != nil {
+		return err
+	}
+	if _, err := parseHistoryRetention(c.Global.Access_History_Retention); err != nil {
+		return err
+	}
+	if c.Global.Backend_Type == BackendTypeReplicated {
+		if err := verifyReplicas(c); err != nil {
+			return err
+		}
+	} else if c.Global.Backend_Type == BackendTypeTiered {
+		if err := verifyTiers(c); err != nil {
+			return err
+		}
+	} else if c.Global.Backend_Type == BackendTypeFailover {
+		if err := verifyFailover(c); err != nil {
+			return err
+		}
+	}
+	if bc, err := backendConfig(c); err != nil {
+		return err
+	} else if _, err = parseWriteConfig(bc.Options); err != nil {
+		return err
+	} else if _, err = parseDiskMonitor(bc.Options); err != nil {
+		return err
+	} else if _, _, err = parseSharedLocking(bc.Options); err != nil {
+		return err
+	}
+	if c.Global.Shared_Storage && !usesBackend(c, BackendTypeFile) {
+		return errors.New("Shared-Storage requires the file backend")
+	} else if !c.Global.Shared_Storage && c.Global.Shared_Storage_Lease != `` {
+		return errors.New("Shared-Storage-Lease requires Shared-Storage")
+	}
+	if _, err := maintenance.ParseSchedule(c.Global.Maintenance_Window); err != nil {
+		return err
+	} else if c.Global.Maintenance_Push_Limit < 0 {
+		return errors.New("Maintenance-Push-Limit must not be negative")
+	}
 	ll := strings.ToUpper(strings.TrimSpace(c.Global.Log_Level))
 	switch ll {
 	case `INFO`:
@@ -142,6 +467,119 @@ func verifyConfig(c *cfgType) error {
 	return nil
 }
 
+// loginBackoff builds the per-address failed login backoff settings
+func loginBackoff(c *cfgType) (lb webserver.LoginBackoff, err error) {
+	if c.Global.Login_Backoff_Attempts < 0 {
+		err = errors.New("Login-Backoff-Attempts must not be negative")
+		return
+	}
+	lb.Disable = c.Global.Disable_Login_Backoff
+	lb.Free = c.Global.Login_Backoff_Attempts
+	lb.MaxDelay, err = parseMaxDuration(`Login-Backoff-Max`, c.Global.Login_Backoff_Max)
+	return
+}
+
+// rateLimits parses the default and per-customer transfer caps into bytes per second
+func rateLimits(c *cfgType) (def webserver.RateLimits, cust map[uint64]webserver.RateLimits, err error) {
+	if def.Ingress, err = parseRateLimit(`Ingress-Rate-Limit`, c.Global.Ingress_Rate_Limit); err != nil {
+		return
+	} else if def.Egress, err = parseRateLimit(`Egress-Rate-Limit`, c.Global.Egress_Rate_Limit); err != nil {
+		return
+	}
+	cust = make(map[uint64]webserver.RateLimits, len(c.Customer))
+	for k, v := range c.Customer {
+		var cid uint64
+		if cid, err = strconv.ParseUint(k, 10, 64); err != nil {
+			err = fmt.Errorf("Customer %q is not a valid customer number", k)
+			return
+		}
+		rl := def
+		if v.Ingress_Rate_Limit != `` {
+			if rl.Ingress, err = parseRateLimit(`Ingress-Rate-Limit`, v.Ingress_Rate_Limit); err != nil {
+				return
+			}
+		}
+		if v.Egress_Rate_Limit != `` {
+			if rl.Egress, err = parseRateLimit(`Egress-Rate-Limit`, v.Egress_Rate_Limit); err != nil {
+				return
+			}
+		}
+		cust[cid] = rl
+	}
+	return
+}
+
+// legalHolds collects the customers and wells placed under legal hold
+func legalHolds(c *cfgType) (lh util.LegalHolds, err error) {
+	lh = util.LegalHolds{}
+	for k, v := range c.Customer {
+		if !v.Legal_Hold && len(v.Legal_Hold_Well) == 0 {
+			continue
+		}
+		var cid uint64
+		if cid, err = strconv.ParseUint(k, 10, 64); err != nil {
+			err = fmt.Errorf("Customer %q is not a valid customer number", k)
+			return
+		}
+		ch := util.CustomerHold{All: v.Legal_Hold}
+		for _, w := range v.Legal_Hold_Well {
+			if w = strings.TrimSpace(w); w == `` {
+				err = fmt.Errorf("Customer %q has an empty Legal-Hold-Well", k)
+				return
+			}
+			ch.Wells = append(ch.Wells, w)
+		}
+		lh[cid] = ch
+	}
+	return
+}
+
+// cacheSize parses Cache-Size, zero means the pull cache is disabled
+func cacheSize(c *cfgType) (sz int64, err error) {
+	if c.Global.Cache_Directory == `` {
+		if c.Global.Cache_Size != `` {
+			err = errors.New("Cache-Size requires Cache-Directory")
+		}
+		return
+	} else if c.Global.Backend_Type == BackendTypeFile {
+		err = errors.New("Cache-Directory cannot be used with the file backend, its shards are already on local disk")
+		return
+	} else if c.Global.Cache_Size == `` {
+		err = errors.New("Cache-Directory requires Cache-Size")
+		return
+	}
+	var v uint64
+	if v, err = util.ParseSize(c.Global.Cache_Size); err != nil {
+		err = fmt.Errorf("Invalid Cache-Size %q: %w", c.Global.Cache_Size, err)
+	} else if v == 0 || v > math.MaxInt64 {
+		err = fmt.Errorf("Cache-Size %q is out of range", c.Global.Cache_Size)
+	} else {
+		sz = int64(v)
+	}
+	return
+}
+
+// keyRefresh returns how often keys are fetched again from Vault and KMS
+func keyRefresh(c *cfgType) (d time.Duration, err error) {
+	if d, err = parseMaxDuration(`Encryption-Key-Refresh`, c.Global.Encryption_Key_Refresh); err == nil && d == 0 {
+		d = defaultKeyRefresh
+	}
+	return
+}
+
+func parseRateLimit(name, v string) (bytesPerSec int64, err error) {
+	var bps int64
+	if bps, err = icfg.ParseRate(strings.TrimSpace(v)); err != nil {
+		err = fmt.Errorf("Invalid %s %q: %v", name, v, err)
+		return
+	}
+	bytesPerSec = bps / 8
+	if bps > 0 && bytesPerSec == 0 {
+		bytesPerSec = 1
+	}
+	return
+}
+
 // writableDir ensures that the provided location exists, is a dir, and is R/W
 func writableDir(pth string) error {
 	if fi, err := os.Stat(pth); err != nil {
@@ -155,3 +593,156 @@ func writableDir(pth string) error {
 	}
 	return nil
 }
+
+// parseMaxDuration parses a transfer duration limit, empty is unlimited
+func parseMaxDuration(name, v string) (d time.Duration, err error) {
+	if v = strings.TrimSpace(v); v == `` {
+		return
+	} else if d, err = time.ParseDuration(v); err != nil {
+		err = fmt.Errorf("Invalid %s %q: %w", name, v, err)
+	} else if d < 0 {
+		err = fmt.Errorf("%s %q must not be negative", name, v)
+	}
+	return
+}
+
+// verifyBackend checks the Global settings used by a backend type, types registered by
+// plugins bring their own settings in Backend-Option
+func verifyBackend(c *cfgType, typ string) error {
+	switch typ {
+	case BackendTypeFile:
+	case BackendTypeFTP:
+		if c.Global.FTP_Server == `` {
+			return errors.New("Must specify FTP-Server")
+		} else if c.Global.FTP_Username == `` {
+			return errors.New("Must specify FTP-Username")
+		} else if c.Global.FTP_Password == `` {
+			return errors.New("Must specify FTP-Password")
+		}
+		// it's ok to leave Remote-Base-Directory empty.
+		if c.Global.FTP_Pull_Workers < 0 || c.Global.FTP_Pull_Queue < 0 {
+			return errors.New("FTP-Pull-Workers and FTP-Pull-Queue must not be negative")
+		}
+	case BackendTypeS3:
+		if c.Global.S3_Endpoint == `` {
+			return errors.New("Must specify S3-Endpoint")
+		} else if c.Global.S3_Bucket == `` {
+			return errors.New("Must specify S3-Bucket")
+		} else if c.Global.S3_Access_Key == `` {
+			return errors.New("Must specify S3-Access-Key")
+		} else if c.Global.S3_Secret_Key == `` {
+			return errors.New("Must specify S3-Secret-Key")
+		}
+	case BackendTypeRemote:
+		if c.Global.Remote_Backend_Address == `` {
+			return errors.New("Must specify Remote-Backend-Address")
+		}
+	case BackendTypeCAS:
+		if _, err := parseSweepInterval(c.Global.CAS_Sweep_Interval); err != nil {
+			return err
+		}
+	case BackendTypeSwift:
+		if c.Global.Swift_Auth_URL == `` {
+			return errors.New("Must specify Swift-Auth-URL")
+		} else if c.Global.Swift_Username == `` {
+			return errors.New("Must specify Swift-Username")
+		} else if c.Global.Swift_Password == `` {
+			return errors.New("Must specify Swift-Password")
+		} else if c.Global.Swift_Project == `` {
+			return errors.New("Must specify Swift-Project")
+		}
+	}
+	return nil
+}
+
+// localShards reports whether the backend keeps shards under Storage-Directory
+func localShards(typ string) bool {
+	return typ == BackendTypeFile || typ == BackendTypeFTP || typ == BackendTypeCAS
+}
+
+// verifyReplicas checks the backends listed by Replica-Backend
+func verifyReplicas(c *cfgType) error {
+	if len(c.Global.Replica_Backend) < 2 {
+		return errors.New("The replicated backend requires at least two Replica-Backend entries")
+	}
+	seen := map[string]bool{}
+	for i, v := range c.Global.Replica_Backend {
+		v = strings.ToLower(strings.TrimSpace(v))
+		c.Global.Replica_Backend[i] = v
+		if v == BackendTypeReplicated || v == BackendTypeTiered || v == BackendTypeFailover {
+			return fmt.Errorf("Replica-Backend may not be %s", v)
+		} else if seen[v] {
+			return fmt.Errorf("Replica-Backend %s is listed more than once", v)
+		}
+		seen[v] = true
+		if err := verifyBackend(c, v); err != nil {
+			return err
+		}
+	}
+	var local int
+	for v := range seen {
+		if localShards(v) {
+			local++
+		}
+	}
+	if local > 1 {
+		return errors.New("The file, ftp, and cas backends all keep shards under Storage-Directory and cannot be replicas of each other")
+	}
+	if c.Global.Replica_Min_Writes < 0 || c.Global.Replica_Min_Writes > len(c.Global.Replica_Backend) {
+		return fmt.Errorf("Replica-Min-Writes must be between 1 and the number of Replica-Backend entries")
+	}
+	if _, err := parseReconcileInterval(`Replica-Reconcile-Interval`, c.Global.Replica_Reconcile_Interval); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyTiers checks the cold backend and ages used by the tiered backend
+func verifyTiers(c *cfgType) error {
+	c.Global.Tier_Cold_Backend = strings.ToLower(strings.TrimSpace(c.Global.Tier_Cold_Backend))
+	switch c.Global.Tier_Cold_Backend {
+	case ``:
+		return errors.New("The tiered backend requires Tier-Cold-Backend")
+	case BackendTypeFile, BackendTypeFTP, BackendTypeCAS, BackendTypeReplicated, BackendTypeTiered, BackendTypeFailover:
+		return fmt.Errorf("Tier-Cold-Backend may not be %s, it would share Storage-Directory with the hot file backend", c.Global.Tier_Cold_Backend)
+	}
+	if err := verifyBackend(c, c.Global.Tier_Cold_Backend); err != nil {
+		return err
+	}
+	if _, err := parseTierMaxAge(c.Global.Tier_Max_Age); err != nil {
+		return err
+	} else if _, err = parseMigrateInterval(c.Global.Tier_Migrate_Interval); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyFailover checks the primary and secondary backends used by the failover backend
+func verifyFailover(c *cfgType) error {
+	c.Global.Failover_Primary_Backend = strings.ToLower(strings.TrimSpace(c.Global.Failover_Primary_Backend))
+	c.Global.Failover_Secondary_Backend = strings.ToLower(strings.TrimSpace(c.Global.Failover_Secondary_Backend))
+	pri, sec := c.Global.Failover_Primary_Backend, c.Global.Failover_Secondary_Backend
+	if pri == `` {
+		return errors.New("The failover backend requires Failover-Primary-Backend")
+	} else if sec == `` {
+		return errors.New("The failover backend requires Failover-Secondary-Backend")
+	} else if pri == sec {
+		return errors.New("Failover-Primary-Backend and Failover-Secondary-Backend must differ")
+	}
+	for _, v := range []string{pri, sec} {
+		switch v {
+		case BackendTypeReplicated, BackendTypeTiered, BackendTypeFailover:
+			return fmt.Errorf("The failover backend may not use the %s backend", v)
+		}
+		if err := verifyBackend(c, v); err != nil {
+			return err
+		}
+	}
+	if localShards(pri) && localShards(sec) {
+		return errors.New("The file, ftp, and cas backends all keep shards under Storage-Directory and cannot fail over to each other")
+	}
+	if _, err := parseReconcileInterval(`Failover-Reconcile-Interval`, c.Global.Failover_Reconcile_Interval); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// historyPurgeTask returns a maintenance task which drops access history past its retention period
+func historyPurgeTask(ah webserver.AccessHistory, lgr *log.Logger) maintenance.Task {
+	return func(ctx context.Context) error {
+		purged, err := ah.PurgeHistory(ctx)
+		lgr.Info("access history purge finished", log.KV("months", purged))
+		return err
+	}
+}
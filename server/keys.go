@@ -0,0 +1,310 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/cloudarchive/pkg/cryptstore"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const (
+	keyFetchTimeout = time.Minute
+)
+
+// keyList is the encryption keys configured globally or for a customer
+type keyList struct {
+	files  []string
+	vault  []string
+	awsKMS []string
+	gcpKMS []string
+}
+
+func (kl keyList) empty() bool {
+	return len(kl.files) == 0 && len(kl.vault) == 0 && len(kl.awsKMS) == 0 && len(kl.gcpKMS) == 0
+}
+
+// keySources are the services keys are fetched from, a source is nil if no keys use it
+type keySources struct {
+	vault  cryptstore.KeySource
+	awsKMS cryptstore.KeySource
+	gcpKMS cryptstore.KeySource
+}
+
+func (ks keySources) remote() bool {
+	return ks.vault != nil || ks.awsKMS != nil || ks.gcpKMS != nil
+}
+
+func globalKeys(c *cfgType) keyList {
+	return keyList{
+		files:  c.Global.Encryption_Key_File,
+		vault:  c.Global.Encryption_Key_Vault_Secret,
+		awsKMS: c.Global.Encryption_Key_AWS_KMS_File,
+		gcpKMS: c.Global.Encryption_Key_GCP_KMS_File,
+	}
+}
+
+// customerKeys returns the keys configured for each customer which has its own keys
+func customerKeys(c *cfgType) (m map[uint64]keyList, err error) {
+	m = map[uint64]keyList{}
+	for k, v := range c.Customer {
+		kl := keyList{
+			files:  v.Encryption_Key_File,
+			vault:  v.Encryption_Key_Vault_Secret,
+			awsKMS: v.Encryption_Key_AWS_KMS_File,
+			gcpKMS: v.Encryption_Key_GCP_KMS_File,
+		}
+		if kl.empty() {
+			continue
+		}
+		var cid uint64
+		if cid, err = strconv.ParseUint(k, 10, 64); err != nil {
+			err = fmt.Errorf("Customer %q is not a valid customer number", k)
+			return
+		}
+		m[cid] = kl
+	}
+	return
+}
+
+// checkEncryption validates the encryption settings without fetching any keys from Vault
+// or KMS, and reports whether encryption is enabled
+func checkEncryption(c *cfgType) (enabled bool, err error) {
+	var custs map[uint64]keyList
+	if custs, err = customerKeys(c); err != nil {
+		return
+	}
+	global := globalKeys(c)
+	if global.empty() {
+		if len(custs) > 0 {
+			err = errors.New("Customer encryption keys require Global encryption keys")
+		}
+		return
+	}
+	if _, err = keyRefresh(c); err != nil {
+		return
+	} else if _, err = newKeySources(c); err != nil {
+		return
+	}
+	//key files are local, so are loaded now to catch bad ones early
+	kr := cryptstore.NewKeyring()
+	if err = addKeyFiles(kr, 0, global.files); err != nil {
+		return
+	}
+	for cid, kl := range custs {
+		if err = addKeyFiles(kr, cid, kl.files); err != nil {
+			err = fmt.Errorf("Customer %d %w", cid, err)
+			return
+		}
+	}
+	enabled = true
+	return
+}
+
+// encryptionKeys loads the keys shards are encrypted with, fetching those held in Vault
+// or KMS.  A nil keyring means encryption is disabled, remote is set if keys were fetched.
+func encryptionKeys(ctx context.Context, c *cfgType) (kr *cryptstore.Keyring, remote bool, err error) {
+	var enabled bool
+	var srcs keySources
+	var custs map[uint64]keyList
+	if enabled, err = checkEncryption(c); err != nil || !enabled {
+		return
+	} else if srcs, err = newKeySources(c); err != nil {
+		return
+	} else if custs, err = customerKeys(c); err != nil {
+		return
+	}
+	kr = cryptstore.NewKeyring()
+	if err = addKeys(ctx, kr, 0, globalKeys(c), srcs); err != nil {
+		kr = nil
+		return
+	}
+	for cid, kl := range custs {
+		if err = addKeys(ctx, kr, cid, kl, srcs); err != nil {
+			err = fmt.Errorf("Customer %d %w", cid, err)
+			kr = nil
+			return
+		}
+	}
+	remote = srcs.remote()
+	return
+}
+
+func addKeyFiles(kr *cryptstore.Keyring, cid uint64, files []string) (err error) {
+	var key []byte
+	for _, p := range files {
+		if key, err = cryptstore.LoadKeyFile(p); err != nil {
+			return
+		}
+		if cid == 0 {
+			err = kr.AddKey(key)
+		} else {
+			err = kr.AddCustomerKey(cid, key)
+		}
+		if err != nil {
+			return fmt.Errorf("Encryption-Key-File %s: %w", p, err)
+		}
+	}
+	return
+}
+
+// addKeys adds the listed keys, global keys if cid is zero.  The key files come first and
+// then the keys from each source, so the last key from the last source encrypts new data.
+func addKeys(ctx context.Context, kr *cryptstore.Keyring, cid uint64, kl keyList, srcs keySources) (err error) {
+	if err = addKeyFiles(kr, cid, kl.files); err != nil {
+		return
+	}
+	for _, v := range []struct {
+		setting string
+		src     cryptstore.KeySource
+		names   []string
+	}{
+		{`Encryption-Key-Vault-Secret`, srcs.vault, kl.vault},
+		{`Encryption-Key-AWS-KMS-File`, srcs.awsKMS, kl.awsKMS},
+		{`Encryption-Key-GCP-KMS-File`, srcs.gcpKMS, kl.gcpKMS},
+	} {
+		for _, name := range v.names {
+			if cid == 0 {
+				err = kr.AddKeySource(ctx, v.src, name)
+			} else {
+				err = kr.AddCustomerKeySource(ctx, cid, v.src, name)
+			}
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", v.setting, name, err)
+			}
+		}
+	}
+	return
+}
+
+// newKeySources builds the sources the configured keys are fetched from, nothing is fetched
+func newKeySources(c *cfgType) (srcs keySources, err error) {
+	var refresh time.Duration
+	if refresh, err = keyRefresh(c); err != nil {
+		return
+	}
+	//every key is fetched again on each refresh, caching for half the interval keeps a key
+	//listed for several customers from being fetched for each without serving a refresh stale keys
+	cache := func(src cryptstore.KeySource) cryptstore.KeySource {
+		return cryptstore.NewCachedKeySource(src, refresh/2)
+	}
+	var custs map[uint64]keyList
+	if custs, err = customerKeys(c); err != nil {
+		return
+	}
+	var vault, aws, gcp bool
+	for _, kl := range append([]keyList{globalKeys(c)}, mapValues(custs)...) {
+		vault = vault || len(kl.vault) > 0
+		aws = aws || len(kl.awsKMS) > 0
+		gcp = gcp || len(kl.gcpKMS) > 0
+	}
+	var src cryptstore.KeySource
+	if vault {
+		if src, err = vaultKeySource(c); err != nil {
+			return
+		}
+		srcs.vault = cache(src)
+	}
+	if aws {
+		if src, err = awsKMSKeySource(c); err != nil {
+			return
+		}
+		srcs.awsKMS = cache(src)
+	}
+	if gcp {
+		if src, err = gcpKMSKeySource(c); err != nil {
+			return
+		}
+		srcs.gcpKMS = cache(src)
+	}
+	return
+}
+
+func mapValues(m map[uint64]keyList) (r []keyList) {
+	for _, v := range m {
+		r = append(r, v)
+	}
+	return
+}
+
+func vaultKeySource(c *cfgType) (src cryptstore.KeySource, err error) {
+	vc := cryptstore.VaultConfig{
+		Address: c.Global.Encryption_Key_Vault_Address,
+		Token:   os.Getenv(`VAULT_TOKEN`),
+		Mount:   c.Global.Encryption_Key_Vault_Mount,
+		Field:   c.Global.Encryption_Key_Vault_Field,
+	}
+	if p := c.Global.Encryption_Key_Vault_Token_File; p != `` {
+		var bts []byte
+		if bts, err = ioutil.ReadFile(p); err != nil {
+			err = fmt.Errorf("Encryption-Key-Vault-Token-File %w", err)
+			return
+		}
+		vc.Token = strings.TrimSpace(string(bts))
+	}
+	if src, err = cryptstore.NewVaultKeySource(vc); err != nil {
+		err = fmt.Errorf("Vault: %w", err)
+	}
+	return
+}
+
+func awsKMSKeySource(c *cfgType) (src cryptstore.KeySource, err error) {
+	ac := cryptstore.AWSKMSConfig{
+		Region:          c.Global.Encryption_Key_AWS_KMS_Region,
+		Endpoint:        c.Global.Encryption_Key_AWS_KMS_Endpoint,
+		KeyID:           c.Global.Encryption_Key_AWS_KMS_Key_ID,
+		AccessKeyID:     os.Getenv(`AWS_ACCESS_KEY_ID`),
+		SecretAccessKey: os.Getenv(`AWS_SECRET_ACCESS_KEY`),
+		SessionToken:    os.Getenv(`AWS_SESSION_TOKEN`),
+	}
+	if ac.Region == `` {
+		ac.Region = os.Getenv(`AWS_REGION`)
+	}
+	if src, err = cryptstore.NewAWSKMSKeySource(ac); err != nil {
+		err = fmt.Errorf("AWS KMS: %w", err)
+	}
+	return
+}
+
+func gcpKMSKeySource(c *cfgType) (src cryptstore.KeySource, err error) {
+	gc := cryptstore.GCPKMSConfig{
+		Key:       c.Global.Encryption_Key_GCP_KMS_Key,
+		TokenFile: c.Global.Encryption_Key_GCP_KMS_Token_File,
+	}
+	if src, err = cryptstore.NewGCPKMSKeySource(gc); err != nil {
+		err = fmt.Errorf("GCP KMS: %w", err)
+	}
+	return
+}
+
+// refreshKeys fetches the keys held in Vault or KMS every interval so that new versions
+// are used without a restart, a failed refresh keeps the keys already held
+func refreshKeys(kr *cryptstore.Keyring, interval time.Duration, lgr *log.Logger) {
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for range tckr.C {
+		ctx, cf := context.WithTimeout(context.Background(), interval)
+		added, err := kr.Refresh(ctx)
+		cf()
+		if err != nil {
+			lgr.Error("Failed to refresh encryption keys", log.KVErr(err))
+		} else if added > 0 {
+			lgr.Info("encryption keys rotated", log.KV("added", added))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/util"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+var (
+	ErrReencryptDisabled = errors.New("shard encryption is not enabled, set Encryption-Key-File")
+)
+
+// reencrypter is implemented by the encrypting store wrapper
+type reencrypter interface {
+	Reencrypt(ctx context.Context, dryRun bool) (util.ReencryptResult, error)
+}
+
+// reencryptShards runs a single re-encryption pass and prints what was, or would be, rewritten
+func reencryptShards(handler webserver.ShardHandler, dryRun bool) error {
+	re, ok := handler.(reencrypter)
+	if !ok {
+		return ErrReencryptDisabled
+	}
+	res, err := re.Reencrypt(context.Background(), dryRun)
+	verb := `re-encrypted`
+	if dryRun {
+		verb = `would re-encrypt`
+	}
+	fmt.Printf("checked %d shards, %s %d files in %d shards, skipped %d busy or held shards\n",
+		res.Checked, verb, res.Files, res.Reencrypted, res.Skipped)
+	return err
+}
+
+// reencryptionTask returns a maintenance task which re-encrypts shards under the current keys and logs the outcome
+func reencryptionTask(re reencrypter, lgr *log.Logger) maintenance.Task {
+	return func(ctx context.Context) error {
+		res, err := re.Reencrypt(ctx, false)
+		if errors.Is(err, util.ErrReencryptRunning) {
+			lgr.Info("shard re-encryption skipped, a pass started by an administrator is still running")
+			return nil
+		}
+		lgr.Info("shard re-encryption finished", log.KV("checked", res.Checked), log.KV("shards", res.Reencrypted),
+			log.KV("files", res.Files), log.KV("skipped", res.Skipped))
+		return err
+	}
+}
@@ -9,17 +9,28 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
+	"io/ioutil"
 	glog "log"
 	"os"
 	"os/signal"
 
 	"github.com/gravwell/cloudarchive/pkg/auth"
-	"github.com/gravwell/cloudarchive/pkg/filestore"
-	"github.com/gravwell/cloudarchive/pkg/ftpstore"
+	"github.com/gravwell/cloudarchive/pkg/backend"
+	"github.com/gravwell/cloudarchive/pkg/cachestore"
+	"github.com/gravwell/cloudarchive/pkg/cryptstore"
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/s3gateway"
+	"github.com/gravwell/cloudarchive/pkg/shardpacker"
 	"github.com/gravwell/cloudarchive/pkg/webserver"
 
 	"github.com/gravwell/gravwell/v3/ingest/log"
+
+	//SQL drivers for the database auth backends
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
 const (
@@ -27,7 +38,11 @@ const (
 )
 
 var (
-	fConfig = flag.String("config-file", "", "Path to configuration file")
+	fConfig      = flag.String("config-file", "", "Path to configuration file")
+	fOpenAPISpec = flag.String("openapi-spec", "", "Write the HTTP API OpenAPI specification to the given file (- for stdout) and exit")
+	fCompact     = flag.Bool("compact-duplicates", false, "Remove redundant copies of re-pushed shards from the storage backend and exit")
+	fReencrypt   = flag.Bool("reencrypt", false, "Re-encrypt every stored file which is not encrypted with the current key and exit")
+	fDryRun      = flag.Bool("dry-run", false, "Report what -compact-duplicates would remove, or -reencrypt would rewrite, without changing anything")
 )
 
 func main() {
@@ -37,6 +52,13 @@ func main() {
 
 	flag.Parse()
 
+	if *fOpenAPISpec != `` {
+		if err := writeOpenAPISpec(*fOpenAPISpec); err != nil {
+			glog.Fatalf("Failed to write OpenAPI specification: %v", err)
+		}
+		return
+	}
+
 	cfg, err := GetConfig(*fConfig)
 	if err != nil {
 		glog.Fatalf("Failed to open config %v: %v", *fConfig, err)
@@ -56,31 +78,176 @@ func main() {
 		glog.Fatalf("Failed to set log level %v: %v", cfg.Global.Log_Level, err)
 	}
 
-	var handler webserver.ShardHandler
-	switch cfg.Global.Backend_Type {
-	case BackendTypeFile:
-		handler, err = filestore.NewFilestoreHandler(cfg.Global.Storage_Directory)
+	for _, pat := range cfg.Global.Shard_Artifact {
+		if err = shardpacker.RegisterArtifact(pat); err != nil {
+			lgr.Fatalf("Failed to register shard artifact: %v", err)
+		}
+	}
+
+	for _, p := range cfg.Global.Backend_Plugin {
+		if err = backend.LoadPlugin(p); err != nil {
+			lgr.Fatalf("%v", err)
+		}
+	}
+	bcfg, err := backendConfig(cfg)
+	if err != nil {
+		lgr.Fatalf("Invalid backend configuration: %v", err)
+	}
+	bcfg.Logger = lgr
+	handler, err := backend.New(cfg.Global.Backend_Type, bcfg)
+	if err != nil {
+		lgr.Fatalf("Failed to create %s storage backend: %v", cfg.Global.Backend_Type, err)
+	}
+	//the cache sits under encryption so cached shards are encrypted too
+	if sz, err := cacheSize(cfg); err != nil {
+		lgr.Fatalf("%v", err)
+	} else if sz > 0 {
+		if handler, err = cachestore.NewCacheStoreHandler(cachestore.CacheStoreConfig{
+			Backend: handler,
+			Dir:     cfg.Global.Cache_Directory,
+			MaxSize: sz,
+			Lgr:     lgr,
+		}); err != nil {
+			lgr.Fatalf("Failed to create pull cache: %v", err)
+		}
+		lgr.Info("pull cache enabled", log.KV("directory", cfg.Global.Cache_Directory), log.KV("size", sz))
+	}
+	kctx, kcf := context.WithTimeout(context.Background(), keyFetchTimeout)
+	kr, remoteKeys, err := encryptionKeys(kctx, cfg)
+	kcf()
+	if err != nil {
+		lgr.Fatalf("Failed to load encryption keys: %v", err)
+	} else if kr != nil {
+		cs, err := cryptstore.NewCryptStoreHandler(handler, kr)
+		if err != nil {
+			lgr.Fatalf("Failed to enable encryption: %v", err)
+		}
+		cs.SetRequireEncryption(cfg.Global.Encryption_Require)
+		handler = cs
+		lgr.Info("shard encryption enabled", log.KV("required", cfg.Global.Encryption_Require))
+		if remoteKeys {
+			refresh, _ := keyRefresh(cfg) //checked with the config
+			go refreshKeys(kr, refresh, lgr)
+		}
+	}
+
+	//holds are set before anything can touch the store, including offline compaction
+	if holds, err := legalHolds(cfg); err != nil {
+		lgr.Fatalf("Invalid legal holds: %v", err)
+	} else if len(holds) > 0 {
+		lhe, ok := handler.(webserver.LegalHoldEnforcer)
+		if !ok {
+			lgr.Fatalf("The %s storage backend does not support Legal-Hold", cfg.Global.Backend_Type)
+		}
+		lhe.SetLegalHolds(holds)
+		lgr.Info("legal holds in effect", log.KV("customers", len(holds)))
+	}
+
+	if *fCompact {
+		if err = compactDuplicates(handler, *fDryRun); err != nil {
+			lgr.Fatalf("Failed to compact duplicate shards: %v", err)
+		}
+		return
+	}
+	if *fReencrypt {
+		if err = reencryptShards(handler, *fDryRun); err != nil {
+			lgr.Fatalf("Failed to re-encrypt shards: %v", err)
+		}
+		return
+	}
+
+	var authModule webserver.Authenticator
+	switch cfg.Global.Auth_Type {
+	case AuthTypeFile:
+		fileAuth, err := auth.NewAuthModule(cfg.Global.Password_File)
+		if err != nil {
+			lgr.Fatalf("Failed to load file based auth module: %v", err)
+		}
+		if cfg.Global.Password_Cost > 0 {
+			fileAuth.SetCost(cfg.Global.Password_Cost)
+		}
+		authModule = fileAuth
+	case AuthTypePostgres, AuthTypeMySQL:
+		sqlAuth, err := auth.NewSQLAuthModule(cfg.Global.Auth_Type, cfg.Global.Auth_DB_DSN, cfg.Global.Auth_DB_Table)
 		if err != nil {
-			lgr.Fatalf("Failed to create a new file store handler: %v", err)
-		}
-	case BackendTypeFTP:
-		fcfg := ftpstore.FtpStoreConfig{
-			LocalStore: cfg.Global.Storage_Directory,
-			FtpServer:  cfg.Global.FTP_Server,
-			BaseDir:    cfg.Global.Remote_Base_Directory,
-			Username:   cfg.Global.FTP_Username,
-			Password:   cfg.Global.FTP_Password,
-			Lgr:        lgr,
-		}
-		handler, err = ftpstore.NewFtpStoreHandler(fcfg)
+			lgr.Fatalf("Failed to load SQL auth module: %v", err)
+		}
+		defer sqlAuth.Close()
+		if cfg.Global.Password_Cost > 0 {
+			sqlAuth.SetCost(cfg.Global.Password_Cost)
+		}
+		authModule = sqlAuth
+	case AuthTypeHtpasswd:
+		htAuth, err := auth.NewHtpasswdAuthModule(cfg.Global.Password_File, cfg.Global.Htpasswd_Map_File)
 		if err != nil {
-			lgr.Fatalf("Failed to create new ftp store handler: %v", err)
+			lgr.Fatalf("Failed to load htpasswd auth module: %v", err)
 		}
+		authModule = htAuth
 	}
 
-	fileAuth, err := auth.NewAuthModule(cfg.Global.Password_File)
+	sched, err := maintenance.NewScheduler(maintenance.SchedulerConfig{
+		Windows:   cfg.Global.Maintenance_Window,
+		PushLimit: cfg.Global.Maintenance_Push_Limit,
+		Logger:    lgr,
+	})
 	if err != nil {
-		lgr.Fatalf("Failed to load file based auth module: %v", err)
+		lgr.Fatalf("Failed to create maintenance scheduler: %v", err)
+	}
+	if cfg.Global.Read_Only {
+		lgr.Info("archive is read-only, shard pushes, deletes, and tag syncs will be refused")
+	}
+	if cfg.Global.Compact_Duplicate_Shards && !cfg.Global.Read_Only {
+		dc, ok := handler.(webserver.DuplicateCompactor)
+		if !ok {
+			lgr.Fatalf("The %s storage backend does not support Compact-Duplicate-Shards", cfg.Global.Backend_Type)
+		}
+		sched.Register(`compact-duplicates`, compactionTask(dc, lgr))
+	}
+	if cfg.Global.Reencrypt_Shards && !cfg.Global.Read_Only {
+		re, ok := handler.(reencrypter)
+		if !ok {
+			lgr.Fatalf("Reencrypt-Shards requires Encryption-Key-File")
+		}
+		sched.Register(`reencrypt-shards`, reencryptionTask(re, lgr))
+	}
+	if cfg.Global.Backup_Directory != `` {
+		task, err := backupTask(cfg, handler, lgr)
+		if err != nil {
+			lgr.Fatalf("Failed to set up state backups: %v", err)
+		}
+		sched.Register(`backup-state`, task)
+	}
+	if st, ok := handler.(webserver.ShardTrash); ok && !cfg.Global.Read_Only {
+		sched.Register(`purge-trash`, trashPurgeTask(st, lgr))
+	}
+	if ah, ok := handler.(webserver.AccessHistory); ok {
+		sched.Register(`purge-history`, historyPurgeTask(ah, lgr))
+	}
+
+	defLimits, custLimits, err := rateLimits(cfg)
+	if err != nil {
+		lgr.Fatalf("Invalid rate limits: %v", err)
+	}
+
+	maxPush, err := parseMaxDuration(`Max-Push-Duration`, cfg.Global.Max_Push_Duration)
+	if err != nil {
+		lgr.Fatalf("%v", err)
+	}
+	maxPull, err := parseMaxDuration(`Max-Pull-Duration`, cfg.Global.Max_Pull_Duration)
+	if err != nil {
+		lgr.Fatalf("%v", err)
+	}
+
+	healthInterval, err := parseMaxDuration(`Health-Check-Interval`, cfg.Global.Health_Check_Interval)
+	if err != nil {
+		lgr.Fatalf("%v", err)
+	} else if healthInterval == 0 && cfg.Global.Health_Check_Interval != `` {
+		healthInterval = -1 //the webserver treats zero as the default
+	}
+
+	backoff, err := loginBackoff(cfg)
+	if err != nil {
+		lgr.Fatalf("%v", err)
 	}
 
 	conf := webserver.WebserverConfig{
@@ -90,7 +257,23 @@ func main() {
 		KeyFile:      cfg.Global.Key_File,
 		Logger:       lgr,
 		ShardHandler: handler,
-		Auth:         fileAuth,
+		Auth:         authModule,
+		Metrics:      cfg.Global.Enable_Metrics,
+
+		RateLimits:         defLimits,
+		CustomerRateLimits: custLimits,
+		PushThrottle:       sched,
+		DuplicatePolicy:    webserver.DuplicatePolicy(cfg.Global.Duplicate_Shard_Policy),
+		ReadOnly:           cfg.Global.Read_Only,
+		MaxPushDuration:    maxPush,
+		MaxPullDuration:    maxPull,
+		LoginBackoff:       backoff,
+		TokenIssuer:        cfg.Global.Token_Issuer,
+		TokenAudience:      cfg.Global.Token_Audience,
+
+		HealthCheckInterval: healthInterval,
+
+		GRPCListenString: cfg.Global.GRPC_Listen_Address,
 	}
 
 	ws, err := webserver.NewWebserver(conf)
@@ -108,11 +291,67 @@ func main() {
 
 	glog.Printf("Webserver running.")
 
+	if err = sched.Start(); err != nil {
+		lgr.Fatalf("Failed to start maintenance scheduler: %v", err)
+	}
+
+	var gw *s3gateway.Gateway
+	if cfg.Global.S3_Gateway_Listen_Address != `` {
+		gcfg := s3gateway.GatewayConfig{
+			ListenString: cfg.Global.S3_Gateway_Listen_Address,
+			DisableTLS:   cfg.Global.Disable_TLS,
+			CertFile:     cfg.Global.Cert_File,
+			KeyFile:      cfg.Global.Key_File,
+			Bucket:       cfg.Global.S3_Gateway_Bucket,
+			Region:       cfg.Global.S3_Gateway_Region,
+			Logger:       lgr,
+			ShardHandler: handler,
+			Auth:         authModule,
+		}
+		if gcfg.Credentials, err = s3gateway.LoadCredentials(cfg.Global.S3_Gateway_Credentials_File); err != nil {
+			lgr.Fatalf("Failed to load S3 gateway credentials: %v", err)
+		}
+		if gw, err = s3gateway.NewGateway(gcfg); err != nil {
+			lgr.Fatalf("Failed to create S3 gateway: %v", err)
+		}
+		if err = gw.Run(); err != nil {
+			lgr.Fatalf("Failed to run S3 gateway: %v", err)
+		}
+		glog.Printf("S3 gateway running.")
+	}
+
 	<-quitSig
 
 	glog.Printf("Webserver exiting.")
+	if err = sched.Close(); err != nil {
+		glog.Println("Failed to close maintenance scheduler", err)
+	}
+	if gw != nil {
+		if err = gw.Close(); err != nil {
+			glog.Println("Failed to close S3 gateway", err)
+		}
+	}
 
 	if err = ws.Close(); err != nil {
 		glog.Fatalln("Failed to close webserver", err)
 	}
+	//backends with background work, such as queued pulls, are shut down last
+	if hc, ok := handler.(io.Closer); ok {
+		if err = hc.Close(); err != nil {
+			glog.Println("Failed to close storage backend", err)
+		}
+	}
+}
+
+func writeOpenAPISpec(p string) error {
+	bts, err := webserver.GenerateOpenAPI()
+	if err != nil {
+		return err
+	}
+	bts = append(bts, '\n')
+	if p == `-` {
+		_, err = os.Stdout.Write(bts)
+		return err
+	}
+	return ioutil.WriteFile(p, bts, 0644)
 }
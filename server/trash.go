@@ -0,0 +1,34 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+
+	"github.com/gravwell/cloudarchive/pkg/maintenance"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+// trashPurgeTask returns a maintenance task which destroys trashed shards past their retention period
+func trashPurgeTask(st webserver.ShardTrash, lgr *log.Logger) maintenance.Task {
+	return func(ctx context.Context) error {
+		purged, err := st.PurgeTrash(ctx)
+		var total int64
+		for _, te := range purged {
+			total += te.Size
+			lgr.Info("purged deleted shard",
+				log.KV("customer", te.CID), log.KV("indexer", te.IdxUUID), log.KV("well", te.Well), log.KV("shard", te.Shard),
+				log.KV("deleted", te.Deleted), log.KV("bytes", te.Size))
+		}
+		lgr.Info("trash purge finished", log.KV("shards", len(purged)), log.KV("bytes", total))
+		return err
+	}
+}
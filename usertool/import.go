@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+)
+
+const (
+	csvID          = `id`
+	csvPassword    = `password`
+	csvHash        = `hash`
+	csvDescription = `description`
+	csvEmail       = `email`
+)
+
+type importResult struct {
+	Action   string
+	Imported int
+}
+
+func importUsers(us userStore, p string) {
+	ius, err := readImportFile(p)
+	if err != nil {
+		log.Fatalf("Failed to read import file %s: %v\n", p, err)
+	}
+	if err = us.ImportUsers(ius, passCost); err != nil {
+		log.Fatalf("Failed to import users: %v\n", err)
+	}
+	if *fjson {
+		emitJSON(importResult{Action: *fact, Imported: len(ius)})
+	} else {
+		fmt.Printf("Imported %d users\n", len(ius))
+	}
+}
+
+// readImportFile reads a JSON array of users if the file has a .json extension, otherwise CSV
+func readImportFile(p string) (ius []auth.ImportUser, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	if strings.EqualFold(filepath.Ext(p), `.json`) {
+		err = json.NewDecoder(fin).Decode(&ius)
+	} else {
+		ius, err = readImportCSV(fin)
+	}
+	return
+}
+
+// readImportCSV reads users from CSV, the first row is a header naming the columns.
+// The id column is required, along with one of password or hash.
+func readImportCSV(rdr io.Reader) (ius []auth.ImportUser, err error) {
+	cr := csv.NewReader(rdr)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	var header []string
+	if header, err = cr.Read(); err != nil {
+		return
+	}
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, ok := cols[csvID]; !ok {
+		err = fmt.Errorf("missing %q column", csvID)
+		return
+	}
+	for {
+		var rec []string
+		if rec, err = cr.Read(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		get := func(name string) string {
+			if i, ok := cols[name]; ok {
+				return strings.TrimSpace(rec[i])
+			}
+			return ``
+		}
+		var iu auth.ImportUser
+		if iu.ID, err = strconv.ParseUint(get(csvID), 10, 64); err != nil {
+			line, _ := cr.FieldPos(0)
+			err = fmt.Errorf("line %d: invalid id: %v", line, err)
+			return
+		}
+		iu.Password = get(csvPassword)
+		iu.Hash = get(csvHash)
+		iu.Description = get(csvDescription)
+		iu.Email = get(csvEmail)
+		ius = append(ius, iu)
+	}
+	return
+}
@@ -9,106 +9,431 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/util"
 
+	"github.com/google/uuid"
 	"github.com/howeyc/gopass"
 )
 
 const (
 	passCost int = 12
+
+	//a token in the environment keeps it out of process listings
+	tokenEnv = `CLOUDARCHIVE_TOKEN`
 )
 
 var (
-	fpath = flag.String("passfile", "", "Path to the password file")
-	fact  = flag.String("action", "list", "action to take (list, useradd, userdel, passwd)")
+	fpath = flag.String("passfile", "", "Path to the password file, mutually exclusive with -server")
+	fsrv  = flag.String("server", "", "Manage the users of a running archive server through its admin API instead of a password file")
+	flog  = flag.String("login", "", "Customer number holding the admin role used to log in to -server")
+	flpwd = flag.String("login-password", "", "Password used to log in to -server, if blank you will be prompted")
+	ftotp = flag.String("totp", "", "TOTP code for -server, required if the login has TOTP enabled")
+	ftok  = flag.String("token", os.Getenv(tokenEnv), "Token from an earlier admin login used with -server in place of -login, defaults to $"+tokenEnv)
+	fssl  = flag.Bool("nossl", false, "Use an insecure HTTP connection to -server")
+	fact  = flag.String("action", "list", "action to take (list, show, useradd, userdel, usermod, passwd, lock, unlock, settotp, cleartotp, setindexers, setrole, setquota, getquota, import)")
 	fuid  = flag.Uint("id", 0, "User ID")
 	fpwd  = flag.String("password", "", "Password to use when adding a user, if blank you will be prompted")
+	fgen  = flag.Bool("genpass", false, "Generate a random password when adding a user, it is printed once")
+	fdesc = flag.String("description", "", "Optional user description used by useradd and usermod")
+	fmail = flag.String("email", "", "Optional contact email used by useradd and usermod")
+	frole = flag.String("role", auth.RoleFull, "Credential role used by setrole (full, readonly, admin)")
+	fquot = flag.String("quota", "", "Storage quota used by setquota, in bytes or with a K, M, G, T, or P suffix, 0 removes the quota")
+	ffile = flag.String("file", "", "CSV or JSON file of users used by import")
+	fjson = flag.Bool("json", false, "Emit machine readable JSON output")
+	fidxs = flag.String("indexers", "", "Comma separated list of indexer UUIDs used by setindexers, blank allows any indexer")
 )
 
+// result is emitted by actions other than list when JSON output is enabled
+type result struct {
+	ID       uint64
+	Action   string
+	Password string  `json:",omitempty"`
+	Secret   string  `json:",omitempty"`
+	Quota    *uint64 `json:",omitempty"`
+	URI      string  `json:",omitempty"`
+}
+
 func init() {
 	flag.Parse()
-	if *fpath == `` {
-		log.Fatal("passfile path is required")
+	if *fpath == `` && *fsrv == `` {
+		log.Fatal("passfile path or server is required")
+	} else if *fpath != `` && *fsrv != `` {
+		log.Fatal("passfile and server are mutually exclusive")
+	} else if *fsrv != `` && *flog == `` && *ftok == `` {
+		log.Fatal("login or token is required with server")
 	} else if err := checkAction(*fact); err != nil {
 		log.Fatalf("action %s is invalid: %v\n", *fact, err)
 	}
 }
 
 func main() {
-	am, err := auth.NewAuthModule(*fpath)
-	if err != nil {
+	var us userStore
+	var err error
+	if *fsrv != `` {
+		if us, err = newRemoteStore(*fsrv, *flog, *flpwd, *ftotp, *ftok, *fssl); err != nil {
+			log.Fatalf("Failed to log in to %s: %v\n", *fsrv, err)
+		}
+	} else if us, err = newLocalStore(*fpath); err != nil {
 		log.Fatalf("Failed to initialize auth module: %v\n", err)
 	}
 	switch *fact {
 	case `list`:
-		listUsers(am)
+		listUsers(us)
+	case `show`:
+		showUser(us, uint64(*fuid))
 	case `useradd`:
-		addUser(am, uint64(*fuid))
+		addUser(us, uint64(*fuid))
 	case `userdel`:
-		delUser(am, uint64(*fuid))
+		delUser(us, uint64(*fuid))
+	case `usermod`:
+		modUser(us, uint64(*fuid))
 	case `passwd`:
-		chpasswd(am, uint64(*fuid))
+		chpasswd(us, uint64(*fuid))
+	case `lock`:
+		setDisabled(us, uint64(*fuid), true)
+	case `unlock`:
+		setDisabled(us, uint64(*fuid), false)
+	case `settotp`:
+		setTOTP(us, uint64(*fuid))
+	case `cleartotp`:
+		clearTOTP(us, uint64(*fuid))
+	case `setindexers`:
+		setIndexers(us, uint64(*fuid))
+	case `setrole`:
+		setRole(us, uint64(*fuid))
+	case `setquota`:
+		setQuota(us, uint64(*fuid))
+	case `getquota`:
+		getQuota(us, uint64(*fuid))
+	case `import`:
+		importUsers(us, *ffile)
 	}
 }
 
-func listUsers(am *auth.Auth) {
-	uhs, err := am.List()
+func listUsers(us userStore) {
+	uis, err := us.ListUsers()
 	if err != nil {
 		log.Fatalf("Failed to get user list: %v\n", err)
-	} else if len(uhs) == 0 {
+	}
+	if *fjson {
+		emitJSON(uis)
+		return
+	} else if len(uis) == 0 {
 		fmt.Println("No users")
 		return
 	}
-	for _, uh := range uhs {
-		fmt.Println(uh.ID())
+	for _, ui := range uis {
+		fmt.Printf("%d", ui.ID)
+		if ui.Disabled {
+			fmt.Printf("\tdisabled")
+		}
+		if ui.TOTP {
+			fmt.Printf("\ttotp")
+		}
+		if ui.Role != auth.RoleFull {
+			fmt.Printf("\t%s", ui.Role)
+		}
+		if !ui.Created.IsZero() {
+			fmt.Printf("\tcreated=%s", ui.Created.Format(time.RFC3339))
+		}
+		if ui.Email != `` {
+			fmt.Printf("\temail=%s", ui.Email)
+		}
+		if ui.Description != `` {
+			fmt.Printf("\tdescription=%q", ui.Description)
+		}
+		if ui.Quota > 0 {
+			fmt.Printf("\tquota=%s", util.FormatSize(ui.Quota))
+		}
+		if len(ui.Indexers) > 0 {
+			ids := make([]string, 0, len(ui.Indexers))
+			for _, guid := range ui.Indexers {
+				ids = append(ids, guid.String())
+			}
+			fmt.Printf("\tindexers=%s", strings.Join(ids, ","))
+		}
+		fmt.Println()
 	}
 }
 
-func delUser(am *auth.Auth, id uint64) {
-	if err := am.DeleteUser(id); err != nil {
+func showUser(us userStore, id uint64) {
+	ui, err := us.GetUser(id)
+	if err != nil {
+		log.Fatalf("Failed to get id %d: %v\n", id, err)
+	}
+	if *fjson {
+		emitJSON(ui)
+		return
+	}
+	fmt.Printf("ID:          %d\n", ui.ID)
+	fmt.Printf("Hash:        %s\n", ui.HashAlgorithm)
+	if ui.HashCost < passCost {
+		fmt.Printf("Cost:        %d (below recommended %d)\n", ui.HashCost, passCost)
+	} else {
+		fmt.Printf("Cost:        %d\n", ui.HashCost)
+	}
+	fmt.Printf("Role:        %s\n", ui.Role)
+	fmt.Printf("Disabled:    %v\n", ui.Disabled)
+	fmt.Printf("TOTP:        %v\n", ui.TOTP)
+	if ui.Quota == 0 {
+		fmt.Printf("Quota:       unlimited\n")
+	} else {
+		fmt.Printf("Quota:       %s\n", util.FormatSize(ui.Quota))
+	}
+	if len(ui.Indexers) == 0 {
+		fmt.Printf("Indexers:    any\n")
+	} else {
+		for i, guid := range ui.Indexers {
+			if i == 0 {
+				fmt.Printf("Indexers:    %s\n", guid)
+			} else {
+				fmt.Printf("             %s\n", guid)
+			}
+		}
+	}
+	if !ui.Created.IsZero() {
+		fmt.Printf("Created:     %s\n", ui.Created.Format(time.RFC3339))
+	}
+	if ui.Email != `` {
+		fmt.Printf("Email:       %s\n", ui.Email)
+	}
+	if ui.Description != `` {
+		fmt.Printf("Description: %s\n", ui.Description)
+	}
+}
+
+// report emits the outcome of an action, either as JSON or as the formatted message
+func report(r result, format string, args ...interface{}) {
+	r.Action = *fact
+	if *fjson {
+		emitJSON(r)
+	} else {
+		fmt.Printf(format, args...)
+	}
+}
+
+func emitJSON(obj interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent(``, `  `)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		log.Fatalf("Failed to encode output: %v\n", err)
+	}
+}
+
+func delUser(us userStore, id uint64) {
+	if err := us.DeleteUser(id); err != nil {
 		log.Fatalf("Failed to delete id %d: %v\n", id, err)
 	}
-	fmt.Printf("ID %d deleted\n", id)
+	report(result{ID: id}, "ID %d deleted\n", id)
 }
 
-func addUser(am *auth.Auth, id uint64) {
+func addUser(us userStore, id uint64) {
 	var err error
 	pass := []byte(*fpwd)
-	if len(pass) == 0 {
-		fmt.Printf("Enter %d passphrase: ", id)
+	if *fgen {
+		var gen string
+		if gen, err = auth.GeneratePassword(auth.DefaultPasswordLength); err != nil {
+			log.Fatalf("Failed to generate passphrase: %v\n", err)
+		}
+		pass = []byte(gen)
+	} else if len(pass) == 0 {
+		fmt.Fprintf(os.Stderr, "Enter %d passphrase: ", id)
 		if pass, err = gopass.GetPasswd(); err != nil {
 			log.Fatalf("Failed to get passphrase for %d\n", id)
 		}
 	}
-	if err = am.AddUser(id, string(pass), passCost); err != nil {
+	md := auth.Metadata{
+		Description: *fdesc,
+		Email:       *fmail,
+	}
+	if err = us.AddUserWithMetadata(id, string(pass), passCost, md); err != nil {
 		log.Fatalf("Failed to add id %d: %v\n", id, err)
 	}
-	fmt.Printf("ID %d added\n", id)
+	if *fgen {
+		//this is the only time the generated passphrase is ever shown
+		report(result{ID: id, Password: string(pass)}, "ID %d added\nPassphrase: %s\n", id, pass)
+	} else {
+		report(result{ID: id}, "ID %d added\n", id)
+	}
+}
+
+// modUser changes only the metadata given on the command line, an empty value
+// such as -email "" clears the field while an omitted flag leaves it alone
+func modUser(us userStore, id uint64) {
+	ui, err := us.GetUser(id)
+	if err != nil {
+		log.Fatalf("Failed to get id %d: %v\n", id, err)
+	}
+	md := ui.Metadata
+	var changed bool
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case `description`:
+			md.Description, changed = *fdesc, true
+		case `email`:
+			md.Email, changed = *fmail, true
+		}
+	})
+	if !changed {
+		report(result{ID: id}, "ID %d unchanged, give -description or -email\n", id)
+		return
+	}
+	if err = us.SetMetadata(id, md); err != nil {
+		log.Fatalf("Failed to update id %d: %v\n", id, err)
+	}
+	report(result{ID: id}, "ID %d updated\n", id)
+}
+
+func setDisabled(us userStore, id uint64, disabled bool) {
+	state := `unlocked`
+	if disabled {
+		state = `locked`
+	}
+	current, err := us.UserDisabled(id)
+	if err != nil {
+		log.Fatalf("Failed to get status for id %d: %v\n", id, err)
+	} else if current == disabled {
+		report(result{ID: id}, "ID %d already %s\n", id, state)
+		return
+	}
+	if err = us.SetDisabled(id, disabled); err != nil {
+		log.Fatalf("Failed to update id %d: %v\n", id, err)
+	}
+	report(result{ID: id}, "ID %d %s\n", id, state)
+}
+
+func setTOTP(us userStore, id uint64) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		log.Fatalf("Failed to generate TOTP secret: %v\n", err)
+	}
+	if err = us.SetTOTPSecret(id, secret); err != nil {
+		log.Fatalf("Failed to set TOTP secret for id %d: %v\n", id, err)
+	}
+	uri := auth.TOTPURI(id, secret)
+	report(result{ID: id, Secret: secret, URI: uri}, "ID %d TOTP enabled\nSecret: %s\nURI:    %s\n", id, secret, uri)
+}
+
+func clearTOTP(us userStore, id uint64) {
+	if err := us.SetTOTPSecret(id, ``); err != nil {
+		log.Fatalf("Failed to clear TOTP secret for id %d: %v\n", id, err)
+	}
+	report(result{ID: id}, "ID %d TOTP disabled\n", id)
+}
+
+func setIndexers(us userStore, id uint64) {
+	var idxs []uuid.UUID
+	for _, v := range strings.Split(*fidxs, ",") {
+		if v = strings.TrimSpace(v); v == `` {
+			continue
+		}
+		guid, err := uuid.Parse(v)
+		if err != nil {
+			log.Fatalf("Invalid indexer UUID %q: %v\n", v, err)
+		}
+		idxs = append(idxs, guid)
+	}
+	if err := us.SetIndexers(id, idxs); err != nil {
+		log.Fatalf("Failed to set indexers for id %d: %v\n", id, err)
+	}
+	if len(idxs) == 0 {
+		report(result{ID: id}, "ID %d may use any indexer\n", id)
+	} else {
+		report(result{ID: id}, "ID %d restricted to %d indexers\n", id, len(idxs))
+	}
+}
+
+func setRole(us userStore, id uint64) {
+	if err := us.SetRole(id, *frole); err != nil {
+		log.Fatalf("Failed to set role for id %d: %v\n", id, err)
+	}
+	report(result{ID: id}, "ID %d role set to %s\n", id, *frole)
 }
 
-func chpasswd(am *auth.Auth, id uint64) {
-	fmt.Printf("Enter %d passphrase: ", id)
+func setQuota(us userStore, id uint64) {
+	quota, err := util.ParseSize(*fquot)
+	if err != nil {
+		log.Fatalf("Invalid quota %q: %v\n", *fquot, err)
+	}
+	if err = us.SetQuota(id, quota); err != nil {
+		log.Fatalf("Failed to set quota for id %d: %v\n", id, err)
+	}
+	if quota == 0 {
+		report(result{ID: id, Quota: &quota}, "ID %d quota removed\n", id)
+	} else {
+		report(result{ID: id, Quota: &quota}, "ID %d quota set to %s\n", id, util.FormatSize(quota))
+	}
+}
+
+func getQuota(us userStore, id uint64) {
+	quota, err := us.UserQuota(id)
+	if err != nil {
+		log.Fatalf("Failed to get quota for id %d: %v\n", id, err)
+	}
+	if quota == 0 {
+		report(result{ID: id, Quota: &quota}, "ID %d quota unlimited\n", id)
+	} else {
+		report(result{ID: id, Quota: &quota}, "ID %d quota %s\n", id, util.FormatSize(quota))
+	}
+}
+
+func chpasswd(us userStore, id uint64) {
+	fmt.Fprintf(os.Stderr, "Enter %d passphrase: ", id)
 	pass, err := gopass.GetPasswd()
 	if err != nil {
 		log.Fatalf("Failed to get passphrase for %d\n", id)
 	}
-	if err = am.ChangePassword(id, string(pass)); err != nil {
+	if err = us.ChangePassword(id, string(pass)); err != nil {
 		log.Fatalf("Failed to change passphrase for id %d: %v\n", id, err)
 	}
-	fmt.Printf("ID %d passphrase changed\n", id)
+	report(result{ID: id}, "ID %d passphrase changed\n", id)
 }
 
 func checkAction(act string) (err error) {
 	switch act {
 	case `list`:
+	case `import`:
+		if *ffile == `` {
+			err = fmt.Errorf("Action %s requires a file", act)
+		}
 	case `useradd`:
+		if *fgen && *fpwd != `` {
+			err = fmt.Errorf("Action %s cannot use both -password and -genpass", act)
+			return
+		}
+		fallthrough
+	case `show`:
 		fallthrough
 	case `userdel`:
 		fallthrough
+	case `usermod`:
+		fallthrough
+	case `lock`:
+		fallthrough
+	case `unlock`:
+		fallthrough
+	case `settotp`:
+		fallthrough
+	case `cleartotp`:
+		fallthrough
+	case `setindexers`:
+		fallthrough
+	case `setrole`:
+		fallthrough
+	case `setquota`:
+		fallthrough
+	case `getquota`:
+		fallthrough
 	case `passwd`:
 		if *fuid == 0 {
 			err = fmt.Errorf("Action %s requires a user id", act)
@@ -0,0 +1,144 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gravwell/cloudarchive/pkg/auth"
+	"github.com/gravwell/cloudarchive/pkg/client"
+	"github.com/gravwell/cloudarchive/pkg/webserver"
+
+	"github.com/google/uuid"
+	"github.com/howeyc/gopass"
+)
+
+var (
+	//the server generates a password when given none, we never want that silently
+	ErrEmptyPassword = errors.New("empty password")
+)
+
+// remoteStore manages users on a running archive server through its admin API, the
+// login must hold the admin role.  Every action the password file supports is available.
+type remoteStore struct {
+	cli *client.Client
+}
+
+// newRemoteStore logs in to the server, using the token if one was given and otherwise
+// prompting for the password if none was given
+func newRemoteStore(server, login, passwd, totp, token string, nossl bool) (rs *remoteStore, err error) {
+	var cli *client.Client
+	if cli, err = client.NewClient(server, false, !nossl); err != nil {
+		return
+	} else if err = cli.Test(); err != nil {
+		return
+	}
+	if token != `` {
+		if err = cli.LoginToken(token); err != nil {
+			return
+		}
+		rs = &remoteStore{cli: cli}
+		return
+	}
+	if passwd == `` {
+		var pass []byte
+		fmt.Fprintf(os.Stderr, "Enter %s passphrase: ", login)
+		if pass, err = gopass.GetPasswd(); err != nil {
+			return
+		}
+		passwd = string(pass)
+	}
+	if err = cli.LoginTOTP(login, passwd, totp); err != nil {
+		return
+	}
+	rs = &remoteStore{cli: cli}
+	return
+}
+
+func (rs *remoteStore) ListUsers() ([]auth.UserInfo, error) {
+	return rs.cli.AdminListUsers()
+}
+
+func (rs *remoteStore) GetUser(id uint64) (auth.UserInfo, error) {
+	return rs.cli.AdminGetUser(id)
+}
+
+// AddUserWithMetadata adds the user, the server hashes the password at its own cost
+func (rs *remoteStore) AddUserWithMetadata(id uint64, passwd string, cost int, md auth.Metadata) (err error) {
+	if passwd == `` {
+		return ErrEmptyPassword
+	}
+	_, err = rs.cli.AdminAddUser(id, passwd, md)
+	return
+}
+
+// ImportUsers sends the whole batch at once so the server adds all of the users or none,
+// passwords are hashed at the server's own cost
+func (rs *remoteStore) ImportUsers(ius []auth.ImportUser, cost int) error {
+	return rs.cli.AdminImportUsers(ius)
+}
+
+func (rs *remoteStore) DeleteUser(id uint64) error {
+	return rs.cli.AdminDeleteUser(id)
+}
+
+func (rs *remoteStore) ChangePassword(id uint64, passwd string) (err error) {
+	if passwd == `` {
+		return ErrEmptyPassword
+	}
+	_, err = rs.cli.AdminResetPassword(id, passwd)
+	return
+}
+
+func (rs *remoteStore) UserDisabled(id uint64) (disabled bool, err error) {
+	var ui auth.UserInfo
+	if ui, err = rs.cli.AdminGetUser(id); err == nil {
+		disabled = ui.Disabled
+	}
+	return
+}
+
+func (rs *remoteStore) UserQuota(id uint64) (quota uint64, err error) {
+	var ui auth.UserInfo
+	if ui, err = rs.cli.AdminGetUser(id); err == nil {
+		quota = ui.Quota
+	}
+	return
+}
+
+func (rs *remoteStore) update(id uint64, upd webserver.AdminUserUpdate) (err error) {
+	_, err = rs.cli.AdminUpdateUser(id, upd)
+	return
+}
+
+func (rs *remoteStore) SetMetadata(id uint64, md auth.Metadata) error {
+	return rs.update(id, webserver.AdminUserUpdate{Description: &md.Description, Email: &md.Email})
+}
+
+func (rs *remoteStore) SetDisabled(id uint64, disabled bool) error {
+	return rs.update(id, webserver.AdminUserUpdate{Disabled: &disabled})
+}
+
+func (rs *remoteStore) SetTOTPSecret(id uint64, secret string) error {
+	return rs.update(id, webserver.AdminUserUpdate{TOTPSecret: &secret})
+}
+
+func (rs *remoteStore) SetIndexers(id uint64, indexers []uuid.UUID) error {
+	return rs.update(id, webserver.AdminUserUpdate{Indexers: &indexers})
+}
+
+func (rs *remoteStore) SetRole(id uint64, role string) error {
+	return rs.update(id, webserver.AdminUserUpdate{Role: &role})
+}
+
+func (rs *remoteStore) SetQuota(id uint64, quota uint64) error {
+	return rs.update(id, webserver.AdminUserUpdate{Quota: &quota})
+}
@@ -0,0 +1,47 @@
+/*************************************************************************
+ * Copyright 2023 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"github.com/gravwell/cloudarchive/pkg/auth"
+
+	"github.com/google/uuid"
+)
+
+// userStore is the set of user management operations the actions are built on,
+// it is satisfied by the local password file and by a remote server's admin API
+type userStore interface {
+	ListUsers() ([]auth.UserInfo, error)
+	GetUser(id uint64) (auth.UserInfo, error)
+	AddUserWithMetadata(id uint64, passwd string, cost int, md auth.Metadata) error
+	ImportUsers(ius []auth.ImportUser, cost int) error
+	DeleteUser(id uint64) error
+	ChangePassword(id uint64, passwd string) error
+	SetMetadata(id uint64, md auth.Metadata) error
+	SetDisabled(id uint64, disabled bool) error
+	UserDisabled(id uint64) (bool, error)
+	SetTOTPSecret(id uint64, secret string) error
+	SetIndexers(id uint64, indexers []uuid.UUID) error
+	SetRole(id uint64, role string) error
+	SetQuota(id uint64, quota uint64) error
+	UserQuota(id uint64) (uint64, error)
+}
+
+// localStore operates directly on a password file
+type localStore struct {
+	*auth.Auth
+}
+
+func newLocalStore(p string) (*localStore, error) {
+	am, err := auth.NewAuthModule(p)
+	if err != nil {
+		return nil, err
+	}
+	return &localStore{Auth: am}, nil
+}